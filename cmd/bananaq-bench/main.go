@@ -0,0 +1,480 @@
+// bananaq-bench generates load against the redis a bananaq deployment uses, and
+// reports the throughput and latency of each kind of command, so that redis can
+// be sized for the expected workload. It connects directly to redis using
+// peel, as bananaq servers do.
+//
+//	bananaq-bench [options]
+//
+// Run it with --help for the list of options.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/mediocregopher/lever"
+)
+
+// config describes the workload to generate
+type config struct {
+	duration    time.Duration
+	queues      int
+	groups      int
+	producers   int // per queue
+	consumers   int // per queue per consumer group
+	batch       int
+	payloadSize int
+	rate        float64 // events per second across all producers, 0 for no limit
+	ackRatio    float64
+	deadline    time.Duration
+	expire      time.Duration
+}
+
+func main() {
+	l := lever.New("bananaq-bench", &lever.Opts{
+		HelpHeader:         "Usage: bananaq-bench [options]\n\n",
+		DisallowConfigFile: true,
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-addr",
+		Description: "Address redis is listening on. May be a solo redis instance or a node in a cluster",
+		Default:     "127.0.0.1:6379",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-tls",
+		Description: "Connect to redis using TLS",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-username",
+		Description: "Username to authenticate to redis with. Requires --redis-password and redis 6 or later",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-password",
+		Description: "Password to authenticate to redis with",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-db",
+		Description: "Redis database to use. Must be 0 when using a cluster",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-prefix",
+		Description: "String all redis keys are prefixed with. Defaults to one which won't collide with a bananaq server's",
+		Default:     "bananaq-bench",
+	})
+	l.Add(lever.Param{
+		Name:        "--pool-size",
+		Description: "Number of connections to redis to keep open",
+		Default:     "20",
+	})
+	l.Add(lever.Param{
+		Name:        "--duration",
+		Description: "Number of seconds to generate load for",
+		Default:     "30",
+	})
+	l.Add(lever.Param{
+		Name:        "--queues",
+		Description: "Number of queues to spread the load across",
+		Default:     "1",
+	})
+	l.Add(lever.Param{
+		Name:        "--groups",
+		Description: "Number of consumer groups consuming each queue",
+		Default:     "1",
+	})
+	l.Add(lever.Param{
+		Name:        "--producers",
+		Description: "Number of producers adding events to each queue",
+		Default:     "4",
+	})
+	l.Add(lever.Param{
+		Name:        "--consumers",
+		Description: "Number of consumers in each consumer group of each queue",
+		Default:     "4",
+	})
+	l.Add(lever.Param{
+		Name:        "--batch",
+		Description: "Number of events each producer adds at once, using QADDMULTI if more than 1",
+		Default:     "1",
+	})
+	l.Add(lever.Param{
+		Name:        "--payload-size",
+		Description: "Size of each event's contents, in bytes",
+		Default:     "256",
+	})
+	l.Add(lever.Param{
+		Name:        "--rate",
+		Description: "Number of events per second to add, across all producers. 0 means as many as possible",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--ack-ratio",
+		Description: "Fraction of retrieved events which are acked, between 0 and 1. The rest are nacked, and so retrieved again",
+		Default:     "1",
+	})
+	l.Add(lever.Param{
+		Name:        "--deadline",
+		Description: "Number of seconds consumers have to ack each event",
+		Default:     "30",
+	})
+	l.Add(lever.Param{
+		Name:        "--keep",
+		Description: "Don't flush the queues once done, e.g. to inspect how much memory redis is using",
+		Flag:        true,
+	})
+	l.Parse()
+
+	redisAddr, _ := l.ParamStr("--redis-addr")
+	redisTLS := l.ParamFlag("--redis-tls")
+	redisUsername, _ := l.ParamStr("--redis-username")
+	redisPassword, _ := l.ParamStr("--redis-password")
+	redisDB, _ := l.ParamInt("--redis-db")
+	redisPrefix, _ := l.ParamStr("--redis-prefix")
+	poolSize, _ := l.ParamInt("--pool-size")
+	duration, _ := l.ParamInt("--duration")
+	queues, _ := l.ParamInt("--queues")
+	groups, _ := l.ParamInt("--groups")
+	producers, _ := l.ParamInt("--producers")
+	consumers, _ := l.ParamInt("--consumers")
+	batch, _ := l.ParamInt("--batch")
+	payloadSize, _ := l.ParamInt("--payload-size")
+	rateStr, _ := l.ParamStr("--rate")
+	ackRatioStr, _ := l.ParamStr("--ack-ratio")
+	deadline, _ := l.ParamInt("--deadline")
+	keep := l.ParamFlag("--keep")
+
+	cfg := config{
+		duration:    time.Duration(duration) * time.Second,
+		queues:      queues,
+		groups:      groups,
+		producers:   producers,
+		consumers:   consumers,
+		batch:       batch,
+		payloadSize: payloadSize,
+		deadline:    time.Duration(deadline) * time.Second,
+		expire:      time.Duration(duration)*time.Second + time.Hour,
+	}
+	var err error
+	if cfg.rate, err = strconv.ParseFloat(rateStr, 64); err != nil {
+		fatal(fmt.Errorf("invalid --rate: %s", err))
+	} else if cfg.ackRatio, err = strconv.ParseFloat(ackRatioStr, 64); err != nil {
+		fatal(fmt.Errorf("invalid --ack-ratio: %s", err))
+	} else if err := cfg.validate(); err != nil {
+		fatal(err)
+	}
+
+	dialOpts := core.DialOpts{
+		Username:    redisUsername,
+		Password:    redisPassword,
+		DB:          redisDB,
+		DialTimeout: 5 * time.Second,
+	}
+	if redisTLS {
+		dialOpts.TLSConfig = &tls.Config{}
+	}
+	cmder, err := core.Dial(redisAddr, poolSize, dialOpts)
+	if err != nil {
+		fatal(fmt.Errorf("could not connect to redis: %s", err))
+	}
+	p := peel.New(cmder, &peel.Opts{
+		Opts: core.Opts{
+			RedisPrefix: redisPrefix,
+			DialOpts:    dialOpts,
+		},
+		CleanPeriod: -1,
+		// Commands interrupted by the end of the benchmark would otherwise be
+		// logged as failures
+		Logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError})),
+	})
+	errCh := p.Run(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		select {
+		case <-sigCh:
+		case err := <-errCh:
+			fmt.Fprintf(os.Stderr, "error during peel runtime: %s\n", err)
+		}
+		cancel()
+	}()
+
+	queueNames := make([]string, cfg.queues)
+	for i := range queueNames {
+		queueNames[i] = fmt.Sprintf("bench-%s-%d", testutil.RandStr(), i)
+	}
+	s := bench(ctx, p, cfg, queueNames)
+	cfg.describe(os.Stdout)
+	s.report(os.Stdout)
+
+	if !keep {
+		for _, queue := range queueNames {
+			if err := p.QFlush(context.Background(), peel.QFlushCommand{Queue: queue}); err != nil {
+				fatal(fmt.Errorf("flushing %q: %s", queue, err))
+			}
+		}
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "bananaq-bench: %s\n", err)
+	os.Exit(1)
+}
+
+func (cfg config) validate() error {
+	switch {
+	case cfg.duration <= 0:
+		return errors.New("--duration must be positive")
+	case cfg.queues < 1 || cfg.groups < 1:
+		return errors.New("--queues and --groups must be at least 1")
+	case cfg.producers < 1 || cfg.consumers < 0:
+		return errors.New("--producers must be at least 1, and --consumers may not be negative")
+	case cfg.batch < 1:
+		return errors.New("--batch must be at least 1")
+	case cfg.payloadSize < 20:
+		// Contents start with the time they were added, for measuring the
+		// end to end latency
+		return errors.New("--payload-size must be at least 20")
+	case cfg.rate < 0:
+		return errors.New("--rate may not be negative")
+	case cfg.ackRatio < 0 || cfg.ackRatio > 1:
+		return errors.New("--ack-ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+func (cfg config) describe(out io.Writer) {
+	rate := "unlimited"
+	if cfg.rate > 0 {
+		rate = strconv.FormatFloat(cfg.rate, 'f', -1, 64) + "/s"
+	}
+	fmt.Fprintf(out,
+		"%v, %d queue(s) with %d producer(s) and %d consumer group(s) of %d consumer(s) each, %d byte payloads in batches of %d, rate %s, ack ratio %v\n\n",
+		cfg.duration, cfg.queues, cfg.producers, cfg.groups, cfg.consumers,
+		cfg.payloadSize, cfg.batch, rate, cfg.ackRatio,
+	)
+}
+
+// stats collects the latency of every command performed, by command
+type stats struct {
+	l       sync.Mutex
+	elapsed time.Duration
+	lats    map[string][]time.Duration
+	errs    map[string]int
+	lastErr map[string]error
+}
+
+// The rows of the report, in order. "e2e" is the time from starting to add an
+// event to it being retrieved by a consumer group.
+var statOps = []string{"add", "get", "ack", "nack", "e2e"}
+
+func newStats() *stats {
+	return &stats{
+		lats:    map[string][]time.Duration{},
+		errs:    map[string]int{},
+		lastErr: map[string]error{},
+	}
+}
+
+// record records a command taking d, and failing with err if it's not nil.
+// Commands interrupted by the end of the benchmark aren't recorded. n is the
+// number of events the command was for.
+func (s *stats) record(ctx context.Context, op string, d time.Duration, n int, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	if err != nil {
+		s.errs[op]++
+		s.lastErr[op] = err
+		return
+	}
+	for i := 0; i < n; i++ {
+		s.lats[op] = append(s.lats[op], d)
+	}
+}
+
+// returns the given percentile of the sorted durations, rounded to the
+// microsecond
+func percentile(dd []time.Duration, p float64) time.Duration {
+	if len(dd) == 0 {
+		return 0
+	}
+	return dd[int(p*float64(len(dd)-1))].Round(time.Microsecond)
+}
+
+// report writes a table of the throughput and latency percentiles of each kind
+// of command, followed by the last error of each kind which failed
+func (s *stats) report(out io.Writer) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "\tevents\tevents/s\terrors\tp50\tp90\tp99\tmax\t")
+	for _, op := range statOps {
+		dd := s.lats[op]
+		sort.Slice(dd, func(i, j int) bool { return dd[i] < dd[j] })
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%d\t%v\t%v\t%v\t%v\t\n",
+			op, len(dd), float64(len(dd))/s.elapsed.Seconds(), s.errs[op],
+			percentile(dd, 0.5), percentile(dd, 0.9), percentile(dd, 0.99), percentile(dd, 1),
+		)
+	}
+	tw.Flush()
+
+	for _, op := range statOps {
+		if err := s.lastErr[op]; err != nil {
+			fmt.Fprintf(out, "\nlast %s error: %s", op, err)
+		}
+	}
+	if len(s.lastErr) > 0 {
+		fmt.Fprintln(out)
+	}
+}
+
+// bench generates the load described by cfg against the given queues until
+// cfg.duration has passed or ctx is canceled, returning the stats of what was
+// done
+func bench(ctx context.Context, p *peel.Peel, cfg config, queues []string) *stats {
+	ctx, cancel := context.WithTimeout(ctx, cfg.duration)
+	defer cancel()
+	s := newStats()
+	start := time.Now()
+
+	// Each producer waits this long between batches, so that all of them
+	// together add cfg.rate events per second
+	var interval time.Duration
+	if cfg.rate > 0 {
+		producers := float64(len(queues) * cfg.producers)
+		interval = time.Duration(float64(time.Second) * float64(cfg.batch) * producers / cfg.rate)
+	}
+
+	var wg sync.WaitGroup
+	for _, queue := range queues {
+		for i := 0; i < cfg.producers; i++ {
+			wg.Add(1)
+			go func(queue string) {
+				defer wg.Done()
+				produce(ctx, p, cfg, queue, interval, s)
+			}(queue)
+		}
+		for g := 0; g < cfg.groups; g++ {
+			group := "group-" + strconv.Itoa(g)
+			for i := 0; i < cfg.consumers; i++ {
+				wg.Add(1)
+				go func(queue string, seed int64) {
+					defer wg.Done()
+					consume(ctx, p, cfg, queue, group, rand.New(rand.NewSource(seed)), s)
+				}(queue, rand.Int63())
+			}
+		}
+	}
+	wg.Wait()
+	s.elapsed = time.Since(start)
+	return s
+}
+
+// contents returns an event's contents, which start with the time it was added
+// at and are padded out to the payload size
+func contents(t time.Time, size int) string {
+	ts := strconv.FormatInt(t.UnixNano(), 10)
+	return ts + " " + strings.Repeat("x", size-len(ts)-1)
+}
+
+func produce(ctx context.Context, p *peel.Peel, cfg config, queue string, interval time.Duration, s *stats) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	cc := make([]peel.QAddCommand, cfg.batch)
+	for {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				return
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+
+		now := time.Now()
+		for i := range cc {
+			cc[i] = peel.QAddCommand{
+				Queue:    queue,
+				Expire:   now.Add(cfg.expire),
+				Contents: contents(now, cfg.payloadSize),
+			}
+		}
+		var err error
+		if len(cc) == 1 {
+			_, err = p.QAdd(ctx, cc[0])
+		} else {
+			_, err = p.QAddMulti(ctx, cc)
+		}
+		s.record(ctx, "add", time.Since(now), len(cc), err)
+	}
+}
+
+func consume(ctx context.Context, p *peel.Peel, cfg config, queue, group string, r *rand.Rand, s *stats) {
+	for ctx.Err() == nil {
+		start := time.Now()
+		e, err := p.QGet(ctx, peel.QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: group,
+			AckDeadline:   start.Add(cfg.deadline),
+			Block:         time.Second,
+		})
+		if err != nil || e.ID == (core.ID{}) {
+			s.record(ctx, "get", time.Since(start), 0, err)
+			continue
+		}
+		got := time.Now()
+		s.record(ctx, "get", got.Sub(start), 1, nil)
+		if ts, _, ok := strings.Cut(e.Contents, " "); ok {
+			if added, err := strconv.ParseInt(ts, 10, 64); err == nil {
+				s.record(ctx, "e2e", got.Sub(time.Unix(0, added)), 1, nil)
+			}
+		}
+
+		start = time.Now()
+		if r.Float64() < cfg.ackRatio {
+			_, err = p.QAck(ctx, peel.QAckCommand{
+				Queue:         queue,
+				ConsumerGroup: group,
+				EventID:       e.ID,
+				DeliveryToken: e.DeliveryToken,
+			})
+			s.record(ctx, "ack", time.Since(start), 1, err)
+		} else {
+			_, err = p.QNack(ctx, peel.QNackCommand{
+				Queue:         queue,
+				ConsumerGroup: group,
+				EventID:       e.ID,
+				DeliveryToken: e.DeliveryToken,
+			})
+			s.record(ctx, "nack", time.Since(start), 1, err)
+		}
+	}
+}
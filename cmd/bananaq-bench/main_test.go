@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBench(t *T) {
+	p := peel.NewWithBackend(core.NewMemBackend(), nil)
+	p.Run(nil)
+	cfg := config{
+		duration:    500 * time.Millisecond,
+		queues:      2,
+		groups:      2,
+		producers:   2,
+		consumers:   2,
+		batch:       3,
+		payloadSize: 100,
+		rate:        600,
+		ackRatio:    0.5,
+		deadline:    time.Minute,
+		expire:      time.Hour,
+	}
+	require.Nil(t, cfg.validate())
+
+	s := bench(context.Background(), p, cfg, []string{testutil.RandStr(), testutil.RandStr()})
+	assert.True(t, s.elapsed >= cfg.duration)
+	for _, op := range statOps {
+		assert.NotEmpty(t, s.lats[op], op)
+		assert.Zero(t, s.errs[op], op)
+	}
+	// Batches are only added as fast as the rate allows
+	assert.True(t, len(s.lats["add"]) <= 600, "added:%d", len(s.lats["add"]))
+	assert.True(t, len(s.lats["get"]) >= len(s.lats["ack"])+len(s.lats["nack"]))
+
+	buf := new(bytes.Buffer)
+	s.report(buf)
+	for _, op := range statOps {
+		assert.Contains(t, buf.String(), op)
+	}
+	assert.Contains(t, buf.String(), "p99")
+
+	cfg.payloadSize = 10
+	assert.NotNil(t, cfg.validate())
+}
+
+func TestPercentile(t *T) {
+	dd := make([]time.Duration, 101)
+	for i := range dd {
+		dd[i] = time.Duration(i)*time.Millisecond + 1
+	}
+	assert.Equal(t, 50*time.Millisecond, percentile(dd, 0.5))
+	assert.Equal(t, 99*time.Millisecond, percentile(dd, 0.99))
+	assert.Equal(t, 100*time.Millisecond, percentile(dd, 1))
+	assert.Equal(t, time.Duration(0), percentile(nil, 0.5))
+}
@@ -0,0 +1,447 @@
+// bananaq-cli is a command-line tool for producing, consuming and inspecting
+// bananaq queues. It connects directly to redis using peel, so doesn't need a
+// bananaq server to be running.
+//
+//	bananaq-cli [options] <command> [args...]
+//
+// Run it with --help for the list of options and commands.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/mediocregopher/bananaq/peel/streamimport"
+	"github.com/mediocregopher/lever"
+	"github.com/mediocregopher/radix.v2/util"
+)
+
+const usage = `Commands:
+  add <queue> <contents>         Add an event to the queue, printing its id
+  get <queue> <group>            Retrieve the next event for the consumer group,
+                                 printing its id and contents
+  ack <queue> <group> <id>       Acknowledge an event retrieved with --deadline
+  peek <queue> <group>           Print the next event for the consumer group
+                                 without retrieving it
+  status [queue...]              Print the status of all queues, or only the
+                                 given ones
+  list [queue]                   List all queues and their consumer groups
+  flush <queue> [group]          Remove all events from the queue, or only the
+                                 consumer group's state
+  tail <queue>                   Print events as they're added to the queue,
+                                 until interrupted
+  import-stream <stream> <queue> Add every entry of a Redis Stream to an empty
+                                 queue, keeping its consumer groups' state
+  export <queue>                 Write a snapshot of the queue, its events and
+                                 its consumer groups' state to stdout
+  import [queue]                 Recreate a queue from a snapshot read from
+                                 stdin, into the given queue if there is one
+  migrate <queue>                Move the queue to the redis at --migrate-to,
+                                 while it's still being used`
+
+// opts are the options which affect commands, as opposed to how to connect
+type opts struct {
+	expire       time.Duration
+	delay        time.Duration
+	deadline     time.Duration
+	block        time.Duration
+	field        string
+	drainTimeout time.Duration
+
+	// Used by import-stream to read the stream
+	redis util.Cmder
+
+	// Used by import to read the snapshot
+	in io.Reader
+}
+
+func main() {
+	l := lever.New("bananaq-cli", &lever.Opts{
+		HelpHeader:         "Usage: bananaq-cli [options] <command> [args...]\n\n" + usage + "\n",
+		DisallowConfigFile: true,
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-addr",
+		Description: "Address redis is listening on. May be a solo redis instance or a node in a cluster",
+		Default:     "127.0.0.1:6379",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-tls",
+		Description: "Connect to redis using TLS",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-username",
+		Description: "Username to authenticate to redis with. Requires --redis-password and redis 6 or later",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-password",
+		Description: "Password to authenticate to redis with",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-db",
+		Description: "Redis database to use. Must be 0 when using a cluster",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-prefix",
+		Description: "String all redis keys are prefixed with, as given to the bananaq server",
+		Default:     "bananaq",
+	})
+	l.Add(lever.Param{
+		Name:        "--encryption-key",
+		Description: "Hex encoded AES key which events' contents are encrypted with, as given to the bananaq server",
+	})
+	l.Add(lever.Param{
+		Name:        "--expire",
+		Description: "Number of seconds after which events added with add expire",
+		Default:     "3600",
+	})
+	l.Add(lever.Param{
+		Name:        "--delay",
+		Description: "Number of seconds before events added with add become visible to consumer groups",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--deadline",
+		Description: "Number of seconds events retrieved with get have to be acked in. 0 means they don't need to be",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--block",
+		Description: "Number of seconds get waits for an event, if none is available",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--migrate-to",
+		Description: "Address of the redis migrate moves queues to. The bananaq servers must be given it as --migrate-to-redis-addr",
+	})
+	l.Add(lever.Param{
+		Name:        "--drain-timeout",
+		Description: "Number of seconds migrate waits for events in progress to be acked before cutting the queue over anyway",
+		Default:     "60",
+	})
+	l.Add(lever.Param{
+		Name:        "--field",
+		Description: "Stream entry field import-stream uses as each event's contents. If not given all of the entry's fields are used, as a JSON object",
+	})
+	l.Parse()
+
+	redisAddr, _ := l.ParamStr("--redis-addr")
+	redisTLS := l.ParamFlag("--redis-tls")
+	redisUsername, _ := l.ParamStr("--redis-username")
+	redisPassword, _ := l.ParamStr("--redis-password")
+	redisDB, _ := l.ParamInt("--redis-db")
+	redisPrefix, _ := l.ParamStr("--redis-prefix")
+	encryptionKey, _ := l.ParamStr("--encryption-key")
+	expire, _ := l.ParamInt("--expire")
+	delay, _ := l.ParamInt("--delay")
+	deadline, _ := l.ParamInt("--deadline")
+	block, _ := l.ParamInt("--block")
+	field, _ := l.ParamStr("--field")
+	migrateTo, _ := l.ParamStr("--migrate-to")
+	drainTimeout, _ := l.ParamInt("--drain-timeout")
+
+	args := l.ParamRest()
+	if len(args) == 0 {
+		fatal(errors.New("no command given, see --help"))
+	}
+
+	dialOpts := core.DialOpts{
+		Username:    redisUsername,
+		Password:    redisPassword,
+		DB:          redisDB,
+		DialTimeout: 5 * time.Second,
+	}
+	if redisTLS {
+		dialOpts.TLSConfig = &tls.Config{}
+	}
+	cmder, err := core.Dial(redisAddr, 1, dialOpts)
+	if err != nil {
+		fatal(fmt.Errorf("could not connect to redis: %s", err))
+	}
+
+	peelOpts := &peel.Opts{
+		Opts: core.Opts{
+			RedisPrefix: redisPrefix,
+			DialOpts:    dialOpts,
+		},
+		// Cleaning is left to the servers
+		CleanPeriod: -1,
+	}
+	if encryptionKey != "" {
+		key, err := hex.DecodeString(encryptionKey)
+		if err != nil {
+			fatal(fmt.Errorf("could not decode --encryption-key: %s", err))
+		}
+		if peelOpts.Encrypter, err = peel.NewAESGCMEncrypter(key); err != nil {
+			fatal(fmt.Errorf("invalid --encryption-key: %s", err))
+		}
+	}
+	if migrateTo != "" {
+		targetCmder, err := core.Dial(migrateTo, 1, dialOpts)
+		if err != nil {
+			fatal(fmt.Errorf("could not connect to --migrate-to redis: %s", err))
+		}
+		targetOpts := *peelOpts
+		peelOpts.MigrationTarget = peel.New(targetCmder, &targetOpts)
+		peelOpts.MigrationTarget.Run(nil)
+	}
+	p := peel.New(cmder, peelOpts)
+	errCh := p.Run(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		select {
+		case <-sigCh:
+		case err := <-errCh:
+			fmt.Fprintf(os.Stderr, "error during peel runtime: %s\n", err)
+		}
+		cancel()
+	}()
+
+	o := opts{
+		expire:       time.Duration(expire) * time.Second,
+		delay:        time.Duration(delay) * time.Second,
+		deadline:     time.Duration(deadline) * time.Second,
+		block:        time.Duration(block) * time.Second,
+		field:        field,
+		drainTimeout: time.Duration(drainTimeout) * time.Second,
+		redis:        cmder,
+		in:           os.Stdin,
+	}
+	if err := run(ctx, p, os.Stdout, o, args); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "bananaq-cli: %s\n", err)
+	os.Exit(1)
+}
+
+// returns the time the given duration after now, or the zero time if it's zero
+func after(now time.Time, d time.Duration) time.Time {
+	if d == 0 {
+		return time.Time{}
+	}
+	return now.Add(d)
+}
+
+func printEvent(out io.Writer, e core.Event) {
+	fmt.Fprintf(out, "%s\t%s\n", e.ID, e.Contents)
+}
+
+// run performs the command given by args, writing its output to out
+func run(ctx context.Context, p *peel.Peel, out io.Writer, o opts, args []string) error {
+	cmd, args := args[0], args[1:]
+	minArgs := map[string]int{
+		"add":           2,
+		"get":           2,
+		"ack":           3,
+		"peek":          2,
+		"status":        0,
+		"list":          0,
+		"flush":         1,
+		"tail":          1,
+		"import-stream": 2,
+		"export":        1,
+		"import":        0,
+		"migrate":       1,
+	}
+	if n, ok := minArgs[cmd]; !ok {
+		return fmt.Errorf("unknown command %q, see --help", cmd)
+	} else if len(args) < n {
+		return fmt.Errorf("%s requires at least %d arguments", cmd, n)
+	}
+
+	now := time.Now()
+	switch cmd {
+	case "add":
+		id, err := p.QAdd(ctx, peel.QAddCommand{
+			Queue:        args[0],
+			Contents:     args[1],
+			Expire:       now.Add(o.expire),
+			VisibleAfter: after(now, o.delay),
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, id)
+
+	case "get":
+		e, err := p.QGet(ctx, peel.QGetCommand{
+			Queue:         args[0],
+			ConsumerGroup: args[1],
+			AckDeadline:   after(now, o.deadline),
+			BlockUntil:    after(now, o.block),
+		})
+		if err != nil {
+			return err
+		} else if (e != core.Event{}) {
+			printEvent(out, e)
+		}
+
+	case "ack":
+		id, err := core.IDFromString(args[2])
+		if err != nil {
+			return err
+		}
+		acked, err := p.QAck(ctx, peel.QAckCommand{
+			Queue:         args[0],
+			ConsumerGroup: args[1],
+			EventID:       id,
+		})
+		if err != nil {
+			return err
+		} else if !acked {
+			return errors.New("event's deadline had already passed")
+		}
+
+	case "peek":
+		e, err := p.QPeek(ctx, peel.QPeekCommand{
+			Queue:         args[0],
+			ConsumerGroup: args[1],
+		})
+		if err != nil {
+			return err
+		} else if (e != core.Event{}) {
+			printEvent(out, e)
+		}
+
+	case "status":
+		var qcg map[string][]string
+		if len(args) > 0 {
+			all, err := p.AllQueuesConsumerGroups(ctx)
+			if err != nil {
+				return err
+			}
+			qcg = map[string][]string{}
+			for _, queue := range args {
+				qcg[queue] = all[queue]
+			}
+		}
+		lines, err := p.QInfo(ctx, peel.QStatusCommand{QueuesConsumerGroups: qcg})
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fmt.Fprintln(out, line)
+		}
+
+	case "list":
+		var c peel.QListCommand
+		if len(args) > 0 {
+			c.Queue = args[0]
+		}
+		m, err := p.QList(ctx, c)
+		if err != nil {
+			return err
+		}
+		queues := make([]string, 0, len(m))
+		for queue := range m {
+			queues = append(queues, queue)
+		}
+		sort.Strings(queues)
+		for _, queue := range queues {
+			fmt.Fprintf(out, "%s\t%s\n", queue, strings.Join(m[queue], " "))
+		}
+
+	case "flush":
+		c := peel.QFlushCommand{Queue: args[0]}
+		if len(args) > 1 {
+			c.ConsumerGroup = args[1]
+		}
+		return p.QFlush(ctx, c)
+
+	case "tail":
+		return tail(ctx, p, out, args[0])
+
+	case "import-stream":
+		stats, err := streamimport.Importer{
+			Peel:   p,
+			Stream: streamimport.NewRedisStream(o.redis, args[0]),
+			Queue:  args[1],
+			TTL:    o.expire,
+			Field:  o.field,
+		}.Run(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "imported %d entries\n", stats.Entries)
+		groups := make([]string, 0, len(stats.Groups))
+		for group := range stats.Groups {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		for _, group := range groups {
+			gs := stats.Groups[group]
+			fmt.Fprintf(out, "%s\tdone:%d pending:%d available:%d\n", group, gs.Done, gs.Pending, gs.Available)
+		}
+
+	case "export":
+		return p.Export(ctx, args[0], out)
+
+	case "import":
+		var queue string
+		if len(args) > 0 {
+			queue = args[0]
+		}
+		return p.Import(ctx, queue, o.in)
+
+	case "migrate":
+		return p.Migrate(ctx, peel.MigrateCommand{
+			Queue:        args[0],
+			DrainTimeout: o.drainTimeout,
+		})
+	}
+	return nil
+}
+
+// tail prints events as they're added to the queue until ctx is canceled. It
+// does this using its own consumer group, which starts from the present and is
+// deleted again afterwards, so it doesn't affect any other consumers.
+func tail(ctx context.Context, p *peel.Peel, out io.Writer, queue string) error {
+	cgroup := "bananaq-cli-tail-" + testutil.RandStr()
+	err := p.QSeek(ctx, peel.QSeekCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		From:          time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	defer p.QGroupDel(context.Background(), peel.QGroupDelCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+
+	for {
+		e, err := p.QGet(ctx, peel.QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			Block:         30 * time.Second,
+		})
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			return err
+		} else if (e != core.Event{}) {
+			printEvent(out, e)
+		}
+	}
+}
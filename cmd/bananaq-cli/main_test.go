@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testCtx = context.Background()
+
+func newTestPeel() *peel.Peel {
+	p := peel.NewWithBackend(core.NewMemBackend(), nil)
+	errCh := p.Run(nil)
+	go func() { panic(<-errCh) }()
+	return p
+}
+
+func runOut(t *T, p *peel.Peel, o opts, args ...string) string {
+	buf := new(bytes.Buffer)
+	require.Nil(t, run(testCtx, p, buf, o, args))
+	return buf.String()
+}
+
+func TestRun(t *T) {
+	p := newTestPeel()
+	queue, group := testutil.RandStr(), testutil.RandStr()
+	o := opts{expire: time.Minute, deadline: time.Minute}
+
+	id := strings.TrimSpace(runOut(t, p, o, "add", queue, "foo"))
+	assert.Equal(t, id+"\tfoo\n", runOut(t, p, o, "peek", queue, group))
+	assert.Equal(t, id+"\tfoo\n", runOut(t, p, o, "get", queue, group))
+	assert.Equal(t, "", runOut(t, p, o, "get", queue, group))
+	assert.Equal(t, queue+"\t"+group+"\n", runOut(t, p, o, "list", queue))
+	assert.Contains(t, runOut(t, p, o, "status", queue), queue)
+	assert.Equal(t, "", runOut(t, p, o, "ack", queue, group, id))
+
+	// Acking a second time fails, since the event's no longer in progress
+	assert.NotNil(t, run(testCtx, p, new(bytes.Buffer), o, []string{"ack", queue, group, id}))
+
+	assert.Equal(t, "", runOut(t, p, o, "flush", queue))
+	assert.Equal(t, "", runOut(t, p, o, "list", queue))
+
+	assert.NotNil(t, run(testCtx, p, new(bytes.Buffer), o, []string{"add", queue}))
+	assert.NotNil(t, run(testCtx, p, new(bytes.Buffer), o, []string{"foo"}))
+}
+
+func TestTail(t *T) {
+	p := newTestPeel()
+	queue := testutil.RandStr()
+	o := opts{expire: time.Minute}
+
+	// Events added before tail starts aren't printed
+	runOut(t, p, o, "add", queue, "before")
+
+	ctx, cancel := context.WithCancel(testCtx)
+	buf := new(bytes.Buffer)
+	doneCh := make(chan error)
+	go func() { doneCh <- run(ctx, p, buf, o, []string{"tail", queue}) }()
+	time.Sleep(50 * time.Millisecond)
+
+	id := strings.TrimSpace(runOut(t, p, o, "add", queue, "after"))
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	require.Nil(t, <-doneCh)
+	assert.Equal(t, id+"\tafter\n", buf.String())
+
+	// tail's consumer group is cleaned up after it's done
+	assert.Equal(t, queue+"\t\n", runOut(t, p, o, "list", queue))
+}
+
+func TestImportStream(t *T) {
+	rpool, err := pool.New("tcp", "127.0.0.1:6379", 1)
+	require.Nil(t, err)
+	stream := "bananaq-cli-" + testutil.RandStr()
+	defer rpool.Cmd("DEL", stream)
+	for _, n := range []string{"1", "2"} {
+		require.Nil(t, rpool.Cmd("XADD", stream, "*", "n", n).Err)
+	}
+	require.Nil(t, rpool.Cmd("XGROUP", "CREATE", stream, "g", "0").Err)
+
+	p := newTestPeel()
+	queue := testutil.RandStr()
+	o := opts{expire: time.Minute, field: "n", redis: rpool}
+	assert.Equal(t, "imported 2 entries\ng\tdone:0 pending:0 available:2\n", runOut(t, p, o, "import-stream", stream, queue))
+	assert.Contains(t, runOut(t, p, o, "get", queue, "g"), "\t1\n")
+}
+
+func TestExportImport(t *T) {
+	p := newTestPeel()
+	queue, group := testutil.RandStr(), testutil.RandStr()
+	o := opts{expire: time.Minute}
+	runOut(t, p, o, "add", queue, "foo")
+	runOut(t, p, o, "add", queue, "bar")
+	runOut(t, p, o, "get", queue, group)
+
+	snapshot := runOut(t, p, o, "export", queue)
+	queue2 := testutil.RandStr()
+	o.in = strings.NewReader(snapshot)
+	assert.Equal(t, "", runOut(t, p, o, "import", queue2))
+	assert.Contains(t, runOut(t, p, o, "get", queue2, group), "\tbar\n")
+}
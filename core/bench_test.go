@@ -0,0 +1,93 @@
+package core
+
+import (
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// The number of events handled by each operation in the benchmarks, which is
+// about what a busy producer batches together when adding 50k events/sec
+const benchBatch = 100
+
+func benchEvents() []Event {
+	now := time.Now()
+	contents := strings.Repeat("x", 256)
+	ee := make([]Event, benchBatch)
+	for i := range ee {
+		ee[i] = Event{
+			ID:       ID{T: NewTS(now) + TS(i), Expire: NewTS(now.Add(time.Minute))},
+			Contents: contents,
+		}
+	}
+	return ee
+}
+
+func reportEventsPerSec(b *B) {
+	b.ReportMetric(float64(b.N*benchBatch)/b.Elapsed().Seconds(), "events/s")
+}
+
+func BenchmarkMarshalEvents(b *B) {
+	ee := benchEvents()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		withMarshaled(testCtx, func(bb [][]byte) {}, eventMarshalers(ee)...)
+	}
+	reportEventsPerSec(b)
+}
+
+func BenchmarkSetEvents(b *B) {
+	ee := benchEvents()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.Nil(b, testRedis.SetEvents(testCtx, ee, 0))
+	}
+	reportEventsPerSec(b)
+}
+
+func BenchmarkGetEvents(b *B) {
+	ee := benchEvents()
+	require.Nil(b, testRedis.SetEvents(testCtx, ee, 0))
+	ii := make([]ID, len(ee))
+	for i := range ee {
+		ii[i] = ee[i].ID
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := testRedis.GetEvents(testCtx, ii)
+		require.Nil(b, err)
+	}
+	reportEventsPerSec(b)
+}
+
+// Adds events to a Key the same way peel's QAdd does
+func BenchmarkQueryEvents(b *B) {
+	ee := benchEvents()
+	ii := make([]ID, len(ee))
+	for i := range ee {
+		ii[i] = ee[i].ID
+	}
+	k := randKey(testutil.RandStr())
+	qas := QueryActions{
+		KeyBase: k.Base,
+		QueryActions: []QueryAction{
+			{QuerySelector: &QuerySelector{Key: k, IDs: ii}},
+			{QueryAddTo: &QueryAddTo{Keys: []Key{k}}},
+		},
+		Now:    NewTS(time.Now()),
+		Events: ee,
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := testRedis.Query(testCtx, qas)
+		require.Nil(b, err)
+	}
+	reportEventsPerSec(b)
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells a Core (and a MemBackend) what the current time is, which
+// decides which events have expired, which are no longer delayed and which
+// have missed their ack deadline. Everything but tests should use SystemClock.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is the Clock used unless another is given, which always returns
+// the time according to the system
+var SystemClock Clock = systemClock{}
+
+// ManualClock is a Clock which only moves when told to, so that tests can
+// make events expire or miss their ack deadlines without sleeping. It's safe
+// to use from multiple goroutines.
+type ManualClock struct {
+	l sync.Mutex
+	t time.Time
+}
+
+// NewManualClock returns a ManualClock which starts at the given time
+func NewManualClock(t time.Time) *ManualClock {
+	return &ManualClock{t: t}
+}
+
+// Now implements the method for the Clock interface
+func (mc *ManualClock) Now() time.Time {
+	mc.l.Lock()
+	defer mc.l.Unlock()
+	return mc.t
+}
+
+// Set sets the ManualClock's time to t. It may be moved backwards, although
+// TSs handed out by MonoTS never are.
+func (mc *ManualClock) Set(t time.Time) {
+	mc.l.Lock()
+	defer mc.l.Unlock()
+	mc.t = t
+}
+
+// Advance moves the ManualClock's time forward by d
+func (mc *ManualClock) Advance(d time.Duration) {
+	mc.l.Lock()
+	defer mc.l.Unlock()
+	mc.t = mc.t.Add(d)
+}
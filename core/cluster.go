@@ -0,0 +1,151 @@
+package core
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/cluster"
+	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/mediocregopher/radix.v2/util"
+)
+
+// The maximum number of times luaEval will retry a script which was redirected
+const maxRedirects = 5
+
+// How long luaEval waits before retrying a script which got TRYAGAIN
+const tryAgainWait = 50 * time.Millisecond
+
+// returns the kind of redirect ("MOVED", "ASK" or "TRYAGAIN") the given
+// response is, along with the address being redirected to for MOVED and ASK.
+// An empty kind is returned if the response isn't a redirect.
+func redirect(r *redis.Resp) (string, string) {
+	if r.Err == nil || !r.IsType(redis.AppErr) {
+		return "", ""
+	}
+
+	parts := strings.Split(r.Err.Error(), " ")
+	switch {
+	case parts[0] == "TRYAGAIN":
+		return parts[0], ""
+	case (parts[0] == "MOVED" || parts[0] == "ASK") && len(parts) == 3:
+		return parts[0], parts[2]
+	}
+	return "", ""
+}
+
+// the hex encoded SHA1 of every script run by evalSHA, keyed by the script
+var scriptSHAs sync.Map
+
+// evalSHA is the same as util.LuaEval, except that each script's SHA1 is only
+// computed the first time it's run, rather than every time. query.lua is big
+// enough for that to matter.
+func evalSHA(cmder util.Cmder, script string, numKeys int, args []interface{}) *redis.Resp {
+	sum, ok := scriptSHAs.Load(script)
+	if !ok {
+		sumRaw := sha1.Sum([]byte(script))
+		sum, _ = scriptSHAs.LoadOrStore(script, hex.EncodeToString(sumRaw[:]))
+	}
+
+	eval := func(cc util.Cmder) *redis.Resp {
+		r := cc.Cmd("EVALSHA", sum, numKeys, args)
+		if r.Err != nil && strings.HasPrefix(r.Err.Error(), "NOSCRIPT") {
+			r = cc.Cmd("EVAL", script, numKeys, args)
+		}
+		return r
+	}
+
+	// As with util.LuaEval, a single connection is used for both commands,
+	// and against a cluster it's the one for the first key
+	switch cc := cmder.(type) {
+	case *cluster.Cluster:
+		key, _ := redis.KeyFromArgs(args...)
+		client, err := cc.GetForKey(key)
+		if err != nil {
+			return redis.NewResp(err)
+		}
+		defer cc.Put(client)
+		return eval(client)
+	case *pool.Pool:
+		client, err := cc.Get()
+		if err != nil {
+			return redis.NewResp(err)
+		}
+		defer cc.Put(client)
+		return eval(client)
+	case *Pool:
+		client, err := cc.Get()
+		if err != nil {
+			return redis.NewResp(err)
+		}
+		defer cc.Put(client)
+		return eval(client)
+	default:
+		return eval(cmder)
+	}
+}
+
+// luaEval is like util.LuaEval, but also handles the cluster redirecting the
+// script to a different node while slots are being migrated, which
+// util.LuaEval doesn't do. All keys given to the script must be in the same
+// slot.
+func (c *redisBackend) luaEval(script string, numKeys int, args ...interface{}) *redis.Resp {
+	r := evalSHA(c.c, script, numKeys, args)
+	cl, ok := c.inner.(*cluster.Cluster)
+	if !ok {
+		return r
+	}
+
+	for i := 0; i < maxRedirects; i++ {
+		kind, addr := redirect(r)
+		switch kind {
+		case "MOVED":
+			// The slot has moved for good, update our mapping so evalSHA
+			// picks the right node
+			if err := cl.Reset(); err != nil {
+				return redis.NewResp(err)
+			}
+			r = evalSHA(c.c, script, numKeys, args)
+		case "ASK":
+			r = askEval(cl, addr, script, numKeys, args)
+		case "TRYAGAIN":
+			// Some of the keys have been migrated and others haven't
+			time.Sleep(tryAgainWait)
+			r = evalSHA(c.c, script, numKeys, args)
+		default:
+			return r
+		}
+	}
+	return r
+}
+
+// performs the script on the node at addr, which the slot is being migrated to.
+// The cluster doesn't provide a way to get a connection to a specific node, so
+// one is taken for every node and all but the one at addr are put right back.
+func askEval(cl *cluster.Cluster, addr, script string, numKeys int, args []interface{}) *redis.Resp {
+	conns, err := cl.GetEvery()
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	for _, conn := range conns {
+		defer cl.Put(conn)
+	}
+
+	conn, ok := conns[addr]
+	if !ok {
+		// The node isn't known yet, the next attempt will get MOVED or ASK
+		// again and hopefully succeed after the Reset
+		if err := cl.Reset(); err != nil {
+			return redis.NewResp(err)
+		}
+		return evalSHA(cl, script, numKeys, args)
+	}
+
+	if r := conn.Cmd("ASKING"); r.Err != nil {
+		return r
+	}
+	return conn.Cmd("EVAL", script, numKeys, args)
+}
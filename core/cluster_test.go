@@ -0,0 +1,23 @@
+package core
+
+import (
+	"errors"
+	. "testing"
+
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirect(t *T) {
+	assertRedirect := func(r *redis.Resp, expKind, expAddr string) {
+		kind, addr := redirect(r)
+		assert.Equal(t, expKind, kind)
+		assert.Equal(t, expAddr, addr)
+	}
+
+	assertRedirect(redis.NewResp("OK"), "", "")
+	assertRedirect(redis.NewResp(errors.New("WRONGTYPE nope")), "", "")
+	assertRedirect(redis.NewResp(errors.New("MOVED 3999 127.0.0.1:6381")), "MOVED", "127.0.0.1:6381")
+	assertRedirect(redis.NewResp(errors.New("ASK 3999 127.0.0.1:6381")), "ASK", "127.0.0.1:6381")
+	assertRedirect(redis.NewResp(errors.New("TRYAGAIN Multiple keys request during rehashing of slot")), "TRYAGAIN", "")
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"encoding/json"
+)
+
+// Match returns whether the given Contents match the ContentsFilter, as
+// QueryContentsFilter decides it. Contents which aren't a JSON object never
+// match.
+func (cf ContentsFilter) Match(contents string) bool {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(contents), &obj); err != nil || obj == nil {
+		return false
+	}
+	for _, cond := range cf.Conditions {
+		// A missing field is left as nil, i.e. null
+		var v interface{} = obj
+		for _, key := range cond.Path {
+			m, _ := v.(map[string]interface{})
+			v = m[key]
+		}
+		if !cond.match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// v is a value decoded from JSON, so it's a string, float64, bool, nil, or a
+// map or slice
+func (cond ContentsCondition) match(v interface{}) bool {
+	switch cond.Op {
+	case "==":
+		return v == cond.Value
+	case "!=":
+		return v != cond.Value
+	}
+
+	var cmp int
+	switch v := v.(type) {
+	case float64:
+		want, ok := cond.Value.(float64)
+		if !ok {
+			return false
+		} else if v < want {
+			cmp = -1
+		} else if v > want {
+			cmp = 1
+		}
+	case string:
+		want, ok := cond.Value.(string)
+		if !ok {
+			return false
+		} else if v < want {
+			cmp = -1
+		} else if v > want {
+			cmp = 1
+		}
+	default:
+		return false
+	}
+
+	switch cond.Op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
@@ -1,84 +1,141 @@
-// Package core is responsible for actually communicating with redis and
-// providing an abstraction for the data stored in it
+// Package core is responsible for actually communicating with redis (or
+// whatever other Backend is being used) and providing an abstraction for the
+// data stored in it
 //
 // This package is not stable! At present it is only intended to be used by
 // other components in bananaq
 package core
 
 //go:generate msgp -io=false
-//go:generate varembed -pkg core -in query.lua -out query_lua.go -varname queryLua
+//msgp:ignore Opts
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"math/rand"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/mediocregopher/radix.v2/cluster"
-	"github.com/mediocregopher/radix.v2/pool"
-	"github.com/mediocregopher/radix.v2/redis"
 	"github.com/mediocregopher/radix.v2/util"
-	"github.com/mediocregopher/wublub"
-	"github.com/tinylib/msgp/msgp"
 )
 
-var (
-	bpool = sync.Pool{
-		New: func() interface{} {
-			return make([]byte, 0, 10240)
-		},
-	}
-)
-
-// Cleverly marshal multiple things into a single byte buffer. All the []bytes
-// that get put in bb and passed to the callback are actually pointers into the
-// same buffer, which gets expanded and put back in the pool.
-func withMarshaled(fn func([][]byte), mm ...msgp.Marshaler) {
-	b := bpool.Get().([]byte)
-	bb := make([][]byte, len(mm))
-	var err error
-	for i := range mm {
-		// at this point len(b) is always 0
-		b, err = mm[i].MarshalMsg(b)
-		if err != nil {
-			panic(err)
-		}
-		bb[i] = b
-		b = b[len(b):]
-	}
-	fn(bb)
-	bpool.Put(b[:0])
-}
-
 // Various errors this package may return
 var (
 	ErrNotFound = errors.New("not found")
+
+	// Returned by Query when a QueryContentsFilter is used against a cluster
+	ErrClusterContentsFilter = errors.New("contents can't be filtered against a cluster")
+
+	// Returned by Query when CrossBase is set against a cluster
+	ErrClusterCrossBase = errors.New("keys with different Bases can't be queried together against a cluster")
 )
 
-// Opts are extra configuration fields which may be set on Core
+// Opts are extra configuration fields which may be set on Core when using New
 type Opts struct {
 	// Default 10. Number of threads which may publish simultaneously.
 	NumPublishers int
 
-	// Default "bananaq". String to prefix all redis keys with
+	// Default "bananaq". String to prefix all redis keys and pubsub channels
+	// with. Multiple deployments, e.g. for different environments, can share
+	// the same redis without colliding by using different prefixes. May not
+	// contain '{' or '}', since they would interfere with the hash tags used
+	// to keep each queue's keys in one cluster slot.
 	RedisPrefix string
+
+	// Optional. How Run makes its pubsub connection to redis. This should be
+	// the same as what was used to make the Cmder passed into New, e.g. using
+	// Dial.
+	DialOpts DialOpts
+
+	// Optional. The address of the redis instance Run makes its pubsub
+	// connection to. Required if the Cmder passed into New (once unwrapped,
+	// see Wrapper) isn't a *Pool, *pool.Pool, *cluster.Cluster or *Sentinel,
+	// since otherwise there's no way of knowing where redis is.
+	PubSubAddr string
+
+	// Optional. If set it receives a Stat for every operation performed, see
+	// Hook.
+	Hook Hook
+
+	// Optional. If set every operation performed is traced using it, see
+	// Tracer.
+	Tracer Tracer
+
+	// Optional. If set operations which fail because of a transient error,
+	// e.g. a dropped connection or a failover, are retried according to it.
+	// Each attempt is reported to the Hook and Tracer separately. See
+	// RetryPolicy and WithRetryPolicy.
+	Retry *RetryPolicy
+
+	// Default SystemClock. What the Core, and any peel.Peel using it, consider
+	// the current time to be, see Clock. Redis still expires keys according to
+	// its own clock, so anything else is only useful in tests, e.g. for
+	// exercising what happens once events expire or miss their ack deadlines
+	// without sleeping until they do.
+	Clock Clock
+
+	// Optional, and only meant for tests. If set its Faults are injected into
+	// operations on redis, see FaultInjector. The Hook, Tracer and Retry all
+	// see the failures it causes as if they came from redis.
+	Faults *FaultInjector
+}
+
+// Backend is where Core actually stores its data. New uses one which stores
+// everything in redis, but NewWithBackend may be used with any other, e.g. the
+// one returned by NewMemBackend.
+//
+// Each method corresponds to the Core method of the same name, and must behave
+// as described there. Core does some work before calling into the Backend, so
+// a Backend can assume that MonoTSs is called with n of at least 1, that
+// SetEvents, GetEvents and HashGetIDs are called with at least one Event/ID,
+// and that Query is called with QueryActions.Now set.
+//
+// A Backend's Query must perform all of the QueryActions atomically, setting
+// any Events on them first, and the IDs returned by it may be nil if there are
+// none.
+type Backend interface {
+	Run(stopCh chan struct{}) chan error
+	MonoTSs(ctx context.Context, t TS, n int) ([]TS, error)
+	SetEvents(ctx context.Context, ee []Event, expireBuffer time.Duration) error
+	GetEvents(ctx context.Context, ii []ID) ([]Event, error)
+	Query(ctx context.Context, qas QueryActions) (QueryRes, error)
+	KeyScan(ctx context.Context, k Key) ([]Key, error)
+	HashGetIDs(ctx context.Context, k Key, ii []ID) ([]string, error)
+	HashSetAll(ctx context.Context, k Key, m map[string]string) error
+	HashGetAll(ctx context.Context, k Key) (map[string]string, error)
+	SetString(ctx context.Context, k Key, val string, ttl time.Duration) error
+	GetString(ctx context.Context, k Key) (string, error)
+	SetIDNX(ctx context.Context, k Key, id ID, ttl time.Duration) (ID, bool, error)
+	KeyWait(ctx context.Context, k Key) <-chan struct{}
+	KeyNotify(ctx context.Context, k Key)
+	KeySubscribe(ctx context.Context, k Key) <-chan Publication
 }
 
 // Core contains all the information needed to interact with the underlying
-// redis instances for bananaq. All methods on Core are thread-safe, except Run
-// which should only be run by a single goroutine at any time.
+// storage for bananaq, which is usually redis. All methods on Core are
+// thread-safe, except Run which should only be run by a single goroutine at
+// any time.
+//
+// Methods which communicate with redis take a context.Context. If it is
+// canceled or its deadline is reached before redis responds the method returns
+// the context's error, although the command may still be carried out.
 type Core struct {
-	w *wublub.Wublub
-	c util.Cmder
-	o Opts
+	b     Backend
+	clock Clock
+
+	// The innermost Cmder given to New, if any, used by Health
+	inner util.Cmder
 }
 
-// New initializes a new Core instance based on the given Cmder (which may be a
-// *pool.Pool or *cluster.Cluster) and extra options (which may be nil). Run
-// must be called in order to actually use the Core
+// New initializes a new Core instance based on the given Cmder and extra
+// options (which may be nil). Run must be called in order to actually use the
+// Core.
+//
+// The Cmder will usually be a *Pool, *pool.Pool, *cluster.Cluster or *Sentinel, but
+// may be any util.Cmder which is safe to use from multiple goroutines, e.g. a
+// pool shared with the rest of the application, or one wrapped to add tracing
+// (see Wrapper). For any other kind of Cmder Opts.PubSubAddr must be set.
 func New(cmder util.Cmder, o *Opts) *Core {
 	if o == nil {
 		o = &Opts{}
@@ -89,12 +146,58 @@ func New(cmder util.Cmder, o *Opts) *Core {
 	if o.RedisPrefix == "" {
 		o.RedisPrefix = "bananaq"
 	}
+	if o.Clock == nil {
+		o.Clock = SystemClock
+	}
+
+	var b Backend = newRedisBackend(cmder, *o)
+	if o.Faults != nil {
+		b = WithFaults(b, o.Faults)
+	}
+	if o.Hook != nil || o.Tracer != nil {
+		b = instrumentedBackend{Backend: b, h: o.Hook, t: o.Tracer}
+	}
+	if o.Retry != nil {
+		b = WithRetry(b, o.Retry)
+	}
+	c := NewWithBackendClock(b, o.Clock)
+	c.inner = unwrap(cmder)
+	return c
+}
+
+// NewWithBackend initializes a new Core instance which stores its data in the
+// given Backend. Run must be called in order to actually use the Core.
+func NewWithBackend(b Backend) *Core {
+	return NewWithBackendClock(b, SystemClock)
+}
 
-	return &Core{
-		w: wublub.New(nil),
-		c: cmder,
-		o: *o,
+// NewWithBackendClock is like NewWithBackend, but the Core considers the
+// current time to be whatever the given Clock says it is. Only a Backend which
+// uses the same Clock, like one returned by NewMemBackendWithClock, makes
+// sense with anything other than SystemClock, since redis expires keys
+// according to its own clock.
+func NewWithBackendClock(b Backend, clock Clock) *Core {
+	return &Core{b: b, clock: clock}
+}
+
+// NewMem initializes a new Core instance which keeps everything in memory (see
+// MemBackend), and which considers the current time to be whatever the given
+// Clock (e.g. a ManualClock) says it is. A nil Clock means SystemClock. Run
+// must be called in order to actually use the Core.
+//
+// It's meant for tests of applications using bananaq, which then don't need
+// redis, and can make events expire or miss their ack deadlines by moving the
+// Clock rather than sleeping.
+func NewMem(clock Clock) *Core {
+	if clock == nil {
+		clock = SystemClock
 	}
+	return NewWithBackendClock(NewMemBackendWithClock(clock), clock)
+}
+
+// Now returns the current time according to the Core's Clock
+func (c *Core) Now() time.Time {
+	return c.clock.Now()
 }
 
 // Run performs all the background work needed to support Core. It spawns a
@@ -108,24 +211,7 @@ func New(cmder util.Cmder, o *Opts) *Core {
 // stopCh is optional and may be used to prematurely stop execution of Run. nil
 // will be written to the returned channel in this case.
 func (c *Core) Run(stopCh chan struct{}) chan error {
-	wErrCh := make(chan error, 1)
-	var addr string
-	if cl, ok := c.c.(*cluster.Cluster); ok {
-		rand := rand.New(rand.NewSource(time.Now().UnixNano()))
-		addr = cl.GetAddrForKey(strconv.Itoa(rand.Int()))
-	} else {
-		cp := c.c.(*pool.Pool)
-		conn, err := cp.Get()
-		if err != nil {
-			wErrCh <- err
-			return wErrCh
-		}
-		addr = conn.Addr
-		cp.Put(conn)
-	}
-
-	go func() { wErrCh <- c.w.Run("tcp", addr, stopCh) }()
-	return wErrCh
+	return c.b.Run(stopCh)
 }
 
 // TS identifies a single point in time as an integer number of microseconds
@@ -156,43 +242,21 @@ func (ts TS) String() string {
 // returns are monotonically increasing across the entire cluster. Consequently,
 // the TS returned might differ in the time it represents from the given TS by a
 // very small amount (or a big amount, if the given time is way in the past).
-func (c Core) MonoTS(t TS) (TS, error) {
-	lua := `
-		local key = KEYS[1]
-		local now_raw = ARGV[1]
-		local now = cmsgpack.unpack(now_raw)
-		local last_raw = redis.call("GET", key)
-
-		if not last_raw then
-			redis.call("SET", key, now_raw)
-			return now_raw
-		end
-
-		local last = cmsgpack.unpack(last_raw)
-		if last < now then
-			redis.call("SET", key, now_raw)
-			return now_raw
-		end
-
-		-- Add a microsecond and use that
-		last = last + 1
-		last_raw = cmsgpack.pack(last)
-		redis.call("SET", key, last_raw)
-		return last_raw
-	`
-
-	idKey := c.o.RedisPrefix + ":monots"
-
-	var ib []byte
-	var err error
-	withMarshaled(func(bb [][]byte) {
-		nowb := bb[0]
-		ib, err = util.LuaEval(c.c, lua, 1, idKey, nowb).Bytes()
-	}, t)
-
-	var t2 TS
-	_, err = t2.UnmarshalMsg(ib)
-	return t2, err
+func (c Core) MonoTS(ctx context.Context, t TS) (TS, error) {
+	tt, err := c.MonoTSs(ctx, t, 1)
+	if err != nil {
+		return 0, err
+	}
+	return tt[0], nil
+}
+
+// MonoTSs is like MonoTS, but returns n new, unique TSs at once using a single
+// round-trip. The returned TSs will be in ascending order.
+func (c Core) MonoTSs(ctx context.Context, t TS, n int) ([]TS, error) {
+	if n < 1 {
+		return nil, errors.New("n must be at least 1")
+	}
+	return c.b.MonoTSs(ctx, t, n)
 }
 
 // ID identifies a single event across the entire cluster, and is unique for all
@@ -204,7 +268,15 @@ type ID struct {
 
 // String returns the string form of the ID
 func (id ID) String() string {
-	return fmt.Sprintf("%d_%d", id.T, id.Expire)
+	var buf [41]byte
+	return string(id.appendString(buf[:0]))
+}
+
+// appends the String form of the ID to b
+func (id ID) appendString(b []byte) []byte {
+	b = strconv.AppendUint(b, uint64(id.T), 10)
+	b = append(b, '_')
+	return strconv.AppendUint(b, uint64(id.Expire), 10)
 }
 
 // IDFromString takes a string previously returned by an ID's String method and
@@ -226,10 +298,39 @@ func IDFromString(idstr string) (ID, error) {
 }
 
 // Event describes all the information related to a single event. An event is
-// immutable, nothing in this struct will ever change
+// immutable, nothing in this struct will ever change, with the exception of
+// Attempts and DeliveryToken
 type Event struct {
 	ID       ID
 	Contents string
+
+	// Optional. The queue which replies to this event should be added to
+	ReplyTo string
+
+	// If this event was added as a reply to another event, this is the ID of
+	// that event
+	InReplyTo ID
+
+	// Optional. Describes how Contents has been encoded by whatever stored the
+	// event, e.g. peel uses it to mark contents it has compressed. Events
+	// stored before Flags existed will have it set to 0.
+	Flags uint8
+
+	// Optional. The trace context of whatever added the event, as returned by
+	// Tracer's Inject, so that the consumers of the event can link their
+	// processing of it back to its producer.
+	TraceContext string
+
+	// Attempts isn't stored with the event. It may be filled in when the event
+	// is retrieved for a consumer group, and indicates how many times the event
+	// has been delivered to that consumer group
+	Attempts uint64 `msg:"-"`
+
+	// DeliveryToken isn't stored with the event either. It's filled in when
+	// the event is retrieved for a consumer group with an ack deadline, and is
+	// unique to that delivery of the event, so that acking the event can be
+	// limited to whoever it was most recently delivered to.
+	DeliveryToken string `msg:"-"`
 }
 
 // NewEvent initializes an event struct with the given information, as well as
@@ -238,8 +339,8 @@ type Event struct {
 // NewEvent creates an event struct with the given information. The returned
 // Event will have the given contents, and its ID will a unique identifier based
 // on the passed in now and expire.
-func (c *Core) NewEvent(now, expire TS, contents string) (Event, error) {
-	nowMono, err := c.MonoTS(now)
+func (c *Core) NewEvent(ctx context.Context, now, expire TS, contents string) (Event, error) {
+	nowMono, err := c.MonoTS(ctx, now)
 	if err != nil {
 		return Event{}, err
 	}
@@ -251,56 +352,46 @@ func (c *Core) NewEvent(now, expire TS, contents string) (Event, error) {
 	}, nil
 }
 
-func pexpireAt(t TS, buffer time.Duration) int64 {
-	return t.Time().Add(buffer).UnixNano() / 1e6 // to millisecond
-}
-
-// this is separate from Key so events don't get picked up by KeyScan
-func (c *Core) eventKey(id ID) string {
-	return fmt.Sprintf("%s:event:%s", c.o.RedisPrefix, id.String())
-}
-
 // SetEvent sets the event with the given id to have the given contents. The
 // event will expire based on the ID field in it (which will be truncated to an
 // integer) added with the given buffer
-func (c *Core) SetEvent(e Event, expireBuffer time.Duration) error {
-	pex := pexpireAt(e.ID.Expire, expireBuffer)
-	lua := `
-		local key = KEYS[1]
-		local pexpire = ARGV[1]
-		local val = ARGV[2]
-		redis.call("SET", key, val)
-		redis.call("PEXPIREAT", key, pexpire)
-	`
-
-	var err error
-	withMarshaled(func(bb [][]byte) {
-		eb := bb[0]
-		err = util.LuaEval(c.c, lua, 1, c.eventKey(e.ID), pex, eb).Err
-	}, &e)
-	return err
+func (c *Core) SetEvent(ctx context.Context, e Event, expireBuffer time.Duration) error {
+	return c.b.SetEvents(ctx, []Event{e}, expireBuffer)
 }
 
-// GetEvent returns the event identified by the given ID, or ErrNotFound if it's
-// expired or never existed
-func (c *Core) GetEvent(id ID) (Event, error) {
-	r := c.c.Cmd("GET", c.eventKey(id))
-	if r.IsType(redis.Nil) {
-		return Event{}, ErrNotFound
+// SetEvents is like SetEvent, but sets multiple events at once. When not
+// running against a cluster this is done in a single round-trip.
+func (c *Core) SetEvents(ctx context.Context, ee []Event, expireBuffer time.Duration) error {
+	if len(ee) == 0 {
+		return nil
 	}
+	return c.b.SetEvents(ctx, ee, expireBuffer)
+}
 
-	eb, err := r.Bytes()
+// GetEvent returns the event identified by the given ID, or ErrNotFound if it's
+// expired or never existed
+func (c *Core) GetEvent(ctx context.Context, id ID) (Event, error) {
+	ee, err := c.b.GetEvents(ctx, []ID{id})
 	if err != nil {
 		return Event{}, err
 	}
+	return ee[0], nil
+}
 
-	var e Event
-	_, err = e.UnmarshalMsg(eb)
-	return e, err
+// GetEvents is like GetEvent, but retrieves multiple events at once. When not
+// running against a cluster this is done in a single round-trip. The returned
+// events will be in the same order as the given IDs. ErrNotFound is returned if
+// any of the events are expired or never existed.
+func (c *Core) GetEvents(ctx context.Context, ii []ID) ([]Event, error) {
+	if len(ii) == 0 {
+		return []Event{}, nil
+	}
+	return c.b.GetEvents(ctx, ii)
 }
 
 // Key describes a location some data can be stored in in redis. Keys with the
-// same Base will be stored together and can be interacted with transactionally.
+// same Base will be stored together (in the same slot, when using a cluster)
+// and can be interacted with transactionally.
 // Subs is used a further set of identifiers for the Key.
 //
 // The only disallowed character in the strings making up key is ':'
@@ -424,12 +515,60 @@ type QueryFilter struct {
 	// If set, only IDs which have not expired will be allowed through
 	Expired bool
 
+	// If set, only IDs which are in the given Key with a score within the
+	// filter's ScoreMin/ScoreMax (inclusive) will be allowed through. If
+	// ScoreMin or ScoreMax are 0 that indicates -infinity or +infinity,
+	// respectively
+	ScoreKey           *Key
+	ScoreMin, ScoreMax TS
+
 	// May be set alongside any other filter field. Will invert the filter, so
 	// that whatever IDs would have been allowed through will not be, and
 	// vice-versa
 	Invert bool
 }
 
+// QueryContentsFilter only outputs the IDs in its input whose events' Contents
+// match the ContentsFilter. Events whose Flags are set (e.g. because peel
+// compressed or encrypted their Contents), or which can't be retrieved, never
+// match. It can't be used against a cluster, since the events' keys aren't in
+// the same slot as the Query's.
+//
+// If Limit is set at most that many IDs are output, the oldest ones.
+//
+// If SkipTo is set and none of the input matches, the newest ID in the input is
+// set at SkipTo as with a QuerySingleSet with IfNewer and Newest set, and
+// ScoreFrom set to SkipScoreFrom. The number of IDs which were skipped this way
+// (0 if any matched) is then appended to the result's Counts. This allows a
+// pointer to be moved past events which don't match.
+type QueryContentsFilter struct {
+	ContentsFilter
+	Limit         int64
+	SkipTo        *Key
+	SkipScoreFrom *Key
+}
+
+// ContentsFilter matches events whose Contents are a JSON object by the values
+// of their fields. An event matches if every one of the Conditions does.
+type ContentsFilter struct {
+	Conditions []ContentsCondition
+}
+
+// ContentsCondition compares a field in an event's Contents with Value. A field
+// which the Contents don't have is treated as being null.
+type ContentsCondition struct {
+	// The keys followed through the Contents to reach the field, e.g.
+	// {"user", "id"}
+	Path []string
+
+	// One of "==", "!=", "<", "<=", ">" or ">=". The ordering comparisons
+	// only match numbers with numbers and strings with strings.
+	Op string
+
+	// A string, float64, bool, or nil to compare with JSON's null
+	Value interface{}
+}
+
 // QueryConditional is a field on QueryAction which can affect what the
 // QueryAction does. More than one field may be set on this to have multiple
 // conditionals.
@@ -457,10 +596,20 @@ type QueryConditional struct {
 // true, then each ID's expire time will be used as its score. If Score is given
 // it will be used as the score for all IDs being added, otherwise the T of
 // each individual ID will be used
+//
+// If ScoreIncr is set alongside Score, each ID will instead be given Score plus
+// its position in the input (starting at zero), so that every ID added gets a
+// distinct score
+//
+// If Incr is set, each ID's existing score in the Keys will be incremented by
+// whatever score would have otherwise been given to it. IDs not already in the
+// Keys are added as normal.
 type QueryAddTo struct {
 	Keys          []Key
 	ExpireAsScore bool
 	Score         TS
+	ScoreIncr     bool
+	Incr          bool
 }
 
 // QueryRemoveByScore is used to remove IDs from Keys based on a range of
@@ -477,9 +626,41 @@ type QueryRemoveByScore struct {
 //
 // If IfNewer is set, the key will only be set if its ID is newer than the ID
 // already in the Key. This does not change the output in any way
+//
+// If Newest is set, the newest ID in the input will be used instead of the
+// first one
+//
+// If ScoreFrom is set, the ID will be stored with its T field replaced by its
+// score in the ScoreFrom Key. If the ID isn't in that Key then nothing is set.
+// IfNewer will compare using this replaced T.
 type QuerySingleSet struct {
 	Key
-	IfNewer bool
+	IfNewer   bool
+	Newest    bool
+	ScoreFrom *Key
+}
+
+// QueryHashSet sets a field in the hash at Key for each ID in the input, with
+// the field being the ID's string form (see ID's String method) and the value
+// being Value. The input is passed through as the output.
+type QueryHashSet struct {
+	Key
+	Value string
+}
+
+// QueryPublish publishes the IDs in the input, along with Message, to the Key
+// (see KeySubscribe). Nothing is published if the input is empty. The input is
+// passed through as the output.
+type QueryPublish struct {
+	Key
+	Message string
+}
+
+// Publication is a set of IDs published by a QueryPublish, as received by
+// KeySubscribe
+type Publication struct {
+	Message string
+	IDs     []ID
 }
 
 // QueryAction describes a single action to take on a set of IDs. Every action
@@ -500,6 +681,11 @@ type QueryAction struct {
 	// that count to the result, and pass that input through as the output.
 	CountInput bool
 
+	// For each ID in the input, in order, appends its score in the given Key to
+	// the result's Counts (or 0 if it's not in the Key). The input is passed
+	// through as the output.
+	ScoresFrom *Key
+
 	// Adds the input IDs to the given Keys. See its doc string for more info
 	*QueryAddTo
 
@@ -509,6 +695,27 @@ type QueryAction struct {
 	// Removes the input IDs from the given Keys
 	RemoveFrom []Key
 
+	// Sets a hash field for each of the input IDs. See its doc string for more
+	// info
+	*QueryHashSet
+
+	// Removes the fields for the input IDs from the hash at the given Key (see
+	// QueryHashSet). The input is passed through as the output
+	HashDel *Key
+
+	// Publishes the input IDs to subscribers of a Key. See its doc string for
+	// more info
+	*QueryPublish
+
+	// Limits the input to however many tokens are available in the token
+	// bucket at the given Key, consuming a token for each ID output. The
+	// bucket is a hash, whose "rate" field is the number of tokens added per
+	// second and whose "burst" field is the maximum number of tokens it can
+	// hold (default 1). A full bucket is assumed if it has not been used
+	// before. If the "rate" field isn't set the input is passed through
+	// unchanged. The IDs which are kept are the oldest ones.
+	RateLimit *Key
+
 	// Adds an ID to a key. See its doc string for more info
 	*QuerySingleSet
 
@@ -520,6 +727,10 @@ type QueryAction struct {
 	// Filters Events out of the input. See its doc string for more info
 	*QueryFilter
 
+	// Filters Events out of the input by their Contents. See its doc string
+	// for more info
+	*QueryContentsFilter
+
 	// Deletes whatever the Key's contents are. The input to this action becomes
 	// the output
 	Delete *Key
@@ -546,62 +757,215 @@ type QueryAction struct {
 // the output set of IDs from the Query method, as well as the set of results
 // from all Count operations which occurred during the query.
 type QueryActions struct {
-	// This must match the Base field on all Keys being used in this pipeline
+	// This must match the Base field on all Keys being used in this pipeline,
+	// unless CrossBase is set
 	KeyBase      string
 	QueryActions []QueryAction
 
+	// Optional. Must be set if any of the Keys being used have a Base other
+	// than KeyBase. Their keys may then be in different slots, so the Query
+	// can't be performed against a cluster, see ErrClusterCrossBase.
+	CrossBase bool `msg:"-"`
+
 	// Optional, may be passed in if there is a previous notion of "current
 	// time", to maintain consistency
 	Now TS `msg:"-"`
+
+	// Optional. If set the QueryRes will describe what each QueryAction did,
+	// which is useful for figuring out why a Query isn't returning what's
+	// expected.
+	Explain bool
+
+	// Optional. Should be set if performing the QueryActions more than once
+	// has the same effect as performing them once, e.g. if they only add given
+	// IDs with given scores. Only idempotent Queries are retried after an error
+	// which leaves it unknown whether they were performed, see RetryPolicy.
+	Idempotent bool `msg:"-"`
+
+	// Optional. Events to set, as SetEvents would with EventsExpireBuffer,
+	// before any of the QueryActions are performed. Except against a cluster
+	// this happens in the same round-trip as the QueryActions, so adding new
+	// events to Keys only needs one.
+	Events             []Event       `msg:"-"`
+	EventsExpireBuffer time.Duration `msg:"-"`
 }
 
 // QueryRes contains all the return values from a Query
 type QueryRes struct {
 	IDs    []ID
 	Counts []uint64
+
+	// Only set if Explain was set on the QueryActions. Has a step for each
+	// QueryAction which was reached, in order, so if a Break stopped the
+	// pipeline it will be the last step.
+	Explain []QueryExplainStep
+}
+
+// QueryExplainStep describes what happened to a single QueryAction during a
+// Query, see the Explain field on QueryActions
+type QueryExplainStep struct {
+	// The QueryAction which was reached. This is filled in by Query, Backends
+	// don't need to set it.
+	QueryAction QueryAction `msg:"-"`
+
+	// True if the QueryAction's QueryConditional stopped it from being
+	// performed, in which case its input was passed through as its output
+	Skipped bool
+
+	// True if the QueryAction was a Break which stopped the pipeline. The
+	// pipeline's output is this step's input.
+	Broke bool
+
+	// The number of IDs input to the QueryAction, and the number it output
+	// (after Union, if set)
+	In, Out int
+}
+
+// String returns a single line describing the step, e.g.
+// "QuerySelector(QueryRangeSelect) :k:{foo}:bar in=0 out=3"
+func (s QueryExplainStep) String() string {
+	str := fmt.Sprintf("%s in=%d out=%d", queryActionName(s.QueryAction), s.In, s.Out)
+	if s.QueryAction.Union {
+		str += " union"
+	}
+	if s.Skipped {
+		str += " skipped"
+	}
+	if s.Broke {
+		str += " break"
+	}
+	return str
+}
+
+// returns the name of the field set on the QueryAction, along with which kind of
+// selector it is and which Key it acts on, where applicable
+func queryActionName(qa QueryAction) string {
+	keys := func(kk ...Key) string {
+		ss := make([]string, len(kk))
+		for i := range kk {
+			ss[i] = kk[i].String("")
+		}
+		return strings.Join(ss, ",")
+	}
+
+	switch {
+	case qa.QuerySelector != nil:
+		qs := qa.QuerySelector
+		var kind string
+		switch {
+		case qs.QueryRangeSelect != nil:
+			kind = "QueryRangeSelect"
+		case qs.QueryIDScoreSelect != nil:
+			kind = "QueryIDScoreSelect"
+		case len(qs.PosRangeSelect) > 0:
+			kind = "PosRangeSelect"
+		default:
+			return fmt.Sprintf("QuerySelector(IDs) n=%d", len(qs.IDs))
+		}
+		return fmt.Sprintf("QuerySelector(%s) %s", kind, keys(qs.Key))
+	case qa.QueryCount != nil:
+		return "QueryCount " + keys(qa.QueryCount.Key)
+	case qa.CountInput:
+		return "CountInput"
+	case qa.ScoresFrom != nil:
+		return "ScoresFrom " + keys(*qa.ScoresFrom)
+	case qa.QueryAddTo != nil:
+		return "QueryAddTo " + keys(qa.QueryAddTo.Keys...)
+	case qa.QueryRemoveByScore != nil:
+		return "QueryRemoveByScore " + keys(qa.QueryRemoveByScore.Keys...)
+	case len(qa.RemoveFrom) > 0:
+		return "RemoveFrom " + keys(qa.RemoveFrom...)
+	case qa.QueryHashSet != nil:
+		return "QueryHashSet " + keys(qa.QueryHashSet.Key)
+	case qa.HashDel != nil:
+		return "HashDel " + keys(*qa.HashDel)
+	case qa.RateLimit != nil:
+		return "RateLimit " + keys(*qa.RateLimit)
+	case qa.QuerySingleSet != nil:
+		return "QuerySingleSet " + keys(qa.QuerySingleSet.Key)
+	case qa.SingleGet != nil:
+		return "SingleGet " + keys(*qa.SingleGet)
+	case qa.QueryFilter != nil:
+		return "QueryFilter"
+	case qa.Delete != nil:
+		return "Delete " + keys(*qa.Delete)
+	case qa.Break:
+		return "Break"
+	}
+	return "Noop"
 }
 
 // Query performs the given QueryActions pipeline. Whatever the final output
 // from the pipeline is is returned.
-func (c *Core) Query(qas QueryActions) (QueryRes, error) {
-	var err error
-
+//
+// The whole pipeline is performed atomically. When using redis it's sent as a
+// single lua script, so no other commands are run while it is and there are no
+// round trips between actions. Anything which must not race with other callers,
+// like moving events from one key to another, should be done within a single
+// Query rather than across several.
+func (c *Core) Query(ctx context.Context, qas QueryActions) (QueryRes, error) {
 	if qas.Now == 0 {
-		qas.Now = NewTS(time.Now())
+		qas.Now = NewTS(c.clock.Now())
 	}
 
-	var resb []byte
-	withMarshaled(func(bb [][]byte) {
-		nowb := bb[0]
-		qasb := bb[1]
-		k := Key{Base: qas.KeyBase}.String(c.o.RedisPrefix)
-		resb, err = util.LuaEval(c.c, string(queryLua), 1, k, nowb, qasb, c.o.RedisPrefix).Bytes()
-	}, qas.Now, &qas)
+	res, err := c.b.Query(ctx, qas)
 	if err != nil {
 		return QueryRes{}, err
 	}
-
-	var res QueryRes
-	if _, err = res.UnmarshalMsg(resb); err != nil {
-		return QueryRes{}, err
-	}
 	if res.IDs == nil {
 		res.IDs = []ID{}
 	}
+	for i := range res.Explain {
+		res.Explain[i].QueryAction = qas.QueryActions[i]
+	}
 	return res, nil
 }
 
 // KeyScan returns all the Keys matching the given Key pattern. At least one
-// field in the given Key should be a "*"
-func (c *Core) KeyScan(k Key) ([]Key, error) {
-	s := util.NewScanner(c.c, util.ScanOpts{
-		Command: "SCAN",
-		Pattern: k.String(c.o.RedisPrefix),
-	})
-
-	var ret []Key
-	for s.HasNext() {
-		ret = append(ret, KeyFromString(s.Next()))
+// field in the given Key should be a "*".
+func (c *Core) KeyScan(ctx context.Context, k Key) ([]Key, error) {
+	return c.b.KeyScan(ctx, k)
+}
+
+// HashGetIDs returns the values of the fields for the given IDs in the hash at
+// the given Key, as set by QueryHashSet. The returned slice is in the same order
+// as the given IDs, and has empty strings for IDs which have no field set.
+func (c *Core) HashGetIDs(ctx context.Context, k Key, ii []ID) ([]string, error) {
+	if len(ii) == 0 {
+		return []string{}, nil
 	}
-	return ret, s.Err()
+	return c.b.HashGetIDs(ctx, k, ii)
+}
+
+// HashSetAll replaces the contents of the hash at the given Key with the given
+// fields and values. If m is empty the Key is deleted. The Key should not be
+// used in a Query.
+func (c *Core) HashSetAll(ctx context.Context, k Key, m map[string]string) error {
+	return c.b.HashSetAll(ctx, k, m)
+}
+
+// HashGetAll returns all fields and values in the hash at the given Key, as set
+// by HashSetAll. An empty map is returned if the Key isn't set.
+func (c *Core) HashGetAll(ctx context.Context, k Key) (map[string]string, error) {
+	return c.b.HashGetAll(ctx, k)
+}
+
+// SetString sets the given Key to the given string, which will be removed after
+// ttl. The Key should not be used in a Query.
+func (c *Core) SetString(ctx context.Context, k Key, val string, ttl time.Duration) error {
+	return c.b.SetString(ctx, k, val, ttl)
+}
+
+// GetString returns the string which was set on the given Key using SetString.
+// ErrNotFound is returned if the Key isn't set.
+func (c *Core) GetString(ctx context.Context, k Key) (string, error) {
+	return c.b.GetString(ctx, k)
+}
+
+// SetIDNX sets the given Key to the given ID, but only if the Key isn't already
+// set. The Key will be removed after ttl. Returns the ID the Key holds once the
+// call is done, and true if it was set by this call. The Key should not be used
+// in a Query.
+func (c *Core) SetIDNX(ctx context.Context, k Key, id ID, ttl time.Duration) (ID, bool, error) {
+	return c.b.SetIDNX(ctx, k, id, ttl)
 }
@@ -1,16 +1,25 @@
 package core
 
 import (
+	"context"
+	"strings"
+	"sync/atomic"
 	. "testing"
 	"time"
 
 	"github.com/levenlabs/golib/testutil"
 	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/mediocregopher/radix.v2/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-var testCore *Core
+var (
+	testCore  *Core
+	testRedis *redisBackend
+	testCtx   = context.Background()
+)
 
 func init() {
 	p, err := pool.New("tcp", "127.0.0.1:6379", 1)
@@ -20,6 +29,7 @@ func init() {
 	testCore = New(p, &Opts{
 		RedisPrefix: testutil.RandStr(),
 	})
+	testRedis = testCore.b.(*redisBackend)
 	errCh := testCore.Run(nil)
 	go func() { panic(<-errCh) }()
 }
@@ -28,7 +38,7 @@ func TestMonoTS(t *T) {
 	for i := 0; i < 100; i++ {
 		now := time.Now()
 		nowTS := NewTS(now)
-		mTS, err := testCore.MonoTS(nowTS)
+		mTS, err := testCore.MonoTS(testCtx, nowTS)
 		assert.Nil(t, err)
 		assert.Equal(t, nowTS, mTS)
 
@@ -36,19 +46,63 @@ func TestMonoTS(t *T) {
 		// won't match exactly because we truncate to microseconds
 		assert.Equal(t, now.Unix(), mTS.Time().Unix())
 
-		mTS2, err := testCore.MonoTS(nowTS)
+		mTS2, err := testCore.MonoTS(testCtx, nowTS)
 		assert.Nil(t, err)
 		assert.True(t, mTS2 > mTS, "mTS2:%d !> mTS:%d ", mTS2, mTS)
 
 		nowTS = NewTS(time.Now())
-		mTS3, err := testCore.MonoTS(nowTS)
+		mTS3, err := testCore.MonoTS(testCtx, nowTS)
 		assert.Nil(t, err)
 		assert.True(t, mTS3 > mTS2, "mTS3:%d !> mTS2:%d ", mTS3, mTS2)
 	}
 }
 
+func TestMonoTSs(t *T) {
+	nowTS := NewTS(time.Now())
+	tt, err := testCore.MonoTSs(testCtx, nowTS, 5)
+	require.Nil(t, err)
+	require.Len(t, tt, 5)
+	for i := 1; i < len(tt); i++ {
+		assert.Equal(t, tt[i-1]+1, tt[i])
+	}
+
+	// Make sure MonoTS picks up after the last TS that was handed out
+	mTS, err := testCore.MonoTS(testCtx, nowTS)
+	require.Nil(t, err)
+	assert.True(t, mTS > tt[4], "mTS:%d !> tt[4]:%d", mTS, tt[4])
+
+	_, err = testCore.MonoTSs(testCtx, nowTS, 0)
+	assert.NotNil(t, err)
+}
+
+func TestHealth(t *T) {
+	p, err := pool.New("tcp", "127.0.0.1:6379", 2)
+	require.Nil(t, err)
+	c := New(p, &Opts{RedisPrefix: testutil.RandStr()})
+
+	h, err := c.Health(testCtx)
+	require.Nil(t, err)
+	// The pool fills itself in the background, so exactly how many
+	// connections are idle can't be known
+	assert.True(t, h.PoolAvail >= 0, "PoolAvail:%d", h.PoolAvail)
+	assert.True(t, h.Latency > 0)
+	assert.True(t, h.ClockSkew < time.Second, "ClockSkew:%v", h.ClockSkew)
+
+	// If a TS in the future has been handed out then Health sees the skew
+	_, err = c.MonoTS(testCtx, NewTS(time.Now().Add(time.Hour)))
+	require.Nil(t, err)
+	h, err = c.Health(testCtx)
+	require.Nil(t, err)
+	assert.True(t, h.ClockSkew > 59*time.Minute, "ClockSkew:%v", h.ClockSkew)
+
+	// A Core without a Cmder doesn't know its pool's size
+	h, err = newTestMemCore().Health(testCtx)
+	require.Nil(t, err)
+	assert.Equal(t, -1, h.PoolAvail)
+}
+
 func requireNewID(t *T) ID {
-	ts, err := testCore.MonoTS(NewTS(time.Now()))
+	ts, err := testCore.MonoTS(testCtx, NewTS(time.Now()))
 	require.Nil(t, err)
 	return ID{
 		T:      ts,
@@ -65,7 +119,7 @@ func randKey(base string) Key {
 
 func populatedKey(t *T, base string, ii ...ID) Key {
 	k := randKey(base)
-	_, err := testCore.Query(QueryActions{
+	_, err := testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -92,7 +146,7 @@ func randPopulatedKey(t *T, base string, size int) (Key, []ID) {
 }
 
 func assertKey(t *T, k Key, ii ...ID) {
-	res, err := testCore.Query(QueryActions{
+	res, err := testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -114,7 +168,7 @@ func assertKey(t *T, k Key, ii ...ID) {
 
 // Assert the contents of a set as well as its scores
 func assertKeyRaw(t *T, k Key, ixm map[ID]int64) {
-	arr, err := testCore.c.Cmd("ZRANGE", k.String(testCore.o.RedisPrefix), 0, -1, "WITHSCORES").Array()
+	arr, err := testRedis.c.Cmd("ZRANGE", k.String(testRedis.o.RedisPrefix), 0, -1, "WITHSCORES").Array()
 	require.Nil(t, err)
 
 	m := map[ID]int64{}
@@ -138,16 +192,94 @@ func TestGetSetEvent(t *T) {
 	now := time.Now()
 	expire := time.Now().Add(500 * time.Millisecond)
 
-	e, err := testCore.NewEvent(NewTS(now), NewTS(expire), contents)
+	e, err := testCore.NewEvent(testCtx, NewTS(now), NewTS(expire), contents)
 	require.Nil(t, err)
 
-	assert.Nil(t, testCore.SetEvent(e, 500*time.Millisecond))
-	e2, err := testCore.GetEvent(e.ID)
+	assert.Nil(t, testCore.SetEvent(testCtx, e, 500*time.Millisecond))
+	e2, err := testCore.GetEvent(testCtx, e.ID)
 	assert.Nil(t, err)
 	assert.Equal(t, e, e2)
 
 	time.Sleep(1*time.Second + 100*time.Millisecond)
-	_, err = testCore.GetEvent(e.ID)
+	_, err = testCore.GetEvent(testCtx, e.ID)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestSetEvents(t *T) {
+	now := time.Now()
+	expire := NewTS(now.Add(1 * time.Minute))
+	ee := make([]Event, 3)
+	for i := range ee {
+		var err error
+		ee[i], err = testCore.NewEvent(testCtx, NewTS(now), expire, testutil.RandStr())
+		require.Nil(t, err)
+	}
+
+	require.Nil(t, testCore.SetEvents(testCtx, ee, 0))
+	for _, e := range ee {
+		e2, err := testCore.GetEvent(testCtx, e.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, e, e2)
+	}
+
+	assert.Nil(t, testCore.SetEvents(testCtx, nil, 0))
+
+	ii := []ID{ee[2].ID, ee[0].ID}
+	ee2, err := testCore.GetEvents(testCtx, ii)
+	require.Nil(t, err)
+	assert.Equal(t, []Event{ee[2], ee[0]}, ee2)
+
+	ii = append(ii, requireNewID(t))
+	_, err = testCore.GetEvents(testCtx, ii)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestQueryEvents(t *T) {
+	for _, c := range []*Core{testCore, newTestMemCore()} {
+		now := time.Now()
+		ee := make([]Event, 3)
+		ii := make([]ID, len(ee))
+		for i := range ee {
+			var err error
+			ee[i], err = c.NewEvent(testCtx, NewTS(now), NewTS(now.Add(-time.Second)), testutil.RandStr())
+			require.Nil(t, err)
+			ii[i] = ee[i].ID
+		}
+
+		// The events have already expired, so are only kept due to the buffer
+		k := randKey(testutil.RandStr())
+		res, err := c.Query(testCtx, QueryActions{
+			KeyBase: k.Base,
+			QueryActions: []QueryAction{
+				{QuerySelector: &QuerySelector{Key: k, IDs: ii}},
+				{QueryAddTo: &QueryAddTo{Keys: []Key{k}}},
+			},
+			Events:             ee,
+			EventsExpireBuffer: time.Minute,
+		})
+		require.Nil(t, err)
+		assert.Equal(t, ii, res.IDs)
+
+		ee2, err := c.GetEvents(testCtx, ii)
+		require.Nil(t, err)
+		assert.Equal(t, ee, ee2)
+	}
+}
+
+func TestContext(t *T) {
+	e, err := testCore.NewEvent(testCtx, NewTS(time.Now()), NewTS(time.Now().Add(1*time.Minute)), testutil.RandStr())
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(testCtx)
+	cancel()
+	assert.Equal(t, context.Canceled, testCore.SetEvent(ctx, e, 0))
+	_, err = testCore.GetEvent(ctx, e.ID)
+	assert.Equal(t, context.Canceled, err)
+	_, err = testCore.Query(ctx, QueryActions{KeyBase: testutil.RandStr()})
+	assert.Equal(t, context.Canceled, err)
+
+	// The event was never set, since ctx was already canceled
+	_, err = testCore.GetEvent(testCtx, e.ID)
 	assert.Equal(t, ErrNotFound, err)
 }
 
@@ -159,7 +291,7 @@ func TestKeyString(t *T) {
 	}
 
 	for _, k := range kk {
-		str := k.String(testCore.o.RedisPrefix)
+		str := k.String(testRedis.o.RedisPrefix)
 		assert.Equal(t, k, KeyFromString(str), "key:%q", str)
 	}
 }
@@ -169,7 +301,7 @@ func TestQueryBasicAddRemove(t *T) {
 	k, ii := randPopulatedKey(t, base, 3)
 	assertKey(t, k, ii...)
 
-	_, err := testCore.Query(QueryActions{
+	_, err := testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -194,6 +326,7 @@ func TestQueryAddScores(t *T) {
 	k1 := randKey(base)
 	k2 := randKey(base)
 	k3 := randKey(base)
+	k4 := randKey(base)
 	ii := []ID{
 		requireNewID(t),
 		requireNewID(t),
@@ -203,7 +336,7 @@ func TestQueryAddScores(t *T) {
 	ii[1].Expire = NewTS(time.Now().Add(-1 * time.Second))
 	ii[3].Expire = NewTS(time.Now().Add(-1 * time.Second))
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testCore.Query(testCtx, QueryActions{
 		KeyBase: base,
 		QueryActions: []QueryAction{
 			{
@@ -226,6 +359,13 @@ func TestQueryAddScores(t *T) {
 					Score: 5,
 				},
 			},
+			{
+				QueryAddTo: &QueryAddTo{
+					Keys:      []Key{k4},
+					Score:     5,
+					ScoreIncr: true,
+				},
+			},
 		},
 	})
 	require.Nil(t, err)
@@ -248,6 +388,12 @@ func TestQueryAddScores(t *T) {
 		ii[2]: 5,
 		ii[3]: 5,
 	})
+	assertKeyRaw(t, k4, map[ID]int64{
+		ii[0]: 5,
+		ii[1]: 6,
+		ii[2]: 7,
+		ii[3]: 8,
+	})
 }
 
 func TestQueryRemoveByScore(t *T) {
@@ -255,7 +401,7 @@ func TestQueryRemoveByScore(t *T) {
 	// QueryScoreRange, which is tested in TestQueryRangeSelect extensively
 	base := testutil.RandStr()
 	k, ii := randPopulatedKey(t, base, 4)
-	res, err := testCore.Query(QueryActions{
+	res, err := testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -278,7 +424,7 @@ func TestQueryRangeSelect(t *T) {
 	base := testutil.RandStr()
 	k, ii := randPopulatedKey(t, base, 4)
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -297,7 +443,7 @@ func TestQueryRangeSelect(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, []ID{ii[1], ii[2]}, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -318,7 +464,7 @@ func TestQueryRangeSelect(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, []ID{ii[1], ii[2]}, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -339,7 +485,7 @@ func TestQueryRangeSelect(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, []ID{ii[1], ii[2]}, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -362,7 +508,7 @@ func TestQueryRangeSelect(t *T) {
 
 	minK := populatedKey(t, base, ii[0], ii[1])
 	maxK := populatedKey(t, base, ii[2], ii[3])
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -386,7 +532,7 @@ func TestQueryRangeSelect(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, []ID{ii[1], ii[2], ii[3]}, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -415,7 +561,7 @@ func TestQueryIDScoreSelect(t *T) {
 	base := testutil.RandStr()
 	k, ii := randPopulatedKey(t, base, 1)
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -431,7 +577,7 @@ func TestQueryIDScoreSelect(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, []ID{ii[0]}, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -448,7 +594,7 @@ func TestQueryIDScoreSelect(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, []ID{ii[0]}, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -471,7 +617,7 @@ func TestQueryPosRangeSelect(t *T) {
 	base := testutil.RandStr()
 	k, ii := randPopulatedKey(t, base, 4)
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -498,7 +644,7 @@ func TestQueryFiltering(t *T) {
 	ii[1].Expire = NewTS(time.Now().Add(-1 * time.Second))
 	ii[3].Expire = NewTS(time.Now().Add(-1 * time.Second))
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -517,7 +663,7 @@ func TestQueryFiltering(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, []ID{ii[0], ii[2]}, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -538,6 +684,100 @@ func TestQueryFiltering(t *T) {
 	assert.Equal(t, []ID{ii[1], ii[3]}, res.IDs)
 }
 
+func TestQueryContentsFilter(t *T) {
+	contents := []string{
+		`{"user":{"country":"NZ"},"amount":150}`,
+		`{"user":{"country":"US"},"amount":200}`,
+		`{"user":{"country":"NZ"},"amount":50}`,
+		`not json`,
+		`{"user":{"country":"NZ"},"amount":500}`, // has Flags set
+		`{"user":{"country":"NZ"},"amount":100,"ok":true,"x":null}`,
+	}
+	cond := func(path, op string, v interface{}) ContentsCondition {
+		return ContentsCondition{Path: strings.Split(path, "."), Op: op, Value: v}
+	}
+	nzBig := ContentsFilter{Conditions: []ContentsCondition{
+		cond("user.country", "==", "NZ"),
+		cond("amount", ">=", float64(100)),
+	}}
+
+	for _, c := range []*Core{testCore, newTestMemCore()} {
+		now := time.Now()
+		ee := make([]Event, len(contents))
+		ii := make([]ID, len(ee))
+		for i := range ee {
+			var err error
+			ee[i], err = c.NewEvent(testCtx, NewTS(now), NewTS(now.Add(time.Minute)), contents[i])
+			require.Nil(t, err)
+			ii[i] = ee[i].ID
+		}
+		ee[4].Flags = 1
+		require.Nil(t, c.SetEvents(testCtx, ee, 0))
+
+		k := randKey(testutil.RandStr())
+		ptr := randKey(k.Base)
+		query := func(input []ID, qcf QueryContentsFilter) QueryRes {
+			res, err := c.Query(testCtx, QueryActions{
+				KeyBase: k.Base,
+				QueryActions: []QueryAction{
+					{QuerySelector: &QuerySelector{Key: k, IDs: input}},
+					{QueryContentsFilter: &qcf},
+				},
+				Now: NewTS(now),
+			})
+			require.Nil(t, err)
+			return res
+		}
+		assertFilter := func(expected []ID, cc ...ContentsCondition) {
+			res := query(ii, QueryContentsFilter{ContentsFilter: ContentsFilter{Conditions: cc}})
+			if len(expected) == 0 {
+				assert.Empty(t, res.IDs)
+			} else {
+				assert.Equal(t, expected, res.IDs)
+			}
+		}
+
+		assertFilter([]ID{ii[0], ii[5]}, nzBig.Conditions...)
+		assertFilter([]ID{ii[5]}, cond("ok", "==", true), cond("x", "==", nil))
+		assertFilter([]ID{ii[0], ii[1], ii[2], ii[5]}, cond("amount", "!=", "foo"))
+		assertFilter(nil, cond("amount", "<", "foo"))
+		assertFilter(nil, cond("amount", ">", nil))
+		assertFilter([]ID{ii[0], ii[1], ii[2], ii[5]}, cond("nope", "==", nil))
+		assertFilter(nil, cond("user.country.nope", "!=", nil))
+		assertFilter([]ID{ii[1]}, cond("user.country", ">", "NZ"))
+
+		res := query(ii, QueryContentsFilter{ContentsFilter: nzBig, Limit: 1})
+		assert.Equal(t, []ID{ii[0]}, res.IDs)
+
+		assertPtr := func(expected ID) {
+			res, err := c.Query(testCtx, QueryActions{
+				KeyBase:      k.Base,
+				QueryActions: []QueryAction{{SingleGet: &ptr}},
+				Now:          NewTS(now),
+			})
+			require.Nil(t, err)
+			assert.Equal(t, []ID{expected}, res.IDs)
+		}
+
+		// None match, so the pointer is moved to the newest input
+		res = query(ii[1:4], QueryContentsFilter{ContentsFilter: nzBig, SkipTo: &ptr})
+		assert.Empty(t, res.IDs)
+		assert.Equal(t, []uint64{3}, res.Counts)
+		assertPtr(ii[3])
+
+		// Something matches, so it isn't
+		res = query(ii[4:], QueryContentsFilter{ContentsFilter: nzBig, SkipTo: &ptr})
+		assert.Equal(t, []ID{ii[5]}, res.IDs)
+		assert.Equal(t, []uint64{0}, res.Counts)
+		assertPtr(ii[3])
+
+		// The pointer is never moved backwards
+		res = query(ii[1:3], QueryContentsFilter{ContentsFilter: nzBig, SkipTo: &ptr})
+		assert.Equal(t, []uint64{2}, res.Counts)
+		assertPtr(ii[3])
+	}
+}
+
 func TestQueryIDs(t *T) {
 	base := testutil.RandStr()
 	k := randKey(base)
@@ -548,7 +788,7 @@ func TestQueryIDs(t *T) {
 		requireNewID(t),
 	}
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -567,7 +807,7 @@ func TestQueryIDs(t *T) {
 func TestQueryEmpty(t *T) {
 	base := testutil.RandStr()
 	k := randKey(base)
-	res, err := testCore.Query(QueryActions{
+	res, err := testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -603,7 +843,7 @@ func TestQueryUnion(t *T) {
 	assert.True(t, iiU[1].T < iiU[2].T)
 
 	// First test that previous output is overwritten without Union
-	res, err := testCore.Query(QueryActions{
+	res, err := testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -623,7 +863,7 @@ func TestQueryUnion(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, iiB, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -651,7 +891,7 @@ func TestQueryBreak(t *T) {
 	iiA := []ID{requireNewID(t)}
 	iiB := []ID{requireNewID(t)}
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -674,7 +914,7 @@ func TestQueryBreak(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, iiA, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -699,13 +939,67 @@ func TestQueryBreak(t *T) {
 	assert.Equal(t, iiB, res.IDs)
 }
 
+func testQueryExplain(t *T, c *Core) {
+	base := testutil.RandStr()
+	k, kEmpty := randKey(base), randKey(base)
+	ii := []ID{requireNewID(t), requireNewID(t)}
+
+	qas := QueryActions{
+		KeyBase: base,
+		QueryActions: []QueryAction{
+			{QuerySelector: &QuerySelector{IDs: ii}},
+			{QueryAddTo: &QueryAddTo{Keys: []Key{k}}},
+			{
+				QuerySelector: &QuerySelector{
+					Key:              kEmpty,
+					QueryRangeSelect: &QueryRangeSelect{},
+				},
+			},
+			{
+				QuerySelector:    &QuerySelector{Key: k, IDs: ii[:1]},
+				QueryConditional: QueryConditional{IfNotEmpty: &kEmpty},
+			},
+			{
+				Break:            true,
+				QueryConditional: QueryConditional{IfNoInput: true},
+			},
+			{QuerySelector: &QuerySelector{IDs: ii}},
+		},
+	}
+
+	res, err := c.Query(testCtx, qas)
+	require.Nil(t, err)
+	assert.Empty(t, res.IDs)
+	assert.Nil(t, res.Explain)
+
+	qas.Explain = true
+	res, err = c.Query(testCtx, qas)
+	require.Nil(t, err)
+	assert.Empty(t, res.IDs)
+	assert.Equal(t, []QueryExplainStep{
+		{QueryAction: qas.QueryActions[0], In: 0, Out: 2},
+		{QueryAction: qas.QueryActions[1], In: 2, Out: 2},
+		{QueryAction: qas.QueryActions[2], In: 2, Out: 0},
+		{QueryAction: qas.QueryActions[3], Skipped: true, In: 0, Out: 0},
+		{QueryAction: qas.QueryActions[4], Broke: true, In: 0, Out: 0},
+	}, res.Explain)
+
+	assert.Equal(t, "QuerySelector(QueryRangeSelect) "+kEmpty.String("")+" in=2 out=0", res.Explain[2].String())
+	assert.Equal(t, "QuerySelector(IDs) n=1 in=0 out=0 skipped", res.Explain[3].String())
+	assert.Equal(t, "Break in=0 out=0 break", res.Explain[4].String())
+}
+
+func TestQueryExplain(t *T) {
+	testQueryExplain(t, testCore)
+}
+
 func TestQueryConditionals(t *T) {
 	base := testutil.RandStr()
 	keyFull, _ := randPopulatedKey(t, base, 5)
 	keyEmpty := randKey(base)
 	id := requireNewID(t)
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testCore.Query(testCtx, QueryActions{
 		KeyBase: base,
 		QueryActions: []QueryAction{
 			{
@@ -721,7 +1015,7 @@ func TestQueryConditionals(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, id, res.IDs[0])
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: base,
 		QueryActions: []QueryAction{
 			{
@@ -737,7 +1031,7 @@ func TestQueryConditionals(t *T) {
 	require.Nil(t, err)
 	assert.Empty(t, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: base,
 		QueryActions: []QueryAction{
 			{
@@ -760,7 +1054,7 @@ func TestQueryConditionals(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, id, res.IDs[0])
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: base,
 		QueryActions: []QueryAction{
 			{
@@ -791,7 +1085,7 @@ func TestQueryCount(t *T) {
 	qsr := QueryScoreRange{}
 
 	assertCounts := func(a, b uint64) {
-		res, err := testCore.Query(QueryActions{
+		res, err := testCore.Query(testCtx, QueryActions{
 			KeyBase: base,
 			QueryActions: []QueryAction{
 				{
@@ -820,7 +1114,7 @@ func TestQueryCount(t *T) {
 	qsr.MaxExcl = true
 	assertCounts(3, 0)
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testCore.Query(testCtx, QueryActions{
 		KeyBase: base,
 		QueryActions: []QueryAction{
 			{
@@ -841,6 +1135,27 @@ func TestQueryCount(t *T) {
 	assert.Equal(t, uint64(3), res.Counts[0])
 }
 
+func TestQueryScoresFrom(t *T) {
+	base := testutil.RandStr()
+	k1, ii := randPopulatedKey(t, base, 2)
+	ii = append(ii, requireNewID(t))
+
+	res, err := testCore.Query(testCtx, QueryActions{
+		KeyBase: base,
+		QueryActions: []QueryAction{
+			{
+				QuerySelector: &QuerySelector{IDs: ii},
+			},
+			{
+				ScoresFrom: &k1,
+			},
+		},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ii, res.IDs)
+	assert.Equal(t, []uint64{uint64(ii[0].T), uint64(ii[1].T), 0}, res.Counts)
+}
+
 func TestKeyScan(t *T) {
 	base1 := testutil.RandStr()
 	base2 := testutil.RandStr()
@@ -850,10 +1165,10 @@ func TestKeyScan(t *T) {
 	k22, _ := randPopulatedKey(t, base2, 1)
 
 	assertScan := func(pattern Key, kk ...Key) {
-		found, err := testCore.KeyScan(pattern)
+		found, err := testCore.KeyScan(testCtx, pattern)
 		require.Nil(t, err)
 		for _, k := range found {
-			assert.Contains(t, kk, k, "k.String():%q", k.String(testCore.o.RedisPrefix))
+			assert.Contains(t, kk, k, "k.String():%q", k.String(testRedis.o.RedisPrefix))
 		}
 	}
 
@@ -863,12 +1178,203 @@ func TestKeyScan(t *T) {
 	assertScan(Key{Base: "*"}, k11, k12, k21, k22)
 }
 
+func testKeyPage(t *T, c *Core) {
+	base := testutil.RandStr()
+	k := randKey(base)
+	now := NewTS(time.Now())
+	tt, err := c.MonoTSs(testCtx, now, 5)
+	require.Nil(t, err)
+	ii := make([]ID, len(tt))
+	for i := range tt {
+		ii[i] = ID{T: tt[i], Expire: tt[i] + NewTS(time.Unix(60, 0))}
+	}
+
+	// The last three IDs all have the same score, so they'll have to be split
+	// across pages using the cursor's Offset
+	scores := []TS{ii[1].T, ii[0].T, ii[4].T, ii[4].T, ii[4].T}
+	for i := range ii {
+		_, err := c.Query(testCtx, QueryActions{
+			KeyBase: base,
+			QueryActions: []QueryAction{
+				{QuerySelector: &QuerySelector{IDs: ii[i : i+1]}},
+				{QueryAddTo: &QueryAddTo{Keys: []Key{k}, Score: scores[i]}},
+			},
+		})
+		require.Nil(t, err)
+	}
+
+	var cur PageCursor
+	var gotII []ID
+	var gotScores []TS
+	for {
+		p, err := c.KeyPage(testCtx, k, cur, 2)
+		require.Nil(t, err)
+		assert.True(t, len(p.IDs) <= 2)
+		gotII = append(gotII, p.IDs...)
+		gotScores = append(gotScores, p.Scores...)
+		if p.Done {
+			break
+		}
+		cur = p.Next
+	}
+
+	assert.Equal(t, []TS{ii[0].T, ii[1].T, ii[4].T, ii[4].T, ii[4].T}, gotScores)
+	require.Len(t, gotII, len(ii))
+	assert.Equal(t, []ID{ii[1], ii[0]}, gotII[:2])
+	assert.ElementsMatch(t, ii[2:], gotII[2:])
+
+	_, err = c.KeyPage(testCtx, k, PageCursor{}, 0)
+	assert.NotNil(t, err)
+}
+
+func TestKeyPage(t *T) {
+	testKeyPage(t, testCore)
+}
+
+func TestQueryHash(t *T) {
+	base := testutil.RandStr()
+	k := randKey(base)
+	ii := []ID{requireNewID(t), requireNewID(t), requireNewID(t)}
+
+	query := func(qa QueryAction, ii ...ID) {
+		_, err := testCore.Query(testCtx, QueryActions{
+			KeyBase: base,
+			QueryActions: []QueryAction{
+				{
+					QuerySelector: &QuerySelector{IDs: ii},
+				},
+				qa,
+			},
+		})
+		require.Nil(t, err)
+	}
+
+	assertHash := func(expect ...string) {
+		vals, err := testCore.HashGetIDs(testCtx, k, ii)
+		require.Nil(t, err)
+		assert.Equal(t, expect, vals)
+	}
+
+	assertHash("", "", "")
+
+	query(QueryAction{QueryHashSet: &QueryHashSet{Key: k, Value: "foo"}}, ii[0], ii[1])
+	assertHash("foo", "foo", "")
+
+	query(QueryAction{QueryHashSet: &QueryHashSet{Key: k, Value: "bar"}}, ii[1], ii[2])
+	assertHash("foo", "bar", "bar")
+
+	query(QueryAction{HashDel: &k}, ii[0], ii[1])
+	assertHash("", "", "bar")
+}
+
+func TestHashSetAll(t *T) {
+	k := randKey(testutil.RandStr())
+
+	m, err := testCore.HashGetAll(testCtx, k)
+	require.Nil(t, err)
+	assert.Empty(t, m)
+
+	m1 := map[string]string{"foo": "a", "bar": "b"}
+	require.Nil(t, testCore.HashSetAll(testCtx, k, m1))
+	m, err = testCore.HashGetAll(testCtx, k)
+	require.Nil(t, err)
+	assert.Equal(t, m1, m)
+
+	// Fields not given are removed
+	m2 := map[string]string{"foo": "c"}
+	require.Nil(t, testCore.HashSetAll(testCtx, k, m2))
+	m, err = testCore.HashGetAll(testCtx, k)
+	require.Nil(t, err)
+	assert.Equal(t, m2, m)
+
+	require.Nil(t, testCore.HashSetAll(testCtx, k, nil))
+	m, err = testCore.HashGetAll(testCtx, k)
+	require.Nil(t, err)
+	assert.Empty(t, m)
+}
+
+func TestQueryRateLimit(t *T) {
+	base := testutil.RandStr()
+	k := randKey(base)
+	ii := []ID{requireNewID(t), requireNewID(t), requireNewID(t)}
+
+	assertLimited := func(expect ...ID) {
+		res, err := testCore.Query(testCtx, QueryActions{
+			KeyBase: base,
+			QueryActions: []QueryAction{
+				{
+					QuerySelector: &QuerySelector{IDs: ii},
+				},
+				{
+					RateLimit: &k,
+				},
+			},
+		})
+		require.Nil(t, err)
+		if expect == nil {
+			expect = []ID{}
+		}
+		assert.Equal(t, expect, res.IDs)
+	}
+
+	// No rate means no limit
+	assertLimited(ii...)
+
+	require.Nil(t, testCore.HashSetAll(testCtx, k, map[string]string{
+		"rate":  "2",
+		"burst": "2",
+	}))
+	assertLimited(ii[:2]...)
+	assertLimited()
+
+	time.Sleep(600 * time.Millisecond)
+	assertLimited(ii[0])
+}
+
+func TestSetGetString(t *T) {
+	k := randKey(testutil.RandStr())
+
+	_, err := testCore.GetString(testCtx, k)
+	assert.Equal(t, ErrNotFound, err)
+
+	require.Nil(t, testCore.SetString(testCtx, k, "foo", 500*time.Millisecond))
+	val, err := testCore.GetString(testCtx, k)
+	require.Nil(t, err)
+	assert.Equal(t, "foo", val)
+
+	time.Sleep(600 * time.Millisecond)
+	_, err = testCore.GetString(testCtx, k)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestSetIDNX(t *T) {
+	k := randKey(testutil.RandStr())
+	id1 := requireNewID(t)
+	id2 := requireNewID(t)
+
+	id, set, err := testCore.SetIDNX(testCtx, k, id1, 500*time.Millisecond)
+	require.Nil(t, err)
+	assert.True(t, set)
+	assert.Equal(t, id1, id)
+
+	id, set, err = testCore.SetIDNX(testCtx, k, id2, 500*time.Millisecond)
+	require.Nil(t, err)
+	assert.False(t, set)
+	assert.Equal(t, id1, id)
+
+	time.Sleep(600 * time.Millisecond)
+	id, set, err = testCore.SetIDNX(testCtx, k, id2, 500*time.Millisecond)
+	require.Nil(t, err)
+	assert.True(t, set)
+	assert.Equal(t, id2, id)
+}
+
 func TestSingleGetSet(t *T) {
 	key := randKey(testutil.RandStr())
 	id := requireNewID(t)
 
 	// Setting returns the ID
-	res, err := testCore.Query(QueryActions{
+	res, err := testCore.Query(testCtx, QueryActions{
 		KeyBase: key.Base,
 		QueryActions: []QueryAction{
 			{
@@ -887,7 +1393,7 @@ func TestSingleGetSet(t *T) {
 	assert.Equal(t, id, res.IDs[0])
 
 	// Getting a set ID returns it
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: key.Base,
 		QueryActions: []QueryAction{
 			{
@@ -899,7 +1405,7 @@ func TestSingleGetSet(t *T) {
 	assert.Equal(t, id, res.IDs[0])
 
 	// Getting a set ID after the expire doesn't return it
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		Now:     id.Expire + 1,
 		KeyBase: key.Base,
 		QueryActions: []QueryAction{
@@ -914,7 +1420,7 @@ func TestSingleGetSet(t *T) {
 	// Trying to put an older ID with IfNewer results in no change
 	id2 := id
 	id2.T -= 5
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: key.Base,
 		QueryActions: []QueryAction{
 			{
@@ -933,7 +1439,7 @@ func TestSingleGetSet(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, id2, res.IDs[0])
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: key.Base,
 		QueryActions: []QueryAction{
 			{
@@ -944,8 +1450,77 @@ func TestSingleGetSet(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, id, res.IDs[0])
 
+	// Using Newest with multiple IDs sets the newest one
+	id3, id4 := requireNewID(t), requireNewID(t)
+	res, err = testCore.Query(testCtx, QueryActions{
+		KeyBase: key.Base,
+		QueryActions: []QueryAction{
+			{
+				QuerySelector: &QuerySelector{
+					IDs: []ID{id3, id4},
+				},
+			},
+			{
+				QuerySingleSet: &QuerySingleSet{
+					Key:     key,
+					IfNewer: true,
+					Newest:  true,
+				},
+			},
+			{
+				SingleGet: &key,
+			},
+		},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []ID{id4}, res.IDs)
+
+	// Using ScoreFrom stores the ID with its score from another key, or nothing
+	// if the ID isn't in that key
+	scoreKey := randKey(key.Base)
+	id5, id6 := requireNewID(t), requireNewID(t)
+	res, err = testCore.Query(testCtx, QueryActions{
+		KeyBase: key.Base,
+		QueryActions: []QueryAction{
+			{
+				QuerySelector: &QuerySelector{
+					IDs: []ID{id5},
+				},
+			},
+			{
+				QueryAddTo: &QueryAddTo{
+					Keys:  []Key{scoreKey},
+					Score: id6.T + 10,
+				},
+			},
+			{
+				QuerySingleSet: &QuerySingleSet{
+					Key:       key,
+					IfNewer:   true,
+					ScoreFrom: &scoreKey,
+				},
+			},
+			{
+				QuerySelector: &QuerySelector{
+					IDs: []ID{id6},
+				},
+			},
+			{
+				QuerySingleSet: &QuerySingleSet{
+					Key:       key,
+					ScoreFrom: &scoreKey,
+				},
+			},
+			{
+				SingleGet: &key,
+			},
+		},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []ID{{T: id6.T + 10, Expire: id5.Expire}}, res.IDs)
+
 	// Make sure delete works, here works as well as anywhere to test it
-	res, err = testCore.Query(QueryActions{
+	res, err = testCore.Query(testCtx, QueryActions{
 		KeyBase: key.Base,
 		QueryActions: []QueryAction{
 			{
@@ -959,3 +1534,60 @@ func TestSingleGetSet(t *T) {
 	require.Nil(t, err)
 	assert.Empty(t, res.IDs)
 }
+
+type countingCmder struct {
+	util.Cmder
+	n int64
+}
+
+func (cc *countingCmder) Cmd(cmd string, args ...interface{}) *redis.Resp {
+	atomic.AddInt64(&cc.n, 1)
+	return cc.Cmder.Cmd(cmd, args...)
+}
+
+type countingWrapper struct {
+	countingCmder
+}
+
+func (cw *countingWrapper) Unwrap() util.Cmder {
+	return cw.Cmder
+}
+
+func TestWrapper(t *T) {
+	p, err := pool.New("tcp", "127.0.0.1:6379", 1)
+	require.Nil(t, err)
+
+	// Without Unwrap the Core can't know where redis is
+	cc := &countingCmder{Cmder: p}
+	c := New(cc, &Opts{RedisPrefix: testutil.RandStr()})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	assert.NotNil(t, <-c.Run(stopCh))
+
+	// ...unless it's told
+	c = New(cc, &Opts{
+		RedisPrefix: testutil.RandStr(),
+		PubSubAddr:  "127.0.0.1:6379",
+	})
+	errCh := c.Run(stopCh)
+	_, err = c.MonoTS(testCtx, NewTS(time.Now()))
+	require.Nil(t, err)
+	assert.NotZero(t, atomic.LoadInt64(&cc.n))
+	select {
+	case err := <-errCh:
+		t.Fatalf("Run returned error: %s", err)
+	default:
+	}
+
+	cw := &countingWrapper{countingCmder{Cmder: p}}
+	c = New(cw, &Opts{RedisPrefix: testutil.RandStr()})
+	errCh = c.Run(stopCh)
+	_, err = c.MonoTS(testCtx, NewTS(time.Now()))
+	require.Nil(t, err)
+	assert.NotZero(t, atomic.LoadInt64(&cw.n))
+	select {
+	case err := <-errCh:
+		t.Fatalf("Run returned error: %s", err)
+	default:
+	}
+}
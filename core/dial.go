@@ -0,0 +1,154 @@
+package core
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/cluster"
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/mediocregopher/radix.v2/util"
+)
+
+// DialOpts describe how connections to redis are made. The zero value makes
+// plain tcp connections without authentication or timeouts.
+type DialOpts struct {
+	// Optional. If set connections are made over TLS using this config. When
+	// using a cluster or sentinel connections are made to the addresses redis
+	// reports for its instances, which are usually IPs, so ServerName will
+	// need to be set for the server's certificate to be verified.
+	TLSConfig *tls.Config
+
+	// Optional. If Password is set every connection is authenticated using
+	// AUTH. Username may only be set alongside Password, and requires redis 6
+	// or later.
+	Username string
+	Password string
+
+	// Default 0. The database every connection SELECTs. Must be 0 when using a
+	// cluster.
+	DB int
+
+	// Default 0, meaning no timeout. How long to wait for a connection to be
+	// made, including the TLS handshake, authentication and selecting the
+	// database.
+	DialTimeout time.Duration
+
+	// Default 0, meaning no timeout. How long to wait for each command to be
+	// written to and read from redis. Connections which time out are closed.
+	// The pubsub connection used by Run ignores these.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Optional. Tunes the Pool which Dial returns when connecting to a single
+	// instance. Ignored when connecting to a cluster, and by NewSentinel and
+	// Run.
+	Pool PoolOpts
+}
+
+// dialConn makes a new connection to addr, authenticated and with the database
+// selected. The read and write timeouts are left to the user of the connection,
+// since pubsub connections handle their own.
+func (o DialOpts) dialConn(network, addr string) (net.Conn, error) {
+	if o.Username != "" && o.Password == "" {
+		return nil, errors.New("Username may not be set without Password")
+	}
+
+	d := &net.Dialer{Timeout: o.DialTimeout}
+	var conn net.Conn
+	var err error
+	if o.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(d, network, addr, o.TLSConfig)
+	} else {
+		conn, err = d.Dial(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var setup [][]string
+	if o.Username != "" {
+		setup = append(setup, []string{"AUTH", o.Username, o.Password})
+	} else if o.Password != "" {
+		setup = append(setup, []string{"AUTH", o.Password})
+	}
+	if o.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(o.DB)})
+	}
+
+	if o.DialTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(o.DialTimeout))
+	}
+
+	// Nothing else is written to the connection until these are responded to,
+	// so it's safe for the RespReader to be thrown away afterwards
+	rr := redis.NewRespReader(conn)
+	for _, cmd := range setup {
+		if _, err := redis.NewResp(cmd).WriteTo(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if r := rr.Read(); r.Err != nil {
+			conn.Close()
+			return nil, r.Err
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// DialFunc returns a function which makes new connections according to the
+// DialOpts. It can be used with NewPool or pool.NewCustom, or as the Dialer in
+// cluster.Opts.
+func (o DialOpts) DialFunc() func(network, addr string) (*redis.Client, error) {
+	return func(network, addr string) (*redis.Client, error) {
+		conn, err := o.dialConn(network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := redis.NewClient(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		client.ReadTimeout = o.ReadTimeout
+		client.WriteTimeout = o.WriteTimeout
+		return client, nil
+	}
+}
+
+// Dial connects to the redis instance at addr using the DialOpts. If the
+// instance is part of a cluster a *cluster.Cluster is returned, otherwise a
+// *Pool is. poolSize is the number of connections kept to each instance.
+//
+// The same DialOpts should be given in the Opts passed to New, so that the
+// Core's pubsub connection is made in the same way.
+func Dial(addr string, poolSize int, o DialOpts) (util.Cmder, error) {
+	df := o.DialFunc()
+	conn, err := df("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if r := conn.Cmd("CLUSTER", "SLOTS"); r.IsType(redis.IOErr) {
+		return nil, r.Err
+	} else if r.IsType(redis.AppErr) {
+		// Cluster support is disabled
+		p, err := NewPool("tcp", addr, poolSize, df, o.Pool)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+
+	return cluster.NewWithOpts(cluster.Opts{
+		Addr:     addr,
+		PoolSize: poolSize,
+		Dialer:   df,
+	})
+}
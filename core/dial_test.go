@@ -0,0 +1,29 @@
+package core
+
+import (
+	. "testing"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDial(t *T) {
+	cmder, err := Dial("127.0.0.1:6379", 1, DialOpts{})
+	require.Nil(t, err)
+	assert.IsType(t, &Pool{}, cmder)
+
+	// Keys set in one database aren't visible from another
+	cmder1, err := Dial("127.0.0.1:6379", 1, DialOpts{DB: 1})
+	require.Nil(t, err)
+	k := testutil.RandStr()
+	require.Nil(t, cmder1.Cmd("SET", k, "foo", "PX", 1000).Err)
+	s, err := cmder1.Cmd("GET", k).Str()
+	require.Nil(t, err)
+	assert.Equal(t, "foo", s)
+	assert.True(t, cmder.Cmd("GET", k).IsType(redis.Nil))
+
+	_, err = Dial("127.0.0.1:6379", 1, DialOpts{Username: "foo"})
+	assert.NotNil(t, err)
+}
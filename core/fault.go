@@ -0,0 +1,268 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The errors injected by a Fault when it doesn't specify one. They're both
+// treated as transient by WithRetry, ErrFaultInjected as if the operation
+// definitely wasn't performed and ErrFaultDropped as if it may have been.
+var (
+	ErrFaultInjected = errors.New("injected fault")
+	ErrFaultDropped  = errors.New("injected fault: response dropped")
+)
+
+// FaultKind is what a Fault does to the operations it's injected into
+type FaultKind int
+
+// All possible FaultKind values
+const (
+	// The operation fails without being performed
+	FaultError FaultKind = iota
+
+	// The operation is performed, but fails as though its response was lost
+	FaultDrop
+
+	// The operation is performed after waiting for the Fault's Delay, or
+	// fails with the context's error if it's done first
+	FaultDelay
+)
+
+// Fault describes a failure which a FaultInjector injects into operations, so
+// that tests can check how bananaq (and what's using it) behaves when redis
+// partially fails, e.g. that events whose acks are lost are redelivered.
+type Fault struct {
+	Kind FaultKind
+
+	// Optional. Names of the operations the Fault may be injected into, as
+	// used for Stat.Name, e.g. "Query" or "SetEvents". If empty it may be
+	// injected into any of them.
+	Ops []string
+
+	// Optional. If set the Fault is only injected into operations on Keys with
+	// this Base, as used for Stat.Queue.
+	Queue string
+
+	// Between 0 and 1. The chance of the Fault being injected into each
+	// operation it applies to.
+	Probability float64
+
+	// How long FaultDelay delays operations for
+	Delay time.Duration
+
+	// Optional. The error which FaultError and FaultDrop fail operations with.
+	// Defaults to ErrFaultInjected or ErrFaultDropped, respectively.
+	Err error
+}
+
+func (f Fault) appliesTo(op, queue string) bool {
+	if f.Queue != "" && f.Queue != queue {
+		return false
+	} else if len(f.Ops) == 0 {
+		return true
+	}
+	for _, o := range f.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// FaultInjector injects Faults into the operations of any Backend wrapped with
+// it using WithFaults, or of the redis Backend when given in Opts. Its Faults
+// may be changed at any point, e.g. to let a test set up a queue normally
+// before making redis flaky. It's only meant for use in tests.
+type FaultInjector struct {
+	l        sync.Mutex
+	ff       []Fault
+	rand     *rand.Rand
+	injected int
+}
+
+// NewFaultInjector returns a FaultInjector which injects the given Faults.
+// Each operation has each Fault which applies to it injected in turn, until
+// one fails it.
+func NewFaultInjector(ff ...Fault) *FaultInjector {
+	return &FaultInjector{
+		ff:   ff,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Set replaces the Faults being injected. Calling it with none stops any from
+// being injected.
+func (fi *FaultInjector) Set(ff ...Fault) {
+	fi.l.Lock()
+	defer fi.l.Unlock()
+	fi.ff = ff
+}
+
+// Injected returns how many times a Fault has been injected so far
+func (fi *FaultInjector) Injected() int {
+	fi.l.Lock()
+	defer fi.l.Unlock()
+	return fi.injected
+}
+
+// returns the Faults to inject into an operation, which end at the first one
+// which fails it
+func (fi *FaultInjector) roll(op, queue string) []Fault {
+	fi.l.Lock()
+	defer fi.l.Unlock()
+	var ff []Fault
+	for _, f := range fi.ff {
+		if !f.appliesTo(op, queue) || fi.rand.Float64() >= f.Probability {
+			continue
+		}
+		ff = append(ff, f)
+		fi.injected++
+		if f.Kind != FaultDelay {
+			break
+		}
+	}
+	return ff
+}
+
+// do performs fn, injecting whichever Faults are rolled for it
+func (fi *FaultInjector) do(ctx context.Context, op, queue string, fn func() error) error {
+	for _, f := range fi.roll(op, queue) {
+		switch f.Kind {
+		case FaultError:
+			if f.Err == nil {
+				return ErrFaultInjected
+			}
+			return f.Err
+		case FaultDrop:
+			fn()
+			if f.Err == nil {
+				return ErrFaultDropped
+			}
+			return f.Err
+		case FaultDelay:
+			select {
+			case <-time.After(f.Delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return fn()
+}
+
+// WithFaults returns a Backend which passes all calls through to the given one,
+// injecting the FaultInjector's Faults into them. Run, KeyWait and KeySubscribe
+// are passed through untouched. New does this automatically when Opts.Faults
+// is set.
+func WithFaults(b Backend, fi *FaultInjector) Backend {
+	return faultBackend{Backend: b, fi: fi}
+}
+
+type faultBackend struct {
+	Backend
+	fi *FaultInjector
+}
+
+func (fb faultBackend) MonoTSs(ctx context.Context, t TS, n int) ([]TS, error) {
+	var tt []TS
+	err := fb.fi.do(ctx, "MonoTSs", "", func() (err error) {
+		tt, err = fb.Backend.MonoTSs(ctx, t, n)
+		return err
+	})
+	return tt, err
+}
+
+func (fb faultBackend) SetEvents(ctx context.Context, ee []Event, expireBuffer time.Duration) error {
+	return fb.fi.do(ctx, "SetEvents", "", func() error {
+		return fb.Backend.SetEvents(ctx, ee, expireBuffer)
+	})
+}
+
+func (fb faultBackend) GetEvents(ctx context.Context, ii []ID) ([]Event, error) {
+	var ee []Event
+	err := fb.fi.do(ctx, "GetEvents", "", func() (err error) {
+		ee, err = fb.Backend.GetEvents(ctx, ii)
+		return err
+	})
+	return ee, err
+}
+
+func (fb faultBackend) Query(ctx context.Context, qas QueryActions) (QueryRes, error) {
+	var res QueryRes
+	err := fb.fi.do(ctx, "Query", qas.KeyBase, func() (err error) {
+		res, err = fb.Backend.Query(ctx, qas)
+		return err
+	})
+	return res, err
+}
+
+func (fb faultBackend) KeyScan(ctx context.Context, k Key) ([]Key, error) {
+	var kk []Key
+	err := fb.fi.do(ctx, "KeyScan", k.Base, func() (err error) {
+		kk, err = fb.Backend.KeyScan(ctx, k)
+		return err
+	})
+	return kk, err
+}
+
+func (fb faultBackend) HashGetIDs(ctx context.Context, k Key, ii []ID) ([]string, error) {
+	var vv []string
+	err := fb.fi.do(ctx, "HashGetIDs", k.Base, func() (err error) {
+		vv, err = fb.Backend.HashGetIDs(ctx, k, ii)
+		return err
+	})
+	return vv, err
+}
+
+func (fb faultBackend) HashSetAll(ctx context.Context, k Key, m map[string]string) error {
+	return fb.fi.do(ctx, "HashSetAll", k.Base, func() error {
+		return fb.Backend.HashSetAll(ctx, k, m)
+	})
+}
+
+func (fb faultBackend) HashGetAll(ctx context.Context, k Key) (map[string]string, error) {
+	var m map[string]string
+	err := fb.fi.do(ctx, "HashGetAll", k.Base, func() (err error) {
+		m, err = fb.Backend.HashGetAll(ctx, k)
+		return err
+	})
+	return m, err
+}
+
+func (fb faultBackend) SetString(ctx context.Context, k Key, val string, ttl time.Duration) error {
+	return fb.fi.do(ctx, "SetString", k.Base, func() error {
+		return fb.Backend.SetString(ctx, k, val, ttl)
+	})
+}
+
+func (fb faultBackend) GetString(ctx context.Context, k Key) (string, error) {
+	var s string
+	err := fb.fi.do(ctx, "GetString", k.Base, func() (err error) {
+		s, err = fb.Backend.GetString(ctx, k)
+		return err
+	})
+	return s, err
+}
+
+func (fb faultBackend) SetIDNX(ctx context.Context, k Key, id ID, ttl time.Duration) (ID, bool, error) {
+	var curID ID
+	var set bool
+	err := fb.fi.do(ctx, "SetIDNX", k.Base, func() (err error) {
+		curID, set, err = fb.Backend.SetIDNX(ctx, k, id, ttl)
+		return err
+	})
+	return curID, set, err
+}
+
+// A KeyNotify which fails is simply never sent, as it would be if the publish
+// to redis failed
+func (fb faultBackend) KeyNotify(ctx context.Context, k Key) {
+	fb.fi.do(ctx, "KeyNotify", k.Base, func() error {
+		fb.Backend.KeyNotify(ctx, k)
+		return nil
+	})
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"context"
+	"errors"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaults(t *T) {
+	mem := NewMemBackend()
+	k := Key{Base: testutil.RandStr()}
+	fi := NewFaultInjector(Fault{Kind: FaultError, Ops: []string{"SetString"}, Probability: 1})
+	b := WithFaults(mem, fi)
+
+	// FaultError fails without performing the operation, and only applies to
+	// the given Ops
+	assert.Equal(t, ErrFaultInjected, b.SetString(testCtx, k, "foo", time.Minute))
+	_, err := b.GetString(testCtx, k)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, 1, fi.Injected())
+
+	// FaultDrop performs it before failing
+	fi.Set(Fault{Kind: FaultDrop, Queue: k.Base, Probability: 1})
+	assert.Equal(t, ErrFaultDropped, b.SetString(testCtx, k, "foo", time.Minute))
+	s, err := mem.GetString(testCtx, k)
+	require.Nil(t, err)
+	assert.Equal(t, "foo", s)
+
+	// Faults for other Queues, or which aren't rolled, aren't injected
+	fi.Set(
+		Fault{Kind: FaultError, Queue: testutil.RandStr(), Probability: 1},
+		Fault{Kind: FaultError, Probability: 0},
+	)
+	_, err = b.GetString(testCtx, k)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, fi.Injected())
+
+	// FaultDelay delays, and gives up if the context is done first
+	fi.Set(Fault{Kind: FaultDelay, Delay: 50 * time.Millisecond, Probability: 1})
+	start := time.Now()
+	_, err = b.GetString(testCtx, k)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	ctx, cancel := context.WithTimeout(testCtx, 10*time.Millisecond)
+	defer cancel()
+	_, err = b.GetString(ctx, k)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// Custom errors are used as given
+	myErr := errors.New("foo")
+	fi.Set(Fault{Kind: FaultError, Probability: 1, Err: myErr})
+	_, err = b.GetString(testCtx, k)
+	assert.Equal(t, myErr, err)
+
+	// Retries see the injected errors as transient, only retrying dropped ones
+	// if the operation is idempotent
+	rp := &RetryPolicy{MaxRetries: 1, MinBackoff: time.Millisecond}
+	fi.Set(Fault{Kind: FaultDrop, Probability: 0.5})
+	c := NewWithBackend(WithRetry(b, rp))
+	qas := QueryActions{KeyBase: k.Base}
+	var dropped, readsFailed int
+	for i := 0; i < 100; i++ {
+		if _, err := c.Query(testCtx, qas); err == ErrFaultDropped {
+			dropped++
+		}
+		if _, err := c.GetString(testCtx, k); err != nil {
+			readsFailed++
+		}
+	}
+	assert.True(t, dropped > 25 && dropped < 75, "dropped:%d", dropped)
+	assert.True(t, readsFailed < 50, "readsFailed:%d", readsFailed)
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"context"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/cluster"
+	"github.com/mediocregopher/radix.v2/pool"
+)
+
+// Health describes the state of the Core's connection to its Backend, as
+// returned by Health
+type Health struct {
+	// How long the round trip to the Backend took
+	Latency time.Duration
+
+	// How far ahead of the local clock (the Core's Clock) the TS handed out by
+	// the Backend was.
+	// TSs are kept monotonic across every process sharing the Backend, so if
+	// this is large then some process's clock is ahead of the others (or this
+	// one's is behind), and IDs are being generated for the wrong time.
+	ClockSkew time.Duration
+
+	// The number of idle connections in the Cmder's pool(s), or -1 if it's not
+	// known for the kind of Cmder being used (or there isn't one). Zero means
+	// every pooled connection is in use, and new ones are being made as
+	// needed, or waited for if the pool has a MaxActive.
+	PoolAvail int
+
+	// Only set if the Cmder is a *Pool, see PoolStats
+	PoolStats *PoolStats
+}
+
+// Health checks that the Backend can be reached and returns information about
+// the connection to it. An error is returned if the Backend couldn't be
+// reached. Checking involves handing out a TS, as MonoTS does.
+func (c *Core) Health(ctx context.Context) (Health, error) {
+	h := Health{PoolAvail: -1}
+	if ps, ok := c.PoolStats(); ok {
+		h.PoolAvail = ps.Idle
+		h.PoolStats = &ps
+	}
+	switch inner := c.inner.(type) {
+	case *pool.Pool:
+		h.PoolAvail = inner.Avail()
+	case *cluster.Cluster:
+		h.PoolAvail = 0
+		for _, avail := range inner.GetEveryAvail() {
+			h.PoolAvail += avail
+		}
+	}
+
+	now := NewTS(c.clock.Now())
+	start := time.Now()
+	tt, err := c.b.MonoTSs(ctx, now, 1)
+	if err != nil {
+		return h, err
+	}
+	h.Latency = time.Since(start)
+	h.ClockSkew = tt[0].Time().Sub(now.Time())
+	return h, nil
+}
+
+// PoolStats returns the stats of the Cmder's pool, if the Cmder given to New
+// (once unwrapped, see Wrapper) is a *Pool, e.g. one returned by Dial.
+// Otherwise false is returned.
+func (c *Core) PoolStats() (PoolStats, bool) {
+	p, ok := c.inner.(*Pool)
+	if !ok {
+		return PoolStats{}, false
+	}
+	return p.Stats(), true
+}
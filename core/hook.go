@@ -0,0 +1,190 @@
+package core
+
+import (
+	"context"
+	"time"
+)
+
+// Hook receives a Stat for every operation performed, and may be used to
+// collect metrics like latencies and error rates, e.g. for prometheus, statsd
+// or expvar. Observe is called inline once each operation completes, so it must
+// be safe to call from multiple goroutines and should return quickly.
+//
+// Core reports a Stat for every call it makes to its Backend, named after the
+// Backend method (e.g. "Query"). Peel, which uses the same Hook, additionally
+// reports one for every command, named after the command's method (e.g.
+// "QAdd").
+type Hook interface {
+	Observe(s Stat)
+}
+
+// Stat describes a single operation which was performed
+type Stat struct {
+	Name string
+
+	// The queue the operation was for, if any. For Core operations on a Key
+	// this is the Key's Base, which Peel sets to the queue's name.
+	Queue string
+
+	// The consumer group the operation was for, if any. Only set for Peel
+	// commands.
+	ConsumerGroup string
+
+	Duration time.Duration
+
+	// Set if the operation failed
+	Err error
+
+	// The number of events, ids or keys which were returned or affected, where
+	// applicable
+	Count int
+}
+
+// Tracer is used to trace operations, e.g. by creating OpenTelemetry spans for
+// them. It's told about the same operations as a Hook, but is also told when
+// each one starts, and can carry trace context from the producer of an event to
+// its consumers.
+type Tracer interface {
+	// Start is called as each operation starts, with a Stat which only has
+	// Name, Queue and ConsumerGroup set. The returned context is used for the
+	// rest of the operation, so operations performed as part of it will be
+	// started with it. The returned function is called with the completed
+	// Stat once the operation is done.
+	Start(ctx context.Context, s Stat) (context.Context, func(Stat))
+
+	// Inject returns the trace context from ctx in a serialized form, which is
+	// stored in the TraceContext field of events being added. It may return
+	// empty string if there's nothing to store.
+	Inject(ctx context.Context) string
+
+	// Extract returns a copy of ctx which carries the trace context which was
+	// previously returned from Inject.
+	Extract(ctx context.Context, traceContext string) context.Context
+}
+
+// WithHook returns a Backend which passes all calls through to the given one,
+// reporting each one to the Hook as it completes. Run, KeyWait and KeySubscribe
+// are passed through without being reported, since they don't complete in the
+// usual sense.
+// New does this automatically when Opts.Hook is set.
+func WithHook(b Backend, h Hook) Backend {
+	return instrumentedBackend{Backend: b, h: h}
+}
+
+// WithTracer is like WithHook, but traces each call using the Tracer instead.
+// New does this automatically when Opts.Tracer is set.
+func WithTracer(b Backend, t Tracer) Backend {
+	return instrumentedBackend{Backend: b, t: t}
+}
+
+// instrumentedBackend reports calls to a Hook and/or Tracer, whichever are set
+type instrumentedBackend struct {
+	Backend
+	h Hook
+	t Tracer
+}
+
+// start begins an operation, returning the context to perform it with and a
+// function to call with its result once it's done
+func (ib instrumentedBackend) start(ctx context.Context, name, queue string) (context.Context, func(int, error)) {
+	s := Stat{Name: name, Queue: queue}
+	var traceDone func(Stat)
+	if ib.t != nil {
+		ctx, traceDone = ib.t.Start(ctx, s)
+	}
+	start := time.Now()
+	return ctx, func(count int, err error) {
+		s.Duration = time.Since(start)
+		s.Count = count
+		s.Err = err
+		if ib.h != nil {
+			ib.h.Observe(s)
+		}
+		if traceDone != nil {
+			traceDone(s)
+		}
+	}
+}
+
+func (ib instrumentedBackend) MonoTSs(ctx context.Context, t TS, n int) ([]TS, error) {
+	ctx, done := ib.start(ctx, "MonoTSs", "")
+	tt, err := ib.Backend.MonoTSs(ctx, t, n)
+	done(len(tt), err)
+	return tt, err
+}
+
+func (ib instrumentedBackend) SetEvents(ctx context.Context, ee []Event, expireBuffer time.Duration) error {
+	ctx, done := ib.start(ctx, "SetEvents", "")
+	err := ib.Backend.SetEvents(ctx, ee, expireBuffer)
+	done(len(ee), err)
+	return err
+}
+
+func (ib instrumentedBackend) GetEvents(ctx context.Context, ii []ID) ([]Event, error) {
+	ctx, done := ib.start(ctx, "GetEvents", "")
+	ee, err := ib.Backend.GetEvents(ctx, ii)
+	done(len(ee), err)
+	return ee, err
+}
+
+func (ib instrumentedBackend) Query(ctx context.Context, qas QueryActions) (QueryRes, error) {
+	ctx, done := ib.start(ctx, "Query", qas.KeyBase)
+	res, err := ib.Backend.Query(ctx, qas)
+	done(len(res.IDs), err)
+	return res, err
+}
+
+func (ib instrumentedBackend) KeyScan(ctx context.Context, k Key) ([]Key, error) {
+	ctx, done := ib.start(ctx, "KeyScan", k.Base)
+	kk, err := ib.Backend.KeyScan(ctx, k)
+	done(len(kk), err)
+	return kk, err
+}
+
+func (ib instrumentedBackend) HashGetIDs(ctx context.Context, k Key, ii []ID) ([]string, error) {
+	ctx, done := ib.start(ctx, "HashGetIDs", k.Base)
+	vv, err := ib.Backend.HashGetIDs(ctx, k, ii)
+	done(len(vv), err)
+	return vv, err
+}
+
+func (ib instrumentedBackend) HashSetAll(ctx context.Context, k Key, m map[string]string) error {
+	ctx, done := ib.start(ctx, "HashSetAll", k.Base)
+	err := ib.Backend.HashSetAll(ctx, k, m)
+	done(len(m), err)
+	return err
+}
+
+func (ib instrumentedBackend) HashGetAll(ctx context.Context, k Key) (map[string]string, error) {
+	ctx, done := ib.start(ctx, "HashGetAll", k.Base)
+	m, err := ib.Backend.HashGetAll(ctx, k)
+	done(len(m), err)
+	return m, err
+}
+
+func (ib instrumentedBackend) SetString(ctx context.Context, k Key, val string, ttl time.Duration) error {
+	ctx, done := ib.start(ctx, "SetString", k.Base)
+	err := ib.Backend.SetString(ctx, k, val, ttl)
+	done(0, err)
+	return err
+}
+
+func (ib instrumentedBackend) GetString(ctx context.Context, k Key) (string, error) {
+	ctx, done := ib.start(ctx, "GetString", k.Base)
+	s, err := ib.Backend.GetString(ctx, k)
+	done(0, err)
+	return s, err
+}
+
+func (ib instrumentedBackend) SetIDNX(ctx context.Context, k Key, id ID, ttl time.Duration) (ID, bool, error) {
+	ctx, done := ib.start(ctx, "SetIDNX", k.Base)
+	id, set, err := ib.Backend.SetIDNX(ctx, k, id, ttl)
+	done(0, err)
+	return id, set, err
+}
+
+func (ib instrumentedBackend) KeyNotify(ctx context.Context, k Key) {
+	ctx, done := ib.start(ctx, "KeyNotify", k.Base)
+	ib.Backend.KeyNotify(ctx, k)
+	done(0, nil)
+}
@@ -0,0 +1,48 @@
+package core
+
+import (
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testHook records every Stat it's given
+type testHook struct {
+	l  sync.Mutex
+	ss []Stat
+}
+
+func (th *testHook) Observe(s Stat) {
+	th.l.Lock()
+	defer th.l.Unlock()
+	th.ss = append(th.ss, s)
+}
+
+func TestHook(t *T) {
+	th := &testHook{}
+	c := NewWithBackend(WithHook(NewMemBackend(), th))
+	c.Run(nil)
+
+	k := Key{Base: testutil.RandStr()}
+	require.Nil(t, c.SetString(testCtx, k, "foo", time.Minute))
+	_, err := c.GetString(testCtx, Key{Base: k.Base, Subs: []string{"other"}})
+	assert.Equal(t, ErrNotFound, err)
+	_, err = c.MonoTSs(testCtx, NewTS(time.Now()), 3)
+	require.Nil(t, err)
+
+	require.Len(t, th.ss, 3)
+	for _, s := range th.ss {
+		assert.True(t, s.Duration > 0)
+	}
+	assert.Equal(t, "SetString", th.ss[0].Name)
+	assert.Equal(t, k.Base, th.ss[0].Queue)
+	assert.Nil(t, th.ss[0].Err)
+	assert.Equal(t, "GetString", th.ss[1].Name)
+	assert.Equal(t, ErrNotFound, th.ss[1].Err)
+	assert.Equal(t, "MonoTSs", th.ss[2].Name)
+	assert.Equal(t, 3, th.ss[2].Count)
+}
@@ -0,0 +1,874 @@
+package core
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often MemBackend's Run clears out expired events and Keys. They're
+// ignored as soon as they expire either way, this only frees up their memory.
+const memCleanPeriod = 1 * time.Minute
+
+// The prefix used for the string form of Keys within MemBackend, which only
+// matters for pattern matching in KeyScan
+const memPrefix = "mem"
+
+type memEvent struct {
+	e      Event
+	expire time.Time
+}
+
+// the value of a Key is either a memZSet, a string (set using SetString or
+// SetIDNX), an ID (set using QuerySingleSet) or a map[string]string (a hash)
+type memVal struct {
+	v      interface{}
+	expire time.Time // zero if the Key doesn't expire
+}
+
+// memZSet is a sorted set of IDs, each of which has a score
+type memZSet map[ID]float64
+
+// returns the IDs in the set ordered by score. IDs with the same score are
+// ordered by T.
+func (zs memZSet) sorted() []ID {
+	ii := make([]ID, 0, len(zs))
+	for id := range zs {
+		ii = append(ii, id)
+	}
+	sort.Slice(ii, func(i, j int) bool {
+		si, sj := zs[ii[i]], zs[ii[j]]
+		if si != sj {
+			return si < sj
+		}
+		if ii[i].T != ii[j].T {
+			return ii[i].T < ii[j].T
+		}
+		return ii[i].Expire < ii[j].Expire
+	})
+	return ii
+}
+
+// MemBackend is a Backend which keeps everything in the memory of the current
+// process, for use in tests and small deployments where running redis isn't
+// worth it. Nothing is persisted, and separate processes using their own
+// MemBackends share nothing, so only one bananaq server may use it at a time.
+//
+// Every method is performed while holding a single lock, so Query is atomic in
+// the same way it is with redis.
+type MemBackend struct {
+	ps    *pubsub
+	clock Clock
+
+	l      sync.Mutex
+	lastTS TS
+	events map[ID]memEvent
+	keys   map[string]*memVal
+}
+
+// NewMemBackend returns an empty MemBackend, which may be passed into
+// NewWithBackend.
+func NewMemBackend() *MemBackend {
+	return NewMemBackendWithClock(SystemClock)
+}
+
+// NewMemBackendWithClock is like NewMemBackend, but events and Keys expire
+// according to the given Clock rather than the system's. The Core using it
+// should be given the same Clock, see NewMem.
+func NewMemBackendWithClock(clock Clock) *MemBackend {
+	return &MemBackend{
+		ps:     newPubsub(),
+		clock:  clock,
+		events: map[ID]memEvent{},
+		keys:   map[string]*memVal{},
+	}
+}
+
+// Run implements the method for the Backend interface. It periodically removes
+// expired data, and never returns an error.
+func (m *MemBackend) Run(stopCh chan struct{}) chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		tick := time.NewTicker(memCleanPeriod)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				m.clean()
+			case <-stopCh:
+				errCh <- nil
+				return
+			}
+		}
+	}()
+	return errCh
+}
+
+func (m *MemBackend) clean() {
+	m.l.Lock()
+	defer m.l.Unlock()
+	now := m.clock.Now()
+	for id, me := range m.events {
+		if !now.Before(me.expire) {
+			delete(m.events, id)
+		}
+	}
+	for key, mv := range m.keys {
+		if !mv.expire.IsZero() && !now.Before(mv.expire) {
+			delete(m.keys, key)
+		}
+	}
+}
+
+// MonoTSs implements the method for the Backend interface
+func (m *MemBackend) MonoTSs(ctx context.Context, t TS, n int) ([]TS, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	first := t
+	if m.lastTS >= t {
+		first = m.lastTS + 1
+	}
+	m.lastTS = first + TS(n) - 1
+
+	tt := make([]TS, n)
+	for i := range tt {
+		tt[i] = first + TS(i)
+	}
+	return tt, nil
+}
+
+// SetEvents implements the method for the Backend interface
+func (m *MemBackend) SetEvents(ctx context.Context, ee []Event, expireBuffer time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.setEvents(ee, expireBuffer)
+	return nil
+}
+
+// setEvents must be called with the lock held
+func (m *MemBackend) setEvents(ee []Event, expireBuffer time.Duration) {
+	for _, e := range ee {
+		// Attempts and DeliveryToken aren't stored with the event, see their
+		// docs
+		e.Attempts, e.DeliveryToken = 0, ""
+		m.events[e.ID] = memEvent{
+			e:      e,
+			expire: e.ID.Expire.Time().Add(expireBuffer),
+		}
+	}
+}
+
+// GetEvents implements the method for the Backend interface
+func (m *MemBackend) GetEvents(ctx context.Context, ii []ID) ([]Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	now := m.clock.Now()
+	ee := make([]Event, len(ii))
+	for i, id := range ii {
+		me, ok := m.events[id]
+		if !ok || !now.Before(me.expire) {
+			return nil, ErrNotFound
+		}
+		ee[i] = me.e
+	}
+	return ee, nil
+}
+
+// returns the value of the Key with the given string form, or nil if it isn't
+// set or has expired. Must be called with l held.
+func (m *MemBackend) get(key string) *memVal {
+	mv, ok := m.keys[key]
+	if !ok {
+		return nil
+	} else if !mv.expire.IsZero() && !m.clock.Now().Before(mv.expire) {
+		delete(m.keys, key)
+		return nil
+	}
+	return mv
+}
+
+// Keys holding a different kind of value than expected are treated as being
+// empty, and are overwritten by writes. Nothing in bananaq uses a Key for more
+// than one kind of value.
+
+// returns the sorted set at the given Key, which will be nil if it's not set.
+// Must be called with l held.
+func (m *MemBackend) zset(key string) memZSet {
+	mv := m.get(key)
+	if mv == nil {
+		return nil
+	}
+	zs, _ := mv.v.(memZSet)
+	return zs
+}
+
+// like zset, but creates the sorted set if it doesn't exist. Must be called
+// with l held.
+func (m *MemBackend) zsetCreate(key string) memZSet {
+	if zs := m.zset(key); zs != nil {
+		return zs
+	}
+	zs := memZSet{}
+	m.keys[key] = &memVal{v: zs}
+	return zs
+}
+
+// like zset, but for hashes. Must be called with l held.
+func (m *MemBackend) hash(key string) map[string]string {
+	mv := m.get(key)
+	if mv == nil {
+		return nil
+	}
+	h, _ := mv.v.(map[string]string)
+	return h
+}
+
+// like zsetCreate, but for hashes. Must be called with l held.
+func (m *MemBackend) hashCreate(key string) map[string]string {
+	if h := m.hash(key); h != nil {
+		return h
+	}
+	h := map[string]string{}
+	m.keys[key] = &memVal{v: h}
+	return h
+}
+
+// Like redis, Keys are removed once they have nothing in them. Must be called
+// with l held.
+func (m *MemBackend) delIfEmpty(key string) {
+	mv := m.get(key)
+	if mv == nil {
+		return
+	}
+	switch v := mv.v.(type) {
+	case memZSet:
+		if len(v) == 0 {
+			delete(m.keys, key)
+		}
+	case map[string]string:
+		if len(v) == 0 {
+			delete(m.keys, key)
+		}
+	}
+}
+
+// Query implements the method for the Backend interface. It follows what
+// query.lua does as closely as possible.
+func (m *MemBackend) Query(ctx context.Context, qas QueryActions) (QueryRes, error) {
+	if err := ctx.Err(); err != nil {
+		return QueryRes{}, err
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.setEvents(qas.Events, qas.EventsExpireBuffer)
+
+	mq := &memQuery{m: m, now: qas.Now}
+	var ii []ID
+	var explain []QueryExplainStep
+	for _, qa := range qas.QueryActions {
+		newii, skipped := mq.action(ii, qa)
+		if !skipped && qa.Break {
+			if qas.Explain {
+				explain = append(explain, QueryExplainStep{Broke: true, In: len(ii), Out: len(ii)})
+			}
+			break
+		}
+		inLen := len(ii)
+
+		if qa.Union {
+			set := map[TS]ID{}
+			for _, id := range ii {
+				set[id.T] = id
+			}
+			for _, id := range newii {
+				set[id.T] = id
+			}
+			newii = make([]ID, 0, len(set))
+			for _, id := range set {
+				newii = append(newii, id)
+			}
+		}
+
+		sort.SliceStable(newii, func(i, j int) bool { return newii[i].T < newii[j].T })
+		ii = newii
+
+		if qas.Explain {
+			explain = append(explain, QueryExplainStep{Skipped: skipped, In: inLen, Out: len(ii)})
+		}
+	}
+
+	return QueryRes{IDs: ii, Counts: mq.counts, Explain: explain}, nil
+}
+
+// memQuery holds the state of a single Query against a MemBackend
+type memQuery struct {
+	m      *MemBackend
+	now    TS
+	counts []uint64
+}
+
+func memKey(k Key) string {
+	return k.String(memPrefix)
+}
+
+// memRange is a QueryScoreRange with the input already taken into account
+type memRange struct {
+	min, max         float64
+	minExcl, maxExcl bool
+}
+
+func newMemRange(input []ID, qsr QueryScoreRange) memRange {
+	if qsr.MinFromInput {
+		qsr.Min = 0
+		if len(input) > 0 {
+			qsr.Min = input[len(input)-1].T
+		}
+	}
+	if qsr.MaxFromInput {
+		qsr.Max = 0
+		if len(input) > 0 {
+			qsr.Max = input[0].T
+		}
+	}
+
+	mr := memRange{
+		min:     math.Inf(-1),
+		max:     math.Inf(1),
+		minExcl: qsr.MinExcl,
+		maxExcl: qsr.MaxExcl,
+	}
+	if qsr.Min != 0 {
+		mr.min = float64(qsr.Min)
+	}
+	if qsr.Max != 0 {
+		mr.max = float64(qsr.Max)
+	}
+	return mr
+}
+
+func (mr memRange) contains(score float64) bool {
+	if score < mr.min || (mr.minExcl && score == mr.min) {
+		return false
+	}
+	if score > mr.max || (mr.maxExcl && score == mr.max) {
+		return false
+	}
+	return true
+}
+
+// returns the IDs in the given sorted set whose scores are in the range,
+// ordered by score
+func (mr memRange) sel(zs memZSet) []ID {
+	var ii []ID
+	for _, id := range zs.sorted() {
+		if mr.contains(zs[id]) {
+			ii = append(ii, id)
+		}
+	}
+	return ii
+}
+
+func (mq *memQuery) sel(input []ID, qs *QuerySelector) []ID {
+	zs := mq.m.zset(memKey(qs.Key))
+	switch {
+	case qs.QueryRangeSelect != nil:
+		qrs := qs.QueryRangeSelect
+		ii := newMemRange(input, qrs.QueryScoreRange).sel(zs)
+		if qrs.Reverse {
+			for i, j := 0, len(ii)-1; i < j; i, j = i+1, j-1 {
+				ii[i], ii[j] = ii[j], ii[i]
+			}
+		}
+		if qrs.Limit != 0 {
+			if qrs.Offset >= int64(len(ii)) {
+				return nil
+			}
+			ii = ii[qrs.Offset:]
+			if qrs.Limit > 0 && qrs.Limit < int64(len(ii)) {
+				ii = ii[:qrs.Limit]
+			}
+		}
+		return ii
+
+	case qs.QueryIDScoreSelect != nil:
+		qiss := qs.QueryIDScoreSelect
+		score, ok := zs[qiss.ID]
+		if !ok {
+			return nil
+		}
+		if score < float64(qiss.Min) {
+			return nil
+		}
+		if qiss.Max > 0 && score > float64(qiss.Max) {
+			return nil
+		}
+		if qiss.Equal > 0 && score != float64(qiss.Equal) {
+			return nil
+		}
+		return []ID{qiss.ID}
+
+	case len(qs.PosRangeSelect) > 0:
+		ii := zs.sorted()
+		start, stop := qs.PosRangeSelect[0], qs.PosRangeSelect[1]
+		l := int64(len(ii))
+		if start < 0 {
+			start += l
+		}
+		if stop < 0 {
+			stop += l
+		}
+		if start < 0 {
+			start = 0
+		}
+		if stop >= l {
+			stop = l - 1
+		}
+		if start > stop {
+			return nil
+		}
+		return ii[start : stop+1]
+	}
+
+	return append([]ID(nil), qs.IDs...)
+}
+
+func (mq *memQuery) filter(input []ID, qf *QueryFilter) []ID {
+	var output []ID
+	for _, id := range input {
+		var filter bool
+		if qf.Expired {
+			filter = id.Expire <= mq.now
+		} else if qf.ScoreKey != nil {
+			score, ok := mq.m.zset(memKey(*qf.ScoreKey))[id]
+			filter = !ok ||
+				(qf.ScoreMin > 0 && score < float64(qf.ScoreMin)) ||
+				(qf.ScoreMax > 0 && score > float64(qf.ScoreMax))
+		}
+		if filter != qf.Invert {
+			continue
+		}
+		output = append(output, id)
+	}
+	return output
+}
+
+// see the QueryContentsFilter field on QueryAction
+func (mq *memQuery) contentsFilter(input []ID, qcf *QueryContentsFilter) []ID {
+	now := mq.m.clock.Now()
+	var output []ID
+	for _, id := range input {
+		if qcf.Limit > 0 && int64(len(output)) >= qcf.Limit {
+			break
+		}
+		me, ok := mq.m.events[id]
+		if !ok || !now.Before(me.expire) || me.e.Flags != 0 {
+			continue
+		} else if qcf.Match(me.e.Contents) {
+			output = append(output, id)
+		}
+	}
+
+	if qcf.SkipTo != nil {
+		var skipped uint64
+		if len(output) == 0 && len(input) > 0 {
+			skipped = uint64(len(input))
+			mq.action(input, QueryAction{QuerySingleSet: &QuerySingleSet{
+				Key:       *qcf.SkipTo,
+				IfNewer:   true,
+				Newest:    true,
+				ScoreFrom: qcf.SkipScoreFrom,
+			}})
+		}
+		mq.counts = append(mq.counts, skipped)
+	}
+	return output
+}
+
+// returns true if the conditional succeeds, i.e. the QueryAction should be
+// performed
+func (mq *memQuery) conditional(input []ID, qc QueryConditional) bool {
+	for _, and := range qc.And {
+		if !mq.conditional(input, and) {
+			return false
+		}
+	}
+	if qc.IfNoInput && len(input) > 0 {
+		return false
+	}
+	if qc.IfInput && len(input) == 0 {
+		return false
+	}
+	if qc.IfEmpty != nil && mq.m.get(memKey(*qc.IfEmpty)) != nil {
+		return false
+	}
+	if qc.IfNotEmpty != nil && mq.m.get(memKey(*qc.IfNotEmpty)) == nil {
+		return false
+	}
+	return true
+}
+
+// performs the QueryAction with the given input set. Returns the new input set,
+// and whether or not the action was skipped (which it might be if a conditional
+// stopped it from happening)
+func (mq *memQuery) action(input []ID, qa QueryAction) ([]ID, bool) {
+	if !mq.conditional(input, qa.QueryConditional) {
+		return input, true
+	}
+
+	m := mq.m
+	switch {
+	case qa.QuerySelector != nil:
+		return mq.sel(input, qa.QuerySelector), false
+
+	case qa.QueryCount != nil:
+		mr := newMemRange(input, qa.QueryCount.QueryScoreRange)
+		mq.counts = append(mq.counts, uint64(len(mr.sel(m.zset(memKey(qa.QueryCount.Key))))))
+
+	case qa.CountInput:
+		mq.counts = append(mq.counts, uint64(len(input)))
+
+	case qa.ScoresFrom != nil:
+		zs := m.zset(memKey(*qa.ScoresFrom))
+		for _, id := range input {
+			mq.counts = append(mq.counts, uint64(zs[id]))
+		}
+
+	case qa.QueryAddTo != nil:
+		qat := qa.QueryAddTo
+		if len(input) == 0 {
+			break
+		}
+		for _, k := range qat.Keys {
+			zs := m.zsetCreate(memKey(k))
+			for i, id := range input {
+				score := float64(id.T)
+				if qat.ExpireAsScore {
+					score = float64(id.Expire)
+				}
+				if qat.Score > 0 {
+					score = float64(qat.Score)
+					if qat.ScoreIncr {
+						score += float64(i)
+					}
+				}
+				if qat.Incr {
+					zs[id] += score
+				} else {
+					zs[id] = score
+				}
+			}
+		}
+
+	case len(qa.RemoveFrom) > 0:
+		for _, k := range qa.RemoveFrom {
+			key := memKey(k)
+			zs := m.zset(key)
+			for _, id := range input {
+				delete(zs, id)
+			}
+			m.delIfEmpty(key)
+		}
+
+	case qa.QueryHashSet != nil:
+		if len(input) == 0 {
+			break
+		}
+		h := m.hashCreate(memKey(qa.QueryHashSet.Key))
+		for _, id := range input {
+			h[id.String()] = qa.QueryHashSet.Value
+		}
+
+	case qa.HashDel != nil:
+		key := memKey(*qa.HashDel)
+		h := m.hash(key)
+		for _, id := range input {
+			delete(h, id.String())
+		}
+		m.delIfEmpty(key)
+
+	case qa.QueryPublish != nil:
+		if len(input) == 0 {
+			break
+		}
+		pub := Publication{Message: qa.QueryPublish.Message, IDs: input}
+		// Marshaling a Publication can't fail
+		b, _ := pub.MarshalMsg(nil)
+		m.ps.notify(memKey(qa.QueryPublish.Key), string(b))
+
+	case qa.RateLimit != nil:
+		return mq.rateLimit(input, *qa.RateLimit), false
+
+	case qa.QueryRemoveByScore != nil:
+		mr := newMemRange(input, qa.QueryRemoveByScore.QueryScoreRange)
+		for _, k := range qa.QueryRemoveByScore.Keys {
+			key := memKey(k)
+			zs := m.zset(key)
+			for _, id := range mr.sel(zs) {
+				delete(zs, id)
+			}
+			m.delIfEmpty(key)
+		}
+
+	case qa.QuerySingleSet != nil:
+		qss := qa.QuerySingleSet
+		if len(input) == 0 {
+			break
+		}
+		id := input[0]
+		if qss.Newest {
+			id = input[len(input)-1]
+		}
+		if qss.ScoreFrom != nil {
+			score, ok := m.zset(memKey(*qss.ScoreFrom))[id]
+			if !ok {
+				break
+			}
+			id = ID{T: TS(score), Expire: id.Expire}
+		}
+		key := memKey(qss.Key)
+		if qss.IfNewer {
+			if mv := m.get(key); mv != nil {
+				if oldID, ok := mv.v.(ID); ok && oldID.T > id.T {
+					break
+				}
+			}
+		}
+		m.keys[key] = &memVal{v: id}
+
+	case qa.SingleGet != nil:
+		mv := m.get(memKey(*qa.SingleGet))
+		if mv == nil {
+			return nil, false
+		}
+		id, ok := mv.v.(ID)
+		if !ok || id.Expire < mq.now {
+			return nil, false
+		}
+		return []ID{id}, false
+
+	case qa.Delete != nil:
+		delete(m.keys, memKey(*qa.Delete))
+
+	case qa.QueryFilter != nil:
+		return mq.filter(input, qa.QueryFilter), false
+
+	case qa.QueryContentsFilter != nil:
+		return mq.contentsFilter(input, qa.QueryContentsFilter), false
+	}
+
+	return input, false
+}
+
+// see the RateLimit field on QueryAction
+func (mq *memQuery) rateLimit(input []ID, k Key) []ID {
+	if len(input) == 0 {
+		return input
+	}
+	key := memKey(k)
+	h := mq.m.hash(key)
+	rate, err := strconv.ParseFloat(h["rate"], 64)
+	if err != nil || rate <= 0 {
+		return input
+	}
+	burst, err := strconv.ParseFloat(h["burst"], 64)
+	if err != nil || burst < 1 {
+		burst = 1
+	}
+	tokens, err := strconv.ParseFloat(h["tokens"], 64)
+	if err != nil {
+		tokens = burst
+	}
+	ts, err := strconv.ParseUint(h["ts"], 10, 64)
+	if err != nil {
+		ts = uint64(mq.now)
+	}
+
+	// TSs are in microseconds. The bucket's ts is never moved backwards, see
+	// query.lua
+	if uint64(mq.now) > ts {
+		tokens = math.Min(burst, tokens+(float64(uint64(mq.now)-ts)/1e6)*rate)
+		ts = uint64(mq.now)
+	}
+
+	n := int(math.Min(float64(len(input)), math.Floor(tokens)))
+	output := input[:n]
+	tokens -= float64(n)
+
+	h["tokens"] = strconv.FormatFloat(tokens, 'f', -1, 64)
+	h["ts"] = strconv.FormatUint(ts, 10)
+	return output
+}
+
+// KeyScan implements the method for the Backend interface. Only "*" is treated
+// specially in the pattern.
+func (m *MemBackend) KeyScan(ctx context.Context, k Key) ([]Key, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	pattern := memKey(k)
+	var ret []Key
+	for key := range m.keys {
+		if m.get(key) != nil && globMatch(pattern, key) {
+			ret = append(ret, KeyFromString(key))
+		}
+	}
+	return ret, nil
+}
+
+// returns whether s matches pattern, where "*" in pattern matches any number
+// of characters
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] != '*' {
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+			continue
+		}
+
+		pattern = pattern[1:]
+		for i := len(s); i >= 0; i-- {
+			if globMatch(pattern, s[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	return len(s) == 0
+}
+
+// HashGetIDs implements the method for the Backend interface
+func (m *MemBackend) HashGetIDs(ctx context.Context, k Key, ii []ID) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	h := m.hash(memKey(k))
+	ret := make([]string, len(ii))
+	for i, id := range ii {
+		ret[i] = h[id.String()]
+	}
+	return ret, nil
+}
+
+// HashSetAll implements the method for the Backend interface
+func (m *MemBackend) HashSetAll(ctx context.Context, k Key, hm map[string]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	key := memKey(k)
+	delete(m.keys, key)
+	if len(hm) == 0 {
+		return nil
+	}
+	h := make(map[string]string, len(hm))
+	for field, val := range hm {
+		h[field] = val
+	}
+	m.keys[key] = &memVal{v: h}
+	return nil
+}
+
+// HashGetAll implements the method for the Backend interface
+func (m *MemBackend) HashGetAll(ctx context.Context, k Key) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	h := m.hash(memKey(k))
+	ret := make(map[string]string, len(h))
+	for field, val := range h {
+		ret[field] = val
+	}
+	return ret, nil
+}
+
+// SetString implements the method for the Backend interface
+func (m *MemBackend) SetString(ctx context.Context, k Key, val string, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	m.keys[memKey(k)] = &memVal{v: val, expire: m.clock.Now().Add(ttl)}
+	return nil
+}
+
+// GetString implements the method for the Backend interface
+func (m *MemBackend) GetString(ctx context.Context, k Key) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	mv := m.get(memKey(k))
+	if mv == nil {
+		return "", ErrNotFound
+	}
+	str, ok := mv.v.(string)
+	if !ok {
+		return "", ErrNotFound
+	}
+	return str, nil
+}
+
+// SetIDNX implements the method for the Backend interface
+func (m *MemBackend) SetIDNX(ctx context.Context, k Key, id ID, ttl time.Duration) (ID, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return ID{}, false, err
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	key := memKey(k)
+	if mv := m.get(key); mv != nil {
+		if str, ok := mv.v.(string); ok {
+			curID, err := IDFromString(str)
+			return curID, false, err
+		}
+	}
+	m.keys[key] = &memVal{v: id.String(), expire: m.clock.Now().Add(ttl)}
+	return id, true, nil
+}
+
+// KeyWait implements the method for the Backend interface
+func (m *MemBackend) KeyWait(ctx context.Context, k Key) <-chan struct{} {
+	return m.ps.wait(ctx, memKey(k))
+}
+
+// KeyNotify implements the method for the Backend interface
+func (m *MemBackend) KeyNotify(ctx context.Context, k Key) {
+	m.ps.notify(memKey(k), "notify")
+}
+
+// KeySubscribe implements the method for the Backend interface
+func (m *MemBackend) KeySubscribe(ctx context.Context, k Key) <-chan Publication {
+	return m.ps.publications(ctx, memKey(k))
+}
@@ -0,0 +1,278 @@
+package core
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMemCore() *Core {
+	c := NewWithBackend(NewMemBackend())
+	c.Run(nil)
+	return c
+}
+
+func TestMemMonoTSs(t *T) {
+	c := newTestMemCore()
+	nowTS := NewTS(time.Now())
+	tt, err := c.MonoTSs(testCtx, nowTS, 3)
+	require.Nil(t, err)
+	assert.Equal(t, []TS{nowTS, nowTS + 1, nowTS + 2}, tt)
+
+	tt, err = c.MonoTSs(testCtx, nowTS, 2)
+	require.Nil(t, err)
+	assert.Equal(t, []TS{nowTS + 3, nowTS + 4}, tt)
+}
+
+func TestMemEvents(t *T) {
+	c := newTestMemCore()
+	now := time.Now()
+	e1, err := c.NewEvent(testCtx, NewTS(now), NewTS(now.Add(time.Minute)), testutil.RandStr())
+	require.Nil(t, err)
+	e2, err := c.NewEvent(testCtx, NewTS(now), NewTS(now.Add(-time.Second)), testutil.RandStr())
+	require.Nil(t, err)
+	require.Nil(t, c.SetEvents(testCtx, []Event{e1, e2}, 0))
+
+	e, err := c.GetEvent(testCtx, e1.ID)
+	require.Nil(t, err)
+	assert.Equal(t, e1, e)
+
+	// e2 has already expired
+	_, err = c.GetEvents(testCtx, []ID{e1.ID, e2.ID})
+	assert.Equal(t, ErrNotFound, err)
+
+	// unless there's a buffer
+	require.Nil(t, c.SetEvent(testCtx, e2, time.Minute))
+	ee, err := c.GetEvents(testCtx, []ID{e1.ID, e2.ID})
+	require.Nil(t, err)
+	assert.Equal(t, []Event{e1, e2}, ee)
+}
+
+func TestMemQuery(t *T) {
+	c := newTestMemCore()
+	base := testutil.RandStr()
+	k := Key{Base: base, Subs: []string{testutil.RandStr()}}
+	k2 := Key{Base: base, Subs: []string{testutil.RandStr()}}
+
+	now := NewTS(time.Now())
+	tt, err := c.MonoTSs(testCtx, now, 4)
+	require.Nil(t, err)
+	ii := make([]ID, len(tt))
+	for i := range tt {
+		ii[i] = ID{T: tt[i], Expire: tt[i] + NewTS(time.Unix(60, 0))}
+	}
+
+	query := func(qa ...QueryAction) QueryRes {
+		res, err := c.Query(testCtx, QueryActions{KeyBase: base, QueryActions: qa})
+		require.Nil(t, err)
+		return res
+	}
+	rangeSel := func(k Key, qrs QueryRangeSelect) QueryAction {
+		return QueryAction{QuerySelector: &QuerySelector{Key: k, QueryRangeSelect: &qrs}}
+	}
+
+	res := query(
+		QueryAction{QuerySelector: &QuerySelector{Key: k, IDs: ii}},
+		QueryAction{QueryAddTo: &QueryAddTo{Keys: []Key{k}}},
+		QueryAction{QueryAddTo: &QueryAddTo{Keys: []Key{k2}, ExpireAsScore: true}},
+		QueryAction{CountInput: true},
+	)
+	assert.Equal(t, ii, res.IDs)
+	assert.Equal(t, []uint64{4}, res.Counts)
+
+	res = query(rangeSel(k, QueryRangeSelect{}))
+	assert.Equal(t, ii, res.IDs)
+
+	// Output is always sorted, even when selecting in reverse
+	res = query(rangeSel(k, QueryRangeSelect{Reverse: true, Limit: 2}))
+	assert.Equal(t, ii[2:], res.IDs)
+
+	res = query(rangeSel(k, QueryRangeSelect{
+		QueryScoreRange: QueryScoreRange{Min: ii[0].T, MinExcl: true, Max: ii[2].T},
+	}))
+	assert.Equal(t, ii[1:3], res.IDs)
+
+	res = query(QueryAction{QuerySelector: &QuerySelector{Key: k, PosRangeSelect: []int64{-2, -1}}})
+	assert.Equal(t, ii[2:], res.IDs)
+
+	res = query(QueryAction{QueryCount: &QueryCount{
+		Key:             k2,
+		QueryScoreRange: QueryScoreRange{Min: ii[2].Expire},
+	}})
+	assert.Equal(t, []uint64{2}, res.Counts)
+
+	// RemoveFrom, then Union what's left of k with what's in k2
+	res = query(
+		QueryAction{QuerySelector: &QuerySelector{Key: k, IDs: ii[:2]}},
+		QueryAction{RemoveFrom: []Key{k}},
+		rangeSel(k, QueryRangeSelect{}),
+	)
+	assert.Equal(t, ii[2:], res.IDs)
+	res = query(
+		rangeSel(k, QueryRangeSelect{}),
+		QueryAction{
+			QuerySelector: &QuerySelector{Key: k2, PosRangeSelect: []int64{0, 0}},
+			Union:         true,
+		},
+	)
+	assert.Equal(t, []ID{ii[0], ii[2], ii[3]}, res.IDs)
+
+	// Conditionals and Break
+	res = query(
+		rangeSel(k, QueryRangeSelect{}),
+		QueryAction{Break: true, QueryConditional: QueryConditional{IfEmpty: &k}},
+		QueryAction{Break: true, QueryConditional: QueryConditional{IfNotEmpty: &k}},
+		QueryAction{CountInput: true},
+	)
+	assert.Equal(t, ii[2:], res.IDs)
+	assert.Empty(t, res.Counts)
+
+	// SingleSet/SingleGet
+	ks := Key{Base: base, Subs: []string{testutil.RandStr()}}
+	res = query(
+		rangeSel(k, QueryRangeSelect{}),
+		QueryAction{QuerySingleSet: &QuerySingleSet{Key: ks, Newest: true}},
+		QueryAction{SingleGet: &ks},
+	)
+	assert.Equal(t, []ID{ii[3]}, res.IDs)
+
+	// Filtering
+	res = query(
+		QueryAction{QuerySelector: &QuerySelector{Key: k, IDs: ii}},
+		QueryAction{QueryFilter: &QueryFilter{ScoreKey: &k}},
+	)
+	assert.Equal(t, ii[2:], res.IDs)
+
+	// Delete
+	res = query(
+		QueryAction{Delete: &k},
+		rangeSel(k, QueryRangeSelect{}),
+	)
+	assert.Empty(t, res.IDs)
+}
+
+func TestMemQueryExplain(t *T) {
+	testQueryExplain(t, newTestMemCore())
+}
+
+func TestMemKeyScan(t *T) {
+	c := newTestMemCore()
+	base := testutil.RandStr()
+	k1 := Key{Base: base, Subs: []string{"a"}}
+	k2 := Key{Base: base, Subs: []string{"b"}}
+	k3 := Key{Base: testutil.RandStr(), Subs: []string{"a"}}
+	for _, k := range []Key{k1, k2, k3} {
+		require.Nil(t, c.SetString(testCtx, k, "foo", time.Minute))
+	}
+
+	kk, err := c.KeyScan(testCtx, Key{Base: base, Subs: []string{"*"}})
+	require.Nil(t, err)
+	assert.Len(t, kk, 2)
+	assert.Contains(t, kk, k1)
+	assert.Contains(t, kk, k2)
+
+	kk, err = c.KeyScan(testCtx, Key{Base: "*", Subs: []string{"a"}})
+	require.Nil(t, err)
+	assert.Len(t, kk, 2)
+	assert.Contains(t, kk, k1)
+	assert.Contains(t, kk, k3)
+}
+
+func TestMemKeyPage(t *T) {
+	testKeyPage(t, newTestMemCore())
+}
+
+func TestMemStrings(t *T) {
+	c := newTestMemCore()
+	k := Key{Base: testutil.RandStr()}
+
+	_, err := c.GetString(testCtx, k)
+	assert.Equal(t, ErrNotFound, err)
+
+	require.Nil(t, c.SetString(testCtx, k, "foo", 10*time.Millisecond))
+	s, err := c.GetString(testCtx, k)
+	require.Nil(t, err)
+	assert.Equal(t, "foo", s)
+
+	time.Sleep(20 * time.Millisecond)
+	_, err = c.GetString(testCtx, k)
+	assert.Equal(t, ErrNotFound, err)
+
+	id1 := ID{T: 1, Expire: 2}
+	id2 := ID{T: 3, Expire: 4}
+	id, set, err := c.SetIDNX(testCtx, k, id1, time.Minute)
+	require.Nil(t, err)
+	assert.True(t, set)
+	assert.Equal(t, id1, id)
+	id, set, err = c.SetIDNX(testCtx, k, id2, time.Minute)
+	require.Nil(t, err)
+	assert.False(t, set)
+	assert.Equal(t, id1, id)
+}
+
+func TestMemClock(t *T) {
+	clock := NewManualClock(time.Now())
+	c := NewMem(clock)
+	c.Run(nil)
+	now := clock.Now()
+
+	e, err := c.NewEvent(testCtx, NewTS(now), NewTS(now.Add(time.Minute)), testutil.RandStr())
+	require.Nil(t, err)
+	require.Nil(t, c.SetEvent(testCtx, e, 0))
+	k := Key{Base: testutil.RandStr()}
+	require.Nil(t, c.SetString(testCtx, k, "foo", 10*time.Second))
+
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, now.Add(30*time.Second), c.Now())
+	_, err = c.GetEvent(testCtx, e.ID)
+	assert.Nil(t, err)
+	_, err = c.GetString(testCtx, k)
+	assert.Equal(t, ErrNotFound, err)
+
+	// Queries use the Clock when they aren't given a Now
+	qas := QueryActions{
+		KeyBase: k.Base,
+		QueryActions: []QueryAction{
+			{QuerySelector: &QuerySelector{IDs: []ID{e.ID}}},
+			{QueryFilter: &QueryFilter{Expired: true}},
+		},
+	}
+	res, err := c.Query(testCtx, qas)
+	require.Nil(t, err)
+	assert.Equal(t, []ID{e.ID}, res.IDs)
+
+	clock.Advance(time.Minute)
+	_, err = c.GetEvent(testCtx, e.ID)
+	assert.Equal(t, ErrNotFound, err)
+	res, err = c.Query(testCtx, qas)
+	require.Nil(t, err)
+	assert.Empty(t, res.IDs)
+}
+
+func TestMemKeyWait(t *T) {
+	c := newTestMemCore()
+	k := Key{Base: testutil.RandStr()}
+	ch := c.KeyWait(testCtx, k)
+
+	// Give the KeyWait time to subscribe
+	time.Sleep(10 * time.Millisecond)
+	c.KeyNotify(testCtx, k)
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("KeyWait wasn't notified")
+	}
+}
+
+func TestGlobMatch(t *T) {
+	assert.True(t, globMatch("foo", "foo"))
+	assert.False(t, globMatch("foo", "fo"))
+	assert.True(t, globMatch("f*", "foo"))
+	assert.True(t, globMatch("*o", "foo"))
+	assert.True(t, globMatch("f*o*r", "foobar"))
+	assert.False(t, globMatch("f*z", "foobar"))
+	assert.True(t, globMatch("*", ""))
+}
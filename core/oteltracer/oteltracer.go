@@ -0,0 +1,116 @@
+// Package oteltracer implements core.Tracer using OpenTelemetry. Setting it as
+// the Tracer in core.Opts (or the core.Opts embedded in peel.Opts) gives every
+// peel command and core operation its own span, with the queue and consumer
+// group it was for as attributes:
+//
+//	p := peel.New(rpool, &peel.Opts{
+//		Opts: core.Opts{Tracer: oteltracer.New(nil)},
+//	})
+//
+// Events carry the trace context of the QAdd which added them, so consumers can
+// link their processing of an event back to its producer, either by using the
+// context returned from peel's EventContext as the parent of their processing
+// span, or by adding a link to it using Link.
+package oteltracer
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/mediocregopher/bananaq/core"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The name of the instrumentation library, as given to the TracerProvider
+const instrumentationName = "github.com/mediocregopher/bananaq"
+
+// Attribute keys set on spans
+const (
+	QueueKey         = attribute.Key("bananaq.queue")
+	ConsumerGroupKey = attribute.Key("bananaq.consumer_group")
+	CountKey         = attribute.Key("bananaq.count")
+)
+
+// Tracer implements core.Tracer
+type Tracer struct {
+	t trace.Tracer
+	p propagation.TextMapPropagator
+}
+
+// New returns a Tracer which creates spans using the given TracerProvider, or
+// otel's global one if it's nil. Trace context is injected into and extracted
+// from events using otel's global TextMapPropagator, which must be set (e.g.
+// to propagation.TraceContext{}) for it to be carried.
+func New(tp trace.TracerProvider) *Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &Tracer{
+		t: tp.Tracer(instrumentationName),
+		p: otel.GetTextMapPropagator(),
+	}
+}
+
+// Start implements the method for the core.Tracer interface. Spans are named
+// after the operation, e.g. "bananaq.QAdd" or "bananaq.Query".
+func (t *Tracer) Start(ctx context.Context, s core.Stat) (context.Context, func(core.Stat)) {
+	var attrs []attribute.KeyValue
+	if s.Queue != "" {
+		attrs = append(attrs, QueueKey.String(s.Queue))
+	}
+	if s.ConsumerGroup != "" {
+		attrs = append(attrs, ConsumerGroupKey.String(s.ConsumerGroup))
+	}
+
+	ctx, span := t.t.Start(ctx, "bananaq."+s.Name, trace.WithAttributes(attrs...))
+	return ctx, func(s core.Stat) {
+		span.SetAttributes(CountKey.Int(s.Count))
+		if s.Err != nil {
+			span.RecordError(s.Err)
+			span.SetStatus(codes.Error, s.Err.Error())
+		}
+		span.End()
+	}
+}
+
+// Inject implements the method for the core.Tracer interface
+func (t *Tracer) Inject(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	t.p.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return ""
+	}
+
+	vals := url.Values{}
+	for k, v := range carrier {
+		vals.Set(k, v)
+	}
+	return vals.Encode()
+}
+
+// Extract implements the method for the core.Tracer interface
+func (t *Tracer) Extract(ctx context.Context, traceContext string) context.Context {
+	vals, err := url.ParseQuery(traceContext)
+	if err != nil {
+		return ctx
+	}
+
+	carrier := propagation.MapCarrier{}
+	for k := range vals {
+		carrier.Set(k, vals.Get(k))
+	}
+	return t.p.Extract(ctx, carrier)
+}
+
+// Link returns a trace.Link to the span which added the given Event, for
+// consumers which would rather link their processing span to it than make it
+// the parent. The returned Link will be empty if the Event has no trace
+// context.
+func (t *Tracer) Link(e core.Event) trace.Link {
+	ctx := t.Extract(context.Background(), e.TraceContext)
+	return trace.Link{SpanContext: trace.SpanContextFromContext(ctx)}
+}
@@ -0,0 +1,74 @@
+package oteltracer
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var testCtx = context.Background()
+
+func TestTracer(t *T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	tr := New(tp)
+
+	p := peel.NewWithBackend(core.NewMemBackend(), &peel.Opts{
+		Opts: core.Opts{Tracer: tr},
+	})
+	p.Run(nil)
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+
+	// Spans are named after the operation and have the queue/consumer group as
+	// attributes, and core's operations are children of peel's
+	id, err := p.QAdd(testCtx, peel.QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(1 * time.Minute),
+		Contents: testutil.RandStr(),
+	})
+	require.Nil(t, err)
+	e, err := p.QGet(testCtx, peel.QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, id, e.ID)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range rec.Ended() {
+		spans[s.Name()] = s
+	}
+	qadd, qget := spans["bananaq.QAdd"], spans["bananaq.QGet"]
+	require.NotNil(t, qadd)
+	require.NotNil(t, qget)
+	assert.Contains(t, qadd.Attributes(), QueueKey.String(queue))
+	assert.Contains(t, qadd.Attributes(), CountKey.Int(1))
+	assert.Contains(t, qget.Attributes(), ConsumerGroupKey.String(cgroup))
+	require.NotNil(t, spans["bananaq.MonoTSs"])
+	assert.Equal(t, qadd.SpanContext().SpanID(), spans["bananaq.MonoTSs"].Parent().SpanID())
+
+	// The consumer can link back to the span which added the event
+	assert.NotEmpty(t, e.TraceContext)
+	ctx := p.EventContext(testCtx, e)
+	assert.Equal(t, qadd.SpanContext().TraceID(), trace.SpanContextFromContext(ctx).TraceID())
+	assert.Equal(t, qadd.SpanContext().SpanID(), trace.SpanContextFromContext(ctx).SpanID())
+	assert.Equal(t, qadd.SpanContext().SpanID(), tr.Link(e).SpanContext.SpanID())
+
+	// Errors are recorded
+	_, err = p.QGetMulti(testCtx, peel.QGetMultiCommand{})
+	require.NotNil(t, err)
+	ended := rec.Ended()
+	last := ended[len(ended)-1]
+	assert.Equal(t, "bananaq.QGetMulti", last.Name())
+	assert.Equal(t, err.Error(), last.Status().Description)
+}
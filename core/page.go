@@ -0,0 +1,98 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+// PageCursor marks a position within a Key being walked using KeyPage. The zero
+// value is the start of the Key.
+type PageCursor struct {
+	// The score of the last ID which was returned
+	Score TS
+
+	// How many IDs with Score have already been returned, so they can be
+	// skipped
+	Offset int64
+}
+
+// Page is a single page of IDs from a Key, as returned by KeyPage
+type Page struct {
+	// The IDs in the page, sorted by score, and their scores in the Key
+	IDs    []ID
+	Scores []TS
+
+	// Should be passed into KeyPage to retrieve the next page
+	Next PageCursor
+
+	// True if there are no more IDs in the Key after this page
+	Done bool
+}
+
+// KeyPage returns up to n of the IDs in the given Key, and their scores,
+// starting at the given cursor. IDs are walked in order of their score, so
+// large Keys can be walked a page at a time without any single call having to
+// read the whole thing.
+//
+// Each page is read atomically, but the Key may change between pages. IDs
+// which are in the Key for the whole walk, and whose score doesn't change, will
+// be returned exactly once, unless IDs with the same score are added or removed
+// during it.
+func (c *Core) KeyPage(ctx context.Context, k Key, cur PageCursor, n int) (Page, error) {
+	if n < 1 {
+		return Page{}, errors.New("n must be at least 1")
+	}
+
+	res, err := c.Query(ctx, QueryActions{
+		KeyBase: k.Base,
+		QueryActions: []QueryAction{
+			{
+				QuerySelector: &QuerySelector{
+					Key: k,
+					QueryRangeSelect: &QueryRangeSelect{
+						QueryScoreRange: QueryScoreRange{Min: cur.Score},
+						Limit:           int64(n),
+						Offset:          cur.Offset,
+					},
+				},
+			},
+			{
+				ScoresFrom: &k,
+			},
+		},
+	})
+	if err != nil {
+		return Page{}, err
+	}
+
+	// Query output is sorted by T, which isn't necessarily the same as by
+	// score
+	p := Page{
+		IDs:    res.IDs,
+		Scores: make([]TS, len(res.IDs)),
+		Next:   cur,
+		Done:   len(res.IDs) < n,
+	}
+	for i := range res.Counts {
+		p.Scores[i] = TS(res.Counts[i])
+	}
+	sort.Stable(pageByScore(p))
+
+	for _, score := range p.Scores {
+		if score != p.Next.Score {
+			p.Next = PageCursor{Score: score}
+		}
+		p.Next.Offset++
+	}
+	return p, nil
+}
+
+type pageByScore Page
+
+func (p pageByScore) Len() int           { return len(p.IDs) }
+func (p pageByScore) Less(i, j int) bool { return p.Scores[i] < p.Scores[j] }
+func (p pageByScore) Swap(i, j int) {
+	p.IDs[i], p.IDs[j] = p.IDs[j], p.IDs[i]
+	p.Scores[i], p.Scores[j] = p.Scores[j], p.Scores[i]
+}
@@ -0,0 +1,359 @@
+package core
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// ErrPoolTimeout is returned by a Pool's Get, and so by any command sent through
+// it, when PoolOpts.MaxActive connections are already in use and none is put
+// back within PoolOpts.WaitTimeout
+var ErrPoolTimeout = errors.New("timed out waiting for a pooled connection")
+
+var errPoolClosed = errors.New("pool closed")
+
+// PoolOpts tune a Pool. The zero value gives a Pool which behaves like a
+// *pool.Pool: it makes as many connections as are needed at once, keeps up to
+// its size of them around when they're not being used, and never closes them
+// for being idle or old.
+type PoolOpts struct {
+	// Default 0, meaning no limit. The most connections which may be in use at
+	// once. Once this many are, Get waits for one to be put back rather than
+	// making another, so that a burst of commands can't open an unbounded
+	// number of connections to redis.
+	MaxActive int
+
+	// Default 0, meaning Get waits for as long as it takes. How long Get waits
+	// for a connection when MaxActive are in use, before returning
+	// ErrPoolTimeout.
+	WaitTimeout time.Duration
+
+	// Default 0, meaning never. Connections which have been idle in the Pool
+	// for this long are closed.
+	MaxIdleTime time.Duration
+
+	// Default 0, meaning never. Connections which were made this long ago are
+	// closed rather than being reused, e.g. so that they're spread across new
+	// instances behind a load balancer.
+	MaxLifetime time.Duration
+}
+
+// PoolStats describe a Pool's connections, as returned by its Stats method.
+// The counts and durations are totals since the Pool was made.
+type PoolStats struct {
+	// Open is always InUse plus Idle
+	Open, InUse, Idle int
+
+	// The number of times Get had to wait for a connection because MaxActive
+	// were in use, and the total time spent waiting. WaitTimeouts is how many
+	// of those waits ended in ErrPoolTimeout.
+	WaitCount    uint64
+	WaitDuration time.Duration
+	WaitTimeouts uint64
+
+	// The number of connections closed because of MaxIdleTime and MaxLifetime
+	MaxIdleTimeClosed uint64
+	MaxLifetimeClosed uint64
+}
+
+type poolConn struct {
+	c        *redis.Client
+	made     time.Time
+	lastUsed time.Time
+}
+
+// Pool is a pool of connections to a single redis instance, like a *pool.Pool,
+// but whose usage can be inspected with Stats and which can be tuned with
+// PoolOpts. Dial returns one when it isn't connecting to a cluster. It
+// implements util.Cmder, and may be passed into New.
+type Pool struct {
+	// The network and address connections are made to
+	Network, Addr string
+
+	size int
+	df   func(network, addr string) (*redis.Client, error)
+	o    PoolOpts
+
+	// Has a value for each connection in use, if MaxActive is set
+	active chan struct{}
+
+	l      sync.Mutex
+	idle   []*poolConn // the most recently used are at the end
+	inUse  map[*redis.Client]time.Time
+	stats  PoolStats
+	closed bool
+	stopCh chan struct{}
+}
+
+// NewPool makes a Pool which keeps up to size idle connections to addr, made
+// using df (e.g. one returned by DialOpts.DialFunc). One connection is made
+// straight away, to check that redis can be reached, and the rest of the idle
+// ones are made in the background. Idle connections are pinged periodically so
+// that broken ones are found before they're used.
+func NewPool(network, addr string, size int, df func(network, addr string) (*redis.Client, error), o PoolOpts) (*Pool, error) {
+	p := &Pool{
+		Network: network,
+		Addr:    addr,
+		size:    size,
+		df:      df,
+		o:       o,
+		inUse:   map[*redis.Client]time.Time{},
+		stopCh:  make(chan struct{}),
+	}
+	if o.MaxActive > 0 {
+		p.active = make(chan struct{}, o.MaxActive)
+	}
+	if size <= 0 {
+		return p, nil
+	}
+
+	mkConn := func() error {
+		c, err := df(network, addr)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		p.l.Lock()
+		defer p.l.Unlock()
+		if p.closed || len(p.idle) >= size {
+			c.Close()
+		} else {
+			p.idle = append(p.idle, &poolConn{c: c, made: now, lastUsed: now})
+		}
+		return nil
+	}
+	if err := mkConn(); err != nil {
+		return nil, err
+	}
+	go func() {
+		for i := 1; i < size; i++ {
+			mkConn()
+		}
+	}()
+
+	// As with *pool.Pool, every idle connection is pinged about every 10
+	// seconds
+	go p.spin(10 * time.Second / time.Duration(size))
+	return p, nil
+}
+
+func (p *Pool) spin(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-t.C:
+			p.closeExpired()
+			p.ping()
+		}
+	}
+}
+
+// returns whether the idle connection should be closed, and the stat to count
+// it against if so. Must be called with the lock held.
+func (p *Pool) expired(pc *poolConn, now time.Time) (bool, *uint64) {
+	if p.o.MaxLifetime > 0 && now.Sub(pc.made) >= p.o.MaxLifetime {
+		return true, &p.stats.MaxLifetimeClosed
+	} else if p.o.MaxIdleTime > 0 && now.Sub(pc.lastUsed) >= p.o.MaxIdleTime {
+		return true, &p.stats.MaxIdleTimeClosed
+	}
+	return false, nil
+}
+
+func (p *Pool) closeExpired() {
+	now := time.Now()
+	p.l.Lock()
+	defer p.l.Unlock()
+	idle := p.idle[:0]
+	for _, pc := range p.idle {
+		if ok, stat := p.expired(pc, now); ok {
+			(*stat)++
+			pc.c.Close()
+			continue
+		}
+		idle = append(idle, pc)
+	}
+	for i := len(idle); i < len(p.idle); i++ {
+		p.idle[i] = nil
+	}
+	p.idle = idle
+}
+
+// pings the least recently used idle connection, closing it if that fails.
+// Pinging doesn't count as using the connection as far as MaxIdleTime goes.
+func (p *Pool) ping() {
+	p.l.Lock()
+	if len(p.idle) == 0 {
+		p.l.Unlock()
+		return
+	}
+	pc := p.idle[0]
+	p.idle = p.idle[1:]
+	p.l.Unlock()
+
+	if err := pc.c.Cmd("PING").Err; err != nil {
+		pc.c.Close()
+		return
+	}
+
+	p.l.Lock()
+	defer p.l.Unlock()
+	if p.closed {
+		pc.c.Close()
+		return
+	}
+	p.idle = append([]*poolConn{pc}, p.idle...)
+}
+
+// Get returns a connection from the Pool, making a new one if none are idle. If
+// MaxActive connections are in use it waits for one to be put back first. The
+// connection must be given back with Put once it's done with.
+func (p *Pool) Get() (*redis.Client, error) {
+	if err := p.waitActive(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	p.l.Lock()
+	if p.closed {
+		p.l.Unlock()
+		p.releaseActive()
+		return nil, errPoolClosed
+	}
+	for len(p.idle) > 0 {
+		pc := p.idle[len(p.idle)-1]
+		p.idle[len(p.idle)-1] = nil
+		p.idle = p.idle[:len(p.idle)-1]
+		if ok, stat := p.expired(pc, now); ok {
+			(*stat)++
+			pc.c.Close()
+			continue
+		}
+		p.inUse[pc.c] = pc.made
+		p.l.Unlock()
+		return pc.c, nil
+	}
+	p.l.Unlock()
+
+	c, err := p.df(p.Network, p.Addr)
+	if err != nil {
+		p.releaseActive()
+		return nil, err
+	}
+	p.l.Lock()
+	p.inUse[c] = time.Now()
+	p.l.Unlock()
+	return c, nil
+}
+
+func (p *Pool) waitActive() error {
+	if p.active == nil {
+		return nil
+	}
+	select {
+	case p.active <- struct{}{}:
+		return nil
+	default:
+	}
+
+	var timeoutCh <-chan time.Time
+	if p.o.WaitTimeout > 0 {
+		timer := time.NewTimer(p.o.WaitTimeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	start := time.Now()
+	var err error
+	select {
+	case p.active <- struct{}{}:
+	case <-timeoutCh:
+		err = ErrPoolTimeout
+	case <-p.stopCh:
+		err = errPoolClosed
+	}
+
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.stats.WaitCount++
+	p.stats.WaitDuration += time.Since(start)
+	if err == ErrPoolTimeout {
+		p.stats.WaitTimeouts++
+	}
+	return err
+}
+
+func (p *Pool) releaseActive() {
+	if p.active != nil {
+		<-p.active
+	}
+}
+
+// Put gives a connection returned by Get back to the Pool. It's closed instead
+// if it's broken, too old, or the Pool already has size idle connections.
+func (p *Pool) Put(c *redis.Client) {
+	now := time.Now()
+	p.l.Lock()
+	made, ok := p.inUse[c]
+	if !ok {
+		p.l.Unlock()
+		c.Close()
+		return
+	}
+	delete(p.inUse, c)
+
+	pc := &poolConn{c: c, made: made, lastUsed: now}
+	if c.LastCritical != nil || p.closed || len(p.idle) >= p.size {
+		c.Close()
+	} else if ok, stat := p.expired(pc, now); ok {
+		(*stat)++
+		c.Close()
+	} else {
+		p.idle = append(p.idle, pc)
+	}
+	p.l.Unlock()
+	p.releaseActive()
+}
+
+// Cmd implements the method for the util.Cmder interface. It gets a
+// connection, performs the command on it and puts it back.
+func (p *Pool) Cmd(cmd string, args ...interface{}) *redis.Resp {
+	c, err := p.Get()
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	defer p.Put(c)
+	return c.Cmd(cmd, args...)
+}
+
+// Stats returns the current state of the Pool's connections
+func (p *Pool) Stats() PoolStats {
+	p.l.Lock()
+	defer p.l.Unlock()
+	s := p.stats
+	s.InUse = len(p.inUse)
+	s.Idle = len(p.idle)
+	s.Open = s.InUse + s.Idle
+	return s
+}
+
+// Close closes all the Pool's idle connections, and those in use as they're
+// put back. The Pool can't be used afterwards.
+func (p *Pool) Close() {
+	p.l.Lock()
+	defer p.l.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.stopCh)
+	for _, pc := range p.idle {
+		pc.c.Close()
+	}
+	p.idle = nil
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool(t *T) {
+	p, err := NewPool("tcp", "127.0.0.1:6379", 2, DialOpts{}.DialFunc(), PoolOpts{
+		MaxActive:   2,
+		WaitTimeout: 50 * time.Millisecond,
+	})
+	require.Nil(t, err)
+	defer p.Close()
+	require.Nil(t, p.Cmd("PING").Err)
+
+	c1, err := p.Get()
+	require.Nil(t, err)
+	c2, err := p.Get()
+	require.Nil(t, err)
+	s := p.Stats()
+	assert.Equal(t, 2, s.InUse)
+	assert.Equal(t, s.InUse+s.Idle, s.Open)
+
+	// Both allowed connections are in use, so Get times out
+	_, err = p.Get()
+	assert.Equal(t, ErrPoolTimeout, err)
+	assert.Equal(t, ErrPoolTimeout, p.Cmd("PING").Err)
+
+	// until one is put back
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.Put(c1)
+	}()
+	c3, err := p.Get()
+	require.Nil(t, err)
+	assert.Equal(t, c1, c3)
+
+	s = p.Stats()
+	assert.Equal(t, uint64(3), s.WaitCount)
+	assert.Equal(t, uint64(2), s.WaitTimeouts)
+	assert.True(t, s.WaitDuration >= 100*time.Millisecond, "WaitDuration:%s", s.WaitDuration)
+
+	p.Put(c2)
+	p.Put(c3)
+	s = p.Stats()
+	assert.Equal(t, 0, s.InUse)
+	assert.Equal(t, 2, s.Idle)
+}
+
+func TestPoolExpire(t *T) {
+	df := DialOpts{}.DialFunc()
+	p, err := NewPool("tcp", "127.0.0.1:6379", 1, df, PoolOpts{MaxIdleTime: 50 * time.Millisecond})
+	require.Nil(t, err)
+	defer p.Close()
+
+	// Connections which have been idle for too long aren't reused
+	c1, err := p.Get()
+	require.Nil(t, err)
+	p.Put(c1)
+	time.Sleep(100 * time.Millisecond)
+	c2, err := p.Get()
+	require.Nil(t, err)
+	assert.NotEqual(t, c1, c2)
+	p.Put(c2)
+	assert.Equal(t, uint64(1), p.Stats().MaxIdleTimeClosed)
+
+	// and nor are those which are too old, however recently they were used
+	p, err = NewPool("tcp", "127.0.0.1:6379", 1, df, PoolOpts{MaxLifetime: 50 * time.Millisecond})
+	require.Nil(t, err)
+	defer p.Close()
+	c1, err = p.Get()
+	require.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	p.Put(c1)
+	s := p.Stats()
+	assert.Equal(t, uint64(1), s.MaxLifetimeClosed)
+	assert.Equal(t, 0, s.Open)
+}
+
+func TestHealthPoolStats(t *T) {
+	p, err := NewPool("tcp", "127.0.0.1:6379", 2, DialOpts{}.DialFunc(), PoolOpts{})
+	require.Nil(t, err)
+	defer p.Close()
+	c := New(p, nil)
+	c.Run(nil)
+
+	h, err := c.Health(testCtx)
+	require.Nil(t, err)
+	require.NotNil(t, h.PoolStats)
+	assert.Equal(t, h.PoolStats.Idle, h.PoolAvail)
+
+	ps, ok := c.PoolStats()
+	assert.True(t, ok)
+	assert.True(t, ps.Open > 0)
+	_, ok = testCore.PoolStats()
+	assert.False(t, ok)
+}
@@ -0,0 +1,218 @@
+package core
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// How often the pubsub connection is pinged to make sure it's still alive. If
+// nothing is read from it for twice this long it's considered dead.
+const pubsubPingPeriod = 5 * time.Second
+
+// How many Publications a KeySubscribe channel can have waiting to be read
+// before further ones are dropped
+const pubsubPublicationsBuffer = 1024
+
+// pubsub maintains a single connection to redis which is subscribed to every
+// channel being waited on with KeyWait or KeySubscribe, and passes publishes
+// on those channels along to the waiters. Channels subscribed to while the
+// connection isn't up are subscribed to once it is.
+type pubsub struct {
+	l    sync.Mutex
+	subs map[string]map[chan<- string]bool
+	conn net.Conn
+}
+
+func newPubsub() *pubsub {
+	return &pubsub{
+		subs: map[string]map[chan<- string]bool{},
+	}
+}
+
+// must be called with l held. Errors are ignored, since they'll also be
+// encountered by the read loop in run, which will then reconnect.
+func (ps *pubsub) write(cmd ...string) {
+	if ps.conn == nil {
+		return
+	}
+	ps.conn.SetWriteDeadline(time.Now().Add(pubsubPingPeriod))
+	redis.NewResp(cmd).WriteTo(ps.conn)
+}
+
+// ch will have the message written to it, without blocking, whenever there is
+// a publish to the given channel
+func (ps *pubsub) subscribe(ch chan<- string, channel string) {
+	ps.l.Lock()
+	defer ps.l.Unlock()
+	if ps.subs[channel] == nil {
+		ps.subs[channel] = map[chan<- string]bool{}
+		ps.write("SUBSCRIBE", channel)
+	}
+	ps.subs[channel][ch] = true
+}
+
+func (ps *pubsub) unsubscribe(ch chan<- string, channel string) {
+	ps.l.Lock()
+	defer ps.l.Unlock()
+	delete(ps.subs[channel], ch)
+	if len(ps.subs[channel]) == 0 {
+		delete(ps.subs, channel)
+		ps.write("UNSUBSCRIBE", channel)
+	}
+}
+
+func (ps *pubsub) publish(r *redis.Resp) {
+	arr, err := r.Array()
+	if err != nil || len(arr) < 3 {
+		return
+	} else if kind, _ := arr[0].Str(); kind != "message" {
+		return
+	}
+	channel, err := arr[1].Str()
+	if err != nil {
+		return
+	}
+	msg, err := arr[2].Str()
+	if err != nil {
+		return
+	}
+	ps.notify(channel, msg)
+}
+
+// notify writes the message to every channel subscribed to the given pubsub
+// channel. It's also used directly by MemBackend, which has no connection to
+// publish over.
+func (ps *pubsub) notify(channel, msg string) {
+	ps.l.Lock()
+	defer ps.l.Unlock()
+	for ch := range ps.subs[channel] {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// wait implements KeyWait for the given pubsub channel
+func (ps *pubsub) wait(ctx context.Context, channel string) <-chan struct{} {
+	retCh := make(chan struct{})
+
+	// Subscribe before returning, so that a KeyNotify made any time after
+	// KeyWait returns is seen
+	readCh := make(chan string, 1)
+	ps.subscribe(readCh, channel)
+
+	go func() {
+		select {
+		case <-readCh:
+		case <-ctx.Done():
+		}
+		close(retCh)
+		ps.unsubscribe(readCh, channel)
+	}()
+
+	return retCh
+}
+
+// publications implements KeySubscribe for the given pubsub channel
+func (ps *pubsub) publications(ctx context.Context, channel string) <-chan Publication {
+	retCh := make(chan Publication)
+
+	// As with wait, the subscription is made before returning
+	readCh := make(chan string, pubsubPublicationsBuffer)
+	ps.subscribe(readCh, channel)
+
+	go func() {
+		defer close(retCh)
+		defer ps.unsubscribe(readCh, channel)
+		for {
+			var msg string
+			select {
+			case msg = <-readCh:
+			case <-ctx.Done():
+				return
+			}
+
+			var pub Publication
+			if _, err := pub.UnmarshalMsg([]byte(msg)); err != nil {
+				continue
+			}
+			select {
+			case retCh <- pub:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return retCh
+}
+
+// run connects to redis at addr and passes along publishes until the
+// connection fails, in which case the error is returned, or stopCh is closed,
+// in which case nil is returned.
+func (ps *pubsub) run(network, addr string, o DialOpts, stopCh <-chan struct{}) error {
+	conn, err := o.dialConn(network, addr)
+	if err != nil {
+		return err
+	}
+
+	ps.l.Lock()
+	ps.conn = conn
+	if len(ps.subs) > 0 {
+		cmd := []string{"SUBSCRIBE"}
+		for channel := range ps.subs {
+			cmd = append(cmd, channel)
+		}
+		ps.write(cmd...)
+	}
+	ps.l.Unlock()
+
+	doneCh := make(chan struct{})
+	defer func() {
+		close(doneCh)
+		ps.l.Lock()
+		ps.conn = nil
+		ps.l.Unlock()
+		conn.Close()
+	}()
+
+	go func() {
+		tick := time.NewTicker(pubsubPingPeriod)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				ps.l.Lock()
+				ps.write("PING")
+				ps.l.Unlock()
+			case <-stopCh:
+				// Closing the connection is the only way to interrupt the read
+				// loop
+				conn.Close()
+				return
+			case <-doneCh:
+				return
+			}
+		}
+	}()
+
+	rr := redis.NewRespReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * pubsubPingPeriod))
+		r := rr.Read()
+		if r.Err != nil {
+			select {
+			case <-stopCh:
+				return nil
+			default:
+				return r.Err
+			}
+		}
+		ps.publish(r)
+	}
+}
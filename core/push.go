@@ -1,29 +1,27 @@
 package core
 
-import "github.com/mediocregopher/wublub"
+import (
+	"context"
+)
 
 // KeyWait returns a channel which will be closed when the given Key
-// is notified by some other process. stopCh can be closed to stop waiting and
+// is notified by some other process. ctx can be canceled to stop waiting and
 // immediately close the returned channel
-func (c *Core) KeyWait(k Key, stopCh <-chan struct{}) <-chan struct{} {
-	retCh := make(chan struct{})
-
-	go func() {
-		readCh := make(chan wublub.Publish, 1)
-		c.w.Subscribe(readCh, k.String(c.o.RedisPrefix))
-		select {
-		case <-readCh:
-		case <-stopCh:
-		}
-		close(retCh)
-		c.w.Unsubscribe(readCh, k.String(c.o.RedisPrefix))
-	}()
-
-	return retCh
+func (c *Core) KeyWait(ctx context.Context, k Key) <-chan struct{} {
+	return c.b.KeyWait(ctx, k)
 }
 
 // KeyNotify will notify all processes currently waiting on the given
 // Key using KeyWait
-func (c *Core) KeyNotify(k Key) {
-	c.c.Cmd("PUBLISH", k.String(c.o.RedisPrefix), "notify")
+func (c *Core) KeyNotify(ctx context.Context, k Key) {
+	c.b.KeyNotify(ctx, k)
+}
+
+// KeySubscribe returns a channel on which every Publication made to the given
+// Key by a QueryPublish is written, until ctx is canceled, after which the
+// channel is closed. Publications are made over redis pubsub, so those made
+// while the connection kept open by Run is down are never received, and those
+// made while the channel isn't being read from quickly enough are dropped.
+func (c *Core) KeySubscribe(ctx context.Context, k Key) <-chan Publication {
+	return c.b.KeySubscribe(ctx, k)
 }
@@ -1,11 +1,13 @@
 package core
 
 import (
+	"context"
 	. "testing"
 	"time"
 
 	"github.com/levenlabs/golib/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestKeyWait(t *T) {
@@ -13,8 +15,8 @@ func TestKeyWait(t *T) {
 	base := testutil.RandStr()
 	k1 := randKey(base)
 	k2 := randKey(base)
-	testCore.KeyNotify(k1)
-	testCore.KeyNotify(k2)
+	testCore.KeyNotify(testCtx, k1)
+	testCore.KeyNotify(testCtx, k2)
 
 	// This test shouldn't take too long
 	go func() {
@@ -24,26 +26,26 @@ func TestKeyWait(t *T) {
 
 	ch1 := make(chan bool, 1)
 	go func() {
-		<-testCore.KeyWait(k1, nil)
+		<-testCore.KeyWait(testCtx, k1)
 		ch1 <- true
 	}()
 
 	ch2 := make(chan bool, 1)
 	go func() {
-		<-testCore.KeyWait(k1, nil)
+		<-testCore.KeyWait(testCtx, k1)
 		ch2 <- true
 	}()
 
 	ch3 := make(chan bool, 1)
 	go func() {
-		<-testCore.KeyWait(k2, nil)
+		<-testCore.KeyWait(testCtx, k2)
 		ch3 <- true
 	}()
 
 	ch4 := make(chan bool, 1)
-	ch4stop := make(chan struct{})
+	ctx4, cancel4 := context.WithCancel(testCtx)
 	go func() {
-		<-testCore.KeyWait(randKey(base), ch4stop)
+		<-testCore.KeyWait(ctx4, randKey(base))
 		ch4 <- true
 	}()
 
@@ -71,16 +73,57 @@ func TestKeyWait(t *T) {
 	assertBlocking(ch3)
 	assertBlocking(ch4)
 
-	testCore.KeyNotify(k1)
+	testCore.KeyNotify(testCtx, k1)
 	assertNotBlocking(ch1)
 	assertNotBlocking(ch2)
 	assertBlocking(ch3)
 	assertBlocking(ch4)
 
-	testCore.KeyNotify(k2)
+	testCore.KeyNotify(testCtx, k2)
 	assertNotBlocking(ch3)
 	assertBlocking(ch4)
 
-	close(ch4stop)
+	cancel4()
 	assertNotBlocking(ch4)
 }
+
+func TestKeySubscribe(t *T) {
+	for _, c := range []*Core{testCore, newTestMemCore()} {
+		base := testutil.RandStr()
+		k, kOther := randKey(base), randKey(base)
+		ctx, cancel := context.WithCancel(testCtx)
+		ch := c.KeySubscribe(ctx, k)
+		time.Sleep(100 * time.Millisecond)
+
+		now := time.Now()
+		ii := []ID{
+			{T: NewTS(now), Expire: NewTS(now.Add(time.Minute))},
+			{T: NewTS(now) + 1, Expire: NewTS(now.Add(time.Minute))},
+		}
+		publish := func(k Key, ii []ID, msg string) {
+			_, err := c.Query(testCtx, QueryActions{
+				KeyBase: base,
+				QueryActions: []QueryAction{
+					{QuerySelector: &QuerySelector{Key: k, IDs: ii}},
+					{QueryPublish: &QueryPublish{Key: k, Message: msg}},
+				},
+			})
+			require.Nil(t, err)
+		}
+
+		// Nothing is published for an empty input or to other Keys
+		publish(k, nil, "empty")
+		publish(kOther, ii, "other")
+		publish(k, ii, "foo")
+		select {
+		case pub := <-ch:
+			assert.Equal(t, Publication{Message: "foo", IDs: ii}, pub)
+		case <-time.After(time.Second):
+			assert.Fail(t, "publication not received")
+		}
+
+		cancel()
+		for range ch {
+		}
+	}
+}
@@ -1,6 +1,13 @@
 local nowTS = cmsgpack.unpack(ARGV[1])
 local prefix = ARGV[3]
 
+-- Any events to set before performing the actions follow the Key, with their
+-- PEXPIREAT times and values following the other ARGV
+for i = 2,#KEYS do
+    redis.call("SET", KEYS[i], ARGV[(i*2)+1])
+    redis.call("PEXPIREAT", KEYS[i], ARGV[i*2])
+end
+
 -- For the result field, but we have to declare it before it's used for whatever
 -- reason
 local counts = {}
@@ -18,6 +25,11 @@ local function keyString(k)
     return str
 end
 
+-- returns the same string as the String method on ID in go
+local function idString(id)
+    return string.format("%.0f_%.0f", id.T, id.Expire)
+end
+
 local function expandID(id)
     local idout
     if type(id) == "string" then
@@ -127,6 +139,15 @@ local function query_filter(input, qf)
         local filter
         if qf.Expired then
             filter = id.Expire <= nowTS
+        elseif qf.ScoreKey then
+            local score = redis.call("ZSCORE", keyString(qf.ScoreKey), id.packed)
+            if not score then
+                filter = true
+            else
+                score = tonumber(score)
+                filter = (qf.ScoreMin > 0 and score < qf.ScoreMin) or
+                         (qf.ScoreMax > 0 and score > qf.ScoreMax)
+            end
         end
         -- ~= is not equals, which is synonomous with xor
         filter = filter ~= qf.Invert
@@ -135,6 +156,76 @@ local function query_filter(input, qf)
     return output
 end
 
+-- returns whether the value found in an event's contents matches the
+-- ContentsCondition, see ContentsCondition's match method in go
+local function contents_compare(v, cond)
+    local want = cond.Value
+    if v == nil then v = cjson.null end
+    if want == nil then want = cjson.null end
+    if cond.Op == "==" then return v == want end
+    if cond.Op == "!=" then return v ~= want end
+    if type(v) ~= type(want) or (type(v) ~= "number" and type(v) ~= "string") then
+        return false
+    end
+    if cond.Op == "<" then return v < want end
+    if cond.Op == "<=" then return v <= want end
+    if cond.Op == ">" then return v > want end
+    if cond.Op == ">=" then return v >= want end
+    return false
+end
+
+local function contents_match(id, cf)
+    local val = redis.call("GET", prefix .. ":event:" .. idString(id))
+    if not val then return false end
+    local e = cmsgpack.unpack(val)
+    if e.Flags and e.Flags ~= 0 then return false end
+    local ok, obj = pcall(cjson.decode, e.Contents)
+    if not ok or type(obj) ~= "table" then return false end
+    for i = 1, #cf.Conditions do
+        local cond = cf.Conditions[i]
+        local v = obj
+        for j = 1, #cond.Path do
+            if type(v) ~= "table" then v = nil break end
+            v = v[cond.Path[j]]
+        end
+        if not contents_compare(v, cond) then return false end
+    end
+    return true
+end
+
+local function query_contents_filter(input, qcf)
+    local output = {}
+    for i = 1, #input do
+        if qcf.Limit > 0 and #output >= qcf.Limit then break end
+        if contents_match(input[i], qcf.ContentsFilter) then
+            table.insert(output, input[i])
+        end
+    end
+
+    if qcf.SkipTo then
+        local skipped = 0
+        if #output == 0 and #input > 0 then
+            skipped = #input
+
+            -- The same as a QuerySingleSet with IfNewer and Newest
+            local id = input[#input]
+            local score = id.T
+            if qcf.SkipScoreFrom then
+                score = redis.call("ZSCORE", keyString(qcf.SkipScoreFrom), id.packed)
+            end
+            if score then
+                id = expandID({T = tonumber(score), Expire = id.Expire})
+                local key = keyString(qcf.SkipTo)
+                local oldi = redis.call("GET", key)
+                if not oldi or expandID(oldi).T <= id.T then
+                    redis.call("SET", key, id.packed)
+                end
+            end
+        end
+        table.insert(counts, skipped)
+    end
+    return output
+end
 
 -- Returns true if the conditional succeeds, i.e. the QueryAction should be
 -- performed
@@ -178,14 +269,30 @@ local function query_action(input, qa)
         return input, false
     end
 
+    if qa.ScoresFrom then
+        local key = keyString(qa.ScoresFrom)
+        for i = 1, #input do
+            local score = redis.call("ZSCORE", key, input[i].packed)
+            table.insert(counts, tonumber(score) or 0)
+        end
+        return input, false
+    end
+
     if qa.QueryAddTo then
         for i = 1, #qa.QueryAddTo.Keys do
             local key = keyString(qa.QueryAddTo.Keys[i])
             for i = 1, #input do
                 local score = input[i].T
                 if qa.QueryAddTo.ExpireAsScore then score = input[i].Expire end
-                if qa.QueryAddTo.Score > 0 then score = qa.QueryAddTo.Score end
-                redis.call("ZADD", key, score, input[i].packed)
+                if qa.QueryAddTo.Score > 0 then
+                    score = qa.QueryAddTo.Score
+                    if qa.QueryAddTo.ScoreIncr then score = score + i - 1 end
+                end
+                if qa.QueryAddTo.Incr then
+                    redis.call("ZINCRBY", key, score, input[i].packed)
+                else
+                    redis.call("ZADD", key, score, input[i].packed)
+                end
             end
         end
         return input, false
@@ -201,6 +308,61 @@ local function query_action(input, qa)
         return input, false
     end
 
+    if qa.QueryHashSet then
+        local key = keyString(qa.QueryHashSet.Key)
+        for i = 1, #input do
+            redis.call("HSET", key, idString(input[i]), qa.QueryHashSet.Value)
+        end
+        return input, false
+    end
+
+    if qa.HashDel then
+        local key = keyString(qa.HashDel)
+        for i = 1, #input do
+            redis.call("HDEL", key, idString(input[i]))
+        end
+        return input, false
+    end
+
+    if qa.QueryPublish then
+        if #input == 0 then return input, false end
+        local ids = {}
+        for i = 1, #input do
+            table.insert(ids, {T = input[i].T, Expire = input[i].Expire})
+        end
+        local pub = cmsgpack.pack({Message = qa.QueryPublish.Message, IDs = ids})
+        redis.call("PUBLISH", keyString(qa.QueryPublish.Key), pub)
+        return input, false
+    end
+
+    if qa.RateLimit then
+        if #input == 0 then return input, false end
+        local key = keyString(qa.RateLimit)
+        local bucket = redis.call("HMGET", key, "rate", "burst", "tokens", "ts")
+        local rate = tonumber(bucket[1])
+        if not rate or rate <= 0 then return input, false end
+        local burst = tonumber(bucket[2]) or 1
+        if burst < 1 then burst = 1 end
+        local tokens = tonumber(bucket[3]) or burst
+        local ts = tonumber(bucket[4]) or nowTS
+
+        -- TSs are in microseconds. Clocks on different machines might not
+        -- agree, so the bucket's ts is never moved backwards
+        if nowTS > ts then
+            tokens = math.min(burst, tokens + ((nowTS - ts) / 1e6) * rate)
+            ts = nowTS
+        end
+
+        local output = {}
+        for i = 1, math.min(#input, math.floor(tokens)) do
+            table.insert(output, input[i])
+        end
+        tokens = tokens - #output
+
+        redis.call("HMSET", key, "tokens", tostring(tokens), "ts", string.format("%.0f", ts))
+        return output, false
+    end
+
     if qa.QueryRemoveByScore then
         local qrems = qa.QueryRemoveByScore
         local min, max = query_score_range(input, qrems.QueryScoreRange)
@@ -215,16 +377,23 @@ local function query_action(input, qa)
         local qss = qa.QuerySingleSet
         local key = keyString(qss.Key)
         if #input > 0 then
+            local id = input[1]
+            if qss.Newest then id = input[#input] end
+            if qss.ScoreFrom then
+                local score = redis.call("ZSCORE", keyString(qss.ScoreFrom), id.packed)
+                if not score then return input, false end
+                id = expandID({T = tonumber(score), Expire = id.Expire})
+            end
             if qss.IfNewer then
                 local oldi = redis.call("GET", key)
                 if oldi then
                     oldi = expandID(oldi)
-                    if oldi.T > input[1].T then
+                    if oldi.T > id.T then
                         return input, false
                     end
                 end
             end
-            redis.call("SET", key, input[1].packed)
+            redis.call("SET", key, id.packed)
         end
         return input, false
     end
@@ -246,6 +415,10 @@ local function query_action(input, qa)
 
     if qa.QueryFilter then return query_filter(input, qa.QueryFilter), false end
 
+    if qa.QueryContentsFilter then
+        return query_contents_filter(input, qa.QueryContentsFilter), false
+    end
+
     -- Shouldn't really get here but whatever
     return input, false
 end
@@ -267,10 +440,17 @@ end
 
 local qas = cmsgpack.unpack(ARGV[2])
 local ii = {}
+local explain = {}
 for i = 1,#qas.QueryActions do
     local qa = qas.QueryActions[i]
     local newii, skipped = query_action(ii, qa)
-    if not skipped and qas.QueryActions[i].Break then break end
+    if not skipped and qas.QueryActions[i].Break then
+        if qas.Explain then
+            table.insert(explain, {Skipped = false, Broke = true, In = #ii, Out = #ii})
+        end
+        break
+    end
+    local inLen = #ii
 
     if qa.Union then
         local set = {}
@@ -291,10 +471,16 @@ for i = 1,#qas.QueryActions do
     -- knowing that the ids were stored ordered by T versus something else, and
     -- for Union we have to do it anyway
     ii = sort_ids(newii)
+
+    if qas.Explain then
+        table.insert(explain, {Skipped = skipped, Broke = false, In = inLen, Out = #ii})
+    end
 end
 
 for i = 1,#ii do
     ii[i].packed = nil
 end
 
-return cmsgpack.pack({IDs = ii, Counts = counts})
+local res = {IDs = ii, Counts = counts}
+if qas.Explain then res.Explain = explain end
+return cmsgpack.pack(res)
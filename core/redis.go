@@ -0,0 +1,582 @@
+package core
+
+//go:generate varembed -pkg core -in query.lua -out query_lua.go -varname queryLua
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/cluster"
+	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/mediocregopher/radix.v2/util"
+	"github.com/tinylib/msgp/msgp"
+)
+
+var (
+	bpool = sync.Pool{
+		New: func() interface{} {
+			return make([]byte, 0, 10240)
+		},
+	}
+
+	// converted once, rather than on every Query
+	queryLuaStr = string(queryLua)
+)
+
+// Cleverly marshal multiple things into a single byte buffer. All the []bytes
+// that get put in bb and passed to the callback are actually pointers into the
+// same buffer, which gets expanded and put back in the pool. If ctx is done by
+// the time the callback returns the buffer is left out of the pool, since a
+// command abandoned by withCtx may still be using it.
+func withMarshaled(ctx context.Context, fn func([][]byte), mm ...msgp.Marshaler) {
+	b := bpool.Get().([]byte)
+	bb := make([][]byte, len(mm))
+
+	// Everything is appended to b, and only sliced up once it's all been
+	// marshaled, since b may be reallocated along the way. That way it's the
+	// whole of b which goes back in the pool, rather than whatever was left of
+	// it after the last thing.
+	ends := make([]int, len(mm))
+	var err error
+	for i := range mm {
+		if b, err = mm[i].MarshalMsg(b); err != nil {
+			panic(err)
+		}
+		ends[i] = len(b)
+	}
+	var start int
+	for i := range bb {
+		bb[i] = b[start:ends[i]:ends[i]]
+		start = ends[i]
+	}
+
+	fn(bb)
+	if ctx.Err() == nil {
+		bpool.Put(b[:0])
+	}
+}
+
+// withCtx calls fn and returns its response, unless ctx is done first, in which
+// case a response containing ctx's error is returned instead. radix has no way
+// of interrupting a command, so fn is left to finish in the background.
+func withCtx(ctx context.Context, fn func() *redis.Resp) *redis.Resp {
+	if err := ctx.Err(); err != nil {
+		return redis.NewResp(err)
+	} else if ctx.Done() == nil {
+		// ctx can never be canceled, don't bother with the goroutine
+		return fn()
+	}
+
+	respCh := make(chan *redis.Resp, 1)
+	go func() { respCh <- fn() }()
+	select {
+	case r := <-respCh:
+		return r
+	case <-ctx.Done():
+		return redis.NewResp(ctx.Err())
+	}
+}
+
+// Wrapper may be implemented by a util.Cmder which wraps another one, e.g. to
+// add tracing or metrics to every command. Core uses it to find out what kind
+// of Cmder is ultimately being used, so that a wrapped *cluster.Cluster is
+// still treated as a cluster. All commands are still sent through the
+// Wrapper, except SCANs against a cluster which need to be sent to every node.
+type Wrapper interface {
+	util.Cmder
+	Unwrap() util.Cmder
+}
+
+// returns the innermost Cmder of any Wrappers
+func unwrap(cmder util.Cmder) util.Cmder {
+	for {
+		w, ok := cmder.(Wrapper)
+		if !ok {
+			return cmder
+		}
+		cmder = w.Unwrap()
+	}
+}
+
+// redisBackend is the Backend used by New, which stores everything in redis
+type redisBackend struct {
+	ps *pubsub
+	c  util.Cmder
+	o  Opts
+
+	// c with any Wrappers removed
+	inner util.Cmder
+}
+
+func newRedisBackend(cmder util.Cmder, o Opts) *redisBackend {
+	return &redisBackend{
+		ps:    newPubsub(),
+		c:     cmder,
+		o:     o,
+		inner: unwrap(cmder),
+	}
+}
+
+// Run implements the method for the Backend interface. It keeps a pubsub
+// connection open for KeyWait and KeySubscribe.
+func (c *redisBackend) Run(stopCh chan struct{}) chan error {
+	wErrCh := make(chan error, 1)
+	addr := c.o.PubSubAddr
+	switch inner := c.inner.(type) {
+	case *cluster.Cluster:
+		rand := rand.New(rand.NewSource(time.Now().UnixNano()))
+		addr = inner.GetAddrForKey(strconv.Itoa(rand.Int()))
+	case *Sentinel:
+		var err error
+		if addr, err = inner.masterAddr(); err != nil {
+			wErrCh <- err
+			return wErrCh
+		}
+	case *pool.Pool:
+		conn, err := inner.Get()
+		if err != nil {
+			wErrCh <- err
+			return wErrCh
+		}
+		// The pool's Addr is used rather than the connection's, since it's
+		// what the user gave and so will work with TLS verification
+		addr = inner.Addr
+		inner.Put(conn)
+	case *Pool:
+		conn, err := inner.Get()
+		if err != nil {
+			wErrCh <- err
+			return wErrCh
+		}
+		addr = inner.Addr
+		inner.Put(conn)
+	default:
+		if addr == "" {
+			wErrCh <- errors.New("PubSubAddr must be set for this kind of Cmder")
+			return wErrCh
+		}
+	}
+
+	go func() {
+		for {
+			err := c.ps.run("tcp", addr, c.o.DialOpts, stopCh)
+			s, ok := c.inner.(*Sentinel)
+			if err == nil || !ok {
+				wErrCh <- err
+				return
+			}
+
+			// If the master was failed over pubsub continues on the new one,
+			// otherwise the error is real
+			newAddr, aerr := s.masterAddr()
+			if aerr != nil || newAddr == addr {
+				wErrCh <- err
+				return
+			}
+			addr = newAddr
+		}
+	}()
+	return wErrCh
+}
+
+// MonoTSs implements the method for the Backend interface. The last TS handed
+// out is kept in redis, so TSs are unique across every process using it.
+func (c *redisBackend) MonoTSs(ctx context.Context, t TS, n int) ([]TS, error) {
+	lua := `
+		local key = KEYS[1]
+		local now_raw = ARGV[1]
+		local n = tonumber(ARGV[2])
+		local now = cmsgpack.unpack(now_raw)
+		local last_raw = redis.call("GET", key)
+
+		local first = now
+		if last_raw then
+			local last = cmsgpack.unpack(last_raw)
+			-- Add a microsecond and use that
+			if last >= now then first = last + 1 end
+		end
+
+		redis.call("SET", key, cmsgpack.pack(first + n - 1))
+		return cmsgpack.pack(first)
+	`
+
+	idKey := c.o.RedisPrefix + ":monots"
+
+	var ib []byte
+	var err error
+	withMarshaled(ctx, func(bb [][]byte) {
+		nowb := bb[0]
+		ib, err = withCtx(ctx, func() *redis.Resp {
+			return c.luaEval(lua, 1, idKey, nowb, n)
+		}).Bytes()
+	}, t)
+	if err != nil {
+		return nil, err
+	}
+
+	var first TS
+	if _, err = first.UnmarshalMsg(ib); err != nil {
+		return nil, err
+	}
+
+	tt := make([]TS, n)
+	for i := range tt {
+		tt[i] = first + TS(i)
+	}
+	return tt, nil
+}
+
+// returns the events as msgp.Marshalers, for passing into withMarshaled
+func eventMarshalers(ee []Event) []msgp.Marshaler {
+	mm := make([]msgp.Marshaler, len(ee))
+	for i := range ee {
+		mm[i] = &ee[i]
+	}
+	return mm
+}
+
+func pexpireAt(t TS, buffer time.Duration) int64 {
+	return t.Time().Add(buffer).UnixNano() / 1e6 // to millisecond
+}
+
+// this is separate from Key so events don't get picked up by KeyScan
+func (c *redisBackend) eventKey(id ID) string {
+	var buf [64]byte
+	b := append(buf[:0], c.o.RedisPrefix...)
+	b = append(b, ":event:"...)
+	return string(id.appendString(b))
+}
+
+// sets a single event, whose key will expire based on the ID field in it (which
+// will be truncated to an integer) added with the given buffer
+func (c *redisBackend) setEvent(ctx context.Context, e Event, expireBuffer time.Duration) error {
+	pex := pexpireAt(e.ID.Expire, expireBuffer)
+	lua := `
+		local key = KEYS[1]
+		local pexpire = ARGV[1]
+		local val = ARGV[2]
+		redis.call("SET", key, val)
+		redis.call("PEXPIREAT", key, pexpire)
+	`
+
+	var err error
+	withMarshaled(ctx, func(bb [][]byte) {
+		eb := bb[0]
+		err = withCtx(ctx, func() *redis.Resp {
+			return c.luaEval(lua, 1, c.eventKey(e.ID), pex, eb)
+		}).Err
+	}, &e)
+	return err
+}
+
+// SetEvents implements the method for the Backend interface. When not running
+// against a cluster this is done in a single round-trip.
+func (c *redisBackend) SetEvents(ctx context.Context, ee []Event, expireBuffer time.Duration) error {
+	// The event keys are spread across the cluster, so there's no way to set
+	// them all in a single script
+	if _, ok := c.inner.(*cluster.Cluster); ok || len(ee) == 1 {
+		for _, e := range ee {
+			if err := c.setEvent(ctx, e, expireBuffer); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	lua := `
+		for i = 1,#KEYS do
+			local pexpire = ARGV[(i*2)-1]
+			local val = ARGV[i*2]
+			redis.call("SET", KEYS[i], val)
+			redis.call("PEXPIREAT", KEYS[i], pexpire)
+		end
+	`
+
+	var err error
+	withMarshaled(ctx, func(bb [][]byte) {
+		args := make([]interface{}, 0, len(ee)*3)
+		for i := range ee {
+			args = append(args, c.eventKey(ee[i].ID))
+		}
+		for i := range ee {
+			args = append(args, pexpireAt(ee[i].ID.Expire, expireBuffer), bb[i])
+		}
+		err = withCtx(ctx, func() *redis.Resp {
+			return c.luaEval(lua, len(ee), args...)
+		}).Err
+	}, eventMarshalers(ee)...)
+	return err
+}
+
+func (c *redisBackend) getEvent(ctx context.Context, id ID) (Event, error) {
+	return unmarshalEventResp(withCtx(ctx, func() *redis.Resp {
+		return c.c.Cmd("GET", c.eventKey(id))
+	}))
+}
+
+// GetEvents implements the method for the Backend interface. When not running
+// against a cluster this is done in a single round-trip.
+func (c *redisBackend) GetEvents(ctx context.Context, ii []ID) ([]Event, error) {
+	ee := make([]Event, len(ii))
+
+	// The event keys are spread across the cluster, so there's no way to get
+	// them all in a single command
+	if _, ok := c.inner.(*cluster.Cluster); ok || len(ii) == 1 {
+		for i := range ii {
+			var err error
+			if ee[i], err = c.getEvent(ctx, ii[i]); err != nil {
+				return nil, err
+			}
+		}
+		return ee, nil
+	}
+
+	keys := make([]interface{}, len(ii))
+	for i := range ii {
+		keys[i] = c.eventKey(ii[i])
+	}
+
+	rr, err := withCtx(ctx, func() *redis.Resp {
+		return c.c.Cmd("MGET", keys...)
+	}).Array()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rr {
+		if ee[i], err = unmarshalEventResp(rr[i]); err != nil {
+			return nil, err
+		}
+	}
+	return ee, nil
+}
+
+func unmarshalEventResp(r *redis.Resp) (Event, error) {
+	if r.IsType(redis.Nil) {
+		return Event{}, ErrNotFound
+	}
+
+	eb, err := r.Bytes()
+	if err != nil {
+		return Event{}, err
+	}
+
+	var e Event
+	_, err = e.UnmarshalMsg(eb)
+	return e, err
+}
+
+// Query implements the method for the Backend interface. The QueryActions are
+// performed by a single lua script, see query.lua.
+func (c *redisBackend) Query(ctx context.Context, qas QueryActions) (QueryRes, error) {
+	// The event keys won't be in the same slot as the Query's, so against a
+	// cluster they have to be set separately
+	ee := qas.Events
+	_, isCluster := c.inner.(*cluster.Cluster)
+	if isCluster && qas.CrossBase {
+		return QueryRes{}, ErrClusterCrossBase
+	} else if isCluster {
+		for _, qa := range qas.QueryActions {
+			if qa.QueryContentsFilter != nil {
+				return QueryRes{}, ErrClusterContentsFilter
+			}
+		}
+	}
+	if isCluster && len(ee) > 0 {
+		if err := c.SetEvents(ctx, ee, qas.EventsExpireBuffer); err != nil {
+			return QueryRes{}, err
+		}
+		ee = nil
+	}
+
+	mm := append([]msgp.Marshaler{qas.Now, &qas}, eventMarshalers(ee)...)
+
+	var err error
+	var resb []byte
+	withMarshaled(ctx, func(bb [][]byte) {
+		nowb := bb[0]
+		qasb := bb[1]
+		k := Key{Base: qas.KeyBase}.String(c.o.RedisPrefix)
+
+		// query.lua sets the events given after its own KEYS and ARGV
+		args := make([]interface{}, 0, 4+len(ee)*3)
+		args = append(args, k)
+		for i := range ee {
+			args = append(args, c.eventKey(ee[i].ID))
+		}
+		args = append(args, nowb, qasb, c.o.RedisPrefix)
+		for i := range ee {
+			args = append(args, pexpireAt(ee[i].ID.Expire, qas.EventsExpireBuffer), bb[i+2])
+		}
+
+		resb, err = withCtx(ctx, func() *redis.Resp {
+			return c.luaEval(queryLuaStr, 1+len(ee), args...)
+		}).Bytes()
+	}, mm...)
+	if err != nil {
+		return QueryRes{}, err
+	}
+
+	var res QueryRes
+	_, err = res.UnmarshalMsg(resb)
+	return res, err
+}
+
+// KeyScan implements the method for the Backend interface. ctx is checked
+// between each batch of keys returned by redis.
+func (c *redisBackend) KeyScan(ctx context.Context, k Key) ([]Key, error) {
+	// The scanner needs to know if it's dealing with a cluster, so it can scan
+	// every node
+	s := util.NewScanner(c.inner, util.ScanOpts{
+		Command: "SCAN",
+		Pattern: k.String(c.o.RedisPrefix),
+	})
+
+	var ret []Key
+	for s.HasNext() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ret = append(ret, KeyFromString(s.Next()))
+	}
+	return ret, s.Err()
+}
+
+// HashGetIDs implements the method for the Backend interface
+func (c *redisBackend) HashGetIDs(ctx context.Context, k Key, ii []ID) ([]string, error) {
+	ret := make([]string, len(ii))
+
+	args := make([]interface{}, 0, len(ii)+1)
+	args = append(args, k.String(c.o.RedisPrefix))
+	for _, id := range ii {
+		args = append(args, id.String())
+	}
+
+	arr, err := withCtx(ctx, func() *redis.Resp {
+		return c.c.Cmd("HMGET", args...)
+	}).Array()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, r := range arr {
+		if r.IsType(redis.Nil) {
+			continue
+		}
+		if ret[i], err = r.Str(); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// HashSetAll implements the method for the Backend interface
+func (c *redisBackend) HashSetAll(ctx context.Context, k Key, m map[string]string) error {
+	lua := `
+		redis.call("DEL", KEYS[1])
+		if #ARGV > 0 then
+			redis.call("HMSET", KEYS[1], unpack(ARGV))
+		end
+		return "OK"
+	`
+
+	args := make([]interface{}, 0, len(m)*2)
+	for field, val := range m {
+		args = append(args, field, val)
+	}
+
+	return withCtx(ctx, func() *redis.Resp {
+		return c.luaEval(lua, 1, append([]interface{}{k.String(c.o.RedisPrefix)}, args...)...)
+	}).Err
+}
+
+// HashGetAll implements the method for the Backend interface
+func (c *redisBackend) HashGetAll(ctx context.Context, k Key) (map[string]string, error) {
+	return withCtx(ctx, func() *redis.Resp {
+		return c.c.Cmd("HGETALL", k.String(c.o.RedisPrefix))
+	}).Map()
+}
+
+// SetString implements the method for the Backend interface
+func (c *redisBackend) SetString(ctx context.Context, k Key, val string, ttl time.Duration) error {
+	pttl := int64(ttl / time.Millisecond)
+	if pttl < 1 {
+		pttl = 1
+	}
+	return withCtx(ctx, func() *redis.Resp {
+		return c.c.Cmd("SET", k.String(c.o.RedisPrefix), val, "PX", pttl)
+	}).Err
+}
+
+// GetString implements the method for the Backend interface
+func (c *redisBackend) GetString(ctx context.Context, k Key) (string, error) {
+	r := withCtx(ctx, func() *redis.Resp {
+		return c.c.Cmd("GET", k.String(c.o.RedisPrefix))
+	})
+	if r.IsType(redis.Nil) {
+		return "", ErrNotFound
+	}
+	return r.Str()
+}
+
+// SetIDNX implements the method for the Backend interface
+func (c *redisBackend) SetIDNX(ctx context.Context, k Key, id ID, ttl time.Duration) (ID, bool, error) {
+	lua := `
+		local key = KEYS[1]
+		local val = ARGV[1]
+		local pttl = ARGV[2]
+		if redis.call("SET", key, val, "NX", "PX", pttl) then
+			return {1, val}
+		end
+		return {0, redis.call("GET", key)}
+	`
+
+	pttl := int64(ttl / time.Millisecond)
+	if pttl < 1 {
+		pttl = 1
+	}
+
+	arr, err := withCtx(ctx, func() *redis.Resp {
+		return c.luaEval(lua, 1, k.String(c.o.RedisPrefix), id.String(), pttl)
+	}).Array()
+	if err != nil {
+		return ID{}, false, err
+	} else if len(arr) != 2 {
+		return ID{}, false, errors.New("unexpected response from SetIDNX script")
+	}
+
+	set, err := arr[0].Int()
+	if err != nil {
+		return ID{}, false, err
+	}
+	idStr, err := arr[1].Str()
+	if err != nil {
+		return ID{}, false, err
+	}
+	curID, err := IDFromString(idStr)
+	return curID, set == 1, err
+}
+
+// KeyWait implements the method for the Backend interface. Notifications are
+// received over the pubsub connection kept open by Run.
+func (c *redisBackend) KeyWait(ctx context.Context, k Key) <-chan struct{} {
+	return c.ps.wait(ctx, k.String(c.o.RedisPrefix))
+}
+
+// KeySubscribe implements the method for the Backend interface. Publications
+// are received over the pubsub connection kept open by Run.
+func (c *redisBackend) KeySubscribe(ctx context.Context, k Key) <-chan Publication {
+	return c.ps.publications(ctx, k.String(c.o.RedisPrefix))
+}
+
+// KeyNotify implements the method for the Backend interface
+func (c *redisBackend) KeyNotify(ctx context.Context, k Key) {
+	withCtx(ctx, func() *redis.Resp {
+		return c.c.Cmd("PUBLISH", k.String(c.o.RedisPrefix), "notify")
+	})
+}
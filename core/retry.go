@@ -0,0 +1,285 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy describes how operations which fail because of a transient error
+// are retried, see Opts.
+//
+// Transient errors are those which are likely to go away by themselves, like a
+// dropped connection, redis still loading its data after a restart, or a
+// replica which was written to during a failover. Some of them, like a
+// connection being dropped while waiting for a response, leave it unknown
+// whether the operation was performed. Operations are only retried after those
+// if performing them twice has the same effect as performing them once. So
+// reads are, as are writes which set given values, but a Query is only retried
+// if its QueryActions are marked as Idempotent, otherwise an event could be
+// retrieved twice.
+type RetryPolicy struct {
+	// Default 3. The most times an operation will be retried after its first
+	// attempt fails.
+	MaxRetries int
+
+	// Default 50 milliseconds. How long to wait before the first retry. The
+	// wait doubles with every retry after that, up to MaxBackoff, and is
+	// randomly jittered so that many clients aren't all retrying at once.
+	MinBackoff time.Duration
+
+	// Default 1 second. The longest time to wait between retries.
+	MaxBackoff time.Duration
+
+	// Default 0, meaning none. How long each attempt may take. An attempt which
+	// takes longer is abandoned, and retried if the operation is idempotent.
+	// The context passed into the operation can still be used to limit how
+	// long it takes in total.
+	Timeout time.Duration
+}
+
+func (rp RetryPolicy) withDefaults() RetryPolicy {
+	if rp.MaxRetries == 0 {
+		rp.MaxRetries = 3
+	}
+	if rp.MinBackoff == 0 {
+		rp.MinBackoff = 50 * time.Millisecond
+	}
+	if rp.MaxBackoff == 0 {
+		rp.MaxBackoff = 1 * time.Second
+	}
+	return rp
+}
+
+// backoff returns how long to wait before the given retry, starting at 0
+func (rp RetryPolicy) backoff(retry int) time.Duration {
+	d := rp.MinBackoff
+	for i := 0; i < retry && d < rp.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > rp.MaxBackoff {
+		d = rp.MaxBackoff
+	}
+	// between half and all of d
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+type retryPolicyKey struct{}
+
+// WithRetryPolicy returns a copy of ctx which causes operations performed with
+// it to be retried according to the given RetryPolicy, instead of the one in
+// Opts. If rp is nil they aren't retried at all. This can be used to change how
+// individual commands are retried, e.g. to give up sooner on a request which
+// is latency sensitive. It has no effect on a Core which wasn't given a
+// RetryPolicy in its Opts.
+func WithRetryPolicy(ctx context.Context, rp *RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, rp)
+}
+
+// Prefixes of errors returned by redis, before performing a command, because of
+// a condition which should pass by itself
+var transientRedisErrs = []string{
+	"LOADING ",     // redis is loading its data from disk
+	"READONLY ",    // the master was failed over to a replica
+	"MASTERDOWN ",  // a replica lost its master
+	"CLUSTERDOWN ", // the cluster is failing over
+	"TRYAGAIN ",    // a cluster slot is being migrated
+	"BUSY ",        // another lua script is taking a long time
+}
+
+// classifyErr returns whether an operation which failed with err may succeed if
+// it's retried, and if so whether the operation definitely wasn't performed.
+func classifyErr(err error) (transient, notPerformed bool) {
+	switch {
+	case errors.Is(err, ErrFaultInjected):
+		return true, true
+	case errors.Is(err, ErrFaultDropped):
+		return true, false
+	}
+
+	for _, prefix := range transientRedisErrs {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return true, true
+		}
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true, true
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE),
+		errors.As(err, &netErr):
+		return true, false
+	}
+	return false, false
+}
+
+// WithRetry returns a Backend which passes all calls through to the given one,
+// retrying those which fail with a transient error according to the
+// RetryPolicy, or the one set on the call's context with WithRetryPolicy. If rp
+// is nil calls are only retried if their context has a RetryPolicy. New does
+// this automatically when Opts.Retry is set.
+func WithRetry(b Backend, rp *RetryPolicy) Backend {
+	return retryBackend{Backend: b, rp: rp}
+}
+
+type retryBackend struct {
+	Backend
+	rp *RetryPolicy
+}
+
+// do calls fn until it succeeds, it fails with an error which can't be retried,
+// or the RetryPolicy's MaxRetries is reached. fn must use the context it's
+// given. If idempotent is false fn is only retried if it definitely wasn't
+// performed.
+func (rb retryBackend) do(ctx context.Context, idempotent bool, fn func(context.Context) error) error {
+	rp := rb.rp
+	if ctxRP, ok := ctx.Value(retryPolicyKey{}).(*RetryPolicy); ok {
+		rp = ctxRP
+	}
+	if rp == nil {
+		return fn(ctx)
+	}
+	rpd := rp.withDefaults()
+
+	for retry := 0; ; retry++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if rpd.Timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, rpd.Timeout)
+		}
+		err := fn(attemptCtx)
+		cancel()
+
+		if err == nil || ctx.Err() != nil || retry >= rpd.MaxRetries {
+			return err
+		}
+
+		// An attempt which timed out may have been performed, just like one
+		// whose connection was dropped
+		transient, notPerformed := classifyErr(err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			transient, notPerformed = true, false
+		}
+		if !transient || (!idempotent && !notPerformed) {
+			return err
+		}
+
+		select {
+		case <-time.After(rpd.backoff(retry)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Each retried attempt of MonoTSs generates new TSs, but since they're only
+// required to be monotonic it doesn't matter if the ones generated by an
+// earlier attempt are skipped
+func (rb retryBackend) MonoTSs(ctx context.Context, t TS, n int) ([]TS, error) {
+	var tt []TS
+	err := rb.do(ctx, true, func(ctx context.Context) (err error) {
+		tt, err = rb.Backend.MonoTSs(ctx, t, n)
+		return err
+	})
+	return tt, err
+}
+
+func (rb retryBackend) SetEvents(ctx context.Context, ee []Event, expireBuffer time.Duration) error {
+	return rb.do(ctx, true, func(ctx context.Context) error {
+		return rb.Backend.SetEvents(ctx, ee, expireBuffer)
+	})
+}
+
+func (rb retryBackend) GetEvents(ctx context.Context, ii []ID) ([]Event, error) {
+	var ee []Event
+	err := rb.do(ctx, true, func(ctx context.Context) (err error) {
+		ee, err = rb.Backend.GetEvents(ctx, ii)
+		return err
+	})
+	return ee, err
+}
+
+func (rb retryBackend) Query(ctx context.Context, qas QueryActions) (QueryRes, error) {
+	var res QueryRes
+	err := rb.do(ctx, qas.Idempotent, func(ctx context.Context) (err error) {
+		res, err = rb.Backend.Query(ctx, qas)
+		return err
+	})
+	return res, err
+}
+
+func (rb retryBackend) KeyScan(ctx context.Context, k Key) ([]Key, error) {
+	var kk []Key
+	err := rb.do(ctx, true, func(ctx context.Context) (err error) {
+		kk, err = rb.Backend.KeyScan(ctx, k)
+		return err
+	})
+	return kk, err
+}
+
+func (rb retryBackend) HashGetIDs(ctx context.Context, k Key, ii []ID) ([]string, error) {
+	var vv []string
+	err := rb.do(ctx, true, func(ctx context.Context) (err error) {
+		vv, err = rb.Backend.HashGetIDs(ctx, k, ii)
+		return err
+	})
+	return vv, err
+}
+
+func (rb retryBackend) HashSetAll(ctx context.Context, k Key, m map[string]string) error {
+	return rb.do(ctx, true, func(ctx context.Context) error {
+		return rb.Backend.HashSetAll(ctx, k, m)
+	})
+}
+
+func (rb retryBackend) HashGetAll(ctx context.Context, k Key) (map[string]string, error) {
+	var m map[string]string
+	err := rb.do(ctx, true, func(ctx context.Context) (err error) {
+		m, err = rb.Backend.HashGetAll(ctx, k)
+		return err
+	})
+	return m, err
+}
+
+func (rb retryBackend) SetString(ctx context.Context, k Key, val string, ttl time.Duration) error {
+	return rb.do(ctx, true, func(ctx context.Context) error {
+		return rb.Backend.SetString(ctx, k, val, ttl)
+	})
+}
+
+func (rb retryBackend) GetString(ctx context.Context, k Key) (string, error) {
+	var s string
+	err := rb.do(ctx, true, func(ctx context.Context) (err error) {
+		s, err = rb.Backend.GetString(ctx, k)
+		return err
+	})
+	return s, err
+}
+
+// If an earlier attempt of SetIDNX set the ID, but its response was lost, then
+// a retry will find the key already set to the ID it's trying to set. Since IDs
+// are unique that can only have been done by this call, so it still reports
+// the ID as having been set.
+func (rb retryBackend) SetIDNX(ctx context.Context, k Key, id ID, ttl time.Duration) (ID, bool, error) {
+	var curID ID
+	var set bool
+	err := rb.do(ctx, true, func(ctx context.Context) (err error) {
+		curID, set, err = rb.Backend.SetIDNX(ctx, k, id, ttl)
+		return err
+	})
+	if err == nil && !set && curID == id {
+		set = true
+	}
+	return curID, set, err
+}
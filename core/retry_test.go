@@ -0,0 +1,209 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyBackend fails each call with the next of errs, until there are none
+// left. If performed is set the call is made before its error is returned, as
+// if the response was lost.
+type flakyBackend struct {
+	Backend
+	errs      []error
+	performed bool
+	calls     int
+}
+
+func (fb *flakyBackend) fail(fn func() error) error {
+	fb.calls++
+	if len(fb.errs) == 0 {
+		return fn()
+	}
+	err := fb.errs[0]
+	fb.errs = fb.errs[1:]
+	if fb.performed {
+		fn()
+	}
+	return err
+}
+
+func (fb *flakyBackend) GetString(ctx context.Context, k Key) (string, error) {
+	var s string
+	err := fb.fail(func() (err error) {
+		s, err = fb.Backend.GetString(ctx, k)
+		return err
+	})
+	return s, err
+}
+
+func (fb *flakyBackend) Query(ctx context.Context, qas QueryActions) (QueryRes, error) {
+	var res QueryRes
+	err := fb.fail(func() (err error) {
+		res, err = fb.Backend.Query(ctx, qas)
+		return err
+	})
+	return res, err
+}
+
+func (fb *flakyBackend) SetIDNX(ctx context.Context, k Key, id ID, ttl time.Duration) (ID, bool, error) {
+	var curID ID
+	var set bool
+	err := fb.fail(func() (err error) {
+		curID, set, err = fb.Backend.SetIDNX(ctx, k, id, ttl)
+		return err
+	})
+	return curID, set, err
+}
+
+func TestClassifyErr(t *T) {
+	assertClass := func(err error, transient, notPerformed bool) {
+		tr, np := classifyErr(err)
+		assert.Equal(t, transient, tr, "%v", err)
+		assert.Equal(t, notPerformed, np, "%v", err)
+	}
+	assertClass(errors.New("LOADING Redis is loading the dataset in memory"), true, true)
+	assertClass(errors.New("READONLY You can't write against a read only replica."), true, true)
+	assertClass(&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true, true)
+	assertClass(io.EOF, true, false)
+	assertClass(&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, true, false)
+	assertClass(errors.New("ERR unknown command"), false, false)
+	assertClass(ErrNotFound, false, false)
+	assertClass(ErrFaultInjected, true, true)
+	assertClass(ErrFaultDropped, true, false)
+}
+
+func TestRetry(t *T) {
+	rp := &RetryPolicy{MaxRetries: 2, MinBackoff: time.Millisecond}
+	k := Key{Base: testutil.RandStr()}
+	mem := NewMemBackend()
+	require.Nil(t, mem.SetString(testCtx, k, "foo", time.Minute))
+	loading := errors.New("LOADING Redis is loading the dataset in memory")
+
+	// Reads are retried after any transient error
+	fb := &flakyBackend{Backend: mem, errs: []error{io.EOF, loading}}
+	s, err := WithRetry(fb, rp).GetString(testCtx, k)
+	require.Nil(t, err)
+	assert.Equal(t, "foo", s)
+	assert.Equal(t, 3, fb.calls)
+
+	// Until MaxRetries is reached
+	fb = &flakyBackend{Backend: mem, errs: []error{io.EOF, io.EOF, io.EOF}}
+	_, err = WithRetry(fb, rp).GetString(testCtx, k)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 3, fb.calls)
+
+	// Other errors aren't retried
+	fb = &flakyBackend{Backend: mem, errs: []error{ErrNotFound}}
+	_, err = WithRetry(fb, rp).GetString(testCtx, k)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, 1, fb.calls)
+
+	// Neither is anything if there's no RetryPolicy, or the context disables
+	// retries
+	fb = &flakyBackend{Backend: mem, errs: []error{io.EOF}}
+	_, err = WithRetry(fb, nil).GetString(testCtx, k)
+	assert.Equal(t, io.EOF, err)
+	fb = &flakyBackend{Backend: mem, errs: []error{io.EOF}}
+	_, err = WithRetry(fb, rp).GetString(WithRetryPolicy(testCtx, nil), k)
+	assert.Equal(t, io.EOF, err)
+
+	// But they may be enabled by the context
+	fb = &flakyBackend{Backend: mem, errs: []error{io.EOF}}
+	_, err = WithRetry(fb, nil).GetString(WithRetryPolicy(testCtx, rp), k)
+	assert.Nil(t, err)
+
+	// A Query which may have been performed is only retried if it's idempotent
+	qas := QueryActions{KeyBase: k.Base, Now: NewTS(time.Now())}
+	fb = &flakyBackend{Backend: mem, errs: []error{io.EOF}}
+	_, err = WithRetry(fb, rp).Query(testCtx, qas)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 1, fb.calls)
+
+	fb = &flakyBackend{Backend: mem, errs: []error{loading}}
+	_, err = WithRetry(fb, rp).Query(testCtx, qas)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, fb.calls)
+
+	qas.Idempotent = true
+	fb = &flakyBackend{Backend: mem, errs: []error{io.EOF}}
+	_, err = WithRetry(fb, rp).Query(testCtx, qas)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, fb.calls)
+}
+
+func TestRetrySetIDNX(t *T) {
+	rp := &RetryPolicy{MinBackoff: time.Millisecond}
+	k := Key{Base: testutil.RandStr()}
+	id := ID{T: NewTS(time.Now()), Expire: NewTS(time.Now().Add(time.Minute))}
+
+	// The first attempt sets the ID but its response is lost, the retry still
+	// reports it as having been set
+	fb := &flakyBackend{Backend: NewMemBackend(), errs: []error{io.EOF}, performed: true}
+	curID, set, err := WithRetry(fb, rp).SetIDNX(testCtx, k, id, time.Minute)
+	require.Nil(t, err)
+	assert.True(t, set)
+	assert.Equal(t, id, curID)
+	assert.Equal(t, 2, fb.calls)
+
+	// Anyone else trying to set it still finds it set
+	id2 := ID{T: id.T + 1, Expire: id.Expire}
+	curID, set, err = WithRetry(fb, rp).SetIDNX(testCtx, k, id2, time.Minute)
+	require.Nil(t, err)
+	assert.False(t, set)
+	assert.Equal(t, id, curID)
+}
+
+// slowBackend takes longer than the RetryPolicy's Timeout on its first call
+type slowBackend struct {
+	Backend
+	calls int
+}
+
+func (sb *slowBackend) GetString(ctx context.Context, k Key) (string, error) {
+	if sb.calls++; sb.calls == 1 {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	return sb.Backend.GetString(ctx, k)
+}
+
+func TestRetryTimeout(t *T) {
+	k := Key{Base: testutil.RandStr()}
+	mem := NewMemBackend()
+	require.Nil(t, mem.SetString(testCtx, k, "foo", time.Minute))
+
+	sb := &slowBackend{Backend: mem}
+	rp := &RetryPolicy{MinBackoff: time.Millisecond, Timeout: 10 * time.Millisecond}
+	s, err := WithRetry(sb, rp).GetString(testCtx, k)
+	require.Nil(t, err)
+	assert.Equal(t, "foo", s)
+	assert.Equal(t, 2, sb.calls)
+
+	// The context's own deadline isn't retried
+	sb = &slowBackend{Backend: mem}
+	ctx, cancel := context.WithTimeout(testCtx, 10*time.Millisecond)
+	defer cancel()
+	_, err = WithRetry(sb, rp).GetString(ctx, k)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, sb.calls)
+}
+
+func TestRetryBackoff(t *T) {
+	rp := RetryPolicy{}.withDefaults()
+	for retry, max := range []time.Duration{
+		50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond,
+		400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second,
+	} {
+		d := rp.backoff(retry)
+		assert.True(t, d >= max/2 && d <= max, "retry:%d d:%s", retry, d)
+	}
+}
@@ -0,0 +1,115 @@
+package core
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/mediocregopher/radix.v2/sentinel"
+)
+
+// Sentinel is a util.Cmder which sends all commands to the current master of a
+// set of redis instances monitored by redis sentinel. When sentinel fails the
+// master over commands are sent to the new master from then on. If the
+// sentinel being used becomes unreachable the next one in the list is
+// connected to. It may be passed into New in place of a *pool.Pool.
+//
+// Commands which are in progress while the master is being failed over may
+// fail.
+type Sentinel struct {
+	addrs    []string
+	poolSize int
+	name     string
+	o        DialOpts
+
+	l sync.RWMutex
+	c *sentinel.Client
+}
+
+// NewSentinel connects to the first reachable sentinel instance in addrs, and
+// creates a pool of poolSize connections to the current master of masterName.
+// Connections to the master are made using the DialOpts, but connections to
+// sentinel itself are always plain tcp connections without authentication.
+func NewSentinel(addrs []string, poolSize int, masterName string, o DialOpts) (*Sentinel, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("at least one sentinel address is required")
+	}
+
+	s := &Sentinel{
+		addrs:    addrs,
+		poolSize: poolSize,
+		name:     masterName,
+		o:        o,
+	}
+	c, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	s.c = c
+	return s, nil
+}
+
+// tries each sentinel address in turn, returning the error from the last one if
+// none of them work
+func (s *Sentinel) dial() (*sentinel.Client, error) {
+	var err error
+	for _, addr := range s.addrs {
+		var c *sentinel.Client
+		c, err = sentinel.NewClientCustom("tcp", addr, s.poolSize, s.o.DialFunc(), s.name)
+		if err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+// returns a connection to the current master, and the client it should be put
+// back into. If the current sentinel is unreachable a new one is connected to.
+func (s *Sentinel) getMaster() (*sentinel.Client, *redis.Client, error) {
+	s.l.RLock()
+	c := s.c
+	s.l.RUnlock()
+
+	conn, err := c.GetMaster(s.name)
+	if cerr, ok := err.(*sentinel.ClientError); !ok || !cerr.SentinelErr {
+		return c, conn, err
+	}
+
+	s.l.Lock()
+	// Another routine may have already replaced the client
+	if s.c == c {
+		newC, err := s.dial()
+		if err != nil {
+			s.l.Unlock()
+			return nil, nil, err
+		}
+		c.Close()
+		s.c = newC
+	}
+	c = s.c
+	s.l.Unlock()
+
+	conn, err = c.GetMaster(s.name)
+	return c, conn, err
+}
+
+// Cmd implements the method for the util.Cmder interface. The command is sent to
+// the current master.
+func (s *Sentinel) Cmd(cmd string, args ...interface{}) *redis.Resp {
+	c, conn, err := s.getMaster()
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	defer c.PutMaster(s.name, conn)
+	return conn.Cmd(cmd, args...)
+}
+
+// returns the address of the current master
+func (s *Sentinel) masterAddr() (string, error) {
+	c, conn, err := s.getMaster()
+	if err != nil {
+		return "", err
+	}
+	defer c.PutMaster(s.name, conn)
+	return conn.Addr, nil
+}
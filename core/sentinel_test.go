@@ -0,0 +1,16 @@
+package core
+
+import (
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSentinel(t *T) {
+	_, err := NewSentinel(nil, 1, "mymaster", DialOpts{})
+	assert.NotNil(t, err)
+
+	// None of the addresses are reachable, so the last error is returned
+	_, err = NewSentinel([]string{"127.0.0.1:1", "127.0.0.1:2"}, 1, "mymaster", DialOpts{})
+	assert.NotNil(t, err)
+}
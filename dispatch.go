@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -14,27 +17,93 @@ import (
 )
 
 type dispatchFn struct {
-	fn      func([]string) (interface{}, error)
+	fn      func(context.Context, []string) (interface{}, error)
 	minArgs int
+
+	// The Right which is needed to perform the command if there's an ACL, and
+	// how many of its leading arguments are queues it's needed for. If none are
+	// it's needed for every queue. Commands without a Right only need the
+	// client to have authenticated.
+	right     peel.Right
+	queueArgs int
 }
 
 var dispatchTable = map[string]dispatchFn{
-	"PING":    {ping, 0},
-	"QADD":    {qadd, 3},
-	"QGET":    {qget, 2},
-	"QACK":    {qack, 3},
-	"QSTATUS": {qstatus, 0},
-	"QINFO":   {qinfo, 0},
+	"PING":          {ping, 0, "", 0},
+	"QADD":          {qadd, 3, peel.RightProduce, 1},
+	"QADDMULTI":     {qaddmulti, 3, peel.RightProduce, 1},
+	"QGET":          {qget, 2, peel.RightConsume, 1},
+	"QGETMULTI":     {qgetmulti, 3, peel.RightConsume, 1},
+	"QPEEK":         {qpeek, 2, peel.RightConsume, 1},
+	"QACK":          {qack, 3, peel.RightConsume, 1},
+	"QACKMULTI":     {qackmulti, 3, peel.RightConsume, 1},
+	"QRESULT":       {qresult, 2, peel.RightProduce, 1},
+	"QREPLY":        {qreply, 3, "", 0},
+	"QEXTEND":       {qextend, 4, peel.RightConsume, 1},
+	"QNACK":         {qnack, 3, peel.RightConsume, 1},
+	"QPENDINGLIST":  {qpendinglist, 2, peel.RightConsume, 1},
+	"QCONSUMERS":    {qconsumers, 1, peel.RightConsume, 1},
+	"QSTEAL":        {qsteal, 4, peel.RightConsume, 1},
+	"QDONELIST":     {qdonelist, 2, peel.RightConsume, 1},
+	"QBROWSE":       {qbrowse, 1, peel.RightConsume, 1},
+	"QDEADLIST":     {qdeadlist, 2, peel.RightConsume, 1},
+	"QDEADREDRIVE":  {qdeadredrive, 2, peel.RightAdmin, 1},
+	"QCLEAN":        {qclean, 0, peel.RightAdmin, 0},
+	"QSEEK":         {qseek, 2, peel.RightAdmin, 1},
+	"QREPLAY":       {qreplay, 2, peel.RightAdmin, 1},
+	"QTRACE":        {qtrace, 2, peel.RightConsume, 1},
+	"QGROUPDEL":     {qgroupdel, 2, peel.RightAdmin, 1},
+	"QMOVE":         {qmove, 2, peel.RightAdmin, 2},
+	"QFLUSH":        {qflush, 1, peel.RightAdmin, 1},
+	"QPAUSE":        {qpause, 1, peel.RightAdmin, 1},
+	"QCONFIG":       {qconfig, 1, peel.RightAdmin, 1},
+	"QRATELIMIT":    {qratelimit, 2, peel.RightAdmin, 1},
+	"QTENANT":       {qtenant, 1, peel.RightAdmin, 0},
+	"QRESUME":       {qresume, 1, peel.RightAdmin, 1},
+	"QLIST":         {qlist, 0, peel.RightAdmin, 0},
+	"QSTATUS":       {qstatus, 0, peel.RightAdmin, 0},
+	"QTENANTSTATUS": {qtenantstatus, 1, peel.RightAdmin, 0},
+	"QINFO":         {qinfo, 0, peel.RightAdmin, 0},
 }
 
-func dispatch(cmd string, args []string) (interface{}, error) {
+func dispatch(ctx context.Context, cmd string, args []string) (interface{}, error) {
 	fn, ok := dispatchTable[cmd]
 	if !ok {
 		return fmt.Errorf("unknown cmd %q", cmd), nil
 	} else if len(args) < fn.minArgs {
 		return errors.New("insufficient arguments"), nil
 	}
-	return fn.fn(args)
+	if acl != nil && cmd != "PING" {
+		var err error
+		if fn.right != "" {
+			err = peel.Authorize(ctx, fn.right, args[:fn.queueArgs]...)
+		} else if peel.IdentityFrom(ctx) == nil {
+			err = peel.ErrUnauthenticated
+		}
+		if err != nil {
+			return err, nil
+		}
+	}
+	return fn.fn(ctx, args)
+}
+
+// auth performs the AUTH command, returning the context which later commands
+// on the connection should be dispatched with. Like redis' it may be given a
+// username before the token, in which case it must be the Identity's name.
+func auth(ctx context.Context, args []string) (context.Context, interface{}) {
+	if acl == nil {
+		return ctx, errors.New("AUTH given, but no ACL is configured")
+	} else if len(args) < 1 {
+		return ctx, errors.New("insufficient arguments")
+	}
+
+	id, err := acl.ByToken(args[len(args)-1])
+	if err != nil {
+		return ctx, err
+	} else if len(args) > 1 && args[0] != id.Name {
+		return ctx, peel.ErrUnauthenticated
+	}
+	return peel.WithIdentity(ctx, id), redis.NewRespSimple("OK")
 }
 
 func timeFromStr(now time.Time, str string) (time.Time, error) {
@@ -58,13 +127,22 @@ func timeFromStr(now time.Time, str string) (time.Time, error) {
 	return now.Add(d), nil
 }
 
-func ping(args []string) (interface{}, error) {
+// like timeFromStr, but a relative expire of 0 is returned as the zero time, so
+// that the queue's DefaultTTL is used
+func expireFromStr(now time.Time, str string) (time.Time, error) {
+	if str == "0" {
+		return time.Time{}, nil
+	}
+	return timeFromStr(now, str)
+}
+
+func ping(ctx context.Context, args []string) (interface{}, error) {
 	return redis.NewRespSimple("PONG"), nil
 }
 
-func qadd(args []string) (interface{}, error) {
+func qadd(ctx context.Context, args []string) (interface{}, error) {
 	now := time.Now()
-	expire, err := timeFromStr(now, args[1])
+	expire, err := expireFromStr(now, args[1])
 	if err != nil {
 		return err, nil
 	}
@@ -75,7 +153,69 @@ func qadd(args []string) (interface{}, error) {
 		Contents: args[2],
 	}
 
-	if len(args) > 3 && strings.ToUpper(args[3]) == "NOBLOCK" {
+	var noblock bool
+	for args = args[3:]; len(args) > 0; args = args[1:] {
+		switch strings.ToUpper(args[0]) {
+		case "NOBLOCK":
+			noblock = true
+		case "DELAY":
+			if len(args) < 2 {
+				return errors.New("DELAY requires a value"), nil
+			}
+			if qadd.VisibleAfter, err = timeFromStr(now, args[1]); err != nil {
+				return err, nil
+			}
+			args = args[1:]
+		case "DEDUP":
+			if len(args) < 2 {
+				return errors.New("DEDUP requires a value"), nil
+			}
+			qadd.DedupKey = args[1]
+			args = args[1:]
+		case "REPLYTO":
+			if len(args) < 2 {
+				return errors.New("REPLYTO requires a value"), nil
+			}
+			qadd.ReplyTo = args[1]
+			args = args[1:]
+		case "PRIORITY":
+			if len(args) < 2 {
+				return errors.New("PRIORITY requires a value"), nil
+			}
+			if qadd.Priority, err = strconv.Atoi(args[1]); err != nil {
+				return err, nil
+			}
+			args = args[1:]
+		case "PADDING":
+			if len(args) < 2 {
+				return errors.New("PADDING requires a value"), nil
+			}
+			padding, err := strconv.Atoi(args[1])
+			if err != nil {
+				return err, nil
+			} else if padding < 1 {
+				return errors.New("PADDING must be at least 1"), nil
+			}
+			qadd.Padding = time.Duration(padding) * time.Second
+			args = args[1:]
+		case "PARTITION":
+			if len(args) < 2 {
+				return errors.New("PARTITION requires a value"), nil
+			}
+			qadd.PartitionKey = args[1]
+			args = args[1:]
+		case "GROUP":
+			if len(args) < 2 {
+				return errors.New("GROUP requires a value"), nil
+			}
+			qadd.GroupID = args[1]
+			args = args[1:]
+		default:
+			return fmt.Errorf("unknown option %q", args[0]), nil
+		}
+	}
+
+	if noblock {
 		select {
 		case bgQAddCh <- qadd:
 			return redis.NewRespSimple("OK"), nil
@@ -84,17 +224,53 @@ func qadd(args []string) (interface{}, error) {
 		}
 	}
 
-	return p.QAdd(qadd)
+	id, err := p.QAdd(ctx, qadd)
+	if err == peel.ErrQueueFull || err == peel.ErrContentsTooLarge || err == peel.ErrTenantFull || err == peel.ErrTenantRateLimited {
+		return err, nil
+	}
+	return id, err
 }
 
-func qget(args []string) (interface{}, error) {
+func qaddmulti(ctx context.Context, args []string) (interface{}, error) {
 	now := time.Now()
+	queue := args[0]
+	args = args[1:]
+	if len(args)%2 != 0 {
+		return errors.New("uneven number of expire/contents arguments"), nil
+	}
 
-	qget := peel.QGetCommand{
-		Queue:         args[0],
-		ConsumerGroup: args[1],
+	cc := make([]peel.QAddCommand, 0, len(args)/2)
+	for ; len(args) > 0; args = args[2:] {
+		expire, err := expireFromStr(now, args[0])
+		if err != nil {
+			return err, nil
+		}
+		cc = append(cc, peel.QAddCommand{
+			Queue:    queue,
+			Expire:   expire,
+			Contents: args[1],
+		})
+	}
+
+	ii, err := p.QAddMulti(ctx, cc)
+	if err == peel.ErrQueueFull || err == peel.ErrContentsTooLarge || err == peel.ErrTenantFull || err == peel.ErrTenantRateLimited {
+		return err, nil
+	} else if err != nil {
+		return nil, err
 	}
-	args = args[2:]
+
+	ret := make([]string, len(ii))
+	for i := range ii {
+		ret[i] = ii[i].String()
+	}
+	return ret, nil
+}
+
+// parseQGetOpts fills in the optional DEADLINE, BLOCK and CONSUMER fields of a
+// QGetCommand from the given args, which should not include the queue or
+// consumer group
+func parseQGetOpts(c *peel.QGetCommand, args []string) error {
+	now := time.Now()
 
 	timeKV := func(k string) (time.Time, error) {
 		if len(args) < 2 {
@@ -112,33 +288,872 @@ func qget(args []string) (interface{}, error) {
 	}
 
 	var err error
-	if qget.AckDeadline, err = timeKV("DEADLINE"); err != nil {
+	if c.AckDeadline, err = timeKV("DEADLINE"); err != nil {
+		return err
+	}
+	if c.BlockUntil, err = timeKV("BLOCK"); err != nil {
+		return err
+	}
+	if len(args) >= 2 && strings.ToUpper(args[0]) == "CONSUMER" {
+		c.ConsumerID = args[1]
+		args = args[2:]
+	}
+	if len(args) >= 2 && strings.ToUpper(args[0]) == "FILTER" {
+		if _, err := peel.ParseFilter(args[1]); err != nil {
+			return err
+		}
+		c.Filter = args[1]
+	}
+	return nil
+}
+
+// eventResp returns the id and contents of an event retrieved by a consumer,
+// followed by its REPLYTO, INREPLYTO and TOKEN fields if they're set
+func eventResp(e core.Event) []string {
+	ret := []string{e.ID.String(), e.Contents}
+	if e.ReplyTo != "" {
+		ret = append(ret, "REPLYTO", e.ReplyTo)
+	}
+	if (e.InReplyTo != core.ID{}) {
+		ret = append(ret, "INREPLYTO", e.InReplyTo.String())
+	}
+	if e.DeliveryToken != "" {
+		ret = append(ret, "TOKEN", e.DeliveryToken)
+	}
+	return ret
+}
+
+func qget(ctx context.Context, args []string) (interface{}, error) {
+	qget := peel.QGetCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
+	}
+	if err := parseQGetOpts(&qget, args[2:]); err != nil {
 		return err, nil
 	}
-	if qget.BlockUntil, err = timeKV("BLOCK"); err != nil {
+
+	e, err := p.QGet(ctx, qget)
+	if err == peel.ErrDraining {
 		return err, nil
+	} else if err != nil {
+		return nil, err
+	} else if (e == core.Event{}) {
+		return nil, nil
 	}
+	return eventResp(e), nil
+}
 
-	e, err := p.QGet(qget)
+func qgetmulti(ctx context.Context, args []string) (interface{}, error) {
+	count, err := strconv.Atoi(args[2])
+	if err != nil {
+		return err, nil
+	} else if count < 1 {
+		return errors.New("count must be at least 1"), nil
+	}
+
+	qget := peel.QGetMultiCommand{
+		QGetCommand: peel.QGetCommand{
+			Queue:         args[0],
+			ConsumerGroup: args[1],
+		},
+		Count: count,
+	}
+	if err := parseQGetOpts(&qget.QGetCommand, args[3:]); err != nil {
+		return err, nil
+	}
+
+	ee, err := p.QGetMulti(ctx, qget)
+	if err == peel.ErrDraining {
+		return err, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ret := make([]interface{}, len(ee))
+	for i, e := range ee {
+		ret[i] = eventResp(e)
+	}
+	return ret, nil
+}
+
+func qpeek(ctx context.Context, args []string) (interface{}, error) {
+	e, err := p.QPeek(ctx, peel.QPeekCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
+	})
 	if err != nil {
 		return nil, err
 	} else if (e == core.Event{}) {
 		return nil, nil
 	}
-	return []string{e.ID.String(), e.Contents}, nil
+	return eventResp(e), nil
 }
 
-func qack(args []string) (interface{}, error) {
+func qack(ctx context.Context, args []string) (interface{}, error) {
 	id, err := core.IDFromString(args[2])
 	if err != nil {
 		return err, nil
 	}
 
-	return p.QAck(peel.QAckCommand{
+	c := peel.QAckCommand{
 		Queue:         args[0],
 		ConsumerGroup: args[1],
 		EventID:       id,
+	}
+
+	for args = args[3:]; len(args) > 0; args = args[2:] {
+		if len(args) < 2 {
+			return fmt.Errorf("%s requires a value", args[0]), nil
+		}
+		switch strings.ToUpper(args[0]) {
+		case "RESULT":
+			c.Result = args[1]
+		case "RESULTTTL":
+			secs, err := strconv.ParseFloat(args[1], 64)
+			if err != nil {
+				return err, nil
+			}
+			c.ResultTTL = time.Duration(secs * float64(time.Second))
+		case "TOKEN":
+			c.DeliveryToken = args[1]
+		default:
+			return fmt.Errorf("unknown option %q", args[0]), nil
+		}
+	}
+
+	return p.QAck(ctx, c)
+}
+
+func qreply(ctx context.Context, args []string) (interface{}, error) {
+	id, err := core.IDFromString(args[0])
+	if err != nil {
+		return err, nil
+	}
+
+	expire, err := expireFromStr(time.Now(), args[1])
+	if err != nil {
+		return err, nil
+	}
+
+	replyID, err := p.QReply(ctx, peel.QReplyCommand{
+		EventID:  id,
+		Expire:   expire,
+		Contents: args[2],
+	})
+	switch err {
+	case nil:
+		return replyID.String(), nil
+	case peel.ErrNoReplyTo, core.ErrNotFound, peel.ErrQueueFull, peel.ErrContentsTooLarge, peel.ErrTenantFull, peel.ErrTenantRateLimited:
+		return err, nil
+	}
+	// The queue being replied to is only known once the event has been
+	// fetched, so Peel checks the client may produce to it
+	if _, ok := err.(*peel.ForbiddenError); ok {
+		return err, nil
+	}
+	return nil, err
+}
+
+func qresult(ctx context.Context, args []string) (interface{}, error) {
+	id, err := core.IDFromString(args[1])
+	if err != nil {
+		return err, nil
+	}
+
+	c := peel.QResultCommand{
+		Queue:   args[0],
+		EventID: id,
+	}
+	if len(args) >= 4 && strings.ToUpper(args[2]) == "BLOCK" {
+		secs, err := strconv.ParseFloat(args[3], 64)
+		if err != nil {
+			return err, nil
+		}
+		c.Block = time.Duration(secs * float64(time.Second))
+	}
+
+	res, ok, err := p.QResult(ctx, c)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, nil
+	}
+	return res, nil
+}
+
+func qackmulti(ctx context.Context, args []string) (interface{}, error) {
+	ii := make([]core.ID, len(args)-2)
+	for i, arg := range args[2:] {
+		var err error
+		if ii[i], err = core.IDFromString(arg); err != nil {
+			return err, nil
+		}
+	}
+
+	return p.QAckMulti(ctx, peel.QAckMultiCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
+		EventIDs:      ii,
+	})
+}
+
+func qextend(ctx context.Context, args []string) (interface{}, error) {
+	id, err := core.IDFromString(args[2])
+	if err != nil {
+		return err, nil
+	}
+
+	deadline, err := timeFromStr(time.Now(), args[3])
+	if err != nil {
+		return err, nil
+	}
+
+	c := peel.QExtendCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
+		EventID:       id,
+		AckDeadline:   deadline,
+	}
+	if c.DeliveryToken, err = parseTokenOpt(args[4:]); err != nil {
+		return err, nil
+	}
+
+	return p.QExtend(ctx, c)
+}
+
+func qnack(ctx context.Context, args []string) (interface{}, error) {
+	id, err := core.IDFromString(args[2])
+	if err != nil {
+		return err, nil
+	}
+
+	c := peel.QNackCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
+		EventID:       id,
+	}
+
+	for args = args[3:]; len(args) > 0; args = args[2:] {
+		if len(args) < 2 {
+			return fmt.Errorf("%s requires a value", args[0]), nil
+		}
+		switch strings.ToUpper(args[0]) {
+		case "TOKEN":
+			c.DeliveryToken = args[1]
+		case "ERROR":
+			c.Error = args[1]
+		default:
+			return fmt.Errorf("unknown option %q", args[0]), nil
+		}
+	}
+
+	return p.QNack(ctx, c)
+}
+
+// parseTokenOpt parses the optional TOKEN argument of commands which act on an
+// in-progress event, returning the token or "" if it wasn't given
+func parseTokenOpt(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", nil
+	} else if strings.ToUpper(args[0]) != "TOKEN" {
+		return "", fmt.Errorf("unknown option %q", args[0])
+	} else if len(args) != 2 {
+		return "", errors.New("TOKEN requires a single value")
+	}
+	return args[1], nil
+}
+
+func qpendinglist(ctx context.Context, args []string) (interface{}, error) {
+	pp, err := p.QPendingList(ctx, peel.QPendingListCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]interface{}, len(pp))
+	for i, pe := range pp {
+		deadline := float64(pe.AckDeadline.UnixNano()) / 1e9
+		ret[i] = []string{
+			pe.ID.String(),
+			pe.Contents,
+			strconv.FormatFloat(deadline, 'f', 3, 64),
+			pe.ConsumerID,
+			pe.LastError,
+		}
+	}
+	return ret, nil
+}
+
+func qconsumers(ctx context.Context, args []string) (interface{}, error) {
+	c := peel.QConsumersCommand{Queue: args[0]}
+	if len(args) > 1 {
+		c.ConsumerGroup = args[1]
+	}
+
+	cc, err := p.QConsumers(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]interface{}, len(cc))
+	for i, ci := range cc {
+		lastSeen := float64(ci.LastSeen.UnixNano()) / 1e9
+		ret[i] = []interface{}{
+			ci.ConsumerGroup,
+			ci.ConsumerID,
+			strconv.FormatFloat(lastSeen, 'f', 3, 64),
+			ci.InFlight,
+		}
+	}
+	return ret, nil
+}
+
+func qsteal(ctx context.Context, args []string) (interface{}, error) {
+	deadline, err := timeFromStr(time.Now(), args[3])
+	if err != nil {
+		return err, nil
+	}
+
+	c := peel.QStealCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
+		ConsumerID:    args[2],
+		AckDeadline:   deadline,
+	}
+
+	args = args[4:]
+	if len(args) > 0 && strings.ToUpper(args[0]) == "COUNT" {
+		if len(args) < 2 {
+			return errors.New("COUNT requires a value"), nil
+		} else if c.Count, err = strconv.Atoi(args[1]); err != nil {
+			return err, nil
+		}
+		args = args[2:]
+	}
+
+	for _, arg := range args {
+		id, err := core.IDFromString(arg)
+		if err != nil {
+			return err, nil
+		}
+		c.EventIDs = append(c.EventIDs, id)
+	}
+
+	ee, err := p.QSteal(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]interface{}, len(ee))
+	for i, e := range ee {
+		ret[i] = eventResp(e)
+	}
+	return ret, nil
+}
+
+func qdonelist(ctx context.Context, args []string) (interface{}, error) {
+	now := time.Now()
+	c := peel.QDoneListCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
+	}
+
+	var err error
+	for args = args[2:]; len(args) > 0; args = args[2:] {
+		if len(args) < 2 {
+			return fmt.Errorf("%s requires a value", args[0]), nil
+		}
+		switch strings.ToUpper(args[0]) {
+		case "FROM":
+			c.From, err = timeFromStr(now, args[1])
+		case "TO":
+			c.To, err = timeFromStr(now, args[1])
+		case "LIMIT":
+			c.Limit, err = strconv.Atoi(args[1])
+		case "CURSOR":
+			var cursor uint64
+			cursor, err = strconv.ParseUint(args[1], 10, 64)
+			c.Cursor = core.TS(cursor)
+		default:
+			err = fmt.Errorf("unknown option %q", args[0])
+		}
+		if err != nil {
+			return err, nil
+		}
+	}
+
+	ee, cursor, err := p.QDoneList(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	eventsRet := make([]interface{}, len(ee))
+	for i, e := range ee {
+		eventsRet[i] = []string{e.ID.String(), e.Contents}
+	}
+	return []interface{}{cursor.String(), eventsRet}, nil
+}
+
+func qbrowse(ctx context.Context, args []string) (interface{}, error) {
+	now := time.Now()
+	c := peel.QBrowseCommand{Queue: args[0]}
+
+	var err error
+	for args = args[1:]; len(args) > 0; args = args[2:] {
+		if len(args) < 2 {
+			return fmt.Errorf("%s requires a value", args[0]), nil
+		}
+		switch strings.ToUpper(args[0]) {
+		case "DONE":
+			c.ConsumerGroup = args[1]
+		case "FROM":
+			c.From, err = timeFromStr(now, args[1])
+		case "TO":
+			c.To, err = timeFromStr(now, args[1])
+		case "LIMIT":
+			c.Limit, err = strconv.Atoi(args[1])
+		case "CURSOR":
+			var cursor uint64
+			cursor, err = strconv.ParseUint(args[1], 10, 64)
+			c.Cursor = core.TS(cursor)
+		case "CONTAINS":
+			c.Contains = args[1]
+		case "MATCH":
+			c.Match, err = regexp.Compile(args[1])
+		default:
+			err = fmt.Errorf("unknown option %q", args[0])
+		}
+		if err != nil {
+			return err, nil
+		}
+	}
+
+	ee, cursor, err := p.QBrowse(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	eventsRet := make([]interface{}, len(ee))
+	for i, e := range ee {
+		eventsRet[i] = []string{e.ID.String(), e.Contents}
+	}
+	return []interface{}{cursor.String(), eventsRet}, nil
+}
+
+func qdeadlist(ctx context.Context, args []string) (interface{}, error) {
+	c := peel.QDeadListCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
+	}
+
+	var err error
+	for args = args[2:]; len(args) > 0; args = args[2:] {
+		if len(args) < 2 {
+			return fmt.Errorf("%s requires a value", args[0]), nil
+		}
+		switch strings.ToUpper(args[0]) {
+		case "LIMIT":
+			c.Limit, err = strconv.Atoi(args[1])
+		case "CURSOR":
+			var cursor uint64
+			cursor, err = strconv.ParseUint(args[1], 10, 64)
+			c.Cursor = core.TS(cursor)
+		default:
+			err = fmt.Errorf("unknown option %q", args[0])
+		}
+		if err != nil {
+			return err, nil
+		}
+	}
+
+	dd, cursor, err := p.QDeadList(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	eventsRet := make([]interface{}, len(dd))
+	for i, d := range dd {
+		eventsRet[i] = []interface{}{d.ID.String(), d.Contents, d.Attempts, d.LastError}
+	}
+	return []interface{}{cursor.String(), eventsRet}, nil
+}
+
+func qdeadredrive(ctx context.Context, args []string) (interface{}, error) {
+	c := peel.QDeadRedriveCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
+	}
+
+	args = args[2:]
+	if len(args) > 0 && strings.ToUpper(args[0]) == "TO" {
+		if len(args) < 2 {
+			return errors.New("TO requires a value"), nil
+		}
+		c.ToQueue = args[1]
+		args = args[2:]
+	}
+
+	c.EventIDs = make([]core.ID, len(args))
+	for i, arg := range args {
+		var err error
+		if c.EventIDs[i], err = core.IDFromString(arg); err != nil {
+			return err, nil
+		}
+	}
+
+	return p.QDeadRedrive(ctx, c)
+}
+
+func qclean(ctx context.Context, args []string) (interface{}, error) {
+	var c peel.QCleanCommand
+	if len(args) > 0 {
+		c.Queue = args[0]
+	}
+	if len(args) > 1 {
+		c.ConsumerGroup = args[1]
+	}
+	return p.QClean(ctx, c)
+}
+
+func qseek(ctx context.Context, args []string) (interface{}, error) {
+	c := peel.QSeekCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
+	}
+	if len(args) > 2 {
+		var err error
+		if c.From, err = timeFromStr(time.Now(), args[2]); err != nil {
+			return err, nil
+		}
+	}
+
+	if err := p.QSeek(ctx, c); err != nil {
+		return nil, err
+	}
+	return redis.NewRespSimple("OK"), nil
+}
+
+func qreplay(ctx context.Context, args []string) (interface{}, error) {
+	now := time.Now()
+	c := peel.QReplayCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
+	}
+
+	var err error
+	for args = args[2:]; len(args) > 0; args = args[1:] {
+		switch strings.ToUpper(args[0]) {
+		case "DONE":
+			c.Done = true
+		case "FROM":
+			if len(args) < 2 {
+				return errors.New("FROM requires a value"), nil
+			}
+			if c.From, err = timeFromStr(now, args[1]); err != nil {
+				return err, nil
+			}
+			args = args[1:]
+		case "TO":
+			if len(args) < 2 {
+				return errors.New("TO requires a value"), nil
+			}
+			if c.To, err = timeFromStr(now, args[1]); err != nil {
+				return err, nil
+			}
+			args = args[1:]
+		default:
+			return fmt.Errorf("unknown option %q", args[0]), nil
+		}
+	}
+
+	return p.QReplay(ctx, c)
+}
+
+func qtrace(ctx context.Context, args []string) (interface{}, error) {
+	id, err := core.IDFromString(args[1])
+	if err != nil {
+		return err, nil
+	}
+
+	tt, err := p.QTrace(ctx, peel.QTraceCommand{
+		Queue:   args[0],
+		EventID: id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]interface{}, len(tt))
+	for i, te := range tt {
+		ts := float64(te.Time.UnixNano()) / 1e9
+		ret[i] = []string{
+			string(te.State),
+			te.ConsumerGroup,
+			strconv.FormatFloat(ts, 'f', 3, 64),
+		}
+	}
+	return ret, nil
+}
+
+func qgroupdel(ctx context.Context, args []string) (interface{}, error) {
+	err := p.QGroupDel(ctx, peel.QGroupDelCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
+	})
+	if err != nil {
+		return nil, err
+	}
+	return redis.NewRespSimple("OK"), nil
+}
+
+func qmove(ctx context.Context, args []string) (interface{}, error) {
+	return p.QMove(ctx, peel.QMoveCommand{
+		Queue:   args[0],
+		ToQueue: args[1],
+	})
+}
+
+func qflush(ctx context.Context, args []string) (interface{}, error) {
+	c := peel.QFlushCommand{Queue: args[0]}
+	if len(args) > 1 {
+		c.ConsumerGroup = args[1]
+	}
+
+	if err := p.QFlush(ctx, c); err != nil {
+		return nil, err
+	}
+	return redis.NewRespSimple("OK"), nil
+}
+
+func qpause(ctx context.Context, args []string) (interface{}, error) {
+	if err := p.QPause(ctx, peel.QPauseCommand{Queue: args[0]}); err != nil {
+		return nil, err
+	}
+	return redis.NewRespSimple("OK"), nil
+}
+
+func qresume(ctx context.Context, args []string) (interface{}, error) {
+	if err := p.QResume(ctx, peel.QResumeCommand{Queue: args[0]}); err != nil {
+		return nil, err
+	}
+	return redis.NewRespSimple("OK"), nil
+}
+
+func qconfig(ctx context.Context, args []string) (interface{}, error) {
+	queue := args[0]
+	qc, err := p.QGetConfig(ctx, peel.QGetConfigCommand{Queue: queue})
+	if err != nil {
+		return nil, err
+	}
+
+	if args = args[1:]; len(args) > 0 {
+		for ; len(args) > 0; args = args[2:] {
+			if len(args) < 2 {
+				return fmt.Errorf("%s requires a value", args[0]), nil
+			}
+			switch strings.ToUpper(args[0]) {
+			case "MAXLENGTH":
+				qc.MaxLength, err = strconv.ParseUint(args[1], 10, 64)
+			case "OVERFLOW":
+				qc.Overflow = peel.Overflow(strings.ToLower(args[1]))
+				switch qc.Overflow {
+				case peel.OverflowReject, peel.OverflowBlock, peel.OverflowEvict:
+				default:
+					err = fmt.Errorf("unknown overflow policy %q", args[1])
+				}
+			case "OVERFLOWTIMEOUT":
+				var secs float64
+				secs, err = strconv.ParseFloat(args[1], 64)
+				qc.OverflowTimeout = time.Duration(secs * float64(time.Second))
+			case "FAIR":
+				qc.Fair, err = strconv.ParseBool(args[1])
+			case "SHARDS":
+				qc.Shards, err = strconv.Atoi(args[1])
+			case "STRICTFIFO":
+				qc.StrictFIFO, err = strconv.ParseBool(args[1])
+			case "GROUPED":
+				qc.Grouped, err = strconv.ParseBool(args[1])
+			case "GROUPBUCKETS":
+				qc.GroupBuckets, err = strconv.Atoi(args[1])
+			case "ACKDEADLINE":
+				var secs float64
+				secs, err = strconv.ParseFloat(args[1], 64)
+				qc.AckDeadline = time.Duration(secs * float64(time.Second))
+			case "MAXDELIVERIES":
+				qc.MaxDeliveries, err = strconv.Atoi(args[1])
+			case "DEFAULTTTL":
+				var secs float64
+				secs, err = strconv.ParseFloat(args[1], 64)
+				qc.DefaultTTL = time.Duration(secs * float64(time.Second))
+			case "REPLAYRETENTION":
+				var secs float64
+				secs, err = strconv.ParseFloat(args[1], 64)
+				qc.ReplayRetention = time.Duration(secs * float64(time.Second))
+			case "REPLAYMAXLENGTH":
+				qc.ReplayMaxLength, err = strconv.ParseUint(args[1], 10, 64)
+			case "TRACEMAXLENGTH":
+				qc.TraceMaxLength, err = strconv.ParseUint(args[1], 10, 64)
+			case "NOTIFY":
+				qc.Notify, err = strconv.ParseBool(args[1])
+			case "RETENTION":
+				var secs float64
+				secs, err = strconv.ParseFloat(args[1], 64)
+				qc.Retention = time.Duration(secs * float64(time.Second))
+			case "PAUSED":
+				qc.Paused, err = strconv.ParseBool(args[1])
+			default:
+				err = fmt.Errorf("unknown option %q", args[0])
+			}
+			if err != nil {
+				return err, nil
+			}
+		}
+
+		err := p.QSetConfig(ctx, peel.QSetConfigCommand{
+			Queue:       queue,
+			QueueConfig: qc,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if qc.Overflow == "" {
+		qc.Overflow = peel.OverflowReject
+	}
+	return []interface{}{
+		"maxlength", strconv.FormatUint(qc.MaxLength, 10),
+		"overflow", string(qc.Overflow),
+		"overflowtimeout", strconv.FormatFloat(qc.OverflowTimeout.Seconds(), 'f', -1, 64),
+		"fair", strconv.FormatBool(qc.Fair),
+		"shards", strconv.Itoa(qc.Shards),
+		"strictfifo", strconv.FormatBool(qc.StrictFIFO),
+		"grouped", strconv.FormatBool(qc.Grouped),
+		"groupbuckets", strconv.Itoa(qc.GroupBuckets),
+		"ackdeadline", strconv.FormatFloat(qc.AckDeadline.Seconds(), 'f', -1, 64),
+		"maxdeliveries", strconv.Itoa(qc.MaxDeliveries),
+		"defaultttl", strconv.FormatFloat(qc.DefaultTTL.Seconds(), 'f', -1, 64),
+		"retention", strconv.FormatFloat(qc.Retention.Seconds(), 'f', -1, 64),
+		"replayretention", strconv.FormatFloat(qc.ReplayRetention.Seconds(), 'f', -1, 64),
+		"replaymaxlength", strconv.FormatUint(qc.ReplayMaxLength, 10),
+		"tracemaxlength", strconv.FormatUint(qc.TraceMaxLength, 10),
+		"notify", strconv.FormatBool(qc.Notify),
+		"paused", strconv.FormatBool(qc.Paused),
+	}, nil
+}
+
+func qratelimit(ctx context.Context, args []string) (interface{}, error) {
+	queue, cgroup := args[0], args[1]
+	if len(args) > 2 {
+		c := peel.QSetRateLimitCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+		}
+		var err error
+		if c.Rate, err = strconv.ParseFloat(args[2], 64); err != nil {
+			return err, nil
+		} else if c.Rate < 0 {
+			return errors.New("rate may not be negative"), nil
+		}
+		if len(args) > 3 {
+			if c.Burst, err = strconv.Atoi(args[3]); err != nil {
+				return err, nil
+			} else if c.Burst < 0 {
+				return errors.New("burst may not be negative"), nil
+			}
+		}
+		if err := p.QSetRateLimit(ctx, c); err != nil {
+			return nil, err
+		}
+	}
+
+	rl, err := p.QGetRateLimit(ctx, peel.QGetRateLimitCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{
+		"rate", strconv.FormatFloat(rl.Rate, 'f', -1, 64),
+		"burst", rl.Burst,
+	}, nil
+}
+
+func qtenant(ctx context.Context, args []string) (interface{}, error) {
+	tenant := args[0]
+	tc, err := p.QGetTenantConfig(ctx, peel.QGetTenantConfigCommand{Tenant: tenant})
+	if err != nil {
+		return nil, err
+	}
+
+	if args = args[1:]; len(args) > 0 {
+		for ; len(args) > 0; args = args[2:] {
+			if len(args) < 2 {
+				return fmt.Errorf("%s requires a value", args[0]), nil
+			}
+			switch strings.ToUpper(args[0]) {
+			case "MAXEVENTS":
+				tc.MaxEvents, err = strconv.ParseUint(args[1], 10, 64)
+			case "ADDRATE":
+				if tc.AddRate, err = strconv.ParseFloat(args[1], 64); err == nil && tc.AddRate < 0 {
+					err = errors.New("ADDRATE may not be negative")
+				}
+			case "ADDBURST":
+				if tc.AddBurst, err = strconv.Atoi(args[1]); err == nil && tc.AddBurst < 0 {
+					err = errors.New("ADDBURST may not be negative")
+				}
+			default:
+				err = fmt.Errorf("unknown option %q", args[0])
+			}
+			if err != nil {
+				return err, nil
+			}
+		}
+
+		err := p.QSetTenantConfig(ctx, peel.QSetTenantConfigCommand{
+			Tenant:       tenant,
+			TenantConfig: tc,
+		})
+		if err != nil {
+			return err, nil
+		}
+		if tc, err = p.QGetTenantConfig(ctx, peel.QGetTenantConfigCommand{Tenant: tenant}); err != nil {
+			return nil, err
+		}
+	}
+
+	return []interface{}{
+		"maxevents", strconv.FormatUint(tc.MaxEvents, 10),
+		"addrate", strconv.FormatFloat(tc.AddRate, 'f', -1, 64),
+		"addburst", tc.AddBurst,
+	}, nil
+}
+
+func qlist(ctx context.Context, args []string) (interface{}, error) {
+	var c peel.QListCommand
+	if len(args) > 0 {
+		c.Queue = args[0]
+	}
+
+	m, err := p.QList(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	queues := make([]string, 0, len(m))
+	for q := range m {
+		queues = append(queues, q)
+	}
+	sort.Strings(queues)
+
+	ret := make([]interface{}, 0, len(queues)*2)
+	for _, q := range queues {
+		ret = append(ret, q, m[q])
+	}
+	return ret, nil
 }
 
 func argsToQCG(args []string) map[string][]string {
@@ -161,8 +1176,8 @@ func argsToQCG(args []string) map[string][]string {
 	return m
 }
 
-func qstatus(args []string) (interface{}, error) {
-	qsm, err := p.QStatus(peel.QStatusCommand{
+func qstatus(ctx context.Context, args []string) (interface{}, error) {
+	qsm, err := p.QStatus(ctx, peel.QStatusCommand{
 		QueuesConsumerGroups: argsToQCG(args),
 	})
 	if err != nil {
@@ -172,7 +1187,11 @@ func qstatus(args []string) (interface{}, error) {
 	ret := []interface{}{}
 	for q, qs := range qsm {
 		ret = append(ret, q)
-		qsret := []interface{}{"total", qs.Total}
+		var paused int
+		if qs.Paused {
+			paused = 1
+		}
+		qsret := []interface{}{"total", qs.Total, "delayed", qs.Delayed, "paused", paused}
 
 		cgsret := []interface{}{}
 		for cg, cgs := range qs.ConsumerGroupStats {
@@ -180,6 +1199,9 @@ func qstatus(args []string) (interface{}, error) {
 				"available", cgs.Available,
 				"inprogress", cgs.InProgress,
 				"redo", cgs.Redo,
+				"done", cgs.Done,
+				"dead", cgs.Dead,
+				"lag", strconv.FormatFloat(cgs.Lag.Seconds(), 'f', 3, 64),
 			}
 			cgsret = append(cgsret, cg, cgret)
 		}
@@ -191,8 +1213,22 @@ func qstatus(args []string) (interface{}, error) {
 	return ret, nil
 }
 
-func qinfo(args []string) (interface{}, error) {
-	return p.QInfo(peel.QStatusCommand{
+func qtenantstatus(ctx context.Context, args []string) (interface{}, error) {
+	ts, err := p.QTenantStatus(ctx, peel.QTenantStatusCommand{Tenant: args[0]})
+	if err != nil {
+		return err, nil
+	}
+	return []interface{}{
+		"queues", ts.Queues,
+		"total", ts.Total,
+		"delayed", ts.Delayed,
+		"inprogress", ts.InProgress,
+		"dead", ts.Dead,
+	}, nil
+}
+
+func qinfo(ctx context.Context, args []string) (interface{}, error) {
+	return p.QInfo(ctx, peel.QStatusCommand{
 		QueuesConsumerGroups: argsToQCG(args),
 	})
 }
@@ -0,0 +1,1279 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.9
+// 	protoc        (unknown)
+// source: bananaq.proto
+
+package grpcapi
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Event struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Id        string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Contents  []byte                 `protobuf:"bytes,2,opt,name=contents,proto3" json:"contents,omitempty"`
+	ReplyTo   string                 `protobuf:"bytes,3,opt,name=reply_to,json=replyTo,proto3" json:"reply_to,omitempty"`
+	InReplyTo string                 `protobuf:"bytes,4,opt,name=in_reply_to,json=inReplyTo,proto3" json:"in_reply_to,omitempty"`
+	// Only set if the event was retrieved with an ack_deadline. Passing it to
+	// Ack, Nack or Extend makes sure they only act on this delivery of the
+	// event, and it's required if the server has RequireDeliveryTokens set (see
+	// peel.Opts).
+	DeliveryToken string `protobuf:"bytes,5,opt,name=delivery_token,json=deliveryToken,proto3" json:"delivery_token,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Event) Reset() {
+	*x = Event{}
+	mi := &file_bananaq_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Event) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Event) ProtoMessage() {}
+
+func (x *Event) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Event.ProtoReflect.Descriptor instead.
+func (*Event) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Event) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Event) GetContents() []byte {
+	if x != nil {
+		return x.Contents
+	}
+	return nil
+}
+
+func (x *Event) GetReplyTo() string {
+	if x != nil {
+		return x.ReplyTo
+	}
+	return ""
+}
+
+func (x *Event) GetInReplyTo() string {
+	if x != nil {
+		return x.InReplyTo
+	}
+	return ""
+}
+
+func (x *Event) GetDeliveryToken() string {
+	if x != nil {
+		return x.DeliveryToken
+	}
+	return ""
+}
+
+type AddRequest struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Queue    string                 `protobuf:"bytes,1,opt,name=queue,proto3" json:"queue,omitempty"`
+	Contents []byte                 `protobuf:"bytes,2,opt,name=contents,proto3" json:"contents,omitempty"`
+	// How long until the event expires. Required.
+	Expire *durationpb.Duration `protobuf:"bytes,3,opt,name=expire,proto3" json:"expire,omitempty"`
+	// How long until the event becomes visible to consumer groups.
+	Delay         *durationpb.Duration `protobuf:"bytes,4,opt,name=delay,proto3" json:"delay,omitempty"`
+	Priority      int32                `protobuf:"varint,5,opt,name=priority,proto3" json:"priority,omitempty"`
+	DedupKey      string               `protobuf:"bytes,6,opt,name=dedup_key,json=dedupKey,proto3" json:"dedup_key,omitempty"`
+	ReplyTo       string               `protobuf:"bytes,7,opt,name=reply_to,json=replyTo,proto3" json:"reply_to,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AddRequest) Reset() {
+	*x = AddRequest{}
+	mi := &file_bananaq_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AddRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AddRequest) ProtoMessage() {}
+
+func (x *AddRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AddRequest.ProtoReflect.Descriptor instead.
+func (*AddRequest) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *AddRequest) GetQueue() string {
+	if x != nil {
+		return x.Queue
+	}
+	return ""
+}
+
+func (x *AddRequest) GetContents() []byte {
+	if x != nil {
+		return x.Contents
+	}
+	return nil
+}
+
+func (x *AddRequest) GetExpire() *durationpb.Duration {
+	if x != nil {
+		return x.Expire
+	}
+	return nil
+}
+
+func (x *AddRequest) GetDelay() *durationpb.Duration {
+	if x != nil {
+		return x.Delay
+	}
+	return nil
+}
+
+func (x *AddRequest) GetPriority() int32 {
+	if x != nil {
+		return x.Priority
+	}
+	return 0
+}
+
+func (x *AddRequest) GetDedupKey() string {
+	if x != nil {
+		return x.DedupKey
+	}
+	return ""
+}
+
+func (x *AddRequest) GetReplyTo() string {
+	if x != nil {
+		return x.ReplyTo
+	}
+	return ""
+}
+
+type AddResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AddResponse) Reset() {
+	*x = AddResponse{}
+	mi := &file_bananaq_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AddResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AddResponse) ProtoMessage() {}
+
+func (x *AddResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AddResponse.ProtoReflect.Descriptor instead.
+func (*AddResponse) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *AddResponse) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+type GetRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Queue         string                 `protobuf:"bytes,1,opt,name=queue,proto3" json:"queue,omitempty"`
+	ConsumerGroup string                 `protobuf:"bytes,2,opt,name=consumer_group,json=consumerGroup,proto3" json:"consumer_group,omitempty"`
+	// How long the consumer has to ack the event. If not given the event
+	// doesn't need to be acked.
+	AckDeadline *durationpb.Duration `protobuf:"bytes,3,opt,name=ack_deadline,json=ackDeadline,proto3" json:"ack_deadline,omitempty"`
+	// How long to wait for an event if none is available.
+	Block         *durationpb.Duration `protobuf:"bytes,4,opt,name=block,proto3" json:"block,omitempty"`
+	ConsumerId    string               `protobuf:"bytes,5,opt,name=consumer_id,json=consumerId,proto3" json:"consumer_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetRequest) Reset() {
+	*x = GetRequest{}
+	mi := &file_bananaq_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetRequest) ProtoMessage() {}
+
+func (x *GetRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetRequest.ProtoReflect.Descriptor instead.
+func (*GetRequest) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *GetRequest) GetQueue() string {
+	if x != nil {
+		return x.Queue
+	}
+	return ""
+}
+
+func (x *GetRequest) GetConsumerGroup() string {
+	if x != nil {
+		return x.ConsumerGroup
+	}
+	return ""
+}
+
+func (x *GetRequest) GetAckDeadline() *durationpb.Duration {
+	if x != nil {
+		return x.AckDeadline
+	}
+	return nil
+}
+
+func (x *GetRequest) GetBlock() *durationpb.Duration {
+	if x != nil {
+		return x.Block
+	}
+	return nil
+}
+
+func (x *GetRequest) GetConsumerId() string {
+	if x != nil {
+		return x.ConsumerId
+	}
+	return ""
+}
+
+type GetResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Not set if there was no event available.
+	Event         *Event `protobuf:"bytes,1,opt,name=event,proto3" json:"event,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetResponse) Reset() {
+	*x = GetResponse{}
+	mi := &file_bananaq_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetResponse) ProtoMessage() {}
+
+func (x *GetResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetResponse.ProtoReflect.Descriptor instead.
+func (*GetResponse) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *GetResponse) GetEvent() *Event {
+	if x != nil {
+		return x.Event
+	}
+	return nil
+}
+
+type PeekRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Queue         string                 `protobuf:"bytes,1,opt,name=queue,proto3" json:"queue,omitempty"`
+	ConsumerGroup string                 `protobuf:"bytes,2,opt,name=consumer_group,json=consumerGroup,proto3" json:"consumer_group,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PeekRequest) Reset() {
+	*x = PeekRequest{}
+	mi := &file_bananaq_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PeekRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PeekRequest) ProtoMessage() {}
+
+func (x *PeekRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PeekRequest.ProtoReflect.Descriptor instead.
+func (*PeekRequest) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *PeekRequest) GetQueue() string {
+	if x != nil {
+		return x.Queue
+	}
+	return ""
+}
+
+func (x *PeekRequest) GetConsumerGroup() string {
+	if x != nil {
+		return x.ConsumerGroup
+	}
+	return ""
+}
+
+type AckRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Queue         string                 `protobuf:"bytes,1,opt,name=queue,proto3" json:"queue,omitempty"`
+	ConsumerGroup string                 `protobuf:"bytes,2,opt,name=consumer_group,json=consumerGroup,proto3" json:"consumer_group,omitempty"`
+	EventId       string                 `protobuf:"bytes,3,opt,name=event_id,json=eventId,proto3" json:"event_id,omitempty"`
+	Result        []byte                 `protobuf:"bytes,4,opt,name=result,proto3" json:"result,omitempty"`
+	ResultTtl     *durationpb.Duration   `protobuf:"bytes,5,opt,name=result_ttl,json=resultTtl,proto3" json:"result_ttl,omitempty"`
+	// The delivery_token of the event, see Event.
+	DeliveryToken string `protobuf:"bytes,6,opt,name=delivery_token,json=deliveryToken,proto3" json:"delivery_token,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AckRequest) Reset() {
+	*x = AckRequest{}
+	mi := &file_bananaq_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AckRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AckRequest) ProtoMessage() {}
+
+func (x *AckRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AckRequest.ProtoReflect.Descriptor instead.
+func (*AckRequest) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *AckRequest) GetQueue() string {
+	if x != nil {
+		return x.Queue
+	}
+	return ""
+}
+
+func (x *AckRequest) GetConsumerGroup() string {
+	if x != nil {
+		return x.ConsumerGroup
+	}
+	return ""
+}
+
+func (x *AckRequest) GetEventId() string {
+	if x != nil {
+		return x.EventId
+	}
+	return ""
+}
+
+func (x *AckRequest) GetResult() []byte {
+	if x != nil {
+		return x.Result
+	}
+	return nil
+}
+
+func (x *AckRequest) GetResultTtl() *durationpb.Duration {
+	if x != nil {
+		return x.ResultTtl
+	}
+	return nil
+}
+
+func (x *AckRequest) GetDeliveryToken() string {
+	if x != nil {
+		return x.DeliveryToken
+	}
+	return ""
+}
+
+type AckResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// False if the event's deadline had already passed.
+	Acked         bool `protobuf:"varint,1,opt,name=acked,proto3" json:"acked,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AckResponse) Reset() {
+	*x = AckResponse{}
+	mi := &file_bananaq_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AckResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AckResponse) ProtoMessage() {}
+
+func (x *AckResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AckResponse.ProtoReflect.Descriptor instead.
+func (*AckResponse) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *AckResponse) GetAcked() bool {
+	if x != nil {
+		return x.Acked
+	}
+	return false
+}
+
+type NackRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Queue         string                 `protobuf:"bytes,1,opt,name=queue,proto3" json:"queue,omitempty"`
+	ConsumerGroup string                 `protobuf:"bytes,2,opt,name=consumer_group,json=consumerGroup,proto3" json:"consumer_group,omitempty"`
+	EventId       string                 `protobuf:"bytes,3,opt,name=event_id,json=eventId,proto3" json:"event_id,omitempty"`
+	// The delivery_token of the event, see Event.
+	DeliveryToken string `protobuf:"bytes,4,opt,name=delivery_token,json=deliveryToken,proto3" json:"delivery_token,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *NackRequest) Reset() {
+	*x = NackRequest{}
+	mi := &file_bananaq_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *NackRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NackRequest) ProtoMessage() {}
+
+func (x *NackRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NackRequest.ProtoReflect.Descriptor instead.
+func (*NackRequest) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *NackRequest) GetQueue() string {
+	if x != nil {
+		return x.Queue
+	}
+	return ""
+}
+
+func (x *NackRequest) GetConsumerGroup() string {
+	if x != nil {
+		return x.ConsumerGroup
+	}
+	return ""
+}
+
+func (x *NackRequest) GetEventId() string {
+	if x != nil {
+		return x.EventId
+	}
+	return ""
+}
+
+func (x *NackRequest) GetDeliveryToken() string {
+	if x != nil {
+		return x.DeliveryToken
+	}
+	return ""
+}
+
+type NackResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Nacked        bool                   `protobuf:"varint,1,opt,name=nacked,proto3" json:"nacked,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *NackResponse) Reset() {
+	*x = NackResponse{}
+	mi := &file_bananaq_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *NackResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NackResponse) ProtoMessage() {}
+
+func (x *NackResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NackResponse.ProtoReflect.Descriptor instead.
+func (*NackResponse) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *NackResponse) GetNacked() bool {
+	if x != nil {
+		return x.Nacked
+	}
+	return false
+}
+
+type ExtendRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Queue         string                 `protobuf:"bytes,1,opt,name=queue,proto3" json:"queue,omitempty"`
+	ConsumerGroup string                 `protobuf:"bytes,2,opt,name=consumer_group,json=consumerGroup,proto3" json:"consumer_group,omitempty"`
+	EventId       string                 `protobuf:"bytes,3,opt,name=event_id,json=eventId,proto3" json:"event_id,omitempty"`
+	// How long from now the new deadline is. Required.
+	AckDeadline *durationpb.Duration `protobuf:"bytes,4,opt,name=ack_deadline,json=ackDeadline,proto3" json:"ack_deadline,omitempty"`
+	// The delivery_token of the event, see Event.
+	DeliveryToken string `protobuf:"bytes,5,opt,name=delivery_token,json=deliveryToken,proto3" json:"delivery_token,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ExtendRequest) Reset() {
+	*x = ExtendRequest{}
+	mi := &file_bananaq_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExtendRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExtendRequest) ProtoMessage() {}
+
+func (x *ExtendRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExtendRequest.ProtoReflect.Descriptor instead.
+func (*ExtendRequest) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *ExtendRequest) GetQueue() string {
+	if x != nil {
+		return x.Queue
+	}
+	return ""
+}
+
+func (x *ExtendRequest) GetConsumerGroup() string {
+	if x != nil {
+		return x.ConsumerGroup
+	}
+	return ""
+}
+
+func (x *ExtendRequest) GetEventId() string {
+	if x != nil {
+		return x.EventId
+	}
+	return ""
+}
+
+func (x *ExtendRequest) GetAckDeadline() *durationpb.Duration {
+	if x != nil {
+		return x.AckDeadline
+	}
+	return nil
+}
+
+func (x *ExtendRequest) GetDeliveryToken() string {
+	if x != nil {
+		return x.DeliveryToken
+	}
+	return ""
+}
+
+type ExtendResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Extended      bool                   `protobuf:"varint,1,opt,name=extended,proto3" json:"extended,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ExtendResponse) Reset() {
+	*x = ExtendResponse{}
+	mi := &file_bananaq_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExtendResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExtendResponse) ProtoMessage() {}
+
+func (x *ExtendResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExtendResponse.ProtoReflect.Descriptor instead.
+func (*ExtendResponse) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *ExtendResponse) GetExtended() bool {
+	if x != nil {
+		return x.Extended
+	}
+	return false
+}
+
+type StatusRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Limits the status to these queues. If empty all queues are returned.
+	Queues        []string `protobuf:"bytes,1,rep,name=queues,proto3" json:"queues,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatusRequest) Reset() {
+	*x = StatusRequest{}
+	mi := &file_bananaq_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatusRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatusRequest) ProtoMessage() {}
+
+func (x *StatusRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatusRequest.ProtoReflect.Descriptor instead.
+func (*StatusRequest) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *StatusRequest) GetQueues() []string {
+	if x != nil {
+		return x.Queues
+	}
+	return nil
+}
+
+type StatusResponse struct {
+	state         protoimpl.MessageState  `protogen:"open.v1"`
+	Queues        map[string]*QueueStatus `protobuf:"bytes,1,rep,name=queues,proto3" json:"queues,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatusResponse) Reset() {
+	*x = StatusResponse{}
+	mi := &file_bananaq_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatusResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatusResponse) ProtoMessage() {}
+
+func (x *StatusResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatusResponse.ProtoReflect.Descriptor instead.
+func (*StatusResponse) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *StatusResponse) GetQueues() map[string]*QueueStatus {
+	if x != nil {
+		return x.Queues
+	}
+	return nil
+}
+
+type QueueStatus struct {
+	state          protoimpl.MessageState          `protogen:"open.v1"`
+	Total          uint64                          `protobuf:"varint,1,opt,name=total,proto3" json:"total,omitempty"`
+	Delayed        uint64                          `protobuf:"varint,2,opt,name=delayed,proto3" json:"delayed,omitempty"`
+	Paused         bool                            `protobuf:"varint,3,opt,name=paused,proto3" json:"paused,omitempty"`
+	ConsumerGroups map[string]*ConsumerGroupStatus `protobuf:"bytes,4,rep,name=consumer_groups,json=consumerGroups,proto3" json:"consumer_groups,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *QueueStatus) Reset() {
+	*x = QueueStatus{}
+	mi := &file_bananaq_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *QueueStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QueueStatus) ProtoMessage() {}
+
+func (x *QueueStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QueueStatus.ProtoReflect.Descriptor instead.
+func (*QueueStatus) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *QueueStatus) GetTotal() uint64 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+func (x *QueueStatus) GetDelayed() uint64 {
+	if x != nil {
+		return x.Delayed
+	}
+	return 0
+}
+
+func (x *QueueStatus) GetPaused() bool {
+	if x != nil {
+		return x.Paused
+	}
+	return false
+}
+
+func (x *QueueStatus) GetConsumerGroups() map[string]*ConsumerGroupStatus {
+	if x != nil {
+		return x.ConsumerGroups
+	}
+	return nil
+}
+
+type ConsumerGroupStatus struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Available     uint64                 `protobuf:"varint,1,opt,name=available,proto3" json:"available,omitempty"`
+	InProgress    uint64                 `protobuf:"varint,2,opt,name=in_progress,json=inProgress,proto3" json:"in_progress,omitempty"`
+	Redo          uint64                 `protobuf:"varint,3,opt,name=redo,proto3" json:"redo,omitempty"`
+	Done          uint64                 `protobuf:"varint,4,opt,name=done,proto3" json:"done,omitempty"`
+	Dead          uint64                 `protobuf:"varint,5,opt,name=dead,proto3" json:"dead,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConsumerGroupStatus) Reset() {
+	*x = ConsumerGroupStatus{}
+	mi := &file_bananaq_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConsumerGroupStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConsumerGroupStatus) ProtoMessage() {}
+
+func (x *ConsumerGroupStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConsumerGroupStatus.ProtoReflect.Descriptor instead.
+func (*ConsumerGroupStatus) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *ConsumerGroupStatus) GetAvailable() uint64 {
+	if x != nil {
+		return x.Available
+	}
+	return 0
+}
+
+func (x *ConsumerGroupStatus) GetInProgress() uint64 {
+	if x != nil {
+		return x.InProgress
+	}
+	return 0
+}
+
+func (x *ConsumerGroupStatus) GetRedo() uint64 {
+	if x != nil {
+		return x.Redo
+	}
+	return 0
+}
+
+func (x *ConsumerGroupStatus) GetDone() uint64 {
+	if x != nil {
+		return x.Done
+	}
+	return 0
+}
+
+func (x *ConsumerGroupStatus) GetDead() uint64 {
+	if x != nil {
+		return x.Dead
+	}
+	return 0
+}
+
+type ConsumeRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Queue         string                 `protobuf:"bytes,1,opt,name=queue,proto3" json:"queue,omitempty"`
+	ConsumerGroup string                 `protobuf:"bytes,2,opt,name=consumer_group,json=consumerGroup,proto3" json:"consumer_group,omitempty"`
+	// How long the consumer has to ack each event. If not given events don't
+	// need to be acked.
+	AckDeadline   *durationpb.Duration `protobuf:"bytes,3,opt,name=ack_deadline,json=ackDeadline,proto3" json:"ack_deadline,omitempty"`
+	ConsumerId    string               `protobuf:"bytes,4,opt,name=consumer_id,json=consumerId,proto3" json:"consumer_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConsumeRequest) Reset() {
+	*x = ConsumeRequest{}
+	mi := &file_bananaq_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConsumeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConsumeRequest) ProtoMessage() {}
+
+func (x *ConsumeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_bananaq_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConsumeRequest.ProtoReflect.Descriptor instead.
+func (*ConsumeRequest) Descriptor() ([]byte, []int) {
+	return file_bananaq_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *ConsumeRequest) GetQueue() string {
+	if x != nil {
+		return x.Queue
+	}
+	return ""
+}
+
+func (x *ConsumeRequest) GetConsumerGroup() string {
+	if x != nil {
+		return x.ConsumerGroup
+	}
+	return ""
+}
+
+func (x *ConsumeRequest) GetAckDeadline() *durationpb.Duration {
+	if x != nil {
+		return x.AckDeadline
+	}
+	return nil
+}
+
+func (x *ConsumeRequest) GetConsumerId() string {
+	if x != nil {
+		return x.ConsumerId
+	}
+	return ""
+}
+
+var File_bananaq_proto protoreflect.FileDescriptor
+
+const file_bananaq_proto_rawDesc = "" +
+	"\n" +
+	"\rbananaq.proto\x12\abananaq\x1a\x1egoogle/protobuf/duration.proto\"\x95\x01\n" +
+	"\x05Event\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x1a\n" +
+	"\bcontents\x18\x02 \x01(\fR\bcontents\x12\x19\n" +
+	"\breply_to\x18\x03 \x01(\tR\areplyTo\x12\x1e\n" +
+	"\vin_reply_to\x18\x04 \x01(\tR\tinReplyTo\x12%\n" +
+	"\x0edelivery_token\x18\x05 \x01(\tR\rdeliveryToken\"\xf6\x01\n" +
+	"\n" +
+	"AddRequest\x12\x14\n" +
+	"\x05queue\x18\x01 \x01(\tR\x05queue\x12\x1a\n" +
+	"\bcontents\x18\x02 \x01(\fR\bcontents\x121\n" +
+	"\x06expire\x18\x03 \x01(\v2\x19.google.protobuf.DurationR\x06expire\x12/\n" +
+	"\x05delay\x18\x04 \x01(\v2\x19.google.protobuf.DurationR\x05delay\x12\x1a\n" +
+	"\bpriority\x18\x05 \x01(\x05R\bpriority\x12\x1b\n" +
+	"\tdedup_key\x18\x06 \x01(\tR\bdedupKey\x12\x19\n" +
+	"\breply_to\x18\a \x01(\tR\areplyTo\"\x1d\n" +
+	"\vAddResponse\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\"\xd9\x01\n" +
+	"\n" +
+	"GetRequest\x12\x14\n" +
+	"\x05queue\x18\x01 \x01(\tR\x05queue\x12%\n" +
+	"\x0econsumer_group\x18\x02 \x01(\tR\rconsumerGroup\x12<\n" +
+	"\fack_deadline\x18\x03 \x01(\v2\x19.google.protobuf.DurationR\vackDeadline\x12/\n" +
+	"\x05block\x18\x04 \x01(\v2\x19.google.protobuf.DurationR\x05block\x12\x1f\n" +
+	"\vconsumer_id\x18\x05 \x01(\tR\n" +
+	"consumerId\"3\n" +
+	"\vGetResponse\x12$\n" +
+	"\x05event\x18\x01 \x01(\v2\x0e.bananaq.EventR\x05event\"J\n" +
+	"\vPeekRequest\x12\x14\n" +
+	"\x05queue\x18\x01 \x01(\tR\x05queue\x12%\n" +
+	"\x0econsumer_group\x18\x02 \x01(\tR\rconsumerGroup\"\xdd\x01\n" +
+	"\n" +
+	"AckRequest\x12\x14\n" +
+	"\x05queue\x18\x01 \x01(\tR\x05queue\x12%\n" +
+	"\x0econsumer_group\x18\x02 \x01(\tR\rconsumerGroup\x12\x19\n" +
+	"\bevent_id\x18\x03 \x01(\tR\aeventId\x12\x16\n" +
+	"\x06result\x18\x04 \x01(\fR\x06result\x128\n" +
+	"\n" +
+	"result_ttl\x18\x05 \x01(\v2\x19.google.protobuf.DurationR\tresultTtl\x12%\n" +
+	"\x0edelivery_token\x18\x06 \x01(\tR\rdeliveryToken\"#\n" +
+	"\vAckResponse\x12\x14\n" +
+	"\x05acked\x18\x01 \x01(\bR\x05acked\"\x8c\x01\n" +
+	"\vNackRequest\x12\x14\n" +
+	"\x05queue\x18\x01 \x01(\tR\x05queue\x12%\n" +
+	"\x0econsumer_group\x18\x02 \x01(\tR\rconsumerGroup\x12\x19\n" +
+	"\bevent_id\x18\x03 \x01(\tR\aeventId\x12%\n" +
+	"\x0edelivery_token\x18\x04 \x01(\tR\rdeliveryToken\"&\n" +
+	"\fNackResponse\x12\x16\n" +
+	"\x06nacked\x18\x01 \x01(\bR\x06nacked\"\xcc\x01\n" +
+	"\rExtendRequest\x12\x14\n" +
+	"\x05queue\x18\x01 \x01(\tR\x05queue\x12%\n" +
+	"\x0econsumer_group\x18\x02 \x01(\tR\rconsumerGroup\x12\x19\n" +
+	"\bevent_id\x18\x03 \x01(\tR\aeventId\x12<\n" +
+	"\fack_deadline\x18\x04 \x01(\v2\x19.google.protobuf.DurationR\vackDeadline\x12%\n" +
+	"\x0edelivery_token\x18\x05 \x01(\tR\rdeliveryToken\",\n" +
+	"\x0eExtendResponse\x12\x1a\n" +
+	"\bextended\x18\x01 \x01(\bR\bextended\"'\n" +
+	"\rStatusRequest\x12\x16\n" +
+	"\x06queues\x18\x01 \x03(\tR\x06queues\"\x9e\x01\n" +
+	"\x0eStatusResponse\x12;\n" +
+	"\x06queues\x18\x01 \x03(\v2#.bananaq.StatusResponse.QueuesEntryR\x06queues\x1aO\n" +
+	"\vQueuesEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12*\n" +
+	"\x05value\x18\x02 \x01(\v2\x14.bananaq.QueueStatusR\x05value:\x028\x01\"\x89\x02\n" +
+	"\vQueueStatus\x12\x14\n" +
+	"\x05total\x18\x01 \x01(\x04R\x05total\x12\x18\n" +
+	"\adelayed\x18\x02 \x01(\x04R\adelayed\x12\x16\n" +
+	"\x06paused\x18\x03 \x01(\bR\x06paused\x12Q\n" +
+	"\x0fconsumer_groups\x18\x04 \x03(\v2(.bananaq.QueueStatus.ConsumerGroupsEntryR\x0econsumerGroups\x1a_\n" +
+	"\x13ConsumerGroupsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x122\n" +
+	"\x05value\x18\x02 \x01(\v2\x1c.bananaq.ConsumerGroupStatusR\x05value:\x028\x01\"\x90\x01\n" +
+	"\x13ConsumerGroupStatus\x12\x1c\n" +
+	"\tavailable\x18\x01 \x01(\x04R\tavailable\x12\x1f\n" +
+	"\vin_progress\x18\x02 \x01(\x04R\n" +
+	"inProgress\x12\x12\n" +
+	"\x04redo\x18\x03 \x01(\x04R\x04redo\x12\x12\n" +
+	"\x04done\x18\x04 \x01(\x04R\x04done\x12\x12\n" +
+	"\x04dead\x18\x05 \x01(\x04R\x04dead\"\xac\x01\n" +
+	"\x0eConsumeRequest\x12\x14\n" +
+	"\x05queue\x18\x01 \x01(\tR\x05queue\x12%\n" +
+	"\x0econsumer_group\x18\x02 \x01(\tR\rconsumerGroup\x12<\n" +
+	"\fack_deadline\x18\x03 \x01(\v2\x19.google.protobuf.DurationR\vackDeadline\x12\x1f\n" +
+	"\vconsumer_id\x18\x04 \x01(\tR\n" +
+	"consumerId2\xb4\x03\n" +
+	"\aBananaq\x120\n" +
+	"\x03Add\x12\x13.bananaq.AddRequest\x1a\x14.bananaq.AddResponse\x120\n" +
+	"\x03Get\x12\x13.bananaq.GetRequest\x1a\x14.bananaq.GetResponse\x122\n" +
+	"\x04Peek\x12\x14.bananaq.PeekRequest\x1a\x14.bananaq.GetResponse\x120\n" +
+	"\x03Ack\x12\x13.bananaq.AckRequest\x1a\x14.bananaq.AckResponse\x123\n" +
+	"\x04Nack\x12\x14.bananaq.NackRequest\x1a\x15.bananaq.NackResponse\x129\n" +
+	"\x06Extend\x12\x16.bananaq.ExtendRequest\x1a\x17.bananaq.ExtendResponse\x129\n" +
+	"\x06Status\x12\x16.bananaq.StatusRequest\x1a\x17.bananaq.StatusResponse\x124\n" +
+	"\aConsume\x12\x17.bananaq.ConsumeRequest\x1a\x0e.bananaq.Event0\x01B+Z)github.com/mediocregopher/bananaq/grpcapib\x06proto3"
+
+var (
+	file_bananaq_proto_rawDescOnce sync.Once
+	file_bananaq_proto_rawDescData []byte
+)
+
+func file_bananaq_proto_rawDescGZIP() []byte {
+	file_bananaq_proto_rawDescOnce.Do(func() {
+		file_bananaq_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_bananaq_proto_rawDesc), len(file_bananaq_proto_rawDesc)))
+	})
+	return file_bananaq_proto_rawDescData
+}
+
+var file_bananaq_proto_msgTypes = make([]protoimpl.MessageInfo, 19)
+var file_bananaq_proto_goTypes = []any{
+	(*Event)(nil),               // 0: bananaq.Event
+	(*AddRequest)(nil),          // 1: bananaq.AddRequest
+	(*AddResponse)(nil),         // 2: bananaq.AddResponse
+	(*GetRequest)(nil),          // 3: bananaq.GetRequest
+	(*GetResponse)(nil),         // 4: bananaq.GetResponse
+	(*PeekRequest)(nil),         // 5: bananaq.PeekRequest
+	(*AckRequest)(nil),          // 6: bananaq.AckRequest
+	(*AckResponse)(nil),         // 7: bananaq.AckResponse
+	(*NackRequest)(nil),         // 8: bananaq.NackRequest
+	(*NackResponse)(nil),        // 9: bananaq.NackResponse
+	(*ExtendRequest)(nil),       // 10: bananaq.ExtendRequest
+	(*ExtendResponse)(nil),      // 11: bananaq.ExtendResponse
+	(*StatusRequest)(nil),       // 12: bananaq.StatusRequest
+	(*StatusResponse)(nil),      // 13: bananaq.StatusResponse
+	(*QueueStatus)(nil),         // 14: bananaq.QueueStatus
+	(*ConsumerGroupStatus)(nil), // 15: bananaq.ConsumerGroupStatus
+	(*ConsumeRequest)(nil),      // 16: bananaq.ConsumeRequest
+	nil,                         // 17: bananaq.StatusResponse.QueuesEntry
+	nil,                         // 18: bananaq.QueueStatus.ConsumerGroupsEntry
+	(*durationpb.Duration)(nil), // 19: google.protobuf.Duration
+}
+var file_bananaq_proto_depIdxs = []int32{
+	19, // 0: bananaq.AddRequest.expire:type_name -> google.protobuf.Duration
+	19, // 1: bananaq.AddRequest.delay:type_name -> google.protobuf.Duration
+	19, // 2: bananaq.GetRequest.ack_deadline:type_name -> google.protobuf.Duration
+	19, // 3: bananaq.GetRequest.block:type_name -> google.protobuf.Duration
+	0,  // 4: bananaq.GetResponse.event:type_name -> bananaq.Event
+	19, // 5: bananaq.AckRequest.result_ttl:type_name -> google.protobuf.Duration
+	19, // 6: bananaq.ExtendRequest.ack_deadline:type_name -> google.protobuf.Duration
+	17, // 7: bananaq.StatusResponse.queues:type_name -> bananaq.StatusResponse.QueuesEntry
+	18, // 8: bananaq.QueueStatus.consumer_groups:type_name -> bananaq.QueueStatus.ConsumerGroupsEntry
+	19, // 9: bananaq.ConsumeRequest.ack_deadline:type_name -> google.protobuf.Duration
+	14, // 10: bananaq.StatusResponse.QueuesEntry.value:type_name -> bananaq.QueueStatus
+	15, // 11: bananaq.QueueStatus.ConsumerGroupsEntry.value:type_name -> bananaq.ConsumerGroupStatus
+	1,  // 12: bananaq.Bananaq.Add:input_type -> bananaq.AddRequest
+	3,  // 13: bananaq.Bananaq.Get:input_type -> bananaq.GetRequest
+	5,  // 14: bananaq.Bananaq.Peek:input_type -> bananaq.PeekRequest
+	6,  // 15: bananaq.Bananaq.Ack:input_type -> bananaq.AckRequest
+	8,  // 16: bananaq.Bananaq.Nack:input_type -> bananaq.NackRequest
+	10, // 17: bananaq.Bananaq.Extend:input_type -> bananaq.ExtendRequest
+	12, // 18: bananaq.Bananaq.Status:input_type -> bananaq.StatusRequest
+	16, // 19: bananaq.Bananaq.Consume:input_type -> bananaq.ConsumeRequest
+	2,  // 20: bananaq.Bananaq.Add:output_type -> bananaq.AddResponse
+	4,  // 21: bananaq.Bananaq.Get:output_type -> bananaq.GetResponse
+	4,  // 22: bananaq.Bananaq.Peek:output_type -> bananaq.GetResponse
+	7,  // 23: bananaq.Bananaq.Ack:output_type -> bananaq.AckResponse
+	9,  // 24: bananaq.Bananaq.Nack:output_type -> bananaq.NackResponse
+	11, // 25: bananaq.Bananaq.Extend:output_type -> bananaq.ExtendResponse
+	13, // 26: bananaq.Bananaq.Status:output_type -> bananaq.StatusResponse
+	0,  // 27: bananaq.Bananaq.Consume:output_type -> bananaq.Event
+	20, // [20:28] is the sub-list for method output_type
+	12, // [12:20] is the sub-list for method input_type
+	12, // [12:12] is the sub-list for extension type_name
+	12, // [12:12] is the sub-list for extension extendee
+	0,  // [0:12] is the sub-list for field type_name
+}
+
+func init() { file_bananaq_proto_init() }
+func file_bananaq_proto_init() {
+	if File_bananaq_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_bananaq_proto_rawDesc), len(file_bananaq_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   19,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_bananaq_proto_goTypes,
+		DependencyIndexes: file_bananaq_proto_depIdxs,
+		MessageInfos:      file_bananaq_proto_msgTypes,
+	}.Build()
+	File_bananaq_proto = out.File
+	file_bananaq_proto_goTypes = nil
+	file_bananaq_proto_depIdxs = nil
+}
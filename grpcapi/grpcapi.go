@@ -0,0 +1,368 @@
+// Package grpcapi exposes peel commands as a gRPC service, defined in
+// bananaq.proto, so that strongly typed clients can be generated for any
+// language. The Go client is generated alongside the server:
+//
+//	conn, err := grpc.NewClient("127.0.0.1:5779", grpc.WithTransportCredentials(insecure.NewCredentials()))
+//	if err != nil {
+//		panic(err)
+//	}
+//	client := grpcapi.NewBananaqClient(conn)
+//
+// Errors from peel are returned with the codes.ResourceExhausted code if the
+// queue is full, codes.Unavailable if the Peel is draining (see peel.Drain),
+// and codes.InvalidArgument for invalid requests, including ones with a missing
+// or invalid delivery_token. If the Server was given an ACL (see NewWithACL)
+// requests from clients which haven't authenticated get codes.Unauthenticated,
+// and those from clients which aren't allowed to make them
+// codes.PermissionDenied.
+package grpcapi
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative bananaq.proto
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// How long each QGet made by Consume blocks for. Consume keeps calling QGet
+// until the client goes away, so this only affects how often that's checked.
+const consumeBlock = 30 * time.Second
+
+// Server implements BananaqServer using a Peel
+type Server struct {
+	UnimplementedBananaqServer
+	p   *peel.Peel
+	acl *peel.ACL
+}
+
+// New returns a Server which performs commands using the given Peel, which
+// should already be running. It can be registered on a grpc.Server using
+// RegisterBananaqServer.
+func New(p *peel.Peel) *Server {
+	return &Server{p: p}
+}
+
+// NewWithACL is like New, but if the ACL isn't nil clients must authenticate as
+// one of its Identities. They can do so with "authorization: Bearer <token>"
+// metadata, or with a verified TLS client certificate. Add needs the
+// peel.RightProduce Right for the queue, Status needs peel.RightAdmin for the
+// queues it's limited to, or all of them, and every other method needs
+// peel.RightConsume.
+func NewWithACL(p *peel.Peel, acl *peel.ACL) *Server {
+	return &Server{p: p, acl: acl}
+}
+
+// authorize authenticates the request's client, returning the context with its
+// Identity in it, and checks that it has the Right for the queues. If the
+// Server has no ACL the context is returned as-is.
+func (s *Server) authorize(ctx context.Context, right peel.Right, queues ...string) (context.Context, error) {
+	if s.acl == nil {
+		return ctx, nil
+	}
+
+	var id *peel.Identity
+	err := peel.ErrUnauthenticated
+	md, _ := metadata.FromIncomingContext(ctx)
+	if vv := md.Get("authorization"); len(vv) > 0 {
+		if token, ok := strings.CutPrefix(vv[0], "Bearer "); ok {
+			id, err = s.acl.ByToken(token)
+		}
+	} else if pr, ok := peer.FromContext(ctx); ok {
+		if ti, ok := pr.AuthInfo.(credentials.TLSInfo); ok {
+			id, err = s.acl.ByTLS(ti.State)
+		}
+	}
+	if err != nil {
+		return nil, grpcErr(err)
+	}
+
+	ctx = peel.WithIdentity(ctx, id)
+	if err := peel.Authorize(ctx, right, queues...); err != nil {
+		return nil, grpcErr(err)
+	}
+	return ctx, nil
+}
+
+// converts an error from peel into one with the appropriate gRPC status code
+func grpcErr(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case peel.ErrQueueFull, peel.ErrTenantFull, peel.ErrTenantRateLimited:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case peel.ErrContentsTooLarge, peel.ErrDeliveryTokenRequired, peel.ErrInvalidDeliveryToken:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case peel.ErrDraining:
+		return status.Error(codes.Unavailable, err.Error())
+	case peel.ErrUnauthenticated:
+		return status.Error(codes.Unauthenticated, err.Error())
+	case context.Canceled, context.DeadlineExceeded:
+		return status.FromContextError(err).Err()
+	}
+	if _, ok := err.(*peel.ForbiddenError); ok {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+func invalidArg(err error) error {
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+// returns the time the given Duration after now, or the zero time if it's not
+// set
+func durationFrom(now time.Time, d *durationpb.Duration) time.Time {
+	if d == nil {
+		return time.Time{}
+	}
+	return now.Add(d.AsDuration())
+}
+
+func eventProto(e core.Event) *Event {
+	ret := &Event{
+		Id:            e.ID.String(),
+		Contents:      []byte(e.Contents),
+		ReplyTo:       e.ReplyTo,
+		DeliveryToken: e.DeliveryToken,
+	}
+	if (e.InReplyTo != core.ID{}) {
+		ret.InReplyTo = e.InReplyTo.String()
+	}
+	return ret
+}
+
+// Add implements the method for the BananaqServer interface
+func (s *Server) Add(ctx context.Context, req *AddRequest) (*AddResponse, error) {
+	ctx, err := s.authorize(ctx, peel.RightProduce, req.Queue)
+	if err != nil {
+		return nil, err
+	} else if req.Expire == nil {
+		return nil, status.Error(codes.InvalidArgument, "expire is required")
+	}
+
+	now := time.Now()
+	id, err := s.p.QAdd(ctx, peel.QAddCommand{
+		Queue:        req.Queue,
+		Expire:       durationFrom(now, req.Expire),
+		Contents:     string(req.Contents),
+		VisibleAfter: durationFrom(now, req.Delay),
+		Priority:     int(req.Priority),
+		DedupKey:     req.DedupKey,
+		ReplyTo:      req.ReplyTo,
+	})
+	if err != nil {
+		return nil, grpcErr(err)
+	}
+	return &AddResponse{Id: id.String()}, nil
+}
+
+// Get implements the method for the BananaqServer interface
+func (s *Server) Get(ctx context.Context, req *GetRequest) (*GetResponse, error) {
+	ctx, err := s.authorize(ctx, peel.RightConsume, req.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	e, err := s.p.QGet(ctx, peel.QGetCommand{
+		Queue:         req.Queue,
+		ConsumerGroup: req.ConsumerGroup,
+		AckDeadline:   durationFrom(now, req.AckDeadline),
+		BlockUntil:    durationFrom(now, req.Block),
+		ConsumerID:    req.ConsumerId,
+	})
+	if err != nil {
+		return nil, grpcErr(err)
+	} else if (e == core.Event{}) {
+		return &GetResponse{}, nil
+	}
+	return &GetResponse{Event: eventProto(e)}, nil
+}
+
+// Peek implements the method for the BananaqServer interface
+func (s *Server) Peek(ctx context.Context, req *PeekRequest) (*GetResponse, error) {
+	ctx, err := s.authorize(ctx, peel.RightConsume, req.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := s.p.QPeek(ctx, peel.QPeekCommand{
+		Queue:         req.Queue,
+		ConsumerGroup: req.ConsumerGroup,
+	})
+	if err != nil {
+		return nil, grpcErr(err)
+	} else if (e == core.Event{}) {
+		return &GetResponse{}, nil
+	}
+	return &GetResponse{Event: eventProto(e)}, nil
+}
+
+// Ack implements the method for the BananaqServer interface
+func (s *Server) Ack(ctx context.Context, req *AckRequest) (*AckResponse, error) {
+	ctx, err := s.authorize(ctx, peel.RightConsume, req.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := core.IDFromString(req.EventId)
+	if err != nil {
+		return nil, invalidArg(err)
+	}
+
+	acked, err := s.p.QAck(ctx, peel.QAckCommand{
+		Queue:         req.Queue,
+		ConsumerGroup: req.ConsumerGroup,
+		EventID:       id,
+		Result:        string(req.Result),
+		ResultTTL:     req.ResultTtl.AsDuration(),
+		DeliveryToken: req.DeliveryToken,
+	})
+	if err != nil {
+		return nil, grpcErr(err)
+	}
+	return &AckResponse{Acked: acked}, nil
+}
+
+// Nack implements the method for the BananaqServer interface
+func (s *Server) Nack(ctx context.Context, req *NackRequest) (*NackResponse, error) {
+	ctx, err := s.authorize(ctx, peel.RightConsume, req.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := core.IDFromString(req.EventId)
+	if err != nil {
+		return nil, invalidArg(err)
+	}
+
+	nacked, err := s.p.QNack(ctx, peel.QNackCommand{
+		Queue:         req.Queue,
+		ConsumerGroup: req.ConsumerGroup,
+		EventID:       id,
+		DeliveryToken: req.DeliveryToken,
+	})
+	if err != nil {
+		return nil, grpcErr(err)
+	}
+	return &NackResponse{Nacked: nacked}, nil
+}
+
+// Extend implements the method for the BananaqServer interface
+func (s *Server) Extend(ctx context.Context, req *ExtendRequest) (*ExtendResponse, error) {
+	ctx, err := s.authorize(ctx, peel.RightConsume, req.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := core.IDFromString(req.EventId)
+	if err != nil {
+		return nil, invalidArg(err)
+	} else if req.AckDeadline == nil {
+		return nil, status.Error(codes.InvalidArgument, "ack_deadline is required")
+	}
+
+	extended, err := s.p.QExtend(ctx, peel.QExtendCommand{
+		Queue:         req.Queue,
+		ConsumerGroup: req.ConsumerGroup,
+		EventID:       id,
+		AckDeadline:   durationFrom(time.Now(), req.AckDeadline),
+		DeliveryToken: req.DeliveryToken,
+	})
+	if err != nil {
+		return nil, grpcErr(err)
+	}
+	return &ExtendResponse{Extended: extended}, nil
+}
+
+// Status implements the method for the BananaqServer interface
+func (s *Server) Status(ctx context.Context, req *StatusRequest) (*StatusResponse, error) {
+	ctx, err := s.authorize(ctx, peel.RightAdmin, req.Queues...)
+	if err != nil {
+		return nil, err
+	}
+
+	// QStatus only returns the consumer groups it's given for each queue, so
+	// when limiting it to some queues their consumer groups have to be found
+	// first
+	var qcg map[string][]string
+	if len(req.Queues) > 0 {
+		all, err := s.p.AllQueuesConsumerGroups(ctx)
+		if err != nil {
+			return nil, grpcErr(err)
+		}
+		qcg = map[string][]string{}
+		for _, queue := range req.Queues {
+			qcg[queue] = all[queue]
+		}
+	}
+
+	qsm, err := s.p.QStatus(ctx, peel.QStatusCommand{
+		QueuesConsumerGroups: qcg,
+	})
+	if err != nil {
+		return nil, grpcErr(err)
+	}
+
+	ret := &StatusResponse{Queues: map[string]*QueueStatus{}}
+	for queue, qs := range qsm {
+		qstatus := &QueueStatus{
+			Total:          qs.Total,
+			Delayed:        qs.Delayed,
+			Paused:         qs.Paused,
+			ConsumerGroups: map[string]*ConsumerGroupStatus{},
+		}
+		for group, cgs := range qs.ConsumerGroupStats {
+			qstatus.ConsumerGroups[group] = &ConsumerGroupStatus{
+				Available:  cgs.Available,
+				InProgress: cgs.InProgress,
+				Redo:       cgs.Redo,
+				Done:       cgs.Done,
+				Dead:       cgs.Dead,
+			}
+		}
+		ret.Queues[queue] = qstatus
+	}
+	return ret, nil
+}
+
+// Consume implements the method for the BananaqServer interface
+func (s *Server) Consume(req *ConsumeRequest, stream grpc.ServerStreamingServer[Event]) error {
+	ctx, err := s.authorize(stream.Context(), peel.RightConsume, req.Queue)
+	if err != nil {
+		return err
+	}
+	for {
+		now := time.Now()
+		e, err := s.p.QGet(ctx, peel.QGetCommand{
+			Queue:         req.Queue,
+			ConsumerGroup: req.ConsumerGroup,
+			AckDeadline:   durationFrom(now, req.AckDeadline),
+			BlockUntil:    now.Add(consumeBlock),
+			ConsumerID:    req.ConsumerId,
+		})
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			return grpcErr(err)
+		} else if (e == core.Event{}) {
+			continue
+		}
+
+		if err := stream.Send(eventProto(e)); err != nil {
+			return err
+		}
+	}
+}
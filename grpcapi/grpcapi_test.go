@@ -0,0 +1,256 @@
+package grpcapi
+
+import (
+	"context"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+var testCtx = context.Background()
+
+func newTestClient(t *T) BananaqClient {
+	return newTestClientWithACL(t, nil)
+}
+
+func newTestClientWithACL(t *T, acl *peel.ACL) BananaqClient {
+	return newTestClientWithOpts(t, nil, acl)
+}
+
+func newTestClientWithOpts(t *T, o *peel.Opts, acl *peel.ACL) BananaqClient {
+	p := peel.NewWithBackend(core.NewMemBackend(), o)
+	errCh := p.Run(nil)
+	go func() { panic(<-errCh) }()
+
+	l := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	RegisterBananaqServer(srv, NewWithACL(p, acl))
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return l.Dial()
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return NewBananaqClient(conn)
+}
+
+func TestServer(t *T) {
+	client := newTestClient(t)
+	queue, group := testutil.RandStr(), testutil.RandStr()
+	contents := []byte{0, 1, 0xff}
+
+	addResp, err := client.Add(testCtx, &AddRequest{
+		Queue:    queue,
+		Contents: contents,
+		Expire:   durationpb.New(time.Minute),
+	})
+	require.Nil(t, err)
+
+	getResp, err := client.Get(testCtx, &GetRequest{
+		Queue:         queue,
+		ConsumerGroup: group,
+		AckDeadline:   durationpb.New(30 * time.Second),
+	})
+	require.Nil(t, err)
+	assert.NotEmpty(t, getResp.Event.DeliveryToken)
+	assert.True(t, proto.Equal(&Event{
+		Id:            addResp.Id,
+		Contents:      contents,
+		DeliveryToken: getResp.Event.DeliveryToken,
+	}, getResp.Event))
+
+	statusResp, err := client.Status(testCtx, &StatusRequest{Queues: []string{queue}})
+	require.Nil(t, err)
+	assert.True(t, proto.Equal(&StatusResponse{Queues: map[string]*QueueStatus{
+		queue: {
+			Total: 1,
+			ConsumerGroups: map[string]*ConsumerGroupStatus{
+				group: {InProgress: 1},
+			},
+		},
+	}}, statusResp), "%v", statusResp)
+
+	ackResp, err := client.Ack(testCtx, &AckRequest{
+		Queue:         queue,
+		ConsumerGroup: group,
+		EventId:       getResp.Event.Id,
+	})
+	require.Nil(t, err)
+	assert.True(t, ackResp.Acked)
+
+	getResp, err = client.Get(testCtx, &GetRequest{Queue: queue, ConsumerGroup: group})
+	require.Nil(t, err)
+	assert.Nil(t, getResp.Event)
+
+	_, err = client.Ack(testCtx, &AckRequest{
+		Queue:         queue,
+		ConsumerGroup: group,
+		EventId:       "foo",
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.Add(testCtx, &AddRequest{Queue: queue, Contents: contents})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServerDeliveryTokens(t *T) {
+	client := newTestClientWithOpts(t, &peel.Opts{RequireDeliveryTokens: true}, nil)
+	queue, group := testutil.RandStr(), testutil.RandStr()
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Add(testCtx, &AddRequest{
+			Queue:    queue,
+			Contents: []byte(testutil.RandStr()),
+			Expire:   durationpb.New(time.Minute),
+		})
+		require.Nil(t, err)
+	}
+	get := func() *Event {
+		getResp, err := client.Get(testCtx, &GetRequest{
+			Queue:         queue,
+			ConsumerGroup: group,
+			AckDeadline:   durationpb.New(30 * time.Second),
+		})
+		require.Nil(t, err)
+		require.NotNil(t, getResp.Event)
+		require.NotEmpty(t, getResp.Event.DeliveryToken)
+		return getResp.Event
+	}
+
+	e := get()
+	_, err := client.Ack(testCtx, &AckRequest{
+		Queue:         queue,
+		ConsumerGroup: group,
+		EventId:       e.Id,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.Ack(testCtx, &AckRequest{
+		Queue:         queue,
+		ConsumerGroup: group,
+		EventId:       e.Id,
+		DeliveryToken: "foo",
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	extendResp, err := client.Extend(testCtx, &ExtendRequest{
+		Queue:         queue,
+		ConsumerGroup: group,
+		EventId:       e.Id,
+		AckDeadline:   durationpb.New(time.Minute),
+		DeliveryToken: e.DeliveryToken,
+	})
+	require.Nil(t, err)
+	assert.True(t, extendResp.Extended)
+
+	ackResp, err := client.Ack(testCtx, &AckRequest{
+		Queue:         queue,
+		ConsumerGroup: group,
+		EventId:       e.Id,
+		DeliveryToken: e.DeliveryToken,
+	})
+	require.Nil(t, err)
+	assert.True(t, ackResp.Acked)
+
+	e = get()
+	_, err = client.Nack(testCtx, &NackRequest{
+		Queue:         queue,
+		ConsumerGroup: group,
+		EventId:       e.Id,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	nackResp, err := client.Nack(testCtx, &NackRequest{
+		Queue:         queue,
+		ConsumerGroup: group,
+		EventId:       e.Id,
+		DeliveryToken: e.DeliveryToken,
+	})
+	require.Nil(t, err)
+	assert.True(t, nackResp.Nacked)
+}
+
+func TestConsume(t *T) {
+	client := newTestClient(t)
+	queue, group := testutil.RandStr(), testutil.RandStr()
+
+	ctx, cancel := context.WithCancel(testCtx)
+	defer cancel()
+	stream, err := client.Consume(ctx, &ConsumeRequest{Queue: queue, ConsumerGroup: group})
+	require.Nil(t, err)
+
+	// Events added both before and after the consumer starts waiting are
+	// streamed to it
+	var ids []string
+	for i := 0; i < 3; i++ {
+		addResp, err := client.Add(testCtx, &AddRequest{
+			Queue:    queue,
+			Contents: []byte(testutil.RandStr()),
+			Expire:   durationpb.New(time.Minute),
+		})
+		require.Nil(t, err)
+		ids = append(ids, addResp.Id)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, id := range ids {
+		e, err := stream.Recv()
+		require.Nil(t, err)
+		assert.Equal(t, id, e.Id)
+	}
+
+	cancel()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Canceled, status.Code(err))
+}
+
+func TestServerACL(t *T) {
+	acl, err := peel.NewACL([]peel.Identity{{
+		Name:  "foo",
+		Token: "secret",
+		Rules: []peel.ACLRule{{Queues: "foo.*", Rights: []peel.Right{peel.RightProduce}}},
+	}})
+	require.Nil(t, err)
+	client := newTestClientWithACL(t, acl)
+
+	add := func(ctx context.Context, queue string) error {
+		_, err := client.Add(ctx, &AddRequest{
+			Queue:    queue,
+			Contents: []byte("bar"),
+			Expire:   durationpb.New(time.Minute),
+		})
+		return err
+	}
+	withToken := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(testCtx, "authorization", "Bearer "+token)
+	}
+
+	assert.Equal(t, codes.Unauthenticated, status.Code(add(testCtx, "foo.bar")))
+	assert.Equal(t, codes.Unauthenticated, status.Code(add(withToken("wrong"), "foo.bar")))
+	assert.Nil(t, add(withToken("secret"), "foo.bar"))
+	assert.Equal(t, codes.PermissionDenied, status.Code(add(withToken("secret"), "bar")))
+
+	_, err = client.Get(withToken("secret"), &GetRequest{Queue: "foo.bar", ConsumerGroup: "baz"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Status(withToken("secret"), &StatusRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -0,0 +1,214 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+)
+
+// Each CloudEvents attribute is sent in binary mode as a header with this
+// prefix, apart from datacontenttype, which is the Content-Type
+const ceHeaderPrefix = "Ce-"
+
+// Headers which the parts of an event which aren't part of its CloudEvent are
+// sent in, when an event is returned in binary mode
+const (
+	headerID            = "Bananaq-Id"
+	headerReplyTo       = "Bananaq-Reply-To"
+	headerInReplyTo     = "Bananaq-In-Reply-To"
+	headerDeliveryToken = "Bananaq-Delivery-Token"
+)
+
+// The Content-Type of a CloudEvent in structured mode
+const ceStructuredContentType = "application/cloudevents+json"
+
+// binaryEvent is returned from route when an event should be written as a
+// binary mode CloudEvent
+type binaryEvent struct {
+	e  core.Event
+	ce peel.CloudEvent
+}
+
+// cloudEventMode returns "binary" or "structured" if the request's body is a
+// CloudEvent in that mode, or "" if it isn't one
+func cloudEventMode(r *http.Request) string {
+	if r.Header.Get(ceHeaderPrefix+"Specversion") != "" {
+		return "binary"
+	}
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt == ceStructuredContentType {
+		return "structured"
+	}
+	return ""
+}
+
+// The CloudEvents HTTP binding requires header values to be percent-encoded
+// if they contain anything other than printable ASCII, or a space, '"' or '%'
+func ceHeaderEncode(s string) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if b <= ' ' || b > '~' || b == '"' || b == '%' {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		} else {
+			sb.WriteByte(b)
+		}
+	}
+	return sb.String()
+}
+
+// cloudEventFromBinary builds a CloudEvent from a binary mode request's headers
+// and body
+func cloudEventFromBinary(r *http.Request) (peel.CloudEvent, error) {
+	var ce peel.CloudEvent
+	for name, vv := range r.Header {
+		if !strings.HasPrefix(name, ceHeaderPrefix) || len(vv) == 0 {
+			continue
+		}
+		attr := strings.ToLower(strings.TrimPrefix(name, ceHeaderPrefix))
+		v, err := url.PathUnescape(vv[0])
+		if err != nil {
+			return ce, badRequest(fmt.Errorf("invalid %s header: %s", name, err))
+		}
+
+		switch attr {
+		case "specversion":
+			if v != peel.CloudEventsSpecVersion {
+				return ce, badRequest(fmt.Errorf("unsupported CloudEvents specversion %q", v))
+			}
+		case "id":
+			ce.ID = v
+		case "source":
+			ce.Source = v
+		case "type":
+			ce.Type = v
+		case "subject":
+			ce.Subject = v
+		case "dataschema":
+			ce.DataSchema = v
+		case "time":
+			if ce.Time, err = time.Parse(time.RFC3339Nano, v); err != nil {
+				return ce, badRequest(fmt.Errorf("invalid %s header: %s", name, err))
+			}
+		default:
+			if ce.Extensions == nil {
+				ce.Extensions = map[string]string{}
+			}
+			ce.Extensions[attr] = v
+		}
+	}
+	ce.DataContentType = r.Header.Get("Content-Type")
+
+	var err error
+	if ce.Data, err = io.ReadAll(r.Body); err != nil {
+		return ce, err
+	}
+	return ce, nil
+}
+
+// addCloudEvent adds a CloudEvent sent in either mode as the contents of an
+// event. The rest of the event's fields are taken from the query parameters.
+func (h handler) addCloudEvent(r *http.Request, queue, mode string) (interface{}, error) {
+	var contents []byte
+	if mode == "binary" {
+		ce, err := cloudEventFromBinary(r)
+		if err != nil {
+			return nil, err
+		}
+		// Marshaling also validates the CloudEvent
+		if contents, err = json.Marshal(ce); err != nil {
+			return nil, badRequest(err)
+		}
+	} else {
+		var err error
+		if contents, err = io.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		// Structured mode events are stored as they are, but must still be
+		// valid
+		if err := json.Unmarshal(contents, new(peel.CloudEvent)); err != nil {
+			return nil, badRequest(fmt.Errorf("invalid CloudEvent: %s", err))
+		}
+	}
+
+	q := r.URL.Query()
+	secsParam := func(name string) (float64, error) {
+		str := q.Get(name)
+		if str == "" {
+			return 0, nil
+		}
+		secs, err := strconv.ParseFloat(str, 64)
+		if err != nil || secs < 0 {
+			return 0, badRequest(fmt.Errorf("invalid %s %q", name, str))
+		}
+		return secs, nil
+	}
+	expire, err := secsParam("expire")
+	if err != nil {
+		return nil, err
+	}
+	delay, err := secsParam("delay")
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	id, err := h.p.QAdd(r.Context(), peel.QAddCommand{
+		Queue:        queue,
+		Expire:       secsFrom(now, expire),
+		Contents:     string(contents),
+		VisibleAfter: secsFrom(now, delay),
+		DedupKey:     q.Get("dedupKey"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return AddResponse{ID: id.String()}, nil
+}
+
+// writeBinaryEvent writes the event as a binary mode CloudEvent, with the
+// event's other fields in Bananaq-* headers
+func writeBinaryEvent(w http.ResponseWriter, be binaryEvent) {
+	header := w.Header()
+	setCE := func(attr, v string) {
+		if v != "" {
+			header.Set(ceHeaderPrefix+attr, ceHeaderEncode(v))
+		}
+	}
+	setCE("Specversion", peel.CloudEventsSpecVersion)
+	setCE("Id", be.ce.ID)
+	setCE("Source", be.ce.Source)
+	setCE("Type", be.ce.Type)
+	setCE("Subject", be.ce.Subject)
+	setCE("Dataschema", be.ce.DataSchema)
+	if !be.ce.Time.IsZero() {
+		setCE("Time", be.ce.Time.UTC().Format(time.RFC3339Nano))
+	}
+	for name, v := range be.ce.Extensions {
+		setCE(name, v)
+	}
+	if be.ce.DataContentType != "" {
+		header.Set("Content-Type", be.ce.DataContentType)
+	}
+
+	header.Set(headerID, be.e.ID.String())
+	if be.e.ReplyTo != "" {
+		header.Set(headerReplyTo, be.e.ReplyTo)
+	}
+	if (be.e.InReplyTo != core.ID{}) {
+		header.Set(headerInReplyTo, be.e.InReplyTo.String())
+	}
+	if be.e.DeliveryToken != "" {
+		header.Set(headerDeliveryToken, be.e.DeliveryToken)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(be.ce.Data)
+}
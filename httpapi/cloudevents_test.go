@@ -0,0 +1,100 @@
+package httpapi
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	. "testing"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPICloudEvents(t *T) {
+	srv := newTestServer()
+	defer srv.Close()
+	queue, group := testutil.RandStr(), testutil.RandStr()
+	queueURL := srv.URL + "/queues/" + queue
+	groupURL := queueURL + "/groups/" + group
+
+	post := func(header http.Header, body string) int {
+		r, err := http.NewRequest("POST", queueURL+"?expire=60", bytes.NewBufferString(body))
+		require.Nil(t, err)
+		r.Header = header
+		resp, err := http.DefaultClient.Do(r)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Binary mode in, structured mode stored
+	code := post(http.Header{
+		"Ce-Specversion": {"1.0"},
+		"Ce-Id":          {"1"},
+		"Ce-Source":      {"/orders"},
+		"Ce-Type":        {"com.example.order.created"},
+		"Ce-Subject":     {"order%20123"},
+		"Ce-Traceparent": {"00-abc-def-01"},
+		"Content-Type":   {"text/plain"},
+	}, "hello")
+	require.Equal(t, 200, code)
+
+	var e Event
+	code = do(t, "GET", groupURL, nil, &e)
+	require.Equal(t, 200, code)
+	assert.JSONEq(t, `{
+		"specversion":"1.0",
+		"id":"1",
+		"source":"/orders",
+		"type":"com.example.order.created",
+		"subject":"order 123",
+		"traceparent":"00-abc-def-01",
+		"datacontenttype":"text/plain",
+		"data":"hello"
+	}`, e.Contents)
+
+	// Structured mode in, binary mode out
+	code = post(http.Header{
+		"Content-Type": {"application/cloudevents+json; charset=utf-8"},
+	}, e.Contents)
+	require.Equal(t, 200, code)
+
+	resp, err := http.Get(groupURL + "?cloudevents=binary&deadline=30")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, 200, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "1.0", resp.Header.Get("Ce-Specversion"))
+	assert.Equal(t, "1", resp.Header.Get("Ce-Id"))
+	assert.Equal(t, "order%20123", resp.Header.Get("Ce-Subject"))
+	assert.Equal(t, "00-abc-def-01", resp.Header.Get("Ce-Traceparent"))
+	assert.NotEmpty(t, resp.Header.Get("Bananaq-Delivery-Token"))
+
+	var ackResp AckResponse
+	code = do(t, "POST", groupURL+"/ack", AckRequest{
+		ID:            resp.Header.Get("Bananaq-Id"),
+		DeliveryToken: resp.Header.Get("Bananaq-Delivery-Token"),
+	}, &ackResp)
+	require.Equal(t, 200, code)
+	assert.True(t, ackResp.Acked)
+
+	// Events which aren't CloudEvents are returned as usual
+	var addResp AddResponse
+	code = do(t, "POST", queueURL, AddRequest{Contents: "foo", Expire: 60}, &addResp)
+	require.Equal(t, 200, code)
+	code = do(t, "GET", groupURL+"?cloudevents=binary", nil, &e)
+	require.Equal(t, 200, code)
+	assert.Equal(t, Event{ID: addResp.ID, Contents: "foo"}, e)
+
+	// Invalid CloudEvents aren't added
+	code = post(http.Header{"Ce-Specversion": {"1.0"}, "Ce-Id": {"1"}}, "hello")
+	assert.Equal(t, 400, code)
+	code = post(http.Header{"Ce-Specversion": {"0.3"}, "Ce-Id": {"1"}, "Ce-Source": {"a"}, "Ce-Type": {"b"}}, "hello")
+	assert.Equal(t, 400, code)
+	code = post(http.Header{"Content-Type": {"application/cloudevents+json"}}, `{"id":"1"}`)
+	assert.Equal(t, 400, code)
+}
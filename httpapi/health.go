@@ -0,0 +1,83 @@
+package httpapi
+
+import (
+	"net/http"
+
+	"github.com/mediocregopher/bananaq/peel"
+)
+
+// HealthResponse is the body of a response from the health endpoint, see
+// peel.Health
+type HealthResponse struct {
+	Healthy bool `json:"healthy"`
+
+	// In seconds
+	Latency   float64 `json:"latency"`
+	ClockSkew float64 `json:"clockSkew"`
+
+	PoolAvail int         `json:"poolAvail"`
+	Pool      *HealthPool `json:"pool,omitempty"`
+	Problems  []string    `json:"problems,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
+}
+
+// HealthPool describes the connection pool in a HealthResponse, see
+// core.PoolStats. It's only included when bananaq is connected to a single
+// redis instance.
+type HealthPool struct {
+	Open              int     `json:"open"`
+	InUse             int     `json:"inUse"`
+	Idle              int     `json:"idle"`
+	WaitCount         uint64  `json:"waitCount"`
+	WaitDuration      float64 `json:"waitDuration"` // In seconds
+	WaitTimeouts      uint64  `json:"waitTimeouts"`
+	MaxIdleTimeClosed uint64  `json:"maxIdleTimeClosed"`
+	MaxLifetimeClosed uint64  `json:"maxLifetimeClosed"`
+}
+
+type healthHandler struct {
+	p *peel.Peel
+}
+
+// NewHealthHandler returns an http.Handler which serves only the health
+// endpoint described in the package doc, at any path. It's useful for serving
+// health checks to liveness and readiness probes without serving the rest of
+// the API.
+func NewHealthHandler(p *peel.Peel) http.Handler {
+	return healthHandler{p: p}
+}
+
+func (hh healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method must be GET"})
+		return
+	}
+
+	h := hh.p.Healthy(r.Context())
+	code := http.StatusOK
+	if !h.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+	var pool *HealthPool
+	if ps := h.PoolStats; ps != nil {
+		pool = &HealthPool{
+			Open:              ps.Open,
+			InUse:             ps.InUse,
+			Idle:              ps.Idle,
+			WaitCount:         ps.WaitCount,
+			WaitDuration:      ps.WaitDuration.Seconds(),
+			WaitTimeouts:      ps.WaitTimeouts,
+			MaxIdleTimeClosed: ps.MaxIdleTimeClosed,
+			MaxLifetimeClosed: ps.MaxLifetimeClosed,
+		}
+	}
+	writeJSON(w, code, HealthResponse{
+		Healthy:   h.Healthy,
+		Latency:   h.Latency.Seconds(),
+		ClockSkew: h.ClockSkew.Seconds(),
+		PoolAvail: h.PoolAvail,
+		Pool:      pool,
+		Problems:  h.Problems,
+		Warnings:  h.Warnings,
+	})
+}
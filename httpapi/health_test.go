@@ -0,0 +1,35 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	. "testing"
+
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	var res HealthResponse
+	assert.Equal(t, http.StatusOK, do(t, "GET", srv.URL+"/health", nil, &res))
+	assert.True(t, res.Healthy)
+	assert.Equal(t, -1, res.PoolAvail)
+	assert.Empty(t, res.Problems)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, do(t, "POST", srv.URL+"/health", nil, nil))
+
+	// With a negative MaxClockSkew any skew at all is too much, so the Peel is
+	// always unhealthy
+	p := peel.NewWithBackend(core.NewMemBackend(), &peel.Opts{MaxClockSkew: -1})
+	srv2 := httptest.NewServer(NewHealthHandler(p))
+	defer srv2.Close()
+
+	res = HealthResponse{}
+	assert.Equal(t, http.StatusServiceUnavailable, do(t, "GET", srv2.URL+"/healthz", nil, &res))
+	assert.False(t, res.Healthy)
+	assert.Len(t, res.Problems, 1)
+}
@@ -0,0 +1,562 @@
+// Package httpapi exposes peel commands over HTTP, with JSON request and
+// response bodies, for clients which can't easily speak the redis protocol. The
+// following endpoints are served by the http.Handler returned from New:
+//
+//	POST /queues/{queue}
+//		Adds an event to the queue (QAdd). The body is an AddRequest, and the
+//		response an AddResponse. The body may instead be a CloudEvent, in
+//		either binary or structured mode, which is added as the event's
+//		contents in structured mode (see peel.CloudEvent). The event's other
+//		fields are then taken from the query parameters:
+//			expire:   seconds from now until the event expires.
+//			delay:    seconds from now until the event becomes visible.
+//			dedupKey: see peel.QAddCommand.
+//
+//	GET /queues/{queue}/groups/{group}
+//		Retrieves the next event for the consumer group (QGet), responding
+//		with an Event, or with 204 No Content if there isn't one. Takes the
+//		query parameters:
+//			deadline: seconds the consumer has to ack the event. If not given
+//			          the event doesn't need to be acked.
+//			wait:     seconds to long-poll for an event if none is available.
+//			consumer: identifies the consumer, see QPendingList.
+//			cloudevents: if "binary", events whose contents are a
+//			          CloudEvent are returned as one in binary mode, with
+//			          the rest of the event's fields in Bananaq-* headers.
+//
+//	POST /queues/{queue}/groups/{group}/ack
+//		Acknowledges an event retrieved with a deadline (QAck). The body is an
+//		AckRequest, and the response an AckResponse.
+//
+//	GET /queues/{queue}/groups/{group}/ws
+//		Upgrades to a websocket, over which events for the consumer group are
+//		pushed as WSResponses as they become available. Each one must be
+//		acked (or nacked) by sending a WSRequest over the same socket, and
+//		events which haven't been by the time the socket is closed are
+//		nacked, so they're retried straight away. Takes the query
+//		parameters:
+//			deadline: seconds the consumer has to ack each event, default 30.
+//			prefetch: how many events may be un-acked at once, default 1.
+//			consumer: identifies the consumer, see QPendingList.
+//		Browsers will only be allowed to connect from the same origin.
+//
+//	GET /queues/{queue}/groups/{group}/scale
+//		Returns how much work the consumer group has waiting as a
+//		ScaleResponse, for autoscalers which poll a JSON endpoint, such as
+//		KEDA's metrics-api scaler.
+//
+//	GET /status
+//		Returns the status of queues and their consumer groups (QStatus) as a
+//		map of queue name to QueueStatus. Takes any number of "queue" query
+//		parameters to limit it to those queues, otherwise all are returned.
+//
+//	GET /health
+//		Checks whether the Peel is able to do its work (peel.Healthy),
+//		responding with a HealthResponse, with a 503 status if it's
+//		unhealthy. Suitable for liveness and readiness probes.
+//
+// Errors are returned with a 4xx or 5xx status, and an ErrorResponse body. If
+// the handler was given an ACL (see NewWithACL) requests from clients which
+// haven't authenticated get a 401 status, and those from clients which aren't
+// allowed to use the endpoint a 403.
+//
+// Event contents are JSON strings, so contents which aren't valid UTF-8 should
+// be encoded (e.g. as base64) by the client.
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+)
+
+// AddRequest is the body of a request to add an event to a queue
+type AddRequest struct {
+	Contents string `json:"contents"`
+
+	// Seconds from now until the event expires. Required, unless the queue
+	// has a DefaultTTL (see peel.QueueConfig).
+	Expire float64 `json:"expire"`
+
+	// Optional. Seconds from now until the event becomes visible to consumer
+	// groups.
+	Delay float64 `json:"delay,omitempty"`
+
+	// Optional, see the fields of the same name on peel.QAddCommand
+	Priority     int    `json:"priority,omitempty"`
+	DedupKey     string `json:"dedupKey,omitempty"`
+	ReplyTo      string `json:"replyTo,omitempty"`
+	PartitionKey string `json:"partitionKey,omitempty"`
+	GroupID      string `json:"groupID,omitempty"`
+}
+
+// AddResponse is the response to a request to add an event to a queue
+type AddResponse struct {
+	ID string `json:"id"`
+}
+
+// Event is an event which was retrieved for a consumer group
+type Event struct {
+	ID        string `json:"id"`
+	Contents  string `json:"contents"`
+	ReplyTo   string `json:"replyTo,omitempty"`
+	InReplyTo string `json:"inReplyTo,omitempty"`
+
+	// Only set if the event was retrieved with a deadline, see core.Event's
+	// DeliveryToken
+	DeliveryToken string `json:"deliveryToken,omitempty"`
+}
+
+// AckRequest is the body of a request to acknowledge an event
+type AckRequest struct {
+	ID string `json:"id"`
+
+	// Optional, see the fields of the same name on peel.QAckCommand.
+	// ResultTTL is in seconds.
+	Result        string  `json:"result,omitempty"`
+	ResultTTL     float64 `json:"resultTTL,omitempty"`
+	DeliveryToken string  `json:"deliveryToken,omitempty"`
+}
+
+// AckResponse is the response to a request to acknowledge an event. Acked is
+// false if the event's deadline had already passed.
+type AckResponse struct {
+	Acked bool `json:"acked"`
+}
+
+// QueueStatus describes a queue, see peel.QueueStats
+type QueueStatus struct {
+	Total          uint64                         `json:"total"`
+	Delayed        uint64                         `json:"delayed"`
+	Paused         bool                           `json:"paused"`
+	ConsumerGroups map[string]ConsumerGroupStatus `json:"consumerGroups"`
+}
+
+// ConsumerGroupStatus describes a consumer group of a queue, see
+// peel.ConsumerGroupStats
+type ConsumerGroupStatus struct {
+	Available  uint64 `json:"available"`
+	InProgress uint64 `json:"inProgress"`
+	Redo       uint64 `json:"redo"`
+	Done       uint64 `json:"done"`
+	Dead       uint64 `json:"dead"`
+
+	// Seconds, see peel.ConsumerGroupStats' Lag
+	Lag float64 `json:"lag"`
+}
+
+// ScaleResponse is the body of a response to a scale request. An autoscaler can
+// be pointed at whichever of its fields suits the consumers best, e.g. Pending
+// for consumers whose events each take a while, or Lag for ones which have to
+// keep up with the queue within some time.
+type ScaleResponse struct {
+	// Events the consumer group has yet to retrieve, including those awaiting
+	// being retrieved again
+	Backlog uint64 `json:"backlog"`
+
+	// Events the consumer group has retrieved but not yet acked
+	InProgress uint64 `json:"inProgress"`
+
+	// Backlog plus InProgress, i.e. every event the consumer group has yet to
+	// finish with
+	Pending uint64 `json:"pending"`
+
+	// Seconds, see peel.ConsumerGroupStats' Lag
+	Lag float64 `json:"lag"`
+}
+
+// ErrorResponse is the body of any response with an error status
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// httpError is an error which should be returned to the client with the given
+// status code
+type httpError struct {
+	code int
+	err  error
+}
+
+func (he httpError) Error() string {
+	return he.err.Error()
+}
+
+func badRequest(err error) error {
+	return httpError{code: http.StatusBadRequest, err: err}
+}
+
+type handler struct {
+	p   *peel.Peel
+	acl *peel.ACL
+}
+
+// New returns an http.Handler which serves the API described in the package
+// doc using the given Peel, which should already be running.
+func New(p *peel.Peel) http.Handler {
+	return handler{p: p}
+}
+
+// NewWithACL is like New, but if the ACL isn't nil clients must authenticate as
+// one of its Identities, other than for the health endpoint. They can do so
+// with an "Authorization: Bearer <token>" header, or with a verified TLS client
+// certificate. Adding events needs the peel.RightProduce Right for the queue,
+// the consumer group endpoints need peel.RightConsume, and the status endpoint
+// needs peel.RightAdmin for the queues it's limited to, or all of them.
+func NewWithACL(p *peel.Peel, acl *peel.ACL) http.Handler {
+	return handler{p: p, acl: acl}
+}
+
+func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Trim(r.URL.Path, "/") == "health" {
+		healthHandler{p: h.p}.ServeHTTP(w, r)
+		return
+	}
+	if h.acl != nil {
+		ctx, err := h.authorize(r)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		r = r.WithContext(ctx)
+	}
+	if queue, cgroup, ok := wsPath(r.URL.Path); ok {
+		h.serveWS(w, r, queue, cgroup)
+		return
+	}
+
+	ret, err := h.route(r)
+	if err != nil {
+		writeErr(w, err)
+	} else if ret == nil {
+		w.WriteHeader(http.StatusNoContent)
+	} else if be, ok := ret.(binaryEvent); ok {
+		writeBinaryEvent(w, be)
+	} else {
+		writeJSON(w, http.StatusOK, ret)
+	}
+}
+
+func writeErr(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch err {
+	case peel.ErrQueueFull, peel.ErrDraining, peel.ErrTenantFull:
+		code = http.StatusServiceUnavailable
+	case peel.ErrTenantRateLimited:
+		code = http.StatusTooManyRequests
+	case peel.ErrContentsTooLarge:
+		code = http.StatusRequestEntityTooLarge
+	case peel.ErrNoExpire, peel.ErrDeliveryTokenRequired, peel.ErrInvalidDeliveryToken:
+		code = http.StatusBadRequest
+	case peel.ErrUnauthenticated:
+		code = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	if he, ok := err.(httpError); ok {
+		code = he.code
+	} else if _, ok := err.(*peel.ForbiddenError); ok {
+		code = http.StatusForbidden
+	}
+	writeJSON(w, code, ErrorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// route calls the appropriate method for the request, returning what should be
+// written back as JSON, or nil if there's nothing to write
+func (h handler) route(r *http.Request) (interface{}, error) {
+	notFound := httpError{code: http.StatusNotFound, err: errors.New("not found")}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	method := func(m string) error {
+		if r.Method != m {
+			return httpError{
+				code: http.StatusMethodNotAllowed,
+				err:  fmt.Errorf("method must be %s", m),
+			}
+		}
+		return nil
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "status":
+		if err := method("GET"); err != nil {
+			return nil, err
+		}
+		return h.status(r)
+
+	case len(parts) < 2 || parts[0] != "queues":
+		return nil, notFound
+
+	case len(parts) == 2:
+		if err := method("POST"); err != nil {
+			return nil, err
+		}
+		return h.add(r, parts[1])
+
+	case len(parts) < 4 || parts[2] != "groups":
+		return nil, notFound
+
+	case len(parts) == 4:
+		if err := method("GET"); err != nil {
+			return nil, err
+		}
+		return h.get(r, parts[1], parts[3])
+
+	case len(parts) == 5 && parts[4] == "ack":
+		if err := method("POST"); err != nil {
+			return nil, err
+		}
+		return h.ack(r, parts[1], parts[3])
+
+	case len(parts) == 5 && parts[4] == "scale":
+		if err := method("GET"); err != nil {
+			return nil, err
+		}
+		return h.scale(r, parts[1], parts[3])
+	}
+
+	return nil, notFound
+}
+
+// authorize authenticates the request's client, returning the request's context
+// with its Identity in it, and checks that it has the Right needed for the
+// endpoint. Requests for unknown endpoints are left to route.
+func (h handler) authorize(r *http.Request) (context.Context, error) {
+	var id *peel.Identity
+	err := peel.ErrUnauthenticated
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		id, err = h.acl.ByToken(token)
+	} else if r.TLS != nil {
+		id, err = h.acl.ByTLS(*r.TLS)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := peel.WithIdentity(r.Context(), id)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "status":
+		return ctx, peel.Authorize(ctx, peel.RightAdmin, r.URL.Query()["queue"]...)
+	case len(parts) == 2 && parts[0] == "queues":
+		return ctx, peel.Authorize(ctx, peel.RightProduce, parts[1])
+	case len(parts) > 2 && parts[0] == "queues":
+		return ctx, peel.Authorize(ctx, peel.RightConsume, parts[1])
+	}
+	return ctx, nil
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return badRequest(fmt.Errorf("invalid body: %s", err))
+	}
+	return nil
+}
+
+// returns the time the given number of seconds after now, or the zero time if
+// secs is zero
+func secsFrom(now time.Time, secs float64) time.Time {
+	if secs == 0 {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(secs * float64(time.Second)))
+}
+
+func (h handler) add(r *http.Request, queue string) (interface{}, error) {
+	if mode := cloudEventMode(r); mode != "" {
+		return h.addCloudEvent(r, queue, mode)
+	}
+
+	var req AddRequest
+	if err := decodeBody(r, &req); err != nil {
+		return nil, err
+	} else if req.Expire < 0 {
+		return nil, badRequest(errors.New("expire may not be negative"))
+	}
+
+	now := time.Now()
+	id, err := h.p.QAdd(r.Context(), peel.QAddCommand{
+		Queue:        queue,
+		Expire:       secsFrom(now, req.Expire),
+		Contents:     req.Contents,
+		VisibleAfter: secsFrom(now, req.Delay),
+		Priority:     req.Priority,
+		DedupKey:     req.DedupKey,
+		ReplyTo:      req.ReplyTo,
+		PartitionKey: req.PartitionKey,
+		GroupID:      req.GroupID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return AddResponse{ID: id.String()}, nil
+}
+
+func (h handler) get(r *http.Request, queue, group string) (interface{}, error) {
+	q := r.URL.Query()
+	secsParam := func(name string) (float64, error) {
+		str := q.Get(name)
+		if str == "" {
+			return 0, nil
+		}
+		secs, err := strconv.ParseFloat(str, 64)
+		if err != nil || secs < 0 {
+			return 0, badRequest(fmt.Errorf("invalid %s %q", name, str))
+		}
+		return secs, nil
+	}
+
+	deadline, err := secsParam("deadline")
+	if err != nil {
+		return nil, err
+	}
+	wait, err := secsParam("wait")
+	if err != nil {
+		return nil, err
+	}
+	filter := q.Get("filter")
+	if filter != "" {
+		if _, err := peel.ParseFilter(filter); err != nil {
+			return nil, badRequest(err)
+		}
+	}
+
+	// The request's context is canceled if the client goes away, which ends
+	// the long-poll early
+	now := time.Now()
+	e, err := h.p.QGet(r.Context(), peel.QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: group,
+		AckDeadline:   secsFrom(now, deadline),
+		BlockUntil:    secsFrom(now, wait),
+		ConsumerID:    q.Get("consumer"),
+		Filter:        filter,
+	})
+	if err == context.Canceled {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if (e == core.Event{}) {
+		return nil, nil
+	}
+
+	// Events which aren't CloudEvents are returned as usual
+	if q.Get("cloudevents") == "binary" {
+		if ce, err := peel.ParseCloudEvent(e); err == nil {
+			return binaryEvent{e: e, ce: ce}, nil
+		}
+	}
+	return eventJSON(e), nil
+}
+
+func eventJSON(e core.Event) Event {
+	ret := Event{
+		ID:            e.ID.String(),
+		Contents:      e.Contents,
+		ReplyTo:       e.ReplyTo,
+		DeliveryToken: e.DeliveryToken,
+	}
+	if (e.InReplyTo != core.ID{}) {
+		ret.InReplyTo = e.InReplyTo.String()
+	}
+	return ret
+}
+
+func (h handler) ack(r *http.Request, queue, group string) (interface{}, error) {
+	var req AckRequest
+	if err := decodeBody(r, &req); err != nil {
+		return nil, err
+	}
+	id, err := core.IDFromString(req.ID)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+
+	acked, err := h.p.QAck(r.Context(), peel.QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: group,
+		EventID:       id,
+		Result:        req.Result,
+		ResultTTL:     time.Duration(req.ResultTTL * float64(time.Second)),
+		DeliveryToken: req.DeliveryToken,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return AckResponse{Acked: acked}, nil
+}
+
+func (h handler) status(r *http.Request) (interface{}, error) {
+	// QStatus only returns the consumer groups it's given for each queue, so
+	// when limiting it to some queues their consumer groups have to be found
+	// first
+	var qcg map[string][]string
+	if queues := r.URL.Query()["queue"]; len(queues) > 0 {
+		all, err := h.p.AllQueuesConsumerGroups(r.Context())
+		if err != nil {
+			return nil, err
+		}
+		qcg = map[string][]string{}
+		for _, queue := range queues {
+			qcg[queue] = all[queue]
+		}
+	}
+
+	qsm, err := h.p.QStatus(r.Context(), peel.QStatusCommand{
+		QueuesConsumerGroups: qcg,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := map[string]QueueStatus{}
+	for queue, qs := range qsm {
+		qstatus := QueueStatus{
+			Total:          qs.Total,
+			Delayed:        qs.Delayed,
+			Paused:         qs.Paused,
+			ConsumerGroups: map[string]ConsumerGroupStatus{},
+		}
+		for group, cgs := range qs.ConsumerGroupStats {
+			qstatus.ConsumerGroups[group] = ConsumerGroupStatus{
+				Available:  cgs.Available,
+				InProgress: cgs.InProgress,
+				Redo:       cgs.Redo,
+				Done:       cgs.Done,
+				Dead:       cgs.Dead,
+				Lag:        cgs.Lag.Seconds(),
+			}
+		}
+		ret[queue] = qstatus
+	}
+	return ret, nil
+}
+
+func (h handler) scale(r *http.Request, queue, cgroup string) (interface{}, error) {
+	qsm, err := h.p.QStatus(r.Context(), peel.QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: {cgroup}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cgs := qsm[queue].ConsumerGroupStats[cgroup]
+	backlog := cgs.Available + cgs.Redo
+	return ScaleResponse{
+		Backlog:    backlog,
+		InProgress: cgs.InProgress,
+		Pending:    backlog + cgs.InProgress,
+		Lag:        cgs.Lag.Seconds(),
+	}, nil
+}
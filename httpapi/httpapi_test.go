@@ -0,0 +1,221 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer() *httptest.Server {
+	return newTestServerWithACL(nil)
+}
+
+func newTestServerWithACL(acl *peel.ACL) *httptest.Server {
+	return newTestServerWithOpts(nil, acl)
+}
+
+func newTestServerWithOpts(o *peel.Opts, acl *peel.ACL) *httptest.Server {
+	p := peel.NewWithBackend(core.NewMemBackend(), o)
+	errCh := p.Run(nil)
+	go func() { panic(<-errCh) }()
+	return httptest.NewServer(NewWithACL(p, acl))
+}
+
+// do performs the request, decoding the response body into into if it's
+// non-nil, and returns the status code
+func do(t *T, method, url string, body, into interface{}) int {
+	var bodyb []byte
+	if body != nil {
+		var err error
+		bodyb, err = json.Marshal(body)
+		require.Nil(t, err)
+	}
+
+	r, err := http.NewRequest(method, url, bytes.NewReader(bodyb))
+	require.Nil(t, err)
+	resp, err := http.DefaultClient.Do(r)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	if into != nil {
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(into))
+	}
+	return resp.StatusCode
+}
+
+func TestAPI(t *T) {
+	srv := newTestServer()
+	defer srv.Close()
+	queue, group := testutil.RandStr(), testutil.RandStr()
+	queueURL := srv.URL + "/queues/" + queue
+	groupURL := queueURL + "/groups/" + group
+
+	var addResp AddResponse
+	contents := testutil.RandStr()
+	code := do(t, "POST", queueURL, AddRequest{Contents: contents, Expire: 60}, &addResp)
+	require.Equal(t, 200, code)
+	assert.NotEmpty(t, addResp.ID)
+
+	var e Event
+	code = do(t, "GET", groupURL+"?deadline=30", nil, &e)
+	require.Equal(t, 200, code)
+	assert.NotEmpty(t, e.DeliveryToken)
+	assert.Equal(t, Event{ID: addResp.ID, Contents: contents, DeliveryToken: e.DeliveryToken}, e)
+
+	var status map[string]QueueStatus
+	code = do(t, "GET", srv.URL+"/status?queue="+queue, nil, &status)
+	require.Equal(t, 200, code)
+	assert.Equal(t, map[string]QueueStatus{
+		queue: {
+			Total: 1,
+			ConsumerGroups: map[string]ConsumerGroupStatus{
+				group: {InProgress: 1},
+			},
+		},
+	}, status)
+
+	var ackResp AckResponse
+	code = do(t, "POST", groupURL+"/ack", AckRequest{ID: e.ID, DeliveryToken: e.DeliveryToken}, &ackResp)
+	require.Equal(t, 200, code)
+	assert.True(t, ackResp.Acked)
+
+	// Nothing left, so this returns nothing once the wait is over
+	start := time.Now()
+	code = do(t, "GET", groupURL+"?wait=0.1", nil, nil)
+	assert.Equal(t, 204, code)
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	// Long-polling returns as soon as an event is added
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		do(t, "POST", queueURL, AddRequest{Contents: contents, Expire: 60}, nil)
+	}()
+	code = do(t, "GET", groupURL+"?wait=5", nil, &e)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, contents, e.Contents)
+}
+
+func TestAPIScale(t *T) {
+	srv := newTestServer()
+	defer srv.Close()
+	queue, group := testutil.RandStr(), testutil.RandStr()
+	queueURL := srv.URL + "/queues/" + queue
+	groupURL := queueURL + "/groups/" + group
+
+	// A consumer group which hasn't retrieved anything yet has the whole queue
+	// to get through
+	for i := 0; i < 3; i++ {
+		code := do(t, "POST", queueURL, AddRequest{Contents: testutil.RandStr(), Expire: 60}, nil)
+		require.Equal(t, 200, code)
+	}
+	var scale ScaleResponse
+	code := do(t, "GET", groupURL+"/scale", nil, &scale)
+	require.Equal(t, 200, code)
+	assert.Equal(t, uint64(3), scale.Backlog)
+	assert.Equal(t, uint64(3), scale.Pending)
+	assert.True(t, scale.Lag > 0)
+
+	code = do(t, "GET", groupURL+"?deadline=30", nil, nil)
+	require.Equal(t, 200, code)
+	code = do(t, "GET", groupURL+"/scale", nil, &scale)
+	require.Equal(t, 200, code)
+	assert.Equal(t, uint64(2), scale.Backlog)
+	assert.Equal(t, uint64(1), scale.InProgress)
+	assert.Equal(t, uint64(3), scale.Pending)
+}
+
+func TestAPIErrors(t *T) {
+	srv := newTestServer()
+	defer srv.Close()
+	queueURL := srv.URL + "/queues/" + testutil.RandStr()
+
+	assertErr := func(expCode int, method, url string, body interface{}) {
+		var errResp ErrorResponse
+		code := do(t, method, url, body, &errResp)
+		assert.Equal(t, expCode, code)
+		assert.NotEmpty(t, errResp.Error)
+	}
+
+	assertErr(404, "GET", srv.URL+"/foo", nil)
+	assertErr(404, "GET", queueURL+"/foo/bar", nil)
+	assertErr(405, "GET", queueURL, nil)
+	assertErr(405, "POST", srv.URL+"/status", nil)
+	assertErr(405, "POST", queueURL+"/groups/foo/scale", nil)
+	assertErr(400, "POST", queueURL, AddRequest{Contents: "foo"})
+	assertErr(400, "POST", queueURL, "foo")
+	assertErr(400, "GET", queueURL+"/groups/foo?wait=bar", nil)
+	assertErr(400, "POST", queueURL+"/groups/foo/ack", AckRequest{ID: "bar"})
+	assertErr(400, "POST", queueURL+"/groups/foo/ack", AckRequest{
+		ID:            "1464387077_1464387087",
+		DeliveryToken: "bar",
+	})
+}
+
+func TestAPIDeliveryTokens(t *T) {
+	srv := newTestServerWithOpts(&peel.Opts{RequireDeliveryTokens: true}, nil)
+	defer srv.Close()
+	queue, group := testutil.RandStr(), testutil.RandStr()
+	queueURL := srv.URL + "/queues/" + queue
+	groupURL := queueURL + "/groups/" + group
+
+	code := do(t, "POST", queueURL, AddRequest{Contents: testutil.RandStr(), Expire: 60}, nil)
+	require.Equal(t, 200, code)
+
+	var e Event
+	code = do(t, "GET", groupURL+"?deadline=30", nil, &e)
+	require.Equal(t, 200, code)
+	require.NotEmpty(t, e.DeliveryToken)
+
+	var errResp struct{ Error string }
+	code = do(t, "POST", groupURL+"/ack", AckRequest{ID: e.ID}, &errResp)
+	assert.Equal(t, 400, code)
+	assert.NotEmpty(t, errResp.Error)
+
+	var ackResp AckResponse
+	code = do(t, "POST", groupURL+"/ack", AckRequest{ID: e.ID, DeliveryToken: e.DeliveryToken}, &ackResp)
+	assert.Equal(t, 200, code)
+	assert.True(t, ackResp.Acked)
+}
+
+func TestAPIACL(t *T) {
+	acl, err := peel.NewACL([]peel.Identity{{
+		Name:  "foo",
+		Token: "secret",
+		Rules: []peel.ACLRule{{Queues: "foo.*", Rights: []peel.Right{peel.RightProduce}}},
+	}})
+	require.Nil(t, err)
+	srv := newTestServerWithACL(acl)
+	defer srv.Close()
+
+	doAuth := func(method, path, token string, body interface{}) int {
+		bodyb, err := json.Marshal(body)
+		require.Nil(t, err)
+		r, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(bodyb))
+		require.Nil(t, err)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	add := AddRequest{Contents: "bar", Expire: 60}
+	assert.Equal(t, 401, doAuth("POST", "/queues/foo.bar", "", add))
+	assert.Equal(t, 401, doAuth("POST", "/queues/foo.bar", "wrong", add))
+	assert.Equal(t, 200, doAuth("POST", "/queues/foo.bar", "secret", add))
+	assert.Equal(t, 403, doAuth("POST", "/queues/bar", "secret", add))
+	assert.Equal(t, 403, doAuth("GET", "/queues/foo.bar/groups/baz", "secret", nil))
+	assert.Equal(t, 403, doAuth("GET", "/status", "secret", nil))
+	assert.Equal(t, 200, doAuth("GET", "/health", "", nil))
+}
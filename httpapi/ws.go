@@ -0,0 +1,292 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+)
+
+// WSRequest is sent by the client over a websocket to ack or nack an event it
+// was sent. Only one of Ack or Nack should be set, to the event's id.
+type WSRequest struct {
+	Ack  string `json:"ack,omitempty"`
+	Nack string `json:"nack,omitempty"`
+
+	// Optional, only used with Ack. See the field of the same name on
+	// peel.QAckCommand.
+	Result string `json:"result,omitempty"`
+
+	// Optional, only used with Nack. See the field of the same name on
+	// peel.QNackCommand.
+	Error string `json:"error,omitempty"`
+
+	// Optional, the deliveryToken of the event. See the DeliveryToken field
+	// on peel.QAckCommand.
+	DeliveryToken string `json:"deliveryToken,omitempty"`
+}
+
+// WSResponse is sent by the server over a websocket. Either Event is set, or
+// the other fields are set in response to a WSRequest.
+type WSResponse struct {
+	Event *Event `json:"event,omitempty"`
+
+	// The id of the event the WSRequest was for
+	ID string `json:"id,omitempty"`
+
+	// Whether the ack or nack succeeded. False if the event's deadline had
+	// already passed.
+	OK bool `json:"ok,omitempty"`
+
+	// Set if the WSRequest couldn't be performed
+	Error string `json:"error,omitempty"`
+}
+
+// Default values for the query parameters of the websocket endpoint
+const (
+	wsDefaultDeadline = 30 * time.Second
+	wsDefaultPrefetch = 1
+)
+
+// How long each QGet made for a websocket blocks for. QGet is called again
+// until the socket is closed, so this only affects how often that's checked.
+const wsBlock = 30 * time.Second
+
+var upgrader = websocket.Upgrader{}
+
+// returns the queue and consumer group from a websocket endpoint path, or false
+// if the path isn't one
+func wsPath(path string) (string, string, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 5 || parts[0] != "queues" || parts[2] != "groups" || parts[4] != "ws" {
+		return "", "", false
+	}
+	return parts[1], parts[3], true
+}
+
+// wsConn holds the state of a single websocket connection
+type wsConn struct {
+	p             *peel.Peel
+	conn          *websocket.Conn
+	queue, cgroup string
+
+	// Only one goroutine may write to conn at a time
+	writeL sync.Mutex
+
+	// slots limits how many events may be in flight at once. A slot is
+	// taken before each QGet, and given back once the event is acked or
+	// nacked.
+	slots     chan struct{}
+	inFlightL sync.Mutex
+	inFlight  map[core.ID]bool
+}
+
+// serveWS upgrades the request to a websocket, and then sends events for the
+// consumer group over it until it's closed. Each event is retrieved with an ack
+// deadline, and is expected to be acked or nacked over the socket. Events
+// which are still in flight when the socket is closed are nacked so they can
+// be retrieved again straight away.
+func (h handler) serveWS(w http.ResponseWriter, r *http.Request, queue, cgroup string) {
+	q := r.URL.Query()
+	deadline, prefetch := wsDefaultDeadline, wsDefaultPrefetch
+	if str := q.Get("deadline"); str != "" {
+		secs, err := strconv.ParseFloat(str, 64)
+		if err != nil || secs <= 0 {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid deadline"})
+			return
+		}
+		deadline = time.Duration(secs * float64(time.Second))
+	}
+	if str := q.Get("prefetch"); str != "" {
+		var err error
+		if prefetch, err = strconv.Atoi(str); err != nil || prefetch < 1 {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid prefetch"})
+			return
+		}
+	}
+
+	// Upgrade writes an error response itself
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	wc := &wsConn{
+		p:        h.p,
+		conn:     conn,
+		queue:    queue,
+		cgroup:   cgroup,
+		slots:    make(chan struct{}, prefetch),
+		inFlight: map[core.ID]bool{},
+	}
+
+	// The request's context can't be relied on once the connection has been
+	// hijacked, so it's canceled when reading from the socket fails instead,
+	// which is how a closed socket is noticed
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		wc.readLoop(ctx)
+	}()
+
+	wc.sendLoop(ctx, deadline, q.Get("consumer"))
+	cancel()
+	conn.Close()
+	wc.nackInFlight()
+}
+
+func (wc *wsConn) write(res WSResponse) error {
+	wc.writeL.Lock()
+	defer wc.writeL.Unlock()
+	return wc.conn.WriteJSON(res)
+}
+
+func (wc *wsConn) sendLoop(ctx context.Context, deadline time.Duration, consumerID string) {
+	for {
+		select {
+		case wc.slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		now := time.Now()
+		e, err := wc.p.QGet(ctx, peel.QGetCommand{
+			Queue:         wc.queue,
+			ConsumerGroup: wc.cgroup,
+			AckDeadline:   now.Add(deadline),
+			BlockUntil:    now.Add(wsBlock),
+			ConsumerID:    consumerID,
+		})
+		if err == peel.ErrDraining {
+			// No more events will be sent, but the socket is kept open so
+			// that the ones which were can still be acked
+			wc.write(WSResponse{Error: err.Error()})
+			<-ctx.Done()
+			return
+		} else if err != nil {
+			if ctx.Err() == nil {
+				wc.write(WSResponse{Error: err.Error()})
+			}
+			return
+		} else if ctx.Err() != nil {
+			return
+		} else if (e == core.Event{}) {
+			<-wc.slots
+			continue
+		}
+
+		wc.inFlightL.Lock()
+		wc.inFlight[e.ID] = true
+		wc.inFlightL.Unlock()
+
+		ret := eventJSON(e)
+		if err := wc.write(WSResponse{Event: &ret}); err != nil {
+			return
+		}
+	}
+}
+
+func (wc *wsConn) readLoop(ctx context.Context) {
+	for {
+		var req WSRequest
+		err := wc.conn.ReadJSON(&req)
+		switch err.(type) {
+		case nil:
+		case *json.SyntaxError, *json.UnmarshalTypeError:
+			// The message was malformed, but the socket is still usable
+			if wc.write(WSResponse{Error: err.Error()}) != nil {
+				return
+			}
+			continue
+		default:
+			// A message which ends part way through its JSON is malformed
+			// too. If the socket was actually closed part way through a
+			// message then the next read will fail as well.
+			if err == io.ErrUnexpectedEOF && wc.write(WSResponse{Error: err.Error()}) == nil {
+				continue
+			}
+			return
+		}
+
+		res, err := wc.handle(ctx, req)
+		if err != nil {
+			res.Error = err.Error()
+		}
+		if wc.write(res) != nil {
+			return
+		}
+	}
+}
+
+func (wc *wsConn) handle(ctx context.Context, req WSRequest) (WSResponse, error) {
+	var res WSResponse
+	idStr := req.Ack
+	if idStr == "" {
+		idStr = req.Nack
+	}
+	if idStr == "" {
+		return res, errors.New("one of ack or nack must be set")
+	}
+	res.ID = idStr
+
+	id, err := core.IDFromString(idStr)
+	if err != nil {
+		return res, err
+	}
+
+	if req.Ack != "" {
+		res.OK, err = wc.p.QAck(ctx, peel.QAckCommand{
+			Queue:         wc.queue,
+			ConsumerGroup: wc.cgroup,
+			EventID:       id,
+			Result:        req.Result,
+			DeliveryToken: req.DeliveryToken,
+		})
+	} else {
+		res.OK, err = wc.p.QNack(ctx, peel.QNackCommand{
+			Queue:         wc.queue,
+			ConsumerGroup: wc.cgroup,
+			EventID:       id,
+			DeliveryToken: req.DeliveryToken,
+			Error:         req.Error,
+		})
+	}
+	if err != nil {
+		return res, err
+	}
+
+	// Whether or not the ack or nack succeeded the event isn't in flight
+	// anymore
+	wc.inFlightL.Lock()
+	if wc.inFlight[id] {
+		delete(wc.inFlight, id)
+		<-wc.slots
+	}
+	wc.inFlightL.Unlock()
+	return res, nil
+}
+
+// nackInFlight nacks all events which were sent but never acked or nacked
+func (wc *wsConn) nackInFlight() {
+	wc.inFlightL.Lock()
+	defer wc.inFlightL.Unlock()
+	for id := range wc.inFlight {
+		// There's nothing to be done about an error here, the event will be
+		// retried once its deadline passes anyway
+		wc.p.QNack(context.Background(), peel.QNackCommand{
+			Queue:         wc.queue,
+			ConsumerGroup: wc.cgroup,
+			EventID:       id,
+		})
+	}
+	wc.inFlight = map[core.ID]bool{}
+}
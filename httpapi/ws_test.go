@@ -0,0 +1,86 @@
+package httpapi
+
+import (
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWS(t *T) {
+	srv := newTestServer()
+	defer srv.Close()
+	queue, group := testutil.RandStr(), testutil.RandStr()
+	queueURL := srv.URL + "/queues/" + queue
+	groupURL := queueURL + "/groups/" + group
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		var addResp AddResponse
+		code := do(t, "POST", queueURL, AddRequest{Contents: testutil.RandStr(), Expire: 60}, &addResp)
+		require.Equal(t, 200, code)
+		ids = append(ids, addResp.ID)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(groupURL, "http") + "/ws?prefetch=2"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.Nil(t, err)
+
+	read := func() WSResponse {
+		var res WSResponse
+		require.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		require.Nil(t, conn.ReadJSON(&res))
+		return res
+	}
+
+	// Only two events are sent until one of them is acked
+	assert.Equal(t, ids[0], read().Event.ID)
+	assert.Equal(t, ids[1], read().Event.ID)
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	var res WSResponse
+	assert.NotNil(t, conn.ReadJSON(&res))
+
+	// A timed out read leaves the connection unusable, so start a new one. The
+	// first one's events are nacked when it's closed, so they're sent again
+	// before the third.
+	conn.Close()
+	for start := time.Now(); ; {
+		var status map[string]QueueStatus
+		require.Equal(t, 200, do(t, "GET", srv.URL+"/status?queue="+queue, nil, &status))
+		if status[queue].ConsumerGroups[group].Redo == 2 {
+			break
+		}
+		require.True(t, time.Since(start) < time.Second, "events weren't nacked")
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, _, err = websocket.DefaultDialer.Dial(wsURL, nil)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	e0, e1 := read().Event, read().Event
+	assert.ElementsMatch(t, ids[:2], []string{e0.ID, e1.ID})
+
+	require.Nil(t, conn.WriteJSON(WSRequest{Ack: e0.ID}))
+	var gotAck, gotEvent bool
+	for i := 0; i < 2; i++ {
+		res := read()
+		if res.Event != nil {
+			assert.Equal(t, ids[2], res.Event.ID)
+			gotEvent = true
+		} else {
+			assert.Equal(t, WSResponse{ID: e0.ID, OK: true}, res)
+			gotAck = true
+		}
+	}
+	assert.True(t, gotAck)
+	assert.True(t, gotEvent)
+
+	require.Nil(t, conn.WriteJSON(WSRequest{Nack: "foo"}))
+	assert.NotEmpty(t, read().Error)
+	require.Nil(t, conn.WriteMessage(websocket.TextMessage, []byte("{")))
+	assert.NotEmpty(t, read().Error)
+}
@@ -1,23 +1,45 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/levenlabs/go-llog"
-	"github.com/levenlabs/golib/radixutil"
+	"github.com/levenlabs/go-srvclient"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/grpcapi"
+	"github.com/mediocregopher/bananaq/httpapi"
 	"github.com/mediocregopher/bananaq/peel"
+	"github.com/mediocregopher/bananaq/peel/prommetrics"
+	"github.com/mediocregopher/bananaq/peel/webhook"
+	"github.com/mediocregopher/bananaq/sqsapi"
 	"github.com/mediocregopher/lever"
 	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/mediocregopher/radix.v2/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 // TODO go through and make sure "okq" is completely gone
 // TODO metalint everything
 
 var p *peel.Peel
+var acl *peel.ACL
 var bgQAddCh chan peel.QAddCommand
 
 func main() {
@@ -27,21 +49,196 @@ func main() {
 		Description: "Address to listen for client connections on",
 		Default:     ":5777",
 	})
+	l.Add(lever.Param{
+		Name:        "--http-listen-addr",
+		Description: "Address to serve the HTTP/JSON API on. If not set the HTTP API is disabled",
+	})
+	l.Add(lever.Param{
+		Name:        "--sqs-listen-addr",
+		Description: "Address to serve the SQS-compatible API on. If not set the SQS API is disabled",
+	})
+	l.Add(lever.Param{
+		Name:        "--grpc-listen-addr",
+		Description: "Address to serve the gRPC API on. If not set the gRPC API is disabled",
+	})
+	l.Add(lever.Param{
+		Name:        "--metrics-listen-addr",
+		Description: "Address to serve prometheus metrics on, at /metrics, as well as health checks at /health. If not set metrics are disabled",
+	})
+	l.Add(lever.Param{
+		Name:        "--acl-file",
+		Description: "JSON file of the identities clients must authenticate as, and the rights each has to which queues. If not set clients aren't authenticated",
+	})
+	l.Add(lever.Param{
+		Name:        "--tls-cert",
+		Description: "Certificate file to serve client connections, and the HTTP and gRPC APIs, over TLS with. Requires --tls-key",
+	})
+	l.Add(lever.Param{
+		Name:        "--tls-key",
+		Description: "Key file for --tls-cert",
+	})
+	l.Add(lever.Param{
+		Name:        "--tls-client-ca",
+		Description: "CA certificate file to verify client certificates with. Clients whose certificates are verified are authenticated as the identity named by their subject's common name. Requires --tls-cert",
+	})
 	l.Add(lever.Param{
 		Name:        "--redis-addr",
 		Description: "Address redis is listening on. May be a solo redis instance or a node in a cluster",
 		Default:     "127.0.0.1:6379",
 	})
+	l.Add(lever.Param{
+		Name:        "--redis-sentinel-addrs",
+		Description: "Comma separated addresses of redis sentinel instances. If set these are used to find the current redis master, which is followed across failovers, and --redis-addr is ignored",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-sentinel-master",
+		Description: "Name of the master to use when --redis-sentinel-addrs is set",
+		Default:     "mymaster",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-tls",
+		Description: "Connect to redis using TLS",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-tls-server-name",
+		Description: "Name to verify redis' TLS certificate against. Defaults to the host in --redis-addr, which won't work for other nodes in a cluster or when using sentinel if they're addressed by IP",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-username",
+		Description: "Username to authenticate to redis with. Requires --redis-password and redis 6 or later",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-password",
+		Description: "Password to authenticate to redis with",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-db",
+		Description: "Redis database to use. Must be 0 when using a cluster",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-timeout",
+		Description: "Number of seconds to wait when connecting to redis, and for each command sent to it. 0 means no timeout",
+		Default:     "5",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-retries",
+		Description: "Number of times to retry each command sent to redis which fails because of a transient error, e.g. a dropped connection or a failover. Commands which may already have been performed are only retried if doing so is safe. 0 means no retries",
+		Default:     "3",
+	})
 	l.Add(lever.Param{
 		Name:        "--redis-pool-size",
 		Description: "Size of the pool of idle connections to keep for redis. If a cluster is used, this many connections will be kept to each member of the cluster",
 		Default:     "10",
 	})
+	l.Add(lever.Param{
+		Name:        "--redis-pool-max-active",
+		Description: "Most connections to redis which may be in use at once. Once this many are, commands wait for one to become free. 0 means no limit. Ignored if a cluster or sentinel is used",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-pool-wait-timeout",
+		Description: "Seconds a command waits for a free connection when --redis-pool-max-active are in use, before failing. 0 means it waits indefinitely",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-pool-max-idle-time",
+		Description: "Seconds a pooled connection to redis may be idle before it's closed. 0 means never. Ignored if a cluster or sentinel is used",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-pool-max-lifetime",
+		Description: "Seconds after which a pooled connection to redis is closed rather than reused. 0 means never. Ignored if a cluster or sentinel is used",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-prefix",
+		Description: "String to prefix all redis keys with. Deployments using the same redis must use different prefixes if they shouldn't share queues",
+		Default:     "bananaq",
+	})
+	l.Add(lever.Param{
+		Name:        "--migrate-to-redis-addr",
+		Description: "Address of a redis which queues are being migrated to, using the same options as --redis-addr. Events added to queues being migrated are added to it too, and queues which have been cut over are used from it. See bananaq-cli's migrate command",
+	})
+	l.Add(lever.Param{
+		Name:        "--mem",
+		Description: "Keep all data in this process' memory instead of in redis, ignoring all --redis-* options. Meant for development and testing, everything is lost when the process exits",
+		Flag:        true,
+	})
 	l.Add(lever.Param{
 		Name:        "--log-level",
 		Description: "Log level to run with. Can be debug, info, warn, error, fatal",
 		Default:     "info",
 	})
+	l.Add(lever.Param{
+		Name:        "--max-deliveries",
+		Description: "Number of times a consumer group may retrieve an event with a deadline before it gives up and moves the event to the group's dead set. 0 means no limit",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--require-delivery-tokens",
+		Description: "Make QACK, QNACK and QEXTEND fail unless they're given the delivery token which QGET returned for the event, so that a consumer which missed its deadline can never act on the event's next delivery",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--dedup-window",
+		Description: "Number of seconds after an event is added with DEDUP during which other events with the same DEDUP key will be ignored",
+		Default:     "300",
+	})
+	l.Add(lever.Param{
+		Name:        "--event-padding",
+		Description: "Number of seconds an event's contents are kept for after it expires, in case a consumer retrieves it just as it expires. May be overridden for individual events using PADDING",
+		Default:     "30",
+	})
+	l.Add(lever.Param{
+		Name:        "--max-contents-size",
+		Description: "Maximum size, in bytes, of an event's contents. Adding an event with larger contents returns an error. 0 means no limit",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--compress-threshold",
+		Description: "Size, in bytes, at or above which events' contents are gzip compressed before being stored in redis. 0 means contents are never compressed",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--encryption-key",
+		Description: "Hex encoded AES key, 16, 24 or 32 bytes long. If set events' contents are encrypted with it using AES-GCM before being stored in redis",
+	})
+	l.Add(lever.Param{
+		Name:        "--event-cache-size",
+		Description: "Number of recently retrieved events to keep in memory, so that retrieving them again doesn't require fetching their contents from redis. 0 disables the cache",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--event-cache-ttl",
+		Description: "Maximum number of seconds an event is kept in the event cache for. Events are never kept past their expiration",
+		Default:     "60",
+	})
+	l.Add(lever.Param{
+		Name:        "--clean-period",
+		Description: "Number of seconds between cleanups of expired events and events which missed their deadline. Only one of the instances sharing a redis does this each period. -1 disables automatic cleanup",
+		Default:     "60",
+	})
+	l.Add(lever.Param{
+		Name:        "--redo-sweep-period",
+		Description: "Number of seconds between sweeps which make events that missed their deadline available again. 0 means they're only swept up every minute, along with other cleanup",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--consumer-ttl",
+		Description: "Number of seconds a consumer is listed by QCONSUMERS for after it last retrieved events with CONSUMER",
+		Default:     "60",
+	})
+	l.Add(lever.Param{
+		Name:        "--drain-timeout",
+		Description: "Number of seconds to wait, on SIGTERM or SIGINT, for events which were retrieved with a deadline to be acked before exiting. Events which still haven't been are made available to be retrieved again",
+		Default:     "30",
+	})
+	l.Add(lever.Param{
+		Name:        "--webhook",
+		Description: "POST every event in a queue to a URL, given as queue,name,url[,secret]. name is the consumer group used. Can be given more than once",
+	})
 	l.Add(lever.Param{
 		Name:        "--bg-qadd-pool-size",
 		Description: "Number of goroutines to have processing NOBLOCK QADD commands",
@@ -50,26 +247,203 @@ func main() {
 	l.Parse()
 
 	listenAddr, _ := l.ParamStr("--listen-addr")
+	httpListenAddr, _ := l.ParamStr("--http-listen-addr")
+	sqsListenAddr, _ := l.ParamStr("--sqs-listen-addr")
+	grpcListenAddr, _ := l.ParamStr("--grpc-listen-addr")
+	metricsListenAddr, _ := l.ParamStr("--metrics-listen-addr")
+	aclFile, _ := l.ParamStr("--acl-file")
+	tlsCert, _ := l.ParamStr("--tls-cert")
+	tlsKey, _ := l.ParamStr("--tls-key")
+	tlsClientCA, _ := l.ParamStr("--tls-client-ca")
 	redisAddr, _ := l.ParamStr("--redis-addr")
+	redisSentinelAddrs, _ := l.ParamStr("--redis-sentinel-addrs")
+	redisSentinelMaster, _ := l.ParamStr("--redis-sentinel-master")
+	redisTLS := l.ParamFlag("--redis-tls")
+	redisTLSServerName, _ := l.ParamStr("--redis-tls-server-name")
+	redisUsername, _ := l.ParamStr("--redis-username")
+	redisPassword, _ := l.ParamStr("--redis-password")
+	redisDB, _ := l.ParamInt("--redis-db")
+	redisTimeout, _ := l.ParamInt("--redis-timeout")
+	redisRetries, _ := l.ParamInt("--redis-retries")
 	redisPoolSize, _ := l.ParamInt("--redis-pool-size")
+	redisPoolMaxActive, _ := l.ParamInt("--redis-pool-max-active")
+	redisPoolWaitTimeout, _ := l.ParamInt("--redis-pool-wait-timeout")
+	redisPoolMaxIdleTime, _ := l.ParamInt("--redis-pool-max-idle-time")
+	redisPoolMaxLifetime, _ := l.ParamInt("--redis-pool-max-lifetime")
+	redisPrefix, _ := l.ParamStr("--redis-prefix")
+	migrateToRedisAddr, _ := l.ParamStr("--migrate-to-redis-addr")
+	mem := l.ParamFlag("--mem")
 	logLevel, _ := l.ParamStr("--log-level")
+	maxDeliveries, _ := l.ParamInt("--max-deliveries")
+	requireDeliveryTokens := l.ParamFlag("--require-delivery-tokens")
+	dedupWindow, _ := l.ParamInt("--dedup-window")
+	eventPadding, _ := l.ParamInt("--event-padding")
+	maxContentsSize, _ := l.ParamInt("--max-contents-size")
+	compressThreshold, _ := l.ParamInt("--compress-threshold")
+	encryptionKey, _ := l.ParamStr("--encryption-key")
+	eventCacheSize, _ := l.ParamInt("--event-cache-size")
+	eventCacheTTL, _ := l.ParamInt("--event-cache-ttl")
+	cleanPeriod, _ := l.ParamInt("--clean-period")
+	redoSweepPeriod, _ := l.ParamInt("--redo-sweep-period")
+	consumerTTL, _ := l.ParamInt("--consumer-ttl")
+	drainTimeout, _ := l.ParamInt("--drain-timeout")
 	bgQAddPoolSize, _ := l.ParamInt("--bg-qadd-pool-size")
+	webhooks, _ := l.ParamStrs("--webhook")
 
 	llog.SetLevelFromString(logLevel)
 
+	var serverTLS *tls.Config
+	if tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			llog.Fatal("could not load --tls-cert and --tls-key", llog.KV{"err": err})
+		}
+		serverTLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		if tlsClientCA != "" {
+			pem, err := os.ReadFile(tlsClientCA)
+			if err != nil {
+				llog.Fatal("could not read --tls-client-ca", llog.KV{"err": err})
+			}
+			serverTLS.ClientCAs = x509.NewCertPool()
+			if !serverTLS.ClientCAs.AppendCertsFromPEM(pem) {
+				llog.Fatal("no certificates found in --tls-client-ca")
+			}
+			serverTLS.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	} else if tlsClientCA != "" {
+		llog.Fatal("--tls-client-ca requires --tls-cert")
+	}
+
+	if aclFile != "" {
+		kv := llog.KV{"aclFile": aclFile}
+		f, err := os.Open(aclFile)
+		if err != nil {
+			llog.Fatal("could not open --acl-file", kv.Set("err", err))
+		}
+		acl, err = peel.ParseACL(f)
+		f.Close()
+		if err != nil {
+			llog.Fatal("invalid --acl-file", kv.Set("err", err))
+		} else if sqsListenAddr != "" {
+			llog.Fatal("--sqs-listen-addr can't be used with --acl-file, since the SQS API doesn't authenticate clients", kv)
+		}
+	}
+
+	var metrics *prommetrics.Collector
+	if metricsListenAddr != "" {
+		metrics = prommetrics.New()
+	}
+
 	// Set up redis/peel
 	{
-		kv := llog.KV{
-			"redisAddr":     redisAddr,
-			"redisPoolSize": redisPoolSize,
+		peelOpts := &peel.Opts{
+			MaxDeliveries:         maxDeliveries,
+			RequireDeliveryTokens: requireDeliveryTokens,
+			DedupWindow:           time.Duration(dedupWindow) * time.Second,
+			CleanPeriod:           time.Duration(cleanPeriod) * time.Second,
+			RedoSweepPeriod:       time.Duration(redoSweepPeriod) * time.Second,
+			EventPadding:          time.Duration(eventPadding) * time.Second,
+			MaxContentsSize:       maxContentsSize,
+			CompressThreshold:     compressThreshold,
+			EventCacheSize:        eventCacheSize,
+			EventCacheTTL:         time.Duration(eventCacheTTL) * time.Second,
+			ConsumerTTL:           time.Duration(consumerTTL) * time.Second,
+			Logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+				Level: slogLevel(logLevel),
+			})),
 		}
-		llog.Info("connecting to redis", kv)
-		cmder, err := radixutil.DialMaybeCluster("tcp", redisAddr, redisPoolSize)
-		if err != nil {
-			llog.Fatal("could not connect to redis", kv.Set("err", err))
+		if metrics != nil {
+			peelOpts.Hook = metrics
+		}
+		if encryptionKey != "" {
+			key, err := hex.DecodeString(encryptionKey)
+			if err != nil {
+				llog.Fatal("could not decode --encryption-key", llog.KV{"err": err})
+			}
+			if peelOpts.Encrypter, err = peel.NewAESGCMEncrypter(key); err != nil {
+				llog.Fatal("invalid --encryption-key", llog.KV{"err": err})
+			}
+		}
+
+		var kv llog.KV
+		if mem {
+			kv = llog.KV{"mem": true}
+			llog.Info("keeping data in memory", kv)
+			p = peel.NewWithBackend(core.NewMemBackend(), peelOpts)
+		} else {
+			kv = llog.KV{
+				"redisAddr":     redisAddr,
+				"redisPoolSize": redisPoolSize,
+			}
+			if strings.ContainsAny(redisPrefix, "{}") {
+				llog.Fatal("--redis-prefix may not contain '{' or '}'", kv)
+			}
+			dialOpts := core.DialOpts{
+				Username:     redisUsername,
+				Password:     redisPassword,
+				DB:           redisDB,
+				DialTimeout:  time.Duration(redisTimeout) * time.Second,
+				ReadTimeout:  time.Duration(redisTimeout) * time.Second,
+				WriteTimeout: time.Duration(redisTimeout) * time.Second,
+				Pool: core.PoolOpts{
+					MaxActive:   redisPoolMaxActive,
+					WaitTimeout: time.Duration(redisPoolWaitTimeout) * time.Second,
+					MaxIdleTime: time.Duration(redisPoolMaxIdleTime) * time.Second,
+					MaxLifetime: time.Duration(redisPoolMaxLifetime) * time.Second,
+				},
+			}
+			if redisTLS {
+				dialOpts.TLSConfig = &tls.Config{ServerName: redisTLSServerName}
+			}
+
+			var cmder util.Cmder
+			var err error
+			if redisSentinelAddrs != "" {
+				kv = llog.KV{
+					"redisSentinelAddrs":  redisSentinelAddrs,
+					"redisSentinelMaster": redisSentinelMaster,
+					"redisPoolSize":       redisPoolSize,
+				}
+				llog.Info("connecting to redis via sentinel", kv)
+				addrs := strings.Split(redisSentinelAddrs, ",")
+				cmder, err = core.NewSentinel(addrs, redisPoolSize, redisSentinelMaster, dialOpts)
+			} else {
+				llog.Info("connecting to redis", kv)
+				addr := srvclient.DefaultSRVClient.MaybeSRV(redisAddr)
+				cmder, err = core.Dial(addr, redisPoolSize, dialOpts)
+			}
+			if err != nil {
+				llog.Fatal("could not connect to redis", kv.Set("err", err))
+			}
+
+			peelOpts.RedisPrefix = redisPrefix
+			peelOpts.DialOpts = dialOpts
+			if redisRetries > 0 {
+				peelOpts.Retry = &core.RetryPolicy{MaxRetries: redisRetries}
+			}
+
+			if migrateToRedisAddr != "" {
+				mkv := llog.KV{"migrateToRedisAddr": migrateToRedisAddr}
+				llog.Info("connecting to redis being migrated to", mkv)
+				addr := srvclient.DefaultSRVClient.MaybeSRV(migrateToRedisAddr)
+				targetCmder, err := core.Dial(addr, redisPoolSize, dialOpts)
+				if err != nil {
+					llog.Fatal("could not connect to redis being migrated to", mkv.Set("err", err))
+				}
+				targetOpts := *peelOpts
+				target := peel.New(targetCmder, &targetOpts)
+				go func() {
+					for {
+						err := <-target.Run(nil)
+						llog.Error("error during migration target peel runtime", mkv.Set("err", err))
+						time.Sleep(500 * time.Millisecond)
+					}
+				}()
+				peelOpts.MigrationTarget = target
+			}
+			p = peel.New(cmder, peelOpts)
 		}
 
-		p := peel.New(cmder, nil)
 		go func() {
 			for {
 				err := <-p.Run(nil)
@@ -93,7 +467,7 @@ func main() {
 				for qadd := range bgQAddCh {
 					qkv := llog.KV{"queue": qadd.Queue}
 					llog.Debug("bg qadd", kv, qkv)
-					if ret, err := p.QAdd(qadd); err != nil {
+					if ret, err := p.QAdd(context.Background(), qadd); err != nil {
 						llog.Error("error doing background qadd", kv, qkv, llog.KV{"err": err})
 					} else {
 						llog.Debug("bg qadd ret", kv, qkv, llog.KV{"ret": ret})
@@ -112,6 +486,9 @@ func main() {
 		if err != nil {
 			llog.Fatal("error listening", kv, llog.KV{"err": err})
 		}
+		if serverTLS != nil {
+			server = tls.NewListener(server, serverTLS)
+		}
 
 		go func() {
 			for {
@@ -125,9 +502,120 @@ func main() {
 		}()
 	}
 
+	if httpListenAddr != "" {
+		kv := llog.KV{"httpListenAddr": httpListenAddr}
+		llog.Info("starting http listen", kv)
+		srv := &http.Server{
+			Addr:      httpListenAddr,
+			Handler:   httpapi.NewWithACL(p, acl),
+			TLSConfig: serverTLS,
+		}
+		go func() {
+			var err error
+			if serverTLS != nil {
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				err = srv.ListenAndServe()
+			}
+			llog.Fatal("error serving http", kv, llog.KV{"err": err})
+		}()
+	}
+
+	if sqsListenAddr != "" {
+		kv := llog.KV{"sqsListenAddr": sqsListenAddr}
+		llog.Info("starting sqs listen", kv)
+		go func() {
+			err := http.ListenAndServe(sqsListenAddr, sqsapi.New(p))
+			llog.Fatal("error serving sqs", kv, llog.KV{"err": err})
+		}()
+	}
+
+	if metrics != nil {
+		metrics.SetPeel(p)
+		prometheus.MustRegister(metrics)
+		kv := llog.KV{"metricsListenAddr": metricsListenAddr}
+		llog.Info("starting metrics listen", kv)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.Handle("/health", httpapi.NewHealthHandler(p))
+		go func() {
+			err := http.ListenAndServe(metricsListenAddr, mux)
+			llog.Fatal("error serving metrics", kv, llog.KV{"err": err})
+		}()
+	}
+
+	if grpcListenAddr != "" {
+		kv := llog.KV{"grpcListenAddr": grpcListenAddr}
+		llog.Info("starting grpc listen", kv)
+		server, err := net.Listen("tcp", grpcListenAddr)
+		if err != nil {
+			llog.Fatal("error listening", kv, llog.KV{"err": err})
+		}
+		var opts []grpc.ServerOption
+		if serverTLS != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(serverTLS)))
+		}
+		srv := grpc.NewServer(opts...)
+		grpcapi.RegisterBananaqServer(srv, grpcapi.NewWithACL(p, acl))
+		go func() {
+			err := srv.Serve(server)
+			llog.Fatal("error serving grpc", kv, llog.KV{"err": err})
+		}()
+	}
+
+	if len(webhooks) > 0 {
+		var queues []string
+		endpoints := map[string][]webhook.Endpoint{}
+		for _, wh := range webhooks {
+			parts := strings.SplitN(wh, ",", 4)
+			if len(parts) < 3 {
+				llog.Fatal("--webhook must be given as queue,name,url[,secret]", llog.KV{"webhook": wh})
+			}
+			ep := webhook.Endpoint{Name: parts[1], URL: parts[2]}
+			if len(parts) == 4 {
+				ep.Secret = parts[3]
+			}
+			if _, ok := endpoints[parts[0]]; !ok {
+				queues = append(queues, parts[0])
+			}
+			endpoints[parts[0]] = append(endpoints[parts[0]], ep)
+		}
+
+		for _, queue := range queues {
+			kv := llog.KV{"queue": queue}
+			llog.Info("starting webhook dispatcher", kv)
+			d := webhook.Dispatcher{
+				Peel:      p,
+				Queue:     queue,
+				Endpoints: endpoints[queue],
+				OnError: func(err error) {
+					llog.Warn("webhook error", kv, llog.KV{"err": err})
+				},
+			}
+			go func() {
+				if err := d.Run(context.Background()); err != nil {
+					llog.Fatal("invalid --webhook", kv, llog.KV{"err": err})
+				}
+			}()
+		}
+	}
+
 	llog.Info("ready, set, go!")
-	select {}
 
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, os.Interrupt)
+	sig := <-sigCh
+
+	// Connections are left open while draining so that events which were
+	// already retrieved can still be acked, but no more can be retrieved
+	kv := llog.KV{"signal": sig.String(), "drainTimeout": drainTimeout}
+	llog.Info("draining", kv)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(drainTimeout)*time.Second)
+	defer cancel()
+	if err := p.Drain(ctx); err != nil {
+		llog.Warn("timed out waiting for events to be acked", kv)
+	}
+	llog.Info("drained, exiting", kv)
 }
 
 func serveConn(conn net.Conn) {
@@ -138,49 +626,63 @@ func serveConn(conn net.Conn) {
 
 	llog.Debug("client connected", kv)
 
-	var cmd string
-	var args []string
-
-	readCmd := func() (string, []string, error) {
-		m := rr.Read()
-		if m.IsType(redis.IOErr) {
-			return "", nil, m.Err
-		}
+	writeErr := func(err error) {
+		redis.NewResp(fmt.Errorf("ERR %s", err)).WriteTo(conn)
+	}
 
-		parts, err := m.Array()
-		if err != nil {
-			return "", nil, fmt.Errorf("invalid command: %s", err)
+	// Clients with a verified TLS certificate are authenticated straight away,
+	// others have to use AUTH
+	ctx := context.Background()
+	if tc, ok := conn.(*tls.Conn); ok && acl != nil {
+		if err := tc.Handshake(); err != nil {
+			llog.Warn("client TLS handshake error", kv.Set("err", err))
+			conn.Close()
+			return
 		}
-		args = args[:0]
-		for i := range parts {
-			val, err := parts[i].Str()
-			if err != nil {
-				return "", nil, fmt.Errorf("invalid command: %s", err)
-			}
-			if i == 0 {
-				cmd = val
-			} else {
-				args = append(args, val)
-			}
+		if id, err := acl.ByTLS(tc.ConnectionState()); err == nil {
+			kv = kv.Set("identity", id.Name)
+			ctx = peel.WithIdentity(ctx, id)
 		}
-		return strings.ToUpper(cmd), args, nil
-	}
-
-	writeErr := func(err error) {
-		redis.NewResp(fmt.Errorf("ERR %s", err)).WriteTo(conn)
 	}
 
 	for {
-		cmd, args, err := readCmd()
-		if nerr, ok := err.(*net.OpError); ok && nerr.Timeout() {
-			continue
-		} else if err == io.EOF {
-			llog.Debug("client disconnected", kv)
+		m := rr.Read()
+		if m.IsType(redis.IOErr) {
+			if nerr, ok := m.Err.(*net.OpError); ok && nerr.Timeout() {
+				continue
+			} else if m.Err == io.EOF {
+				llog.Debug("client disconnected", kv)
+			} else {
+				llog.Warn("client connection error", kv.Set("err", m.Err))
+			}
 			conn.Close()
 			return
-		} else if err != nil {
+		}
+
+		// The whole message has been read, so the connection can keep being
+		// used even if the command in it is invalid
+		cmd, args, err := parseCmd(m)
+		if err != nil {
 			llog.Warn("client error reading command", kv.Set("err", err))
 			writeErr(err)
+			continue
+		}
+
+		// AUTH changes the context later commands are dispatched with, and its
+		// arguments mustn't be logged
+		if cmd == "AUTH" {
+			var ret interface{}
+			ctx, ret = auth(ctx, args)
+			if rerr, ok := ret.(error); ok {
+				llog.Warn("client error authenticating", kv, llog.KV{"err": rerr})
+				writeErr(rerr)
+			} else {
+				id := peel.IdentityFrom(ctx)
+				kv = kv.Set("identity", id.Name)
+				llog.Debug("client authenticated", kv)
+				redis.NewResp(ret).WriteTo(conn)
+			}
+			continue
 		}
 
 		shortArgs := make([]string, len(args))
@@ -195,9 +697,8 @@ func serveConn(conn net.Conn) {
 		llog.Debug("client command", kv, cmdKV)
 
 		// ret may be an error if it's a client error (e.g. invalid params)
-		if ret, err := dispatch(cmd, args); err != nil {
+		if ret, err := dispatch(ctx, cmd, args); err != nil {
 			llog.Error("error dispatching command", kv, cmdKV, llog.KV{"err": err})
-			redis.NewResp(fmt.Errorf("server-side error: %s", err)).WriteTo(conn)
 			writeErr(fmt.Errorf("server-side error: %s", err))
 		} else if rerr, ok := ret.(error); ok {
 			llog.Warn("client error dispatching command", kv, cmdKV, llog.KV{"err": rerr})
@@ -208,3 +709,36 @@ func serveConn(conn net.Conn) {
 		}
 	}
 }
+
+// parseCmd returns the command and arguments from a message read off a client
+// connection, which should be an array of strings. The command is returned
+// upper-cased.
+func parseCmd(m *redis.Resp) (string, []string, error) {
+	parts, err := m.Array()
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid command: %s", err)
+	} else if len(parts) == 0 {
+		return "", nil, errors.New("invalid command: empty")
+	}
+
+	strs := make([]string, len(parts))
+	for i := range parts {
+		if strs[i], err = parts[i].Str(); err != nil {
+			return "", nil, fmt.Errorf("invalid command: %s", err)
+		}
+	}
+	return strings.ToUpper(strs[0]), strs[1:], nil
+}
+
+// slogLevel returns the slog.Level corresponding to the given --log-level
+func slogLevel(logLevel string) slog.Level {
+	if strings.ToLower(logLevel) == "fatal" {
+		// peel never logs anything this severe
+		return slog.LevelError + 4
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(logLevel)); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
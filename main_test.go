@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	. "testing"
+
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeConn(t *T) {
+	p = peel.NewWithBackend(core.NewMemBackend(), nil)
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		serveConn(server)
+		close(done)
+	}()
+
+	rr := redis.NewRespReader(client)
+	cmd := func(args ...interface{}) *redis.Resp {
+		_, err := redis.NewResp(args).WriteTo(client)
+		require.Nil(t, err)
+		return rr.Read()
+	}
+
+	m := cmd("ping")
+	str, err := m.Str()
+	require.Nil(t, err)
+	assert.Equal(t, "PONG", str)
+
+	// Invalid and unknown commands get an error, but the connection can still
+	// be used after them
+	assert.True(t, cmd().IsType(redis.AppErr))
+	assert.True(t, cmd([]string{"PING"}).IsType(redis.AppErr))
+	assert.True(t, cmd("QFOO").IsType(redis.AppErr))
+	assert.True(t, cmd("QADD", "foo").IsType(redis.AppErr))
+
+	m = cmd("QADD", "foo", "60", "bar")
+	require.Nil(t, m.Err)
+	_, err = m.Str()
+	assert.Nil(t, err)
+
+	client.Close()
+	<-done
+}
+
+func TestServeConnACL(t *T) {
+	p = peel.NewWithBackend(core.NewMemBackend(), nil)
+	var err error
+	acl, err = peel.NewACL([]peel.Identity{{
+		Name:  "foo",
+		Token: "secret",
+		Rules: []peel.ACLRule{{Queues: "foo.*", Rights: []peel.Right{peel.RightProduce}}},
+	}})
+	require.Nil(t, err)
+	defer func() { acl = nil }()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		serveConn(server)
+		close(done)
+	}()
+
+	rr := redis.NewRespReader(client)
+	cmd := func(args ...interface{}) *redis.Resp {
+		_, err := redis.NewResp(args).WriteTo(client)
+		require.Nil(t, err)
+		return rr.Read()
+	}
+
+	// PING doesn't need authenticating, but everything else does
+	assert.Nil(t, cmd("PING").Err)
+	assert.True(t, cmd("QADD", "foo.bar", "60", "baz").IsType(redis.AppErr))
+	assert.True(t, cmd("AUTH", "wrong").IsType(redis.AppErr))
+	assert.True(t, cmd("AUTH", "bar", "secret").IsType(redis.AppErr))
+	assert.Nil(t, cmd("AUTH", "foo", "secret").Err)
+
+	assert.Nil(t, cmd("QADD", "foo.bar", "60", "baz").Err)
+	assert.True(t, cmd("QADD", "bar", "60", "baz").IsType(redis.AppErr))
+	assert.True(t, cmd("QGET", "foo.bar", "group").IsType(redis.AppErr))
+	assert.True(t, cmd("QSTATUS").IsType(redis.AppErr))
+
+	client.Close()
+	<-done
+}
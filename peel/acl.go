@@ -0,0 +1,223 @@
+package peel
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+)
+
+// The servers in front of a Peel (the redis protocol, HTTP and gRPC ones) can
+// require their clients to authenticate, either with a token or with the
+// identity in their TLS client certificate, as one of the Identities in an ACL.
+// The server then checks the Identity has the Right it needs for each command
+// before performing it, using Authorize. Peel itself checks that Identities
+// given to it in a context, see WithIdentity, may produce to the queues it adds
+// events to, since QReply doesn't know which queue that is until the event
+// being replied to has been fetched. Commands from contexts without an
+// Identity aren't checked at all.
+
+// Right is something an Identity may be allowed to do to a queue
+type Right string
+
+// All possible Right values
+const (
+	// Adding events to the queue, and retrieving their results
+	RightProduce Right = "produce"
+
+	// Retrieving, acknowledging and inspecting the queue's events
+	RightConsume Right = "consume"
+
+	// Everything else, e.g. configuring, pausing or flushing the queue, or
+	// redriving its dead events. Implies the other Rights.
+	RightAdmin Right = "admin"
+)
+
+// ErrUnauthenticated is returned by Authorize when there's no Identity in the
+// context, and from ACL when a token or name isn't one of its Identities
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// ForbiddenError is returned by Authorize when the Identity doesn't have the
+// Right needed for a command
+type ForbiddenError struct {
+	Identity string
+	Right    Right
+
+	// The queue the Right was needed for, or "" if it was needed for all of
+	// them
+	Queue string
+}
+
+func (fe *ForbiddenError) Error() string {
+	if fe.Queue == "" {
+		return fmt.Sprintf("%q may not %s all queues", fe.Identity, fe.Right)
+	}
+	return fmt.Sprintf("%q may not %s queue %q", fe.Identity, fe.Right, fe.Queue)
+}
+
+// ACLRule grants Rights to the queues whose names match a pattern
+type ACLRule struct {
+	// A pattern as used by path.Match, e.g. "team-a.*" or "*"
+	Queues string  `json:"queues"`
+	Rights []Right `json:"rights"`
+}
+
+// Identity is a client which can be authenticated, and the Rights it has
+type Identity struct {
+	// Required. Also the name which clients authenticating with a TLS client
+	// certificate must have as its subject's common name.
+	Name string `json:"name"`
+
+	// Optional. If set clients may authenticate as the Identity by giving it.
+	Token string `json:"token,omitempty"`
+
+	Rules []ACLRule `json:"rules"`
+}
+
+// Allowed returns whether the Identity has the Right for the queue. If queue is
+// "" it returns whether it has the Right for every queue, which only rules
+// whose Queues is "*" grant.
+func (id *Identity) Allowed(right Right, queue string) bool {
+	for _, r := range id.Rules {
+		if queue == "" && r.Queues != "*" {
+			continue
+		} else if ok, _ := path.Match(r.Queues, queue); queue != "" && !ok {
+			continue
+		}
+		for _, rr := range r.Rights {
+			if rr == right || rr == RightAdmin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ACL holds the Identities which clients may authenticate as
+type ACL struct {
+	byToken, byName map[string]*Identity
+}
+
+// NewACL returns an ACL of the given Identities, returning an error if any of
+// them are invalid or have the same Name or Token
+func NewACL(ii []Identity) (*ACL, error) {
+	a := &ACL{byToken: map[string]*Identity{}, byName: map[string]*Identity{}}
+	for i := range ii {
+		id := &ii[i]
+		if id.Name == "" {
+			return nil, errors.New("identity has no name")
+		} else if a.byName[id.Name] != nil {
+			return nil, fmt.Errorf("identity %q given more than once", id.Name)
+		} else if id.Token != "" && a.byToken[id.Token] != nil {
+			return nil, fmt.Errorf("identity %q has the same token as %q", id.Name, a.byToken[id.Token].Name)
+		}
+		for _, r := range id.Rules {
+			if _, err := path.Match(r.Queues, ""); err != nil {
+				return nil, fmt.Errorf("identity %q has invalid queues pattern %q", id.Name, r.Queues)
+			}
+			for _, rr := range r.Rights {
+				switch rr {
+				case RightProduce, RightConsume, RightAdmin:
+				default:
+					return nil, fmt.Errorf("identity %q has unknown right %q", id.Name, rr)
+				}
+			}
+		}
+
+		a.byName[id.Name] = id
+		if id.Token != "" {
+			a.byToken[id.Token] = id
+		}
+	}
+	return a, nil
+}
+
+// ParseACL reads an ACL from JSON of the form:
+//
+//	{"identities": [
+//		{
+//			"name": "team-a",
+//			"token": "secret",
+//			"rules": [{"queues": "team-a.*", "rights": ["produce", "consume"]}]
+//		}
+//	]}
+func ParseACL(r io.Reader) (*ACL, error) {
+	var f struct {
+		Identities []Identity `json:"identities"`
+	}
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, fmt.Errorf("decoding ACL: %w", err)
+	}
+	return NewACL(f.Identities)
+}
+
+// ByToken returns the Identity with the given Token, or ErrUnauthenticated
+func (a *ACL) ByToken(token string) (*Identity, error) {
+	if id := a.byToken[token]; token != "" && id != nil {
+		return id, nil
+	}
+	return nil, ErrUnauthenticated
+}
+
+// ByName returns the Identity with the given Name, or ErrUnauthenticated
+func (a *ACL) ByName(name string) (*Identity, error) {
+	if id := a.byName[name]; id != nil {
+		return id, nil
+	}
+	return nil, ErrUnauthenticated
+}
+
+// ByTLS returns the Identity named by the common name of the subject of the
+// client certificate in the given TLS connection, or ErrUnauthenticated if
+// there is no such Identity or the certificate wasn't verified
+func (a *ACL) ByTLS(cs tls.ConnectionState) (*Identity, error) {
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return nil, ErrUnauthenticated
+	}
+	return a.ByName(cs.VerifiedChains[0][0].Subject.CommonName)
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a context which the given Identity has been
+// authenticated in, see Authorize
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFrom returns the Identity which was authenticated in the context, or
+// nil if none was
+func IdentityFrom(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+// Authorize returns nil if the Identity in the context has the Right for all of
+// the given queues, or for every queue if none are given. Otherwise it returns
+// ErrUnauthenticated if there is no Identity, or a *ForbiddenError.
+func Authorize(ctx context.Context, right Right, queues ...string) error {
+	id := IdentityFrom(ctx)
+	if id == nil {
+		return ErrUnauthenticated
+	}
+	if len(queues) == 0 {
+		queues = []string{""}
+	}
+	for _, q := range queues {
+		if !id.Allowed(right, q) {
+			return &ForbiddenError{Identity: id.Name, Right: right, Queue: q}
+		}
+	}
+	return nil
+}
+
+// like Authorize, but commands from contexts without an Identity are allowed
+func authorizeIdentity(ctx context.Context, right Right, queues ...string) error {
+	if IdentityFrom(ctx) == nil {
+		return nil
+	}
+	return Authorize(ctx, right, queues...)
+}
@@ -0,0 +1,85 @@
+package peel
+
+import (
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestACL(t *T) {
+	acl, err := ParseACL(strings.NewReader(`{"identities": [
+		{
+			"name": "team-a",
+			"token": "a",
+			"rules": [
+				{"queues": "team-a.*", "rights": ["produce", "consume"]},
+				{"queues": "shared", "rights": ["consume"]}
+			]
+		},
+		{"name": "ops", "rules": [{"queues": "*", "rights": ["admin"]}]}
+	]}`))
+	require.Nil(t, err)
+
+	teamA, err := acl.ByToken("a")
+	require.Nil(t, err)
+	assert.Equal(t, "team-a", teamA.Name)
+	_, err = acl.ByToken("b")
+	assert.Equal(t, ErrUnauthenticated, err)
+	_, err = acl.ByToken("")
+	assert.Equal(t, ErrUnauthenticated, err)
+	ops, err := acl.ByName("ops")
+	require.Nil(t, err)
+
+	assert.True(t, teamA.Allowed(RightProduce, "team-a.orders"))
+	assert.True(t, teamA.Allowed(RightConsume, "shared"))
+	assert.False(t, teamA.Allowed(RightProduce, "shared"))
+	assert.False(t, teamA.Allowed(RightAdmin, "team-a.orders"))
+	assert.False(t, teamA.Allowed(RightConsume, "team-b.orders"))
+	assert.False(t, teamA.Allowed(RightConsume, ""))
+	assert.True(t, ops.Allowed(RightProduce, "team-b.orders"))
+	assert.True(t, ops.Allowed(RightAdmin, ""))
+
+	assert.Equal(t, ErrUnauthenticated, Authorize(testCtx, RightConsume, "shared"))
+	ctx := WithIdentity(testCtx, teamA)
+	assert.Nil(t, Authorize(ctx, RightConsume, "shared", "team-a.orders"))
+	assert.Equal(t,
+		&ForbiddenError{Identity: "team-a", Right: RightProduce, Queue: "shared"},
+		Authorize(ctx, RightProduce, "team-a.orders", "shared"),
+	)
+	assert.Equal(t,
+		&ForbiddenError{Identity: "team-a", Right: RightAdmin},
+		Authorize(ctx, RightAdmin),
+	)
+
+	for _, ii := range [][]Identity{
+		{{}},
+		{{Name: "a"}, {Name: "a"}},
+		{{Name: "a", Token: "t"}, {Name: "b", Token: "t"}},
+		{{Name: "a", Rules: []ACLRule{{Queues: "[", Rights: []Right{RightAdmin}}}}},
+		{{Name: "a", Rules: []ACLRule{{Queues: "*", Rights: []Right{"foo"}}}}},
+	} {
+		_, err := NewACL(ii)
+		assert.NotNil(t, err, "%+v", ii)
+	}
+}
+
+func TestQAddAuthorize(t *T) {
+	queue := testutil.RandStr()
+	id := &Identity{Name: "foo", Rules: []ACLRule{{Queues: queue, Rights: []Right{RightConsume}}}}
+	c := QAddCommand{Queue: queue, Expire: time.Now().Add(time.Minute), Contents: "foo"}
+
+	_, err := testPeel.QAdd(WithIdentity(testCtx, id), c)
+	assert.Equal(t, &ForbiddenError{Identity: "foo", Right: RightProduce, Queue: queue}, err)
+
+	id.Rules[0].Rights = append(id.Rules[0].Rights, RightProduce)
+	_, err = testPeel.QAdd(WithIdentity(testCtx, id), c)
+	assert.Nil(t, err)
+
+	// Contexts without an Identity aren't checked
+	_, err = testPeel.QAdd(testCtx, c)
+	assert.Nil(t, err)
+}
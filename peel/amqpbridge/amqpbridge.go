@@ -0,0 +1,219 @@
+// Package amqpbridge shovels messages between bananaq queues and an AMQP 0-9-1
+// broker such as RabbitMQ, so that services can be moved between the two one
+// at a time. A ToAMQP consumes a queue and publishes each of its events to an
+// exchange, and a FromAMQP adds each message delivered from a broker's queue to
+// a bananaq queue. Both deliver at least once: events are only acked once the
+// broker has confirmed them, and messages are only acked once they've been
+// added to the queue.
+//
+// The package doesn't depend on any particular AMQP client. Its Delivery is
+// shaped like amqp091-go's, whose Channel is already an Acknowledger, so an
+// adapter for that client is mostly a matter of copying fields:
+//
+//	msgs, err := ch.Consume("orders", "", false, false, false, false, nil)
+//	deliveries := make(chan amqpbridge.Delivery)
+//	go func() {
+//		defer close(deliveries)
+//		for d := range msgs {
+//			deliveries <- amqpbridge.Delivery{
+//				Acknowledger: d.Acknowledger,
+//				DeliveryTag:  d.DeliveryTag,
+//				MessageID:    d.MessageId,
+//				Body:         d.Body,
+//			}
+//		}
+//	}()
+package amqpbridge
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+)
+
+// Acknowledger acks, nacks or rejects a message delivered by the broker.
+// amqp091-go's Channel implements it.
+type Acknowledger interface {
+	Ack(tag uint64, multiple bool) error
+	Nack(tag uint64, multiple, requeue bool) error
+	Reject(tag uint64, requeue bool) error
+}
+
+// Delivery is a single message delivered by the broker. It must have been
+// consumed without auto-ack.
+type Delivery struct {
+	Acknowledger Acknowledger
+	DeliveryTag  uint64
+
+	// Optional. If set it's used to keep messages which are delivered more
+	// than once from being added more than once, see FromAMQP.
+	MessageID string
+
+	Body []byte
+}
+
+// Publishing is a single message to be published to the broker
+type Publishing struct {
+	Exchange   string
+	RoutingKey string
+	MessageID  string
+	Body       []byte
+}
+
+// Publisher publishes messages to the broker. It should only return once the
+// broker has confirmed the message, e.g. using publisher confirms, and return
+// an error if the broker nacks it.
+type Publisher interface {
+	Publish(context.Context, Publishing) error
+}
+
+// ToAMQP consumes a queue for a consumer group and publishes each event to an
+// exchange, with the event's ID as the message's MessageID and its contents as
+// the message's body. Events are acked once the Publisher returns, and nacked
+// if it returns an error, so they're published again. Since an event may be
+// published more than once, e.g. if the bridge stops between publishing and
+// acking it, whatever consumes the messages should use their MessageIDs to
+// ignore duplicates.
+type ToAMQP struct {
+	Peel          *peel.Peel // Required
+	Queue         string     // Required
+	ConsumerGroup string     // Required
+	Publisher     Publisher  // Required
+
+	// The exchange and routing key each event is published with. An empty
+	// Exchange is the broker's default exchange, which routes messages to the
+	// broker queue named by the RoutingKey.
+	Exchange   string
+	RoutingKey string
+
+	// Default 1. The most events which may be being published at once. Events
+	// are published in the order they're retrieved only if this is 1.
+	Concurrency int
+
+	// Default 30 seconds. How long each publish may take before the event may
+	// be retrieved again, see peel.Consumer.
+	AckDeadline time.Duration
+
+	// Optional. Called with every error encountered, see peel.Consumer.
+	OnError func(error)
+}
+
+// Run publishes events until ctx is done or the Peel starts draining, see
+// peel.Consumer's Run. An error is only returned if the ToAMQP's fields are
+// invalid.
+func (ta ToAMQP) Run(ctx context.Context) error {
+	if ta.Publisher == nil {
+		return errors.New("Publisher is required")
+	}
+	return peel.Consumer{
+		Peel:          ta.Peel,
+		Queue:         ta.Queue,
+		ConsumerGroup: ta.ConsumerGroup,
+		Concurrency:   ta.Concurrency,
+		AckDeadline:   ta.AckDeadline,
+		OnError:       ta.OnError,
+		Handler: func(ctx context.Context, e core.Event) error {
+			return ta.Publisher.Publish(ctx, Publishing{
+				Exchange:   ta.Exchange,
+				RoutingKey: ta.RoutingKey,
+				MessageID:  e.ID.String(),
+				Body:       []byte(e.Contents),
+			})
+		},
+	}.Run(ctx)
+}
+
+// ErrDeliveriesClosed is returned from FromAMQP's Run when its Deliveries
+// channel is closed, which usually means the connection to the broker was lost
+// and must be re-established
+var ErrDeliveriesClosed = errors.New("deliveries channel closed")
+
+// FromAMQP adds each message delivered from a broker's queue to a bananaq queue,
+// with the message's body as the event's contents. Each message is acked once
+// it's been added, and nacked if it couldn't be, so that the broker delivers it
+// again. Messages which can't ever be added, because they're too large (see
+// peel.ErrContentsTooLarge), are rejected without being requeued instead, so
+// that they go to the broker queue's dead letter exchange if it has one.
+//
+// A message may be delivered more than once, e.g. if the bridge stops between
+// adding and acking it. Messages with a MessageID are added with a DedupKey
+// made from it, which keeps duplicates from being added for as long as the
+// Peel's DedupWindow.
+type FromAMQP struct {
+	Peel       *peel.Peel      // Required
+	Deliveries <-chan Delivery // Required
+	Queue      string          // Required
+
+	// How long after being added each event expires. Required unless the
+	// queue has a DefaultTTL (see peel.QueueConfig).
+	TTL time.Duration
+
+	// Optional. Called with every error encountered. Must not block.
+	OnError func(error)
+}
+
+func (fa FromAMQP) onError(err error) {
+	if fa.OnError != nil {
+		fa.OnError(err)
+	}
+}
+
+// Run adds messages one at a time until ctx is done, returning nil, or until
+// Deliveries is closed, returning ErrDeliveriesClosed. Errors from adding or
+// acking messages are passed to OnError. Any other error is only returned if
+// the FromAMQP's fields are invalid.
+func (fa FromAMQP) Run(ctx context.Context) error {
+	if fa.Peel == nil || fa.Deliveries == nil {
+		return errors.New("Peel and Deliveries are required")
+	} else if fa.Queue == "" {
+		return errors.New("Queue is required")
+	}
+
+	for {
+		var d Delivery
+		var ok bool
+		select {
+		case d, ok = <-fa.Deliveries:
+			if !ok {
+				return ErrDeliveriesClosed
+			}
+		case <-ctx.Done():
+			return nil
+		}
+
+		var ackErr error
+		switch err := fa.add(ctx, d); err {
+		case nil:
+			ackErr = d.Acknowledger.Ack(d.DeliveryTag, false)
+		case peel.ErrContentsTooLarge:
+			fa.onError(err)
+			ackErr = d.Acknowledger.Reject(d.DeliveryTag, false)
+		default:
+			fa.onError(err)
+			ackErr = d.Acknowledger.Nack(d.DeliveryTag, false, true)
+		}
+		if ackErr != nil {
+			fa.onError(ackErr)
+		}
+	}
+}
+
+func (fa FromAMQP) add(ctx context.Context, d Delivery) error {
+	c := peel.QAddCommand{
+		Queue:    fa.Queue,
+		Contents: string(d.Body),
+	}
+	if d.MessageID != "" {
+		// DedupKeys may not contain ':'
+		c.DedupKey = "amqp/" + strings.ReplaceAll(d.MessageID, ":", "/")
+	}
+	if fa.TTL > 0 {
+		c.Expire = time.Now().Add(fa.TTL)
+	}
+	_, err := fa.Peel.QAdd(ctx, c)
+	return err
+}
@@ -0,0 +1,152 @@
+package amqpbridge
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testCtx = context.Background()
+
+func newTestPeel(o *peel.Opts) *peel.Peel {
+	p := peel.NewWithBackend(core.NewMemBackend(), o)
+	errCh := p.Run(nil)
+	go func() { panic(<-errCh) }()
+	return p
+}
+
+// fails its first publish, and records the rest
+type testPublisher struct {
+	l      sync.Mutex
+	failed bool
+	pp     []Publishing
+}
+
+func (tp *testPublisher) Publish(_ context.Context, pub Publishing) error {
+	tp.l.Lock()
+	defer tp.l.Unlock()
+	if !tp.failed {
+		tp.failed = true
+		return errors.New("broker nacked the message")
+	}
+	tp.pp = append(tp.pp, pub)
+	return nil
+}
+
+func (tp *testPublisher) publishings() []Publishing {
+	tp.l.Lock()
+	defer tp.l.Unlock()
+	return append([]Publishing(nil), tp.pp...)
+}
+
+func TestToAMQP(t *T) {
+	p := newTestPeel(nil)
+	queue, cgroup := testutil.RandStr(), testutil.RandStr()
+
+	var ii []core.ID
+	var contents []string
+	for i := 0; i < 3; i++ {
+		contents = append(contents, testutil.RandStr())
+		id, err := p.QAdd(testCtx, peel.QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(time.Minute),
+			Contents: contents[i],
+		})
+		require.Nil(t, err)
+		ii = append(ii, id)
+	}
+
+	tp := new(testPublisher)
+	ctx, cancel := context.WithCancel(testCtx)
+	doneCh := make(chan error)
+	go func() {
+		doneCh <- ToAMQP{
+			Peel:          p,
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			Publisher:     tp,
+			RoutingKey:    "orders",
+		}.Run(ctx)
+	}()
+
+	// The event whose publish failed is nacked, and so published again first
+	assert.Eventually(t, func() bool { return len(tp.publishings()) == 3 }, time.Second, 10*time.Millisecond)
+	cancel()
+	require.Nil(t, <-doneCh)
+
+	for i, pub := range tp.publishings() {
+		assert.Equal(t, Publishing{
+			RoutingKey: "orders",
+			MessageID:  ii[i].String(),
+			Body:       []byte(contents[i]),
+		}, pub)
+	}
+}
+
+// records what happened to each delivery tag
+type testAcknowledger struct {
+	l   sync.Mutex
+	res map[uint64]string
+}
+
+func (ta *testAcknowledger) set(tag uint64, res string) error {
+	ta.l.Lock()
+	defer ta.l.Unlock()
+	ta.res[tag] = res
+	return nil
+}
+
+func (ta *testAcknowledger) Ack(tag uint64, _ bool) error {
+	return ta.set(tag, "ack")
+}
+
+func (ta *testAcknowledger) Nack(tag uint64, _, _ bool) error {
+	return ta.set(tag, "nack")
+}
+
+func (ta *testAcknowledger) Reject(tag uint64, _ bool) error {
+	return ta.set(tag, "reject")
+}
+
+func TestFromAMQP(t *T) {
+	p := newTestPeel(&peel.Opts{MaxContentsSize: 100})
+	queue, cgroup := testutil.RandStr(), testutil.RandStr()
+
+	// The second delivery is a redelivery of the first, and the third is too
+	// large to ever be added
+	ta := &testAcknowledger{res: map[uint64]string{}}
+	body := testutil.RandStr()
+	deliveries := make(chan Delivery, 3)
+	deliveries <- Delivery{Acknowledger: ta, DeliveryTag: 1, MessageID: "a:1", Body: []byte(body)}
+	deliveries <- Delivery{Acknowledger: ta, DeliveryTag: 2, MessageID: "a:1", Body: []byte(body)}
+	deliveries <- Delivery{Acknowledger: ta, DeliveryTag: 3, Body: []byte(strings.Repeat("a", 101))}
+	close(deliveries)
+
+	var errs []error
+	err := FromAMQP{
+		Peel:       p,
+		Deliveries: deliveries,
+		Queue:      queue,
+		TTL:        time.Minute,
+		OnError:    func(err error) { errs = append(errs, err) },
+	}.Run(testCtx)
+	assert.Equal(t, ErrDeliveriesClosed, err)
+	assert.Equal(t, []error{peel.ErrContentsTooLarge}, errs)
+	assert.Equal(t, map[uint64]string{1: "ack", 2: "ack", 3: "reject"}, ta.res)
+
+	e, err := p.QGet(testCtx, peel.QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, body, e.Contents)
+	e, err = p.QGet(testCtx, peel.QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{}, e)
+}
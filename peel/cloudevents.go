@@ -0,0 +1,261 @@
+package peel
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// CloudEventsSpecVersion is the version of the CloudEvents spec which
+// CloudEvents are written with, and the only one they can be parsed from
+const CloudEventsSpecVersion = "1.0"
+
+// CloudEvent is an envelope as described by the CloudEvents spec
+// (https://cloudevents.io). Its MarshalJSON and UnmarshalJSON methods use the
+// spec's structured JSON mode, which is how it's stored as an event's Contents.
+type CloudEvent struct {
+	ID     string // Required, but see QAddCommand's CloudEvent
+	Source string // Required
+	Type   string // Required
+
+	// Optional. Time is set to the current time by QAdd if it's not set.
+	Subject         string
+	Time            time.Time
+	DataContentType string
+	DataSchema      string
+
+	// Optional. Extension attributes, by name. Names must be made up of
+	// lowercase letters and digits. Values which aren't strings are converted
+	// to their string form when parsed, as they would be in binary mode.
+	Extensions map[string]string
+
+	// Set from the event's Contents when used with QAddCommand
+	Data []byte
+}
+
+// attributes which extensions may not be named
+var cloudEventReserved = map[string]bool{
+	"specversion": true, "id": true, "source": true, "type": true,
+	"subject": true, "time": true, "datacontenttype": true, "dataschema": true,
+	"data": true, "data_base64": true,
+}
+
+func (ce CloudEvent) validate() error {
+	if ce.ID == "" || ce.Source == "" || ce.Type == "" {
+		return errors.New("CloudEvent must have an ID, Source and Type")
+	}
+	for name := range ce.Extensions {
+		if cloudEventReserved[name] {
+			return fmt.Errorf("CloudEvent extension may not be named %q", name)
+		} else if name == "" || strings.TrimFunc(name, func(r rune) bool {
+			return (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9')
+		}) != "" {
+			return fmt.Errorf("CloudEvent extension name %q must be made up of lowercase letters and digits", name)
+		}
+	}
+	return nil
+}
+
+// returns whether data of the given content type is JSON. The spec says data
+// without a content type is to be treated as JSON.
+func isJSONContentType(ct string) bool {
+	if ct == "" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	return err == nil && (mt == "application/json" || mt == "text/json" || strings.HasSuffix(mt, "+json"))
+}
+
+// MarshalJSON implements the json.Marshaler interface, encoding the CloudEvent
+// in structured mode. Data is encoded as JSON if the DataContentType says it
+// is, as a string if it's some other text, and otherwise as base64.
+func (ce CloudEvent) MarshalJSON() ([]byte, error) {
+	if err := ce.validate(); err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	for name, v := range ce.Extensions {
+		m[name] = v
+	}
+	m["specversion"] = CloudEventsSpecVersion
+	m["id"] = ce.ID
+	m["source"] = ce.Source
+	m["type"] = ce.Type
+	if ce.Subject != "" {
+		m["subject"] = ce.Subject
+	}
+	if !ce.Time.IsZero() {
+		m["time"] = ce.Time.UTC().Format(time.RFC3339Nano)
+	}
+	if ce.DataContentType != "" {
+		m["datacontenttype"] = ce.DataContentType
+	}
+	if ce.DataSchema != "" {
+		m["dataschema"] = ce.DataSchema
+	}
+
+	isJSON := isJSONContentType(ce.DataContentType)
+	switch {
+	case len(ce.Data) == 0:
+	case isJSON && json.Valid(ce.Data):
+		m["data"] = json.RawMessage(ce.Data)
+	case !isJSON && utf8.Valid(ce.Data):
+		m["data"] = string(ce.Data)
+	default:
+		m["data_base64"] = base64.StdEncoding.EncodeToString(ce.Data)
+	}
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface, decoding a
+// CloudEvent in structured mode
+func (ce *CloudEvent) UnmarshalJSON(b []byte) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+
+	// Every attribute other than data is a string, or has a canonical string
+	// form
+	str := func(name string) (string, error) {
+		raw, ok := m[name]
+		delete(m, name)
+		if !ok {
+			return "", nil
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			return s, nil
+		}
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return "", err
+		}
+		switch v.(type) {
+		case bool, float64:
+			return string(raw), nil
+		}
+		return "", fmt.Errorf("CloudEvent attribute %q must be a string", name)
+	}
+
+	var out CloudEvent
+	var specVersion, timeStr string
+	var err error
+	for _, attr := range []struct {
+		name string
+		into *string
+	}{
+		{"specversion", &specVersion},
+		{"id", &out.ID},
+		{"source", &out.Source},
+		{"type", &out.Type},
+		{"subject", &out.Subject},
+		{"time", &timeStr},
+		{"datacontenttype", &out.DataContentType},
+		{"dataschema", &out.DataSchema},
+	} {
+		if *attr.into, err = str(attr.name); err != nil {
+			return err
+		}
+	}
+	if specVersion != CloudEventsSpecVersion {
+		return fmt.Errorf("unsupported CloudEvents specversion %q", specVersion)
+	}
+	if timeStr != "" {
+		if out.Time, err = time.Parse(time.RFC3339Nano, timeStr); err != nil {
+			return fmt.Errorf("invalid CloudEvent time: %s", err)
+		}
+	}
+
+	if raw, ok := m["data_base64"]; ok {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return fmt.Errorf("invalid CloudEvent data_base64: %s", err)
+		} else if out.Data, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return fmt.Errorf("invalid CloudEvent data_base64: %s", err)
+		}
+	} else if raw, ok := m["data"]; ok {
+		var s string
+		if !isJSONContentType(out.DataContentType) && json.Unmarshal(raw, &s) == nil {
+			out.Data = []byte(s)
+		} else {
+			out.Data = []byte(raw)
+		}
+	}
+	delete(m, "data_base64")
+	delete(m, "data")
+
+	for name := range m {
+		v, err := str(name)
+		if err != nil {
+			return err
+		}
+		if out.Extensions == nil {
+			out.Extensions = map[string]string{}
+		}
+		out.Extensions[name] = v
+	}
+
+	if err := out.validate(); err != nil {
+		return err
+	}
+	*ce = out
+	return nil
+}
+
+// ParseCloudEvent parses the Contents of an event, which was added with a
+// CloudEvent, back into one. It's useful for events retrieved with something
+// other than QGet, e.g. QGetMulti or QSubscribe.
+func ParseCloudEvent(e core.Event) (CloudEvent, error) {
+	var ce CloudEvent
+	err := json.Unmarshal([]byte(e.Contents), &ce)
+	return ce, err
+}
+
+// encodeCloudEvent wraps the command's Contents in its CloudEvent, if it has
+// one. It must be called after encodePayload.
+func encodeCloudEvent(c *QAddCommand, now time.Time) error {
+	if c.CloudEvent == nil {
+		return nil
+	} else if c.CloudEvent.Data != nil {
+		return errors.New("CloudEvent's Data may not be set")
+	}
+
+	ce := *c.CloudEvent
+	if ce.ID == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		ce.ID = hex.EncodeToString(b)
+	}
+	if ce.Time.IsZero() {
+		ce.Time = now
+	}
+	ce.Data = []byte(c.Contents)
+
+	// The spec treats data without a content type as JSON, so data which isn't
+	// needs to say what it is instead
+	if ce.DataContentType == "" && len(ce.Data) > 0 && !json.Valid(ce.Data) {
+		ce.DataContentType = "application/octet-stream"
+		if utf8.Valid(ce.Data) {
+			ce.DataContentType = "text/plain"
+		}
+	}
+
+	b, err := json.Marshal(ce)
+	if err != nil {
+		return err
+	}
+	c.Contents, c.CloudEvent = string(b), nil
+	return nil
+}
@@ -0,0 +1,165 @@
+package peel
+
+import (
+	"encoding/json"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloudEventJSON(t *T) {
+	now := time.Now().UTC()
+	base := CloudEvent{
+		ID:     testutil.RandStr(),
+		Source: "/orders",
+		Type:   "com.example.order.created",
+		Time:   now,
+	}
+
+	assertEncoded := func(ce CloudEvent, dataKey string, expected interface{}) {
+		b, err := json.Marshal(ce)
+		require.Nil(t, err)
+		var m map[string]interface{}
+		require.Nil(t, json.Unmarshal(b, &m))
+		assert.Equal(t, CloudEventsSpecVersion, m["specversion"])
+		assert.Equal(t, expected, m[dataKey], "dataKey:%q", dataKey)
+
+		var out CloudEvent
+		require.Nil(t, json.Unmarshal(b, &out))
+		assert.Equal(t, ce, out)
+	}
+
+	ce := base
+	ce.Data = []byte(`{"foo":"bar"}`)
+	assertEncoded(ce, "data", map[string]interface{}{"foo": "bar"})
+
+	ce.DataContentType = "application/vnd.example+json"
+	assertEncoded(ce, "data", map[string]interface{}{"foo": "bar"})
+
+	ce.DataContentType = "text/plain"
+	ce.Data = []byte("hello")
+	ce.Subject = "123"
+	ce.Extensions = map[string]string{"traceparent": "00-abc-def-01"}
+	assertEncoded(ce, "data", "hello")
+
+	ce.DataContentType = "application/octet-stream"
+	ce.Data = []byte{0xff, 0x00}
+	assertEncoded(ce, "data_base64", "/wA=")
+
+	// Extensions which aren't strings are parsed into their string forms
+	var out CloudEvent
+	require.Nil(t, json.Unmarshal([]byte(`{"specversion":"1.0","id":"a","source":"b","type":"c","count":5,"ok":true}`), &out))
+	assert.Equal(t, map[string]string{"count": "5", "ok": "true"}, out.Extensions)
+
+	for _, bad := range []string{
+		`{"id":"a","source":"b","type":"c"}`,
+		`{"specversion":"0.3","id":"a","source":"b","type":"c"}`,
+		`{"specversion":"1.0","source":"b","type":"c"}`,
+		`{"specversion":"1.0","id":"a","source":"b","type":"c","time":"yesterday"}`,
+		`{"specversion":"1.0","id":"a","source":"b","type":"c","Bad":"ext"}`,
+		`not json`,
+	} {
+		assert.NotNil(t, json.Unmarshal([]byte(bad), &out), "bad:%s", bad)
+	}
+
+	ce = base
+	ce.Extensions = map[string]string{"data": "foo"}
+	_, err := json.Marshal(ce)
+	assert.NotNil(t, err)
+}
+
+func TestQAddCloudEvent(t *T) {
+	type payload struct {
+		Foo string
+	}
+	queue, cgroup := testutil.RandStr(), testutil.RandStr()
+	in := payload{Foo: testutil.RandStr()}
+
+	ce := &CloudEvent{Source: "/orders", Type: "com.example.order.created"}
+	_, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:      queue,
+		Expire:     time.Now().Add(time.Minute),
+		Payload:    in,
+		CloudEvent: ce,
+	})
+	require.Nil(t, err)
+	// The caller's CloudEvent isn't modified
+	assert.Equal(t, &CloudEvent{Source: "/orders", Type: "com.example.order.created"}, ce)
+
+	var out payload
+	var outCE CloudEvent
+	e, err := testPeel.QGet(testCtx, QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		Payload:       &out,
+		CloudEvent:    &outCE,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, in, out)
+	assert.NotEmpty(t, outCE.ID)
+	assert.False(t, outCE.Time.IsZero())
+	assert.Equal(t, "", outCE.DataContentType)
+	assert.JSONEq(t, `{"Foo":"`+in.Foo+`"}`, string(outCE.Data))
+
+	parsed, err := ParseCloudEvent(e)
+	require.Nil(t, err)
+	assert.Equal(t, outCE, parsed)
+
+	// Contents which aren't JSON are given a DataContentType
+	_, err = testPeel.QAdd(testCtx, QAddCommand{
+		Queue:      queue,
+		Expire:     time.Now().Add(time.Minute),
+		Contents:   "hello",
+		CloudEvent: &CloudEvent{ID: "1", Source: "/greetings", Type: "hello"},
+	})
+	require.Nil(t, err)
+	e, err = testPeel.QGet(testCtx, QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		CloudEvent:    &outCE,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, "1", outCE.ID)
+	assert.Equal(t, "text/plain", outCE.DataContentType)
+	assert.Equal(t, "hello", string(outCE.Data))
+
+	// Contents which aren't a CloudEvent still return the event
+	id, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(time.Minute),
+		Contents: "not json",
+	})
+	require.Nil(t, err)
+	e, err = testPeel.QGet(testCtx, QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		CloudEvent:    &outCE,
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, id, e.ID)
+
+	_, err = testPeel.QAdd(testCtx, QAddCommand{
+		Queue:      queue,
+		Expire:     time.Now().Add(time.Minute),
+		Contents:   "foo",
+		CloudEvent: &CloudEvent{Source: "/orders"},
+	})
+	assert.NotNil(t, err)
+
+	_, err = testPeel.QAdd(testCtx, QAddCommand{
+		Queue:      queue,
+		Expire:     time.Now().Add(time.Minute),
+		Contents:   "foo",
+		CloudEvent: &CloudEvent{Source: "/orders", Type: "foo", Data: []byte("foo")},
+	})
+	assert.NotNil(t, err)
+
+	_, err = testPeel.QGetMulti(testCtx, QGetMultiCommand{
+		QGetCommand: QGetCommand{Queue: queue, ConsumerGroup: cgroup, CloudEvent: &outCE},
+		Count:       2,
+	})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,99 @@
+package peel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/tinylib/msgp/msgp"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec is used by Peel to marshal the Payload of a QAddCommand into an event's
+// Contents, and to unmarshal events' Contents back into values. See Opts.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+// JSONCodec is a Codec which uses encoding/json
+type JSONCodec struct{}
+
+// Marshal implements the method for the Codec interface
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal implements the method for the Codec interface
+func (JSONCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+// ProtobufCodec is a Codec for values which implement proto.Message
+type ProtobufCodec struct{}
+
+// Marshal implements the method for the Codec interface
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T does not implement proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+// Unmarshal implements the method for the Codec interface
+func (ProtobufCodec) Unmarshal(b []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T does not implement proto.Message", v)
+	}
+	return proto.Unmarshal(b, m)
+}
+
+// MsgpackCodec is a Codec for values which have msgpack methods generated by
+// github.com/tinylib/msgp, i.e. which implement msgp.Marshaler and
+// msgp.Unmarshaler
+type MsgpackCodec struct{}
+
+// Marshal implements the method for the Codec interface
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(msgp.Marshaler)
+	if !ok {
+		return nil, fmt.Errorf("%T does not implement msgp.Marshaler", v)
+	}
+	return m.MarshalMsg(nil)
+}
+
+// Unmarshal implements the method for the Codec interface
+func (MsgpackCodec) Unmarshal(b []byte, v interface{}) error {
+	u, ok := v.(msgp.Unmarshaler)
+	if !ok {
+		return fmt.Errorf("%T does not implement msgp.Unmarshaler", v)
+	}
+	_, err := u.UnmarshalMsg(b)
+	return err
+}
+
+// encodePayload marshals the command's Payload, if it has one, into its
+// Contents
+func (p *Peel) encodePayload(c *QAddCommand) error {
+	if c.Payload == nil {
+		return nil
+	} else if c.Contents != "" {
+		return errors.New("Contents and Payload may not both be set")
+	}
+	b, err := p.o.Codec.Marshal(c.Payload)
+	if err != nil {
+		return err
+	}
+	c.Contents, c.Payload = string(b), nil
+	return nil
+}
+
+// Unmarshal unmarshals the Contents of an event, which was added with a
+// Payload, into v using the Codec (see Opts). It's useful for events retrieved
+// with something other than QGet, e.g. QGetMulti or QSubscribe.
+func (p *Peel) Unmarshal(e core.Event, v interface{}) error {
+	return p.o.Codec.Unmarshal([]byte(e.Contents), v)
+}
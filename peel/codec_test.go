@@ -0,0 +1,104 @@
+package peel
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCodec(t *T) {
+	type payload struct {
+		Foo string
+		Bar int
+	}
+	queue, cgroup := testutil.RandStr(), testutil.RandStr()
+	in := payload{Foo: testutil.RandStr(), Bar: 5}
+
+	id, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:   queue,
+		Expire:  time.Now().Add(time.Minute),
+		Payload: in,
+	})
+	require.Nil(t, err)
+
+	var out payload
+	e, err := testPeel.QGet(testCtx, QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		Payload:       &out,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, id, e.ID)
+	assert.Equal(t, in, out)
+
+	out = payload{}
+	require.Nil(t, testPeel.Unmarshal(e, &out))
+	assert.Equal(t, in, out)
+
+	// Contents which can't be unmarshaled still return the event
+	id, err = testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(time.Minute),
+		Contents: "not json",
+	})
+	require.Nil(t, err)
+	e, err = testPeel.QGet(testCtx, QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		Payload:       &out,
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, id, e.ID)
+
+	_, err = testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(time.Minute),
+		Contents: "foo",
+		Payload:  in,
+	})
+	assert.NotNil(t, err)
+
+	_, err = testPeel.QGetMulti(testCtx, QGetMultiCommand{
+		QGetCommand: QGetCommand{Queue: queue, ConsumerGroup: cgroup, Payload: &out},
+		Count:       2,
+	})
+	assert.NotNil(t, err)
+}
+
+func TestCodecs(t *T) {
+	assertRoundTrip := func(codec Codec, in, out interface{}, eq func() bool) {
+		p := NewWithBackend(core.NewMemBackend(), &Opts{Codec: codec})
+		queue := testutil.RandStr()
+		_, err := p.QAdd(testCtx, QAddCommand{
+			Queue:   queue,
+			Expire:  time.Now().Add(time.Minute),
+			Payload: in,
+		})
+		require.Nil(t, err)
+		_, err = p.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: testutil.RandStr(),
+			Payload:       out,
+		})
+		require.Nil(t, err)
+		assert.True(t, eq(), "%T", codec)
+	}
+
+	pIn, pOut := wrapperspb.String(testutil.RandStr()), &wrapperspb.StringValue{}
+	assertRoundTrip(ProtobufCodec{}, pIn, pOut, func() bool { return proto.Equal(pIn, pOut) })
+
+	mIn := core.Event{Contents: testutil.RandStr(), ReplyTo: testutil.RandStr()}
+	var mOut core.Event
+	assertRoundTrip(MsgpackCodec{}, &mIn, &mOut, func() bool { return mIn == mOut })
+
+	_, err := ProtobufCodec{}.Marshal("foo")
+	assert.NotNil(t, err)
+	_, err = MsgpackCodec{}.Marshal("foo")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,789 @@
+package peel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// Overflow describes what QAdd does when adding events would put a queue over
+// its MaxLength
+type Overflow string
+
+// All possible Overflow values
+const (
+	// The QAdd fails with ErrQueueFull. This is the default
+	OverflowReject Overflow = "reject"
+
+	// The QAdd waits until there's room in the queue, either because events
+	// expired or the queue was flushed, and fails with ErrQueueFull if there
+	// still isn't room after OverflowTimeout
+	OverflowBlock Overflow = "block"
+
+	// The oldest events in the queue are removed to make room, starting with
+	// the lowest priority. Consumer groups which haven't retrieved them yet
+	// never will.
+	OverflowEvict Overflow = "evict"
+)
+
+// ErrQueueFull is returned from QAdd when the events can't be added because the
+// queue is at its MaxLength (see QueueConfig)
+var ErrQueueFull = errors.New("queue is full")
+
+// How often QAdd checks if there's room in a queue while blocking
+const overflowPollPeriod = 100 * time.Millisecond
+
+// QueueConfig describes settings for a single queue. It is stored in the
+// database, so all Peel instances share it.
+type QueueConfig struct {
+	// Default 0, meaning unlimited. The maximum number of events which may be
+	// in the queue at once, across all priorities. Events which have been
+	// added with a VisibleAfter and aren't visible yet don't count.
+	MaxLength uint64
+
+	// Default OverflowReject. What QAdd does when adding events would put the
+	// queue over MaxLength.
+	Overflow Overflow
+
+	// Default 0, meaning wait indefinitely. Only used with OverflowBlock, see
+	// its doc string.
+	OverflowTimeout time.Duration
+
+	// Default false. If set the queue's events are delivered round-robin
+	// across the PartitionKeys they were added with (see QAddCommand), rather
+	// than strictly oldest first, so that a producer which adds a lot of
+	// events at once doesn't hold up everyone else's.
+	//
+	// Events are held back in a backlog when they're added, and each time a
+	// consumer group has retrieved every available event the next event for
+	// each PartitionKey is made available. PartitionKeys are hashed into a
+	// fixed number of buckets, so a few may end up sharing their turn.
+	// Delayed events, and those with a non-zero Priority, are made available
+	// as usual, since they're already delivered out of order.
+	Fair bool
+
+	// Default 0, meaning the queue isn't sharded. If greater than 1 the
+	// queue's events are spread across this many shards, each of which is
+	// stored like a queue of its own, so that a single queue's throughput isn't
+	// limited to what one redis node can handle.
+	//
+	// Events with the same GroupID or PartitionKey (see QAddCommand), or
+	// failing those the same DedupKey, always go into the same shard, so
+	// they're still retrieved in the order they were added. Other events are
+	// spread across the shards round-robin. The rest of the QueueConfig
+	// applies to each shard on its own, e.g. each may hold up to MaxLength
+	// events.
+	//
+	// The commands for adding, retrieving and acknowledging events can be
+	// given the queue itself, as can QPause, QResume, QFlush, QStatus and
+	// QSetRateLimit. Every other command has to be given each shard's name,
+	// which is the queue's followed by '#' and the shard's index, e.g.
+	// "foo#0".
+	//
+	// Peels cache the number of shards a queue has for a few seconds, and
+	// events which are in a shard past the new number are only retrievable by
+	// using the shard's name directly, so this should only be changed while
+	// the queue is empty and nothing is using it.
+	Shards int
+
+	// Default false. If set each consumer group retrieves the queue's events
+	// strictly in the order they were added. While a consumer group has events
+	// in progress it can't retrieve any others, so an event which is QNack'd
+	// or misses its deadline is retrieved again before anything newer. QGet
+	// moves events which missed their deadline back itself, rather than
+	// waiting for Clean to, so a consumer which dies only holds up the
+	// consumer group until its deadline.
+	//
+	// Since only one QGet or QGetMulti's worth of events is in progress at a
+	// time, consumers should retrieve events in batches with QGetMulti if
+	// they need more throughput. Events can't be added to the queue with a
+	// Priority or VisibleAfter, and it can't be Fair or sharded, since they
+	// all change the order events are retrieved in.
+	StrictFIFO bool
+
+	// Default false. Must be set for events to be added to the queue with a
+	// GroupID (see QAddCommand), so that consumer groups of other queues
+	// don't have to check for them. Like Shards it's cached by Peels for a
+	// few seconds, so it should be set before such events are added.
+	Grouped bool
+
+	// Default 16, at most 256. Only used if Grouped is set. The number of
+	// buckets a queue's GroupIDs are hashed into. GroupIDs in the same bucket
+	// share it, so they hold each other back as if they were the same GroupID,
+	// and each consumer group can only have one event in progress from each
+	// bucket. More buckets means less of that, but more work for each QGet. It
+	// can't be changed while the queue has events with a GroupID, including
+	// ack'd ones which haven't expired yet.
+	GroupBuckets int
+
+	// Default 0, meaning none. If set, a QGet on the queue which isn't given
+	// an AckDeadline uses one this long after the events are retrieved, so
+	// that every event retrieved from the queue has to be QAck'd. Like
+	// Grouped it's cached by Peels for a few seconds.
+	AckDeadline time.Duration
+
+	// Default 0, meaning the MaxDeliveries in the Peel's Opts is used.
+	// Otherwise overrides it for the queue. Like Grouped it's cached by Peels
+	// for a few seconds.
+	MaxDeliveries int
+
+	// Default 0, meaning none. If set, events which are added to the queue
+	// without an Expire expire this long after they're added.
+	DefaultTTL time.Duration
+
+	// Default 0, meaning unlimited. The longest an event added to the queue
+	// is kept for. Events which are added with a later Expire, or without one,
+	// expire this long after they're added instead.
+	Retention time.Duration
+
+	// Default 0, meaning none. If set, events added to the queue are kept for
+	// this long after they're added so that they can be replayed with
+	// QReplay, even once they've expired. Their contents are kept for as long
+	// too. Events are removed from the replay log by CleanAvailable.
+	ReplayRetention time.Duration
+
+	// Default 0, meaning unlimited. Only used if ReplayRetention is set, in
+	// which case CleanAvailable only keeps this many of the newest events for
+	// replay. The contents of those it removes aren't kept any longer than
+	// they would have been otherwise.
+	ReplayMaxLength uint64
+
+	// Default 0, meaning disabled. If set, the transitions which the queue's
+	// events make (see TraceState) are recorded so that they can be retrieved
+	// with QTrace. CleanAvailable and Clean only keep this many of the most
+	// recent events which made each transition, for the queue and for each of
+	// its consumer groups respectively.
+	TraceMaxLength uint64
+
+	// Default false. If set, the transitions which the queue's events make
+	// (see TraceState) are published to anyone watching the queue with
+	// QWatch.
+	Notify bool
+
+	// Whether the queue is paused, see QPause. It isn't stored with the rest
+	// of the QueueConfig; QSetConfig pauses or resumes the queue to match it,
+	// and QGetConfig sets it according to whether the queue currently is.
+	Paused bool
+}
+
+// returns the number of group sets the queue uses, see GroupBuckets
+func (qc QueueConfig) groupBuckets() int {
+	if qc.GroupBuckets == 0 {
+		return defaultGroupBuckets
+	}
+	return qc.GroupBuckets
+}
+
+func (qc QueueConfig) toMap() map[string]string {
+	m := map[string]string{}
+	if qc.MaxLength > 0 {
+		m["maxlength"] = strconv.FormatUint(qc.MaxLength, 10)
+	}
+	if qc.Overflow != "" {
+		m["overflow"] = string(qc.Overflow)
+	}
+	if qc.OverflowTimeout > 0 {
+		m["overflowtimeout"] = strconv.FormatInt(int64(qc.OverflowTimeout), 10)
+	}
+	if qc.Fair {
+		m["fair"] = "1"
+	}
+	if qc.Shards > 0 {
+		m["shards"] = strconv.Itoa(qc.Shards)
+	}
+	if qc.StrictFIFO {
+		m["strictfifo"] = "1"
+	}
+	if qc.Grouped {
+		m["grouped"] = "1"
+	}
+	if qc.GroupBuckets > 0 {
+		m["groupbuckets"] = strconv.Itoa(qc.GroupBuckets)
+	}
+	if qc.AckDeadline > 0 {
+		m["ackdeadline"] = strconv.FormatInt(int64(qc.AckDeadline), 10)
+	}
+	if qc.MaxDeliveries > 0 {
+		m["maxdeliveries"] = strconv.Itoa(qc.MaxDeliveries)
+	}
+	if qc.DefaultTTL > 0 {
+		m["defaultttl"] = strconv.FormatInt(int64(qc.DefaultTTL), 10)
+	}
+	if qc.Retention > 0 {
+		m["retention"] = strconv.FormatInt(int64(qc.Retention), 10)
+	}
+	if qc.ReplayRetention > 0 {
+		m["replayretention"] = strconv.FormatInt(int64(qc.ReplayRetention), 10)
+	}
+	if qc.ReplayMaxLength > 0 {
+		m["replaymaxlength"] = strconv.FormatUint(qc.ReplayMaxLength, 10)
+	}
+	if qc.TraceMaxLength > 0 {
+		m["tracemaxlength"] = strconv.FormatUint(qc.TraceMaxLength, 10)
+	}
+	if qc.Notify {
+		m["notify"] = "1"
+	}
+	return m
+}
+
+func queueConfigFromMap(m map[string]string) (QueueConfig, error) {
+	var qc QueueConfig
+	var err error
+	if s, ok := m["maxlength"]; ok {
+		if qc.MaxLength, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return QueueConfig{}, err
+		}
+	}
+	qc.Overflow = Overflow(m["overflow"])
+	if s, ok := m["overflowtimeout"]; ok {
+		d, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return QueueConfig{}, err
+		}
+		qc.OverflowTimeout = time.Duration(d)
+	}
+	qc.Fair = m["fair"] == "1"
+	if s, ok := m["shards"]; ok {
+		if qc.Shards, err = strconv.Atoi(s); err != nil {
+			return QueueConfig{}, err
+		}
+	}
+	qc.StrictFIFO = m["strictfifo"] == "1"
+	qc.Grouped = m["grouped"] == "1"
+	if s, ok := m["groupbuckets"]; ok {
+		if qc.GroupBuckets, err = strconv.Atoi(s); err != nil {
+			return QueueConfig{}, err
+		}
+	}
+	if s, ok := m["ackdeadline"]; ok {
+		d, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return QueueConfig{}, err
+		}
+		qc.AckDeadline = time.Duration(d)
+	}
+	if s, ok := m["maxdeliveries"]; ok {
+		if qc.MaxDeliveries, err = strconv.Atoi(s); err != nil {
+			return QueueConfig{}, err
+		}
+	}
+	if s, ok := m["defaultttl"]; ok {
+		d, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return QueueConfig{}, err
+		}
+		qc.DefaultTTL = time.Duration(d)
+	}
+	if s, ok := m["retention"]; ok {
+		d, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return QueueConfig{}, err
+		}
+		qc.Retention = time.Duration(d)
+	}
+	if s, ok := m["replayretention"]; ok {
+		d, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return QueueConfig{}, err
+		}
+		qc.ReplayRetention = time.Duration(d)
+	}
+	if s, ok := m["replaymaxlength"]; ok {
+		if qc.ReplayMaxLength, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return QueueConfig{}, err
+		}
+	}
+	if s, ok := m["tracemaxlength"]; ok {
+		if qc.TraceMaxLength, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return QueueConfig{}, err
+		}
+	}
+	qc.Notify = m["notify"] == "1"
+	return qc, nil
+}
+
+// QSetConfigCommand describes the parameters which can be passed into the
+// QSetConfig command
+type QSetConfigCommand struct {
+	Queue string // Required
+	QueueConfig
+}
+
+// QSetConfig replaces the given queue's QueueConfig. Setting a zero QueueConfig
+// returns the queue to the defaults, which includes resuming it if it was
+// paused. If the queue is sharded the QueueConfig is also set on each of its
+// shards.
+func (p *Peel) QSetConfig(ctx context.Context, c QSetConfigCommand) (err error) {
+	ctx, end := p.start(ctx, "QSetConfig", c.Queue, "")
+	defer end(&err, nil)
+	switch c.Overflow {
+	case "", OverflowReject, OverflowBlock, OverflowEvict:
+	default:
+		return fmt.Errorf("unknown overflow policy %q", c.Overflow)
+	}
+	if c.Shards < 0 {
+		return errors.New("Shards may not be negative")
+	} else if c.StrictFIFO && (c.Fair || c.Shards > 1) {
+		return errors.New("a StrictFIFO queue can't be Fair or sharded")
+	} else if c.AckDeadline < 0 || c.MaxDeliveries < 0 || c.DefaultTTL < 0 || c.Retention < 0 || c.ReplayRetention < 0 {
+		return errors.New("AckDeadline, MaxDeliveries, DefaultTTL, Retention and ReplayRetention may not be negative")
+	} else if c.GroupBuckets < 0 || c.GroupBuckets > maxGroupBuckets {
+		return fmt.Errorf("GroupBuckets must be between 0 and %d", maxGroupBuckets)
+	}
+
+	// The group sets only need checking if GroupBuckets is actually being
+	// changed. The shards have the same config as the queue, so only its
+	// config is read.
+	if prevQC, err := p.getConfig(ctx, QGetConfigCommand{Queue: c.Queue}); err != nil {
+		return err
+	} else if prevQC.groupBuckets() != c.groupBuckets() {
+		for _, queue := range shardQueues(c.Queue, prevQC.Shards) {
+			if err := p.checkGroupBuckets(ctx, queue, prevQC.groupBuckets()); err != nil {
+				return err
+			}
+		}
+	}
+
+	k, err := queueConfig(c.Queue)
+	if err != nil {
+		return err
+	}
+	if err := p.c.HashSetAll(ctx, k, c.QueueConfig.toMap()); err != nil {
+		return err
+	}
+	p.configs.forget(c.Queue)
+	if err := p.setStrict(ctx, c.Queue, c.StrictFIFO); err != nil {
+		return err
+	}
+
+	// The shards themselves aren't sharded any further
+	shards := shardQueues(c.Queue, c.Shards)
+	if len(shards) > 1 {
+		shardQC := c.QueueConfig
+		shardQC.Shards = 0
+		for _, shard := range shards {
+			k, err := queueConfig(shard)
+			if err != nil {
+				return err
+			}
+			if err := p.c.HashSetAll(ctx, k, shardQC.toMap()); err != nil {
+				return err
+			}
+			p.configs.forget(shard)
+		}
+	}
+
+	for _, queue := range shards {
+		if c.Paused {
+			err = p.qpause(ctx, queue)
+		} else {
+			err = p.qresume(ctx, queue)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sets or deletes the queue's strict key, see queueStrict
+func (p *Peel) setStrict(ctx context.Context, queue string, strict bool) error {
+	keyStrict, err := queueStrict(queue)
+	if err != nil {
+		return err
+	}
+
+	now := core.NewTS(p.now())
+	qq := []core.QueryAction{{Delete: &keyStrict}}
+	if strict {
+		qq = []core.QueryAction{
+			{
+				QuerySelector: &core.QuerySelector{
+					Key: keyStrict,
+					IDs: []core.ID{{T: now}},
+				},
+			},
+			{
+				QuerySingleSet: &core.QuerySingleSet{Key: keyStrict},
+			},
+		}
+	}
+
+	_, err = p.c.Query(ctx, core.QueryActions{
+		KeyBase:      keyStrict.Base,
+		QueryActions: qq,
+		Now:          now,
+	})
+	return err
+}
+
+// QGetConfigCommand describes the parameters which can be passed into the
+// QGetConfig command
+type QGetConfigCommand struct {
+	Queue string // Required
+}
+
+// QGetConfig returns the given queue's QueueConfig, as set by QSetConfig. Fields
+// which have never been set are left as their zero values.
+func (p *Peel) QGetConfig(ctx context.Context, c QGetConfigCommand) (_ QueueConfig, err error) {
+	ctx, end := p.start(ctx, "QGetConfig", c.Queue, "")
+	defer end(&err, nil)
+	qc, err := p.getConfig(ctx, c)
+	if err != nil {
+		return QueueConfig{}, err
+	}
+
+	// A sharded queue is paused if any of its shards are, like in QStatus
+	for _, queue := range shardQueues(c.Queue, qc.Shards) {
+		paused, err := p.isPaused(ctx, queue)
+		if err != nil {
+			return QueueConfig{}, err
+		}
+		qc.Paused = qc.Paused || paused
+	}
+	return qc, nil
+}
+
+// returns whether the queue has been paused with QPause
+func (p *Peel) isPaused(ctx context.Context, queue string) (bool, error) {
+	keyPaused, err := queuePaused(queue)
+	if err != nil {
+		return false, err
+	}
+
+	// The input starts off empty, so this counts 1 if the queue is paused and 0
+	// otherwise
+	now := core.NewTS(p.now())
+	res, err := p.c.Query(ctx, core.QueryActions{
+		KeyBase: keyPaused.Base,
+		QueryActions: []core.QueryAction{
+			{
+				QuerySelector: &core.QuerySelector{
+					Key: keyPaused,
+					IDs: []core.ID{{T: now}},
+				},
+				QueryConditional: core.QueryConditional{
+					IfNotEmpty: &keyPaused,
+				},
+			},
+			{CountInput: true},
+		},
+		Now: now,
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.Counts[0] > 0, nil
+}
+
+// returns an error if any of the queue's first buckets group sets have events
+// in them, since the queue's GroupBuckets are being changed from that number
+// and they'd be left in sets which are no longer used
+func (p *Peel) checkGroupBuckets(ctx context.Context, queue string, buckets int) error {
+	ewGroups, err := queueGroups(queue)
+	if err != nil {
+		return err
+	}
+	qq := make([]core.QueryAction, buckets)
+	for i := range qq {
+		qq[i] = core.QueryAction{QueryCount: &core.QueryCount{Key: ewGroups[i].byArb}}
+	}
+	res, err := p.c.Query(ctx, core.QueryActions{
+		KeyBase:      ewGroups[0].base,
+		QueryActions: qq,
+		Now:          core.NewTS(p.now()),
+	})
+	if err != nil {
+		return err
+	}
+	for _, n := range res.Counts {
+		if n > 0 {
+			return errors.New("GroupBuckets can't be changed while the queue has events with a GroupID")
+		}
+	}
+	return nil
+}
+
+func (p *Peel) getConfig(ctx context.Context, c QGetConfigCommand) (QueueConfig, error) {
+	k, err := queueConfig(c.Queue)
+	if err != nil {
+		return QueueConfig{}, err
+	}
+
+	m, err := p.c.HashGetAll(ctx, k)
+	if err != nil {
+		return QueueConfig{}, err
+	}
+	return queueConfigFromMap(m)
+}
+
+// How long a Peel caches a queue's QueueConfig for, where it's needed by
+// commands which are called often, before fetching it again
+const configCacheTTL = 5 * time.Second
+
+type configCacheEntry struct {
+	qc      QueueConfig
+	fetched time.Time
+}
+
+// configCache keeps track of each queue's QueueConfig, so that commands like
+// QGet and QAck don't have to fetch it every time they're called
+type configCache struct {
+	l sync.Mutex
+	m map[string]configCacheEntry
+}
+
+func newConfigCache() *configCache {
+	return &configCache{m: map[string]configCacheEntry{}}
+}
+
+func (cc *configCache) get(queue string, now time.Time) (QueueConfig, bool) {
+	cc.l.Lock()
+	defer cc.l.Unlock()
+	e, ok := cc.m[queue]
+	if !ok || now.Sub(e.fetched) >= configCacheTTL {
+		return QueueConfig{}, false
+	}
+	return e.qc, true
+}
+
+func (cc *configCache) set(queue string, qc QueueConfig, now time.Time) {
+	cc.l.Lock()
+	defer cc.l.Unlock()
+	cc.m[queue] = configCacheEntry{qc, now}
+}
+
+func (cc *configCache) forget(queue string) {
+	cc.l.Lock()
+	defer cc.l.Unlock()
+	delete(cc.m, queue)
+}
+
+// like getConfig, but the QueueConfig may have been fetched by an earlier call
+// up to configCacheTTL ago. Changes made by QSetConfig through this Peel are
+// seen immediately.
+func (p *Peel) cachedConfig(ctx context.Context, queue string) (QueueConfig, error) {
+	now := time.Now()
+	if qc, ok := p.configs.get(queue, now); ok {
+		return qc, nil
+	}
+	qc, err := p.getConfig(ctx, QGetConfigCommand{Queue: queue})
+	if err != nil {
+		return QueueConfig{}, err
+	}
+	p.configs.set(queue, qc, now)
+	return qc, nil
+}
+
+// makeRoom makes sure that n more events can be added to the queue without
+// going over its MaxLength, according to the queue's Overflow policy. This
+// isn't done atomically with adding the events, so concurrent QAdds may still
+// put the queue over its MaxLength by a small amount. Events in the queue's
+// fair backlog and group sets, which are passed in as ewFairs, count towards its
+// length.
+func (p *Peel) makeRoom(ctx context.Context, qc QueueConfig, ewAvails, ewFairs []exWrap, n uint64) error {
+	if qc.MaxLength == 0 {
+		return nil
+	} else if n > qc.MaxLength {
+		return ErrQueueFull
+	}
+
+	var timeoutCh <-chan time.Time
+	if qc.Overflow == OverflowBlock && qc.OverflowTimeout > 0 {
+		timeoutCh = time.After(qc.OverflowTimeout)
+	}
+
+	for {
+		now := core.NewTS(p.now())
+		length, err := p.queueLength(ctx, ewAvails, ewFairs, now)
+		if err != nil {
+			return err
+		} else if length+n <= qc.MaxLength {
+			return nil
+		}
+
+		switch qc.Overflow {
+		case OverflowEvict:
+			return p.evict(ctx, ewAvails, ewFairs, length+n-qc.MaxLength, now)
+		case OverflowBlock:
+			select {
+			case <-time.After(overflowPollPeriod):
+			case <-timeoutCh:
+				return ErrQueueFull
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		default:
+			return ErrQueueFull
+		}
+	}
+}
+
+// returns the number of non-expired events in the avail of every priority and
+// in the fair backlog
+func (p *Peel) queueLength(ctx context.Context, ewAvails, ewFairs []exWrap, now core.TS) (uint64, error) {
+	var qq []core.QueryAction
+	for _, ew := range append(ewAvails, ewFairs...) {
+		qq = append(qq, ew.removeExpired(now)...)
+		qq = append(qq, ew.countNotExpired(now))
+	}
+
+	res, err := p.c.Query(ctx, core.QueryActions{
+		KeyBase:      ewAvails[0].base,
+		QueryActions: qq,
+		Now:          now,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var length uint64
+	for _, count := range res.Counts {
+		length += count
+	}
+	return length, nil
+}
+
+// removes the n oldest events from the avails, starting with the lowest
+// priority. The fair backlog holds priority zero events which haven't been made
+// available yet, so it's evicted from after the priority zero avail. Each set
+// needs its own query, since how many events to remove from it depends on how
+// many were removed from the ones before.
+func (p *Peel) evict(ctx context.Context, ewAvails, ewFairs []exWrap, n uint64, now core.TS) error {
+	ews := append([]exWrap{ewAvails[0]}, ewFairs...)
+	ews = append(ews, ewAvails[1:]...)
+	for i := 0; i < len(ews) && n > 0; i++ {
+		qq := []core.QueryAction{
+			ews[i].after(0, int64(n)),
+			ews[i].removeFromInput(),
+			{CountInput: true},
+		}
+
+		res, err := p.c.Query(ctx, core.QueryActions{
+			KeyBase:      ewAvails[0].base,
+			QueryActions: qq,
+			Now:          now,
+		})
+		if err != nil {
+			return err
+		}
+		n -= res.Counts[0]
+	}
+	return nil
+}
+
+// RateLimit describes a limit on how quickly a consumer group may retrieve
+// events from a queue, across all consumers and Peel instances. It is
+// implemented as a token bucket.
+type RateLimit struct {
+	// Default 0, meaning unlimited. The number of events per second which may
+	// be retrieved.
+	Rate float64
+
+	// Default 1. The number of events which may be retrieved at once, after
+	// the consumer group has not retrieved any for a while.
+	Burst int
+}
+
+// QSetRateLimitCommand describes the parameters which can be passed into the
+// QSetRateLimit command
+type QSetRateLimitCommand struct {
+	Queue         string // Required
+	ConsumerGroup string // Required
+	RateLimit
+}
+
+// QSetRateLimit replaces the RateLimit for the given queue/consumer group. Once
+// the limit is reached QGet will return fewer events than requested, or none at
+// all, until enough time has passed. Setting a zero RateLimit removes the
+// limit. If the queue is sharded the RateLimit applies to each shard
+// separately.
+func (p *Peel) QSetRateLimit(ctx context.Context, c QSetRateLimitCommand) (err error) {
+	ctx, end := p.start(ctx, "QSetRateLimit", c.Queue, c.ConsumerGroup)
+	defer end(&err, nil)
+	if c.Rate < 0 || c.Burst < 0 {
+		return errors.New("Rate and Burst may not be negative")
+	}
+
+	k, err := queueRateLimit(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return err
+	}
+
+	var m map[string]string
+	if c.Rate > 0 {
+		m = map[string]string{
+			"rate":  strconv.FormatFloat(c.Rate, 'f', -1, 64),
+			"burst": strconv.Itoa(c.Burst),
+		}
+	}
+	if err := p.c.HashSetAll(ctx, k, m); err != nil {
+		return err
+	}
+
+	// Each shard of a sharded queue is limited on its own. The queue's own
+	// RateLimit is still set, since it's used by blocking QGets.
+	shards, err := p.queueShards(ctx, c.Queue)
+	if err != nil || len(shards) == 1 {
+		return err
+	}
+	for _, shard := range shards {
+		k, err := queueRateLimit(shard, c.ConsumerGroup)
+		if err != nil {
+			return err
+		}
+		if err := p.c.HashSetAll(ctx, k, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QGetRateLimitCommand describes the parameters which can be passed into the
+// QGetRateLimit command
+type QGetRateLimitCommand struct {
+	Queue         string // Required
+	ConsumerGroup string // Required
+}
+
+// QGetRateLimit returns the RateLimit for the given queue/consumer group, as set
+// by QSetRateLimit. Burst is 0 if no RateLimit is set.
+func (p *Peel) QGetRateLimit(ctx context.Context, c QGetRateLimitCommand) (_ RateLimit, err error) {
+	ctx, end := p.start(ctx, "QGetRateLimit", c.Queue, c.ConsumerGroup)
+	defer end(&err, nil)
+	return p.getRateLimit(ctx, c)
+}
+
+func (p *Peel) getRateLimit(ctx context.Context, c QGetRateLimitCommand) (RateLimit, error) {
+	k, err := queueRateLimit(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return RateLimit{}, err
+	}
+
+	m, err := p.c.HashGetAll(ctx, k)
+	if err != nil {
+		return RateLimit{}, err
+	}
+
+	var rl RateLimit
+	if s, ok := m["rate"]; ok {
+		if rl.Rate, err = strconv.ParseFloat(s, 64); err != nil {
+			return RateLimit{}, err
+		}
+	}
+	if s, ok := m["burst"]; ok {
+		if rl.Burst, err = strconv.Atoi(s); err != nil {
+			return RateLimit{}, err
+		}
+	}
+	if rl.Rate > 0 && rl.Burst < 1 {
+		rl.Burst = 1
+	}
+	return rl, nil
+}
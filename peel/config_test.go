@@ -0,0 +1,512 @@
+package peel
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQSetConfig(t *T) {
+	queue := testutil.RandStr()
+
+	qc, err := testPeel.QGetConfig(testCtx, QGetConfigCommand{Queue: queue})
+	require.Nil(t, err)
+	assert.Equal(t, QueueConfig{}, qc)
+
+	expected := QueueConfig{
+		MaxLength:       10,
+		Overflow:        OverflowBlock,
+		OverflowTimeout: 5 * time.Second,
+		Fair:            true,
+	}
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       queue,
+		QueueConfig: expected,
+	}))
+	qc, err = testPeel.QGetConfig(testCtx, QGetConfigCommand{Queue: queue})
+	require.Nil(t, err)
+	assert.Equal(t, expected, qc)
+
+	err = testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       queue,
+		QueueConfig: QueueConfig{Overflow: "wat"},
+	})
+	assert.NotNil(t, err)
+
+	// The config doesn't make the queue known, or look like it has a consumer
+	// group
+	queues, err := testPeel.QList(testCtx, QListCommand{Queue: queue})
+	require.Nil(t, err)
+	assert.NotContains(t, queues, queue)
+}
+
+func TestQSetConfigDefaults(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+
+	err := testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       queue,
+		QueueConfig: QueueConfig{MaxDeliveries: -1},
+	})
+	assert.NotNil(t, err)
+	_, err = testPeel.QAdd(testCtx, QAddCommand{Queue: queue, Contents: testutil.RandStr()})
+	assert.Equal(t, ErrNoExpire, err)
+
+	expected := QueueConfig{
+		AckDeadline:   time.Minute,
+		MaxDeliveries: 1,
+		DefaultTTL:    10 * time.Minute,
+		Retention:     time.Hour,
+		Paused:        true,
+	}
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       queue,
+		QueueConfig: expected,
+	}))
+	qc, err := testPeel.QGetConfig(testCtx, QGetConfigCommand{Queue: queue})
+	require.Nil(t, err)
+	assert.Equal(t, expected, qc)
+
+	// Events are capped at the Retention, but may expire sooner
+	now := time.Now()
+	id, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   now.Add(24 * time.Hour),
+		Contents: testutil.RandStr(),
+	})
+	require.Nil(t, err)
+	assert.WithinDuration(t, now.Add(time.Hour), id.Expire.Time(), time.Second)
+	id2, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   now.Add(time.Minute),
+		Contents: testutil.RandStr(),
+	})
+	require.Nil(t, err)
+	assert.WithinDuration(t, now.Add(time.Minute), id2.Expire.Time(), time.Second)
+
+	// Events without an Expire get the DefaultTTL
+	id3, err := testPeel.QAdd(testCtx, QAddCommand{Queue: queue, Contents: testutil.RandStr()})
+	require.Nil(t, err)
+	assert.WithinDuration(t, now.Add(10*time.Minute), id3.Expire.Time(), time.Second)
+
+	// Paused with the rest of the config
+	e, err := testPeel.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{}, e)
+	expected.Paused = false
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       queue,
+		QueueConfig: expected,
+	}))
+
+	// Retrieved with the AckDeadline despite not being given one, and dead
+	// lettered after the first attempt
+	e, err = testPeel.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, id, e.ID)
+	assert.NotEmpty(t, e.DeliveryToken)
+	pp, err := testPeel.QPendingList(testCtx, QPendingListCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	require.Len(t, pp, 1)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), pp[0].AckDeadline, time.Second)
+
+	ok, err := testPeel.QNack(testCtx, QNackCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       e.ID,
+	})
+	require.Nil(t, err)
+	assert.True(t, ok)
+	dead, _, err := testPeel.QDeadList(testCtx, QDeadListCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, id, dead[0].ID)
+
+	// A zero config resumes the queue along with resetting everything else
+	require.Nil(t, testPeel.QPause(testCtx, QPauseCommand{Queue: queue}))
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{Queue: queue}))
+	qc, err = testPeel.QGetConfig(testCtx, QGetConfigCommand{Queue: queue})
+	require.Nil(t, err)
+	assert.Equal(t, QueueConfig{}, qc)
+}
+
+func TestQAddMaxLength(t *T) {
+	qadd := func(queue string, priority int) (core.ID, error) {
+		return testPeel.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(10 * time.Minute),
+			Contents: testutil.RandStr(),
+			Priority: priority,
+		})
+	}
+
+	newFullQueue := func(qc QueueConfig) (string, []core.ID) {
+		queue, ii := newTestQueue(t, 2)
+		require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+			Queue:       queue,
+			QueueConfig: qc,
+		}))
+		return queue, ii
+	}
+
+	// Reject
+	queue, _ := newFullQueue(QueueConfig{MaxLength: 2})
+	_, err := qadd(queue, 0)
+	assert.Equal(t, ErrQueueFull, err)
+
+	// Delayed events don't count
+	_, err = testPeel.QAdd(testCtx, QAddCommand{
+		Queue:        queue,
+		Expire:       time.Now().Add(10 * time.Minute),
+		Contents:     testutil.RandStr(),
+		VisibleAfter: time.Now().Add(1 * time.Minute),
+	})
+	assert.Nil(t, err)
+
+	// Evict, the lowest priority is evicted first
+	queue, ii := newFullQueue(QueueConfig{MaxLength: 2, Overflow: OverflowEvict})
+	ewAvails, err := queueAvailableBands(queue)
+	require.Nil(t, err)
+
+	id2, err := qadd(queue, 1)
+	require.Nil(t, err)
+	assertKey(t, ewAvails[0].byArb, ii[1])
+	assertKey(t, ewAvails[1].byArb, id2)
+
+	id3, err := qadd(queue, 0)
+	require.Nil(t, err)
+	assertKey(t, ewAvails[0].byArb, id3)
+	assertKey(t, ewAvails[1].byArb, id2)
+
+	// Block, waits until the timeout
+	queue, _ = newFullQueue(QueueConfig{
+		MaxLength:       2,
+		Overflow:        OverflowBlock,
+		OverflowTimeout: 500 * time.Millisecond,
+	})
+	start := time.Now()
+	_, err = qadd(queue, 0)
+	assert.Equal(t, ErrQueueFull, err)
+	assert.True(t, time.Since(start) >= 500*time.Millisecond)
+
+	// Block, succeeds once there's room
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		require.Nil(t, testPeel.QFlush(testCtx, QFlushCommand{Queue: queue}))
+	}()
+	start = time.Now()
+	_, err = qadd(queue, 0)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+func TestQGetRateLimit(t *T) {
+	queue, ii := newTestQueue(t, 4)
+	cgroup := testutil.RandStr()
+
+	rl, err := testPeel.QGetRateLimit(testCtx, QGetRateLimitCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, RateLimit{}, rl)
+
+	expected := RateLimit{Rate: 2, Burst: 2}
+	require.Nil(t, testPeel.QSetRateLimit(testCtx, QSetRateLimitCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		RateLimit:     expected,
+	}))
+	rl, err = testPeel.QGetRateLimit(testCtx, QGetRateLimitCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, expected, rl)
+
+	cmd := QGetMultiCommand{
+		QGetCommand: QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+		},
+		Count: 3,
+	}
+	assertGet := func(expect ...core.ID) {
+		ee, err := testPeel.QGetMulti(testCtx, cmd)
+		require.Nil(t, err)
+		var ids []core.ID
+		for _, e := range ee {
+			ids = append(ids, e.ID)
+		}
+		assert.Equal(t, expect, ids)
+	}
+
+	// Only the burst can be retrieved at first
+	assertGet(ii[0], ii[1])
+	assertGet()
+
+	// Peeking isn't limited
+	e, err := testPeel.QPeek(testCtx, QPeekCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ii[2], e.ID)
+
+	// A blocking QGet returns once the bucket has refilled, even though no new
+	// events were added
+	cmd.Block = 1 * time.Second
+	start := time.Now()
+	assertGet(ii[2])
+	assert.True(t, time.Since(start) < 1*time.Second)
+	cmd.Block = 0
+
+	// Other consumer groups aren't affected
+	cmd.ConsumerGroup = testutil.RandStr()
+	assertGet(ii[:3]...)
+
+	// Removing the limit
+	cmd.ConsumerGroup = cgroup
+	require.Nil(t, testPeel.QSetRateLimit(testCtx, QSetRateLimitCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	}))
+	assertGet(ii[3])
+}
+
+func TestQAddFair(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       queue,
+		QueueConfig: QueueConfig{Fair: true},
+	}))
+
+	qadd := func(partitionKey string) core.ID {
+		id, err := testPeel.QAdd(testCtx, QAddCommand{
+			Queue:        queue,
+			Expire:       time.Now().Add(10 * time.Minute),
+			Contents:     testutil.RandStr(),
+			PartitionKey: partitionKey,
+		})
+		require.Nil(t, err)
+		return id
+	}
+
+	// A burst from one producer, then a single event from another
+	var burst []core.ID
+	for i := 0; i < 3; i++ {
+		burst = append(burst, qadd("a"))
+	}
+	other := qadd("b")
+
+	qsm, err := testPeel.QStatus(testCtx, QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: {cgroup}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(4), qsm[queue].Total)
+	assert.Equal(t, uint64(4), qsm[queue].ConsumerGroupStats[cgroup].Available)
+
+	e, err := testPeel.QPeek(testCtx, QPeekCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Contains(t, []core.ID{burst[0], other}, e.ID)
+
+	qget := func() core.ID {
+		e, err := testPeel.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+		require.Nil(t, err)
+		return e.ID
+	}
+
+	// The other producer's event doesn't wait behind the whole burst
+	first := []core.ID{qget(), qget()}
+	assert.ElementsMatch(t, []core.ID{burst[0], other}, first)
+	assert.Equal(t, burst[1], qget())
+	assert.Equal(t, burst[2], qget())
+	assert.Equal(t, core.ID{}, qget())
+}
+
+func TestQStrictFIFO(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+
+	err := testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       queue,
+		QueueConfig: QueueConfig{StrictFIFO: true, Fair: true},
+	})
+	assert.NotNil(t, err)
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       queue,
+		QueueConfig: QueueConfig{StrictFIFO: true},
+	}))
+	qc, err := testPeel.QGetConfig(testCtx, QGetConfigCommand{Queue: queue})
+	require.Nil(t, err)
+	assert.True(t, qc.StrictFIFO)
+
+	qadd := func(c QAddCommand) (core.ID, error) {
+		c.Queue = queue
+		c.Expire = time.Now().Add(10 * time.Minute)
+		c.Contents = testutil.RandStr()
+		return testPeel.QAdd(testCtx, c)
+	}
+	_, err = qadd(QAddCommand{Priority: 1})
+	assert.Equal(t, ErrStrictFIFO, err)
+	_, err = qadd(QAddCommand{VisibleAfter: time.Now().Add(time.Minute)})
+	assert.Equal(t, ErrStrictFIFO, err)
+
+	var ii []core.ID
+	for i := 0; i < 4; i++ {
+		id, err := qadd(QAddCommand{})
+		require.Nil(t, err)
+		ii = append(ii, id)
+	}
+
+	qget := func(deadline time.Duration) core.Event {
+		e, err := testPeel.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   time.Now().Add(deadline),
+		})
+		require.Nil(t, err)
+		return e
+	}
+	qack := func(e core.Event) {
+		ok, err := testPeel.QAck(testCtx, QAckCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			EventID:       e.ID,
+		})
+		require.Nil(t, err)
+		assert.True(t, ok)
+	}
+
+	// Nothing else is retrieved while an event is in progress, and once it's
+	// nack'd it's retrieved again
+	e := qget(time.Minute)
+	assert.Equal(t, ii[0], e.ID)
+	assert.Equal(t, core.Event{}, qget(time.Minute))
+	pe, err := testPeel.QPeek(testCtx, QPeekCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{}, pe)
+
+	ok, err := testPeel.QNack(testCtx, QNackCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       e.ID,
+	})
+	require.Nil(t, err)
+	assert.True(t, ok)
+	e = qget(time.Minute)
+	assert.Equal(t, ii[0], e.ID)
+	qack(e)
+
+	// An event which misses its deadline is retrieved again by the next QGet,
+	// without waiting for it to be cleaned
+	e = qget(100 * time.Millisecond)
+	assert.Equal(t, ii[1], e.ID)
+	time.Sleep(150 * time.Millisecond)
+	e = qget(time.Minute)
+	assert.Equal(t, ii[1], e.ID)
+	assert.Equal(t, uint64(2), e.Attempts)
+	qack(e)
+
+	// A blocking QGet is woken up once the event in progress is acked
+	e = qget(time.Minute)
+	assert.Equal(t, ii[2], e.ID)
+	doneCh := make(chan core.Event)
+	go func() {
+		e, err := testPeel.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			Block:         5 * time.Second,
+		})
+		require.Nil(t, err)
+		doneCh <- e
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	qack(e)
+	assert.Equal(t, ii[3], (<-doneCh).ID)
+	assert.True(t, time.Since(start) < 1*time.Second)
+}
+
+func TestQReplay(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+
+	// Nothing's kept for replay by default
+	_, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(time.Minute),
+		Contents: testutil.RandStr(),
+	})
+	require.Nil(t, err)
+	n, err := testPeel.QReplay(testCtx, QReplayCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(0), n)
+	require.Nil(t, testPeel.QFlush(testCtx, QFlushCommand{Queue: queue}))
+
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue: queue,
+		QueueConfig: QueueConfig{
+			ReplayRetention: time.Hour,
+			ReplayMaxLength: 2,
+		},
+	}))
+
+	var ii []core.ID
+	var contents []string
+	for i := 0; i < 3; i++ {
+		contents = append(contents, testutil.RandStr())
+		id, err := testPeel.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(50 * time.Millisecond),
+			Contents: contents[i],
+		})
+		require.Nil(t, err)
+		ii = append(ii, id)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	qget := func(cgroup string) core.Event {
+		e, err := testPeel.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+		require.Nil(t, err)
+		return e
+	}
+	assertReplayed := func(cgroup string, contents ...string) {
+		for _, c := range contents {
+			e := qget(cgroup)
+			assert.Equal(t, c, e.Contents)
+			assert.NotContains(t, ii, e.ID)
+		}
+		assert.Equal(t, core.Event{}, qget(cgroup))
+	}
+
+	// The events have expired, but can still be replayed
+	assert.Equal(t, core.Event{}, qget(cgroup))
+	n, err = testPeel.QReplay(testCtx, QReplayCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(3), n)
+	assertReplayed(cgroup, contents...)
+
+	// Only the newest two are kept once the queue's been cleaned, and other
+	// consumer groups can replay from a point in time
+	require.Nil(t, testPeel.CleanAvailable(testCtx, queue))
+	cgroup2 := testutil.RandStr()
+	n, err = testPeel.QReplay(testCtx, QReplayCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup2,
+		From:          ii[2].T.Time(),
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(1), n)
+	assertReplayed(cgroup2, contents[2])
+
+	n, err = testPeel.QReplay(testCtx, QReplayCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(2), n)
+	assertReplayed(cgroup, contents[1:]...)
+}
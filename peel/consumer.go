@@ -0,0 +1,254 @@
+package peel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// AckPolicy determines what a Consumer does with each event once its Handler
+// returns
+type AckPolicy int
+
+const (
+	// AckOnSuccess QAcks events whose Handler returns nil, and QNacks those
+	// whose Handler returns an error, so that they're retried straight away.
+	AckOnSuccess AckPolicy = iota
+
+	// AckAlways QAcks every event once its Handler returns, even if it
+	// returned an error.
+	AckAlways
+
+	// AckNever retrieves events without an AckDeadline, so they're done with
+	// as soon as they're retrieved, and are never retried.
+	AckNever
+)
+
+// ErrDeadLetter may be wrapped by an error returned from a Consumer's Handler to
+// have the event moved to the consumer group's dead set straight away, rather
+// than retried, unless the AckPolicy is AckNever. See QNackCommand's Dead.
+var ErrDeadLetter = errors.New("dead-lettered")
+
+// Default values for the fields of Consumer
+const (
+	consumerDefaultAckDeadline = 30 * time.Second
+	consumerDefaultConcurrency = 1
+)
+
+// Consumer retrieves events from a queue for a consumer group and passes each
+// to a Handler, running up to Concurrency Handlers at once. How events are
+// acked is determined by its AckPolicy. While a Handler is running the
+// event's deadline is periodically extended with QExtend, so Handlers may take
+// longer than AckDeadline.
+//
+//	c := peel.Consumer{
+//		Peel:          p,
+//		Queue:         "foo",
+//		ConsumerGroup: "bar",
+//		Concurrency:   10,
+//		Handler: func(ctx context.Context, e core.Event) error {
+//			return process(e.Contents)
+//		},
+//	}
+//	err := c.Run(ctx)
+type Consumer struct {
+	Peel          *Peel  // Required
+	Queue         string // Required
+	ConsumerGroup string // Required
+
+	// Required. Called with each event, in its own goroutine. The context is
+	// canceled once the Consumer's Run is stopped, or if the event's deadline
+	// couldn't be extended, meaning the rest of the consumer group may
+	// retrieve it again. If it panics the panic is treated as an error.
+	Handler func(context.Context, core.Event) error
+
+	// Default 1. The maximum number of Handlers which may be running at once.
+	// No more events are retrieved than can be handled straight away.
+	Concurrency int
+
+	// Default AckOnSuccess
+	AckPolicy AckPolicy
+
+	// Default 30 seconds. How long the Consumer has to ack each event. The
+	// deadline is extended by this much again, roughly whenever half of it has
+	// passed, for as long as the Handler is running (see Heartbeat). Ignored if
+	// AckPolicy is AckNever.
+	AckDeadline time.Duration
+
+	// Optional. Passed along as the ConsumerID of each QGet. See QPendingList.
+	ConsumerID string
+
+	// Optional. Passed along as the Filter of each QGet, so only events which
+	// match it are handled. See QGetCommand.
+	Filter string
+
+	// Optional. Called with every error encountered, both while retrieving,
+	// acking and extending events and those returned by Handler. Must be safe
+	// to call from multiple goroutines, and must not block.
+	OnError func(error)
+}
+
+func (c Consumer) onError(err error) {
+	if c.OnError != nil {
+		c.OnError(err)
+	}
+}
+
+// Run retrieves and handles events until ctx is done or the Peel starts
+// draining (see Drain). It then waits for all running Handlers to return, and
+// for their events to be acked, before returning. Errors encountered while
+// retrieving events are passed to OnError, and retrieval is retried with an
+// exponential backoff, as with QSubscribe.
+//
+// An error is only returned if the Consumer's fields are invalid.
+func (c Consumer) Run(ctx context.Context) error {
+	if c.Peel == nil || c.Handler == nil {
+		return errors.New("Peel and Handler are required")
+	} else if c.Queue == "" || c.ConsumerGroup == "" {
+		return errors.New("Queue and ConsumerGroup are required")
+	} else if _, _, _, err := queueCGroupKeys(c.Queue, c.ConsumerGroup); err != nil {
+		return err
+	}
+	if c.Filter != "" {
+		if _, err := ParseFilter(c.Filter); err != nil {
+			return err
+		}
+	}
+	if c.Concurrency < 1 {
+		c.Concurrency = consumerDefaultConcurrency
+	}
+	if c.AckDeadline <= 0 {
+		c.AckDeadline = consumerDefaultAckDeadline
+	}
+
+	// handleCtx is canceled along with ctx, but not when the Peel starts
+	// draining, so that a drain lets Handlers finish
+	handleCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	slots := make(chan struct{}, c.Concurrency)
+
+	var backoff time.Duration
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+
+		qget := QGetCommand{
+			Queue:         c.Queue,
+			ConsumerGroup: c.ConsumerGroup,
+			Block:         1 * time.Minute,
+			ConsumerID:    c.ConsumerID,
+			Filter:        c.Filter,
+		}
+		if c.AckPolicy != AckNever {
+			qget.AckTimeout = c.AckDeadline
+		}
+
+		ee, err := c.Peel.qget(ctx, qget, 1)
+		if err != nil && (ctx.Err() != nil || err == ErrDraining) {
+			return nil
+		} else if err != nil {
+			<-slots
+			c.onError(err)
+
+			if backoff *= 2; backoff < subscribeMinBackoff {
+				backoff = subscribeMinBackoff
+			} else if backoff > subscribeMaxBackoff {
+				backoff = subscribeMaxBackoff
+			}
+
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil
+			}
+			continue
+		}
+		backoff = 0
+
+		if len(ee) == 0 {
+			<-slots
+			continue
+		}
+
+		// The event's deadline was set when it was retrieved, which was only
+		// just now, however long qget blocked for
+		deadline := c.Peel.now().Add(c.AckDeadline)
+
+		wg.Add(1)
+		go func(e core.Event) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			c.handle(handleCtx, e, deadline)
+		}(ee[0])
+	}
+}
+
+// handle runs the Handler for the event, extending its deadline while it runs,
+// and then acks or nacks it according to the AckPolicy
+func (c Consumer) handle(ctx context.Context, e core.Event, deadline time.Time) {
+	if c.AckPolicy == AckNever {
+		if err := c.callHandler(ctx, e); err != nil {
+			c.onError(err)
+		}
+		return
+	}
+
+	ctx, stopHeartbeat := c.Peel.Heartbeat(ctx, HeartbeatCommand{
+		Queue:         c.Queue,
+		ConsumerGroup: c.ConsumerGroup,
+		EventID:       e.ID,
+		AckDeadline:   deadline,
+		Extension:     c.AckDeadline,
+		OnError:       c.onError,
+		DeliveryToken: e.DeliveryToken,
+	})
+	err := c.callHandler(ctx, e)
+	stopHeartbeat()
+
+	// The acks and nacks use their own context, since they should still be
+	// done if Run has been stopped
+	if err != nil {
+		c.onError(err)
+	}
+	if err == nil || (c.AckPolicy == AckAlways && !errors.Is(err, ErrDeadLetter)) {
+		_, err = c.Peel.QAck(context.Background(), QAckCommand{
+			Queue:         c.Queue,
+			ConsumerGroup: c.ConsumerGroup,
+			EventID:       e.ID,
+			DeliveryToken: e.DeliveryToken,
+		})
+	} else {
+		_, err = c.Peel.QNack(context.Background(), QNackCommand{
+			Queue:         c.Queue,
+			ConsumerGroup: c.ConsumerGroup,
+			EventID:       e.ID,
+			DeliveryToken: e.DeliveryToken,
+			Error:         err.Error(),
+			Dead:          errors.Is(err, ErrDeadLetter),
+		})
+	}
+	if err != nil {
+		c.onError(err)
+	}
+}
+
+func (c Consumer) callHandler(ctx context.Context, e core.Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+	return c.Handler(ctx, e)
+}
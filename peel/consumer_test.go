@@ -0,0 +1,255 @@
+package peel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runTestConsumer runs the Consumer in the background, returning a function
+// which stops it and waits for Run to return
+func runTestConsumer(t *T, c Consumer) func() {
+	ctx, cancel := context.WithCancel(testCtx)
+	errCh := make(chan error)
+	go func() { errCh <- c.Run(ctx) }()
+	return func() {
+		cancel()
+		select {
+		case err := <-errCh:
+			assert.Nil(t, err)
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "Run didn't return")
+		}
+	}
+}
+
+func requireCGroupStats(t *T, queue, cgroup string, expected ConsumerGroupStats) {
+	qsm, err := testPeel.QStatus(testCtx, QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: {cgroup}},
+	})
+	require.Nil(t, err)
+
+	// Lag depends on when the events were added, so it's only checked to be set
+	// when the consumer group is behind
+	cgs := qsm[queue].ConsumerGroupStats[cgroup]
+	assert.Equal(t, expected.Available > 0, cgs.Lag > 0)
+	cgs.Lag = 0
+	assert.Equal(t, expected, cgs)
+}
+
+func TestConsumerValidate(t *T) {
+	h := func(context.Context, core.Event) error { return nil }
+	assert.NotNil(t, Consumer{Queue: "foo", ConsumerGroup: "bar", Handler: h}.Run(testCtx))
+	assert.NotNil(t, Consumer{Peel: testPeel, Queue: "foo", ConsumerGroup: "bar"}.Run(testCtx))
+	assert.NotNil(t, Consumer{Peel: testPeel, ConsumerGroup: "bar", Handler: h}.Run(testCtx))
+	assert.NotNil(t, Consumer{Peel: testPeel, Queue: "foo", Handler: h}.Run(testCtx))
+}
+
+func TestConsumerConcurrency(t *T) {
+	queue, ii := newTestQueue(t, 5)
+	cgroup := testutil.RandStr()
+
+	var running, maxRunning int64
+	var l sync.Mutex
+	var handled []core.ID
+	unblockCh := make(chan struct{})
+	stop := runTestConsumer(t, Consumer{
+		Peel:          testPeel,
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		Concurrency:   2,
+		Handler: func(ctx context.Context, e core.Event) error {
+			n := atomic.AddInt64(&running, 1)
+			defer atomic.AddInt64(&running, -1)
+			l.Lock()
+			if n > maxRunning {
+				maxRunning = n
+			}
+			handled = append(handled, e.ID)
+			l.Unlock()
+			<-unblockCh
+			return nil
+		},
+	})
+
+	// Only two events are retrieved while the Handlers are blocked
+	time.Sleep(100 * time.Millisecond)
+	requireCGroupStats(t, queue, cgroup, ConsumerGroupStats{Available: 3, InProgress: 2})
+
+	close(unblockCh)
+	time.Sleep(100 * time.Millisecond)
+	stop()
+
+	assert.Equal(t, int64(2), maxRunning)
+	assert.ElementsMatch(t, ii, handled)
+	requireCGroupStats(t, queue, cgroup, ConsumerGroupStats{Done: 5})
+}
+
+func TestConsumerAckPolicy(t *T) {
+	errFailed := errors.New("failed")
+	run := func(policy AckPolicy, handler func(context.Context, core.Event) error) (string, string, []error) {
+		queue, _ := newTestQueue(t, 1)
+		cgroup := testutil.RandStr()
+
+		var l sync.Mutex
+		var errs []error
+		stop := runTestConsumer(t, Consumer{
+			Peel:          testPeel,
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckPolicy:     policy,
+			Handler:       handler,
+			OnError: func(err error) {
+				l.Lock()
+				defer l.Unlock()
+				errs = append(errs, err)
+			},
+		})
+		time.Sleep(100 * time.Millisecond)
+		stop()
+		return queue, cgroup, errs
+	}
+
+	// Fails the first time, then succeeds once it's retried
+	var calls int64
+	queue, cgroup, errs := run(AckOnSuccess, func(context.Context, core.Event) error {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			return errFailed
+		}
+		return nil
+	})
+	assert.Equal(t, int64(2), calls)
+	assert.Equal(t, []error{errFailed}, errs)
+	requireCGroupStats(t, queue, cgroup, ConsumerGroupStats{Done: 1})
+
+	// A panic is treated the same as an error
+	calls = 0
+	queue, cgroup, errs = run(AckOnSuccess, func(context.Context, core.Event) error {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			panic("oh no")
+		}
+		return nil
+	})
+	assert.Equal(t, int64(2), calls)
+	assert.Len(t, errs, 1)
+	requireCGroupStats(t, queue, cgroup, ConsumerGroupStats{Done: 1})
+
+	calls = 0
+	queue, cgroup, errs = run(AckAlways, func(context.Context, core.Event) error {
+		atomic.AddInt64(&calls, 1)
+		return errFailed
+	})
+	assert.Equal(t, int64(1), calls)
+	assert.Equal(t, []error{errFailed}, errs)
+	requireCGroupStats(t, queue, cgroup, ConsumerGroupStats{Done: 1})
+
+	// An error wrapping ErrDeadLetter moves the event to the dead set, even
+	// with AckAlways
+	errDead := fmt.Errorf("%w: %w", ErrDeadLetter, errFailed)
+	for _, policy := range []AckPolicy{AckOnSuccess, AckAlways} {
+		calls = 0
+		queue, cgroup, errs = run(policy, func(context.Context, core.Event) error {
+			atomic.AddInt64(&calls, 1)
+			return errDead
+		})
+		assert.Equal(t, int64(1), calls)
+		assert.Equal(t, []error{errDead}, errs)
+		requireCGroupStats(t, queue, cgroup, ConsumerGroupStats{Dead: 1})
+	}
+
+	calls = 0
+	queue, cgroup, errs = run(AckNever, func(context.Context, core.Event) error {
+		atomic.AddInt64(&calls, 1)
+		return errFailed
+	})
+	assert.Equal(t, int64(1), calls)
+	assert.Equal(t, []error{errFailed}, errs)
+	requireCGroupStats(t, queue, cgroup, ConsumerGroupStats{Done: 1})
+}
+
+func TestConsumerHeartbeat(t *T) {
+	queue, _ := newTestQueue(t, 1)
+	cgroup := testutil.RandStr()
+
+	var calls int64
+	stop := runTestConsumer(t, Consumer{
+		Peel:          testPeel,
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   200 * time.Millisecond,
+		Handler: func(ctx context.Context, e core.Event) error {
+			atomic.AddInt64(&calls, 1)
+			select {
+			case <-time.After(time.Second):
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	})
+
+	// The Handler outlives its original deadline several times over, but the
+	// event is never considered to have missed it
+	time.Sleep(500 * time.Millisecond)
+	_, err := testPeel.QClean(testCtx, QCleanCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	requireCGroupStats(t, queue, cgroup, ConsumerGroupStats{InProgress: 1})
+
+	time.Sleep(700 * time.Millisecond)
+	stop()
+	assert.Equal(t, int64(1), calls)
+	requireCGroupStats(t, queue, cgroup, ConsumerGroupStats{Done: 1})
+}
+
+func TestConsumerDrain(t *T) {
+	p, queue := newTestDrainPeel(t, 2)
+	cgroup := testutil.RandStr()
+
+	startedCh := make(chan struct{}, 2)
+	unblockCh := make(chan struct{})
+	errCh := make(chan error)
+	go func() {
+		errCh <- Consumer{
+			Peel:          p,
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			Concurrency:   2,
+			Handler: func(ctx context.Context, e core.Event) error {
+				startedCh <- struct{}{}
+				<-unblockCh
+				return nil
+			},
+		}.Run(testCtx)
+	}()
+	<-startedCh
+	<-startedCh
+
+	// Run doesn't return until its Handlers are done, and Drain doesn't return
+	// until their events have been acked
+	drainErrCh := make(chan error)
+	go func() { drainErrCh <- p.Drain(testCtx) }()
+	select {
+	case <-errCh:
+		assert.Fail(t, "Run returned early")
+	case <-time.After(2 * drainPollPeriod):
+	}
+
+	close(unblockCh)
+	assert.Nil(t, <-errCh)
+	assert.Nil(t, <-drainErrCh)
+
+	qsm, err := p.QStatus(testCtx, QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: {cgroup}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ConsumerGroupStats{Done: 2}, qsm[queue].ConsumerGroupStats[cgroup])
+}
@@ -0,0 +1,198 @@
+package peel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// Bits which may be set in a stored core.Event's Flags, describing how its
+// Contents were encoded before being stored. They're always cleared before an
+// Event is returned from a Peel method.
+const (
+	flagGzip uint8 = 1 << iota
+	flagEncrypted
+)
+
+// Encrypter is used by Peel to encrypt events' Contents before they're stored,
+// and to decrypt them when they're retrieved, so that they're never stored in
+// plaintext. See Opts.
+type Encrypter interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// ErrNoEncrypter is returned when retrieving an event whose Contents were
+// encrypted, if the Peel has no Encrypter to decrypt them with
+var ErrNoEncrypter = errors.New("event is encrypted but no Encrypter is set")
+
+type aesGCM struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCMEncrypter returns an Encrypter which uses AES-GCM with the given key,
+// which must be 16, 24 or 32 bytes long to use AES-128, AES-192 or AES-256
+// respectively. A random nonce is generated for each encryption and stored
+// alongside the ciphertext.
+func NewAESGCMEncrypter(key []byte) (Encrypter, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aesGCM{aead: aead}, nil
+}
+
+// Encrypt implements the method for the Encrypter interface
+func (a aesGCM) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, a.aead.NonceSize(), a.aead.NonceSize()+len(plaintext)+a.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return a.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt implements the method for the Encrypter interface
+func (a aesGCM) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < a.aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:a.aead.NonceSize()], ciphertext[a.aead.NonceSize():]
+	return a.aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// encodeContents returns a copy of the Event with its Contents encoded
+// according to the Opts, and the Flags set to match.
+func (p *Peel) encodeContents(e core.Event) (core.Event, error) {
+	if p.o.CompressThreshold > 0 && len(e.Contents) >= p.o.CompressThreshold {
+		buf := new(bytes.Buffer)
+		gz := gzip.NewWriter(buf)
+		if _, err := gz.Write([]byte(e.Contents)); err != nil {
+			return core.Event{}, err
+		} else if err := gz.Close(); err != nil {
+			return core.Event{}, err
+		}
+
+		// Not all contents compress well, there's no point in storing a
+		// larger version of them
+		if buf.Len() < len(e.Contents) {
+			e.Contents = buf.String()
+			e.Flags |= flagGzip
+		}
+	}
+
+	// Compressing encrypted data is pointless, so encryption is done last
+	if p.o.Encrypter != nil {
+		b, err := p.o.Encrypter.Encrypt([]byte(e.Contents))
+		if err != nil {
+			return core.Event{}, err
+		}
+		e.Contents = string(b)
+		e.Flags |= flagEncrypted
+	}
+	return e, nil
+}
+
+// decodeContents undoes encodeContents. Events with no Flags set are returned
+// as-is, so events stored before encoding was enabled can still be read.
+func (p *Peel) decodeContents(e core.Event) (core.Event, error) {
+	if e.Flags&flagEncrypted != 0 {
+		if p.o.Encrypter == nil {
+			return core.Event{}, ErrNoEncrypter
+		}
+		b, err := p.o.Encrypter.Decrypt([]byte(e.Contents))
+		if err != nil {
+			return core.Event{}, err
+		}
+		e.Contents = string(b)
+	}
+	if e.Flags&flagGzip != 0 {
+		gz, err := gzip.NewReader(bytes.NewBufferString(e.Contents))
+		if err != nil {
+			return core.Event{}, err
+		}
+		b, err := ioutil.ReadAll(gz)
+		if err != nil {
+			return core.Event{}, err
+		}
+		e.Contents = string(b)
+	}
+	e.Flags = 0
+	return e, nil
+}
+
+// returns copies of the events with their Contents encoded
+func (p *Peel) encodeEvents(ee []core.Event) ([]core.Event, error) {
+	encEE := make([]core.Event, len(ee))
+	for i := range ee {
+		var err error
+		if encEE[i], err = p.encodeContents(ee[i]); err != nil {
+			return nil, err
+		}
+	}
+	return encEE, nil
+}
+
+// setEvents is like core.Core's SetEvents, but encodes the events' Contents
+// first
+func (p *Peel) setEvents(ctx context.Context, ee []core.Event, padding time.Duration) error {
+	encEE, err := p.encodeEvents(ee)
+	if err != nil {
+		return err
+	}
+	return p.c.SetEvents(ctx, encEE, padding)
+}
+
+// getEvents is like core.Core's GetEvents, but decodes the events' Contents.
+// Events in the Peel's event cache are taken from there, see
+// Opts.EventCacheSize.
+func (p *Peel) getEvents(ctx context.Context, ii []core.ID) ([]core.Event, error) {
+	now := p.now()
+	ee := make([]core.Event, len(ii))
+	var missingII []core.ID
+	var missingIdx []int
+	for i, id := range ii {
+		var ok bool
+		if ee[i], ok = p.events.get(id, now); !ok {
+			missingII = append(missingII, id)
+			missingIdx = append(missingIdx, i)
+		}
+	}
+	if len(missingII) == 0 {
+		return ee, nil
+	}
+
+	missingEE, err := p.c.GetEvents(ctx, missingII)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range missingEE {
+		if e, err = p.decodeContents(e); err != nil {
+			return nil, err
+		}
+		p.events.set(e, now)
+		ee[missingIdx[i]] = e
+	}
+	return ee, nil
+}
+
+// getEvent is like core.Core's GetEvent, but decodes the event's Contents
+func (p *Peel) getEvent(ctx context.Context, id core.ID) (core.Event, error) {
+	ee, err := p.getEvents(ctx, []core.ID{id})
+	if err != nil {
+		return core.Event{}, err
+	}
+	return ee[0], nil
+}
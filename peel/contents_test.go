@@ -0,0 +1,114 @@
+package peel
+
+import (
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompress(t *T) {
+	b := core.NewMemBackend()
+	p := NewWithBackend(b, &Opts{CompressThreshold: 100})
+	p.Run(nil)
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+
+	qadd := func(p *Peel, contents string) core.ID {
+		id, err := p.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(1 * time.Minute),
+			Contents: contents,
+		})
+		require.Nil(t, err)
+		return id
+	}
+	assertQGet := func(id core.ID, contents string) {
+		e, err := p.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+		require.Nil(t, err)
+		assert.Equal(t, core.Event{ID: id, Contents: contents}, e)
+	}
+	assertStored := func(id core.ID, flags uint8) core.Event {
+		e, err := p.c.GetEvent(testCtx, id)
+		require.Nil(t, err)
+		assert.Equal(t, flags, e.Flags)
+		return e
+	}
+
+	// Contents below the threshold are stored as-is
+	small := testutil.RandStr()
+	id := qadd(p, small)
+	assert.Equal(t, small, assertStored(id, 0).Contents)
+	assertQGet(id, small)
+
+	// Contents above it are compressed
+	large := strings.Repeat(small, 10)
+	id = qadd(p, large)
+	assert.True(t, len(assertStored(id, flagGzip).Contents) < len(large))
+	assertQGet(id, large)
+
+	// Events stored by a Peel without compression can still be read
+	oldP := NewWithBackend(b, nil)
+	id = qadd(oldP, large)
+	assertStored(id, 0)
+	assertQGet(id, large)
+}
+
+func TestEncrypt(t *T) {
+	_, err := NewAESGCMEncrypter([]byte("too short"))
+	assert.NotNil(t, err)
+
+	enc, err := NewAESGCMEncrypter([]byte(strings.Repeat("k", 32)))
+	require.Nil(t, err)
+
+	b := core.NewMemBackend()
+	p := NewWithBackend(b, &Opts{Encrypter: enc, CompressThreshold: 100})
+	p.Run(nil)
+	queue := testutil.RandStr()
+
+	qadd := func(p *Peel, contents string) core.ID {
+		id, err := p.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(1 * time.Minute),
+			Contents: contents,
+		})
+		require.Nil(t, err)
+		return id
+	}
+	qget := func(p *Peel) (core.Event, error) {
+		return p.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: testutil.RandStr(),
+		})
+	}
+
+	// The contents are never stored in plaintext, even when compressed
+	for _, contents := range []string{testutil.RandStr(), strings.Repeat("a", 200)} {
+		id := qadd(p, contents)
+		stored, err := p.c.GetEvent(testCtx, id)
+		require.Nil(t, err)
+		assert.NotContains(t, stored.Contents, contents)
+		assert.NotEqual(t, uint8(0), stored.Flags&flagEncrypted)
+
+		e, err := p.QPeek(testCtx, QPeekCommand{Queue: queue, ConsumerGroup: testutil.RandStr()})
+		require.Nil(t, err)
+		assert.Equal(t, core.Event{ID: id, Contents: contents}, e)
+
+		// A Peel without the Encrypter can't read them
+		_, err = qget(NewWithBackend(b, nil))
+		assert.Equal(t, ErrNoEncrypter, err)
+
+		require.Nil(t, p.QFlush(testCtx, QFlushCommand{Queue: queue}))
+	}
+
+	// Events stored without encryption can still be read
+	contents := testutil.RandStr()
+	id := qadd(NewWithBackend(b, nil), contents)
+	e, err := qget(p)
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{ID: id, Contents: contents}, e)
+}
@@ -0,0 +1,161 @@
+package peel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed standard five field cron expression (minute, hour,
+// day of month, month, day of week). Each field is stored as a bitset of the
+// values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// If either day field was given as "*" then only the other one is used to
+	// match days. Otherwise a day matches if either field matches it, as in
+	// normal cron.
+	domStar, dowStar bool
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a standard five field cron expression. Each field may be
+// "*", a number, a range ("1-5"), any of those with a step ("*/15", "1-30/2"),
+// or a comma separated list of any of the above. The descriptors @yearly,
+// @monthly, @weekly, @daily and @hourly are also supported. For the day of
+// week field both 0 and 7 mean Sunday.
+func parseCron(expr string) (cronSchedule, error) {
+	if d, ok := cronDescriptors[strings.TrimSpace(expr)]; ok {
+		expr = d
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+
+	var cs cronSchedule
+	var err error
+	if cs.minute, _, err = parseCronField(fields[0], 0, 59); err != nil {
+		return cronSchedule{}, err
+	}
+	if cs.hour, _, err = parseCronField(fields[1], 0, 23); err != nil {
+		return cronSchedule{}, err
+	}
+	if cs.dom, cs.domStar, err = parseCronField(fields[2], 1, 31); err != nil {
+		return cronSchedule{}, err
+	}
+	if cs.month, _, err = parseCronField(fields[3], 1, 12); err != nil {
+		return cronSchedule{}, err
+	}
+	if cs.dow, cs.dowStar, err = parseCronField(fields[4], 0, 7); err != nil {
+		return cronSchedule{}, err
+	}
+
+	// Sunday can be given as either 0 or 7
+	if cs.dow&(1<<7) != 0 {
+		cs.dow |= 1
+	}
+	return cs, nil
+}
+
+// returns the bitset of values matched by the field, and whether the field was
+// "*"
+func parseCronField(field string, min, max int) (uint64, bool, error) {
+	if field == "*" {
+		return cronRange(min, max, 1), true, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, false, fmt.Errorf("invalid step in cron field %q", field)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			var err error
+			loStr, hiStr := part, part
+			if i := strings.Index(part, "-"); i >= 0 {
+				loStr, hiStr = part[:i], part[i+1:]
+			} else if step > 1 {
+				// "5/15" means starting at 5, every 15
+				hiStr = strconv.Itoa(max)
+			}
+			if lo, err = strconv.Atoi(loStr); err != nil {
+				return 0, false, fmt.Errorf("invalid value in cron field %q", field)
+			}
+			if hi, err = strconv.Atoi(hiStr); err != nil {
+				return 0, false, fmt.Errorf("invalid value in cron field %q", field)
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, false, fmt.Errorf("cron field %q out of range %d-%d", field, min, max)
+		}
+		bits |= cronRange(lo, hi, step)
+	}
+	return bits, false, nil
+}
+
+func cronRange(lo, hi, step int) uint64 {
+	var bits uint64
+	for i := lo; i <= hi; i += step {
+		bits |= 1 << uint(i)
+	}
+	return bits
+}
+
+func (cs cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := cs.dom&(1<<uint(t.Day())) != 0
+	dowMatch := cs.dow&(1<<uint(t.Weekday())) != 0
+	if cs.domStar || cs.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// next returns the first time strictly after t which the schedule matches, in
+// t's location. The zero time is returned if there isn't one within the next
+// five years (e.g. for "0 0 30 2 *").
+func (cs cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if cs.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !cs.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if cs.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if cs.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
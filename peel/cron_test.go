@@ -0,0 +1,74 @@
+package peel
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCron(t *T) {
+	cs, err := parseCron("*/15 9-17 * * 1-5")
+	require.Nil(t, err)
+	assert.Equal(t, cronRange(0, 59, 15), cs.minute)
+	assert.Equal(t, cronRange(9, 17, 1), cs.hour)
+	assert.True(t, cs.domStar)
+	assert.False(t, cs.dowStar)
+	assert.Equal(t, cronRange(1, 5, 1), cs.dow)
+
+	cs, err = parseCron("0,30 5/6 1 1,6 7")
+	require.Nil(t, err)
+	assert.Equal(t, uint64(1|1<<30), cs.minute)
+	assert.Equal(t, uint64(1<<5|1<<11|1<<17|1<<23), cs.hour)
+	assert.Equal(t, uint64(1<<1|1<<6), cs.month)
+	assert.Equal(t, uint64(1|1<<7), cs.dow)
+
+	cs2, err := parseCron("@daily")
+	require.Nil(t, err)
+	cs, err = parseCron("0 0 * * *")
+	require.Nil(t, err)
+	assert.Equal(t, cs, cs2)
+
+	for _, bad := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	} {
+		_, err := parseCron(bad)
+		assert.NotNil(t, err, "expr:%q", bad)
+	}
+}
+
+func TestCronNext(t *T) {
+	at := func(s string) time.Time {
+		tt, err := time.Parse("2006-01-02 15:04", s)
+		require.Nil(t, err)
+		return tt
+	}
+
+	assertNext := func(expr, from, expect string) {
+		cs, err := parseCron(expr)
+		require.Nil(t, err)
+		if expect == "" {
+			assert.True(t, cs.next(at(from)).IsZero(), "expr:%q", expr)
+			return
+		}
+		assert.Equal(t, at(expect), cs.next(at(from)), "expr:%q", expr)
+	}
+
+	assertNext("* * * * *", "2016-01-01 00:00", "2016-01-01 00:01")
+	assertNext("*/15 * * * *", "2016-01-01 00:15", "2016-01-01 00:30")
+	assertNext("0 * * * *", "2016-01-01 23:30", "2016-01-02 00:00")
+	assertNext("30 9 * * 1-5", "2016-01-01 10:00", "2016-01-04 09:30") // fri -> mon
+	assertNext("0 0 29 2 *", "2016-03-01 00:00", "2020-02-29 00:00")
+	assertNext("0 0 1 * 0", "2016-01-01 00:00", "2016-01-03 00:00") // dom or dow
+	assertNext("0 0 31 12 *", "2016-12-31 00:00", "2017-12-31 00:00")
+	assertNext("0 0 30 2 *", "2016-01-01 00:00", "")
+}
@@ -0,0 +1,156 @@
+package peel
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// ErrDraining is returned by QGet and QGetMulti once Drain has been called
+var ErrDraining = errors.New("peel is draining")
+
+// How often Drain checks whether all in-flight events have been acked
+const drainPollPeriod = 100 * time.Millisecond
+
+type inFlightKey struct {
+	queue, consumerGroup string
+	id                   core.ID
+}
+
+type inFlightEvent struct {
+	deadline time.Time
+	token    string
+}
+
+// inFlight keeps track of the events which were retrieved through a Peel with
+// an AckDeadline, and which haven't yet been acked or nacked through it, along
+// with their deadlines and delivery tokens. Once an event's deadline has passed
+// it's no longer in flight, since it'll be retried by someone else anyway.
+type inFlight struct {
+	l sync.Mutex
+	m map[inFlightKey]inFlightEvent
+
+	// Expired events are pruned when the map grows to this size, so it
+	// doesn't grow forever if consumers never ack
+	pruneAt int
+}
+
+const inFlightMinPruneAt = 1024
+
+func newInFlight() *inFlight {
+	return &inFlight{
+		m:       map[inFlightKey]inFlightEvent{},
+		pruneAt: inFlightMinPruneAt,
+	}
+}
+
+// must be called with l held
+func (f *inFlight) prune(now time.Time) {
+	for k, e := range f.m {
+		if !now.Before(e.deadline) {
+			delete(f.m, k)
+		}
+	}
+}
+
+func (f *inFlight) add(queue, consumerGroup string, ii []core.ID, deadline time.Time, token string) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	for _, id := range ii {
+		f.m[inFlightKey{queue, consumerGroup, id}] = inFlightEvent{deadline, token}
+	}
+	if len(f.m) >= f.pruneAt {
+		f.prune(time.Now())
+		if f.pruneAt = len(f.m) * 2; f.pruneAt < inFlightMinPruneAt {
+			f.pruneAt = inFlightMinPruneAt
+		}
+	}
+}
+
+func (f *inFlight) remove(queue, consumerGroup string, ii ...core.ID) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	for _, id := range ii {
+		delete(f.m, inFlightKey{queue, consumerGroup, id})
+	}
+}
+
+// extend changes the deadline of the event, if it's in flight
+func (f *inFlight) extend(queue, consumerGroup string, id core.ID, deadline time.Time) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	k := inFlightKey{queue, consumerGroup, id}
+	if e, ok := f.m[k]; ok {
+		e.deadline = deadline
+		f.m[k] = e
+	}
+}
+
+// pending returns all events which are still in flight, along with their
+// delivery tokens
+func (f *inFlight) pending() map[inFlightKey]string {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.prune(time.Now())
+	m := make(map[inFlightKey]string, len(f.m))
+	for k, e := range f.m {
+		m[k] = e.token
+	}
+	return m
+}
+
+// Draining returns whether Drain has been called on the Peel
+func (p *Peel) Draining() bool {
+	select {
+	case <-p.drainCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Drain prepares the Peel to be shut down without abandoning the events it has
+// handed out. From when it's called QGet and QGetMulti return ErrDraining,
+// including calls which were already blocking, and so subscriptions created
+// with QSubscribe stop retrieving events and close their channels.
+//
+// Drain then waits until every event which was retrieved through the Peel with
+// an AckDeadline has been QAck'd or QNack'd through it, or its deadline has
+// passed, and returns nil. If ctx is done first the remaining events are
+// QNack'd, so the rest of their consumer groups can retrieve them straight
+// away rather than waiting for their deadlines, and ctx's error is returned.
+//
+// Drain may be called more than once, but there's no way to stop draining
+// once it's started. Healthy reports the Peel as unhealthy while draining.
+func (p *Peel) Drain(ctx context.Context) error {
+	p.drainOnce.Do(func() { close(p.drainCh) })
+
+	tick := time.NewTicker(drainPollPeriod)
+	defer tick.Stop()
+	for {
+		pending := p.inFlight.pending()
+		if len(pending) == 0 {
+			return nil
+		}
+
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			for k, token := range pending {
+				// ctx is done, so the nack can't use it. There's nothing to be
+				// done about an error, the event will be retried once its
+				// deadline passes anyway.
+				p.QNack(context.Background(), QNackCommand{
+					Queue:         k.queue,
+					ConsumerGroup: k.consumerGroup,
+					EventID:       k.id,
+					DeliveryToken: token,
+				})
+			}
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package peel
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Draining can't be undone, so each test uses its own Peel rather than testPeel
+func newTestDrainPeel(t *T, n int) (*Peel, string) {
+	p := NewWithBackend(core.NewMemBackend(), nil)
+	p.Run(nil)
+	queue := testutil.RandStr()
+	for i := 0; i < n; i++ {
+		_, err := p.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(time.Minute),
+			Contents: testutil.RandStr(),
+		})
+		require.Nil(t, err)
+	}
+	return p, queue
+}
+
+func TestDrain(t *T) {
+	p, queue := newTestDrainPeel(t, 2)
+	cgroup := testutil.RandStr()
+	qget := QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(time.Minute),
+	}
+	e1, err := p.QGet(testCtx, qget)
+	require.Nil(t, err)
+	e2, err := p.QGet(testCtx, qget)
+	require.Nil(t, err)
+	_, err = p.QExtend(testCtx, QExtendCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       e2.ID,
+		AckDeadline:   time.Now().Add(2 * time.Minute),
+	})
+	require.Nil(t, err)
+
+	// A QGet which is already blocking is stopped by the drain
+	blockErrCh := make(chan error)
+	go func() {
+		_, err := p.QGet(testCtx, QGetCommand{
+			Queue:         testutil.RandStr(),
+			ConsumerGroup: cgroup,
+			Block:         time.Minute,
+		})
+		blockErrCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	drainErrCh := make(chan error)
+	go func() { drainErrCh <- p.Drain(testCtx) }()
+	assert.Equal(t, ErrDraining, <-blockErrCh)
+	assert.True(t, p.Draining())
+	assert.False(t, p.Healthy(testCtx).Healthy)
+
+	_, err = p.QGet(testCtx, qget)
+	assert.Equal(t, ErrDraining, err)
+
+	// Drain doesn't return until both events are done with
+	acked, err := p.QAck(testCtx, QAckCommand{Queue: queue, ConsumerGroup: cgroup, EventID: e1.ID})
+	require.Nil(t, err)
+	assert.True(t, acked)
+	select {
+	case <-drainErrCh:
+		assert.Fail(t, "Drain returned early")
+	case <-time.After(2 * drainPollPeriod):
+	}
+
+	nacked, err := p.QNack(testCtx, QNackCommand{Queue: queue, ConsumerGroup: cgroup, EventID: e2.ID})
+	require.Nil(t, err)
+	assert.True(t, nacked)
+	select {
+	case err := <-drainErrCh:
+		assert.Nil(t, err)
+	case <-time.After(2 * drainPollPeriod):
+		assert.Fail(t, "Drain didn't return")
+	}
+}
+
+func TestDrainTimeout(t *T) {
+	p, queue := newTestDrainPeel(t, 3)
+	cgroup := testutil.RandStr()
+
+	ch, stop, err := p.QSubscribe(testCtx, QSubscribeCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Minute,
+	})
+	require.Nil(t, err)
+	defer stop()
+
+	// One event is read off the channel but never acked, and the subscription
+	// retrieves another which it's waiting to send
+	<-ch
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(testCtx, 3*drainPollPeriod)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, p.Drain(ctx))
+
+	// The subscription was stopped, and both events were nacked so they can be
+	// retrieved again straight away
+	_, ok := <-ch
+	assert.False(t, ok)
+
+	qsm, err := p.QStatus(testCtx, QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: {cgroup}},
+	})
+	require.Nil(t, err)
+	cgs := qsm[queue].ConsumerGroupStats[cgroup]
+	assert.NotZero(t, cgs.Lag)
+	cgs.Lag = 0
+	assert.Equal(t, ConsumerGroupStats{Available: 1, Redo: 2}, cgs)
+}
@@ -0,0 +1,94 @@
+package peel
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+type eventCacheEntry struct {
+	e      core.Event
+	expire time.Time
+}
+
+// eventCache keeps the most recently retrieved events, with their Contents
+// already decoded, so that retrieving the same events again doesn't need a
+// round trip. An event is never changed once it's been stored, so entries only
+// need to be dropped once they're too old or the event itself has expired. A
+// nil eventCache caches nothing.
+type eventCache struct {
+	l    sync.Mutex
+	size int
+	ttl  time.Duration
+
+	// The front of ll is the most recently used entry. Each element's Value is
+	// an eventCacheEntry.
+	ll *list.List
+	m  map[core.ID]*list.Element
+}
+
+// returns nil if size is 0
+func newEventCache(size int, ttl time.Duration) *eventCache {
+	if size <= 0 {
+		return nil
+	}
+	return &eventCache{
+		size: size,
+		ttl:  ttl,
+		ll:   list.New(),
+		m:    map[core.ID]*list.Element{},
+	}
+}
+
+func (ec *eventCache) get(id core.ID, now time.Time) (core.Event, bool) {
+	if ec == nil {
+		return core.Event{}, false
+	}
+	ec.l.Lock()
+	defer ec.l.Unlock()
+	el, ok := ec.m[id]
+	if !ok {
+		return core.Event{}, false
+	}
+	entry := el.Value.(eventCacheEntry)
+	if !now.Before(entry.expire) {
+		ec.ll.Remove(el)
+		delete(ec.m, id)
+		return core.Event{}, false
+	}
+	ec.ll.MoveToFront(el)
+	return entry.e, true
+}
+
+// the event's Attempts and DeliveryToken aren't cached, since they're specific
+// to whichever retrieval of it set them
+func (ec *eventCache) set(e core.Event, now time.Time) {
+	if ec == nil {
+		return
+	}
+	expire := now.Add(ec.ttl)
+	if eventExpire := e.ID.Expire.Time(); eventExpire.Before(expire) {
+		expire = eventExpire
+	}
+	if !now.Before(expire) {
+		return
+	}
+	e.Attempts, e.DeliveryToken = 0, ""
+
+	ec.l.Lock()
+	defer ec.l.Unlock()
+	entry := eventCacheEntry{e: e, expire: expire}
+	if el, ok := ec.m[e.ID]; ok {
+		el.Value = entry
+		ec.ll.MoveToFront(el)
+		return
+	}
+	ec.m[e.ID] = ec.ll.PushFront(entry)
+	for ec.ll.Len() > ec.size {
+		el := ec.ll.Back()
+		ec.ll.Remove(el)
+		delete(ec.m, el.Value.(eventCacheEntry).e.ID)
+	}
+}
@@ -0,0 +1,109 @@
+package peel
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventCache(t *T) {
+	now := time.Now()
+	newEvent := func(expire time.Duration) core.Event {
+		return core.Event{
+			ID:       core.ID{T: core.NewTS(now), Expire: core.NewTS(now.Add(expire))},
+			Contents: testutil.RandStr(),
+		}
+	}
+
+	ec := newEventCache(2, time.Minute)
+	e1, e2, e3 := newEvent(time.Hour), newEvent(time.Hour), newEvent(time.Hour)
+	e1.ID.T++
+	e2.ID.T += 2
+	ec.set(e1, now)
+	ec.set(e2, now)
+
+	// e1 was used more recently than e2, so e2 is dropped to make room for e3
+	_, ok := ec.get(e1.ID, now)
+	assert.True(t, ok)
+	ec.set(e3, now)
+	e, ok := ec.get(e1.ID, now)
+	assert.True(t, ok)
+	assert.Equal(t, e1, e)
+	_, ok = ec.get(e2.ID, now)
+	assert.False(t, ok)
+
+	// Entries are dropped once the TTL has passed
+	_, ok = ec.get(e3.ID, now.Add(time.Minute-time.Second))
+	assert.True(t, ok)
+	_, ok = ec.get(e3.ID, now.Add(time.Minute))
+	assert.False(t, ok)
+
+	// or once the event has expired
+	e4 := newEvent(time.Second)
+	e4.DeliveryToken = testutil.RandStr()
+	ec.set(e4, now)
+	e, ok = ec.get(e4.ID, now)
+	assert.True(t, ok)
+	assert.Empty(t, e.DeliveryToken)
+	_, ok = ec.get(e4.ID, now.Add(time.Second))
+	assert.False(t, ok)
+
+	// A nil eventCache caches nothing
+	ec = newEventCache(0, time.Minute)
+	ec.set(e1, now)
+	_, ok = ec.get(e1.ID, now)
+	assert.False(t, ok)
+}
+
+func TestEventCachePeel(t *T) {
+	th := &testHook{}
+	clock := core.NewManualClock(time.Now())
+	p := NewMem(clock, &Opts{
+		Opts:           core.Opts{Hook: th},
+		EventCacheSize: 10,
+		EventCacheTTL:  time.Minute,
+	})
+	p.Run(nil)
+	queue := testutil.RandStr()
+
+	getEvents := func() int {
+		th.l.Lock()
+		defer th.l.Unlock()
+		var n int
+		for _, s := range th.ss {
+			if s.Name == "GetEvents" {
+				n++
+			}
+		}
+		return n
+	}
+
+	contents := testutil.RandStr()
+	id, err := p.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   clock.Now().Add(2 * time.Minute),
+		Contents: contents,
+	})
+	require.Nil(t, err)
+
+	// Only the first consumer group's QGet has to fetch the event
+	qget := func() {
+		e, err := p.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: testutil.RandStr()})
+		require.Nil(t, err)
+		assert.Equal(t, id, e.ID)
+		assert.Equal(t, contents, e.Contents)
+	}
+	qget()
+	assert.Equal(t, 1, getEvents())
+	qget()
+	assert.Equal(t, 1, getEvents())
+
+	// Once the TTL has passed it's fetched again
+	clock.Advance(time.Minute)
+	qget()
+	assert.Equal(t, 2, getEvents())
+}
@@ -0,0 +1,559 @@
+package peel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// SnapshotVersion is the version of the snapshot format written by Export.
+// Import only reads snapshots of this version.
+const SnapshotVersion = 1
+
+// A snapshot is JSON lines. The first line is a snapshotHeader, and each line
+// after it is a snapshotRecord. Records holding keys which aren't sets come
+// first, then the queue's events, then its sets, so that when they're imported
+// in order the queue's config is known before its events are stored, and no set
+// refers to an event which hasn't been stored yet.
+
+type snapshotHeader struct {
+	Version        int       `json:"version"`
+	Queue          string    `json:"queue"`
+	ConsumerGroups []string  `json:"consumerGroups"`
+	Created        time.Time `json:"created"`
+}
+
+// The kinds of key held by a snapshot
+const (
+	snapshotSet    = "set"
+	snapshotExWrap = "exwrap" // only byArb is held, byExp is rebuilt from it
+	snapshotSingle = "single"
+	snapshotHash   = "hash"
+)
+
+type snapshotMember struct {
+	ID    string  `json:"id"`
+	Score core.TS `json:"score"`
+}
+
+// Subs are relative to the queue, so a snapshot can be imported into a queue
+// with a different name
+type snapshotKey struct {
+	Subs    []string          `json:"subs"`
+	Kind    string            `json:"kind"`
+	Members []snapshotMember  `json:"members,omitempty"`
+	ID      string            `json:"id,omitempty"`
+	Hash    map[string]string `json:"hash,omitempty"`
+}
+
+type snapshotEvent struct {
+	ID           string `json:"id"`
+	Contents     string `json:"contents"`
+	ReplyTo      string `json:"replyTo,omitempty"`
+	InReplyTo    string `json:"inReplyTo,omitempty"`
+	TraceContext string `json:"traceContext,omitempty"`
+}
+
+// Only one field is set on each record
+type snapshotRecord struct {
+	Event *snapshotEvent `json:"event,omitempty"`
+	Key   *snapshotKey   `json:"key,omitempty"`
+}
+
+type snapshotKindKey struct {
+	key  core.Key
+	kind string
+}
+
+// returns every key of the queue which a snapshot holds, given its consumer
+// groups. Dedup keys, results and consumers are left out, since they only live
+// for a short while anyway.
+func snapshotKeys(queue string, cgroups []string) ([]snapshotKindKey, error) {
+	var kks []snapshotKindKey
+	addEWs := func(ews ...exWrap) {
+		for _, ew := range ews {
+			kks = append(kks, snapshotKindKey{ew.byArb, snapshotExWrap})
+		}
+	}
+	addKeys := func(kind string, kk ...core.Key) {
+		for _, k := range kk {
+			kks = append(kks, snapshotKindKey{k, kind})
+		}
+	}
+
+	for _, fn := range []func(string) ([]exWrap, error){
+		queueAvailableBands, queueDelayedBands, queueFairBacklogs, queueGroups,
+	} {
+		ews, err := fn(queue)
+		if err != nil {
+			return nil, err
+		}
+		addEWs(ews...)
+	}
+
+	keyReplay, err := queueReplay(queue)
+	if err != nil {
+		return nil, err
+	}
+	keyTraces, err := queueTraces(queue, "")
+	if err != nil {
+		return nil, err
+	}
+	addKeys(snapshotSet, append(keyTraces, keyReplay)...)
+
+	keyPaused, err := queuePaused(queue)
+	if err != nil {
+		return nil, err
+	}
+	keyStrict, err := queueStrict(queue)
+	if err != nil {
+		return nil, err
+	}
+	addKeys(snapshotSingle, keyPaused, keyStrict)
+
+	keyConfig, err := queueConfig(queue)
+	if err != nil {
+		return nil, err
+	}
+	addKeys(snapshotHash, keyConfig)
+
+	for _, cgroup := range cgroups {
+		ewInProg, ewRedo, _, err := queueCGroupKeys(queue, cgroup)
+		if err != nil {
+			return nil, err
+		}
+		ewAttempts, ewDead, err := queueDeadLetterKeys(queue, cgroup)
+		if err != nil {
+			return nil, err
+		}
+		ewDeliveries, err := queueDeliveries(queue, cgroup)
+		if err != nil {
+			return nil, err
+		}
+		keyGroupPtrs, ewGroupInProgs, err := queueGroupCGroupKeys(queue, cgroup)
+		if err != nil {
+			return nil, err
+		}
+		addEWs(ewInProg, ewRedo, ewAttempts, ewDead, ewDeliveries)
+		addEWs(ewGroupInProgs...)
+
+		keyPtrs, err := queuePointerBands(queue, cgroup)
+		if err != nil {
+			return nil, err
+		}
+		addKeys(snapshotSingle, append(keyPtrs, keyGroupPtrs...)...)
+
+		keyTraces, err := queueTraces(queue, cgroup)
+		if err != nil {
+			return nil, err
+		}
+		addKeys(snapshotSet, keyTraces...)
+
+		for _, fn := range []func(string, string) (core.Key, error){
+			queueClaims, queueErrors, queueRateLimit,
+		} {
+			k, err := fn(queue, cgroup)
+			if err != nil {
+				return nil, err
+			}
+			addKeys(snapshotHash, k)
+		}
+	}
+	return kks, nil
+}
+
+func isSnapshotSet(kind string) bool {
+	return kind == snapshotSet || kind == snapshotExWrap
+}
+
+// Export writes a snapshot of the given queue to w: its events, along with the
+// sets, pointers and hashes which make up the state of the queue and of each of
+// its consumer groups, including the scores of everything in its sets. The
+// snapshot can be given to Import to recreate the queue as it was, in this
+// redis or another, e.g. to recover from a disaster or to clone an environment.
+//
+// The snapshot is a versioned JSON lines format (see SnapshotVersion). Events'
+// contents are written as they were added, i.e. they are decompressed and
+// decrypted first. The queue is read a little at a time rather than
+// atomically, so it shouldn't be used while it's exported, see QPause. Like
+// most commands Export acts on the queue it's given as-is, so each shard of a
+// sharded queue (see QueueConfig's Shards) is exported separately.
+func (p *Peel) Export(ctx context.Context, queue string, w io.Writer) (err error) {
+	ctx, end := p.start(ctx, "Export", queue, "")
+	var n int
+	defer end(&err, func() int { return n })
+	n, err = p.export(ctx, queue, w)
+	return err
+}
+
+func (p *Peel) export(ctx context.Context, queue string, w io.Writer) (int, error) {
+	cgroups, err := p.queueConsumerGroups(ctx, queue)
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(cgroups)
+
+	kks, err := snapshotKeys(queue, cgroups)
+	if err != nil {
+		return 0, err
+	}
+
+	var sks []*snapshotKey
+	idsM := map[core.ID]bool{}
+	for _, kk := range kks {
+		sk, err := p.exportKey(ctx, kk)
+		if err != nil {
+			return 0, err
+		} else if sk == nil {
+			continue
+		}
+		for _, m := range sk.Members {
+			id, err := core.IDFromString(m.ID)
+			if err != nil {
+				return 0, err
+			}
+			idsM[id] = true
+		}
+		sks = append(sks, sk)
+	}
+
+	ids := make([]core.ID, 0, len(idsM))
+	for id := range idsM {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].T < ids[j].T })
+
+	enc := json.NewEncoder(w)
+	err = enc.Encode(snapshotHeader{
+		Version:        SnapshotVersion,
+		Queue:          queue,
+		ConsumerGroups: cgroups,
+		Created:        p.now().UTC(),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, sk := range sks {
+		if isSnapshotSet(sk.Kind) {
+			continue
+		} else if err := enc.Encode(snapshotRecord{Key: sk}); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > 100 {
+			batch = batch[:100]
+		}
+		ids = ids[len(batch):]
+
+		ee, err := p.exportEvents(ctx, batch)
+		if err != nil {
+			return n, err
+		}
+		for _, e := range ee {
+			se := &snapshotEvent{
+				ID:           e.ID.String(),
+				Contents:     e.Contents,
+				ReplyTo:      e.ReplyTo,
+				TraceContext: e.TraceContext,
+			}
+			if e.InReplyTo != (core.ID{}) {
+				se.InReplyTo = e.InReplyTo.String()
+			}
+			if err := enc.Encode(snapshotRecord{Event: se}); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+
+	for _, sk := range sks {
+		if !isSnapshotSet(sk.Kind) {
+			continue
+		} else if err := enc.Encode(snapshotRecord{Key: sk}); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// returns the key's contents, or nil if it's empty
+func (p *Peel) exportKey(ctx context.Context, kk snapshotKindKey) (*snapshotKey, error) {
+	sk := &snapshotKey{Subs: kk.key.Subs, Kind: kk.kind}
+	switch kk.kind {
+	case snapshotHash:
+		m, err := p.c.HashGetAll(ctx, kk.key)
+		if err != nil {
+			return nil, err
+		} else if len(m) == 0 {
+			return nil, nil
+		}
+		sk.Hash = m
+
+	case snapshotSingle:
+		res, err := p.c.Query(ctx, core.QueryActions{
+			KeyBase:      kk.key.Base,
+			QueryActions: []core.QueryAction{{SingleGet: &kk.key}},
+		})
+		if err != nil {
+			return nil, err
+		} else if len(res.IDs) == 0 {
+			return nil, nil
+		}
+		sk.ID = res.IDs[0].String()
+
+	default:
+		const limit = 1000
+		for offset := int64(0); ; offset += limit {
+			res, err := p.c.Query(ctx, core.QueryActions{
+				KeyBase: kk.key.Base,
+				QueryActions: []core.QueryAction{
+					{
+						QuerySelector: &core.QuerySelector{
+							Key: kk.key,
+							QueryRangeSelect: &core.QueryRangeSelect{
+								Limit:  limit,
+								Offset: offset,
+							},
+						},
+					},
+					{ScoresFrom: &kk.key},
+				},
+			})
+			if err != nil {
+				return nil, err
+			}
+			for i, id := range res.IDs {
+				sk.Members = append(sk.Members, snapshotMember{
+					ID:    id.String(),
+					Score: core.TS(res.Counts[i]),
+				})
+			}
+			if len(res.IDs) < limit {
+				break
+			}
+		}
+		if len(sk.Members) == 0 {
+			return nil, nil
+		}
+	}
+	return sk, nil
+}
+
+// returns the events with the given IDs, leaving out any which are no longer
+// stored
+func (p *Peel) exportEvents(ctx context.Context, ii []core.ID) ([]core.Event, error) {
+	ee, err := p.getEvents(ctx, ii)
+	if err != core.ErrNotFound {
+		return ee, err
+	}
+
+	ee = nil
+	for _, id := range ii {
+		e, err := p.getEvent(ctx, id)
+		if err == core.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ee = append(ee, e)
+	}
+	return ee, nil
+}
+
+// Import recreates a queue from a snapshot written by Export. If queue is
+// empty the snapshot is imported into the queue it was exported from,
+// otherwise it's imported into the given one. The queue being imported into
+// must not have anything in it, including config, which is checked before
+// anything is imported. Events' contents are compressed and encrypted
+// according to this Peel's Opts as they're imported.
+//
+// If an error is returned part of the snapshot may already have been imported.
+func (p *Peel) Import(ctx context.Context, queue string, r io.Reader) (err error) {
+	ctx, end := p.start(ctx, "Import", queue, "")
+	var n int
+	defer end(&err, func() int { return n })
+	n, err = p.qimport(ctx, queue, r)
+	return err
+}
+
+func (p *Peel) qimport(ctx context.Context, queue string, r io.Reader) (int, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var h snapshotHeader
+	if err := dec.Decode(&h); err != nil {
+		return 0, fmt.Errorf("reading snapshot header: %w", err)
+	} else if h.Version != SnapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", h.Version)
+	} else if queue == "" {
+		queue = h.Queue
+	}
+	if queue == "" {
+		return 0, errors.New("snapshot has no queue, one must be given")
+	}
+
+	scanK, err := queueKeyMarshal(core.Key{Base: queue, Subs: []string{"*"}})
+	if err != nil {
+		return 0, err
+	}
+	if kk, err := p.c.KeyScan(ctx, scanK); err != nil {
+		return 0, err
+	} else if len(kk) > 0 {
+		return 0, fmt.Errorf("queue %q must be empty before importing", queue)
+	}
+
+	kks, err := snapshotKeys(queue, h.ConsumerGroups)
+	if err != nil {
+		return 0, err
+	}
+	kksM := make(map[string]snapshotKindKey, len(kks))
+	for _, kk := range kks {
+		kksM[strings.Join(kk.key.Subs, ":")] = kk
+	}
+	defer p.configs.forget(queue)
+
+	// The padding events are stored with depends on the queue's config, which
+	// will have been imported by the time the first one is read
+	var padding time.Duration
+	var ee []core.Event
+	flush := func() error {
+		if len(ee) == 0 {
+			return nil
+		}
+		if padding == 0 {
+			qc, err := p.getConfig(ctx, QGetConfigCommand{Queue: queue})
+			if err != nil {
+				return err
+			}
+			padding = p.o.EventPadding
+			if qc.ReplayRetention > padding {
+				padding = qc.ReplayRetention
+			}
+		}
+		err := p.setEvents(ctx, ee, padding)
+		ee = ee[:0]
+		return err
+	}
+
+	var n int
+	for {
+		var rec snapshotRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return n, fmt.Errorf("reading snapshot: %w", err)
+		}
+
+		switch {
+		case rec.Event != nil:
+			e, err := rec.Event.event()
+			if err != nil {
+				return n, err
+			}
+			if ee = append(ee, e); len(ee) >= 100 {
+				if err := flush(); err != nil {
+					return n, err
+				}
+			}
+			n++
+
+		case rec.Key != nil:
+			if err := flush(); err != nil {
+				return n, err
+			}
+			kk, ok := kksM[strings.Join(rec.Key.Subs, ":")]
+			if !ok || kk.kind != rec.Key.Kind {
+				return n, fmt.Errorf("snapshot has unknown key %q", strings.Join(rec.Key.Subs, ":"))
+			}
+			if err := p.importKey(ctx, kk, rec.Key); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, flush()
+}
+
+func (se snapshotEvent) event() (core.Event, error) {
+	id, err := core.IDFromString(se.ID)
+	if err != nil {
+		return core.Event{}, err
+	}
+	e := core.Event{
+		ID:           id,
+		Contents:     se.Contents,
+		ReplyTo:      se.ReplyTo,
+		TraceContext: se.TraceContext,
+	}
+	if se.InReplyTo != "" {
+		if e.InReplyTo, err = core.IDFromString(se.InReplyTo); err != nil {
+			return core.Event{}, err
+		}
+	}
+	return e, nil
+}
+
+func (p *Peel) importKey(ctx context.Context, kk snapshotKindKey, sk *snapshotKey) error {
+	switch kk.kind {
+	case snapshotHash:
+		return p.c.HashSetAll(ctx, kk.key, sk.Hash)
+
+	case snapshotSingle:
+		id, err := core.IDFromString(sk.ID)
+		if err != nil {
+			return err
+		}
+		_, err = p.c.Query(ctx, core.QueryActions{
+			KeyBase: kk.key.Base,
+			QueryActions: []core.QueryAction{
+				{QuerySelector: &core.QuerySelector{Key: kk.key, IDs: []core.ID{id}}},
+				{QuerySingleSet: &core.QuerySingleSet{Key: kk.key}},
+			},
+		})
+		return err
+	}
+
+	ew := newExWrap(kk.key)
+	members := sk.Members
+	for len(members) > 0 {
+		batch := members
+		if len(batch) > 100 {
+			batch = batch[:100]
+		}
+		members = members[len(batch):]
+
+		var qq []core.QueryAction
+		for _, m := range batch {
+			id, err := core.IDFromString(m.ID)
+			if err != nil {
+				return err
+			}
+			if kk.kind == snapshotExWrap {
+				qq = append(qq, ew.add(id, m.Score)...)
+				continue
+			}
+			qq = append(qq,
+				core.QueryAction{QuerySelector: &core.QuerySelector{Key: kk.key, IDs: []core.ID{id}}},
+				core.QueryAction{QueryAddTo: &core.QueryAddTo{Keys: []core.Key{kk.key}, Score: m.Score}},
+			)
+		}
+		_, err := p.c.Query(ctx, core.QueryActions{
+			KeyBase:      kk.key.Base,
+			QueryActions: qq,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package peel
+
+import (
+	"bytes"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *T) {
+	queue, cgroup := testutil.RandStr(), testutil.RandStr()
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       queue,
+		QueueConfig: QueueConfig{MaxDeliveries: 5},
+	}))
+
+	var contents []string
+	for i := 0; i < 5; i++ {
+		c := testutil.RandStr()
+		_, err := testPeel.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(time.Minute),
+			Contents: c,
+		})
+		require.Nil(t, err)
+		contents = append(contents, c)
+	}
+	_, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:        queue,
+		Expire:       time.Now().Add(time.Minute),
+		VisibleAfter: time.Now().Add(time.Minute),
+		Contents:     testutil.RandStr(),
+	})
+	require.Nil(t, err)
+
+	// The first event is done, the second is in progress, and the third was
+	// nack'd with an error
+	get := func(deadline time.Time) {
+		_, err := testPeel.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup, AckDeadline: deadline})
+		require.Nil(t, err)
+	}
+	get(time.Time{})
+	get(time.Now().Add(time.Minute))
+	e, err := testPeel.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup, AckDeadline: time.Now().Add(time.Minute)})
+	require.Nil(t, err)
+	_, err = testPeel.QNack(testCtx, QNackCommand{Queue: queue, ConsumerGroup: cgroup, EventID: e.ID, DeliveryToken: e.DeliveryToken, Error: "foo"})
+	require.Nil(t, err)
+
+	buf := new(bytes.Buffer)
+	require.Nil(t, testPeel.Export(testCtx, queue, buf))
+	snapshot := buf.String()
+
+	queue2 := testutil.RandStr()
+	require.Nil(t, testPeel.Import(testCtx, queue2, strings.NewReader(snapshot)))
+
+	qsm, err := testPeel.QStatus(testCtx, QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: {cgroup}, queue2: {cgroup}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, qsm[queue], qsm[queue2])
+
+	qc, err := testPeel.QGetConfig(testCtx, QGetConfigCommand{Queue: queue2})
+	require.Nil(t, err)
+	assert.Equal(t, 5, qc.MaxDeliveries)
+
+	pp, err := testPeel.QPendingList(testCtx, QPendingListCommand{Queue: queue2, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	require.Len(t, pp, 1)
+	assert.Equal(t, contents[1], pp[0].Contents)
+
+	for _, expected := range []string{contents[2], contents[3], contents[4], ""} {
+		e, err := testPeel.QGet(testCtx, QGetCommand{Queue: queue2, ConsumerGroup: cgroup})
+		require.Nil(t, err)
+		assert.Equal(t, expected, e.Contents)
+	}
+
+	// Importing into a queue which isn't empty fails, as does importing a
+	// snapshot of a different version
+	assert.NotNil(t, testPeel.Import(testCtx, queue2, strings.NewReader(snapshot)))
+	assert.NotNil(t, testPeel.Import(testCtx, testutil.RandStr(), strings.NewReader(`{"version":0}`)))
+
+	// Without a queue the snapshot is imported into the queue it was exported
+	// from
+	require.Nil(t, testPeel.QFlush(testCtx, QFlushCommand{Queue: queue}))
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{Queue: queue}))
+	require.Nil(t, testPeel.Import(testCtx, "", strings.NewReader(snapshot)))
+	qsm2, err := testPeel.QStatus(testCtx, QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: {cgroup}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, qsm[queue], qsm2[queue])
+}
@@ -45,14 +45,62 @@ func (ew exWrap) addFromInput(score core.TS) []core.QueryAction {
 	}
 }
 
+// returns actions which will increment the scores of the IDs which are input
+// into them by the given amount. IDs which aren't already in this exWrap are
+// added with the amount as their score
+func (ew exWrap) incrFromInput(by core.TS) []core.QueryAction {
+	return []core.QueryAction{
+		{
+			QueryAddTo: &core.QueryAddTo{
+				Keys:  []core.Key{ew.byArb},
+				Score: by,
+				Incr:  true,
+			},
+		},
+		{
+			QueryAddTo: &core.QueryAddTo{
+				Keys:          []core.Key{ew.byExp},
+				ExpireAsScore: true,
+			},
+		},
+	}
+}
+
+// returns an action which will append the score of each ID from its input to
+// the result from the Query, or 0 for IDs not in the set. input is passed
+// straight through to output
+func (ew exWrap) scoresFromInput() core.QueryAction {
+	return core.QueryAction{
+		ScoresFrom: &ew.byArb,
+	}
+}
+
+// returns an action which will only output the IDs from its input which are
+// in this exWrap with a score within the given range (inclusive). If min or max
+// are 0 that indicates -infinity or +infinity, respectively
+func (ew exWrap) filterByScore(min, max core.TS) core.QueryAction {
+	return core.QueryAction{
+		QueryFilter: &core.QueryFilter{
+			ScoreKey: &ew.byArb,
+			ScoreMin: min,
+			ScoreMax: max,
+		},
+	}
+}
+
 // returns actions which will add the given ID with the given score. If score is
 // zero then the T field of the ID will be used as the score
 func (ew exWrap) add(id core.ID, score core.TS) []core.QueryAction {
+	return ew.addMulti([]core.ID{id}, score)
+}
+
+// like add, but adds all of the given IDs with the given score
+func (ew exWrap) addMulti(ii []core.ID, score core.TS) []core.QueryAction {
 	aa := make([]core.QueryAction, 1, 3)
 	aa[0] = core.QueryAction{
 		QuerySelector: &core.QuerySelector{
 			Key: ew.byArb,
-			IDs: []core.ID{id},
+			IDs: ii,
 		},
 	}
 	aa = append(aa, ew.addFromInput(score)...)
@@ -68,6 +116,45 @@ func (ew exWrap) removeFromInput() core.QueryAction {
 	}
 }
 
+// returns actions which will output whichever of the given IDs are in the set
+// with a score of at least min. ii must not be empty
+func (ew exWrap) selectIDs(ii []core.ID, min core.TS) []core.QueryAction {
+	aa := make([]core.QueryAction, len(ii))
+	for i, id := range ii {
+		aa[i] = core.QueryAction{
+			QuerySelector: &core.QuerySelector{
+				Key: ew.byArb,
+				QueryIDScoreSelect: &core.QueryIDScoreSelect{
+					ID:  id,
+					Min: min,
+				},
+			},
+			Union: i > 0,
+		}
+	}
+	return aa
+}
+
+// returns actions which will output whichever of the given IDs are in the set
+// with exactly the score at the same index in ss. ii must not be empty, and
+// none of ss may be zero
+func (ew exWrap) selectIDsEqual(ii []core.ID, ss []core.TS) []core.QueryAction {
+	aa := make([]core.QueryAction, len(ii))
+	for i, id := range ii {
+		aa[i] = core.QueryAction{
+			QuerySelector: &core.QuerySelector{
+				Key: ew.byArb,
+				QueryIDScoreSelect: &core.QueryIDScoreSelect{
+					ID:    id,
+					Equal: ss[i],
+				},
+			},
+			Union: i > 0,
+		}
+	}
+	return aa
+}
+
 // returns actions which will remove all events whose expire has passed (based
 // on the given TS) from both underlying sets. The output from these actions
 // will be the events which were removed
@@ -125,6 +212,21 @@ func (ew exWrap) afterInput(limit int64) core.QueryAction {
 	}
 }
 
+// returns an action which will output all IDs whose score is less than or
+// equal to the given TS
+func (ew exWrap) notAfter(ts core.TS) core.QueryAction {
+	return core.QueryAction{
+		QuerySelector: &core.QuerySelector{
+			Key: ew.byArb,
+			QueryRangeSelect: &core.QueryRangeSelect{
+				QueryScoreRange: core.QueryScoreRange{
+					Max: ts,
+				},
+			},
+		},
+	}
+}
+
 // returns an action which will output up to limit IDs whose score is less than
 // the given TS. If limit is less than 1 there is no limit
 func (ew exWrap) before(ts core.TS, limit int64) core.QueryAction {
@@ -16,7 +16,7 @@ func randExWrap() exWrap {
 }
 
 func requireExWrapDo(t *T, now core.TS, ex exWrap, aa ...core.QueryAction) {
-	_, err := testPeel.c.Query(core.QueryActions{
+	_, err := testPeel.c.Query(testCtx, core.QueryActions{
 		KeyBase:      ex.byArb.Base,
 		QueryActions: aa,
 		Now:          now,
@@ -25,7 +25,7 @@ func requireExWrapDo(t *T, now core.TS, ex exWrap, aa ...core.QueryAction) {
 }
 
 func assertExWrapOut(t *T, now core.TS, ex exWrap, out []core.ID, aa ...core.QueryAction) {
-	res, err := testPeel.c.Query(core.QueryActions{
+	res, err := testPeel.c.Query(testCtx, core.QueryActions{
 		KeyBase:      ex.byArb.Base,
 		QueryActions: aa,
 		Now:          now,
@@ -35,7 +35,7 @@ func assertExWrapOut(t *T, now core.TS, ex exWrap, out []core.ID, aa ...core.Que
 }
 
 func assertExWrapCounts(t *T, now core.TS, ex exWrap, counts []uint64, aa ...core.QueryAction) {
-	res, err := testPeel.c.Query(core.QueryActions{
+	res, err := testPeel.c.Query(testCtx, core.QueryActions{
 		KeyBase:      ex.byArb.Base,
 		QueryActions: aa,
 		Now:          now,
@@ -0,0 +1,94 @@
+package peel
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// The most events a filtered QGet looks through in each of the queue's
+// priorities per Query, see the Filter field of QGetCommand
+const filterScan = 100
+
+// ParseFilter parses a Filter expression, as described on QGetCommand, into the
+// core.ContentsFilter it's matched with. It can be used to check that an
+// expression is valid before it's used.
+func ParseFilter(expr string) (core.ContentsFilter, error) {
+	var cf core.ContentsFilter
+	for i, condStr := range splitFilter(expr) {
+		cond, err := parseFilterCondition(strings.TrimSpace(condStr))
+		if err != nil {
+			return core.ContentsFilter{}, fmt.Errorf("invalid Filter condition %d: %s", i+1, err)
+		}
+		cf.Conditions = append(cf.Conditions, cond)
+	}
+	return cf, nil
+}
+
+// splits the expression at each "&&" which isn't within a string value
+func splitFilter(expr string) []string {
+	var parts []string
+	var inStr, escaped bool
+	start := 0
+	for i := 0; i < len(expr); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case inStr && expr[i] == '\\':
+			escaped = true
+		case expr[i] == '"':
+			inStr = !inStr
+		case !inStr && strings.HasPrefix(expr[i:], "&&"):
+			parts = append(parts, expr[start:i])
+			start = i + 2
+			i++
+		}
+	}
+	return append(parts, expr[start:])
+}
+
+// ordered so that the two character operators are checked first
+var filterOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+func parseFilterCondition(s string) (core.ContentsCondition, error) {
+	opAt := strings.IndexAny(s, "=!<>")
+	if opAt < 0 {
+		return core.ContentsCondition{}, fmt.Errorf("no operator in %q", s)
+	}
+
+	var cond core.ContentsCondition
+	for _, op := range filterOps {
+		if strings.HasPrefix(s[opAt:], op) {
+			cond.Op = op
+			break
+		}
+	}
+	if cond.Op == "" {
+		return core.ContentsCondition{}, fmt.Errorf("invalid operator in %q", s)
+	}
+
+	path := strings.TrimSpace(s[:opAt])
+	path = strings.TrimPrefix(path, "$.")
+	if path == "" {
+		return core.ContentsCondition{}, fmt.Errorf("no field in %q", s)
+	}
+	for _, key := range strings.Split(path, ".") {
+		if key == "" || strings.ContainsAny(key, " \t\"") {
+			return core.ContentsCondition{}, fmt.Errorf("invalid field %q", path)
+		}
+		cond.Path = append(cond.Path, key)
+	}
+
+	valStr := strings.TrimSpace(s[opAt+len(cond.Op):])
+	if err := json.Unmarshal([]byte(valStr), &cond.Value); err != nil {
+		return core.ContentsCondition{}, fmt.Errorf("invalid value %q", valStr)
+	}
+	switch cond.Value.(type) {
+	case string, float64, bool, nil:
+	default:
+		return core.ContentsCondition{}, fmt.Errorf("value %q must be a string, number, boolean or null", valStr)
+	}
+	return cond, nil
+}
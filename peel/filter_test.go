@@ -0,0 +1,147 @@
+package peel
+
+import (
+	"fmt"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFilter(t *T) {
+	cond := func(op string, v interface{}, path ...string) core.ContentsCondition {
+		return core.ContentsCondition{Path: path, Op: op, Value: v}
+	}
+
+	cf, err := ParseFilter(`user.country == "NZ" && $.amount>=100`)
+	require.Nil(t, err)
+	assert.Equal(t, []core.ContentsCondition{
+		cond("==", "NZ", "user", "country"),
+		cond(">=", float64(100), "amount"),
+	}, cf.Conditions)
+
+	cf, err = ParseFilter(`a != null && b < -1.5 && c == true && d == "x && y == \"z\""`)
+	require.Nil(t, err)
+	assert.Equal(t, []core.ContentsCondition{
+		cond("!=", nil, "a"),
+		cond("<", -1.5, "b"),
+		cond("==", true, "c"),
+		cond("==", `x && y == "z"`, "d"),
+	}, cf.Conditions)
+
+	for _, expr := range []string{
+		``,
+		`a`,
+		`a = 1`,
+		`== 1`,
+		`a..b == 1`,
+		`a == `,
+		`a == foo`,
+		`a == [1]`,
+		`a == {"b":1}`,
+		`a == 1 &&`,
+		`a == 1 & b == 2`,
+	} {
+		_, err := ParseFilter(expr)
+		assert.NotNil(t, err, "expr:%q", expr)
+	}
+}
+
+func TestQGetFilter(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+	qadd := func(kind string, n int) core.ID {
+		id, err := testPeel.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(time.Minute),
+			Contents: fmt.Sprintf(`{"kind":%q,"n":%d}`, kind, n),
+		})
+		require.Nil(t, err)
+		return id
+	}
+
+	// More events than are looked through in one Query don't match, so the
+	// pointer has to be moved past them more than once
+	var ii []core.ID
+	for i := 0; i < filterScan*2+1; i++ {
+		ii = append(ii, qadd("a", i))
+	}
+	idB := qadd("b", 0)
+
+	cmd := QGetCommand{Queue: queue, ConsumerGroup: cgroup, Filter: `kind == "b"`}
+	e, err := testPeel.QGet(testCtx, cmd)
+	require.Nil(t, err)
+	assert.Equal(t, idB, e.ID)
+
+	e, err = testPeel.QGet(testCtx, cmd)
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{}, e)
+
+	// Other consumer groups aren't affected
+	e, err = testPeel.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: testutil.RandStr()})
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e.ID)
+
+	// Only the matching events are returned by QGetMulti, oldest first
+	id1, _, id2 := qadd("b", 1), qadd("a", 2), qadd("b", 3)
+	ee, err := testPeel.QGetMulti(testCtx, QGetMultiCommand{QGetCommand: cmd, Count: 5})
+	require.Nil(t, err)
+	require.Len(t, ee, 2)
+	assert.Equal(t, id1, ee[0].ID)
+	assert.Equal(t, id2, ee[1].ID)
+
+	cmd.Filter = `kind == "b" && n >= 10`
+	qadd("b", 9)
+	id3 := qadd("b", 10)
+	e, err = testPeel.QGet(testCtx, cmd)
+	require.Nil(t, err)
+	assert.Equal(t, id3, e.ID)
+
+	// A blocking QGet isn't woken up by events which don't match
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		qadd("a", 11)
+		time.Sleep(50 * time.Millisecond)
+		qadd("b", 12)
+	}()
+	cmd.Block = 2 * time.Second
+	e, err = testPeel.QGet(testCtx, cmd)
+	require.Nil(t, err)
+	assert.Contains(t, e.Contents, `"n":12`)
+
+	_, err = testPeel.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup, Filter: "kind"})
+	assert.NotNil(t, err)
+
+	// Grouped queues can't be filtered
+	groupedQueue := testutil.RandStr()
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       groupedQueue,
+		QueueConfig: QueueConfig{Grouped: true},
+	}))
+	_, err = testPeel.QGet(testCtx, QGetCommand{Queue: groupedQueue, ConsumerGroup: cgroup, Filter: cmd.Filter})
+	assert.NotNil(t, err)
+
+	// Compressed or encrypted events can't be matched, so they'd be skipped
+	// over if filtering was allowed
+	enc, err := NewAESGCMEncrypter([]byte(strings.Repeat("k", 32)))
+	require.Nil(t, err)
+	for _, o := range []Opts{{CompressThreshold: 1}, {Encrypter: enc}} {
+		p := NewWithBackend(core.NewMemBackend(), &o)
+		id, err := p.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(time.Minute),
+			Contents: `{"kind":"b","n":0}`,
+		})
+		require.Nil(t, err)
+
+		_, err = p.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup, Filter: `kind == "b"`})
+		assert.NotNil(t, err)
+		e, err := p.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+		require.Nil(t, err)
+		assert.Equal(t, id, e.ID)
+	}
+}
@@ -0,0 +1,59 @@
+package peel
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// Health describes whether a Peel is able to do its work, as returned by
+// Healthy
+type Health struct {
+	// False if there were any Problems
+	Healthy bool
+
+	// Details of the connection to the database. Only PoolAvail and PoolStats
+	// are set if the database couldn't be reached.
+	core.Health
+
+	// Reasons the Peel is unhealthy
+	Problems []string
+
+	// Issues which don't make the Peel unhealthy, but which may be worth
+	// looking into, e.g. that every pooled connection is in use
+	Warnings []string
+}
+
+// Healthy checks whether the Peel is able to do its work: that the database
+// can be reached, that the database's IDs aren't more than MaxClockSkew ahead
+// of the local clock, and whether the connection pool is saturated. A Peel
+// which is draining (see Drain) is always unhealthy. It's intended to be called
+// by liveness and readiness probes.
+func (p *Peel) Healthy(ctx context.Context) Health {
+	var h Health
+	var err error
+	if h.Health, err = p.c.Health(ctx); err != nil {
+		h.Problems = append(h.Problems, fmt.Sprintf("database unreachable: %s", err))
+	} else if h.ClockSkew > p.o.MaxClockSkew {
+		h.Problems = append(h.Problems, fmt.Sprintf("clock skew of %s is more than %s", h.ClockSkew, p.o.MaxClockSkew))
+	}
+
+	if p.Draining() {
+		h.Problems = append(h.Problems, "draining")
+	}
+
+	if h.PoolAvail == 0 {
+		h.Warnings = append(h.Warnings, "connection pool is saturated")
+	}
+
+	h.Healthy = len(h.Problems) == 0
+	return h
+}
+
+// PoolStats returns the stats of the Peel's connection pool, see core.Pool. It
+// returns false if the Peel wasn't given a *core.Pool, e.g. because it's using
+// a cluster.
+func (p *Peel) PoolStats() (core.PoolStats, bool) {
+	return p.c.PoolStats()
+}
@@ -0,0 +1,37 @@
+package peel
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthy(t *T) {
+	h := testPeel.Healthy(testCtx)
+	assert.True(t, h.Healthy, "%v", h.Problems)
+	assert.Empty(t, h.Problems)
+	assert.True(t, h.PoolAvail >= 0)
+
+	p := NewWithBackend(core.NewMemBackend(), nil)
+	h = p.Healthy(testCtx)
+	assert.True(t, h.Healthy, "%v", h.Problems)
+	assert.Equal(t, -1, h.PoolAvail)
+
+	// Some other process's clock is far ahead, so IDs are being generated in
+	// the future
+	_, err := p.c.MonoTS(testCtx, core.NewTS(time.Now().Add(time.Minute)))
+	require.Nil(t, err)
+	h = p.Healthy(testCtx)
+	assert.False(t, h.Healthy)
+	assert.Len(t, h.Problems, 1)
+
+	ctx, cancel := context.WithCancel(testCtx)
+	cancel()
+	h = NewWithBackend(core.NewMemBackend(), nil).Healthy(ctx)
+	assert.False(t, h.Healthy)
+	assert.Len(t, h.Problems, 1)
+}
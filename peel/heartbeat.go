@@ -0,0 +1,123 @@
+package peel
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// Default value for HeartbeatCommand.Extension
+const heartbeatDefaultExtension = 30 * time.Second
+
+// HeartbeatCommand describes the parameters which can be passed into the
+// Heartbeat command
+type HeartbeatCommand struct {
+	Queue         string  // Required
+	ConsumerGroup string  // Required
+	EventID       core.ID // Required
+
+	// Required. The event's current deadline, i.e. the AckDeadline it was
+	// retrieved with.
+	AckDeadline time.Time
+
+	// Default 30 seconds. How far past the time of each renewal the deadline is
+	// extended to.
+	Extension time.Duration
+
+	// Optional. Called with any error returned by QExtend. Must not block.
+	OnError func(error)
+
+	// Optional, see QAckCommand's DeliveryToken. If the event has been
+	// delivered again since then its deadline isn't extended.
+	DeliveryToken string
+}
+
+// heartbeatWait returns how long to wait before renewing a deadline which is
+// remaining away. Renewals happen roughly halfway to the deadline, with some
+// jitter so that consumers which retrieved events at the same time don't all
+// renew them at once.
+func heartbeatWait(remaining time.Duration) time.Duration {
+	if remaining <= 0 {
+		return 0
+	}
+	// between 40% and 60% of remaining
+	return time.Duration(float64(remaining) * (0.4 + 0.2*rand.Float64()))
+}
+
+// Heartbeat periodically extends the deadline of an event, which was retrieved
+// through a QGet with an AckDeadline, in the background until the returned stop
+// function is called. It's intended to wrap a handler which may take longer
+// than the event's deadline:
+//
+//	ctx, stop := p.Heartbeat(ctx, peel.HeartbeatCommand{...})
+//	err := handle(ctx, e)
+//	stop()
+//
+// The returned context is canceled if the deadline couldn't be extended before
+// it passed, e.g. because the event was already acked or its deadline was
+// missed, meaning the rest of the consumer group may retrieve it again. Errors
+// from QExtend are passed to OnError, and the renewal is retried for as long as
+// the deadline hasn't passed.
+//
+// stop waits for any renewal in progress to finish and cancels the returned
+// context. It must always be called, and the event should be acked or nacked
+// after it has been.
+func (p *Peel) Heartbeat(ctx context.Context, c HeartbeatCommand) (context.Context, func()) {
+	if c.Extension <= 0 {
+		c.Extension = heartbeatDefaultExtension
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		deadline := c.AckDeadline
+		timer := time.NewTimer(heartbeatWait(deadline.Sub(p.now())))
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-stopCh:
+				return
+			case <-ctx.Done():
+				return
+			}
+
+			if !p.now().Before(deadline) {
+				cancel()
+				return
+			}
+
+			newDeadline := p.now().Add(c.Extension)
+			extended, err := p.QExtend(ctx, QExtendCommand{
+				Queue:         c.Queue,
+				ConsumerGroup: c.ConsumerGroup,
+				EventID:       c.EventID,
+				AckDeadline:   newDeadline,
+				DeliveryToken: c.DeliveryToken,
+			})
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				} else if c.OnError != nil {
+					c.OnError(err)
+				}
+			} else if !extended {
+				cancel()
+				return
+			} else {
+				deadline = newDeadline
+			}
+			timer.Reset(heartbeatWait(deadline.Sub(p.now())))
+		}
+	}()
+
+	return ctx, func() {
+		close(stopCh)
+		<-doneCh
+		cancel()
+	}
+}
@@ -0,0 +1,67 @@
+package peel
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeatWait(t *T) {
+	for i := 0; i < 100; i++ {
+		w := heartbeatWait(10 * time.Second)
+		assert.True(t, w >= 4*time.Second && w <= 6*time.Second, "%s", w)
+	}
+	assert.Equal(t, time.Duration(0), heartbeatWait(-time.Second))
+}
+
+func TestHeartbeat(t *T) {
+	queue, _ := newTestQueue(t, 2)
+	cgroup := testutil.RandStr()
+	get := func() HeartbeatCommand {
+		deadline := time.Now().Add(200 * time.Millisecond)
+		e, err := testPeel.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   deadline,
+		})
+		require.Nil(t, err)
+		return HeartbeatCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			EventID:       e.ID,
+			AckDeadline:   deadline,
+			Extension:     200 * time.Millisecond,
+		}
+	}
+
+	// The event is kept in progress well past its original deadline
+	hb := get()
+	ctx, stop := testPeel.Heartbeat(testCtx, hb)
+	time.Sleep(700 * time.Millisecond)
+	_, err := testPeel.QClean(testCtx, QCleanCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Nil(t, ctx.Err())
+	stop()
+	assert.NotNil(t, ctx.Err())
+
+	acked, err := testPeel.QAck(testCtx, QAckCommand{Queue: queue, ConsumerGroup: cgroup, EventID: hb.EventID})
+	require.Nil(t, err)
+	assert.True(t, acked)
+
+	// If the event is acked elsewhere its deadline can't be extended, and the
+	// context is canceled
+	hb = get()
+	ctx, stop = testPeel.Heartbeat(testCtx, hb)
+	defer stop()
+	acked, err = testPeel.QAck(testCtx, QAckCommand{Queue: queue, ConsumerGroup: cgroup, EventID: hb.EventID})
+	require.Nil(t, err)
+	assert.True(t, acked)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		assert.Fail(t, "context wasn't canceled")
+	}
+}
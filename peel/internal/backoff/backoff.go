@@ -0,0 +1,31 @@
+// Package backoff implements the exponential backoff which the bridges use
+// when retrying after an error.
+package backoff
+
+import (
+	"context"
+	"time"
+)
+
+// Bounds of the backoff
+const (
+	Min = 100 * time.Millisecond
+	Max = 10 * time.Second
+)
+
+// Sleep waits out the next step of an exponential backoff, returning false if
+// ctx is done first. backoff holds the step which was last waited out, and
+// should start at zero.
+func Sleep(ctx context.Context, backoff *time.Duration) bool {
+	if *backoff *= 2; *backoff < Min {
+		*backoff = Min
+	} else if *backoff > Max {
+		*backoff = Max
+	}
+	select {
+	case <-time.After(*backoff):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,29 @@
+package backoff
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSleep(t *T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var backoff time.Duration
+	for _, expect := range []time.Duration{Min, 2 * Min, 4 * Min} {
+		assert.False(t, Sleep(ctx, &backoff))
+		assert.Equal(t, expect, backoff)
+	}
+
+	backoff = Max - time.Millisecond
+	assert.False(t, Sleep(ctx, &backoff))
+	assert.Equal(t, Max, backoff)
+
+	start := time.Now()
+	backoff = 0
+	assert.True(t, Sleep(context.Background(), &backoff))
+	assert.True(t, time.Since(start) >= Min)
+}
@@ -0,0 +1,211 @@
+// Package kafkabridge mirrors events between bananaq queues and Kafka topics. A
+// ToKafka consumes a queue and writes each of its events to a topic, and a
+// FromKafka reads a topic and adds each of its messages to a queue. Both
+// deliver at least once: events are only acked once Kafka has accepted them,
+// and messages are only committed once they've been added to the queue.
+//
+// The package doesn't depend on any particular Kafka client. Instead it uses
+// the Reader and Writer interfaces, which are shaped like kafka-go's Reader
+// and Writer, so an adapter for that client only has to convert between the
+// Message types:
+//
+//	type writer struct{ w *kafka.Writer }
+//
+//	func (w writer) WriteMessages(ctx context.Context, mm ...kafkabridge.Message) error {
+//		kmm := make([]kafka.Message, len(mm))
+//		for i, m := range mm {
+//			kmm[i] = kafka.Message{Key: m.Key, Value: m.Value}
+//		}
+//		return w.w.WriteMessages(ctx, kmm...)
+//	}
+package kafkabridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/mediocregopher/bananaq/peel/internal/backoff"
+)
+
+// Message is a single Kafka message
+type Message struct {
+	// Set by the Reader. A Writer may use Topic if it's set, otherwise it
+	// writes to its own topic.
+	Topic     string
+	Partition int
+	Offset    int64
+
+	Key   []byte
+	Value []byte
+}
+
+// Reader reads messages from Kafka as a member of a Kafka consumer group. Like
+// kafka-go's Reader, committing a message commits every message before it in
+// the same partition too.
+type Reader interface {
+	FetchMessage(context.Context) (Message, error)
+	CommitMessages(context.Context, ...Message) error
+}
+
+// Writer writes messages to Kafka. It should only return once Kafka has
+// acknowledged them.
+type Writer interface {
+	WriteMessages(context.Context, ...Message) error
+}
+
+// ToKafka consumes a queue for a consumer group and writes each event to
+// Kafka, with the event's ID as the message's key and its contents as the
+// message's value. Events are acked once the Writer returns, and nacked if it
+// returns an error, so they're written again. Since an event may be written
+// more than once, e.g. if the bridge stops between writing and acking it,
+// whatever reads the topic should use the key to ignore duplicates.
+type ToKafka struct {
+	Peel          *peel.Peel // Required
+	Queue         string     // Required
+	ConsumerGroup string     // Required
+	Writer        Writer     // Required
+
+	// Default 1. The most events which may be being written at once. Events
+	// are written in the order they're retrieved only if this is 1.
+	Concurrency int
+
+	// Default 30 seconds. How long each write may take before the event may be
+	// retrieved again, see peel.Consumer.
+	AckDeadline time.Duration
+
+	// Optional. Called with every error encountered, see peel.Consumer.
+	OnError func(error)
+}
+
+// Run writes events until ctx is done or the Peel starts draining, see
+// peel.Consumer's Run. An error is only returned if the ToKafka's fields are
+// invalid.
+func (tk ToKafka) Run(ctx context.Context) error {
+	if tk.Writer == nil {
+		return errors.New("Writer is required")
+	}
+	return peel.Consumer{
+		Peel:          tk.Peel,
+		Queue:         tk.Queue,
+		ConsumerGroup: tk.ConsumerGroup,
+		Concurrency:   tk.Concurrency,
+		AckDeadline:   tk.AckDeadline,
+		OnError:       tk.OnError,
+		Handler: func(ctx context.Context, e core.Event) error {
+			return tk.Writer.WriteMessages(ctx, Message{
+				Key:   []byte(e.ID.String()),
+				Value: []byte(e.Contents),
+			})
+		},
+	}.Run(ctx)
+}
+
+// FromKafka reads messages from Kafka and adds each one's value to a queue as
+// an event's contents. A message is only committed once it's been added, so if
+// the bridge stops in between the message is read and added again. To keep
+// that from adding duplicate events each one is added with a DedupKey made
+// from the message's topic, partition and offset, which catches duplicates
+// for as long as the Peel's DedupWindow.
+type FromKafka struct {
+	Peel   *peel.Peel // Required
+	Reader Reader     // Required
+	Queue  string     // Required
+
+	// How long after being added each event expires. Required unless the
+	// queue has a DefaultTTL (see peel.QueueConfig).
+	TTL time.Duration
+
+	// Optional. Called with every error encountered. Must not block.
+	OnError func(error)
+}
+
+func (fk FromKafka) onError(err error) {
+	if fk.OnError != nil {
+		fk.OnError(err)
+	}
+}
+
+// returns the DedupKey for the message, which may not contain ':'. Kafka
+// topic names can't either.
+func dedupKey(m Message) string {
+	return fmt.Sprintf("kafka/%s/%d/%d", m.Topic, m.Partition, m.Offset)
+}
+
+// Run reads and adds messages one at a time until ctx is done. Errors from the
+// Reader or from adding events are passed to OnError and retried with an
+// exponential backoff, apart from messages which are too large to be added
+// (see peel.ErrContentsTooLarge), which are passed to OnError and then
+// committed, so that they don't hold up the rest of the topic.
+//
+// An error is only returned if the FromKafka's fields are invalid.
+func (fk FromKafka) Run(ctx context.Context) error {
+	if fk.Peel == nil || fk.Reader == nil {
+		return errors.New("Peel and Reader are required")
+	} else if fk.Queue == "" {
+		return errors.New("Queue is required")
+	}
+
+	// retries fn until it succeeds, returning false if ctx is done first
+	retry := func(fn func() error) bool {
+		var wait time.Duration
+		for {
+			err := fn()
+			if err == nil {
+				return true
+			} else if ctx.Err() != nil {
+				return false
+			}
+			fk.onError(err)
+			if !backoff.Sleep(ctx, &wait) {
+				return false
+			}
+		}
+	}
+
+	for {
+		var m Message
+		ok := retry(func() (err error) {
+			m, err = fk.Reader.FetchMessage(ctx)
+			return err
+		})
+		if !ok {
+			return nil
+		}
+
+		ok = retry(func() error {
+			err := fk.add(ctx, m)
+			if err == peel.ErrContentsTooLarge {
+				fk.onError(fmt.Errorf("skipping message at offset %d of partition %d of %q: %s", m.Offset, m.Partition, m.Topic, err))
+				return nil
+			}
+			return err
+		})
+		if !ok {
+			return nil
+		}
+
+		ok = retry(func() error {
+			return fk.Reader.CommitMessages(ctx, m)
+		})
+		if !ok {
+			return nil
+		}
+	}
+}
+
+func (fk FromKafka) add(ctx context.Context, m Message) error {
+	c := peel.QAddCommand{
+		Queue:    fk.Queue,
+		Contents: string(m.Value),
+		DedupKey: dedupKey(m),
+	}
+	if fk.TTL > 0 {
+		c.Expire = time.Now().Add(fk.TTL)
+	}
+	_, err := fk.Peel.QAdd(ctx, c)
+	return err
+}
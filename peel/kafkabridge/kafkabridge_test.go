@@ -0,0 +1,169 @@
+package kafkabridge
+
+import (
+	"context"
+	"errors"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testCtx = context.Background()
+
+func newTestPeel() *peel.Peel {
+	p := peel.NewWithBackend(core.NewMemBackend(), nil)
+	errCh := p.Run(nil)
+	go func() { panic(<-errCh) }()
+	return p
+}
+
+// fails its first write, and records the rest
+type testWriter struct {
+	l      sync.Mutex
+	failed bool
+	mm     []Message
+}
+
+func (tw *testWriter) WriteMessages(_ context.Context, mm ...Message) error {
+	tw.l.Lock()
+	defer tw.l.Unlock()
+	if !tw.failed {
+		tw.failed = true
+		return errors.New("kafka is down")
+	}
+	tw.mm = append(tw.mm, mm...)
+	return nil
+}
+
+func (tw *testWriter) messages() []Message {
+	tw.l.Lock()
+	defer tw.l.Unlock()
+	return append([]Message(nil), tw.mm...)
+}
+
+func TestToKafka(t *T) {
+	p := newTestPeel()
+	queue, cgroup := testutil.RandStr(), testutil.RandStr()
+
+	var ii []core.ID
+	var contents []string
+	for i := 0; i < 3; i++ {
+		contents = append(contents, testutil.RandStr())
+		id, err := p.QAdd(testCtx, peel.QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(time.Minute),
+			Contents: contents[i],
+		})
+		require.Nil(t, err)
+		ii = append(ii, id)
+	}
+
+	tw := new(testWriter)
+	ctx, cancel := context.WithCancel(testCtx)
+	doneCh := make(chan error)
+	go func() {
+		doneCh <- ToKafka{
+			Peel:          p,
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			Writer:        tw,
+		}.Run(ctx)
+	}()
+
+	// The event whose write failed is nacked, and so written again first
+	assert.Eventually(t, func() bool { return len(tw.messages()) == 3 }, time.Second, 10*time.Millisecond)
+	cancel()
+	require.Nil(t, <-doneCh)
+
+	for i, m := range tw.messages() {
+		assert.Equal(t, ii[i].String(), string(m.Key))
+		assert.Equal(t, contents[i], string(m.Value))
+	}
+
+	qsm, err := p.QStatus(testCtx, peel.QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: {cgroup}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(3), qsm[queue].ConsumerGroupStats[cgroup].Done)
+}
+
+// returns its messages in order, failing its first commit, and then blocks
+type testReader struct {
+	l         sync.Mutex
+	mm        []Message
+	failed    bool
+	committed []Message
+}
+
+func (tr *testReader) FetchMessage(ctx context.Context) (Message, error) {
+	tr.l.Lock()
+	if len(tr.mm) == 0 {
+		tr.l.Unlock()
+		<-ctx.Done()
+		return Message{}, ctx.Err()
+	}
+	defer tr.l.Unlock()
+	m := tr.mm[0]
+	tr.mm = tr.mm[1:]
+	return m, nil
+}
+
+func (tr *testReader) CommitMessages(_ context.Context, mm ...Message) error {
+	tr.l.Lock()
+	defer tr.l.Unlock()
+	if !tr.failed {
+		tr.failed = true
+		return errors.New("kafka is down")
+	}
+	tr.committed = append(tr.committed, mm...)
+	return nil
+}
+
+func (tr *testReader) numCommitted() int {
+	tr.l.Lock()
+	defer tr.l.Unlock()
+	return len(tr.committed)
+}
+
+func TestFromKafka(t *T) {
+	p := newTestPeel()
+	queue, cgroup := testutil.RandStr(), testutil.RandStr()
+	topic := testutil.RandStr()
+
+	// The second message is read twice, as it would be if the bridge had
+	// stopped before committing it
+	m0 := Message{Topic: topic, Offset: 0, Value: []byte(testutil.RandStr())}
+	m1 := Message{Topic: topic, Offset: 1, Value: []byte(testutil.RandStr())}
+	tr := &testReader{mm: []Message{m0, m1, m1}}
+
+	ctx, cancel := context.WithCancel(testCtx)
+	doneCh := make(chan error)
+	go func() {
+		doneCh <- FromKafka{
+			Peel:   p,
+			Reader: tr,
+			Queue:  queue,
+			TTL:    time.Minute,
+		}.Run(ctx)
+	}()
+
+	assert.Eventually(t, func() bool { return tr.numCommitted() == 3 }, time.Second, 10*time.Millisecond)
+	cancel()
+	require.Nil(t, <-doneCh)
+	assert.Equal(t, []Message{m0, m1, m1}, tr.committed)
+
+	for _, m := range []Message{m0, m1} {
+		e, err := p.QGet(testCtx, peel.QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+		require.Nil(t, err)
+		assert.Equal(t, string(m.Value), e.Contents)
+	}
+	e, err := p.QGet(testCtx, peel.QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{}, e)
+}
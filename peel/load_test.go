@@ -36,8 +36,8 @@ func TestConsumerLoad(t *T) {
 
 	go func() {
 		for range time.Tick(10 * time.Millisecond) {
-			require.Nil(t, testPeel.Clean(queue, cgroup))
-			require.Nil(t, testPeel.CleanAvailable(queue))
+			require.Nil(t, testPeel.Clean(testCtx, queue, cgroup))
+			require.Nil(t, testPeel.CleanAvailable(testCtx, queue))
 		}
 	}()
 
@@ -50,7 +50,7 @@ func TestConsumerLoad(t *T) {
 				deadline = time.Now().Add(10 * time.Millisecond)
 			}
 
-			e, err := testPeel.QGet(QGetCommand{
+			e, err := testPeel.QGet(testCtx, QGetCommand{
 				Queue:         queue,
 				ConsumerGroup: cgroup,
 				AckDeadline:   deadline,
@@ -66,7 +66,7 @@ func TestConsumerLoad(t *T) {
 					// force miss deadline
 					time.Sleep(10 * time.Millisecond)
 				}
-				acked, err := testPeel.QAck(QAckCommand{
+				acked, err := testPeel.QAck(testCtx, QAckCommand{
 					Queue:         queue,
 					ConsumerGroup: cgroup,
 					EventID:       e.ID,
@@ -0,0 +1,87 @@
+package peel
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// Logger is used by a Peel to emit structured records about what it's doing.
+// *slog.Logger implements it, and slog.Default() is used if one isn't given in
+// Opts.
+//
+// Records are emitted at the following levels:
+//
+//	Debug: every command once it completes, along with how long it took and how
+//	many events it returned or affected, as well as every event which is
+//	delivered again after a previous attempt at it.
+//
+//	Info: events which missed their ack deadline, and so will be delivered
+//	again.
+//
+//	Warn: commands which failed, e.g. because the database couldn't be
+//	reached, and events which were moved to a dead set.
+//
+//	Error: errors which stopped the background work done by Run.
+type Logger interface {
+	Enabled(ctx context.Context, level slog.Level) bool
+	Log(ctx context.Context, level slog.Level, msg string, args ...any)
+}
+
+func (p *Peel) log(ctx context.Context, level slog.Level, msg string, args ...any) {
+	if p.o.Logger.Enabled(ctx, level) {
+		p.o.Logger.Log(ctx, level, msg, args...)
+	}
+}
+
+// returns the level a command's Stat should be logged at
+func statLevel(s core.Stat) slog.Level {
+	if s.Err != nil {
+		return slog.LevelWarn
+	}
+	return slog.LevelDebug
+}
+
+func (p *Peel) logStat(ctx context.Context, s core.Stat) {
+	args := []any{
+		"command", s.Name,
+		"duration", s.Duration,
+		"count", s.Count,
+	}
+	if s.Queue != "" {
+		args = append(args, "queue", s.Queue)
+	}
+	if s.ConsumerGroup != "" {
+		args = append(args, "consumer_group", s.ConsumerGroup)
+	}
+
+	msg := "command completed"
+	if s.Err != nil {
+		msg = "command failed"
+		args = append(args, "err", s.Err)
+	}
+	p.o.Logger.Log(ctx, statLevel(s), msg, args...)
+}
+
+// logs the outcome of the actions returned by redoMissedDeadlines, given the
+// Counts which they appended to the Query's result
+func (p *Peel) logMissedDeadlines(ctx context.Context, queue, cgroup string, maxDeliveries int, counts []uint64) {
+	var dead uint64
+	if maxDeliveries > 0 {
+		dead, counts = counts[0], counts[1:]
+	}
+	if counts[0] > 0 {
+		p.log(ctx, slog.LevelInfo, "events missed their ack deadline",
+			"queue", queue, "consumer_group", cgroup, "count", counts[0])
+	}
+	p.logDeadLettered(ctx, queue, cgroup, maxDeliveries, dead)
+}
+
+func (p *Peel) logDeadLettered(ctx context.Context, queue, cgroup string, maxDeliveries int, n uint64) {
+	if n > 0 {
+		p.log(ctx, slog.LevelWarn, "events were moved to the dead set",
+			"queue", queue, "consumer_group", cgroup, "count", n,
+			"max_deliveries", maxDeliveries)
+	}
+}
@@ -0,0 +1,98 @@
+package peel
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collects the records written by a JSON slog handler
+type testLogBuf struct {
+	l sync.Mutex
+	b bytes.Buffer
+}
+
+func (tlb *testLogBuf) Write(b []byte) (int, error) {
+	tlb.l.Lock()
+	defer tlb.l.Unlock()
+	return tlb.b.Write(b)
+}
+
+// returns all records logged so far with the given message
+func (tlb *testLogBuf) records(t *T, msg string) []map[string]interface{} {
+	tlb.l.Lock()
+	defer tlb.l.Unlock()
+	var ret []map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(tlb.b.Bytes()), []byte("\n")) {
+		var rec map[string]interface{}
+		require.Nil(t, json.Unmarshal(line, &rec))
+		if rec["msg"] == msg {
+			ret = append(ret, rec)
+		}
+	}
+	return ret
+}
+
+func TestLogger(t *T) {
+	tlb := new(testLogBuf)
+	handler := slog.NewJSONHandler(tlb, &slog.HandlerOptions{Level: slog.LevelDebug})
+	p := NewWithBackend(core.NewMemBackend(), &Opts{Logger: slog.New(handler)})
+
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+	id, err := p.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(time.Minute),
+		Contents: testutil.RandStr(),
+	})
+	require.Nil(t, err)
+
+	recs := tlb.records(t, "command completed")
+	require.Len(t, recs, 1)
+	assert.Equal(t, "QAdd", recs[0]["command"])
+	assert.Equal(t, queue, recs[0]["queue"])
+	assert.Equal(t, float64(1), recs[0]["count"])
+
+	_, err = p.QAdd(testCtx, QAddCommand{Queue: queue})
+	require.NotNil(t, err)
+	recs = tlb.records(t, "command failed")
+	require.Len(t, recs, 1)
+	assert.Equal(t, "WARN", recs[0]["level"])
+	assert.Equal(t, err.Error(), recs[0]["err"])
+
+	// Missing the deadline gets logged when the consumer group is cleaned, and
+	// the event being retrieved again gets logged as a redelivery
+	_, err = p.QGet(testCtx, QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(-10 * time.Millisecond),
+	})
+	require.Nil(t, err)
+	require.Nil(t, p.Clean(testCtx, queue, cgroup))
+
+	recs = tlb.records(t, "events missed their ack deadline")
+	require.Len(t, recs, 1)
+	assert.Equal(t, "INFO", recs[0]["level"])
+	assert.Equal(t, cgroup, recs[0]["consumer_group"])
+	assert.Equal(t, float64(1), recs[0]["count"])
+
+	_, err = p.QGet(testCtx, QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(time.Minute),
+	})
+	require.Nil(t, err)
+
+	recs = tlb.records(t, "event redelivered")
+	require.Len(t, recs, 1)
+	assert.Equal(t, id.String(), recs[0]["id"])
+	assert.Equal(t, float64(2), recs[0]["attempts"])
+}
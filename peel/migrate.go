@@ -0,0 +1,458 @@
+package peel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// A queue is migrated to another redis in two steps, which every Peel with a
+// MigrationTarget follows using the queue's migration key (see
+// queueMigration and migration). While it's being dual-written events added to
+// the queue are added to both redises with the same ID, while consumers carry
+// on as normal against the source. Once it's been cut over every command for
+// the queue is performed on the target instead. Migrate copies the queue's
+// state across in between, pausing the source for the final copy so that it
+// doesn't change underneath it.
+
+// ErrNoMigrationTarget is returned from Migrate if the Peel has no
+// MigrationTarget (see Opts)
+var ErrNoMigrationTarget = errors.New("no migration target")
+
+// The state of a queue's migration, as held by its migration key. Each field is
+// 0 until the queue reaches that step.
+type migration struct {
+	dualWrite, cutOver core.TS
+}
+
+type migrationCacheEntry struct {
+	m       migration
+	fetched time.Time
+}
+
+// migrationCache keeps track of each queue's migration, like configCache does
+// for QueueConfigs
+type migrationCache struct {
+	l sync.Mutex
+	m map[string]migrationCacheEntry
+}
+
+func newMigrationCache() *migrationCache {
+	return &migrationCache{m: map[string]migrationCacheEntry{}}
+}
+
+func (mc *migrationCache) get(queue string, now time.Time) (migration, bool) {
+	mc.l.Lock()
+	defer mc.l.Unlock()
+	e, ok := mc.m[queue]
+	if !ok || now.Sub(e.fetched) >= configCacheTTL {
+		return migration{}, false
+	}
+	return e.m, true
+}
+
+func (mc *migrationCache) set(queue string, m migration, now time.Time) {
+	mc.l.Lock()
+	defer mc.l.Unlock()
+	mc.m[queue] = migrationCacheEntry{m, now}
+}
+
+func (p *Peel) getMigration(ctx context.Context, queue string) (migration, error) {
+	keyMigration, err := queueMigration(queue)
+	if err != nil {
+		return migration{}, err
+	}
+	hm, err := p.c.HashGetAll(ctx, keyMigration)
+	if err != nil {
+		return migration{}, err
+	}
+
+	var m migration
+	for field, ts := range map[string]*core.TS{"dualwrite": &m.dualWrite, "cutover": &m.cutOver} {
+		if hm[field] == "" {
+			continue
+		}
+		i, err := strconv.ParseUint(hm[field], 10, 64)
+		if err != nil {
+			return migration{}, fmt.Errorf("invalid migration %s time %q", field, hm[field])
+		}
+		*ts = core.TS(i)
+	}
+	return m, nil
+}
+
+// like getMigration, but the result may have been fetched up to configCacheTTL
+// ago. Always returns the zero migration if the Peel has no MigrationTarget.
+func (p *Peel) cachedMigration(ctx context.Context, queue string) (migration, error) {
+	if p.o.MigrationTarget == nil {
+		return migration{}, nil
+	}
+	now := time.Now()
+	if m, ok := p.migrations.get(queue, now); ok {
+		return m, nil
+	}
+	m, err := p.getMigration(ctx, queue)
+	if err != nil {
+		return migration{}, err
+	}
+	p.migrations.set(queue, m, now)
+	return m, nil
+}
+
+func (p *Peel) setMigration(ctx context.Context, queue string, m migration) error {
+	keyMigration, err := queueMigration(queue)
+	if err != nil {
+		return err
+	}
+	hm := map[string]string{"dualwrite": strconv.FormatUint(uint64(m.dualWrite), 10)}
+	if m.cutOver != 0 {
+		hm["cutover"] = strconv.FormatUint(uint64(m.cutOver), 10)
+	}
+	if err := p.c.HashSetAll(ctx, keyMigration, hm); err != nil {
+		return err
+	}
+	p.migrations.set(queue, m, time.Now())
+	return nil
+}
+
+// returns the MigrationTarget if the queue has been cut over to it, in which
+// case the command should be performed on it, or nil otherwise
+func (p *Peel) migratedTo(ctx context.Context, queue string) (*Peel, error) {
+	m, err := p.cachedMigration(ctx, queue)
+	if err != nil || m.cutOver == 0 {
+		return nil, err
+	}
+	return p.o.MigrationTarget, nil
+}
+
+// like qaddMulti, but events for queues which have been cut over are added to
+// the MigrationTarget instead. Those for queues which are being dual-written
+// are added by qaddMulti, see dualWrite.
+func (p *Peel) qaddMigrate(ctx context.Context, cc []QAddCommand) ([]core.ID, error) {
+	if p.o.MigrationTarget == nil {
+		return p.qaddMulti(ctx, cc)
+	}
+
+	var sourceIdx, targetIdx []int
+	for i, c := range cc {
+		if t, err := p.migratedTo(ctx, c.Queue); err != nil {
+			return nil, err
+		} else if t != nil {
+			targetIdx = append(targetIdx, i)
+		} else {
+			sourceIdx = append(sourceIdx, i)
+		}
+	}
+
+	ii := make([]core.ID, len(cc))
+	for _, a := range []struct {
+		p   *Peel
+		idx []int
+	}{{p, sourceIdx}, {p.o.MigrationTarget, targetIdx}} {
+		if len(a.idx) == 0 {
+			continue
+		}
+		acc := make([]QAddCommand, len(a.idx))
+		for j, i := range a.idx {
+			acc[j] = cc[i]
+		}
+		aii, err := a.p.qaddMulti(ctx, acc)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range a.idx {
+			ii[i] = aii[j]
+		}
+	}
+	return ii, nil
+}
+
+// called by qaddMulti once it's added the given events, which have been
+// encoded and given their IDs. Those for queues which are being dual-written
+// are added to the MigrationTarget too, with the same IDs. Failures are only
+// logged, since the events are still in the source and so will be copied
+// across by Migrate.
+func (p *Peel) dualWrite(ctx context.Context, cc []QAddCommand, ii []core.ID, dup []bool) {
+	if p.o.MigrationTarget == nil {
+		return
+	}
+
+	var tcc []QAddCommand
+	for i, c := range cc {
+		if dup[i] {
+			continue
+		}
+		m, err := p.cachedMigration(ctx, c.Queue)
+		if err != nil {
+			p.log(ctx, slog.LevelWarn, "could not check if queue is being migrated", "queue", c.Queue, "err", err)
+			continue
+		} else if m.dualWrite == 0 || m.cutOver != 0 {
+			continue
+		}
+		c.id = ii[i]
+		tcc = append(tcc, c)
+	}
+	if len(tcc) == 0 {
+		return
+	}
+	if _, err := p.o.MigrationTarget.qaddMulti(ctx, tcc); err != nil {
+		p.log(ctx, slog.LevelWarn, "could not add events to migration target", "err", err)
+	}
+}
+
+// MigrateCommand describes the parameters which can be passed into the Migrate
+// command
+type MigrateCommand struct {
+	Queue string // Required
+
+	// Default 1 minute. Once the source has been paused, how long to wait for
+	// the events which its consumer groups have in progress to be ack'd or
+	// nack'd before cutting over anyway. Events which are still in progress
+	// are cut over as they are, and will be retried from the target if they
+	// aren't ack'd there in time.
+	DrainTimeout time.Duration
+}
+
+// Migrate moves the given queue, and the state of each of its consumer groups,
+// to the redis of the Peel's MigrationTarget (see Opts) without losing any
+// events, while it's still being used. Every Peel using the queue must have
+// the same MigrationTarget, otherwise events added through those which don't
+// may be lost.
+//
+// First the queue is switched to being dual-written, and Migrate waits long
+// enough for every Peel to have seen the switch. Everything in the queue is
+// then copied to the target. Then the source is paused (see QPause) so that
+// it can be drained of the events which consumers have in progress, see
+// MigrateCommand's DrainTimeout, and everything which has changed is copied
+// again. Finally the queue is cut over, after which every Peel performs QAdd,
+// QAddMulti, QReply, QGet, QGetMulti, QPeek, QAck, QAckMulti, QExtend, QNack
+// and QResult for the queue on the target. Consumers won't be given events
+// while the source is paused, which lasts until each Peel sees the cut over.
+// Other commands carry on acting on whichever redis they're given, so should
+// be given the target once the queue has been cut over.
+//
+// Migrate may be called again if it fails part way through. Calling it on a
+// queue which has already been cut over does nothing. Sharded queues (see
+// QueueConfig's Shards) can't be migrated.
+func (p *Peel) Migrate(ctx context.Context, c MigrateCommand) (err error) {
+	ctx, end := p.start(ctx, "Migrate", c.Queue, "")
+	defer end(&err, nil)
+	return p.migrate(ctx, c)
+}
+
+func (p *Peel) migrate(ctx context.Context, c MigrateCommand) error {
+	t := p.o.MigrationTarget
+	if t == nil {
+		return ErrNoMigrationTarget
+	}
+	if c.DrainTimeout == 0 {
+		c.DrainTimeout = 1 * time.Minute
+	}
+
+	qc, err := p.getConfig(ctx, QGetConfigCommand{Queue: c.Queue})
+	if err != nil {
+		return err
+	} else if qc.Shards > 1 {
+		return errors.New("sharded queues can't be migrated")
+	}
+
+	m, err := p.getMigration(ctx, c.Queue)
+	if err != nil {
+		return err
+	} else if m.cutOver != 0 {
+		return nil
+	}
+
+	wasPaused, err := p.isPaused(ctx, c.Queue)
+	if err != nil {
+		return err
+	}
+
+	// The target needs the queue's config before anything is added to it, so
+	// that events are added to it the same way as to the source
+	keyConfig, err := queueConfig(c.Queue)
+	if err != nil {
+		return err
+	}
+	keyStrict, err := queueStrict(c.Queue)
+	if err != nil {
+		return err
+	}
+	for _, kk := range []snapshotKindKey{{keyConfig, snapshotHash}, {keyStrict, snapshotSingle}} {
+		if sk, err := p.exportKey(ctx, kk); err != nil {
+			return err
+		} else if sk == nil {
+			continue
+		} else if err := t.importKey(ctx, kk, sk); err != nil {
+			return err
+		}
+	}
+	t.configs.forget(c.Queue)
+
+	if m.dualWrite == 0 {
+		m.dualWrite = core.NewTS(time.Now())
+		if err := p.setMigration(ctx, c.Queue, m); err != nil {
+			return err
+		}
+	}
+	if wait := time.Until(m.dualWrite.Time().Add(configCacheTTL)); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	copied := map[core.ID]bool{}
+	if err := p.migrateCopy(ctx, c.Queue, wasPaused, copied, false); err != nil {
+		return err
+	}
+
+	if err := p.qpause(ctx, c.Queue); err != nil {
+		return err
+	}
+	if err := p.migrateDrain(ctx, c.Queue, c.DrainTimeout); err != nil {
+		return err
+	}
+	if err := p.migrateCopy(ctx, c.Queue, wasPaused, copied, true); err != nil {
+		return err
+	}
+
+	m.cutOver = core.NewTS(time.Now())
+	return p.setMigration(ctx, c.Queue, m)
+}
+
+// waits until none of the queue's consumer groups have any events in
+// progress, or until the timeout
+func (p *Peel) migrateDrain(ctx context.Context, queue string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		qs, err := p.qstatus(ctx, queue, nil)
+		if err != nil {
+			return err
+		}
+		var inProg uint64
+		for _, cgs := range qs.ConsumerGroupStats {
+			inProg += cgs.InProgress
+		}
+		if inProg == 0 {
+			return nil
+		}
+
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// copies everything which makes up the queue to the MigrationTarget, along
+// with the events which are referred to and haven't been copied already.
+// Events are added to copied as they're copied. The queue's own sets are only
+// ever added to, since the target may have events the source doesn't yet. If
+// final is set the consumer groups' keys are replaced rather than added to,
+// since events may have been removed from them since they were last copied.
+// The target is paused only if wasPaused is set.
+func (p *Peel) migrateCopy(ctx context.Context, queue string, wasPaused bool, copied map[core.ID]bool, final bool) error {
+	t := p.o.MigrationTarget
+	cgroups, err := p.queueConsumerGroups(ctx, queue)
+	if err != nil {
+		return err
+	}
+	queueKKs, err := snapshotKeys(queue, nil)
+	if err != nil {
+		return err
+	}
+	kks, err := snapshotKeys(queue, cgroups)
+	if err != nil {
+		return err
+	}
+	keyPaused, err := queuePaused(queue)
+	if err != nil {
+		return err
+	}
+
+	qc, err := p.getConfig(ctx, QGetConfigCommand{Queue: queue})
+	if err != nil {
+		return err
+	}
+	padding := p.o.EventPadding
+	if qc.ReplayRetention > padding {
+		padding = qc.ReplayRetention
+	}
+
+	for i, kk := range kks {
+		if kk.key.String("") == keyPaused.String("") {
+			continue
+		}
+		sk, err := p.exportKey(ctx, kk)
+		if err != nil {
+			return err
+		}
+
+		if final && i >= len(queueKKs) {
+			del := []core.Key{kk.key}
+			if kk.kind == snapshotExWrap {
+				del = append(del, newExWrap(kk.key).byExp)
+			}
+			qq := make([]core.QueryAction, len(del))
+			for j := range del {
+				qq[j] = core.QueryAction{Delete: &del[j]}
+			}
+			_, err := t.c.Query(ctx, core.QueryActions{KeyBase: kk.key.Base, QueryActions: qq})
+			if err != nil {
+				return err
+			}
+		}
+		if sk == nil {
+			continue
+		}
+
+		var ids []core.ID
+		for _, m := range sk.Members {
+			id, err := core.IDFromString(m.ID)
+			if err != nil {
+				return err
+			} else if !copied[id] {
+				ids = append(ids, id)
+			}
+		}
+		for len(ids) > 0 {
+			batch := ids
+			if len(batch) > 100 {
+				batch = batch[:100]
+			}
+			ids = ids[len(batch):]
+
+			ee, err := p.exportEvents(ctx, batch)
+			if err != nil {
+				return err
+			} else if len(ee) > 0 {
+				if err := t.setEvents(ctx, ee, padding); err != nil {
+					return err
+				}
+			}
+			for _, id := range batch {
+				copied[id] = true
+			}
+		}
+
+		if err := t.importKey(ctx, kk, sk); err != nil {
+			return err
+		}
+	}
+
+	t.configs.forget(queue)
+	if wasPaused {
+		return t.qpause(ctx, queue)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package peel
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate(t *T) {
+	newPeel := func(o *Opts) *Peel {
+		p := NewWithBackend(core.NewMemBackend(), o)
+		errCh := p.Run(nil)
+		go func() { panic(<-errCh) }()
+		return p
+	}
+	target := newPeel(nil)
+	source := newPeel(&Opts{MigrationTarget: target})
+	queue, cgroup := testutil.RandStr(), testutil.RandStr()
+
+	add := func(contents string) core.ID {
+		id, err := source.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(time.Minute),
+			Contents: contents,
+		})
+		require.Nil(t, err)
+		return id
+	}
+	add("a")
+	add("b")
+	add("c")
+
+	// a is done and b is in progress when the migration starts
+	e, err := source.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, "a", e.Contents)
+	inProg, err := source.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup, AckDeadline: time.Now().Add(time.Minute)})
+	require.Nil(t, err)
+	assert.Equal(t, "b", inProg.Contents)
+
+	// Once the queue's being dual-written events are added to both, with the
+	// same ID
+	require.Nil(t, source.setMigration(testCtx, queue, migration{dualWrite: core.NewTS(time.Now())}))
+	id := add("d")
+	e, err = target.QPeek(testCtx, QPeekCommand{Queue: queue, ConsumerGroup: testutil.RandStr()})
+	require.Nil(t, err)
+	assert.Equal(t, id, e.ID)
+	assert.Equal(t, "d", e.Contents)
+
+	require.Nil(t, source.Migrate(testCtx, MigrateCommand{Queue: queue, DrainTimeout: 100 * time.Millisecond}))
+
+	// The source is left paused, and the target isn't
+	paused, err := source.isPaused(testCtx, queue)
+	require.Nil(t, err)
+	assert.True(t, paused)
+	paused, err = target.isPaused(testCtx, queue)
+	require.Nil(t, err)
+	assert.False(t, paused)
+
+	// Commands given to the source are now performed on the target, which has
+	// the consumer group's state
+	ok, err := source.QAck(testCtx, QAckCommand{Queue: queue, ConsumerGroup: cgroup, EventID: inProg.ID, DeliveryToken: inProg.DeliveryToken})
+	require.Nil(t, err)
+	assert.True(t, ok)
+	add("e")
+	for _, expected := range []string{"c", "d", "e", ""} {
+		e, err := source.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+		require.Nil(t, err)
+		assert.Equal(t, expected, e.Contents)
+	}
+	qs, err := target.QStatus(testCtx, QStatusCommand{QueuesConsumerGroups: map[string][]string{queue: {cgroup}}})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(5), qs[queue].Total)
+
+	// Migrating again does nothing, and a Peel without a MigrationTarget can't
+	// migrate at all
+	assert.Nil(t, source.Migrate(testCtx, MigrateCommand{Queue: queue}))
+	assert.Equal(t, ErrNoMigrationTarget, target.Migrate(testCtx, MigrateCommand{Queue: queue}))
+}
@@ -0,0 +1,197 @@
+// Package mqttbridge adds the messages published to topics on an MQTT broker to
+// bananaq queues, so that fleets of devices which speak MQTT can feed work
+// queues without speaking redis. A FromMQTT maps topic filters to queues, and
+// adds each message it receives to the queue of the first Route whose filter
+// matches its topic.
+//
+// The package doesn't depend on any particular MQTT client. Its Message is a
+// subset of paho.mqtt.golang's, so that client's messages can be used as they
+// are. Auto-ack should be disabled, so that QoS 1 and 2 messages are only
+// acked once they've been added:
+//
+//	opts.SetAutoAckDisabled(true)
+//	client := mqtt.NewClient(opts)
+//	...
+//	msgs := make(chan mqttbridge.Message)
+//	client.Subscribe("sensors/#", 1, func(_ mqtt.Client, m mqtt.Message) {
+//		msgs <- m
+//	})
+package mqttbridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/mediocregopher/bananaq/peel/internal/backoff"
+)
+
+// Message is a single message received from the broker. paho.mqtt.golang's
+// Message implements it.
+type Message interface {
+	Topic() string
+	Payload() []byte
+
+	// Acks the message to the broker. Only does anything for QoS 1 and 2
+	// messages, and only if the client's auto-ack is disabled.
+	Ack()
+}
+
+// Route maps the messages whose topics match an MQTT topic filter onto a queue
+type Route struct {
+	// Required. An MQTT topic filter, in which '+' matches any one level of a
+	// topic and a trailing '#' matches any number of levels, e.g.
+	// "sensors/+/temperature" or "devices/#".
+	Filter string
+
+	Queue string // Required
+
+	// How long after being added each event expires. Required unless the
+	// queue has a DefaultTTL (see peel.QueueConfig).
+	TTL time.Duration
+}
+
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "#" && i != len(levels)-1 {
+			return false
+		} else if level != "+" && level != "#" && strings.ContainsAny(level, "+#") {
+			return false
+		}
+	}
+	return true
+}
+
+// Match returns whether the topic matches the Route's Filter. As in MQTT,
+// wildcards at the start of a filter don't match topics starting with '$'.
+func (r Route) Match(topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(r.Filter, "+") || strings.HasPrefix(r.Filter, "#")) {
+		return false
+	}
+	filterLevels, topicLevels := strings.Split(r.Filter, "/"), strings.Split(topic, "/")
+	for i, fl := range filterLevels {
+		if fl == "#" {
+			return true
+		} else if i >= len(topicLevels) {
+			return false
+		} else if fl != "+" && fl != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// ErrMessagesClosed is returned from FromMQTT's Run when its Messages channel is
+// closed
+var ErrMessagesClosed = errors.New("messages channel closed")
+
+// FromMQTT adds each message received from an MQTT broker to the queue of the
+// first of its Routes which matches the message's topic, with the message's
+// payload as the event's contents. Each message is acked once it's been added,
+// so a QoS 1 or 2 message which the bridge stops before adding is delivered
+// again by the broker, if the client's session is persistent. Since MQTT gives
+// no way to tell a redelivered message apart from a new one with the same
+// payload, events may be added more than once.
+type FromMQTT struct {
+	Peel     *peel.Peel     // Required
+	Messages <-chan Message // Required
+	Routes   []Route        // Required
+
+	// Optional. Called with every error encountered. Must not block.
+	OnError func(error)
+}
+
+func (fm FromMQTT) onError(err error) {
+	if fm.OnError != nil {
+		fm.OnError(err)
+	}
+}
+
+// Run adds messages one at a time until ctx is done, returning nil, or until
+// Messages is closed, returning ErrMessagesClosed. Errors from adding messages
+// are passed to OnError and retried with an exponential backoff, apart from
+// messages which are too large to be added (see peel.ErrContentsTooLarge),
+// which are passed to OnError and then acked, so that they don't hold up the
+// rest. Messages whose topics match none of the Routes are acked and passed to
+// OnError too.
+//
+// Any other error is only returned if the FromMQTT's fields are invalid.
+func (fm FromMQTT) Run(ctx context.Context) error {
+	if fm.Peel == nil || fm.Messages == nil {
+		return errors.New("Peel and Messages are required")
+	} else if len(fm.Routes) == 0 {
+		return errors.New("at least one Route is required")
+	}
+	for _, r := range fm.Routes {
+		if !validFilter(r.Filter) {
+			return fmt.Errorf("invalid Route Filter %q", r.Filter)
+		} else if r.Queue == "" {
+			return fmt.Errorf("Route for %q has no Queue", r.Filter)
+		}
+	}
+
+	for {
+		var m Message
+		var ok bool
+		select {
+		case m, ok = <-fm.Messages:
+			if !ok {
+				return ErrMessagesClosed
+			}
+		case <-ctx.Done():
+			return nil
+		}
+
+		if !fm.add(ctx, m) {
+			return nil
+		}
+		m.Ack()
+	}
+}
+
+// add adds the message to its Route's queue, retrying until it's been added or
+// can't ever be, or returning false if ctx is done first
+func (fm FromMQTT) add(ctx context.Context, m Message) bool {
+	var route *Route
+	for i := range fm.Routes {
+		if fm.Routes[i].Match(m.Topic()) {
+			route = &fm.Routes[i]
+			break
+		}
+	}
+	if route == nil {
+		fm.onError(fmt.Errorf("skipping message on %q: no Route matches it", m.Topic()))
+		return true
+	}
+
+	var wait time.Duration
+	for {
+		c := peel.QAddCommand{
+			Queue:    route.Queue,
+			Contents: string(m.Payload()),
+		}
+		if route.TTL > 0 {
+			c.Expire = time.Now().Add(route.TTL)
+		}
+		_, err := fm.Peel.QAdd(ctx, c)
+		if err == nil {
+			return true
+		} else if err == peel.ErrContentsTooLarge {
+			fm.onError(fmt.Errorf("skipping message on %q: %s", m.Topic(), err))
+			return true
+		} else if ctx.Err() != nil {
+			return false
+		}
+		fm.onError(err)
+		if !backoff.Sleep(ctx, &wait) {
+			return false
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package mqttbridge
+
+import (
+	"context"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testCtx = context.Background()
+
+func newTestPeel(o *peel.Opts) *peel.Peel {
+	p := peel.NewWithBackend(core.NewMemBackend(), o)
+	errCh := p.Run(nil)
+	go func() { panic(<-errCh) }()
+	return p
+}
+
+type testMessage struct {
+	topic   string
+	payload string
+	acked   bool
+}
+
+func (tm *testMessage) Topic() string   { return tm.topic }
+func (tm *testMessage) Payload() []byte { return []byte(tm.payload) }
+func (tm *testMessage) Ack()            { tm.acked = true }
+
+func TestRouteMatch(t *T) {
+	for _, tc := range []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"#", "$SYS/foo", false},
+		{"+/foo", "$SYS/foo", false},
+		{"$SYS/#", "$SYS/foo", true},
+	} {
+		assert.Equal(t, tc.match, Route{Filter: tc.filter}.Match(tc.topic), "filter:%q topic:%q", tc.filter, tc.topic)
+	}
+
+	for _, filter := range []string{"", "a/#/b", "a/b#", "a+/b"} {
+		assert.False(t, validFilter(filter), "filter:%q", filter)
+	}
+}
+
+func TestFromMQTT(t *T) {
+	p := newTestPeel(&peel.Opts{MaxContentsSize: 100})
+	tempQueue, allQueue := testutil.RandStr(), testutil.RandStr()
+	cgroup := testutil.RandStr()
+
+	// The third message is too large to ever be added, and the fourth matches
+	// no Route
+	mm := []*testMessage{
+		{topic: "sensors/1/temperature", payload: "21.5"},
+		{topic: "sensors/1/humidity", payload: "40"},
+		{topic: "sensors/2/temperature", payload: strings.Repeat("a", 101)},
+		{topic: "other", payload: "foo"},
+	}
+	msgs := make(chan Message, len(mm))
+	for _, m := range mm {
+		msgs <- m
+	}
+	close(msgs)
+
+	var errs []error
+	err := FromMQTT{
+		Peel:     p,
+		Messages: msgs,
+		Routes: []Route{
+			{Filter: "sensors/+/temperature", Queue: tempQueue, TTL: time.Minute},
+			{Filter: "sensors/#", Queue: allQueue, TTL: time.Hour},
+		},
+		OnError: func(err error) { errs = append(errs, err) },
+	}.Run(testCtx)
+	assert.Equal(t, ErrMessagesClosed, err)
+	assert.Len(t, errs, 2)
+	for _, m := range mm {
+		assert.True(t, m.acked, "topic:%q", m.topic)
+	}
+
+	assertNext := func(queue, contents string, ttl time.Duration) {
+		e, err := p.QGet(testCtx, peel.QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+		require.Nil(t, err)
+		assert.Equal(t, contents, e.Contents)
+		if contents != "" {
+			assert.WithinDuration(t, time.Now().Add(ttl), e.ID.Expire.Time(), 5*time.Second)
+		}
+	}
+	assertNext(tempQueue, "21.5", time.Minute)
+	assertNext(tempQueue, "", 0)
+	assertNext(allQueue, "40", time.Hour)
+	assertNext(allQueue, "", 0)
+
+	assert.NotNil(t, FromMQTT{Peel: p, Messages: msgs}.Run(testCtx))
+	assert.NotNil(t, FromMQTT{Peel: p, Messages: msgs, Routes: []Route{{Filter: "a/#/b", Queue: "foo"}}}.Run(testCtx))
+	assert.NotNil(t, FromMQTT{Peel: p, Messages: msgs, Routes: []Route{{Filter: "a"}}}.Run(testCtx))
+}
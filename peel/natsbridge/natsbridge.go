@@ -0,0 +1,238 @@
+// Package natsbridge fans the events in bananaq queues out onto NATS subjects,
+// so that lightweight subscribers can watch a queue's traffic without having to
+// be a consumer group of their own. A ToNATS consumes one or more queues and
+// publishes each of their events to a subject named after the queue, and a
+// FromNATS adds each message received on a subscription to a queue.
+//
+// Core NATS delivers at most once, so nothing is acked by the subscribers. A
+// ToNATS only acks an event once it's been handed to the NATS client, and
+// publishes it again if that fails, but a subscriber which is disconnected
+// when it's published won't see it.
+//
+// The package doesn't depend on any particular NATS client. Its Msg is shaped
+// like nats.go's, so an adapter for that client is mostly a matter of copying
+// fields:
+//
+//	type publisher struct{ nc *nats.Conn }
+//
+//	func (p publisher) PublishMsg(m natsbridge.Msg) error {
+//		return p.nc.PublishMsg(&nats.Msg{Subject: m.Subject, Header: nats.Header(m.Header), Data: m.Data})
+//	}
+package natsbridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+)
+
+// Headers which are set on each published message, and read from received
+// ones
+const (
+	// The ID of the event the message was published from
+	HeaderID = "Bananaq-Id"
+
+	// The queue the message was published from. A FromNATS ignores messages
+	// published from the queue it adds to, so that a ToNATS and FromNATS
+	// using the same subject don't add each event again forever.
+	HeaderQueue = "Bananaq-Queue"
+
+	// Set by publishers to have NATS JetStream ignore duplicates. FromNATS
+	// uses it in the same way, see FromNATS.
+	HeaderMsgID = "Nats-Msg-Id"
+)
+
+// DefaultSubjectPrefix is the SubjectPrefix used by ToNATS if none is given
+const DefaultSubjectPrefix = "bananaq."
+
+// Msg is a single NATS message. Header is shaped like nats.go's Header, which
+// is keyed by canonical MIME header names.
+type Msg struct {
+	Subject string
+	Header  map[string][]string
+	Data    []byte
+}
+
+func (m Msg) header(key string) string {
+	if vv := m.Header[key]; len(vv) > 0 {
+		return vv[0]
+	}
+	return ""
+}
+
+// Publisher publishes messages to NATS. nats.go's Conn can be adapted to it,
+// see the package docs.
+type Publisher interface {
+	PublishMsg(Msg) error
+}
+
+// ToNATS consumes each of its queues for a consumer group and publishes every
+// event to the subject made by appending the queue's name to SubjectPrefix,
+// with the event's contents as the message's data, and the event's ID and
+// queue in the Bananaq-Id and Bananaq-Queue headers. Subscribers can use
+// NATS's wildcards to watch many queues at once, e.g. "bananaq.>".
+//
+// Events are acked once the Publisher returns, and nacked if it returns an
+// error, so that they're published again.
+type ToNATS struct {
+	Peel          *peel.Peel // Required
+	Queues        []string   // Required
+	ConsumerGroup string     // Required
+	Publisher     Publisher  // Required
+
+	// Default DefaultSubjectPrefix
+	SubjectPrefix string
+
+	// Default 1. The most events from each queue which may be being published
+	// at once. Events are published in the order they're retrieved only if
+	// this is 1.
+	Concurrency int
+
+	// Default 30 seconds. How long each publish may take before the event may
+	// be retrieved again, see peel.Consumer.
+	AckDeadline time.Duration
+
+	// Optional. Called with every error encountered, see peel.Consumer.
+	OnError func(error)
+}
+
+// Subject returns the subject events from the queue are published to
+func (tn ToNATS) Subject(queue string) string {
+	prefix := tn.SubjectPrefix
+	if prefix == "" {
+		prefix = DefaultSubjectPrefix
+	}
+	return prefix + queue
+}
+
+// Run publishes events until ctx is done or the Peel starts draining, see
+// peel.Consumer's Run. An error is only returned if the ToNATS's fields are
+// invalid.
+func (tn ToNATS) Run(ctx context.Context) error {
+	if tn.Publisher == nil {
+		return errors.New("Publisher is required")
+	} else if len(tn.Queues) == 0 {
+		return errors.New("at least one queue is required")
+	}
+	for _, queue := range tn.Queues {
+		// NATS subjects are made of tokens separated by '.', and may not
+		// contain whitespace. '*' and '>' are wildcards.
+		if queue == "" || strings.ContainsAny(queue, " \t\r\n*>") {
+			return fmt.Errorf("queue %q can't be used in a NATS subject", queue)
+		}
+	}
+
+	errCh := make(chan error, len(tn.Queues))
+	for _, queue := range tn.Queues {
+		go func(queue string) {
+			subject := tn.Subject(queue)
+			errCh <- peel.Consumer{
+				Peel:          tn.Peel,
+				Queue:         queue,
+				ConsumerGroup: tn.ConsumerGroup,
+				Concurrency:   tn.Concurrency,
+				AckDeadline:   tn.AckDeadline,
+				OnError:       tn.OnError,
+				Handler: func(ctx context.Context, e core.Event) error {
+					return tn.Publisher.PublishMsg(Msg{
+						Subject: subject,
+						Header: map[string][]string{
+							HeaderID:    {e.ID.String()},
+							HeaderQueue: {queue},
+						},
+						Data: []byte(e.Contents),
+					})
+				},
+			}.Run(ctx)
+		}(queue)
+	}
+
+	var err error
+	for range tn.Queues {
+		if runErr := <-errCh; runErr != nil && err == nil {
+			err = runErr
+		}
+	}
+	return err
+}
+
+// ErrMsgsClosed is returned from FromNATS's Run when its Msgs channel is
+// closed, e.g. because the subscription was unsubscribed
+var ErrMsgsClosed = errors.New("msgs channel closed")
+
+// FromNATS adds each message received on a subscription to a queue, with the
+// message's data as the event's contents. Messages with a Nats-Msg-Id header
+// are added with a DedupKey made from it, which keeps duplicates from being
+// added for as long as the Peel's DedupWindow. Messages whose Bananaq-Queue
+// header is Queue were published from it by a ToNATS, and are ignored.
+//
+// With nats.go the Msgs channel can be filled using ChanSubscribe, or
+// ChanQueueSubscribe so that many FromNATS can share a subscription's messages
+// between them.
+type FromNATS struct {
+	Peel  *peel.Peel // Required
+	Msgs  <-chan Msg // Required
+	Queue string     // Required
+
+	// How long after being added each event expires. Required unless the
+	// queue has a DefaultTTL (see peel.QueueConfig).
+	TTL time.Duration
+
+	// Optional. Called with every error encountered. Must not block.
+	OnError func(error)
+}
+
+func (fn FromNATS) onError(err error) {
+	if fn.OnError != nil {
+		fn.OnError(err)
+	}
+}
+
+// Run adds messages one at a time until ctx is done, returning nil, or until
+// Msgs is closed, returning ErrMsgsClosed. Since NATS won't redeliver a
+// message, errors from adding messages are passed to OnError and the message
+// is dropped. Any other error is only returned if the FromNATS's fields are
+// invalid.
+func (fn FromNATS) Run(ctx context.Context) error {
+	if fn.Peel == nil || fn.Msgs == nil {
+		return errors.New("Peel and Msgs are required")
+	} else if fn.Queue == "" {
+		return errors.New("Queue is required")
+	}
+
+	for {
+		select {
+		case m, ok := <-fn.Msgs:
+			if !ok {
+				return ErrMsgsClosed
+			} else if m.header(HeaderQueue) == fn.Queue {
+				continue
+			} else if err := fn.add(ctx, m); err != nil {
+				fn.onError(fmt.Errorf("dropping message from %q: %w", m.Subject, err))
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (fn FromNATS) add(ctx context.Context, m Msg) error {
+	c := peel.QAddCommand{
+		Queue:    fn.Queue,
+		Contents: string(m.Data),
+	}
+	if id := m.header(HeaderMsgID); id != "" {
+		// DedupKeys may not contain ':'
+		c.DedupKey = "nats/" + strings.ReplaceAll(id, ":", "/")
+	}
+	if fn.TTL > 0 {
+		c.Expire = time.Now().Add(fn.TTL)
+	}
+	_, err := fn.Peel.QAdd(ctx, c)
+	return err
+}
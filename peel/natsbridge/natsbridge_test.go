@@ -0,0 +1,139 @@
+package natsbridge
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testCtx = context.Background()
+
+func newTestPeel(o *peel.Opts) *peel.Peel {
+	p := peel.NewWithBackend(core.NewMemBackend(), o)
+	errCh := p.Run(nil)
+	go func() { panic(<-errCh) }()
+	return p
+}
+
+// fails its first publish, and records the rest
+type testPublisher struct {
+	l      sync.Mutex
+	failed bool
+	mm     []Msg
+}
+
+func (tp *testPublisher) PublishMsg(m Msg) error {
+	tp.l.Lock()
+	defer tp.l.Unlock()
+	if !tp.failed {
+		tp.failed = true
+		return errors.New("nats: outbound buffer limit exceeded")
+	}
+	tp.mm = append(tp.mm, m)
+	return nil
+}
+
+func (tp *testPublisher) msgs() []Msg {
+	tp.l.Lock()
+	defer tp.l.Unlock()
+	return append([]Msg(nil), tp.mm...)
+}
+
+func TestToNATS(t *T) {
+	p := newTestPeel(nil)
+	queues := []string{testutil.RandStr(), testutil.RandStr()}
+	cgroup := testutil.RandStr()
+
+	ids := map[string]core.ID{}
+	for _, queue := range queues {
+		id, err := p.QAdd(testCtx, peel.QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(time.Minute),
+			Contents: "contents of " + queue,
+		})
+		require.Nil(t, err)
+		ids[queue] = id
+	}
+
+	tp := new(testPublisher)
+	ctx, cancel := context.WithCancel(testCtx)
+	doneCh := make(chan error)
+	go func() {
+		doneCh <- ToNATS{
+			Peel:          p,
+			Queues:        queues,
+			ConsumerGroup: cgroup,
+			Publisher:     tp,
+			SubjectPrefix: "events.",
+		}.Run(ctx)
+	}()
+
+	// The event whose publish failed is nacked, and so published again
+	assert.Eventually(t, func() bool { return len(tp.msgs()) == 2 }, time.Second, 10*time.Millisecond)
+	cancel()
+	require.Nil(t, <-doneCh)
+
+	var expected []Msg
+	for _, queue := range queues {
+		expected = append(expected, Msg{
+			Subject: "events." + queue,
+			Header: map[string][]string{
+				HeaderID:    {ids[queue].String()},
+				HeaderQueue: {queue},
+			},
+			Data: []byte("contents of " + queue),
+		})
+	}
+	assert.ElementsMatch(t, expected, tp.msgs())
+
+	assert.Equal(t, "bananaq.foo", ToNATS{}.Subject("foo"))
+	assert.NotNil(t, ToNATS{Peel: p, ConsumerGroup: cgroup, Publisher: tp}.Run(testCtx))
+	assert.NotNil(t, ToNATS{Peel: p, Queues: []string{"foo>"}, ConsumerGroup: cgroup, Publisher: tp}.Run(testCtx))
+	assert.NotNil(t, ToNATS{Peel: p, Queues: queues, ConsumerGroup: cgroup}.Run(testCtx))
+}
+
+func TestFromNATS(t *T) {
+	p := newTestPeel(&peel.Opts{MaxContentsSize: 100})
+	queue, cgroup := testutil.RandStr(), testutil.RandStr()
+
+	// The second message is a duplicate of the first, the third was published
+	// from the queue itself, and the fourth is too large to be added
+	data := testutil.RandStr()
+	msgs := make(chan Msg, 4)
+	msgs <- Msg{Subject: "foo", Header: map[string][]string{HeaderMsgID: {"a:1"}}, Data: []byte(data)}
+	msgs <- Msg{Subject: "foo", Header: map[string][]string{HeaderMsgID: {"a:1"}}, Data: []byte(data)}
+	msgs <- Msg{Subject: "foo", Header: map[string][]string{HeaderQueue: {queue}}, Data: []byte("loop")}
+	msgs <- Msg{Subject: "foo", Data: []byte(strings.Repeat("a", 101))}
+	close(msgs)
+
+	var errs []error
+	err := FromNATS{
+		Peel:    p,
+		Msgs:    msgs,
+		Queue:   queue,
+		TTL:     time.Minute,
+		OnError: func(err error) { errs = append(errs, err) },
+	}.Run(testCtx)
+	assert.Equal(t, ErrMsgsClosed, err)
+	require.Len(t, errs, 1)
+	assert.True(t, errors.Is(errs[0], peel.ErrContentsTooLarge))
+
+	e, err := p.QGet(testCtx, peel.QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, data, e.Contents)
+	e, err = p.QGet(testCtx, peel.QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{}, e)
+
+	assert.NotNil(t, FromNATS{Peel: p, Queue: queue}.Run(testCtx))
+	assert.NotNil(t, FromNATS{Peel: p, Msgs: msgs}.Run(testCtx))
+}
@@ -6,20 +6,26 @@
 // Initialization and Running
 //
 // A new peel takes in either a *pool.Pool or a *cluster.Cluster from the
-// radix.v2 package, and can be initialized and run like so:
+// radix.v2 package, or a *core.Sentinel when using redis sentinel, and can be
+// initialized and run like so:
 //
 // 	rpool, err := pool.New("tcp", "127.0.0.1:6379", 10)
 //	if err != nil {
 //		panic(err)
 //	}
 //
-//	p := &peel.Peel{Cmder: rpool}
+//	p := peel.New(rpool, nil)
 //	for {
 //  	errCh := p.Run(nil)
 //		err := <-errCh // block until error is hit
 //		log.Printf("peel run encountered error: %s", err)
 //	}
 //
+// Any other util.Cmder may be used as well, e.g. a pool shared with the rest of
+// the application, see core.New for details. For tests, or anywhere else redis
+// isn't available, NewWithBackend may be used with core.NewMemBackend to keep
+// everything in memory instead.
+//
 // All peels require that you call the Run method in them in order for them to
 // work properly. Run will run in the background, and will write to errCh and
 // exit if it encounters an error.
@@ -30,7 +36,7 @@
 // call any of its methods with any arguments. All command methods are
 // completely thread-safe
 //
-//	_, err := p.QAdd(peel.QAddCommand{
+//	_, err := p.QAdd(ctx, peel.QAddCommand{
 //		Queue: "foo",
 //		Expire: time.Now().Add(10 * time.Minute),
 //		Contents: "some stuff",
@@ -39,8 +45,15 @@
 package peel
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/mediocregopher/bananaq/core"
@@ -52,8 +65,95 @@ type Opts struct {
 	core.Opts
 
 	// Default 1 minute. Period of time to wait between automatic cleaning of
-	// all queues/consumer groups.
+	// all queues/consumer groups, which removes expired events and makes events
+	// which missed their ack deadline available again (see CleanAll). Only one
+	// of the Peels sharing the same database does this each period. If negative
+	// Run never cleans automatically.
 	CleanPeriod time.Duration
+
+	// Default 0, meaning unlimited. The maximum number of times a consumer
+	// group may retrieve an event with an ack deadline. Once an event has been
+	// retrieved this many times and missed its deadline (or been nack'd) it is
+	// moved to the consumer group's dead set instead of being made available
+	// again.
+	MaxDeliveries int
+
+	// Default 5 minutes. How long after an event with a DedupKey is added that
+	// further events with the same DedupKey will be ignored.
+	DedupWindow time.Duration
+
+	// Default 0, meaning disabled. If set Run will call QClean on all
+	// queues/consumer groups this often, so that events which miss their ack
+	// deadline are retried promptly rather than on the next CleanPeriod.
+	RedoSweepPeriod time.Duration
+
+	// Default 30 seconds. How long an event's contents are kept for after it
+	// expires, in case a consumer retrieves it just as it expires. Consumers
+	// which may still need the contents of an event (e.g. to QReply to it)
+	// after it's expired should set this to be longer. May be overridden for
+	// individual events with QAddCommand's Padding.
+	EventPadding time.Duration
+
+	// Default 0, meaning unlimited. The maximum size, in bytes, of an event's
+	// Contents. QAdd fails with ErrContentsTooLarge for events whose Contents
+	// are any larger.
+	MaxContentsSize int
+
+	// Default 0, meaning disabled. Events whose Contents are at least this
+	// many bytes are gzip compressed before being stored, and decompressed
+	// when they're retrieved. Events stored without compression are always
+	// read back correctly, so this may be changed at any time, but Peels which
+	// predate it will return compressed Contents as-is.
+	CompressThreshold int
+
+	// Optional. If set all events' Contents are encrypted using it before
+	// they're stored, and decrypted when they're retrieved. Events stored
+	// without encryption can still be retrieved, but retrieving encrypted
+	// events fails with ErrNoEncrypter if this isn't set. See
+	// NewAESGCMEncrypter.
+	Encrypter Encrypter
+
+	// Default 0, meaning disabled. The maximum number of events kept in memory
+	// after they're retrieved, so that retrieving them again, e.g. for
+	// another consumer group or after they're redelivered, doesn't need a
+	// round trip to fetch their Contents. Events are never changed once
+	// they're added, so cached events are only dropped once EventCacheTTL has
+	// passed, they expire, or they're the least recently used.
+	EventCacheSize int
+
+	// Default 1 minute. How long an event is kept in the cache for, see
+	// EventCacheSize.
+	EventCacheTTL time.Duration
+
+	// Default 5 seconds. How far ahead of the local clock the database's IDs
+	// may be before Healthy reports the Peel as unhealthy.
+	MaxClockSkew time.Duration
+
+	// Default JSONCodec. Used to marshal QAddCommand's Payload into an event's
+	// Contents, and by QGet and Unmarshal to unmarshal Contents back into a
+	// value. Every Peel sharing a queue should use the same Codec.
+	Codec Codec
+
+	// Default 1 minute. How long a consumer is listed by QConsumers for after
+	// it last called QGet or QGetMulti with a ConsumerID.
+	ConsumerTTL time.Duration
+
+	// Default slog.Default(). Receives structured records about the commands
+	// being run, events being redelivered or dead-lettered, and errors, see
+	// Logger.
+	Logger Logger
+
+	// Default false. If set QAck, QAckMulti, QExtend and QNack fail with
+	// ErrDeliveryTokenRequired unless they're given the DeliveryToken of the
+	// event they're for, see QAckCommand's DeliveryToken.
+	RequireDeliveryTokens bool
+
+	// Optional. The Peel of the redis which queues are being migrated to, see
+	// Migrate. Events added to queues which are being migrated are added to
+	// it too, and once a queue has been cut over most commands for it are
+	// performed on it instead. It should be given the same Opts as this Peel,
+	// apart from this field, and must be Run as well.
+	MigrationTarget *Peel
 }
 
 // Peel contains all the information needed to actually implement the
@@ -61,27 +161,216 @@ type Opts struct {
 // component and as a client for external applications which want to be able to
 // interact with the database directly. All methods on Peel are thread-safe,
 // except Run which should only be run by a single goroutine at a time.
+//
+// Methods which communicate with the database take a context.Context. If it's
+// done before a method completes the context's error is returned, including
+// while blocking in methods like QGet. As with core.Core, a method returning
+// early may still have made some of its changes.
 type Peel struct {
-	c *core.Core
-	o Opts
-}
+	c     *core.Core
+	o     Opts
+	sched *scheduler
 
-// TODO make methods take in a now parameter
+	// Closed once Drain is called
+	drainCh   chan struct{}
+	drainOnce *sync.Once
+	inFlight  *inFlight
+
+	configs    *configCache
+	migrations *migrationCache
+	tenants    *tenantCache
+	events     *eventCache
+	shardNext  *uint64
+}
 
 // New initializes a new Peel instance based on the given Cmder (which may be a
-// *pool.Pool or *cluster.Cluster) and extra options (which may be nil). Run
-// must be called in order to actually use the Peel.
+// *pool.Pool, *cluster.Cluster or *core.Sentinel) and extra options (which may
+// be nil). Run must be called in order to actually use the Peel.
+//
+// The Cmder may also be one the application already uses for other things, or
+// one which wraps another to add tracing; see core.New for what's allowed.
 func New(cmder util.Cmder, o *Opts) *Peel {
 	if o == nil {
 		o = &Opts{}
 	}
+	return newPeel(core.New(cmder, &o.Opts), o)
+}
+
+// NewWithBackend is like New, but the Peel stores its data in the given
+// core.Backend instead of redis, e.g. one returned by core.NewMemBackend. The
+// core.Opts embedded in Opts are ignored, apart from Hook, Tracer, Retry, Clock
+// and Faults.
+func NewWithBackend(b core.Backend, o *Opts) *Peel {
+	return newWithBackend(b, nil, o)
+}
+
+// NewMem is like New, but the Peel keeps everything in memory (see
+// core.NewMem), and considers the current time to be whatever the given Clock
+// says it is. A nil Clock means Opts.Clock is used, as with NewWithBackend,
+// and the core.Opts embedded in Opts are otherwise ignored in the same way.
+//
+// It's meant for tests of applications using bananaq. With a core.ManualClock
+// they can make events become visible, expire, or miss their ack deadlines by
+// advancing the clock rather than sleeping:
+//
+//	clock := core.NewManualClock(time.Now())
+//	p := peel.NewMem(clock, nil)
+//	p.Run(nil)
+//	// QAdd an event, QGet it with an AckDeadline a minute away, then
+//	clock.Advance(2 * time.Minute)
+//	p.Clean(ctx, queue, consumerGroup)
+//	// QGet returns the event again
+//
+// Anything which waits, like a blocking QGet, Heartbeat's renewals or Run's
+// periodic cleaning (which is what usually retries events that missed their
+// ack deadline), still waits in real time, and doesn't notice the clock being
+// moved until it next checks. So does the caching of QueueConfigs. Tests should
+// call Clean themselves after moving the clock.
+func NewMem(clock core.Clock, o *Opts) *Peel {
+	return newWithBackend(nil, clock, o)
+}
+
+// if b is nil a MemBackend using the Clock is made. If clock is nil the one in
+// the Opts is used.
+func newWithBackend(b core.Backend, clock core.Clock, o *Opts) *Peel {
+	if o == nil {
+		o = &Opts{}
+	}
+	if clock == nil {
+		clock = o.Clock
+	}
+	if clock == nil {
+		clock = core.SystemClock
+	}
+	if b == nil {
+		b = core.NewMemBackendWithClock(clock)
+	}
+	if o.Faults != nil {
+		b = core.WithFaults(b, o.Faults)
+	}
+	if o.Hook != nil {
+		b = core.WithHook(b, o.Hook)
+	}
+	if o.Tracer != nil {
+		b = core.WithTracer(b, o.Tracer)
+	}
+	if o.Retry != nil {
+		b = core.WithRetry(b, o.Retry)
+	}
+	return newPeel(core.NewWithBackendClock(b, clock), o)
+}
+
+func newPeel(c *core.Core, o *Opts) *Peel {
 	if o.CleanPeriod == 0 {
 		o.CleanPeriod = 1 * time.Minute
 	}
+	if o.DedupWindow == 0 {
+		o.DedupWindow = 5 * time.Minute
+	}
+	if o.EventPadding == 0 {
+		o.EventPadding = 30 * time.Second
+	}
+	if o.MaxClockSkew == 0 {
+		o.MaxClockSkew = 5 * time.Second
+	}
+	if o.ConsumerTTL == 0 {
+		o.ConsumerTTL = 1 * time.Minute
+	}
+	if o.EventCacheTTL == 0 {
+		o.EventCacheTTL = 1 * time.Minute
+	}
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+	if o.Codec == nil {
+		o.Codec = JSONCodec{}
+	}
 	return &Peel{
-		c: core.New(cmder, &o.Opts),
+		c: c,
 		o: *o,
+		sched: &scheduler{
+			m: map[string]*scheduled{},
+		},
+		drainCh:    make(chan struct{}),
+		drainOnce:  new(sync.Once),
+		inFlight:   newInFlight(),
+		configs:    newConfigCache(),
+		migrations: newMigrationCache(),
+		tenants:    newTenantCache(),
+		events:     newEventCache(o.EventCacheSize, o.EventCacheTTL),
+		shardNext:  new(uint64),
+	}
+}
+
+// now returns the current time according to the Core's Clock, which decides
+// everything about events which depends on the time
+func (p *Peel) now() time.Time {
+	return p.c.Now()
+}
+
+// start is called at the start of every command method. It starts tracing the
+// command if there's a Tracer (see core.Opts), returning the context the command
+// should use from then on. The returned function must be deferred, with err
+// pointing to the method's error return value, to report the command to the
+// Hook and/or Tracer once it's done. count, if given, is called at that point to
+// get the Stat's Count.
+func (p *Peel) start(ctx context.Context, name, queue, consumerGroup string) (context.Context, func(err *error, count func() int)) {
+	s := core.Stat{Name: name, Queue: queue, ConsumerGroup: consumerGroup}
+	var traceDone func(core.Stat)
+	if p.o.Tracer != nil {
+		ctx, traceDone = p.o.Tracer.Start(ctx, s)
+	}
+	start := time.Now()
+	return ctx, func(err *error, count func() int) {
+		s.Err = *err
+		logging := p.o.Logger.Enabled(ctx, statLevel(s))
+		if p.o.Hook == nil && traceDone == nil && !logging {
+			return
+		}
+		s.Duration = time.Since(start)
+		if count != nil {
+			s.Count = count()
+		}
+		if p.o.Hook != nil {
+			p.o.Hook.Observe(s)
+		}
+		if traceDone != nil {
+			traceDone(s)
+		}
+		if logging {
+			p.logStat(ctx, s)
+		}
+	}
+}
+
+func countOne() int { return 1 }
+
+func countEvent(e core.Event) int {
+	if e.ID == (core.ID{}) {
+		return 0
+	}
+	return 1
+}
+
+func countBool(b bool) int {
+	if !b {
+		return 0
+	}
+	return 1
+}
+
+// returns the queue all of the commands are for, or empty string if they're
+// for more than one
+func multiQueue(cc []QAddCommand) string {
+	for i := range cc {
+		if cc[i].Queue != cc[0].Queue {
+			return ""
+		}
 	}
+	if len(cc) == 0 {
+		return ""
+	}
+	return cc[0].Queue
 }
 
 // Run performs all the background work needed to support Peel. It spawns a
@@ -102,19 +391,46 @@ func (p *Peel) Run(stopCh chan struct{}) chan error {
 	errCh := make(chan error, 1)
 
 	go func() {
-		tick := time.NewTicker(p.o.CleanPeriod)
-		defer tick.Stop()
+		ctx := context.Background()
+
+		var tickCh <-chan time.Time
+		if p.o.CleanPeriod > 0 {
+			tick := time.NewTicker(p.o.CleanPeriod)
+			defer tick.Stop()
+			tickCh = tick.C
+		}
+
+		schedTick := time.NewTicker(1 * time.Second)
+		defer schedTick.Stop()
+
+		var sweepCh <-chan time.Time
+		if p.o.RedoSweepPeriod > 0 {
+			sweepTick := time.NewTicker(p.o.RedoSweepPeriod)
+			defer sweepTick.Stop()
+			sweepCh = sweepTick.C
+		}
 
 		var err error
 		defer func() {
+			if err != nil {
+				p.log(ctx, slog.LevelError, "background work stopped", "err", err)
+			}
 			errCh <- err
 			close(innerStopCh)
 		}()
 
 		for {
 			select {
-			case <-tick.C:
-				if err = p.CleanAll(); err != nil {
+			case <-tickCh:
+				if _, err = p.cleanAllOnce(ctx); err != nil {
+					return
+				}
+			case now := <-schedTick.C:
+				if err = p.runSchedules(ctx, now); err != nil {
+					return
+				}
+			case <-sweepCh:
+				if _, err = p.QClean(ctx, QCleanCommand{}); err != nil {
 					return
 				}
 			case err = <-coreErrCh:
@@ -131,42 +447,580 @@ func (p *Peel) Run(stopCh chan struct{}) chan error {
 // command
 type QAddCommand struct {
 	Queue    string    // Required
-	Expire   time.Time // Required
+	Expire   time.Time // Required, unless the queue has a DefaultTTL
 	Contents string    // Required
+
+	// Optional. If set the event will not be visible to consumer groups until
+	// this time has been reached. Consumers which are blocking on the queue
+	// are woken up once it becomes visible.
+	VisibleAfter time.Time
+
+	// Optional. Must be between 0 and MaxPriority. Events with a higher
+	// priority will be retrieved by consumer groups before those with a lower
+	// one, regardless of which was added first. Events being retried are always
+	// retrieved before any others.
+	Priority int
+
+	// Optional. If another event with the same DedupKey was added to the queue
+	// within the last DedupWindow (see Opts) then this event will not be added,
+	// and the ID of the previous event is returned instead. May not contain ':'.
+	// If an error is returned the DedupKey may still have been claimed.
+	DedupKey string
+
+	// Optional. The queue which the consumer of this event should add a reply
+	// to once it's done processing, using QReply. May not contain ':'.
+	ReplyTo string
+
+	// Optional. Overrides the EventPadding (see Opts) for this event. May not
+	// be negative.
+	Padding time.Duration
+
+	// Optional. Identifies whatever is adding the event, e.g. a producer or
+	// tenant, and is only used if the queue's QueueConfig has Fair set. Events
+	// are then delivered round-robin across PartitionKeys, with all events
+	// which don't have one sharing a turn.
+	PartitionKey string
+
+	// Optional, and may only be set if the queue's QueueConfig has Grouped
+	// set. Each consumer group only has one event with any particular GroupID
+	// in progress at a time, and retrieves a GroupID's events in the order
+	// they were added, while events with different GroupIDs are still
+	// retrieved in parallel. An event stays in progress until it's ack'd,
+	// dead, or expired, so one which is nack'd or misses its deadline is
+	// retried before the rest of its group. Events with a GroupID are
+	// retrieved before any others, and can't have a Priority or VisibleAfter.
+	// A queue's GroupIDs are hashed into its GroupBuckets (see QueueConfig),
+	// so unrelated GroupIDs can occasionally hold each other back.
+	GroupID string
+
+	// Optional. If set it's marshaled using the Codec (see Opts), and the
+	// result is used as the event's Contents, which must then not be set.
+	Payload interface{}
+
+	// Optional. If set the event's Contents, or its Payload once marshaled,
+	// are wrapped in a CloudEvent with these attributes, which is then used as
+	// the event's Contents in structured JSON mode (see ParseCloudEvent). Its
+	// Data must not be set. A random ID is generated if it doesn't have one,
+	// and if it has no DataContentType then one is set for Contents which
+	// aren't JSON.
+	CloudEvent *CloudEvent
+
+	// Set by QReply
+	inReplyTo core.ID
+
+	// Set when adding an event to a MigrationTarget, to give it the same ID it
+	// was given in the source
+	id core.ID
+}
+
+// ErrStrictFIFO is returned from QAdd when an event is given a Priority or
+// VisibleAfter but its queue has StrictFIFO set (see QueueConfig)
+var ErrStrictFIFO = errors.New("queue is strict FIFO")
+
+// ErrNoExpire is returned from QAdd when an event isn't given an Expire and its
+// queue doesn't have a DefaultTTL (see QueueConfig)
+var ErrNoExpire = errors.New("event has no expire")
+
+// ErrNotGrouped is returned from QAdd when an event is given a GroupID but its
+// queue doesn't have Grouped set (see QueueConfig)
+var ErrNotGrouped = errors.New("queue is not grouped")
+
+// MaxPriority is the highest Priority an event may be given
+const MaxPriority = 9
+
+// ErrContentsTooLarge is returned from QAdd when an event's Contents are larger
+// than the MaxContentsSize (see Opts)
+var ErrContentsTooLarge = errors.New("contents too large")
+
+func (p *Peel) checkContents(contents string) error {
+	if p.o.MaxContentsSize > 0 && len(contents) > p.o.MaxContentsSize {
+		return ErrContentsTooLarge
+	}
+	return nil
+}
+
+// checkQAdd returns an error if the command's fields are invalid. It doesn't
+// check the Queue itself.
+func (p *Peel) checkQAdd(c QAddCommand) error {
+	if c.Priority < 0 || c.Priority > MaxPriority {
+		return fmt.Errorf("priority %d is not between 0 and %d", c.Priority, MaxPriority)
+	}
+	if c.ReplyTo != "" {
+		if _, err := queueAvailable(c.ReplyTo); err != nil {
+			return err
+		}
+	}
+	if c.Padding < 0 {
+		return errors.New("Padding may not be negative")
+	}
+	if c.GroupID != "" && (c.Priority != 0 || !c.VisibleAfter.IsZero()) {
+		return errors.New("an event with a GroupID can't have a Priority or VisibleAfter")
+	}
+	return p.checkContents(c.Contents)
 }
 
 // QAdd adds an event to a queue. Once Expire is reached the event will no
 // longer be considered valid in the queue, and will eventually be cleaned up.
-func (p *Peel) QAdd(c QAddCommand) (core.ID, error) {
-	now := core.NewTS(time.Now())
-	e, err := p.c.NewEvent(now, core.NewTS(c.Expire), c.Contents)
+// If the queue's QueueConfig has a Retention then the event expires after that
+// long at the latest, and if Expire isn't set then the queue's DefaultTTL is
+// used.
+//
+// Contents may be any arbitrary bytes, they are stored and returned as-is. So
+// binary payloads like protobuf or msgpack can be used directly, e.g. with
+// string(b), without needing to be encoded first.
+//
+// If the queue has a MaxLength set (see QSetConfig) and is full then what
+// happens depends on the queue's Overflow policy. ErrQueueFull is returned if
+// the event couldn't be added because of it.
+func (p *Peel) QAdd(ctx context.Context, c QAddCommand) (_ core.ID, err error) {
+	ctx, end := p.start(ctx, "QAdd", c.Queue, "")
+	defer end(&err, countOne)
+	ii, err := p.qaddMigrate(ctx, []QAddCommand{c})
 	if err != nil {
 		return core.ID{}, err
 	}
+	return ii[0], nil
+}
 
-	// We always store the event data itself with an extra 30 seconds until it
-	// expires, just in case a consumer gets it just as its expire time hits
-	if err = p.c.SetEvent(e, 30*time.Second); err != nil {
-		return core.ID{}, err
+// QAddMulti is like QAdd, but adds multiple events at once using as few round
+// trips to redis as possible. The events may be for different queues, in which
+// case a round trip is needed for each distinct queue. The returned IDs will
+// be in the same order as the given commands.
+func (p *Peel) QAddMulti(ctx context.Context, cc []QAddCommand) (ii []core.ID, err error) {
+	ctx, end := p.start(ctx, "QAddMulti", multiQueue(cc), "")
+	defer end(&err, func() int { return len(ii) })
+	return p.qaddMigrate(ctx, cc)
+}
+
+func (p *Peel) qaddMulti(ctx context.Context, cc []QAddCommand) ([]core.ID, error) {
+	if len(cc) == 0 {
+		return []core.ID{}, nil
+	}
+	for _, c := range cc {
+		if err := authorizeIdentity(ctx, RightProduce, c.Queue); err != nil {
+			return nil, err
+		}
 	}
 
-	ewAvail, err := queueAvailable(c.Queue)
+	// The commands are copied so that encoding their Payloads and CloudEvents
+	// doesn't modify the caller's
+	cc = append([]QAddCommand(nil), cc...)
+	for i := range cc {
+		if err := p.encodePayload(&cc[i]); err != nil {
+			return nil, err
+		} else if err := encodeCloudEvent(&cc[i], p.now()); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.routeQAdds(ctx, cc); err != nil {
+		return nil, err
+	}
+
+	// Group the commands by queue, keeping track of the order queues were first
+	// seen in so the queries happen in a deterministic order
+	var queues []string
+	ewAvails := map[string][]exWrap{}
+	ewDelayeds := map[string][]exWrap{}
+	ewFairs := map[string][]exWrap{}
+	ewGroups := map[string][]exWrap{}
+	byQueue := map[string][]int{}
+	for i, c := range cc {
+		if err := p.checkQAdd(c); err != nil {
+			return nil, err
+		}
+		if _, ok := ewAvails[c.Queue]; !ok {
+			ewAvailBands, err := queueAvailableBands(c.Queue)
+			if err != nil {
+				return nil, err
+			}
+			ewDelayedBands, err := queueDelayedBands(c.Queue)
+			if err != nil {
+				return nil, err
+			}
+			ewFairBacklogs, err := queueFairBacklogs(c.Queue)
+			if err != nil {
+				return nil, err
+			}
+			ewGroupSets, err := queueGroups(c.Queue)
+			if err != nil {
+				return nil, err
+			}
+			ewAvails[c.Queue] = ewAvailBands
+			ewDelayeds[c.Queue] = ewDelayedBands
+			ewFairs[c.Queue] = ewFairBacklogs
+			ewGroups[c.Queue] = ewGroupSets
+			queues = append(queues, c.Queue)
+		}
+		byQueue[c.Queue] = append(byQueue[c.Queue], i)
+	}
+	if err := p.checkTenants(ctx, cc); err != nil {
+		return nil, err
+	}
+
+	// Delayed events don't count towards a queue's MaxLength until they become
+	// visible. makeRoom may block, so this must be done before the IDs are
+	// generated, otherwise consumer groups might have moved past them by the
+	// time they're added
+	qcs := map[string]QueueConfig{}
+	for _, q := range queues {
+		qc, err := p.getConfig(ctx, QGetConfigCommand{Queue: q})
+		if err != nil {
+			return nil, err
+		}
+		qcs[q] = qc
+		ewGroups[q] = ewGroups[q][:qc.groupBuckets()]
+
+		for _, i := range byQueue[q] {
+			if !cc[i].Expire.IsZero() {
+				continue
+			} else if qc.DefaultTTL == 0 {
+				return nil, ErrNoExpire
+			}
+			cc[i].Expire = p.now().Add(qc.DefaultTTL)
+		}
+		if qc.Retention > 0 {
+			maxExpire := p.now().Add(qc.Retention)
+			for _, i := range byQueue[q] {
+				if cc[i].Expire.IsZero() || cc[i].Expire.After(maxExpire) {
+					cc[i].Expire = maxExpire
+				}
+			}
+		}
+
+		// Both would have the event retrieved out of the order it was added in
+		for _, i := range byQueue[q] {
+			if qc.StrictFIFO && (cc[i].Priority != 0 || !cc[i].VisibleAfter.IsZero()) {
+				return nil, ErrStrictFIFO
+			} else if cc[i].GroupID != "" && !qc.Grouped {
+				return nil, ErrNotGrouped
+			}
+		}
+
+		var n uint64
+		for _, i := range byQueue[q] {
+			if !cc[i].VisibleAfter.After(p.now()) {
+				n++
+			}
+		}
+		if n == 0 {
+			continue
+		}
+		// Group sets are like the fair backlog as far as MaxLength goes
+		ewWaiting := append(append([]exWrap(nil), ewFairs[q]...), ewGroups[q]...)
+		if err := p.makeRoom(ctx, qc, ewAvails[q], ewWaiting, n); err != nil {
+			return nil, err
+		}
+	}
+
+	nowT := p.now()
+	now := core.NewTS(nowT)
+	tt, err := p.c.MonoTSs(ctx, now, len(cc))
 	if err != nil {
-		return core.ID{}, err
+		return nil, err
 	}
 
-	qa := core.QueryActions{
-		KeyBase:      ewAvail.base,
-		QueryActions: ewAvail.add(e.ID, e.ID.T),
-		Now:          now,
+	// Consumers of the events can link their processing of them back to
+	// whatever added them, see EventContext
+	var traceContext string
+	if p.o.Tracer != nil {
+		traceContext = p.o.Tracer.Inject(ctx)
+	}
+
+	// Events are stored alongside any others which have the same padding. The
+	// paddings are kept in the order they were first seen in, like queues
+	var paddings []time.Duration
+	eeByPadding := map[time.Duration][]core.Event{}
+	ii := make([]core.ID, len(cc))
+	dup := make([]bool, len(cc))
+	for i, c := range cc {
+		ii[i] = core.ID{T: tt[i], Expire: core.NewTS(c.Expire)}
+		if c.id != (core.ID{}) {
+			ii[i] = c.id
+		}
+
+		// If the DedupKey has been claimed already then the event is a
+		// duplicate, and the ID of the one which claimed it is returned
+		if c.DedupKey != "" {
+			k, err := queueDedup(c.Queue, c.DedupKey)
+			if err != nil {
+				return nil, err
+			}
+			var set bool
+			if ii[i], set, err = p.c.SetIDNX(ctx, k, ii[i], p.o.DedupWindow); err != nil {
+				return nil, err
+			}
+			if dup[i] = !set; dup[i] {
+				continue
+			}
+		}
+
+		padding := c.Padding
+		if padding == 0 {
+			padding = p.o.EventPadding
+		}
+
+		// Events kept for replay have their contents kept until then too. It's
+		// rounded up to the second so that events added together are still
+		// generally stored together.
+		if retention := qcs[c.Queue].ReplayRetention; retention > 0 && c.Expire.Before(nowT.Add(retention)) {
+			if keep := retention - c.Expire.Sub(nowT); keep > padding {
+				padding = keep.Truncate(time.Second) + time.Second
+			}
+		}
+		if _, ok := eeByPadding[padding]; !ok {
+			paddings = append(paddings, padding)
+		}
+		eeByPadding[padding] = append(eeByPadding[padding], core.Event{
+			ID:           ii[i],
+			Contents:     c.Contents,
+			ReplyTo:      c.ReplyTo,
+			InReplyTo:    c.inReplyTo,
+			TraceContext: traceContext,
+		})
+	}
+
+	// We always store the event data itself for a while longer than it
+	// expires, just in case a consumer gets it just as its expire time hits.
+	// If every event has the same padding, which is usual, they're set by the
+	// first Query below rather than needing a round trip of their own.
+	var queryEE []core.Event
+	var queryPadding time.Duration
+	if len(paddings) == 1 {
+		queryPadding = paddings[0]
+		if queryEE, err = p.encodeEvents(eeByPadding[queryPadding]); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, padding := range paddings {
+			if err = p.setEvents(ctx, eeByPadding[padding], padding); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, q := range queues {
+		ewAvailBands, ewDelayedBands := ewAvails[q], ewDelayeds[q]
+
+		// Delayed events each get added to their priority's delayed with their
+		// own score, all others are added to their priority's avail at once,
+		// or to their group set if they have a GroupID, or to their fair
+		// backlog if the queue is fair
+		var qq []core.QueryAction
+		var qiiReplay []core.ID
+		qiiBands := make([][]core.ID, MaxPriority+1)
+		qiiFairs := make([][]core.ID, fairBuckets)
+		qiiGroups := make([][]core.ID, len(ewGroups[q]))
+		for _, i := range byQueue[q] {
+			prio := cc[i].Priority
+			if dup[i] {
+				continue
+			}
+			qiiReplay = append(qiiReplay, ii[i])
+			if cc[i].GroupID != "" {
+				b := groupBucket(cc[i].GroupID, len(qiiGroups))
+				qiiGroups[b] = append(qiiGroups[b], ii[i])
+			} else if cc[i].VisibleAfter.After(nowT) {
+				visibleTS := core.NewTS(cc[i].VisibleAfter)
+				qq = append(qq, ewDelayedBands[prio].add(ii[i], visibleTS)...)
+			} else if qcs[q].Fair && prio == 0 {
+				b := fairBucket(cc[i].PartitionKey)
+				qiiFairs[b] = append(qiiFairs[b], ii[i])
+			} else {
+				qiiBands[prio] = append(qiiBands[prio], ii[i])
+			}
+		}
+		for prio, qii := range qiiBands {
+			if len(qii) > 0 {
+				qq = append(qq, ewAvailBands[prio].addMulti(qii, 0)...)
+			}
+		}
+		for b, qii := range qiiFairs {
+			if len(qii) > 0 {
+				qq = append(qq, ewFairs[q][b].addMulti(qii, 0)...)
+			}
+		}
+		for b, qii := range qiiGroups {
+			if len(qii) > 0 {
+				qq = append(qq, ewGroups[q][b].addMulti(qii, 0)...)
+			}
+		}
+		if qcs[q].ReplayRetention > 0 && len(qiiReplay) > 0 {
+			keyReplay, err := queueReplay(q)
+			if err != nil {
+				return nil, err
+			}
+			qq = append(qq,
+				core.QueryAction{
+					QuerySelector: &core.QuerySelector{Key: keyReplay, IDs: qiiReplay},
+				},
+				core.QueryAction{
+					QueryAddTo: &core.QueryAddTo{Keys: []core.Key{keyReplay}},
+				},
+			)
+		}
+		if (qcs[q].TraceMaxLength > 0 || qcs[q].Notify) && len(qiiReplay) > 0 {
+			traceAdded, err := traceActions(qcs[q], q, "", TraceAdded, now)
+			if err != nil {
+				return nil, err
+			}
+			qq = append(qq, core.QueryAction{
+				QuerySelector: &core.QuerySelector{Key: ewAvailBands[0].byArb, IDs: qiiReplay},
+			})
+			qq = append(qq, traceAdded...)
+		}
+
+		if len(qq) == 0 {
+			continue
+		}
+
+		// The IDs were generated up front, so adding them again if the Query
+		// is retried has no further effect
+		qa := core.QueryActions{
+			KeyBase:            ewAvailBands[0].base,
+			QueryActions:       qq,
+			Now:                now,
+			Idempotent:         true,
+			Events:             queryEE,
+			EventsExpireBuffer: queryPadding,
+		}
+		if _, err := p.c.Query(ctx, qa); err != nil {
+			return nil, err
+		}
+		queryEE = nil
+	}
+
+	// Blocking consumers wait on the priority zero avail, regardless of which
+	// priorities are actually in use
+	for _, q := range queues {
+		p.c.KeyNotify(ctx, ewAvails[q][0].byArb)
+	}
+
+	p.dualWrite(ctx, cc, ii, dup)
+	return ii, nil
+}
+
+// EventContext returns a copy of ctx which carries the trace context the given
+// Event was added with, if the Peel has a Tracer (see core.Opts) and the Event
+// was added by a Peel which had one too. Consumers can use it when processing
+// the Event, so that their processing is linked back to whatever added it.
+// Otherwise ctx is returned as-is.
+func (p *Peel) EventContext(ctx context.Context, e core.Event) context.Context {
+	if p.o.Tracer == nil || e.TraceContext == "" {
+		return ctx
+	}
+	return p.o.Tracer.Extract(ctx, e.TraceContext)
+}
+
+// ErrNoReplyTo is returned from QReply when the event being replied to wasn't
+// added with a ReplyTo
+var ErrNoReplyTo = errors.New("event has no ReplyTo")
+
+// QReplyCommand describes the parameters which can be passed into the QReply
+// command
+type QReplyCommand struct {
+	EventID  core.ID   // Required, the ID of the event being replied to
+	Expire   time.Time // Required, unless the ReplyTo queue has a DefaultTTL
+	Contents string    // Required
+}
+
+// QReply adds a reply to the event with the given ID to the event's ReplyTo
+// queue, as given to QAdd. The reply's InReplyTo field will be set to the ID of
+// the event it's replying to. ErrNoReplyTo is returned if the event has no
+// ReplyTo, and core.ErrNotFound if the event has expired.
+func (p *Peel) QReply(ctx context.Context, c QReplyCommand) (_ core.ID, err error) {
+	ctx, end := p.start(ctx, "QReply", "", "")
+	defer end(&err, countOne)
+	e, err := p.getEvent(ctx, c.EventID)
+	if err != nil {
+		return core.ID{}, err
+	} else if e.ReplyTo == "" {
+		return core.ID{}, ErrNoReplyTo
 	}
-	if _, err := p.c.Query(qa); err != nil {
+
+	ii, err := p.qaddMigrate(ctx, []QAddCommand{{
+		Queue:     e.ReplyTo,
+		Expire:    c.Expire,
+		Contents:  c.Contents,
+		inReplyTo: e.ID,
+	}})
+	if err != nil {
 		return core.ID{}, err
 	}
+	return ii[0], nil
+}
+
+// returns actions which will move all events in each priority's delayed which
+// have become visible into that priority's avail. They are given scores in
+// avail based on the current time, rather than their IDs, so that consumer
+// groups which have already moved past their IDs will still see them.
+func promoteDelayed(ewDelayeds, ewAvails []exWrap, now core.TS) []core.QueryAction {
+	var qq []core.QueryAction
+	for i := range ewDelayeds {
+		qq = append(qq, promoteDelayedBand(ewDelayeds[i], ewAvails[i], now)...)
+	}
+	return qq
+}
+
+func promoteDelayedBand(ewDelayed, ewAvail exWrap, now core.TS) []core.QueryAction {
+	var qq []core.QueryAction
+	qq = append(qq, ewDelayed.removeExpired(now)...)
+	qq = append(qq, ewDelayed.notAfter(now))
+	qq = append(qq, ewDelayed.removeFromInput())
+	qq = append(qq,
+		core.QueryAction{
+			QueryAddTo: &core.QueryAddTo{
+				Keys:      []core.Key{ewAvail.byArb},
+				Score:     now,
+				ScoreIncr: true,
+			},
+		},
+		core.QueryAction{
+			QueryAddTo: &core.QueryAddTo{
+				Keys:          []core.Key{ewAvail.byExp},
+				ExpireAsScore: true,
+			},
+		},
+	)
+	return qq
+}
 
-	p.c.KeyNotify(ewAvail.byArb)
+// returns actions which will move the oldest event from each fair backlog set
+// into avail, so that events are made available round-robin across the sets.
+// Enough rounds are done to make at least count events available, if every set
+// has enough in it. Like delayed events they're given scores in avail based on
+// the current time.
+func promoteFair(ewFairs []exWrap, ewAvail exWrap, count int, now core.TS) []core.QueryAction {
+	var qq []core.QueryAction
+	for _, ewFair := range ewFairs {
+		qq = append(qq, ewFair.removeExpired(now)...)
+	}
 
-	return e.ID, nil
+	for round := 0; round*len(ewFairs) < count; round++ {
+		for i, ewFair := range ewFairs {
+			sel := ewFair.after(0, 1)
+			sel.Union = i > 0
+			qq = append(qq, sel)
+		}
+		for _, ewFair := range ewFairs {
+			qq = append(qq, ewFair.removeFromInput())
+		}
+		qq = append(qq,
+			core.QueryAction{
+				QueryAddTo: &core.QueryAddTo{
+					Keys:      []core.Key{ewAvail.byArb},
+					Score:     now + core.TS(round*len(ewFairs)),
+					ScoreIncr: true,
+				},
+			},
+			core.QueryAction{
+				QueryAddTo: &core.QueryAddTo{
+					Keys:          []core.Key{ewAvail.byExp},
+					ExpireAsScore: true,
+				},
+			},
+		)
+	}
+	return qq
 }
 
 // QGetCommand describes the parameters which can be passed into the QGet
@@ -175,266 +1029,3309 @@ type QGetCommand struct {
 	Queue         string // Required
 	ConsumerGroup string // Required
 	AckDeadline   time.Time
-	BlockUntil    time.Time
-}
 
-// QGet retrieves an available event from the given queue for the given consumer
-// group.
-//
-// If AckDeadline is given, then the consumer has until then to QAck the
-// Event before it is placed back in the queue for this consumer group. If
+	// Optional. Like AckDeadline, but relative to when the events are
+	// retrieved, so that time spent blocking doesn't count against it. Ignored
+	// if AckDeadline is set.
+	AckTimeout time.Duration
+
+	// Optional. If there are no available events the call will wait until
+	// either one is added or BlockUntil is reached. Waiting is done on a pubsub
+	// channel for the queue, which QAdd publishes to, not by polling. If the
+	// queue has delayed events the call also wakes up when the soonest of them
+	// becomes visible.
+	BlockUntil time.Time
+
+	// Optional. Like BlockUntil, but relative to when the call is made. Ignored
+	// if BlockUntil is set.
+	Block time.Duration
+
+	// Optional. Identifies the consumer retrieving the events, which is then
+	// listed by QConsumers. If AckDeadline is set the events are also claimed
+	// by the consumer, see QPendingList. May not contain ':'.
+	ConsumerID string
+
+	// Optional. If set, and an event is retrieved, the event's Contents are
+	// unmarshaled into it using the Codec (see Opts). It should be a pointer,
+	// e.g. &MyStruct{}. May not be used with QGetMulti, see Unmarshal.
+	Payload interface{}
+
+	// Optional. If set, and an event is retrieved, the event's Contents are
+	// parsed as a CloudEvent into it, and if Payload is also set it's
+	// unmarshaled from the CloudEvent's Data. May not be used with QGetMulti,
+	// see ParseCloudEvent.
+	CloudEvent *CloudEvent
+
+	// Optional. If set only events whose Contents match this expression are
+	// retrieved, e.g. `user.country == "NZ" && amount >= 100`. The expression
+	// is one or more conditions joined by "&&", each being a field, one of the
+	// operators ==, !=, <, <=, > or >=, and a JSON string, number, true, false
+	// or null. Fields are dot separated keys into the Contents, which must be
+	// a JSON object, optionally prefixed with "$.". A field the Contents don't
+	// have is treated as null, and < <= > >= only match numbers with numbers
+	// and strings with strings.
+	//
+	// Events are matched within the Query which retrieves them, so the
+	// consumer group is never sent those which don't match. Events which are
+	// skipped over because they don't match are never retrieved by the
+	// consumer group, as if they'd been acked, so every consumer in a group
+	// should use the same Filter. A consumer group which only wants some of a
+	// queue's events should be given its own group.
+	//
+	// Compressed or encrypted Contents can't be matched, so Filter can't be
+	// used by a Peel with CompressThreshold or an Encrypter set (see Opts),
+	// and events stored by one never match. Filter also can't be used with
+	// Grouped queues, nor against a redis cluster (see
+	// core.ErrClusterContentsFilter).
+	Filter string
+}
+
+// QGet retrieves an available event from the given queue for the given consumer
+// group.
+//
+// If AckDeadline is given, then the consumer has until then to QAck the
+// Event before it is placed back in the queue for this consumer group. If
 // AckDeadline is not set, then the Event will never be placed back, and QAck
-// isn't necessary.
+// isn't necessary, unless the queue's QueueConfig has an AckDeadline in which
+// case that's used.
+//
+// The returned Event's Attempts field will be set to the number of times the
+// event has been retrieved with an AckDeadline by this consumer group, including
+// this time, without being QAck'd.
+//
+// If AckDeadline is given the returned Event's DeliveryToken is also set. It's
+// unique to this delivery of the event, and if it's given to QAck then the ack
+// fails if the event has since been delivered again, e.g. because this
+// delivery's deadline was missed. Combined with QAddCommand's DedupKey this
+// allows each event to be processed exactly once.
+//
+// An empty event is returned if there are no available events for the queue,
+// or if the queue is paused (see QPause).
+//
+// If Payload or CloudEvent is given and the event's Contents can't be
+// unmarshaled into them the event is still returned, along with the error, so
+// that it can be QAck'd or QNack'd.
+func (p *Peel) QGet(ctx context.Context, c QGetCommand) (e core.Event, err error) {
+	if t, err := p.migratedTo(ctx, c.Queue); err != nil {
+		return core.Event{}, err
+	} else if t != nil {
+		return t.QGet(ctx, c)
+	}
+	ctx, end := p.start(ctx, "QGet", c.Queue, c.ConsumerGroup)
+	defer end(&err, func() int { return countEvent(e) })
+	ee, err := p.qget(ctx, c, 1)
+	if err != nil || len(ee) == 0 {
+		return core.Event{}, err
+	}
+	contents := []byte(ee[0].Contents)
+	if c.CloudEvent != nil {
+		ce, err := ParseCloudEvent(ee[0])
+		if err != nil {
+			return ee[0], err
+		}
+		*c.CloudEvent, contents = ce, ce.Data
+	}
+	if c.Payload != nil {
+		if err := p.o.Codec.Unmarshal(contents, c.Payload); err != nil {
+			return ee[0], err
+		}
+	}
+	return ee[0], nil
+}
+
+// QGetMultiCommand describes the parameters which can be passed into the
+// QGetMulti command
+type QGetMultiCommand struct {
+	QGetCommand
+	Count int // Required
+}
+
+// QGetMulti is like QGet, but atomically retrieves up to Count available events
+// at once. If AckDeadline is given it applies to all of the returned events.
+//
+// Events which need to be re-attempted by the consumer group are always
+// returned on their own, before any new events are returned. So fewer than
+// Count events may be returned even if there are more available.
+//
+// An empty slice is returned if there are no available events for the queue.
+func (p *Peel) QGetMulti(ctx context.Context, c QGetMultiCommand) (ee []core.Event, err error) {
+	if t, err := p.migratedTo(ctx, c.Queue); err != nil {
+		return nil, err
+	} else if t != nil {
+		return t.QGetMulti(ctx, c)
+	}
+	ctx, end := p.start(ctx, "QGetMulti", c.Queue, c.ConsumerGroup)
+	defer end(&err, func() int { return len(ee) })
+	if c.Count < 1 {
+		return nil, errors.New("Count must be at least 1")
+	} else if c.Payload != nil || c.CloudEvent != nil {
+		return nil, errors.New("Payload and CloudEvent can't be used with QGetMulti")
+	}
+	return p.qget(ctx, c.QGetCommand, c.Count)
+}
+
+// qget implements QGet and QGetMulti, including blocking. If ctx is done while
+// blocking then no events are returned, along with ctx's error. The same goes
+// for ErrDraining if the Peel starts draining.
+func (p *Peel) qget(ctx context.Context, c QGetCommand, count int) ([]core.Event, error) {
+	if p.Draining() {
+		return nil, ErrDraining
+	}
+
+	if c.ConsumerID != "" {
+		if err := p.registerConsumer(ctx, c.Queue, c.ConsumerGroup, c.ConsumerID); err != nil {
+			return nil, err
+		}
+	}
+
+	now := p.now()
+	if c.BlockUntil.IsZero() && c.Block > 0 {
+		c.BlockUntil = now.Add(c.Block)
+	}
+
+	shards, err := p.queueShards(ctx, c.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.BlockUntil.IsZero() {
+		return p.qgetShards(ctx, c, shards, count, false)
+	}
+
+	kk := make([]core.Key, len(shards))
+	for i, shard := range shards {
+		ewAvail, err := queueAvailable(shard)
+		if err != nil {
+			return nil, err
+		}
+		kk[i] = ewAvail.byArb
+	}
+
+	timeoutCh := time.After(c.BlockUntil.Sub(now))
+
+	// Being woken up by new events being added isn't enough if the consumer
+	// group is rate limited, since events might already be available but not
+	// allowed to be retrieved yet. So also check periodically, based on how
+	// often the rate limit allows for an event to be retrieved.
+	rl, err := p.getRateLimit(ctx, QGetRateLimitCommand{
+		Queue:         c.Queue,
+		ConsumerGroup: c.ConsumerGroup,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rlPeriod time.Duration
+	if rl.Rate > 0 {
+		rlPeriod = time.Duration(float64(time.Second) / rl.Rate)
+		if rlPeriod < 10*time.Millisecond {
+			rlPeriod = 10 * time.Millisecond
+		} else if rlPeriod > 1*time.Second {
+			rlPeriod = 1 * time.Second
+		}
+	}
+
+	for {
+		waitCtx, cancel := context.WithCancel(ctx)
+		pushCh := p.keyWaitAny(waitCtx, kk)
+
+		var rlCh <-chan time.Time
+		if rlPeriod > 0 {
+			rlCh = time.After(rlPeriod)
+		}
+
+		checked := core.NewTS(p.now())
+		if ee, err := p.qgetShards(ctx, c, shards, count, false); err != nil || len(ee) > 0 {
+			cancel()
+			return ee, err
+		}
+
+		// Nothing is notified when a delayed event becomes visible, or when an
+		// event misses its deadline, so wake up in time for the soonest one.
+		// Any which were already due when checked would have been retrieved,
+		// unless the queue is paused.
+		var wakeAt core.TS
+		for _, shard := range shards {
+			shardWakeAt, err := p.nextWake(ctx, shard, c.ConsumerGroup, checked)
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			if shardWakeAt > 0 && (wakeAt == 0 || shardWakeAt < wakeAt) {
+				wakeAt = shardWakeAt
+			}
+		}
+		var wakeCh <-chan time.Time
+		if wakeAt > 0 {
+			wakeCh = time.After(wakeAt.Time().Sub(p.now()))
+		}
+
+		select {
+		case <-pushCh:
+		case <-rlCh:
+		case <-wakeCh:
+		case <-timeoutCh:
+			cancel()
+			return []core.Event{}, nil
+		case <-p.drainCh:
+			cancel()
+			return nil, ErrDraining
+		}
+
+		cancel()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// keyWaitAny is like KeyWait, but the returned channel is written to once any of
+// the given Keys is notified
+func (p *Peel) keyWaitAny(ctx context.Context, kk []core.Key) <-chan struct{} {
+	if len(kk) == 1 {
+		return p.c.KeyWait(ctx, kk[0])
+	}
+	ch := make(chan struct{}, len(kk))
+	for _, k := range kk {
+		go func(pushCh <-chan struct{}) {
+			<-pushCh
+			ch <- struct{}{}
+		}(p.c.KeyWait(ctx, k))
+	}
+	return ch
+}
+
+// nextWake returns the soonest time after the given one at which a blocking QGet
+// should check the queue again even though nothing was notified, or 0 if there
+// is none. That's when the soonest of the queue's delayed events becomes
+// visible, or if the queue is StrictFIFO when the soonest of the consumer
+// group's in progress events misses its deadline.
+func (p *Peel) nextWake(ctx context.Context, queue, cgroup string, after core.TS) (core.TS, error) {
+	ewDelayeds, err := queueDelayedBands(queue)
+	if err != nil {
+		return 0, err
+	}
+
+	ewInProg, err := queueInProgress(queue, cgroup)
+	if err != nil {
+		return 0, err
+	}
+
+	keyStrict, err := queueStrict(queue)
+	if err != nil {
+		return 0, err
+	}
+
+	// The input starts off empty, which is passed through if the queue isn't
+	// StrictFIFO
+	inProg := ewInProg.after(after, 1)
+	inProg.QueryConditional = core.QueryConditional{IfNotEmpty: &keyStrict}
+	qq := []core.QueryAction{inProg, ewInProg.scoresFromInput()}
+	for _, ewDelayed := range ewDelayeds {
+		qq = append(qq, ewDelayed.after(after, 1), ewDelayed.scoresFromInput())
+	}
+
+	res, err := p.c.Query(ctx, core.QueryActions{
+		KeyBase:      ewDelayeds[0].base,
+		QueryActions: qq,
+		Now:          core.NewTS(p.now()),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var wakeAt core.TS
+	for _, score := range res.Counts {
+		if wakeAt == 0 || core.TS(score) < wakeAt {
+			wakeAt = core.TS(score)
+		}
+	}
+	return wakeAt, nil
+}
+
+// qgetDirect does the actual work of retrieving up to count events for QGet. If
+// peek is true then the events which would have been retrieved are returned,
+// but none of the queue/consumer group's state is changed to reflect them
+// having been retrieved.
+//
+// Selecting the events and marking them as retrieved is all done within a single
+// Query, so concurrent consumers in the same group never get the same event.
+func (p *Peel) qgetDirect(ctx context.Context, c QGetCommand, count int, peek bool) ([]core.Event, error) {
+	qc, err := p.cachedConfig(ctx, c.Queue)
+	if err != nil {
+		return nil, err
+	} else if !peek && c.AckDeadline.IsZero() && c.AckTimeout > 0 {
+		c.AckDeadline = p.now().Add(c.AckTimeout)
+	} else if !peek && c.AckDeadline.IsZero() && qc.AckDeadline > 0 {
+		c.AckDeadline = p.now().Add(qc.AckDeadline)
+	}
+
+	var cf *core.ContentsFilter
+	if c.Filter != "" {
+		if qc.Grouped {
+			return nil, errors.New("Filter can't be used with a Grouped queue")
+		} else if p.o.CompressThreshold > 0 || p.o.Encrypter != nil {
+			// Compressed and encrypted Contents can't be matched within redis,
+			// so they'd be skipped over and never retrieved
+			return nil, errors.New("Filter can't be used with CompressThreshold or an Encrypter")
+		}
+		parsed, err := ParseFilter(c.Filter)
+		if err != nil {
+			return nil, err
+		}
+		cf = &parsed
+	}
+
+	ewAvails, err := queueAvailableBands(c.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	ewDelayeds, err := queueDelayedBands(c.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	ewFairs, err := queueFairBacklogs(c.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	ewInProg, ewRedo, _, err := queueCGroupKeys(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPtrs, err := queuePointerBands(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	ewAttempts, err := queueAttempts(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	keyClaims, err := queueClaims(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	ewDeliveries, err := queueDeliveries(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPaused, err := queuePaused(c.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	keyRateLimit, err := queueRateLimit(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	ewDead, err := queueDead(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	keyStrict, err := queueStrict(c.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only Grouped queues have group sets to check, see queueGroups
+	var ewGroups, ewGroupInProgs []exWrap
+	var keyGroupPtrs []core.Key
+	if qc.Grouped {
+		if ewGroups, err = queueGroups(c.Queue); err != nil {
+			return nil, err
+		}
+		keyGroupPtrs, ewGroupInProgs, err = queueGroupCGroupKeys(c.Queue, c.ConsumerGroup)
+		if err != nil {
+			return nil, err
+		}
+		ewGroups = ewGroups[:qc.groupBuckets()]
+	}
+
+	// Events might still have a claim from a previous consumer, which must be
+	// replaced
+	claim := core.QueryAction{HashDel: &keyClaims}
+	if c.ConsumerID != "" {
+		claim = core.QueryAction{
+			QueryHashSet: &core.QueryHashSet{
+				Key:   keyClaims,
+				Value: c.ConsumerID,
+			},
+		}
+	}
+
+	now := core.NewTS(p.now())
+	limit := int64(count)
+
+	traceDelivered, err := traceActions(qc, c.Queue, c.ConsumerGroup, TraceDelivered, now)
+	if err != nil {
+		return nil, err
+	}
+	traceDead, err := traceActions(qc, c.Queue, c.ConsumerGroup, TraceDeadLettered, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// Depending on if Expire is set, we might add the events to the inProg in
+	// addition to setting the pointer (if one is given). If we're only peeking
+	// we do neither.
+	maybeDone := func(keyPtr *core.Key, ewAvail exWrap) []core.QueryAction {
+		qq := make([]core.QueryAction, 0, 9)
+		if !peek && keyPtr != nil {
+			qq = append(qq, core.QueryAction{
+				QuerySingleSet: &core.QuerySingleSet{
+					Key:       *keyPtr,
+					IfNewer:   true,
+					Newest:    true,
+					ScoreFrom: &ewAvail.byArb,
+				},
+			})
+		}
+		if !peek && !c.AckDeadline.IsZero() {
+			addToInProg := ewInProg.addFromInput(core.NewTS(c.AckDeadline))
+			qq = append(qq, addToInProg...)
+			qq = append(qq, claim)
+			qq = append(qq, ewAttempts.incrFromInput(1)...)
+			qq = append(qq, ewDeliveries.addFromInput(now)...)
+		}
+		if !peek {
+			qq = append(qq, traceDelivered...)
+		}
+		qq = append(qq, ewAttempts.scoresFromInput())
+		qq = append(qq, core.QueryAction{
+			Break: true,
+			QueryConditional: core.QueryConditional{
+				IfInput: true,
+			},
+		})
+		return qq
+	}
+
+	// If the consumer group has a rate limit, only as many events as it allows
+	// are retrieved. This must be done before events are removed from wherever
+	// they were selected from.
+	rateLimit := func() []core.QueryAction {
+		if peek {
+			return nil
+		}
+		return []core.QueryAction{{RateLimit: &keyRateLimit}}
+	}
+
+	var qq []core.QueryAction
+
+	// Nothing can be retrieved from a paused queue, though it can still be
+	// peeked at
+	if !peek {
+		qq = append(qq, core.QueryAction{
+			Break: true,
+			QueryConditional: core.QueryConditional{
+				IfNotEmpty: &keyPaused,
+			},
+		})
+	}
+
+	// If the queue is strict FIFO, events which missed their deadline are
+	// moved to redo so they're retrieved before anything newer. After that
+	// nothing can be retrieved while the consumer group has events in
+	// progress. If it isn't, the selections are skipped and their empty input
+	// is passed through.
+	if !peek {
+		missed := ewInProg.notAfter(now)
+		missed.QueryConditional = core.QueryConditional{IfNotEmpty: &keyStrict}
+		qq = append(qq, p.redoFromInProg(missed, p.maxDeliveries(qc), ewInProg, ewRedo, ewAttempts, ewDead, keyClaims, traceDead)...)
+
+		// The missed events are gone from inProg now, so selecting them again
+		// empties the input, which is what the Break below will return
+		qq = append(qq, missed)
+	}
+	qq = append(qq, core.QueryAction{
+		Break: true,
+		QueryConditional: core.QueryConditional{
+			And: []core.QueryConditional{
+				{IfNotEmpty: &keyStrict},
+				{IfNotEmpty: &ewInProg.byArb},
+			},
+		},
+	})
+
+	// Before anything else, any delayed events which have become visible are
+	// made available
+	qq = append(qq, promoteDelayed(ewDelayeds, ewAvails, now)...)
+
+	// First, if there's any IDs in redo, we try to grab the first ones from
+	// there. These have usually been retrieved from avail already, but if the
+	// pointer of the priority they came from isn't past them yet it's moved up
+	// to them.
+	qq = append(qq, ewRedo.removeExpired(now)...)
+	qq = append(qq, ewRedo.after(0, limit))
+	qq = append(qq, rateLimit()...)
+	if !peek {
+		qq = append(qq, ewRedo.removeFromInput())
+		for prio := range ewAvails {
+			qq = append(qq, core.QueryAction{
+				QuerySingleSet: &core.QuerySingleSet{
+					Key:       keyPtrs[prio],
+					IfNewer:   true,
+					Newest:    true,
+					ScoreFrom: &ewAvails[prio].byArb,
+				},
+			})
+		}
+	}
+	qq = append(qq, maybeDone(nil, exWrap{})...)
+
+	// Then try each group set which the consumer group has nothing in progress
+	// from. Events stop holding up their group set once they're no longer in
+	// inProg or redo, at which point they're removed from its groupInProg.
+	// Filtering those removed events by groupInProg afterwards empties the
+	// input, so that it isn't passed through by the conditional selections.
+	for b := range ewGroups {
+		ewGroup, keyPtr, ewGroupInProg := ewGroups[b], &keyGroupPtrs[b], ewGroupInProgs[b]
+		ifNotInProg := core.QueryConditional{IfEmpty: &ewGroupInProg.byArb}
+
+		var gqq []core.QueryAction
+		gqq = append(gqq, ewGroup.removeExpired(now)...)
+		if !peek {
+			gqq = append(gqq,
+				ewGroupInProg.after(0, 0),
+				core.QueryAction{QueryFilter: &core.QueryFilter{ScoreKey: &ewInProg.byArb, Invert: true}},
+				core.QueryAction{QueryFilter: &core.QueryFilter{ScoreKey: &ewRedo.byArb, Invert: true}},
+				ewGroupInProg.removeFromInput(),
+				ewGroupInProg.filterByScore(0, 0),
+			)
+		}
+
+		// Only one event is retrieved from each group set, since the next
+		// one can't be until it's done with
+		markInProg := func() []core.QueryAction {
+			if peek || c.AckDeadline.IsZero() {
+				return nil
+			}
+			return ewGroupInProg.addFromInput(0)
+		}
+
+		ptr := core.QueryAction{SingleGet: keyPtr, QueryConditional: ifNotInProg}
+		next := ewGroup.afterInput(1)
+		next.QueryConditional = ifNotInProg
+		gqq = append(gqq, ptr, next)
+		gqq = append(gqq, rateLimit()...)
+		gqq = append(gqq, markInProg()...)
+		gqq = append(gqq, maybeDone(keyPtr, ewGroup)...)
+
+		first := ewGroup.after(0, 1)
+		first.QueryConditional = core.QueryConditional{
+			And: []core.QueryConditional{{IfEmpty: keyPtr}, ifNotInProg},
+		}
+		gqq = append(gqq, first)
+		gqq = append(gqq, rateLimit()...)
+		gqq = append(gqq, markInProg()...)
+		gqq = append(gqq, maybeDone(keyPtr, ewGroup)...)
+
+		// All of the above is skipped for group sets which are empty
+		for i := range gqq {
+			cond := &gqq[i].QueryConditional
+			cond.And = append(cond.And, core.QueryConditional{IfNotEmpty: &ewGroup.byArb})
+		}
+		qq = append(qq, gqq...)
+	}
+
+	// With a Filter more events than are wanted are selected, and only those
+	// which match are kept. If none of them do the pointer is moved past them,
+	// which is appended to the result's Counts.
+	scan := limit
+	if cf != nil && scan < filterScan {
+		scan = filterScan
+	}
+	filter := func(keyPtr *core.Key, ewAvail exWrap) []core.QueryAction {
+		if cf == nil {
+			return nil
+		}
+		qcf := &core.QueryContentsFilter{ContentsFilter: *cf, Limit: limit}
+		if !peek {
+			qcf.SkipTo, qcf.SkipScoreFrom = keyPtr, &ewAvail.byArb
+		}
+		return []core.QueryAction{{QueryContentsFilter: qcf}}
+	}
+
+	// Otherwise go through each priority's avail, highest first, and grab the
+	// next events from it after our pointer for that priority. Gotta clean
+	// avail first though. If we get any events, set our pointer and return
+	selectAvail := func(prio int) []core.QueryAction {
+		ewAvail, keyPtr := ewAvails[prio], &keyPtrs[prio]
+
+		var qq []core.QueryAction
+		qq = append(qq, ewAvail.removeExpired(now)...)
+		qq = append(qq,
+			core.QueryAction{
+				SingleGet: keyPtr,
+			},
+			ewAvail.afterInput(scan),
+		)
+		qq = append(qq, filter(keyPtr, ewAvail)...)
+		qq = append(qq, rateLimit()...)
+		qq = append(qq, maybeDone(keyPtr, ewAvail)...)
+
+		// The priority has had no activity, simply get the first events in its
+		// avail. Only applies if our pointer is actually empty. If it's not and
+		// we're here it means that the priority has simply been fully processed
+		// thusfar, and the empty input is passed through
+		first := ewAvail.after(0, scan)
+		first.QueryConditional = core.QueryConditional{IfEmpty: keyPtr}
+		qq = append(qq, first)
+		qq = append(qq, filter(keyPtr, ewAvail)...)
+		qq = append(qq, rateLimit()...)
+		qq = append(qq, maybeDone(keyPtr, ewAvail)...)
+		return qq
+	}
+	for prio := MaxPriority; prio >= 0; prio-- {
+		qq = append(qq, selectAvail(prio)...)
+	}
+
+	// If we're still here the consumer group has retrieved everything which is
+	// available, so the next events from the fair backlog, if there are any,
+	// are made available and we try again. When peeking the events are only
+	// looked at, and the oldest of them would be the first retrieved.
+	if peek {
+		for i, ewFair := range ewFairs {
+			sel := ewFair.after(0, 1)
+			sel.Union = i > 0
+			qq = append(qq, sel)
+		}
+		qq = append(qq, maybeDone(nil, exWrap{})...)
+	} else {
+		qq = append(qq, promoteFair(ewFairs, ewAvails[0], count, now)...)
+		qq = append(qq, selectAvail(0)...)
+	}
+
+	qa := core.QueryActions{
+		KeyBase:      ewAvails[0].base,
+		QueryActions: qq,
+		Now:          now,
+	}
+
+	var res core.QueryRes
+	for {
+		if res, err = p.c.Query(ctx, qa); err != nil {
+			return nil, err
+		}
+
+		// If a Filter moved any pointers past events which didn't match then
+		// there may be matching events after them, so the Query is done again.
+		// Events moved to redo also appear in Counts, but doing it again is
+		// harmless then.
+		var moved bool
+		for _, n := range res.Counts {
+			moved = moved || n > 0
+		}
+		if cf == nil || peek || len(res.IDs) > 0 || !moved {
+			break
+		} else if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	// The events were all delivered by this query, so they share its token
+	var token string
+	if !peek && !c.AckDeadline.IsZero() {
+		token = now.String()
+		p.inFlight.add(c.Queue, c.ConsumerGroup, res.IDs, c.AckDeadline, token)
+	}
+
+	ee, err := p.getEvents(ctx, res.IDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// The last Counts are the attempts for each returned ID, in the same
+	// order. Any before them are from moving missed events to redo.
+	attempts := res.Counts[len(res.Counts)-len(res.IDs):]
+	for i := range ee {
+		ee[i].Attempts = attempts[i]
+		ee[i].DeliveryToken = token
+		if ee[i].Attempts > 1 {
+			p.log(ctx, slog.LevelDebug, "event redelivered",
+				"queue", c.Queue, "consumer_group", c.ConsumerGroup,
+				"id", ee[i].ID.String(), "attempts", ee[i].Attempts)
+		}
+	}
+	return ee, nil
+}
+
+// QPeekCommand describes the parameters which can be passed into the QPeek
+// command
+type QPeekCommand struct {
+	Queue         string // Required
+	ConsumerGroup string // Required
+}
+
+// QPeek returns the event which would be returned by a QGet on the given queue
+// for the given consumer group, without actually retrieving it. The event is
+// not marked as in progress, and the consumer group's position in the queue is
+// not changed.
+//
+// An empty event is returned if there are no available events for the queue.
+func (p *Peel) QPeek(ctx context.Context, c QPeekCommand) (e core.Event, err error) {
+	if t, err := p.migratedTo(ctx, c.Queue); err != nil {
+		return core.Event{}, err
+	} else if t != nil {
+		return t.QPeek(ctx, c)
+	}
+	ctx, end := p.start(ctx, "QPeek", c.Queue, c.ConsumerGroup)
+	defer end(&err, func() int { return countEvent(e) })
+	shards, err := p.queueShards(ctx, c.Queue)
+	if err != nil {
+		return core.Event{}, err
+	}
+	ee, err := p.qgetShards(ctx, QGetCommand{
+		Queue:         c.Queue,
+		ConsumerGroup: c.ConsumerGroup,
+	}, shards, 1, true)
+	if err != nil || len(ee) == 0 {
+		return core.Event{}, err
+	}
+	return ee[0], nil
+}
+
+// ErrDeliveryTokenRequired is returned by QAck, QAckMulti, QExtend and QNack
+// when RequireDeliveryTokens is set (see Opts) and they aren't given a
+// DeliveryToken
+var ErrDeliveryTokenRequired = errors.New("delivery token required")
+
+// ErrInvalidDeliveryToken is returned by QAck, QAckMulti, QExtend and QNack
+// when they're given a DeliveryToken which wasn't returned by QGet
+var ErrInvalidDeliveryToken = errors.New("invalid delivery token")
+
+// QAckCommand describes the parameters which can be passed into the QAck
+// command
+type QAckCommand struct {
+	Queue         string  // Required
+	ConsumerGroup string  // Required
+	EventID       core.ID // Required
+
+	// Optional. If set, and the event is successfully acknowledged, this is
+	// stored so it can be retrieved using QResult
+	Result string
+
+	// Optional. How long the Result is kept for. Defaults to however long the
+	// event has until it expires.
+	ResultTTL time.Duration
+
+	// Optional, unless RequireDeliveryTokens is set (see Opts). The
+	// DeliveryToken of the event, as returned by QGet. If given the event is
+	// only acknowledged if it hasn't been delivered again since that QGet.
+	DeliveryToken string
+}
+
+// QAck acknowledges that an event has been successfully processed and should
+// not be re-processed. Only applicable for Events which were gotten through a
+// QGet with an AckDeadline. Returns true if the Event was successfully
+// acknowledged. false will be returned if the deadline was missed, and
+// therefore some other consumer may re-process the Event later, or if the
+// DeliveryToken is stale.
+func (p *Peel) QAck(ctx context.Context, c QAckCommand) (ok bool, err error) {
+	if t, err := p.migratedTo(ctx, c.Queue); err != nil {
+		return false, err
+	} else if t != nil {
+		return t.QAck(ctx, c)
+	}
+	ctx, end := p.start(ctx, "QAck", c.Queue, c.ConsumerGroup)
+	defer end(&err, func() int { return countBool(ok) })
+	ok, err = p.eachEventShard(ctx, c.Queue, c.DeliveryToken, func(queue, token string) (bool, error) {
+		acked, err := p.qackMulti(ctx, QAckMultiCommand{
+			Queue:          queue,
+			ConsumerGroup:  c.ConsumerGroup,
+			EventIDs:       []core.ID{c.EventID},
+			DeliveryTokens: deliveryTokens(token),
+		})
+		if err != nil {
+			return false, err
+		}
+		return acked[0], nil
+	})
+	if err != nil || !ok || c.Result == "" {
+		return ok, err
+	}
+
+	// The Result is kept in the queue it was given, even if that's sharded, so
+	// that QResult can find it
+
+	keyResult, err := queueResult(c.Queue, c.EventID)
+	if err != nil {
+		return false, err
+	}
+
+	ttl := c.ResultTTL
+	if ttl == 0 {
+		ttl = c.EventID.Expire.Time().Sub(p.now())
+	}
+	if err := p.c.SetString(ctx, keyResult, c.Result, ttl); err != nil {
+		return false, err
+	}
+	p.c.KeyNotify(ctx, keyResult)
+
+	return true, nil
+}
+
+// QResultCommand describes the parameters which can be passed into the QResult
+// command
+type QResultCommand struct {
+	Queue   string  // Required
+	EventID core.ID // Required
+
+	// Optional. If set and there's no Result for the event yet, QResult will
+	// wait up to this long for one to be set
+	Block time.Duration
+}
+
+// QResult returns the Result which the event was QAck'd with, and true. If the
+// event wasn't QAck'd with a Result, or the Result has passed its ResultTTL,
+// false is returned. If multiple consumer groups QAck the event with a Result
+// the latest one is returned.
+func (p *Peel) QResult(ctx context.Context, c QResultCommand) (_ string, _ bool, err error) {
+	if t, err := p.migratedTo(ctx, c.Queue); err != nil {
+		return "", false, err
+	} else if t != nil {
+		return t.QResult(ctx, c)
+	}
+	ctx, end := p.start(ctx, "QResult", c.Queue, "")
+	defer end(&err, nil)
+	keyResult, err := queueResult(c.Queue, c.EventID)
+	if err != nil {
+		return "", false, err
+	}
+
+	if c.Block <= 0 {
+		res, err := p.c.GetString(ctx, keyResult)
+		if err == core.ErrNotFound {
+			return "", false, nil
+		}
+		return res, err == nil, err
+	}
+
+	timeoutCh := time.After(c.Block)
+
+	for {
+		// The wait is started before checking, so a Result being set in
+		// between the two isn't missed
+		waitCtx, cancel := context.WithCancel(ctx)
+		pushCh := p.c.KeyWait(waitCtx, keyResult)
+
+		res, err := p.c.GetString(ctx, keyResult)
+		if err == nil {
+			cancel()
+			return res, true, nil
+		} else if err != core.ErrNotFound {
+			cancel()
+			return "", false, err
+		}
+
+		select {
+		case <-pushCh:
+		case <-timeoutCh:
+			cancel()
+			return "", false, nil
+		}
+
+		cancel()
+		if err := ctx.Err(); err != nil {
+			return "", false, err
+		}
+	}
+}
+
+// QAckMultiCommand describes the parameters which can be passed into the
+// QAckMulti command
+type QAckMultiCommand struct {
+	Queue         string    // Required
+	ConsumerGroup string    // Required
+	EventIDs      []core.ID // Required
+
+	// Optional, unless RequireDeliveryTokens is set (see Opts). If given there
+	// must be one for each of the EventIDs, in the same order, see
+	// QAckCommand's DeliveryToken.
+	DeliveryTokens []string
+}
+
+// QAckMulti is like QAck, but acknowledges multiple events at once in a single
+// atomic operation. The returned slice will have a boolean for each of the
+// given EventIDs, in the same order, indicating whether or not that Event was
+// successfully acknowledged.
+func (p *Peel) QAckMulti(ctx context.Context, c QAckMultiCommand) (acked []bool, err error) {
+	if t, err := p.migratedTo(ctx, c.Queue); err != nil {
+		return nil, err
+	} else if t != nil {
+		return t.QAckMulti(ctx, c)
+	}
+	ctx, end := p.start(ctx, "QAckMulti", c.Queue, c.ConsumerGroup)
+	defer end(&err, func() int { return len(acked) })
+	return p.qackMultiShards(ctx, c)
+}
+
+func (p *Peel) qackMulti(ctx context.Context, c QAckMultiCommand) ([]bool, error) {
+	acked := make([]bool, len(c.EventIDs))
+	if len(c.EventIDs) == 0 {
+		return acked, nil
+	}
+
+	now := core.NewTS(p.now())
+
+	ewInProg, err := queueInProgress(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	ewAttempts, err := queueAttempts(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	ewDeliveries, err := queueDeliveries(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	keyClaims, err := queueClaims(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	keyErrors, err := queueErrors(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	selectEvents, err := p.selectInProg(ewInProg, ewDeliveries, c.EventIDs, c.DeliveryTokens, now)
+	if err != nil {
+		return nil, err
+	}
+
+	qc, err := p.cachedConfig(ctx, c.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	var ewGroupInProgs []exWrap
+	if qc.Grouped {
+		if _, ewGroupInProgs, err = queueGroupCGroupKeys(c.Queue, c.ConsumerGroup); err != nil {
+			return nil, err
+		}
+		ewGroupInProgs = ewGroupInProgs[:qc.groupBuckets()]
+	}
+
+	traceAcked, err := traceActions(qc, c.Queue, c.ConsumerGroup, TraceAcked, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var qq []core.QueryAction
+	qq = append(qq, ewInProg.removeExpired(now)...)
+	qq = append(qq, core.QueryAction{HashDel: &keyClaims})
+	qq = append(qq, selectEvents...)
+	qq = append(qq, ewInProg.removeFromInput())
+	qq = append(qq, core.QueryAction{HashDel: &keyClaims})
+	qq = append(qq, ewAttempts.removeFromInput())
+	qq = append(qq, core.QueryAction{HashDel: &keyErrors})
+	qq = append(qq, ewDeliveries.removeFromInput())
+	qq = append(qq, traceAcked...)
+
+	// The events might have been holding up their group set, see queueGroups
+	for _, ew := range ewGroupInProgs {
+		qq = append(qq, core.QueryAction{QueryCount: &core.QueryCount{Key: ew.byArb}})
+	}
+
+	qa := core.QueryActions{
+		KeyBase:      ewInProg.base,
+		QueryActions: qq,
+		Now:          now,
+	}
+
+	res, err := p.c.Query(ctx, qa)
+	if err != nil {
+		return nil, err
+	}
+	p.inFlight.remove(c.Queue, c.ConsumerGroup, c.EventIDs...)
+
+	var grouped bool
+	for _, n := range res.Counts {
+		grouped = grouped || n > 0
+	}
+
+	// Consumers blocking on a StrictFIFO queue, or on a group set, may have
+	// been waiting for the events to be done with
+	if (qc.StrictFIFO || grouped) && len(res.IDs) > 0 {
+		ewAvail, err := queueAvailable(c.Queue)
+		if err != nil {
+			return nil, err
+		}
+		p.c.KeyNotify(ctx, ewAvail.byArb)
+	}
+
+	ackedm := map[core.ID]bool{}
+	for _, id := range res.IDs {
+		ackedm[id] = true
+	}
+	for i, id := range c.EventIDs {
+		acked[i] = ackedm[id]
+	}
+	return acked, nil
+}
+
+// returns the single-element slice of tokens for a command which acts on one
+// event, or nil if the command wasn't given a token
+func deliveryTokens(token string) []string {
+	if token == "" {
+		return nil
+	}
+	return []string{token}
+}
+
+// returns actions which will output whichever of the given IDs are in inProg
+// and haven't missed their deadline. If tokens are given, one per ID, only the
+// IDs whose latest delivery had the corresponding token are output, so that a
+// consumer which missed its deadline can't act on the event once it's been
+// delivered to someone else.
+func (p *Peel) selectInProg(ewInProg, ewDeliveries exWrap, ii []core.ID, tokens []string, now core.TS) ([]core.QueryAction, error) {
+	if len(tokens) == 0 {
+		if p.o.RequireDeliveryTokens {
+			return nil, ErrDeliveryTokenRequired
+		}
+		return ewInProg.selectIDs(ii, now), nil
+	} else if len(tokens) != len(ii) {
+		return nil, errors.New("must be given one delivery token per event")
+	}
+
+	tt := make([]core.TS, len(tokens))
+	for i, token := range tokens {
+		t, err := strconv.ParseUint(token, 10, 64)
+		if err != nil || t == 0 {
+			return nil, ErrInvalidDeliveryToken
+		}
+		tt[i] = core.TS(t)
+	}
+
+	aa := ewDeliveries.selectIDsEqual(ii, tt)
+	aa = append(aa, ewInProg.filterByScore(now, 0))
+	return aa, nil
+}
+
+// QExtendCommand describes the parameters which can be passed into the QExtend
+// command
+type QExtendCommand struct {
+	Queue         string    // Required
+	ConsumerGroup string    // Required
+	EventID       core.ID   // Required
+	AckDeadline   time.Time // Required
+
+	// Optional, see QAckCommand's DeliveryToken
+	DeliveryToken string
+}
+
+// QExtend changes the deadline by which an event, which was retrieved through a
+// QGet with an AckDeadline, must be QAck'd. This can be used by consumers
+// working on long-running jobs to let the rest of the consumer group know the
+// event is still being worked on. Returns true if the deadline was
+// successfully changed. false will be returned if the original deadline was
+// already missed, the event was already ack'd, or the DeliveryToken is stale.
+func (p *Peel) QExtend(ctx context.Context, c QExtendCommand) (_ bool, err error) {
+	if t, err := p.migratedTo(ctx, c.Queue); err != nil {
+		return false, err
+	} else if t != nil {
+		return t.QExtend(ctx, c)
+	}
+	ctx, end := p.start(ctx, "QExtend", c.Queue, c.ConsumerGroup)
+	defer end(&err, nil)
+	return p.eachEventShard(ctx, c.Queue, c.DeliveryToken, func(queue, token string) (bool, error) {
+		c.Queue, c.DeliveryToken = queue, token
+		return p.qextend(ctx, c)
+	})
+}
+
+func (p *Peel) qextend(ctx context.Context, c QExtendCommand) (bool, error) {
+	now := core.NewTS(p.now())
+
+	ewInProg, err := queueInProgress(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return false, err
+	}
+
+	ewDeliveries, err := queueDeliveries(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return false, err
+	}
+
+	keyClaims, err := queueClaims(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return false, err
+	}
+
+	selectEvent, err := p.selectInProg(ewInProg, ewDeliveries, []core.ID{c.EventID}, deliveryTokens(c.DeliveryToken), now)
+	if err != nil {
+		return false, err
+	}
+
+	var qq []core.QueryAction
+	qq = append(qq, ewInProg.removeExpired(now)...)
+	qq = append(qq, core.QueryAction{HashDel: &keyClaims})
+	qq = append(qq, selectEvent...)
+	qq = append(qq, ewInProg.addFromInput(core.NewTS(c.AckDeadline))...)
+
+	qa := core.QueryActions{
+		KeyBase:      ewInProg.base,
+		QueryActions: qq,
+		Now:          now,
+	}
+
+	res, err := p.c.Query(ctx, qa)
+	if err != nil {
+		return false, err
+	} else if len(res.IDs) == 0 {
+		return false, nil
+	}
+	p.inFlight.extend(c.Queue, c.ConsumerGroup, c.EventID, c.AckDeadline)
+	return true, nil
+}
+
+// QNackCommand describes the parameters which can be passed into the QNack
+// command
+type QNackCommand struct {
+	Queue         string  // Required
+	ConsumerGroup string  // Required
+	EventID       core.ID // Required
+
+	// Optional, see QAckCommand's DeliveryToken
+	DeliveryToken string
+
+	// Optional. Why the event couldn't be processed. It's kept until the event
+	// is ack'd, redriven or expires, and is returned as the LastError of the
+	// event by QPendingList and QDeadList.
+	Error string
+
+	// Optional. If true the event is moved to the consumer group's dead set
+	// straight away, regardless of MaxDeliveries, e.g. because it can never be
+	// processed.
+	Dead bool
+}
+
+// QNack indicates that an event which was retrieved through a QGet with an
+// AckDeadline could not be processed, and should be made available to the
+// consumer group again immediately instead of waiting for the deadline to pass.
+// Returns true if the Event was successfully moved back. false will be returned
+// if the deadline was already missed, the event was already ack'd, or the
+// DeliveryToken is stale.
+//
+// If MaxDeliveries is set and the event has already been retrieved that many
+// times, or if Dead is set, it is moved to the consumer group's dead set
+// instead, and true is still returned.
+func (p *Peel) QNack(ctx context.Context, c QNackCommand) (ok bool, err error) {
+	if t, err := p.migratedTo(ctx, c.Queue); err != nil {
+		return false, err
+	} else if t != nil {
+		return t.QNack(ctx, c)
+	}
+	ctx, end := p.start(ctx, "QNack", c.Queue, c.ConsumerGroup)
+	defer end(&err, func() int { return countBool(ok) })
+	return p.eachEventShard(ctx, c.Queue, c.DeliveryToken, func(queue, token string) (bool, error) {
+		c.Queue, c.DeliveryToken = queue, token
+		return p.qnack(ctx, c)
+	})
+}
+
+func (p *Peel) qnack(ctx context.Context, c QNackCommand) (bool, error) {
+	now := core.NewTS(p.now())
+
+	ewInProg, ewRedo, _, err := queueCGroupKeys(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return false, err
+	}
+
+	ewAttempts, ewDead, err := queueDeadLetterKeys(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return false, err
+	}
+
+	keyErrors, err := queueErrors(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return false, err
+	}
+
+	ewDeliveries, err := queueDeliveries(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return false, err
+	}
+
+	keyClaims, err := queueClaims(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return false, err
+	}
+
+	selectEvent, err := p.selectInProg(ewInProg, ewDeliveries, []core.ID{c.EventID}, deliveryTokens(c.DeliveryToken), now)
+	if err != nil {
+		return false, err
+	}
+
+	qc, err := p.cachedConfig(ctx, c.Queue)
+	if err != nil {
+		return false, err
+	}
+
+	traceNacked, err := traceActions(qc, c.Queue, c.ConsumerGroup, TraceNacked, now)
+	if err != nil {
+		return false, err
+	}
+
+	traceDead, err := traceActions(qc, c.Queue, c.ConsumerGroup, TraceDeadLettered, now)
+	if err != nil {
+		return false, err
+	}
+
+	// Every event which has been retrieved has been attempted at least once
+	maxDeliveries := p.maxDeliveries(qc)
+	if c.Dead {
+		maxDeliveries = 1
+	}
+
+	var qq []core.QueryAction
+	qq = append(qq, ewInProg.removeExpired(now)...)
+	qq = append(qq, core.QueryAction{HashDel: &keyClaims})
+
+	// The event is recorded as nacked even if it's then moved to dead
+	if c.Error != "" || len(traceNacked) > 0 {
+		qq = append(qq, selectEvent...)
+		if c.Error != "" {
+			qq = append(qq, core.QueryAction{
+				QueryHashSet: &core.QueryHashSet{Key: keyErrors, Value: c.Error},
+			})
+		}
+		qq = append(qq, traceNacked...)
+	}
+	deadLetter := p.deadLetter(selectEvent, maxDeliveries, ewInProg, ewAttempts, ewDead, keyClaims, traceDead)
+	qq = append(qq, deadLetter...)
+	qq = append(qq, selectEvent...)
+	qq = append(qq, ewInProg.removeFromInput())
+	qq = append(qq, core.QueryAction{HashDel: &keyClaims})
+	qq = append(qq, ewRedo.addFromInput(0)...)
+
+	qa := core.QueryActions{
+		KeyBase:      ewInProg.base,
+		QueryActions: qq,
+		Now:          now,
+	}
+
+	res, err := p.c.Query(ctx, qa)
+	if err != nil {
+		return false, err
+	}
+	p.inFlight.remove(c.Queue, c.ConsumerGroup, c.EventID)
+
+	if len(deadLetter) > 0 && res.Counts[0] > 0 {
+		// The event was dead-lettered, so there's no need to wake anyone up
+		p.logDeadLettered(ctx, c.Queue, c.ConsumerGroup, p.maxDeliveries(qc), res.Counts[0])
+		return true, nil
+	} else if len(res.IDs) == 0 {
+		return false, nil
+	}
+
+	// Wake up any consumers which are blocking on the queue, so they can pick
+	// up the event from redo
+	ewAvail, err := queueAvailable(c.Queue)
+	if err != nil {
+		return false, err
+	}
+	p.c.KeyNotify(ctx, ewAvail.byArb)
+
+	return true, nil
+}
+
+// QPendingListCommand describes the parameters which can be passed into the
+// QPendingList command
+type QPendingListCommand struct {
+	Queue         string // Required
+	ConsumerGroup string // Required
+}
+
+// PendingEvent describes an event which is currently in progress for a
+// consumer group, as returned by QPendingList
+type PendingEvent struct {
+	core.Event
+	AckDeadline time.Time
+
+	// The ConsumerID the event was retrieved with, if any
+	ConsumerID string
+
+	// The Error the event was last QNack'd with by the consumer group, if any
+	LastError string
+}
+
+// QPendingList returns all events which have been retrieved by the consumer
+// group with an AckDeadline which hasn't yet been reached, and which haven't
+// been QAck'd. The events are returned oldest first.
+func (p *Peel) QPendingList(ctx context.Context, c QPendingListCommand) (pp []PendingEvent, err error) {
+	ctx, end := p.start(ctx, "QPendingList", c.Queue, c.ConsumerGroup)
+	defer end(&err, func() int { return len(pp) })
+	now := core.NewTS(p.now())
+
+	ewInProg, err := queueInProgress(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	keyClaims, err := queueClaims(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	keyErrors, err := queueErrors(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	var qq []core.QueryAction
+	qq = append(qq, ewInProg.removeExpired(now)...)
+	qq = append(qq, core.QueryAction{HashDel: &keyClaims})
+	qq = append(qq, ewInProg.after(now, 0))
+	qq = append(qq, ewInProg.scoresFromInput())
+
+	qa := core.QueryActions{
+		KeyBase:      ewInProg.base,
+		QueryActions: qq,
+		Now:          now,
+	}
+
+	res, err := p.c.Query(ctx, qa)
+	if err != nil {
+		return nil, err
+	}
+
+	ee, err := p.getEvents(ctx, res.IDs)
+	if err != nil {
+		return nil, err
+	}
+
+	consumerIDs, err := p.c.HashGetIDs(ctx, keyClaims, res.IDs)
+	if err != nil {
+		return nil, err
+	}
+
+	lastErrors, err := p.c.HashGetIDs(ctx, keyErrors, res.IDs)
+	if err != nil {
+		return nil, err
+	}
+
+	pp = make([]PendingEvent, len(ee))
+	for i := range ee {
+		pp[i] = PendingEvent{
+			Event:       ee[i],
+			AckDeadline: core.TS(res.Counts[i]).Time(),
+			ConsumerID:  consumerIDs[i],
+			LastError:   lastErrors[i],
+		}
+	}
+	return pp, nil
+}
+
+// QConsumersCommand describes the parameters which can be passed into the
+// QConsumers command
+type QConsumersCommand struct {
+	Queue string // Required
+
+	// Optional. If not given the consumers of every consumer group are
+	// returned.
+	ConsumerGroup string
+}
+
+// ConsumerInfo describes a consumer which has recently retrieved events, as
+// returned by QConsumers
+type ConsumerInfo struct {
+	ConsumerGroup string
+	ConsumerID    string
+
+	// The last time the consumer called QGet or QGetMulti
+	LastSeen time.Time
+
+	// The number of events the consumer has retrieved with an AckDeadline
+	// which haven't been QAck'd and whose deadline hasn't passed yet
+	InFlight int
+}
+
+// QConsumers returns the consumers which have retrieved events from the queue
+// with a ConsumerID within the last ConsumerTTL (see Opts), sorted by consumer
+// group and then ConsumerID.
+func (p *Peel) QConsumers(ctx context.Context, c QConsumersCommand) (cc []ConsumerInfo, err error) {
+	ctx, end := p.start(ctx, "QConsumers", c.Queue, c.ConsumerGroup)
+	defer end(&err, func() int { return len(cc) })
+	now := core.NewTS(p.now())
+
+	cgroupPattern := c.ConsumerGroup
+	if cgroupPattern == "" {
+		cgroupPattern = "*"
+	}
+	scanK, err := queueConsumer(c.Queue, cgroupPattern, "*")
+	if err != nil {
+		return nil, err
+	}
+
+	kk, err := p.c.KeyScan(ctx, scanK)
+	if err != nil {
+		return nil, err
+	}
+
+	shards, err := p.queueShards(ctx, c.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	inFlight := map[string]map[string]int{}
+	for _, k := range kk {
+		if k, err = queueKeyUnmarshal(k); err != nil {
+			return nil, err
+		}
+		cgroup, consumerID := k.Subs[0], k.Subs[2]
+
+		lastSeenStr, err := p.c.GetString(ctx, k)
+		if err == core.ErrNotFound {
+			// Expired since the scan
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		lastSeen, err := strconv.ParseUint(lastSeenStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		if inFlight[cgroup] == nil {
+			if inFlight[cgroup], err = p.consumersInFlight(ctx, shards, cgroup, now); err != nil {
+				return nil, err
+			}
+		}
+
+		cc = append(cc, ConsumerInfo{
+			ConsumerGroup: cgroup,
+			ConsumerID:    consumerID,
+			LastSeen:      core.TS(lastSeen).Time(),
+			InFlight:      inFlight[cgroup][consumerID],
+		})
+	}
+
+	sort.Slice(cc, func(i, j int) bool {
+		if cc[i].ConsumerGroup != cc[j].ConsumerGroup {
+			return cc[i].ConsumerGroup < cc[j].ConsumerGroup
+		}
+		return cc[i].ConsumerID < cc[j].ConsumerID
+	})
+	return cc, nil
+}
+
+// marks the consumer as having been seen just now, see QConsumers
+func (p *Peel) registerConsumer(ctx context.Context, queue, cgroup, consumerID string) error {
+	keyConsumer, err := queueConsumer(queue, cgroup, consumerID)
+	if err != nil {
+		return err
+	}
+	lastSeen := core.NewTS(p.now()).String()
+	return p.c.SetString(ctx, keyConsumer, lastSeen, p.o.ConsumerTTL)
+}
+
+// returns whether the consumer has been seen within the last ConsumerTTL, see
+// QConsumers
+func (p *Peel) consumerActive(ctx context.Context, queue, cgroup, consumerID string) (bool, error) {
+	keyConsumer, err := queueConsumer(queue, cgroup, consumerID)
+	if err != nil {
+		return false, err
+	}
+	if _, err := p.c.GetString(ctx, keyConsumer); err == core.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// QStealCommand describes the parameters which can be passed into the QSteal
+// command
+type QStealCommand struct {
+	Queue         string    // Required
+	ConsumerGroup string    // Required
+	ConsumerID    string    // Required, the consumer taking over the events
+	AckDeadline   time.Time // Required
+
+	// Optional. If given only these events may be stolen, otherwise any of the
+	// consumer group's events in progress may be.
+	EventIDs []core.ID
+
+	// Optional. The maximum number of events to steal. If not given there's no
+	// limit.
+	Count int
+}
+
+// QSteal takes over events which are in progress for the consumer group but
+// were claimed by a consumer which is no longer active, i.e. one which hasn't
+// called QGet or QGetMulti within the last ConsumerTTL (see Opts). This lets
+// their events be retried straight away, rather than once their AckDeadlines
+// have passed. Events retrieved without a ConsumerID are never stolen.
+//
+// The stolen events are returned as if they'd been retrieved by ConsumerID
+// using QGet with the given AckDeadline: they're claimed by it, their Attempts
+// are incremented, and they're given new DeliveryTokens, so the consumer they
+// were stolen from can no longer QAck them if it was given a DeliveryToken.
+// ConsumerID is also marked as active, as with QGet.
+func (p *Peel) QSteal(ctx context.Context, c QStealCommand) (ee []core.Event, err error) {
+	ctx, end := p.start(ctx, "QSteal", c.Queue, c.ConsumerGroup)
+	defer end(&err, func() int { return len(ee) })
+	if c.ConsumerID == "" {
+		return nil, errors.New("ConsumerID is required")
+	} else if c.AckDeadline.IsZero() {
+		return nil, errors.New("AckDeadline is required")
+	}
+
+	if err := p.registerConsumer(ctx, c.Queue, c.ConsumerGroup, c.ConsumerID); err != nil {
+		return nil, err
+	}
+
+	shards, err := p.queueShards(ctx, c.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	ee = []core.Event{}
+	for i, shard := range shards {
+		count := c.Count
+		if count > 0 {
+			if count -= len(ee); count <= 0 {
+				break
+			}
+		}
+
+		shardEE, err := p.qsteal(ctx, c, shard, count)
+		if err != nil {
+			return ee, err
+		}
+		if len(shards) > 1 {
+			for j := range shardEE {
+				shardEE[j].DeliveryToken = shardToken(i, shardEE[j].DeliveryToken)
+			}
+		}
+		ee = append(ee, shardEE...)
+	}
+	return ee, nil
+}
+
+// qsteal implements QSteal for a single shard of the queue, stealing no more
+// than count events if count is greater than zero
+func (p *Peel) qsteal(ctx context.Context, c QStealCommand, shard string, count int) ([]core.Event, error) {
+	now := core.NewTS(p.now())
+
+	ewInProg, err := queueInProgress(shard, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	ewAttempts, err := queueAttempts(shard, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	ewDeliveries, err := queueDeliveries(shard, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	keyClaims, err := queueClaims(shard, c.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	// First find the events in progress along with their latest delivery, so
+	// they're only stolen below if they haven't been delivered again since
+	var qq []core.QueryAction
+	if len(c.EventIDs) > 0 {
+		qq = append(qq, ewInProg.selectIDs(c.EventIDs, now)...)
+	} else {
+		qq = append(qq, ewInProg.after(now, 0))
+	}
+	qq = append(qq, ewDeliveries.scoresFromInput())
+
+	res, err := p.c.Query(ctx, core.QueryActions{
+		KeyBase:      ewInProg.base,
+		QueryActions: qq,
+		Now:          now,
+	})
+	if err != nil {
+		return nil, err
+	} else if len(res.IDs) == 0 {
+		return nil, nil
+	}
+
+	consumerIDs, err := p.c.HashGetIDs(ctx, keyClaims, res.IDs)
+	if err != nil {
+		return nil, err
+	}
+
+	active := map[string]bool{c.ConsumerID: true}
+	var ii []core.ID
+	var tokens []string
+	for i, consumerID := range consumerIDs {
+		if consumerID == "" {
+			continue
+		} else if count > 0 && len(ii) >= count {
+			break
+		}
+
+		isActive, ok := active[consumerID]
+		if !ok {
+			if isActive, err = p.consumerActive(ctx, c.Queue, c.ConsumerGroup, consumerID); err != nil {
+				return nil, err
+			}
+			active[consumerID] = isActive
+		}
+		if isActive || res.Counts[i] == 0 {
+			continue
+		}
+		ii = append(ii, res.IDs[i])
+		tokens = append(tokens, core.TS(res.Counts[i]).String())
+	}
+	if len(ii) == 0 {
+		return nil, nil
+	}
+
+	selectEvents, err := p.selectInProg(ewInProg, ewDeliveries, ii, tokens, now)
+	if err != nil {
+		return nil, err
+	}
+
+	qq = append([]core.QueryAction{}, selectEvents...)
+	qq = append(qq, ewInProg.addFromInput(core.NewTS(c.AckDeadline))...)
+	qq = append(qq, core.QueryAction{
+		QueryHashSet: &core.QueryHashSet{Key: keyClaims, Value: c.ConsumerID},
+	})
+	qq = append(qq, ewAttempts.incrFromInput(1)...)
+	qq = append(qq, ewDeliveries.addFromInput(now)...)
+	qq = append(qq, ewAttempts.scoresFromInput())
+
+	res, err = p.c.Query(ctx, core.QueryActions{
+		KeyBase:      ewInProg.base,
+		QueryActions: qq,
+		Now:          now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// As with qgetDirect, the events were all delivered by this query, so they
+	// share its token
+	token := now.String()
+	p.inFlight.add(shard, c.ConsumerGroup, res.IDs, c.AckDeadline, token)
+
+	ee, err := p.getEvents(ctx, res.IDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ee {
+		ee[i].Attempts = res.Counts[i]
+		ee[i].DeliveryToken = token
+	}
+	return ee, nil
+}
+
+// returns the number of events each consumer of the cgroup has in progress,
+// across all of the given shards of a queue, keyed by ConsumerID
+func (p *Peel) consumersInFlight(ctx context.Context, shards []string, cgroup string, now core.TS) (map[string]int, error) {
+	m := map[string]int{}
+	for _, shard := range shards {
+		ewInProg, err := queueInProgress(shard, cgroup)
+		if err != nil {
+			return nil, err
+		}
+
+		keyClaims, err := queueClaims(shard, cgroup)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := p.c.Query(ctx, core.QueryActions{
+			KeyBase:      ewInProg.base,
+			QueryActions: []core.QueryAction{ewInProg.after(now, 0)},
+			Now:          now,
+		})
+		if err != nil {
+			return nil, err
+		} else if len(res.IDs) == 0 {
+			continue
+		}
+
+		consumerIDs, err := p.c.HashGetIDs(ctx, keyClaims, res.IDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, consumerID := range consumerIDs {
+			if consumerID != "" {
+				m[consumerID]++
+			}
+		}
+	}
+	return m, nil
+}
+
+// QDoneListCommand describes the parameters which can be passed into the
+// QDoneList command
+type QDoneListCommand struct {
+	Queue         string // Required
+	ConsumerGroup string // Required
+
+	// Optional. Only events which became available at or after From, and
+	// before To, will be returned. If not given the range is unbounded on that
+	// side.
+	From, To time.Time
+
+	// Optional. The maximum number of events to return. If not given all
+	// events in the range are returned.
+	Limit int
+
+	// Optional. The cursor returned from a previous call to QDoneList with the
+	// same parameters, used to retrieve the next page of events.
+	Cursor core.TS
+}
+
+// QDoneList returns the events which the consumer group has finished
+// processing, i.e. those which it has retrieved and which aren't in progress,
+// waiting to be redone, or dead. Events are returned in the order they became
+// available to the consumer group, and expired events are not returned.
+//
+// If there are more events in the range than Limit then a non-zero cursor is
+// also returned, which can be passed back in to get the next page of events.
+func (p *Peel) QDoneList(ctx context.Context, c QDoneListCommand) (ee []core.Event, _ core.TS, err error) {
+	ctx, end := p.start(ctx, "QDoneList", c.Queue, c.ConsumerGroup)
+	defer end(&err, func() int { return len(ee) })
+
+	dd, err := p.doneIDs(ctx, c.Queue, c.ConsumerGroup, c.From, c.To, c.Cursor)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var cursor core.TS
+	if c.Limit > 0 && len(dd) > c.Limit {
+		dd = dd[:c.Limit]
+		cursor = dd[len(dd)-1].score
+	}
+
+	ii := make([]core.ID, len(dd))
+	for i := range dd {
+		ii[i] = dd[i].id
+	}
+	ee, err = p.getEvents(ctx, ii)
+	return ee, cursor, err
+}
+
+// an event's ID along with its score in the set it was found in
+type scoredID struct {
+	id    core.ID
+	score core.TS
+}
+
+// returns the IDs of the events which the consumer group is done with (see
+// QDoneList) that became available at or after from, before to, and after
+// cursor, sorted by their scores
+func (p *Peel) doneIDs(ctx context.Context, queue, cgroup string, from, to time.Time, cursor core.TS) ([]scoredID, error) {
+	now := core.NewTS(p.now())
+
+	ewAvails, err := queueAvailableBands(queue)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPtrs, err := queuePointerBands(queue, cgroup)
+	if err != nil {
+		return nil, err
+	}
+
+	ewInProg, ewRedo, _, err := queueCGroupKeys(queue, cgroup)
+	if err != nil {
+		return nil, err
+	}
+
+	ewDead, err := queueDead(queue, cgroup)
+	if err != nil {
+		return nil, err
+	}
+
+	// Everything up to and including the pointer has been retrieved
+	rng := core.QueryScoreRange{MaxFromInput: true}
+	if !from.IsZero() {
+		rng.Min = core.NewTS(from)
+	}
+	if cursor > rng.Min {
+		rng.Min, rng.MinExcl = cursor, true
+	}
+
+	// Each priority's pointer applies only to that priority's avail, and the
+	// output of a query only holds one set of IDs, so each priority needs its
+	// own query. The IDs will be sorted by score afterwards anyway, so the
+	// queries not being atomic together doesn't change much
+	var dd []scoredID
+	for prio := range ewAvails {
+		var qq []core.QueryAction
+		qq = append(qq, ewAvails[prio].removeExpired(now)...)
+		qq = append(qq,
+			core.QueryAction{
+				SingleGet: &keyPtrs[prio],
+			},
+			core.QueryAction{
+				QuerySelector: &core.QuerySelector{
+					Key: ewAvails[prio].byArb,
+					QueryRangeSelect: &core.QueryRangeSelect{
+						QueryScoreRange: rng,
+					},
+				},
+				QueryConditional: core.QueryConditional{IfInput: true},
+			},
+		)
+		if !to.IsZero() {
+			qq = append(qq, ewAvails[prio].filterByScore(0, core.NewTS(to)-1))
+		}
+		for _, ew := range []exWrap{ewInProg, ewRedo, ewDead} {
+			f := ew.filterByScore(0, 0)
+			f.QueryFilter.Invert = true
+			qq = append(qq, f)
+		}
+		qq = append(qq, ewAvails[prio].scoresFromInput())
+
+		res, err := p.c.Query(ctx, core.QueryActions{
+			KeyBase:      ewAvails[0].base,
+			QueryActions: qq,
+			Now:          now,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i := range res.IDs {
+			dd = append(dd, scoredID{res.IDs[i], core.TS(res.Counts[i])})
+		}
+	}
+
+	sort.Slice(dd, func(i, j int) bool { return dd[i].score < dd[j].score })
+	return dd, nil
+}
+
+// QBrowseCommand describes the parameters which can be passed into the QBrowse
+// command
+type QBrowseCommand struct {
+	Queue string // Required
+
+	// Optional. If given only the events the consumer group is done with are
+	// browsed, like with QDoneList. Otherwise every event in the queue is.
+	ConsumerGroup string
+
+	// Optional, see QDoneListCommand's fields of the same names. Cursor must
+	// have been returned from QBrowse though.
+	From, To time.Time
+	Limit    int
+	Cursor   core.TS
+
+	// Optional. If either is given only events whose Contents contain Contains
+	// and match Match are returned.
+	Contains string
+	Match    *regexp.Regexp
+}
+
+// QBrowse returns the events in the given queue which became available in a
+// range of time, a page at a time like QDoneList. Events are returned in the
+// order they became available, and expired events are not returned. Events
+// which have been added to a fair queue's backlog or a group set are included,
+// but delayed events aren't until they become available.
+//
+// Events not matching Contains or Match are skipped over, so a page may have
+// fewer than Limit events in it, but it only has none if there are no more
+// events to be found.
+func (p *Peel) QBrowse(ctx context.Context, c QBrowseCommand) (ee []core.Event, _ core.TS, err error) {
+	ctx, end := p.start(ctx, "QBrowse", c.Queue, c.ConsumerGroup)
+	defer end(&err, func() int { return len(ee) })
+
+	matches := func(e core.Event) bool {
+		return strings.Contains(e.Contents, c.Contains) &&
+			(c.Match == nil || c.Match.MatchString(e.Contents))
+	}
+
+	ee = []core.Event{}
+	cursor := c.Cursor
+	for {
+		var dd []scoredID
+		if c.ConsumerGroup != "" {
+			if dd, err = p.doneIDs(ctx, c.Queue, c.ConsumerGroup, c.From, c.To, cursor); err != nil {
+				return nil, 0, err
+			} else if c.Limit > 0 && len(dd) > c.Limit {
+				dd = dd[:c.Limit]
+			}
+		} else if dd, err = p.queueIDs(ctx, c.Queue, c.From, c.To, cursor, c.Limit); err != nil {
+			return nil, 0, err
+		}
+		if len(dd) == 0 {
+			return ee, 0, nil
+		}
+
+		ii := make([]core.ID, len(dd))
+		for i := range dd {
+			ii[i] = dd[i].id
+		}
+		pageEE, err := p.getEvents(ctx, ii)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// The events are looked at a page at a time until there's a full page
+		// which matches, or there are none left
+		for i, e := range pageEE {
+			if !matches(e) {
+				continue
+			}
+			ee = append(ee, e)
+			if c.Limit > 0 && len(ee) == c.Limit {
+				return ee, dd[i].score, nil
+			}
+		}
+		if c.Limit <= 0 || len(dd) < c.Limit {
+			return ee, 0, nil
+		}
+		cursor = dd[len(dd)-1].score
+	}
+}
+
+// returns the IDs of the events in the queue's avail, fair backlog and group
+// sets which became available at or after from, before to, and after cursor,
+// sorted by their scores. If limit is positive at most that many are returned.
+func (p *Peel) queueIDs(ctx context.Context, queue string, from, to time.Time, cursor core.TS, limit int) ([]scoredID, error) {
+	now := core.NewTS(p.now())
+
+	ewAvails, err := queueAvailableBands(queue)
+	if err != nil {
+		return nil, err
+	}
+
+	ewFairs, err := queueFairBacklogs(queue)
+	if err != nil {
+		return nil, err
+	}
+
+	ewGroups, err := p.usedQueueGroups(ctx, queue)
+	if err != nil {
+		return nil, err
+	}
+
+	var rng core.QueryScoreRange
+	if !from.IsZero() {
+		rng.Min = core.NewTS(from)
+	}
+	if cursor > rng.Min {
+		rng.Min, rng.MinExcl = cursor, true
+	}
+	if !to.IsZero() {
+		rng.Max, rng.MaxExcl = core.NewTS(to), true
+	}
+
+	// Each set's events are unioned together, which is enough to find the
+	// first limit of them all if each set contributes its own first limit.
+	// Each ID's score is then taken from whichever set it's in.
+	ews := append(append(append([]exWrap(nil), ewAvails...), ewFairs...), ewGroups...)
+	var qq []core.QueryAction
+	for _, ew := range ews {
+		qq = append(qq, ew.removeExpired(now)...)
+	}
+	for i, ew := range ews {
+		qq = append(qq, core.QueryAction{
+			QuerySelector: &core.QuerySelector{
+				Key: ew.byArb,
+				QueryRangeSelect: &core.QueryRangeSelect{
+					QueryScoreRange: rng,
+					Limit:           int64(limit),
+				},
+			},
+			Union: i > 0,
+		})
+	}
+	for _, ew := range ews {
+		qq = append(qq, ew.scoresFromInput())
+	}
+
+	res, err := p.c.Query(ctx, core.QueryActions{
+		KeyBase:      ewAvails[0].base,
+		QueryActions: qq,
+		Now:          now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dd := make([]scoredID, len(res.IDs))
+	for i := range res.IDs {
+		dd[i].id = res.IDs[i]
+		for j := range ews {
+			if score := core.TS(res.Counts[j*len(res.IDs)+i]); score > dd[i].score {
+				dd[i].score = score
+			}
+		}
+	}
+	sort.Slice(dd, func(i, j int) bool { return dd[i].score < dd[j].score })
+	if limit > 0 && len(dd) > limit {
+		dd = dd[:limit]
+	}
+	return dd, nil
+}
+
+// QDeadListCommand describes the parameters which can be passed into the
+// QDeadList command
+type QDeadListCommand struct {
+	Queue         string // Required
+	ConsumerGroup string // Required
+
+	// Optional. The maximum number of events to return. If not given all
+	// events in the dead set are returned.
+	Limit int
+
+	// Optional. The cursor returned from a previous call to QDeadList with the
+	// same parameters, used to retrieve the next page of events.
+	Cursor core.TS
+}
+
+// DeadEvent describes an event which is in a consumer group's dead set, as
+// returned by QDeadList. The Event's Attempts is the number of times it was
+// retrieved before being dead-lettered.
+type DeadEvent struct {
+	core.Event
+
+	// The Error the event was last QNack'd with, if any
+	LastError string
+}
+
+// QDeadList returns the events in the given consumer group's dead set, i.e.
+// those which have been retrieved MaxDeliveries times without being ack'd, or
+// which were QNack'd with Dead. The events are returned oldest first.
+//
+// If there are more events in the dead set than Limit then a non-zero cursor
+// is also returned, which can be passed back in to get the next page of
+// events.
+func (p *Peel) QDeadList(ctx context.Context, c QDeadListCommand) (dd []DeadEvent, _ core.TS, err error) {
+	ctx, end := p.start(ctx, "QDeadList", c.Queue, c.ConsumerGroup)
+	defer end(&err, func() int { return len(dd) })
+	now := core.NewTS(p.now())
+
+	ewAttempts, ewDead, err := queueDeadLetterKeys(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	keyErrors, err := queueErrors(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// One more than the limit is retrieved, to know if there's another page
+	var limit int64
+	if c.Limit > 0 {
+		limit = int64(c.Limit) + 1
+	}
+
+	var qq []core.QueryAction
+	qq = append(qq, ewDead.removeExpired(now)...)
+	qq = append(qq, ewDead.after(c.Cursor, limit))
+	qq = append(qq, ewAttempts.scoresFromInput())
+
+	qa := core.QueryActions{
+		KeyBase:      ewDead.base,
+		QueryActions: qq,
+		Now:          now,
+	}
+
+	res, err := p.c.Query(ctx, qa)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ii := res.IDs
+	var cursor core.TS
+	if c.Limit > 0 && len(ii) > c.Limit {
+		ii = ii[:c.Limit]
+		cursor = ii[len(ii)-1].T
+	}
+
+	ee, err := p.getEvents(ctx, ii)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	errs, err := p.c.HashGetIDs(ctx, keyErrors, ii)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dd = make([]DeadEvent, len(ee))
+	for i := range ee {
+		ee[i].Attempts = res.Counts[i]
+		dd[i] = DeadEvent{Event: ee[i], LastError: errs[i]}
+	}
+	return dd, cursor, nil
+}
+
+// QDeadRedriveCommand describes the parameters which can be passed into the
+// QDeadRedrive command
+type QDeadRedriveCommand struct {
+	Queue         string // Required
+	ConsumerGroup string // Required
+
+	// Optional. If not given all events in the dead set will be redriven
+	EventIDs []core.ID
+
+	// Optional. If given the events are made available in ToQueue instead of
+	// being retried by the consumer group, see QMove.
+	ToQueue string
+}
+
+// QDeadRedrive moves events out of the given consumer group's dead set and
+// makes them available to be retrieved by the consumer group again. Their
+// attempt counts and errors are reset. Returns the number of events which were
+// redriven.
+//
+// If ToQueue is given the events are made available to all of ToQueue's
+// consumer groups instead, after any events already available there. The two
+// queues can't be modified together atomically, so the events are added to
+// ToQueue before being removed from the dead set. If an error is returned some
+// events may be in both.
+func (p *Peel) QDeadRedrive(ctx context.Context, c QDeadRedriveCommand) (n uint64, err error) {
+	ctx, end := p.start(ctx, "QDeadRedrive", c.Queue, c.ConsumerGroup)
+	defer end(&err, func() int { return int(n) })
+	now := core.NewTS(p.now())
+	if c.ToQueue == c.Queue {
+		c.ToQueue = ""
+	}
+
+	_, ewRedo, _, err := queueCGroupKeys(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return 0, err
+	}
+
+	ewAttempts, ewDead, err := queueDeadLetterKeys(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return 0, err
+	}
+
+	keyErrors, err := queueErrors(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return 0, err
+	}
+
+	var qq []core.QueryAction
+	qq = append(qq, ewDead.removeExpired(now)...)
+	if len(c.EventIDs) == 0 {
+		qq = append(qq, ewDead.after(0, 0))
+	} else {
+		qq = append(qq, ewDead.selectIDs(c.EventIDs, 0)...)
+	}
+
+	// When redriving to another queue the events have to be added there first,
+	// so they're only selected here, and then removed by a second query
+	// afterwards
+	notifyQueue := c.Queue
+	if c.ToQueue != "" {
+		res, err := p.c.Query(ctx, core.QueryActions{
+			KeyBase:      ewDead.base,
+			QueryActions: qq,
+			Now:          now,
+		})
+		if err != nil {
+			return 0, err
+		} else if len(res.IDs) == 0 {
+			return 0, nil
+		}
+
+		ewToAvail, err := queueAvailable(c.ToQueue)
+		if err != nil {
+			return 0, err
+		}
+
+		// Scored based on the current time, see QMove
+		_, err = p.c.Query(ctx, core.QueryActions{
+			KeyBase: ewToAvail.base,
+			QueryActions: []core.QueryAction{
+				{
+					QuerySelector: &core.QuerySelector{IDs: res.IDs},
+				},
+				{
+					QueryAddTo: &core.QueryAddTo{
+						Keys:      []core.Key{ewToAvail.byArb},
+						Score:     now,
+						ScoreIncr: true,
+					},
+				},
+				{
+					QueryAddTo: &core.QueryAddTo{
+						Keys:          []core.Key{ewToAvail.byExp},
+						ExpireAsScore: true,
+					},
+				},
+			},
+			Now: now,
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		qq = []core.QueryAction{{QuerySelector: &core.QuerySelector{IDs: res.IDs}}}
+		notifyQueue = c.ToQueue
+	}
+
+	qq = append(qq, core.QueryAction{CountInput: true})
+	qq = append(qq, ewDead.removeFromInput())
+	qq = append(qq, ewAttempts.removeFromInput())
+	qq = append(qq, core.QueryAction{HashDel: &keyErrors})
+	if c.ToQueue == "" {
+		qq = append(qq, ewRedo.addFromInput(0)...)
+	}
+
+	qa := core.QueryActions{
+		KeyBase:      ewDead.base,
+		QueryActions: qq,
+		Now:          now,
+	}
+
+	res, err := p.c.Query(ctx, qa)
+	if err != nil {
+		return 0, err
+	}
+
+	if res.Counts[0] > 0 {
+		ewAvail, err := queueAvailable(notifyQueue)
+		if err != nil {
+			return 0, err
+		}
+		p.c.KeyNotify(ctx, ewAvail.byArb)
+	}
+
+	return res.Counts[0], nil
+}
+
+// returns actions which will set each priority's pointer to the newest event in
+// that priority's avail whose score is less than ts, so that the next events
+// retrieved will be the ones at or after ts. If ts is 0 the pointers are set to
+// the newest events. Pointers are left alone for priorities with no such event,
+// so they should be deleted beforehand. The same goes for the group sets and
+// their pointers, see queueGroups.
+func seekPointers(ewAvails []exWrap, keyPtrs []core.Key, ts, now core.TS) []core.QueryAction {
+	var qq []core.QueryAction
+	for prio := range keyPtrs {
+		qq = append(qq, ewAvails[prio].removeExpired(now)...)
+		qq = append(qq, ewAvails[prio].before(ts, 1))
+		qq = append(qq, core.QueryAction{
+			QuerySingleSet: &core.QuerySingleSet{
+				Key:       keyPtrs[prio],
+				ScoreFrom: &ewAvails[prio].byArb,
+			},
+		})
+	}
+	return qq
+}
+
+// QSeekCommand describes the parameters which can be passed into the QSeek
+// command
+type QSeekCommand struct {
+	Queue         string // Required
+	ConsumerGroup string // Required
+
+	// Optional. If not given the consumer group will replay all events still
+	// in the queue
+	From time.Time
+}
+
+// QSeek resets all of a consumer group's state, so that it will replay every
+// event in the queue which became available at or after From. Any events the
+// consumer group had in progress, waiting to be redone, or in its dead set are
+// forgotten.
+func (p *Peel) QSeek(ctx context.Context, c QSeekCommand) (err error) {
+	ctx, end := p.start(ctx, "QSeek", c.Queue, c.ConsumerGroup)
+	defer end(&err, nil)
+	now := core.NewTS(p.now())
+
+	ewAvails, err := queueAvailableBands(c.Queue)
+	if err != nil {
+		return err
+	}
+
+	kk, err := queueCGroupAllKeys(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return err
+	}
+
+	keyPtrs, err := queuePointerBands(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return err
+	}
+
+	ewGroups, err := p.usedQueueGroups(ctx, c.Queue)
+	if err != nil {
+		return err
+	}
+
+	keyGroupPtrs, _, err := queueGroupCGroupKeys(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return err
+	}
+	keyGroupPtrs = keyGroupPtrs[:len(ewGroups)]
+
+	var qq []core.QueryAction
+	for i := range kk {
+		qq = append(qq, core.QueryAction{Delete: &kk[i]})
+	}
+	if !c.From.IsZero() {
+		qq = append(qq, seekPointers(ewAvails, keyPtrs, core.NewTS(c.From), now)...)
+		qq = append(qq, seekPointers(ewGroups, keyGroupPtrs, core.NewTS(c.From), now)...)
+	}
+
+	_, err = p.c.Query(ctx, core.QueryActions{
+		KeyBase:      ewAvails[0].base,
+		QueryActions: qq,
+		Now:          now,
+	})
+	if err != nil {
+		return err
+	}
+
+	p.c.KeyNotify(ctx, ewAvails[0].byArb)
+	return nil
+}
+
+// QReplayCommand describes the parameters which can be passed into the QReplay
+// command
+type QReplayCommand struct {
+	Queue         string // Required
+	ConsumerGroup string // Required
+
+	// Optional. Only events which were added at or after From, and before To,
+	// are replayed. If not given the range is unbounded on that side.
+	From, To time.Time
+
+	// Optional. If set the events the consumer group is done with (see
+	// QDoneList) are replayed, rather than those kept for replay. They're
+	// moved back into the consumer group's redo set as they are, so this
+	// doesn't need a ReplayRetention, but expired events can't be replayed.
+	Done bool
+}
+
+// QReplay makes the events the queue is keeping for replay (see QueueConfig's
+// ReplayRetention) which were added in the given range available to be
+// retrieved by the consumer group again. Unlike QSeek this includes events
+// which have expired, and the rest of the consumer group's state is left
+// alone. If Done is set the events the consumer group is done with are
+// replayed instead, see QReplayCommand.
+//
+// Each event is replayed as a copy with a new ID, which expires the queue's
+// ReplayRetention from now and is only retrieved by the given consumer group.
+// Events whose contents are already gone, e.g. because they were added before
+// ReplayRetention was set, are skipped. Returns the number of events which were
+// replayed.
+func (p *Peel) QReplay(ctx context.Context, c QReplayCommand) (n uint64, err error) {
+	ctx, end := p.start(ctx, "QReplay", c.Queue, c.ConsumerGroup)
+	defer end(&err, func() int { return int(n) })
+	now := core.NewTS(p.now())
+
+	keyReplay, err := queueReplay(c.Queue)
+	if err != nil {
+		return 0, err
+	}
+
+	_, ewRedo, _, err := queueCGroupKeys(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.Done {
+		return p.replayDone(ctx, c, ewRedo)
+	}
+
+	qc, err := p.getConfig(ctx, QGetConfigCommand{Queue: c.Queue})
+	if err != nil || qc.ReplayRetention == 0 {
+		return 0, err
+	}
+
+	// Events from before the ReplayRetention may not have their contents
+	// anymore, even if CleanAvailable hasn't forgotten them yet
+	rng := core.QueryScoreRange{Min: core.NewTS(p.now().Add(-qc.ReplayRetention))}
+	if from := core.NewTS(c.From); !c.From.IsZero() && from > rng.Min {
+		rng.Min = from
+	}
+	if !c.To.IsZero() {
+		rng.Max, rng.MaxExcl = core.NewTS(c.To), true
+	}
+	res, err := p.c.Query(ctx, core.QueryActions{
+		KeyBase: keyReplay.Base,
+		QueryActions: []core.QueryAction{{
+			QuerySelector: &core.QuerySelector{
+				Key:              keyReplay,
+				QueryRangeSelect: &core.QueryRangeSelect{QueryScoreRange: rng},
+			},
+		}},
+		Now: now,
+	})
+	if err != nil || len(res.IDs) == 0 {
+		return 0, err
+	}
+
+	// If any of the events' contents are gone they're fetched one at a time,
+	// so the ones which aren't can still be replayed
+	ee, err := p.getEvents(ctx, res.IDs)
+	if err == core.ErrNotFound {
+		ee = nil
+		for _, id := range res.IDs {
+			idEE, err := p.getEvents(ctx, []core.ID{id})
+			if err == core.ErrNotFound {
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+			ee = append(ee, idEE[0])
+		}
+	} else if err != nil {
+		return 0, err
+	}
+	if len(ee) == 0 {
+		return 0, nil
+	}
+
+	tt, err := p.c.MonoTSs(ctx, now, len(ee))
+	if err != nil {
+		return 0, err
+	}
+	expire := core.NewTS(p.now().Add(qc.ReplayRetention))
+	ii := make([]core.ID, len(ee))
+	for i := range ee {
+		ii[i] = core.ID{T: tt[i], Expire: expire}
+		ee[i].ID = ii[i]
+	}
+	if err := p.setEvents(ctx, ee, p.o.EventPadding); err != nil {
+		return 0, err
+	}
+
+	// Like QAdd the IDs were generated up front, so the Query can be retried
+	_, err = p.c.Query(ctx, core.QueryActions{
+		KeyBase:      ewRedo.base,
+		QueryActions: ewRedo.addMulti(ii, 0),
+		Now:          now,
+		Idempotent:   true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	ewAvail, err := queueAvailable(c.Queue)
+	if err != nil {
+		return 0, err
+	}
+	p.c.KeyNotify(ctx, ewAvail.byArb)
+	return uint64(len(ii)), nil
+}
+
+// replayDone is QReplay for when Done is set
+func (p *Peel) replayDone(ctx context.Context, c QReplayCommand, ewRedo exWrap) (uint64, error) {
+	now := core.NewTS(p.now())
+	dd, err := p.doneIDs(ctx, c.Queue, c.ConsumerGroup, c.From, c.To, 0)
+	if err != nil || len(dd) == 0 {
+		return 0, err
+	}
+
+	ii := make([]core.ID, len(dd))
+	for i := range dd {
+		ii[i] = dd[i].id
+	}
+
+	// Finding the done events and moving them aren't atomic together, but only
+	// QSeek or QFlush could stop an event from being done in between, and in
+	// that case it's going to be retrieved again anyway
+	_, err = p.c.Query(ctx, core.QueryActions{
+		KeyBase:      ewRedo.base,
+		QueryActions: ewRedo.addMulti(ii, 0),
+		Now:          now,
+		Idempotent:   true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	ewAvail, err := queueAvailable(c.Queue)
+	if err != nil {
+		return 0, err
+	}
+	p.c.KeyNotify(ctx, ewAvail.byArb)
+	return uint64(len(ii)), nil
+}
+
+// QGroupDelCommand describes the parameters which can be passed into the
+// QGroupDel command
+type QGroupDelCommand struct {
+	Queue         string // Required
+	ConsumerGroup string // Required
+}
+
+// QGroupDel removes all state kept for the given consumer group in the queue,
+// including its RateLimit, after which it will no longer be listed by QList or
+// QStatus. If the consumer group is used again it will start from the beginning
+// of the queue.
+func (p *Peel) QGroupDel(ctx context.Context, c QGroupDelCommand) (err error) {
+	ctx, end := p.start(ctx, "QGroupDel", c.Queue, c.ConsumerGroup)
+	defer end(&err, nil)
+	kk, err := queueCGroupAllKeys(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return err
+	}
+
+	keyRateLimit, err := queueRateLimit(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return err
+	}
+	kk = append(kk, keyRateLimit)
+
+	qq := make([]core.QueryAction, len(kk))
+	for i := range kk {
+		qq[i] = core.QueryAction{Delete: &kk[i]}
+	}
+
+	_, err = p.c.Query(ctx, core.QueryActions{
+		KeyBase:      c.Queue,
+		QueryActions: qq,
+	})
+	return err
+}
+
+// QMoveCommand describes the parameters which can be passed into the QMove
+// command
+type QMoveCommand struct {
+	Queue   string // Required
+	ToQueue string // Required
+}
+
+// QMove moves all events which are currently available in Queue over to
+// ToQueue, keeping their priorities. Events which are delayed, or which are in
+// the queue's fair backlog (see QueueConfig's Fair), are left where they are.
+// Returns the number of events moved.
+//
+// Consumer groups of ToQueue will retrieve the moved events after any which
+// were already available to them. Events which consumer groups of Queue have
+// retrieved but not yet acknowledged may still be acknowledged.
+//
+// The events are moved atomically, so consumers never see an event in both
+// queues or in neither. That requires both queues to be stored together, so
+// QMove can't be used against a redis cluster (see core.ErrClusterCrossBase),
+// nor with sharded queues.
+func (p *Peel) QMove(ctx context.Context, c QMoveCommand) (n uint64, err error) {
+	ctx, end := p.start(ctx, "QMove", c.Queue, "")
+	defer end(&err, func() int { return int(n) })
+	if c.Queue == c.ToQueue {
+		return 0, errors.New("Queue and ToQueue must be different")
+	}
+
+	for _, queue := range []string{c.Queue, c.ToQueue} {
+		shards, err := p.queueShards(ctx, queue)
+		if err != nil {
+			return 0, err
+		} else if len(shards) > 1 {
+			return 0, errors.New("QMove can't be used with sharded queues")
+		}
+	}
+
+	ewAvails, err := queueAvailableBands(c.Queue)
+	if err != nil {
+		return 0, err
+	}
+
+	ewToAvails, err := queueAvailableBands(c.ToQueue)
+	if err != nil {
+		return 0, err
+	}
+
+	now := core.NewTS(p.now())
+	var qq []core.QueryAction
+	for prio := MaxPriority; prio >= 0; prio-- {
+		ewAvail, ewToAvail := ewAvails[prio], ewToAvails[prio]
+
+		// The events are given scores in the new avail based on the current
+		// time, for the same reason as when promoting delayed events
+		qq = append(qq, ewAvail.removeExpired(now)...)
+		qq = append(qq,
+			ewAvail.after(0, 0),
+			core.QueryAction{CountInput: true},
+			core.QueryAction{
+				QueryAddTo: &core.QueryAddTo{
+					Keys:      []core.Key{ewToAvail.byArb},
+					Score:     now,
+					ScoreIncr: true,
+				},
+			},
+			core.QueryAction{
+				QueryAddTo: &core.QueryAddTo{
+					Keys:          []core.Key{ewToAvail.byExp},
+					ExpireAsScore: true,
+				},
+			},
+			ewAvail.removeFromInput(),
+		)
+	}
+
+	res, err := p.c.Query(ctx, core.QueryActions{
+		KeyBase:      ewAvails[0].base,
+		QueryActions: qq,
+		Now:          now,
+		CrossBase:    true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var moved uint64
+	for _, count := range res.Counts {
+		moved += count
+	}
+	if moved > 0 {
+		p.c.KeyNotify(ctx, ewToAvails[0].byArb)
+	}
+	return moved, nil
+}
+
+// QPauseCommand describes the parameters which can be passed into the QPause
+// command
+type QPauseCommand struct {
+	Queue string // Required
+}
+
+// QPause pauses the given queue, so that no events will be retrieved from it
+// by QGet (for any consumer group) until QResume is called. Events can still be
+// added while the queue is paused, and in progress events can still be ack'd.
+// Pausing an already paused queue does nothing.
+func (p *Peel) QPause(ctx context.Context, c QPauseCommand) (err error) {
+	ctx, end := p.start(ctx, "QPause", c.Queue, "")
+	defer end(&err, nil)
+	return p.eachShard(ctx, c.Queue, func(queue string) error {
+		return p.qpause(ctx, queue)
+	})
+}
+
+func (p *Peel) qpause(ctx context.Context, queue string) error {
+	keyPaused, err := queuePaused(queue)
+	if err != nil {
+		return err
+	}
+
+	now := core.NewTS(p.now())
+	qq := []core.QueryAction{
+		{
+			QuerySelector: &core.QuerySelector{
+				Key: keyPaused,
+				IDs: []core.ID{{T: now}},
+			},
+		},
+		{
+			QuerySingleSet: &core.QuerySingleSet{Key: keyPaused},
+			QueryConditional: core.QueryConditional{
+				IfEmpty: &keyPaused,
+			},
+		},
+	}
+
+	_, err = p.c.Query(ctx, core.QueryActions{
+		KeyBase:      keyPaused.Base,
+		QueryActions: qq,
+		Now:          now,
+	})
+	return err
+}
+
+// QResumeCommand describes the parameters which can be passed into the QResume
+// command
+type QResumeCommand struct {
+	Queue string // Required
+}
+
+// QResume resumes a queue which was paused with QPause, so that events can be
+// retrieved from it again. Resuming a queue which isn't paused does nothing.
+func (p *Peel) QResume(ctx context.Context, c QResumeCommand) (err error) {
+	ctx, end := p.start(ctx, "QResume", c.Queue, "")
+	defer end(&err, nil)
+	return p.eachShard(ctx, c.Queue, func(queue string) error {
+		return p.qresume(ctx, queue)
+	})
+}
+
+func (p *Peel) qresume(ctx context.Context, queue string) error {
+	keyPaused, err := queuePaused(queue)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.c.Query(ctx, core.QueryActions{
+		KeyBase: keyPaused.Base,
+		QueryActions: []core.QueryAction{
+			{
+				Delete: &keyPaused,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Wake up any QGets which have been blocking while the queue was paused
+	ewAvail, err := queueAvailable(queue)
+	if err != nil {
+		return err
+	}
+	p.c.KeyNotify(ctx, ewAvail.byArb)
+	return nil
+}
+
+// QFlushCommand describes the parameters which can be passed into the QFlush
+// command
+type QFlushCommand struct {
+	Queue string // Required
+
+	// Optional. If given only this consumer group's state is flushed, and the
+	// queue's events are left for other consumer groups
+	ConsumerGroup string
+}
+
+// QFlush purges all events from the given queue, including those which are
+// delayed, in its fair backlog or added with a GroupID, along with all state
+// kept by the queue's consumer groups. The DedupKeys which its events were
+// added with are forgotten too.
+//
+// If ConsumerGroup is given then the queue's events are left as they are, but
+// the consumer group's in progress, redo and dead events are cleared and all
+// available events are treated as having been consumed by it. Delayed events
+// will still be retrieved by the consumer group once they become visible, as
+// will events in the fair backlog once they're made available.
+func (p *Peel) QFlush(ctx context.Context, c QFlushCommand) (err error) {
+	ctx, end := p.start(ctx, "QFlush", c.Queue, c.ConsumerGroup)
+	defer end(&err, nil)
+	return p.eachShard(ctx, c.Queue, func(queue string) error {
+		c.Queue = queue
+		return p.qflush(ctx, c)
+	})
+}
+
+func (p *Peel) qflush(ctx context.Context, c QFlushCommand) error {
+	now := core.NewTS(p.now())
+
+	ewAvails, err := queueAvailableBands(c.Queue)
+	if err != nil {
+		return err
+	}
+
+	ewGroups, err := queueGroups(c.Queue)
+	if err != nil {
+		return err
+	}
+
+	cgroups := []string{c.ConsumerGroup}
+	if c.ConsumerGroup == "" {
+		if cgroups, err = p.queueConsumerGroups(ctx, c.Queue); err != nil {
+			return err
+		}
+	}
+
+	var kk []core.Key
+	for _, cgroup := range cgroups {
+		cgkk, err := queueCGroupAllKeys(c.Queue, cgroup)
+		if err != nil {
+			return err
+		}
+		kk = append(kk, cgkk...)
+	}
+
+	if c.ConsumerGroup == "" {
+		ewDelayeds, err := queueDelayedBands(c.Queue)
+		if err != nil {
+			return err
+		}
+		for prio := range ewAvails {
+			kk = append(kk, ewAvails[prio].byArb, ewAvails[prio].byExp)
+			kk = append(kk, ewDelayeds[prio].byArb, ewDelayeds[prio].byExp)
+		}
+
+		ewFairs, err := queueFairBacklogs(c.Queue)
+		if err != nil {
+			return err
+		}
+		for _, ewFair := range ewFairs {
+			kk = append(kk, ewFair.byArb, ewFair.byExp)
+		}
+		for _, ewGroup := range ewGroups {
+			kk = append(kk, ewGroup.byArb, ewGroup.byExp)
+		}
+
+		keyReplay, err := queueReplay(c.Queue)
+		if err != nil {
+			return err
+		}
+		kk = append(kk, keyReplay)
+
+		keyTraces, err := queueTraces(c.Queue, "")
+		if err != nil {
+			return err
+		}
+		kk = append(kk, keyTraces...)
+
+		// There's a dedup key per DedupKey, so they have to be found.
+		// Otherwise adding an event with one of them again would return the
+		// ID of an event which is gone.
+		dedupScanK, err := queueDedup(c.Queue, "*")
+		if err != nil {
+			return err
+		}
+		keyDedups, err := p.c.KeyScan(ctx, dedupScanK)
+		if err != nil {
+			return err
+		}
+		kk = append(kk, keyDedups...)
+	}
+
+	var qq []core.QueryAction
+	for i := range kk {
+		qq = append(qq, core.QueryAction{Delete: &kk[i]})
+	}
+
+	// When only flushing a consumer group, its pointers are moved up to the
+	// newest event in each priority's avail and each group set so that
+	// everything currently available counts as done
+	if c.ConsumerGroup != "" {
+		keyPtrs, err := queuePointerBands(c.Queue, c.ConsumerGroup)
+		if err != nil {
+			return err
+		}
+		ewUsedGroups, err := p.usedQueueGroups(ctx, c.Queue)
+		if err != nil {
+			return err
+		}
+		keyGroupPtrs, _, err := queueGroupCGroupKeys(c.Queue, c.ConsumerGroup)
+		if err != nil {
+			return err
+		}
+		qq = append(qq, seekPointers(ewAvails, keyPtrs, 0, now)...)
+		qq = append(qq, seekPointers(ewUsedGroups, keyGroupPtrs[:len(ewUsedGroups)], 0, now)...)
+	}
+
+	_, err = p.c.Query(ctx, core.QueryActions{
+		KeyBase:      ewAvails[0].base,
+		QueryActions: qq,
+		Now:          now,
+	})
+	return err
+}
+
+// returns the MaxDeliveries which applies to a queue with the given
+// QueueConfig, either its own or the one in the Opts
+func (p *Peel) maxDeliveries(qc QueueConfig) int {
+	if qc.MaxDeliveries > 0 {
+		return qc.MaxDeliveries
+	}
+	return p.o.MaxDeliveries
+}
+
+// returns actions which will take the IDs output by sel, which should all be in
+// inProg, and move any which have been attempted at least maxDeliveries times
+// into dead, removing their claims. Their attempts are kept so they can be
+// listed with QDeadList. The number of IDs moved is appended to the Counts of
+// the query. If maxDeliveries isn't set then no actions are returned.
+// traceDead is appended to the actions, see traceActions.
+func (p *Peel) deadLetter(sel []core.QueryAction, maxDeliveries int, ewInProg, ewAttempts, ewDead exWrap, keyClaims core.Key, traceDead []core.QueryAction) []core.QueryAction {
+	if maxDeliveries < 1 {
+		return nil
+	}
+
+	var qq []core.QueryAction
+	qq = append(qq, sel...)
+	qq = append(qq, ewAttempts.filterByScore(core.TS(maxDeliveries), 0))
+	qq = append(qq, core.QueryAction{CountInput: true})
+	qq = append(qq, ewInProg.removeFromInput())
+	qq = append(qq, core.QueryAction{HashDel: &keyClaims})
+	qq = append(qq, ewDead.addFromInput(0)...)
+	qq = append(qq, traceDead...)
+	return qq
+}
+
+// returns actions which will find all events who missed their ack deadline,
+// remove them from inProg and add them to redo. If they've been attempted too
+// many times they go to dead instead. If maxDeliveries is set the number of
+// events moved to dead is appended to the result's Counts, and then always the
+// number of events moved to redo.
+func (p *Peel) redoMissedDeadlines(now core.TS, maxDeliveries int, ewInProg, ewRedo, ewAttempts, ewDead exWrap, keyClaims core.Key, traceDead []core.QueryAction) []core.QueryAction {
+	return p.redoFromInProg(ewInProg.before(now, 0), maxDeliveries, ewInProg, ewRedo, ewAttempts, ewDead, keyClaims, traceDead)
+}
+
+// like redoMissedDeadlines, but for whichever events from inProg are output by
+// sel, which is done twice
+func (p *Peel) redoFromInProg(sel core.QueryAction, maxDeliveries int, ewInProg, ewRedo, ewAttempts, ewDead exWrap, keyClaims core.Key, traceDead []core.QueryAction) []core.QueryAction {
+	var qq []core.QueryAction
+	missedDeadline := []core.QueryAction{sel}
+	qq = append(qq, p.deadLetter(missedDeadline, maxDeliveries, ewInProg, ewAttempts, ewDead, keyClaims, traceDead)...)
+	qq = append(qq, missedDeadline...)
+	qq = append(qq, core.QueryAction{CountInput: true})
+	qq = append(qq, ewInProg.removeFromInput())
+	qq = append(qq, core.QueryAction{HashDel: &keyClaims})
+	qq = append(qq, ewRedo.addFromInput(0)...)
+	return qq
+}
+
+// Clean finds all the events which were retrieved for the given
+// queue/consumerGroup which weren't ack'd by the deadline, and makes them
+// available to be retrieved again. If MaxDeliveries is set, events which have
+// been retrieved too many times are moved to the consumer group's dead set
+// instead. Events recorded for the consumer group beyond the queue's
+// TraceMaxLength are forgotten.
 //
-// An empty event is returned if there are no available events for the queue.
-func (p *Peel) QGet(c QGetCommand) (core.Event, error) {
-	if c.BlockUntil.IsZero() {
-		return p.qgetDirect(c)
+// The Stat reported to the Hook for Clean (see core.Opts) has the number of
+// events which had missed their deadline as its Count.
+func (p *Peel) Clean(ctx context.Context, queue, consumerGroup string) (err error) {
+	var n uint64
+	ctx, end := p.start(ctx, "Clean", queue, consumerGroup)
+	defer end(&err, func() int { return int(n) })
+	now := core.NewTS(p.now())
+
+	ewAvails, err := queueAvailableBands(queue)
+	if err != nil {
+		return err
 	}
 
-	ewAvail, err := queueAvailable(c.Queue)
+	ewInProg, ewRedo, _, err := queueCGroupKeys(queue, consumerGroup)
 	if err != nil {
-		return core.Event{}, err
+		return err
 	}
 
-	now := time.Now()
-	timeoutCh := time.After(c.BlockUntil.Sub(now))
+	keyPtrs, err := queuePointerBands(queue, consumerGroup)
+	if err != nil {
+		return err
+	}
 
-	for {
-		stopCh := make(chan struct{})
-		pushCh := p.c.KeyWait(ewAvail.byArb, stopCh)
+	ewAttempts, ewDead, err := queueDeadLetterKeys(queue, consumerGroup)
+	if err != nil {
+		return err
+	}
 
-		if e, err := p.qgetDirect(c); err != nil || (e != core.Event{}) {
-			return e, err
-		}
+	ewDeliveries, err := queueDeliveries(queue, consumerGroup)
+	if err != nil {
+		return err
+	}
 
-		select {
-		case <-pushCh:
-		case <-timeoutCh:
-			return core.Event{}, nil
-		}
+	keyClaims, err := queueClaims(queue, consumerGroup)
+	if err != nil {
+		return err
+	}
 
-		close(stopCh)
+	keyErrors, err := queueErrors(queue, consumerGroup)
+	if err != nil {
+		return err
 	}
-}
 
-func (p *Peel) qgetDirect(c QGetCommand) (core.Event, error) {
-	ewAvail, err := queueAvailable(c.Queue)
+	_, ewGroupInProgs, err := queueGroupCGroupKeys(queue, consumerGroup)
 	if err != nil {
-		return core.Event{}, err
+		return err
 	}
 
-	ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(c.Queue, c.ConsumerGroup)
+	keyTraces, err := queueTraces(queue, consumerGroup)
 	if err != nil {
-		return core.Event{}, err
+		return err
 	}
 
-	now := core.NewTS(time.Now())
+	qc, err := p.cachedConfig(ctx, queue)
+	if err != nil {
+		return err
+	}
 
-	// Depending on if Expire is set, we might add the event to the inProg in
-	// addition to setting ptr
-	maybeDone := make([]core.QueryAction, 0, 3)
-	maybeDone = append(maybeDone, core.QueryAction{
-		QuerySingleSet: &core.QuerySingleSet{
-			Key:     keyPtr,
-			IfNewer: true,
-		},
-	})
-	if !c.AckDeadline.IsZero() {
-		addToInProg := ewInProg.addFromInput(core.NewTS(c.AckDeadline))
-		maybeDone = append(maybeDone, addToInProg...)
+	traceDead, err := traceActions(qc, queue, consumerGroup, TraceDeadLettered, now)
+	if err != nil {
+		return err
 	}
-	maybeDone = append(maybeDone, core.QueryAction{
-		Break: true,
-		QueryConditional: core.QueryConditional{
-			IfInput: true,
-		},
-	})
+	ewGroupInProgs = ewGroupInProgs[:qc.groupBuckets()]
 
+	// First clean expired events from everything
 	var qq []core.QueryAction
-
-	// First, if there's any IDs in redo, we try to grab the first one from
-	// there
+	qq = append(qq, ewInProg.removeExpired(now)...)
+	qq = append(qq, core.QueryAction{HashDel: &keyClaims})
 	qq = append(qq, ewRedo.removeExpired(now)...)
-	qq = append(qq, ewRedo.after(0, 1))
-	qq = append(qq, ewRedo.removeFromInput())
-	qq = append(qq, maybeDone...)
+	qq = append(qq, ewAttempts.removeExpired(now)...)
+	qq = append(qq, core.QueryAction{HashDel: &keyErrors})
+	qq = append(qq, ewDead.removeExpired(now)...)
+	qq = append(qq, ewDeliveries.removeExpired(now)...)
+	for _, ew := range ewGroupInProgs {
+		qq = append(qq, ew.removeExpired(now)...)
+	}
+	qq = append(qq, trimTraces(qc, keyTraces)...)
 
-	// Otherwise grab the next event from avail after our pointer. Gotta clean
-	// avail first though. If we get an event, set our pointer and return
-	qq = append(qq, ewAvail.removeExpired(now)...)
-	qq = append(qq,
-		core.QueryAction{
-			SingleGet: &keyPtr,
-		},
-		ewAvail.afterInput(1),
-	)
-	qq = append(qq, maybeDone...)
+	qq = append(qq, p.redoMissedDeadlines(now, p.maxDeliveries(qc), ewInProg, ewRedo, ewAttempts, ewDead, keyClaims, traceDead)...)
 
-	// The queue has no activity, simply get the first event in avail. Only
-	// applies if our pointer is actually empty. If it's not and we're here it
-	// means that the queue has simply been fully processed thusfar
-	qq = append(qq, core.QueryAction{
-		Break: true,
-		QueryConditional: core.QueryConditional{
-			IfNotEmpty: &keyPtr,
-		},
-	})
-	qq = append(qq, ewAvail.after(0, 1))
-	qq = append(qq, maybeDone...)
+	// get each priority's pointer, if there's no events equal to or older than
+	// it in that priority's avail, delete it
+	for prio := range keyPtrs {
+		// This is a giant hack. But this is literally the only case where we
+		// don't want to exclude the right side afaik, and we *have* to include
+		// it no matter what, so it seemed weird to add a new method or a
+		// parameter to an existing method. Don't do this again.
+		beforeAvail := ewAvails[prio].beforeInput(1)
+		beforeAvail.QuerySelector.QueryRangeSelect.QueryScoreRange.MaxExcl = false
+
+		qq = append(qq, core.QueryAction{SingleGet: &keyPtrs[prio]})
+		qq = append(qq, beforeAvail)
+		qq = append(qq, core.QueryAction{
+			Delete: &keyPtrs[prio],
+			QueryConditional: core.QueryConditional{
+				IfNoInput: true,
+			},
+		})
+	}
 
 	qa := core.QueryActions{
-		KeyBase:      ewAvail.base,
+		KeyBase:      ewAvails[0].base,
 		QueryActions: qq,
 		Now:          now,
 	}
 
-	res, err := p.c.Query(qa)
+	res, err := p.c.Query(ctx, qa)
 	if err != nil {
-		return core.Event{}, err
-	} else if len(res.IDs) == 0 {
-		return core.Event{}, nil
+		return err
 	}
-
-	return p.c.GetEvent(res.IDs[0])
+	for _, count := range res.Counts {
+		n += count
+	}
+	p.logMissedDeadlines(ctx, queue, consumerGroup, p.maxDeliveries(qc), res.Counts)
+	return nil
 }
 
-// QAckCommand describes the parameters which can be passed into the QAck
+// QCleanCommand describes the parameters which can be passed into the QClean
 // command
-type QAckCommand struct {
-	Queue         string  // Required
-	ConsumerGroup string  // Required
-	EventID       core.ID // Required
+type QCleanCommand struct {
+	// Optional. If not given all known queues are cleaned
+	Queue string
+
+	// Optional. If not given all known consumer groups of the queue(s) are
+	// cleaned
+	ConsumerGroup string
 }
 
-// QAck acknowledges that an event has been successfully processed and should
-// not be re-processed. Only applicable for Events which were gotten through a
-// QGet with an AckDeadline. Returns true if the Event was successfully
-// acknowledged. false will be returned if the deadline was missed, and
-// therefore some other consumer may re-process the Event later.
-func (p *Peel) QAck(c QAckCommand) (bool, error) {
-	now := core.NewTS(time.Now())
+// QClean finds all events which consumer groups retrieved but didn't ack by the
+// deadline, and makes them available to be retrieved again (or moves them to
+// the dead set, see MaxDeliveries). Otherwise this only happens when Clean is
+// called, which Run does every CleanPeriod. Consumers blocking on the queues
+// are woken up if any events were moved.
+//
+// Returns the number of events which had missed their deadline.
+func (p *Peel) QClean(ctx context.Context, c QCleanCommand) (n uint64, err error) {
+	ctx, end := p.start(ctx, "QClean", c.Queue, c.ConsumerGroup)
+	defer end(&err, func() int { return int(n) })
+	var qcg map[string][]string
+	if c.Queue == "" {
+		qcg, err = p.AllQueuesConsumerGroups(ctx)
+	} else if c.ConsumerGroup == "" {
+		var cgs []string
+		cgs, err = p.queueConsumerGroups(ctx, c.Queue)
+		qcg = map[string][]string{c.Queue: cgs}
+	} else {
+		qcg = map[string][]string{c.Queue: {c.ConsumerGroup}}
+	}
+	if err != nil {
+		return 0, err
+	}
 
-	ewInProg, err := queueInProgress(c.Queue, c.ConsumerGroup)
+	var total uint64
+	for q, cgs := range qcg {
+		var moved uint64
+		for _, cg := range cgs {
+			n, err := p.qclean(ctx, q, cg)
+			if err != nil {
+				return total, err
+			}
+			moved += n
+		}
+
+		if moved > 0 {
+			ewAvail, err := queueAvailable(q)
+			if err != nil {
+				return total, err
+			}
+			p.c.KeyNotify(ctx, ewAvail.byArb)
+		}
+		total += moved
+	}
+	return total, nil
+}
+
+// qclean is reported to the Hook as Clean, since it does the same as Clean for
+// the consumer group apart from cleaning its other sets
+func (p *Peel) qclean(ctx context.Context, queue, consumerGroup string) (n uint64, err error) {
+	ctx, end := p.start(ctx, "Clean", queue, consumerGroup)
+	defer end(&err, func() int { return int(n) })
+	now := core.NewTS(p.now())
+
+	ewInProg, ewRedo, _, err := queueCGroupKeys(queue, consumerGroup)
 	if err != nil {
-		return false, err
+		return 0, err
+	}
+
+	ewAttempts, ewDead, err := queueDeadLetterKeys(queue, consumerGroup)
+	if err != nil {
+		return 0, err
+	}
+
+	keyClaims, err := queueClaims(queue, consumerGroup)
+	if err != nil {
+		return 0, err
+	}
+
+	qc, err := p.cachedConfig(ctx, queue)
+	if err != nil {
+		return 0, err
+	}
+
+	traceDead, err := traceActions(qc, queue, consumerGroup, TraceDeadLettered, now)
+	if err != nil {
+		return 0, err
 	}
 
 	var qq []core.QueryAction
 	qq = append(qq, ewInProg.removeExpired(now)...)
-	qq = append(qq, core.QueryAction{
-		QuerySelector: &core.QuerySelector{
-			Key: ewInProg.byArb,
-			QueryIDScoreSelect: &core.QueryIDScoreSelect{
-				ID:  c.EventID,
-				Min: now,
-			},
-		},
-	})
-	qq = append(qq, ewInProg.removeFromInput())
+	qq = append(qq, core.QueryAction{HashDel: &keyClaims})
+	qq = append(qq, p.redoMissedDeadlines(now, p.maxDeliveries(qc), ewInProg, ewRedo, ewAttempts, ewDead, keyClaims, traceDead)...)
 
-	qa := core.QueryActions{
+	res, err := p.c.Query(ctx, core.QueryActions{
 		KeyBase:      ewInProg.base,
 		QueryActions: qq,
 		Now:          now,
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	res, err := p.c.Query(qa)
-	if err != nil {
-		return false, err
+	for _, count := range res.Counts {
+		n += count
 	}
-	return len(res.IDs) > 0, nil
+	p.logMissedDeadlines(ctx, queue, consumerGroup, p.maxDeliveries(qc), res.Counts)
+	return n, nil
 }
 
-// Clean finds all the events which were retrieved for the given
-// queue/consumerGroup which weren't ack'd by the deadline, and makes them
-// available to be retrieved again.
-func (p *Peel) Clean(queue, consumerGroup string) error {
-	now := core.NewTS(time.Now())
+// CleanAvailable cleans up expired events out of the given queue's set of
+// events which are available for consumer groups to retrieve, as well as its
+// sets of delayed events and of events in its fair backlog. Any delayed events
+// which have become visible are made available, and events which are no longer
+// kept for replay (see QueueConfig's ReplayRetention) are forgotten, as are
+// events recorded beyond the queue's TraceMaxLength.
+func (p *Peel) CleanAvailable(ctx context.Context, queue string) (err error) {
+	ctx, end := p.start(ctx, "CleanAvailable", queue, "")
+	defer end(&err, nil)
+	now := core.NewTS(p.now())
 
-	ewAvail, err := queueAvailable(queue)
+	ewAvails, err := queueAvailableBands(queue)
 	if err != nil {
 		return err
 	}
 
-	// This is a giant hack. But this is literally the only case where we don't
-	// want to exclude the right side afaik, and we *have* to include it no
-	// matter what, so it seemed weird to add a new method or a parameter to an
-	// existing method. Don't do this again.
-	beforeAvail := ewAvail.beforeInput(1)
-	beforeAvail.QuerySelector.QueryRangeSelect.QueryScoreRange.MaxExcl = false
-
-	ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(queue, consumerGroup)
+	ewDelayeds, err := queueDelayedBands(queue)
 	if err != nil {
 		return err
 	}
 
-	// First clean expired events from everything
-	var qq []core.QueryAction
-	qq = append(qq, ewInProg.removeExpired(now)...)
-	qq = append(qq, ewRedo.removeExpired(now)...)
-
-	// find all events who missed their ack deadline, remove them from inProg
-	// and add them to redo
-	qq = append(qq, ewInProg.before(now, 0))
-	qq = append(qq, ewInProg.removeFromInput())
-	qq = append(qq, ewRedo.addFromInput(0)...)
+	ewFairs, err := queueFairBacklogs(queue)
+	if err != nil {
+		return err
+	}
 
-	// get the pointer, if there's no events equal to or older than it in the
-	// queue, delete it
-	qq = append(qq, core.QueryAction{SingleGet: &keyPtr})
-	qq = append(qq, beforeAvail)
-	qq = append(qq, core.QueryAction{
-		Delete: &keyPtr,
-		QueryConditional: core.QueryConditional{
-			IfNoInput: true,
-		},
-	})
+	ewGroups, err := p.usedQueueGroups(ctx, queue)
+	if err != nil {
+		return err
+	}
 
-	qa := core.QueryActions{
-		KeyBase:      keyPtr.Base,
-		QueryActions: qq,
-		Now:          now,
+	keyReplay, err := queueReplay(queue)
+	if err != nil {
+		return err
 	}
 
-	_, err = p.c.Query(qa)
-	return err
-}
+	keyTraces, err := queueTraces(queue, "")
+	if err != nil {
+		return err
+	}
 
-// CleanAvailable cleans up expired events out of the given queue's set of
-// events which are available for consumer groups to retrieve
-func (p *Peel) CleanAvailable(queue string) error {
-	now := core.NewTS(time.Now())
+	qc, err := p.cachedConfig(ctx, queue)
+	if err != nil {
+		return err
+	}
 
-	ewAvail, err := queueAvailable(queue)
+	traceExpired, err := traceActions(qc, queue, "", TraceExpired, now)
 	if err != nil {
 		return err
 	}
 
+	var qq []core.QueryAction
+	qq = append(qq, promoteDelayed(ewDelayeds, ewAvails, now)...)
+	for _, ewAvail := range ewAvails {
+		qq = append(qq, ewAvail.removeExpired(now)...)
+		qq = append(qq, traceExpired...)
+	}
+	for _, ew := range append(ewFairs, ewGroups...) {
+		qq = append(qq, ew.removeExpired(now)...)
+		qq = append(qq, traceExpired...)
+	}
+
+	// Events which are no longer kept for replay are forgotten, their
+	// contents will expire on their own
+	if qc.ReplayRetention == 0 {
+		qq = append(qq, core.QueryAction{Delete: &keyReplay})
+	} else {
+		qq = append(qq, core.QueryAction{
+			QueryRemoveByScore: &core.QueryRemoveByScore{
+				Keys: []core.Key{keyReplay},
+				QueryScoreRange: core.QueryScoreRange{
+					Max:     core.NewTS(p.now().Add(-qc.ReplayRetention)),
+					MaxExcl: true,
+				},
+			},
+		})
+	}
+	if qc.ReplayRetention > 0 && qc.ReplayMaxLength > 0 {
+		qq = append(qq,
+			core.QueryAction{
+				QuerySelector: &core.QuerySelector{
+					Key:            keyReplay,
+					PosRangeSelect: []int64{0, -int64(qc.ReplayMaxLength) - 1},
+				},
+			},
+			core.QueryAction{RemoveFrom: []core.Key{keyReplay}},
+		)
+	}
+	qq = append(qq, trimTraces(qc, keyTraces)...)
+
 	qa := core.QueryActions{
-		KeyBase:      ewAvail.base,
-		QueryActions: ewAvail.removeExpired(now),
+		KeyBase:      ewAvails[0].base,
+		QueryActions: qq,
 		Now:          now,
 	}
 
-	_, err = p.c.Query(qa)
+	_, err = p.c.Query(ctx, qa)
 	return err
 }
 
 // CleanAll will call CleanAvailable on all known queues and Clean on all of
 // their known consumer groups. Will return at the first error
-func (p *Peel) CleanAll() error {
-	qcg, err := p.AllQueuesConsumerGroups()
+func (p *Peel) CleanAll(ctx context.Context) (err error) {
+	ctx, end := p.start(ctx, "CleanAll", "", "")
+	defer end(&err, nil)
+	qcg, err := p.AllQueuesConsumerGroups(ctx)
 	if err != nil {
 		return err
 	}
 
 	for q, cgs := range qcg {
-		if err = p.CleanAvailable(q); err != nil {
+		if err = p.CleanAvailable(ctx, q); err != nil {
 			return err
 		}
 		for _, cg := range cgs {
-			if err = p.Clean(q, cg); err != nil {
+			if err = p.Clean(ctx, q, cg); err != nil {
 				return err
 			}
 		}
@@ -442,6 +4339,23 @@ func (p *Peel) CleanAll() error {
 	return err
 }
 
+// cleanAllOnce calls CleanAll, unless another Peel sharing the same database
+// has already done so recently. Returns whether CleanAll was called.
+func (p *Peel) cleanAllOnce(ctx context.Context) (bool, error) {
+	// The lock is held for less than CleanPeriod so that tickers which don't
+	// line up exactly can't cause every Peel to skip a period. Each period will
+	// be cleaned by at least one Peel, and at most two.
+	id := core.ID{T: core.NewTS(p.now())}
+	_, set, err := p.c.SetIDNX(ctx, keyCleanLock, id, p.o.CleanPeriod/2)
+	if err != nil || !set {
+		if err == nil {
+			p.log(ctx, slog.LevelDebug, "skipping cleanup, another instance did it recently")
+		}
+		return false, err
+	}
+	return true, p.CleanAll(ctx)
+}
+
 // ConsumerGroupStats are available statistics about a queue/consumer group.
 type ConsumerGroupStats struct {
 	// Number of events the consumer group has yet to process for the queue
@@ -452,70 +4366,252 @@ type ConsumerGroupStats struct {
 
 	// Number of events awaiting being re-attempted by the consumer group
 	Redo uint64
+
+	// Number of events which the consumer group has finished processing, and
+	// which haven't yet expired
+	Done uint64
+
+	// Number of events which the consumer group gave up on after MaxDeliveries
+	// attempts
+	Dead uint64
+
+	// How far the consumer group is behind the newest available event, i.e.
+	// how long before that event the newest event which the consumer group has
+	// retrieved became available. If the consumer group hasn't retrieved any
+	// yet this is instead measured from the oldest available event. The number
+	// of events it's behind by is Available.
+	Lag time.Duration
 }
 
 // QueueStats are available statistics about a queue across all consumer groups
 type QueueStats struct {
 	// Number of events for the queue in the system. Will be the same regardless
-	// of consumer group. Does NOT include expired events.
+	// of consumer group. Does NOT include expired or delayed events.
 	Total uint64
 
+	// Number of events for the queue which have been added but won't be
+	// visible to consumer groups until some point in the future
+	Delayed uint64
+
+	// Whether the queue is currently paused (see QPause)
+	Paused bool
+
 	// Statistics for each consumer group known for the queue. The key will be
 	// the consumer group's name
 	ConsumerGroupStats map[string]ConsumerGroupStats
 }
 
-func (p *Peel) qstatus(queue string, cgroups []string) (QueueStats, error) {
-	now := core.NewTS(time.Now())
-	ewAvail, err := queueAvailable(queue)
+func (p *Peel) qstatus(ctx context.Context, queue string, cgroups []string) (QueueStats, error) {
+	now := core.NewTS(p.now())
+	ewAvails, err := queueAvailableBands(queue)
+	if err != nil {
+		return QueueStats{}, err
+	}
+
+	ewDelayeds, err := queueDelayedBands(queue)
+	if err != nil {
+		return QueueStats{}, err
+	}
+
+	ewFairs, err := queueFairBacklogs(queue)
+	if err != nil {
+		return QueueStats{}, err
+	}
+
+	ewGroups, err := p.usedQueueGroups(ctx, queue)
+	if err != nil {
+		return QueueStats{}, err
+	}
+
+	keyPaused, err := queuePaused(queue)
 	if err != nil {
 		return QueueStats{}, err
 	}
 
 	var qq []core.QueryAction
-	qq = append(qq, ewAvail.removeExpired(now)...)
-	qq = append(qq, ewAvail.countNotExpired(now))
+
+	// returns actions which append the score of the first ID output by sel to
+	// the Counts, preceded by the number of scores appended (0 or 1)
+	scoreOf := func(ew exWrap, sel *core.QuerySelector) []core.QueryAction {
+		sel.Key = ew.byArb
+		return []core.QueryAction{
+			{QuerySelector: sel},
+			{CountInput: true},
+			ew.scoresFromInput(),
+		}
+	}
+
+	// returns actions which append the score of the newest event in the set,
+	// see scoreOf
+	newestScore := func(ew exWrap) []core.QueryAction {
+		return scoreOf(ew, &core.QuerySelector{PosRangeSelect: []int64{-1, -1}})
+	}
+
+	// returns actions which append the score of the first event in the set
+	// which isn't before the pointer in the input, or of the oldest event if
+	// there's no pointer, see scoreOf
+	pointerScore := func(ew exWrap) []core.QueryAction {
+		return scoreOf(ew, &core.QuerySelector{
+			QueryRangeSelect: &core.QueryRangeSelect{
+				QueryScoreRange: core.QueryScoreRange{MinFromInput: true},
+				Limit:           1,
+			},
+		})
+	}
+
+	// The input starts off empty, so this counts 1 if the queue is paused and 0
+	// otherwise
+	qq = append(qq,
+		core.QueryAction{
+			QuerySelector: &core.QuerySelector{
+				Key: keyPaused,
+				IDs: []core.ID{{T: now}},
+			},
+			QueryConditional: core.QueryConditional{
+				IfNotEmpty: &keyPaused,
+			},
+		},
+		core.QueryAction{CountInput: true},
+	)
+	qq = append(qq, promoteDelayed(ewDelayeds, ewAvails, now)...)
+	for prio := range ewAvails {
+		qq = append(qq, ewAvails[prio].removeExpired(now)...)
+		qq = append(qq, ewAvails[prio].countNotExpired(now))
+		qq = append(qq, ewDelayeds[prio].countNotExpired(now))
+		qq = append(qq, newestScore(ewAvails[prio])...)
+	}
+	for _, ewFair := range ewFairs {
+		qq = append(qq, ewFair.removeExpired(now)...)
+		qq = append(qq, ewFair.countNotExpired(now))
+	}
+	for _, ewGroup := range ewGroups {
+		qq = append(qq, ewGroup.removeExpired(now)...)
+		qq = append(qq, ewGroup.countNotExpired(now))
+		qq = append(qq, newestScore(ewGroup)...)
+	}
 
 	for _, cg := range cgroups {
-		var ewInProg, ewRedo exWrap
-		var keyPtr core.Key
-		if ewInProg, ewRedo, keyPtr, err = queueCGroupKeys(queue, cg); err != nil {
+		var ewInProg, ewRedo, ewDead exWrap
+		var keyPtrs, keyGroupPtrs []core.Key
+		if ewInProg, ewRedo, _, err = queueCGroupKeys(queue, cg); err != nil {
+			return QueueStats{}, err
+		}
+		if keyPtrs, err = queuePointerBands(queue, cg); err != nil {
+			return QueueStats{}, err
+		}
+		if keyGroupPtrs, _, err = queueGroupCGroupKeys(queue, cg); err != nil {
+			return QueueStats{}, err
+		}
+		keyGroupPtrs = keyGroupPtrs[:len(ewGroups)]
+		if ewDead, err = queueDead(queue, cg); err != nil {
 			return QueueStats{}, err
 		}
+		for prio := range keyPtrs {
+			qq = append(qq,
+				core.QueryAction{
+					SingleGet: &keyPtrs[prio],
+				},
+				ewAvails[prio].countAfterInput(),
+			)
+			qq = append(qq, pointerScore(ewAvails[prio])...)
+		}
+		for b := range keyGroupPtrs {
+			qq = append(qq,
+				core.QueryAction{
+					SingleGet: &keyGroupPtrs[b],
+				},
+				ewGroups[b].countAfterInput(),
+			)
+			qq = append(qq, pointerScore(ewGroups[b])...)
+		}
 		qq = append(qq,
-			core.QueryAction{
-				SingleGet: &keyPtr,
-			},
-			ewAvail.countAfterInput(),
 			ewInProg.countNotExpired(now),
 			ewRedo.countNotExpired(now),
+			ewDead.countNotExpired(now),
 		)
 	}
 
 	qa := core.QueryActions{
-		KeyBase:      ewAvail.base,
+		KeyBase:      ewAvails[0].base,
 		QueryActions: qq,
 		Now:          now,
 	}
 
-	res, err := p.c.Query(qa)
+	res, err := p.c.Query(ctx, qa)
 	if err != nil {
 		return QueueStats{}, err
 	}
 
 	qs := QueueStats{
-		Total:              res.Counts[0],
+		Paused:             res.Counts[0] > 0,
 		ConsumerGroupStats: map[string]ConsumerGroupStats{},
 	}
 	res.Counts = res.Counts[1:]
 
+	// reads the score appended by the actions from scoreOf, or 0 if there
+	// wasn't one
+	nextScore := func() core.TS {
+		n := res.Counts[0]
+		res.Counts = res.Counts[1:]
+		if n == 0 {
+			return 0
+		}
+		score := core.TS(res.Counts[0])
+		res.Counts = res.Counts[1:]
+		return score
+	}
+
+	// The newest score of each avail, followed by each group set
+	var newest []core.TS
+	for range ewAvails {
+		qs.Total += res.Counts[0]
+		qs.Delayed += res.Counts[1]
+		res.Counts = res.Counts[2:]
+		newest = append(newest, nextScore())
+	}
+
+	// Events in the fair backlog haven't been made available yet, so none of
+	// the consumer groups have retrieved them
+	var fair uint64
+	for range ewFairs {
+		fair += res.Counts[0]
+		res.Counts = res.Counts[1:]
+	}
+	qs.Total += fair
+
+	for range ewGroups {
+		qs.Total += res.Counts[0]
+		res.Counts = res.Counts[1:]
+		newest = append(newest, nextScore())
+	}
+
 	for _, cg := range cgroups {
-		qs.ConsumerGroupStats[cg] = ConsumerGroupStats{
-			Available:  res.Counts[0],
-			InProgress: res.Counts[1],
-			Redo:       res.Counts[2],
+		cgs := ConsumerGroupStats{Available: fair}
+		for i := 0; i < len(ewAvails)+len(ewGroups); i++ {
+			cgs.Available += res.Counts[0]
+			res.Counts = res.Counts[1:]
+
+			if ptr := nextScore(); ptr > 0 && newest[i] > ptr {
+				if lag := newest[i].Time().Sub(ptr.Time()); lag > cgs.Lag {
+					cgs.Lag = lag
+				}
+			}
 		}
+		cgs.InProgress = res.Counts[0]
+		cgs.Redo = res.Counts[1]
+		cgs.Dead = res.Counts[2]
 		res.Counts = res.Counts[3:]
+
+		// Everything which isn't available has been retrieved at some point by
+		// the consumer group. Of those, whatever isn't being worked on, waiting
+		// to be worked on again, or given up on is done. The counts aren't all
+		// taken at exactly the same moment in the query, so be careful not to
+		// underflow
+		notDone := cgs.Available + cgs.InProgress + cgs.Redo + cgs.Dead
+		if notDone < qs.Total {
+			cgs.Done = qs.Total - notDone
+		}
+		qs.ConsumerGroupStats[cg] = cgs
 	}
 	return qs, nil
 }
@@ -530,20 +4626,26 @@ type QStatusCommand struct {
 // QueuesConsumerGroups may be set to specify specific queue/consumer group
 // combinations to retrieve, otherwise all known queues/consumer groups will be
 // retrieved.
-func (p *Peel) QStatus(c QStatusCommand) (map[string]QueueStats, error) {
+func (p *Peel) QStatus(ctx context.Context, c QStatusCommand) (m map[string]QueueStats, err error) {
+	ctx, end := p.start(ctx, "QStatus", "", "")
+	defer end(&err, func() int { return len(m) })
+	return p.queuesStatus(ctx, c)
+}
+
+func (p *Peel) queuesStatus(ctx context.Context, c QStatusCommand) (map[string]QueueStats, error) {
 	var qcg map[string][]string
 	var err error
 	if len(c.QueuesConsumerGroups) > 0 {
 		qcg = c.QueuesConsumerGroups
 	} else {
-		if qcg, err = p.AllQueuesConsumerGroups(); err != nil {
+		if qcg, err = p.AllQueuesConsumerGroups(ctx); err != nil {
 			return nil, err
 		}
 	}
 
 	ret := map[string]QueueStats{}
 	for q, cgs := range qcg {
-		qs, err := p.qstatus(q, cgs)
+		qs, err := p.qstatusShards(ctx, q, cgs)
 		if err != nil {
 			return nil, err
 		}
@@ -571,42 +4673,87 @@ func maxLength(oldMax int, elStr string, elInt uint64) int {
 }
 
 func cgStatsInfos(cgsm map[string]ConsumerGroupStats) []string {
-	var cgL, availL, inProgL, redoL int
+	var cgL, availL, inProgL, redoL, doneL, deadL, lagL int
 
 	for cg, cgs := range cgsm {
 		cgL = maxLength(cgL, cg, 0)
 		availL = maxLength(availL, "", cgs.Available)
 		inProgL = maxLength(inProgL, "", cgs.InProgress)
 		redoL = maxLength(redoL, "", cgs.Redo)
+		doneL = maxLength(doneL, "", cgs.Done)
+		deadL = maxLength(deadL, "", cgs.Dead)
+		lagL = maxLength(lagL, cgs.Lag.String(), 0)
 	}
 
 	fmtStr := fmt.Sprintf(
-		"consumerGroup:%%-%dq avail:%%-%dd inProg:%%-%dd redo:%%-%dd",
+		"consumerGroup:%%-%dq avail:%%-%dd inProg:%%-%dd redo:%%-%dd done:%%-%dd dead:%%-%dd lag:%%-%ds",
 		cgL,
 		availL,
 		inProgL,
 		redoL,
+		doneL,
+		deadL,
+		lagL,
 	)
 
 	var r []string
 	for cg, cgs := range cgsm {
-		r = append(r, fmt.Sprintf(fmtStr, cg, cgs.Available, cgs.InProgress, cgs.Redo))
+		r = append(r, fmt.Sprintf(fmtStr, cg, cgs.Available, cgs.InProgress, cgs.Redo, cgs.Done, cgs.Dead, cgs.Lag))
 	}
 	return r
 }
 
 // QInfo returns a human readable version of the information from QStatus. It
 // uses the same arguments.
-func (p *Peel) QInfo(c QStatusCommand) ([]string, error) {
-	m, err := p.QStatus(c)
+func (p *Peel) QInfo(ctx context.Context, c QStatusCommand) (_ []string, err error) {
+	ctx, end := p.start(ctx, "QInfo", "", "")
+	defer end(&err, nil)
+	m, err := p.queuesStatus(ctx, c)
 	if err != nil {
 		return nil, err
 	}
 
 	var r []string
 	for q, qs := range m {
-		r = append(r, fmt.Sprintf("queue:%q total:%d", q, qs.Total))
+		r = append(r, fmt.Sprintf("queue:%q total:%d delayed:%d paused:%t", q, qs.Total, qs.Delayed, qs.Paused))
 		r = append(r, cgStatsInfos(qs.ConsumerGroupStats)...)
 	}
 	return r, nil
 }
+
+// QListCommand describes the parameters which can be passed into the QList
+// command
+type QListCommand struct {
+	// Optional. If given only this queue will be listed
+	Queue string
+}
+
+// QList returns a map of all known queues to the consumer groups which have
+// state in them, each sorted alphabetically. A queue may have no consumer
+// groups, but its slice will never be nil. A queue is only known while it has
+// events or consumer groups, so one which has been flushed, or only has a
+// config, isn't listed.
+//
+// If Queue is given the map will only contain that queue, or will be empty if
+// the queue isn't known.
+func (p *Peel) QList(ctx context.Context, c QListCommand) (m map[string][]string, err error) {
+	ctx, end := p.start(ctx, "QList", c.Queue, "")
+	defer end(&err, func() int { return len(m) })
+	if c.Queue == "" {
+		m, err = p.AllQueuesConsumerGroups(ctx)
+	} else {
+		var k core.Key
+		if k, err = queueKeyMarshal(core.Key{Base: c.Queue, Subs: []string{"*"}}); err != nil {
+			return nil, err
+		}
+		m, err = p.scanQueuesConsumerGroups(ctx, k)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cgs := range m {
+		sort.Strings(cgs)
+	}
+	return m, nil
+}
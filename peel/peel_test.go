@@ -1,6 +1,9 @@
 package peel
 
 import (
+	"context"
+	"regexp"
+	"sync"
 	. "testing"
 	"time"
 
@@ -28,7 +31,10 @@ func newTestPeel() *Peel {
 	return peel
 }
 
-var testPeel = newTestPeel()
+var (
+	testPeel = newTestPeel()
+	testCtx  = context.Background()
+)
 
 func assertKey(t *T, k core.Key, ii ...core.ID) {
 	qa := core.QueryActions{
@@ -42,7 +48,7 @@ func assertKey(t *T, k core.Key, ii ...core.ID) {
 			},
 		},
 	}
-	res, err := testPeel.c.Query(qa)
+	res, err := testPeel.c.Query(testCtx, qa)
 	require.Nil(t, err)
 
 	if len(ii) == 0 {
@@ -62,7 +68,7 @@ func assertSingleKey(t *T, k core.Key, id ...core.ID) {
 			},
 		},
 	}
-	res, err := testPeel.c.Query(qa)
+	res, err := testPeel.c.Query(testCtx, qa)
 	require.Nil(t, err)
 	if len(id) == 0 {
 		assert.Empty(t, res.IDs)
@@ -75,7 +81,7 @@ func assertSingleKey(t *T, k core.Key, id ...core.ID) {
 func TestQAdd(t *T) {
 	queue := testutil.RandStr()
 	contents := testutil.RandStr()
-	id, err := testPeel.QAdd(QAddCommand{
+	id, err := testPeel.QAdd(testCtx, QAddCommand{
 		Queue:    queue,
 		Expire:   time.Now().Add(10 * time.Second),
 		Contents: contents,
@@ -88,11 +94,337 @@ func TestQAdd(t *T) {
 	assertKey(t, ewAvail.byArb, id)
 	assertKey(t, ewAvail.byExp, id)
 
-	e, err := testPeel.c.GetEvent(id)
+	e, err := testPeel.c.GetEvent(testCtx, id)
 	require.Nil(t, err)
 	assert.Equal(t, contents, e.Contents)
 }
 
+func TestQAddMulti(t *T) {
+	queue1 := testutil.RandStr()
+	queue2 := testutil.RandStr()
+	expire := time.Now().Add(10 * time.Second)
+
+	var cc []QAddCommand
+	for _, q := range []string{queue1, queue2, queue1} {
+		cc = append(cc, QAddCommand{
+			Queue:    q,
+			Expire:   expire,
+			Contents: testutil.RandStr(),
+		})
+	}
+
+	ii, err := testPeel.QAddMulti(testCtx, cc)
+	require.Nil(t, err)
+	require.Len(t, ii, 3)
+
+	ewAvail1, err := queueAvailable(queue1)
+	require.Nil(t, err)
+	assertKey(t, ewAvail1.byArb, ii[0], ii[2])
+	assertKey(t, ewAvail1.byExp, ii[0], ii[2])
+
+	ewAvail2, err := queueAvailable(queue2)
+	require.Nil(t, err)
+	assertKey(t, ewAvail2.byArb, ii[1])
+	assertKey(t, ewAvail2.byExp, ii[1])
+
+	for i, id := range ii {
+		e, err := testPeel.c.GetEvent(testCtx, id)
+		require.Nil(t, err)
+		assert.Equal(t, cc[i].Contents, e.Contents)
+	}
+
+	ii, err = testPeel.QAddMulti(testCtx, nil)
+	require.Nil(t, err)
+	assert.Empty(t, ii)
+}
+
+func TestQAddVisibleAfter(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+	expire := time.Now().Add(10 * time.Minute)
+
+	ii, err := testPeel.QAddMulti(testCtx, []QAddCommand{
+		{Queue: queue, Expire: expire, Contents: testutil.RandStr()},
+		{
+			Queue:        queue,
+			Expire:       expire,
+			Contents:     testutil.RandStr(),
+			VisibleAfter: time.Now().Add(250 * time.Millisecond),
+		},
+		{Queue: queue, Expire: expire, Contents: testutil.RandStr()},
+	})
+	require.Nil(t, err)
+
+	ewAvail, err := queueAvailable(queue)
+	require.Nil(t, err)
+	ewDelayed, err := queueDelayed(queue)
+	require.Nil(t, err)
+	assertKey(t, ewAvail.byArb, ii[0], ii[2])
+	assertKey(t, ewDelayed.byArb, ii[1])
+	assertKey(t, ewDelayed.byExp, ii[1])
+
+	qsm, err := testPeel.QStatus(testCtx, QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: nil},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(2), qsm[queue].Total)
+	assert.Equal(t, uint64(1), qsm[queue].Delayed)
+
+	cmd := QGetCommand{Queue: queue, ConsumerGroup: cgroup}
+	assertQGet := func(id core.ID) {
+		e, err := testPeel.QGet(testCtx, cmd)
+		require.Nil(t, err)
+		assert.Equal(t, id, e.ID)
+	}
+
+	assertQGet(ii[0])
+	assertQGet(ii[2])
+	assertQGet(core.ID{})
+
+	// Even though the consumer group has moved past the delayed event's ID, it
+	// should still get it once it's visible
+	time.Sleep(300 * time.Millisecond)
+	assertQGet(ii[1])
+	assertQGet(core.ID{})
+	assertKey(t, ewAvail.byArb, ii[0], ii[1], ii[2])
+	assertKey(t, ewDelayed.byArb)
+	assertKey(t, ewDelayed.byExp)
+}
+
+func TestQAddPriority(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+	expire := time.Now().Add(10 * time.Minute)
+
+	ii, err := testPeel.QAddMulti(testCtx, []QAddCommand{
+		{Queue: queue, Expire: expire, Contents: testutil.RandStr()},
+		{Queue: queue, Expire: expire, Contents: testutil.RandStr(), Priority: 5},
+		{Queue: queue, Expire: expire, Contents: testutil.RandStr()},
+		{Queue: queue, Expire: expire, Contents: testutil.RandStr(), Priority: MaxPriority},
+		{Queue: queue, Expire: expire, Contents: testutil.RandStr(), Priority: 5},
+	})
+	require.Nil(t, err)
+
+	ewAvails, err := queueAvailableBands(queue)
+	require.Nil(t, err)
+	assertKey(t, ewAvails[0].byArb, ii[0], ii[2])
+	assertKey(t, ewAvails[5].byArb, ii[1], ii[4])
+	assertKey(t, ewAvails[MaxPriority].byArb, ii[3])
+
+	qsm, err := testPeel.QStatus(testCtx, QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: {cgroup}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(5), qsm[queue].Total)
+	assert.Equal(t, uint64(5), qsm[queue].ConsumerGroupStats[cgroup].Available)
+
+	cmd := QGetCommand{Queue: queue, ConsumerGroup: cgroup}
+	assertQGet := func(id core.ID) {
+		e, err := testPeel.QGet(testCtx, cmd)
+		require.Nil(t, err)
+		assert.Equal(t, id, e.ID)
+	}
+
+	assertQGet(ii[3])
+	assertQGet(ii[1])
+
+	// A new high priority event jumps ahead of everything still available
+	id, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   expire,
+		Contents: testutil.RandStr(),
+		Priority: MaxPriority,
+	})
+	require.Nil(t, err)
+	assertQGet(id)
+
+	assertQGet(ii[4])
+	assertQGet(ii[0])
+	assertQGet(ii[2])
+	assertQGet(core.ID{})
+
+	_, err = testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   expire,
+		Contents: testutil.RandStr(),
+		Priority: MaxPriority + 1,
+	})
+	assert.NotNil(t, err)
+}
+
+func TestQAddDedup(t *T) {
+	queue := testutil.RandStr()
+	dedupKey := testutil.RandStr()
+	expire := time.Now().Add(10 * time.Minute)
+
+	id, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   expire,
+		Contents: testutil.RandStr(),
+		DedupKey: dedupKey,
+	})
+	require.Nil(t, err)
+
+	ii, err := testPeel.QAddMulti(testCtx, []QAddCommand{
+		{Queue: queue, Expire: expire, Contents: testutil.RandStr(), DedupKey: dedupKey},
+		{Queue: queue, Expire: expire, Contents: testutil.RandStr()},
+		{Queue: queue, Expire: expire, Contents: testutil.RandStr(), DedupKey: "other"},
+		{Queue: queue, Expire: expire, Contents: testutil.RandStr(), DedupKey: "other"},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, id, ii[0])
+	assert.Equal(t, ii[2], ii[3])
+
+	ewAvail, err := queueAvailable(queue)
+	require.Nil(t, err)
+	assertKey(t, ewAvail.byArb, id, ii[1], ii[2])
+
+	// The same DedupKey in a different queue is unrelated
+	queue2 := testutil.RandStr()
+	id2, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue2,
+		Expire:   expire,
+		Contents: testutil.RandStr(),
+		DedupKey: dedupKey,
+	})
+	require.Nil(t, err)
+	assert.NotEqual(t, id, id2)
+
+	// dedup keys shouldn't be mistaken for consumer groups
+	m, err := testPeel.QList(testCtx, QListCommand{Queue: queue})
+	require.Nil(t, err)
+	assert.Empty(t, m[queue])
+}
+
+func TestQAddPadding(t *T) {
+	queue := testutil.RandStr()
+	qadd := func(expire time.Time, padding time.Duration) (core.ID, error) {
+		return testPeel.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   expire,
+			Contents: testutil.RandStr(),
+			Padding:  padding,
+		})
+	}
+
+	// The default padding keeps the contents around for 30 seconds after the
+	// event expires
+	id, err := qadd(time.Now().Add(-10*time.Second), 0)
+	require.Nil(t, err)
+	_, err = testPeel.c.GetEvent(testCtx, id)
+	assert.Nil(t, err)
+
+	id, err = qadd(time.Now().Add(-1*time.Minute), 0)
+	require.Nil(t, err)
+	_, err = testPeel.c.GetEvent(testCtx, id)
+	assert.Equal(t, core.ErrNotFound, err)
+
+	// Unless it's overridden
+	id, err = qadd(time.Now().Add(-1*time.Minute), 2*time.Minute)
+	require.Nil(t, err)
+	_, err = testPeel.c.GetEvent(testCtx, id)
+	assert.Nil(t, err)
+
+	_, err = qadd(time.Now().Add(1*time.Minute), -1*time.Second)
+	assert.NotNil(t, err)
+}
+
+func TestQAddBinary(t *T) {
+	queue := testutil.RandStr()
+	b := make([]byte, 256)
+	for i := range b {
+		b[i] = byte(i)
+	}
+
+	id, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(1 * time.Minute),
+		Contents: string(b),
+	})
+	require.Nil(t, err)
+
+	e, err := testPeel.QGet(testCtx, QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: testutil.RandStr(),
+	})
+	require.Nil(t, err)
+	assert.Equal(t, id, e.ID)
+	assert.Equal(t, b, []byte(e.Contents))
+}
+
+func TestQAddMaxContentsSize(t *T) {
+	p := NewWithBackend(core.NewMemBackend(), &Opts{MaxContentsSize: 4})
+	p.Run(nil)
+	queue := testutil.RandStr()
+	qadd := func(contents string) error {
+		_, err := p.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(1 * time.Minute),
+			Contents: contents,
+		})
+		return err
+	}
+
+	assert.Nil(t, qadd("foo"))
+	assert.Nil(t, qadd("fooo"))
+	assert.Equal(t, ErrContentsTooLarge, qadd("foooo"))
+
+	err := p.AddSchedule(Schedule{
+		Name:     testutil.RandStr(),
+		Queue:    queue,
+		Cron:     "@hourly",
+		Contents: "foooo",
+		Expire:   1 * time.Minute,
+	})
+	assert.Equal(t, ErrContentsTooLarge, err)
+}
+
+func TestQReply(t *T) {
+	queue := testutil.RandStr()
+	replyQueue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+	expire := time.Now().Add(10 * time.Minute)
+
+	id, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   expire,
+		Contents: testutil.RandStr(),
+		ReplyTo:  replyQueue,
+	})
+	require.Nil(t, err)
+
+	e, err := testPeel.QGet(testCtx, QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, id, e.ID)
+	assert.Equal(t, replyQueue, e.ReplyTo)
+
+	contents := testutil.RandStr()
+	replyID, err := testPeel.QReply(testCtx, QReplyCommand{
+		EventID:  e.ID,
+		Expire:   expire,
+		Contents: contents,
+	})
+	require.Nil(t, err)
+
+	reply, err := testPeel.QGet(testCtx, QGetCommand{
+		Queue:         replyQueue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{ID: replyID, Contents: contents, InReplyTo: id}, reply)
+
+	// The reply itself has nowhere to be replied to
+	_, err = testPeel.QReply(testCtx, QReplyCommand{
+		EventID:  reply.ID,
+		Expire:   expire,
+		Contents: contents,
+	})
+	assert.Equal(t, ErrNoReplyTo, err)
+}
+
 // score is optional
 func requireAddToKey(t *T, k core.Key, id core.ID, score core.TS) {
 	qa := core.QueryActions{
@@ -111,7 +443,7 @@ func requireAddToKey(t *T, k core.Key, id core.ID, score core.TS) {
 			},
 		},
 	}
-	_, err := testPeel.c.Query(qa)
+	_, err := testPeel.c.Query(testCtx, qa)
 	require.Nil(t, err)
 }
 
@@ -131,7 +463,7 @@ func requireSetSingleKey(t *T, k core.Key, id core.ID) {
 			},
 		},
 	}
-	_, err := testPeel.c.Query(qa)
+	_, err := testPeel.c.Query(testCtx, qa)
 	require.Nil(t, err)
 }
 
@@ -139,7 +471,7 @@ func newTestQueue(t *T, numIDs int) (string, []core.ID) {
 	queue := testutil.RandStr()
 	var ii []core.ID
 	for i := 0; i < numIDs; i++ {
-		id, err := testPeel.QAdd(QAddCommand{
+		id, err := testPeel.QAdd(testCtx, QAddCommand{
 			Queue:    queue,
 			Expire:   time.Now().Add(10 * time.Minute),
 			Contents: testutil.RandStr(),
@@ -160,7 +492,7 @@ func randID(t *T, expired bool) core.ID {
 	} else {
 		expireTS = core.NewTS(now.Add(10 * time.Second))
 	}
-	e, err := testPeel.c.NewEvent(nowTS, expireTS, "")
+	e, err := testPeel.c.NewEvent(testCtx, nowTS, expireTS, "")
 	require.Nil(t, err)
 	return e.ID
 }
@@ -182,7 +514,7 @@ func TestQGet(t *T) {
 		ConsumerGroup: cgroup,
 		AckDeadline:   time.Now().Add(1 * time.Second),
 	}
-	e, err := testPeel.QGet(cmd)
+	e, err := testPeel.QGet(testCtx, cmd)
 	require.Nil(t, err)
 	assert.Equal(t, ii[0], e.ID)
 	assertKey(t, ewInProg.byArb, ii[0])
@@ -192,7 +524,7 @@ func TestQGet(t *T) {
 	assertSingleKey(t, keyPtr, ii[0])
 
 	// Test that a queue with an inProg returns one after inProg
-	e, err = testPeel.QGet(cmd)
+	e, err = testPeel.QGet(testCtx, cmd)
 	require.Nil(t, err)
 	assert.Equal(t, ii[1], e.ID)
 	assertKey(t, ewInProg.byArb, ii[0], ii[1])
@@ -203,7 +535,7 @@ func TestQGet(t *T) {
 
 	// Test that empty expire doesn't go to inProg
 	cmd.AckDeadline = time.Time{}
-	e, err = testPeel.QGet(cmd)
+	e, err = testPeel.QGet(testCtx, cmd)
 	require.Nil(t, err)
 	assert.Equal(t, ii[2], e.ID)
 	assertKey(t, ewInProg.byArb, ii[0], ii[1])
@@ -214,7 +546,7 @@ func TestQGet(t *T) {
 
 	// Test that a queue with pointer ahead of all events in inProg returns the
 	// next one correctly
-	e, err = testPeel.QGet(cmd)
+	e, err = testPeel.QGet(testCtx, cmd)
 	require.Nil(t, err)
 	assert.Equal(t, ii[3], e.ID)
 	assertKey(t, ewInProg.byArb, ii[0], ii[1])
@@ -232,7 +564,7 @@ func TestQGet(t *T) {
 	// because we did this artificially
 
 	// Get first redo
-	e, err = testPeel.QGet(cmd)
+	e, err = testPeel.QGet(testCtx, cmd)
 	require.Nil(t, err)
 	assert.Equal(t, ii[4], e.ID)
 	assertKey(t, ewInProg.byArb, ii[0], ii[1])
@@ -242,7 +574,7 @@ func TestQGet(t *T) {
 	assertSingleKey(t, keyPtr, ii[4])
 
 	// Get second redo
-	e, err = testPeel.QGet(cmd)
+	e, err = testPeel.QGet(testCtx, cmd)
 	require.Nil(t, err)
 	assert.Equal(t, ii[5], e.ID)
 	assertKey(t, ewInProg.byArb, ii[0], ii[1])
@@ -253,7 +585,7 @@ func TestQGet(t *T) {
 
 	// At this point the queue has no available events, make sure empty event is
 	// returned
-	e, err = testPeel.QGet(cmd)
+	e, err = testPeel.QGet(testCtx, cmd)
 	require.Nil(t, err)
 	assert.Equal(t, core.Event{}, e)
 	assertKey(t, ewInProg.byArb, ii[0], ii[1])
@@ -267,14 +599,14 @@ func TestQGet(t *T) {
 	// back
 	contents := testutil.RandStr()
 	expire := ii[5].Expire.Time().Add(-5 * time.Second)
-	id, err := testPeel.QAdd(QAddCommand{
+	id, err := testPeel.QAdd(testCtx, QAddCommand{
 		Queue:    queue,
 		Expire:   expire,
 		Contents: contents,
 	})
 	require.Nil(t, err)
 
-	e, err = testPeel.QGet(cmd)
+	e, err = testPeel.QGet(testCtx, cmd)
 	require.Nil(t, err)
 	assert.Equal(t, core.Event{ID: id, Contents: contents}, e)
 	assertKey(t, ewInProg.byArb, ii[0], ii[1])
@@ -285,13 +617,13 @@ func TestQGet(t *T) {
 
 	// Add an expired event, make sure it doesn't come back (since avail should
 	// get cleaned by QGet)
-	_, err = testPeel.QAdd(QAddCommand{
+	_, err = testPeel.QAdd(testCtx, QAddCommand{
 		Queue:    queue,
 		Expire:   time.Now().Add(-5 * time.Minute),
 		Contents: testutil.RandStr(),
 	})
 	require.Nil(t, err)
-	e, err = testPeel.QGet(cmd)
+	e, err = testPeel.QGet(testCtx, cmd)
 	require.Nil(t, err)
 	assert.Equal(t, core.Event{}, e)
 	assertKey(t, ewInProg.byArb, ii[0], ii[1])
@@ -305,7 +637,7 @@ func TestQGet(t *T) {
 	exRedo := randID(t, true)
 	requireAddToKey(t, ewRedo.byArb, exRedo, 0)
 	requireAddToKey(t, ewRedo.byExp, exRedo, exRedo.Expire)
-	e, err = testPeel.QGet(cmd)
+	e, err = testPeel.QGet(testCtx, cmd)
 	require.Nil(t, err)
 	assert.Equal(t, core.Event{}, e)
 	assertKey(t, ewInProg.byArb, ii[0], ii[1])
@@ -315,6 +647,108 @@ func TestQGet(t *T) {
 	assertSingleKey(t, keyPtr, id)
 }
 
+func TestQGetMulti(t *T) {
+	queue, ii := newTestQueue(t, 5)
+	cgroup := testutil.RandStr()
+
+	ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(queue, cgroup)
+	require.Nil(t, err)
+
+	cmd := QGetMultiCommand{
+		QGetCommand: QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   time.Now().Add(1 * time.Minute),
+		},
+		Count: 2,
+	}
+
+	assertIDs := func(ee []core.Event, ii ...core.ID) {
+		eii := make([]core.ID, len(ee))
+		for i := range ee {
+			eii[i] = ee[i].ID
+		}
+		assert.Equal(t, ii, eii)
+	}
+
+	// A blank queue gives us its first events
+	ee, err := testPeel.QGetMulti(testCtx, cmd)
+	require.Nil(t, err)
+	assertIDs(ee, ii[0], ii[1])
+	assertKey(t, ewInProg.byArb, ii[0], ii[1])
+	assertKey(t, ewInProg.byExp, ii[0], ii[1])
+	assertSingleKey(t, keyPtr, ii[1])
+
+	// Events in redo get returned on their own
+	requireAddToKey(t, ewRedo.byArb, ii[0], 0)
+	requireAddToKey(t, ewRedo.byExp, ii[0], ii[0].Expire)
+	ee, err = testPeel.QGetMulti(testCtx, cmd)
+	require.Nil(t, err)
+	assertIDs(ee, ii[0])
+	assertKey(t, ewRedo.byArb)
+	assertSingleKey(t, keyPtr, ii[1])
+
+	// Asking for more than are available gives what's left
+	cmd.Count = 5
+	ee, err = testPeel.QGetMulti(testCtx, cmd)
+	require.Nil(t, err)
+	assertIDs(ee, ii[2], ii[3], ii[4])
+	assertKey(t, ewInProg.byArb, ii[0], ii[1], ii[2], ii[3], ii[4])
+	assertSingleKey(t, keyPtr, ii[4])
+
+	ee, err = testPeel.QGetMulti(testCtx, cmd)
+	require.Nil(t, err)
+	assert.Empty(t, ee)
+
+	cmd.Count = 0
+	_, err = testPeel.QGetMulti(testCtx, cmd)
+	assert.NotNil(t, err)
+}
+
+func TestQGetConcurrent(t *T) {
+	queue, ii := newTestQueue(t, 20)
+	cgroup := testutil.RandStr()
+
+	cmd := QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(1 * time.Minute),
+	}
+
+	// Many consumers retrieve from the queue at once, between them every event
+	// should be retrieved exactly once
+	const consumers = 5
+	ch := make(chan core.ID)
+	doneCh := make(chan struct{})
+	for i := 0; i < consumers; i++ {
+		go func() {
+			defer func() { doneCh <- struct{}{} }()
+			for {
+				e, err := testPeel.QGet(testCtx, cmd)
+				if !assert.Nil(t, err) || e.ID == (core.ID{}) {
+					return
+				}
+				ch <- e.ID
+			}
+		}()
+	}
+
+	got := map[core.ID]int{}
+	for done := 0; done < consumers; {
+		select {
+		case id := <-ch:
+			got[id]++
+		case <-doneCh:
+			done++
+		}
+	}
+
+	assert.Len(t, got, len(ii))
+	for _, id := range ii {
+		assert.Equal(t, 1, got[id], "id: %v", id)
+	}
+}
+
 func TestQGetBlocking(t *T) {
 	queue, ii := newTestQueue(t, 1)
 	cgroup := testutil.RandStr()
@@ -328,7 +762,7 @@ func TestQGetBlocking(t *T) {
 	assertBlockFor := func(d time.Duration) core.Event {
 		ch := make(chan core.Event)
 		go func() {
-			e, err := testPeel.QGet(cmd)
+			e, err := testPeel.QGet(testCtx, cmd)
 			require.Nil(t, err)
 			ch <- e
 		}()
@@ -362,7 +796,7 @@ func TestQGetBlocking(t *T) {
 		time.Sleep(500 * time.Millisecond)
 		contents := testutil.RandStr()
 		expire := core.NewTS(time.Now().Add(10 * time.Minute))
-		id, err := testPeel.QAdd(QAddCommand{
+		id, err := testPeel.QAdd(testCtx, QAddCommand{
 			Queue:    queue,
 			Expire:   expire.Time(),
 			Contents: contents,
@@ -373,56 +807,1577 @@ func TestQGetBlocking(t *T) {
 	e = assertBlockFor(500 * time.Millisecond)
 	e2 := <-e2ch
 	assert.Equal(t, e2, e)
+
+	// Block should behave the same as BlockUntil, relative to when QGet is
+	// called
+	cmd.BlockUntil = time.Time{}
+	cmd.Block = 500 * time.Millisecond
+	e = assertBlockFor(500 * time.Millisecond)
+	assert.Equal(t, core.Event{}, e)
 }
 
-func TestQAck(t *T) {
-	queue, ii := newTestQueue(t, 2)
+func TestQGetAckTimeout(t *T) {
+	queue := testutil.RandStr()
 	cgroup := testutil.RandStr()
 
-	ewInProg, _, _, err := queueCGroupKeys(queue, cgroup)
-	require.Nil(t, err)
-
-	ackDeadline := core.NewTS(ii[0].T.Time().Add(10 * time.Millisecond))
-	requireAddToKey(t, ewInProg.byArb, ii[0], ackDeadline)
-	requireAddToKey(t, ewInProg.byExp, ii[0], ii[0].Expire)
-
-	cmd := QAckCommand{
+	// The deadline starts once the event is retrieved, not when QGet is called
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		_, err := testPeel.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(10 * time.Minute),
+			Contents: testutil.RandStr(),
+		})
+		require.Nil(t, err)
+	}()
+	e, err := testPeel.QGet(testCtx, QGetCommand{
 		Queue:         queue,
 		ConsumerGroup: cgroup,
-		EventID:       ii[0],
-	}
-	acked, err := testPeel.QAck(cmd)
+		AckTimeout:    time.Second,
+		Block:         5 * time.Second,
+	})
 	require.Nil(t, err)
-	assert.True(t, acked)
-	assertKey(t, ewInProg.byArb)
-	assertKey(t, ewInProg.byExp)
+	require.NotEqual(t, core.Event{}, e)
+	assert.NotEmpty(t, e.DeliveryToken)
 
-	acked, err = testPeel.QAck(cmd)
+	pp, err := testPeel.QPendingList(testCtx, QPendingListCommand{Queue: queue, ConsumerGroup: cgroup})
 	require.Nil(t, err)
-	assert.False(t, acked)
-	assertKey(t, ewInProg.byArb)
-	assertKey(t, ewInProg.byExp)
+	require.Len(t, pp, 1)
+	assert.WithinDuration(t, time.Now().Add(time.Second), pp[0].AckDeadline, 100*time.Millisecond)
+}
 
-	ackDeadline = core.NewTS(ii[1].T.Time().Add(-10 * time.Millisecond))
-	requireAddToKey(t, ewInProg.byArb, ii[1], ackDeadline)
-	requireAddToKey(t, ewInProg.byExp, ii[1], ii[1].Expire)
+func TestQGetContext(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
 
-	cmd.EventID = ii[1]
-	acked, err = testPeel.QAck(cmd)
+	// A blocking QGet returns ctx's error once its deadline is reached, even
+	// though BlockUntil hasn't been
+	ctx, cancel := context.WithTimeout(testCtx, 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := testPeel.QGet(ctx, QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		Block:         10 * time.Second,
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < 1*time.Second)
+
+	// Once ctx is done nothing else is done either
+	_, err = testPeel.QAdd(ctx, QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(10 * time.Minute),
+		Contents: testutil.RandStr(),
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	ewAvail, err := queueAvailable(queue)
 	require.Nil(t, err)
-	assert.False(t, acked)
-	assertKey(t, ewInProg.byArb, ii[1])
-	assertKey(t, ewInProg.byExp, ii[1])
+	assertKey(t, ewAvail.byArb)
 }
 
-func TestClean(t *T) {
-	queue, ii := newTestQueue(t, 6)
+func TestQGetBlockDelayed(t *T) {
+	queue := testutil.RandStr()
 	cgroup := testutil.RandStr()
-	now := time.Now()
 
-	for i, id := range ii {
-		t.Logf("ii[%d]: %d (%#v)", i, id, id)
-	}
+	// A blocking QGet wakes up as soon as a delayed event becomes visible,
+	// even though nothing is added to the queue then
+	id, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:        queue,
+		Expire:       time.Now().Add(10 * time.Minute),
+		Contents:     testutil.RandStr(),
+		VisibleAfter: time.Now().Add(300 * time.Millisecond),
+	})
+	require.Nil(t, err)
+
+	start := time.Now()
+	e, err := testPeel.QGet(testCtx, QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		Block:         10 * time.Second,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, id, e.ID)
+	assert.True(t, time.Since(start) < 1*time.Second)
+
+	// The same goes for a delayed event added while the QGet is blocking
+	idCh := make(chan core.ID, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		id, err := testPeel.QAdd(testCtx, QAddCommand{
+			Queue:        queue,
+			Expire:       time.Now().Add(10 * time.Minute),
+			Contents:     testutil.RandStr(),
+			VisibleAfter: time.Now().Add(200 * time.Millisecond),
+		})
+		require.Nil(t, err)
+		idCh <- id
+	}()
+	start = time.Now()
+	e, err = testPeel.QGet(testCtx, QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		Block:         10 * time.Second,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, <-idCh, e.ID)
+	assert.True(t, time.Since(start) < 1*time.Second)
+}
+
+func TestQGetGroups(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+
+	// The two groups mustn't share a group set
+	groupA, groupB := testutil.RandStr(), testutil.RandStr()
+	for groupBucket(groupA, defaultGroupBuckets) == groupBucket(groupB, defaultGroupBuckets) {
+		groupB = testutil.RandStr()
+	}
+
+	qadd := func(groupID string) core.ID {
+		id, err := testPeel.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(10 * time.Minute),
+			Contents: testutil.RandStr(),
+			GroupID:  groupID,
+		})
+		require.Nil(t, err)
+		return id
+	}
+
+	_, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(10 * time.Minute),
+		Contents: testutil.RandStr(),
+		GroupID:  groupA,
+	})
+	assert.Equal(t, ErrNotGrouped, err)
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       queue,
+		QueueConfig: QueueConfig{Grouped: true},
+	}))
+
+	_, err = testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(10 * time.Minute),
+		Contents: testutil.RandStr(),
+		GroupID:  groupA,
+		Priority: 1,
+	})
+	assert.NotNil(t, err)
+
+	plainID := qadd("")
+	a1, a2, b1 := qadd(groupA), qadd(groupA), qadd(groupB)
+
+	qget := func(cgroup string) core.Event {
+		e, err := testPeel.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   time.Now().Add(time.Minute),
+		})
+		require.Nil(t, err)
+		return e
+	}
+	qack := func(id core.ID) {
+		ok, err := testPeel.QAck(testCtx, QAckCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			EventID:       id,
+		})
+		require.Nil(t, err)
+		assert.True(t, ok)
+	}
+
+	// Grouped events come first, but only one per group until it's done
+	got := []core.ID{qget(cgroup).ID, qget(cgroup).ID}
+	assert.Contains(t, got, a1)
+	assert.Contains(t, got, b1)
+	assert.Equal(t, plainID, qget(cgroup).ID)
+	assert.Equal(t, core.Event{}, qget(cgroup))
+
+	// Other consumer groups aren't held up
+	assert.Contains(t, []core.ID{a1, b1}, qget(testutil.RandStr()).ID)
+
+	// A nack'd event is retried before the rest of its group
+	ok, err := testPeel.QNack(testCtx, QNackCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       a1,
+	})
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, a1, qget(cgroup).ID)
+	assert.Equal(t, core.Event{}, qget(cgroup))
+
+	qack(a1)
+	assert.Equal(t, a2, qget(cgroup).ID)
+
+	// A blocking QGet is woken up once the event holding up its group is
+	// acked
+	a3 := qadd(groupA)
+	doneCh := make(chan core.Event)
+	go func() {
+		e, err := testPeel.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			Block:         5 * time.Second,
+		})
+		require.Nil(t, err)
+		doneCh <- e
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	qack(a2)
+	assert.Equal(t, a3, (<-doneCh).ID)
+	assert.True(t, time.Since(start) < 1*time.Second)
+
+	qsm, err := testPeel.QStatus(testCtx, QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: {cgroup}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(5), qsm[queue].Total)
+	assert.Equal(t, ConsumerGroupStats{InProgress: 2, Done: 3}, qsm[queue].ConsumerGroupStats[cgroup])
+}
+
+func TestQGetGroupBuckets(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+
+	// The two groups share a bucket when there's two of them, but not when
+	// there's the most
+	groupA, groupB := testutil.RandStr(), testutil.RandStr()
+	for groupBucket(groupA, 2) != groupBucket(groupB, 2) ||
+		groupBucket(groupA, maxGroupBuckets) == groupBucket(groupB, maxGroupBuckets) {
+		groupB = testutil.RandStr()
+	}
+
+	setBuckets := func(buckets int) error {
+		return testPeel.QSetConfig(testCtx, QSetConfigCommand{
+			Queue:       queue,
+			QueueConfig: QueueConfig{Grouped: true, GroupBuckets: buckets},
+		})
+	}
+	assert.NotNil(t, setBuckets(-1))
+	assert.NotNil(t, setBuckets(maxGroupBuckets+1))
+	require.Nil(t, setBuckets(2))
+
+	qadd := func(groupID string) core.ID {
+		id, err := testPeel.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(10 * time.Minute),
+			Contents: testutil.RandStr(),
+			GroupID:  groupID,
+		})
+		require.Nil(t, err)
+		return id
+	}
+	qget := func() core.Event {
+		e, err := testPeel.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   time.Now().Add(time.Minute),
+		})
+		require.Nil(t, err)
+		return e
+	}
+	qack := func(id core.ID) {
+		ok, err := testPeel.QAck(testCtx, QAckCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			EventID:       id,
+		})
+		require.Nil(t, err)
+		assert.True(t, ok)
+	}
+
+	// Colliding groups hold each other back as if they were the same group
+	a1, b1 := qadd(groupA), qadd(groupB)
+	assert.Equal(t, a1, qget().ID)
+	assert.Equal(t, core.Event{}, qget())
+
+	// The number of buckets can't be changed while there's grouped events
+	assert.NotNil(t, setBuckets(maxGroupBuckets))
+
+	// Which includes ones which have been acked, until they expire
+	qack(a1)
+	assert.Equal(t, b1, qget().ID)
+	qack(b1)
+	assert.NotNil(t, setBuckets(maxGroupBuckets))
+
+	// With enough buckets they don't collide anymore
+	require.Nil(t, testPeel.QFlush(testCtx, QFlushCommand{Queue: queue}))
+	require.Nil(t, setBuckets(maxGroupBuckets))
+	a2, b2 := qadd(groupA), qadd(groupB)
+	got := []core.ID{qget().ID, qget().ID}
+	assert.Contains(t, got, a2)
+	assert.Contains(t, got, b2)
+}
+
+func TestQPeek(t *T) {
+	queue, ii := newTestQueue(t, 2)
+	cgroup := testutil.RandStr()
+
+	ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(queue, cgroup)
+	require.Nil(t, err)
+
+	peekCmd := QPeekCommand{Queue: queue, ConsumerGroup: cgroup}
+	getCmd := QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(1 * time.Minute),
+	}
+
+	// Peeking multiple times should always give the same event, and not touch
+	// any of the consumer group's state
+	for i := 0; i < 2; i++ {
+		e, err := testPeel.QPeek(testCtx, peekCmd)
+		require.Nil(t, err)
+		assert.Equal(t, ii[0], e.ID)
+		assertKey(t, ewInProg.byArb)
+		assertSingleKey(t, keyPtr)
+	}
+
+	e, err := testPeel.QGet(testCtx, getCmd)
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e.ID)
+
+	e, err = testPeel.QPeek(testCtx, peekCmd)
+	require.Nil(t, err)
+	assert.Equal(t, ii[1], e.ID)
+	assertKey(t, ewInProg.byArb, ii[0])
+	assertSingleKey(t, keyPtr, ii[0])
+
+	// Events in redo should be peeked first, but left in redo
+	requireAddToKey(t, ewRedo.byArb, ii[0], 0)
+	requireAddToKey(t, ewRedo.byExp, ii[0], ii[0].Expire)
+	e, err = testPeel.QPeek(testCtx, peekCmd)
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e.ID)
+	assertKey(t, ewRedo.byArb, ii[0])
+	assertKey(t, ewRedo.byExp, ii[0])
+
+	// Once everything's consumed there's nothing to peek
+	getCmd.AckDeadline = time.Time{}
+	for i := 0; i < 2; i++ {
+		_, err = testPeel.QGet(testCtx, getCmd)
+		require.Nil(t, err)
+	}
+	e, err = testPeel.QPeek(testCtx, peekCmd)
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{}, e)
+}
+
+func TestQAck(t *T) {
+	queue, ii := newTestQueue(t, 2)
+	cgroup := testutil.RandStr()
+
+	ewInProg, _, _, err := queueCGroupKeys(queue, cgroup)
+	require.Nil(t, err)
+
+	ackDeadline := core.NewTS(ii[0].T.Time().Add(10 * time.Millisecond))
+	requireAddToKey(t, ewInProg.byArb, ii[0], ackDeadline)
+	requireAddToKey(t, ewInProg.byExp, ii[0], ii[0].Expire)
+
+	cmd := QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+	}
+	acked, err := testPeel.QAck(testCtx, cmd)
+	require.Nil(t, err)
+	assert.True(t, acked)
+	assertKey(t, ewInProg.byArb)
+	assertKey(t, ewInProg.byExp)
+
+	acked, err = testPeel.QAck(testCtx, cmd)
+	require.Nil(t, err)
+	assert.False(t, acked)
+	assertKey(t, ewInProg.byArb)
+	assertKey(t, ewInProg.byExp)
+
+	ackDeadline = core.NewTS(ii[1].T.Time().Add(-10 * time.Millisecond))
+	requireAddToKey(t, ewInProg.byArb, ii[1], ackDeadline)
+	requireAddToKey(t, ewInProg.byExp, ii[1], ii[1].Expire)
+
+	cmd.EventID = ii[1]
+	acked, err = testPeel.QAck(testCtx, cmd)
+	require.Nil(t, err)
+	assert.False(t, acked)
+	assertKey(t, ewInProg.byArb, ii[1])
+	assertKey(t, ewInProg.byExp, ii[1])
+}
+
+func TestQAckResult(t *T) {
+	queue, ii := newTestQueue(t, 2)
+	cgroup := testutil.RandStr()
+
+	for range ii {
+		_, err := testPeel.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   time.Now().Add(1 * time.Minute),
+		})
+		require.Nil(t, err)
+	}
+
+	assertResult := func(id core.ID, expectRes string, expectOK bool) {
+		res, ok, err := testPeel.QResult(testCtx, QResultCommand{
+			Queue:   queue,
+			EventID: id,
+		})
+		require.Nil(t, err)
+		assert.Equal(t, expectOK, ok)
+		assert.Equal(t, expectRes, res)
+	}
+
+	assertResult(ii[0], "", false)
+
+	result := testutil.RandStr()
+	acked, err := testPeel.QAck(testCtx, QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+		Result:        result,
+		ResultTTL:     500 * time.Millisecond,
+	})
+	require.Nil(t, err)
+	assert.True(t, acked)
+	assertResult(ii[0], result, true)
+
+	// A failed ack doesn't store its result
+	acked, err = testPeel.QAck(testCtx, QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+		Result:        testutil.RandStr(),
+	})
+	require.Nil(t, err)
+	assert.False(t, acked)
+	assertResult(ii[0], result, true)
+
+	time.Sleep(600 * time.Millisecond)
+	assertResult(ii[0], "", false)
+
+	// Blocking for a result
+	result = testutil.RandStr()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_, err := testPeel.QAck(testCtx, QAckCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			EventID:       ii[1],
+			Result:        result,
+		})
+		require.Nil(t, err)
+	}()
+	res, ok, err := testPeel.QResult(testCtx, QResultCommand{
+		Queue:   queue,
+		EventID: ii[1],
+		Block:   1 * time.Second,
+	})
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, result, res)
+}
+
+func TestQAckMulti(t *T) {
+	queue, ii := newTestQueue(t, 3)
+	cgroup := testutil.RandStr()
+
+	ewInProg, _, _, err := queueCGroupKeys(queue, cgroup)
+	require.Nil(t, err)
+
+	// ii[0] and ii[1] are in progress, but ii[1] has missed its deadline. ii[2]
+	// was never retrieved
+	ackDeadline := core.NewTS(time.Now().Add(1 * time.Minute))
+	requireAddToKey(t, ewInProg.byArb, ii[0], ackDeadline)
+	requireAddToKey(t, ewInProg.byExp, ii[0], ii[0].Expire)
+	missedDeadline := core.NewTS(time.Now().Add(-10 * time.Millisecond))
+	requireAddToKey(t, ewInProg.byArb, ii[1], missedDeadline)
+	requireAddToKey(t, ewInProg.byExp, ii[1], ii[1].Expire)
+
+	cmd := QAckMultiCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventIDs:      []core.ID{ii[2], ii[1], ii[0]},
+	}
+	acked, err := testPeel.QAckMulti(testCtx, cmd)
+	require.Nil(t, err)
+	assert.Equal(t, []bool{false, false, true}, acked)
+	assertKey(t, ewInProg.byArb, ii[1])
+	assertKey(t, ewInProg.byExp, ii[1])
+
+	cmd.EventIDs = nil
+	acked, err = testPeel.QAckMulti(testCtx, cmd)
+	require.Nil(t, err)
+	assert.Empty(t, acked)
+}
+
+func TestQExtend(t *T) {
+	queue, ii := newTestQueue(t, 2)
+	cgroup := testutil.RandStr()
+
+	ewInProg, ewRedo, _, err := queueCGroupKeys(queue, cgroup)
+	require.Nil(t, err)
+
+	ackDeadline := core.NewTS(time.Now().Add(50 * time.Millisecond))
+	requireAddToKey(t, ewInProg.byArb, ii[0], ackDeadline)
+	requireAddToKey(t, ewInProg.byExp, ii[0], ii[0].Expire)
+
+	cmd := QExtendCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+		AckDeadline:   time.Now().Add(1 * time.Minute),
+	}
+	extended, err := testPeel.QExtend(testCtx, cmd)
+	require.Nil(t, err)
+	assert.True(t, extended)
+	assertKey(t, ewInProg.byArb, ii[0])
+	assertKey(t, ewInProg.byExp, ii[0])
+
+	// Once the original deadline has passed a Clean shouldn't move the event to
+	// redo, and it should still be ack-able
+	time.Sleep(100 * time.Millisecond)
+	require.Nil(t, testPeel.Clean(testCtx, queue, cgroup))
+	assertKey(t, ewInProg.byArb, ii[0])
+	assertKey(t, ewRedo.byArb)
+
+	acked, err := testPeel.QAck(testCtx, QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+	})
+	require.Nil(t, err)
+	assert.True(t, acked)
+
+	// An event whose deadline has already passed can't be extended
+	ackDeadline = core.NewTS(time.Now().Add(-10 * time.Millisecond))
+	requireAddToKey(t, ewInProg.byArb, ii[1], ackDeadline)
+	requireAddToKey(t, ewInProg.byExp, ii[1], ii[1].Expire)
+
+	cmd.EventID = ii[1]
+	extended, err = testPeel.QExtend(testCtx, cmd)
+	require.Nil(t, err)
+	assert.False(t, extended)
+}
+
+func TestQNack(t *T) {
+	queue, ii := newTestQueue(t, 2)
+	cgroup := testutil.RandStr()
+
+	ewInProg, ewRedo, _, err := queueCGroupKeys(queue, cgroup)
+	require.Nil(t, err)
+
+	ackDeadline := core.NewTS(time.Now().Add(1 * time.Minute))
+	requireAddToKey(t, ewInProg.byArb, ii[0], ackDeadline)
+	requireAddToKey(t, ewInProg.byExp, ii[0], ii[0].Expire)
+
+	cmd := QNackCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+	}
+	nacked, err := testPeel.QNack(testCtx, cmd)
+	require.Nil(t, err)
+	assert.True(t, nacked)
+	assertKey(t, ewInProg.byArb)
+	assertKey(t, ewInProg.byExp)
+	assertKey(t, ewRedo.byArb, ii[0])
+	assertKey(t, ewRedo.byExp, ii[0])
+
+	nacked, err = testPeel.QNack(testCtx, cmd)
+	require.Nil(t, err)
+	assert.False(t, nacked)
+	assertKey(t, ewRedo.byArb, ii[0])
+
+	// The nack'd event should be the next one to come out of QGet
+	e, err := testPeel.QGet(testCtx, QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e.ID)
+	assertKey(t, ewRedo.byArb)
+
+	// An event which has missed its deadline can't be nack'd
+	ackDeadline = core.NewTS(time.Now().Add(-10 * time.Millisecond))
+	requireAddToKey(t, ewInProg.byArb, ii[1], ackDeadline)
+	requireAddToKey(t, ewInProg.byExp, ii[1], ii[1].Expire)
+
+	cmd.EventID = ii[1]
+	nacked, err = testPeel.QNack(testCtx, cmd)
+	require.Nil(t, err)
+	assert.False(t, nacked)
+	assertKey(t, ewInProg.byArb, ii[1])
+	assertKey(t, ewRedo.byArb)
+}
+
+func TestDeliveryToken(t *T) {
+	queue, ii := newTestQueue(t, 1)
+	cgroup := testutil.RandStr()
+
+	ewDeliveries, err := queueDeliveries(queue, cgroup)
+	require.Nil(t, err)
+
+	qget := QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(time.Minute),
+	}
+	e1, err := testPeel.QGet(testCtx, qget)
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e1.ID)
+	assert.NotEmpty(t, e1.DeliveryToken)
+
+	// Redeliver the event, the first delivery's token is now stale
+	nacked, err := testPeel.QNack(testCtx, QNackCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+		DeliveryToken: e1.DeliveryToken,
+	})
+	require.Nil(t, err)
+	assert.True(t, nacked)
+
+	e2, err := testPeel.QGet(testCtx, qget)
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e2.ID)
+	assert.NotEmpty(t, e2.DeliveryToken)
+	assert.NotEqual(t, e1.DeliveryToken, e2.DeliveryToken)
+
+	extended, err := testPeel.QExtend(testCtx, QExtendCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+		AckDeadline:   time.Now().Add(time.Minute),
+		DeliveryToken: e1.DeliveryToken,
+	})
+	require.Nil(t, err)
+	assert.False(t, extended)
+
+	nacked, err = testPeel.QNack(testCtx, QNackCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+		DeliveryToken: e1.DeliveryToken,
+	})
+	require.Nil(t, err)
+	assert.False(t, nacked)
+
+	cmd := QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+		DeliveryToken: e1.DeliveryToken,
+	}
+	acked, err := testPeel.QAck(testCtx, cmd)
+	require.Nil(t, err)
+	assert.False(t, acked)
+
+	cmd.DeliveryToken = "foo"
+	_, err = testPeel.QAck(testCtx, cmd)
+	assert.Equal(t, ErrInvalidDeliveryToken, err)
+
+	_, err = testPeel.QAckMulti(testCtx, QAckMultiCommand{
+		Queue:          queue,
+		ConsumerGroup:  cgroup,
+		EventIDs:       []core.ID{ii[0]},
+		DeliveryTokens: []string{e1.DeliveryToken, e2.DeliveryToken},
+	})
+	assert.NotNil(t, err)
+
+	// Only the latest delivery's token is accepted
+	cmd.DeliveryToken = e2.DeliveryToken
+	acked, err = testPeel.QAck(testCtx, cmd)
+	require.Nil(t, err)
+	assert.True(t, acked)
+	assertKey(t, ewDeliveries.byArb)
+	assertKey(t, ewDeliveries.byExp)
+
+	// Events retrieved without a deadline don't get a token
+	queue, _ = newTestQueue(t, 1)
+	e, err := testPeel.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Empty(t, e.DeliveryToken)
+
+	p := NewWithBackend(core.NewMemBackend(), &Opts{RequireDeliveryTokens: true})
+	_, err = p.QAck(testCtx, QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+	})
+	assert.Equal(t, ErrDeliveryTokenRequired, err)
+}
+
+func TestDeadLetter(t *T) {
+	rpool, err := pool.New("tcp", "127.0.0.1:6379", 10)
+	require.Nil(t, err)
+
+	// Share testPeel's prefix so the key assertion helpers still work
+	o := testPeel.o
+	o.MaxDeliveries = 2
+	p := New(rpool, &o)
+
+	queue, ii := newTestQueue(t, 1)
+	cgroup := testutil.RandStr()
+
+	ewInProg, ewRedo, _, err := queueCGroupKeys(queue, cgroup)
+	require.Nil(t, err)
+	ewAttempts, ewDead, err := queueDeadLetterKeys(queue, cgroup)
+	require.Nil(t, err)
+
+	// Retrieve the event with a deadline which has already passed, so that Clean
+	// treats it as having been dropped by the consumer
+	get := func(attempts uint64) {
+		e, err := p.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   time.Now().Add(-10 * time.Millisecond),
+		})
+		require.Nil(t, err)
+		assert.Equal(t, ii[0], e.ID)
+		assert.Equal(t, attempts, e.Attempts)
+	}
+
+	get(1)
+	require.Nil(t, p.Clean(testCtx, queue, cgroup))
+	assertKey(t, ewRedo.byArb, ii[0])
+	assertKey(t, ewAttempts.byArb, ii[0])
+	assertKey(t, ewDead.byArb)
+
+	get(2)
+	require.Nil(t, p.Clean(testCtx, queue, cgroup))
+	assertKey(t, ewInProg.byArb)
+	assertKey(t, ewRedo.byArb)
+	assertKey(t, ewAttempts.byArb, ii[0])
+	assertKey(t, ewDead.byArb, ii[0])
+	assertKey(t, ewDead.byExp, ii[0])
+
+	dd, cursor, err := p.QDeadList(testCtx, QDeadListCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	require.Len(t, dd, 1)
+	assert.Equal(t, ii[0], dd[0].ID)
+	assert.Equal(t, uint64(2), dd[0].Attempts)
+	assert.Equal(t, "", dd[0].LastError)
+	assert.Equal(t, core.TS(0), cursor)
+
+	qs, err := p.QStatus(testCtx, QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: {cgroup}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(1), qs[queue].ConsumerGroupStats[cgroup].Dead)
+
+	n, err := p.QDeadRedrive(testCtx, QDeadRedriveCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(1), n)
+	assertKey(t, ewDead.byArb)
+	assertKey(t, ewAttempts.byArb)
+	assertKey(t, ewRedo.byArb, ii[0])
+
+	// A nack on the final attempt sends the event straight to dead
+	nack := func(nackErr string) {
+		_, err := p.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   time.Now().Add(1 * time.Minute),
+		})
+		require.Nil(t, err)
+		nacked, err := p.QNack(testCtx, QNackCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			EventID:       ii[0],
+			Error:         nackErr,
+		})
+		require.Nil(t, err)
+		assert.True(t, nacked)
+	}
+
+	nack("first")
+	assertKey(t, ewRedo.byArb, ii[0])
+	assertKey(t, ewDead.byArb)
+
+	nack("second")
+	assertKey(t, ewRedo.byArb)
+	assertKey(t, ewDead.byArb, ii[0])
+
+	dd, _, err = p.QDeadList(testCtx, QDeadListCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	require.Len(t, dd, 1)
+	assert.Equal(t, uint64(2), dd[0].Attempts)
+	assert.Equal(t, "second", dd[0].LastError)
+
+	// Redriving to another queue makes the event available there instead
+	toQueue := testutil.RandStr()
+	n, err = p.QDeadRedrive(testCtx, QDeadRedriveCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		ToQueue:       toQueue,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(1), n)
+	assertKey(t, ewDead.byArb)
+	assertKey(t, ewRedo.byArb)
+	assertKey(t, ewAttempts.byArb)
+
+	e, err := p.QGet(testCtx, QGetCommand{
+		Queue:         toQueue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e.ID)
+}
+
+func TestQDeadListPaging(t *T) {
+	rpool, err := pool.New("tcp", "127.0.0.1:6379", 10)
+	require.Nil(t, err)
+
+	o := testPeel.o
+	o.MaxDeliveries = 1
+	p := New(rpool, &o)
+
+	queue, ii := newTestQueue(t, 3)
+	cgroup := testutil.RandStr()
+
+	for range ii {
+		_, err := p.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   time.Now().Add(-10 * time.Millisecond),
+		})
+		require.Nil(t, err)
+	}
+	require.Nil(t, p.Clean(testCtx, queue, cgroup))
+
+	var got []core.ID
+	var cursor core.TS
+	for {
+		dd, next, err := p.QDeadList(testCtx, QDeadListCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			Limit:         2,
+			Cursor:        cursor,
+		})
+		require.Nil(t, err)
+		for _, d := range dd {
+			got = append(got, d.ID)
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, ii, got)
+}
+
+func TestQMove(t *T) {
+	queue, ii := newTestQueue(t, 2)
+	toQueue, toii := newTestQueue(t, 1)
+	cgroup := testutil.RandStr()
+
+	id, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(10 * time.Minute),
+		Contents: testutil.RandStr(),
+		Priority: 5,
+	})
+	require.Nil(t, err)
+
+	// The consumer group has already moved past everything in toQueue, it
+	// should still get the moved events
+	e, err := testPeel.QGet(testCtx, QGetCommand{Queue: toQueue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, toii[0], e.ID)
+
+	n, err := testPeel.QMove(testCtx, QMoveCommand{Queue: queue, ToQueue: toQueue})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(3), n)
+
+	ewAvails, err := queueAvailableBands(queue)
+	require.Nil(t, err)
+	ewToAvails, err := queueAvailableBands(toQueue)
+	require.Nil(t, err)
+	assertKey(t, ewAvails[0].byArb)
+	assertKey(t, ewAvails[5].byArb)
+	assertKey(t, ewToAvails[0].byArb, ii[0], ii[1], toii[0])
+	assertKey(t, ewToAvails[0].byExp, ii[0], ii[1], toii[0])
+	assertKey(t, ewToAvails[5].byArb, id)
+
+	// The moved events are older than toii[0], but they're scored by when they
+	// were moved, so they're still retrieved after it
+	for _, expectID := range []core.ID{id, ii[0], ii[1], {}} {
+		e, err := testPeel.QGet(testCtx, QGetCommand{Queue: toQueue, ConsumerGroup: cgroup})
+		require.Nil(t, err)
+		assert.Equal(t, expectID, e.ID)
+	}
+
+	_, err = testPeel.QMove(testCtx, QMoveCommand{Queue: queue, ToQueue: queue})
+	assert.NotNil(t, err)
+
+	// Sharded queues can't be moved atomically
+	shardedQueue := testutil.RandStr()
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       shardedQueue,
+		QueueConfig: QueueConfig{Shards: 2},
+	}))
+	_, err = testPeel.QMove(testCtx, QMoveCommand{Queue: shardedQueue, ToQueue: toQueue})
+	assert.NotNil(t, err)
+	_, err = testPeel.QMove(testCtx, QMoveCommand{Queue: toQueue, ToQueue: shardedQueue})
+	assert.NotNil(t, err)
+}
+
+func TestQSeek(t *T) {
+	queue, ii := newTestQueue(t, 3)
+	cgroup := testutil.RandStr()
+
+	ewInProg, _, keyPtr, err := queueCGroupKeys(queue, cgroup)
+	require.Nil(t, err)
+
+	cmd := QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(1 * time.Minute),
+	}
+	assertQGet := func(id core.ID) {
+		e, err := testPeel.QGet(testCtx, cmd)
+		require.Nil(t, err)
+		assert.Equal(t, id, e.ID)
+	}
+	assertQGet(ii[0])
+	assertQGet(ii[1])
+	assertQGet(ii[2])
+	assertQGet(core.ID{})
+
+	// Seeking to the second event's timestamp should replay it and the third
+	require.Nil(t, testPeel.QSeek(testCtx, QSeekCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		From:          ii[1].T.Time(),
+	}))
+	assertKey(t, ewInProg.byArb)
+	assertSingleKey(t, keyPtr, ii[0])
+	assertQGet(ii[1])
+	assertQGet(ii[2])
+	assertQGet(core.ID{})
+
+	// Seeking with no timestamp replays everything
+	require.Nil(t, testPeel.QSeek(testCtx, QSeekCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	}))
+	assertSingleKey(t, keyPtr)
+	assertQGet(ii[0])
+}
+
+func TestQGroupDel(t *T) {
+	queue, ii := newTestQueue(t, 2)
+	cgroup1 := testutil.RandStr()
+	cgroup2 := testutil.RandStr()
+
+	ewInProg1, ewRedo1, keyPtr1, err := queueCGroupKeys(queue, cgroup1)
+	require.Nil(t, err)
+	ewInProg2, _, _, err := queueCGroupKeys(queue, cgroup2)
+	require.Nil(t, err)
+
+	ackDeadline := core.NewTS(time.Now().Add(1 * time.Minute))
+	requireAddToKey(t, ewInProg1.byArb, ii[0], ackDeadline)
+	requireAddToKey(t, ewRedo1.byArb, ii[1], 0)
+	requireSetSingleKey(t, keyPtr1, ii[1])
+	requireAddToKey(t, ewInProg2.byArb, ii[0], ackDeadline)
+
+	require.Nil(t, testPeel.QGroupDel(testCtx, QGroupDelCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup1,
+	}))
+	assertKey(t, ewInProg1.byArb)
+	assertKey(t, ewRedo1.byArb)
+	assertSingleKey(t, keyPtr1)
+	assertKey(t, ewInProg2.byArb, ii[0])
+
+	m, err := testPeel.QList(testCtx, QListCommand{Queue: queue})
+	require.Nil(t, err)
+	assert.Equal(t, []string{cgroup2}, m[queue])
+}
+
+func TestQFlush(t *T) {
+	queue, ii := newTestQueue(t, 3)
+	cgroup1 := testutil.RandStr()
+	cgroup2 := testutil.RandStr()
+
+	ewAvail, err := queueAvailable(queue)
+	require.Nil(t, err)
+	ewInProg1, ewRedo1, keyPtr1, err := queueCGroupKeys(queue, cgroup1)
+	require.Nil(t, err)
+	ewInProg2, _, keyPtr2, err := queueCGroupKeys(queue, cgroup2)
+	require.Nil(t, err)
+
+	ackDeadline := core.NewTS(time.Now().Add(1 * time.Minute))
+	requireAddToKey(t, ewInProg1.byArb, ii[0], ackDeadline)
+	requireAddToKey(t, ewRedo1.byArb, ii[1], 0)
+	requireAddToKey(t, ewInProg2.byArb, ii[0], ackDeadline)
+	requireSetSingleKey(t, keyPtr2, ii[0])
+
+	// Flushing a single consumer group leaves everything else alone
+	require.Nil(t, testPeel.QFlush(testCtx, QFlushCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup1,
+	}))
+	assertKey(t, ewInProg1.byArb)
+	assertKey(t, ewRedo1.byArb)
+	assertSingleKey(t, keyPtr1, ii[2])
+	assertKey(t, ewAvail.byArb, ii...)
+	assertKey(t, ewInProg2.byArb, ii[0])
+	assertSingleKey(t, keyPtr2, ii[0])
+
+	e, err := testPeel.QGet(testCtx, QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup1,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{}, e)
+
+	dedupCmd := QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(1 * time.Minute),
+		Contents: testutil.RandStr(),
+		DedupKey: testutil.RandStr(),
+	}
+	dedupID, err := testPeel.QAdd(testCtx, dedupCmd)
+	require.Nil(t, err)
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       queue,
+		QueueConfig: QueueConfig{MaxLength: 10},
+	}))
+
+	// Flushing the whole queue clears out everything
+	require.Nil(t, testPeel.QFlush(testCtx, QFlushCommand{Queue: queue}))
+	assertKey(t, ewAvail.byArb)
+	assertKey(t, ewAvail.byExp)
+	assertKey(t, ewInProg2.byArb)
+	assertSingleKey(t, keyPtr1)
+	assertSingleKey(t, keyPtr2)
+
+	// The config is kept, but doesn't make the queue known
+	queues, err := testPeel.AllQueuesConsumerGroups(testCtx)
+	require.Nil(t, err)
+	assert.NotContains(t, queues, queue)
+
+	// The DedupKey can be used again
+	id, err := testPeel.QAdd(testCtx, dedupCmd)
+	require.Nil(t, err)
+	assert.NotEqual(t, dedupID, id)
+}
+
+func TestQPause(t *T) {
+	queue, ii := newTestQueue(t, 1)
+	cgroup := testutil.RandStr()
+	cmd := QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	}
+
+	require.Nil(t, testPeel.QPause(testCtx, QPauseCommand{Queue: queue}))
+	// Pausing twice is fine
+	require.Nil(t, testPeel.QPause(testCtx, QPauseCommand{Queue: queue}))
+
+	e, err := testPeel.QGet(testCtx, cmd)
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{}, e)
+
+	// Events can still be added and peeked at
+	_, err = testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(10 * time.Minute),
+		Contents: testutil.RandStr(),
+	})
+	require.Nil(t, err)
+
+	e, err = testPeel.QPeek(testCtx, QPeekCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e.ID)
+
+	qsm, err := testPeel.QStatus(testCtx, QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: nil},
+	})
+	require.Nil(t, err)
+	assert.True(t, qsm[queue].Paused)
+	assert.Equal(t, uint64(2), qsm[queue].Total)
+
+	queues, err := testPeel.QList(testCtx, QListCommand{Queue: queue})
+	require.Nil(t, err)
+	assert.Equal(t, []string{}, queues[queue])
+
+	// A blocking QGet is woken up by the queue being resumed
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		require.Nil(t, testPeel.QResume(testCtx, QResumeCommand{Queue: queue}))
+	}()
+	cmd.Block = 1 * time.Second
+	start := time.Now()
+	e, err = testPeel.QGet(testCtx, cmd)
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e.ID)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+
+	qsm, err = testPeel.QStatus(testCtx, QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: nil},
+	})
+	require.Nil(t, err)
+	assert.False(t, qsm[queue].Paused)
+}
+
+func TestQPendingList(t *T) {
+	queue, ii := newTestQueue(t, 3)
+	cgroup := testutil.RandStr()
+	consumerID := testutil.RandStr()
+
+	keyClaims, err := queueClaims(queue, cgroup)
+	require.Nil(t, err)
+
+	ackDeadline := time.Now().Add(1 * time.Minute)
+	cmd := QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   ackDeadline,
+		ConsumerID:    consumerID,
+	}
+	_, err = testPeel.QGet(testCtx, cmd)
+	require.Nil(t, err)
+
+	cmd.ConsumerID = ""
+	_, err = testPeel.QGet(testCtx, cmd)
+	require.Nil(t, err)
+
+	// Without a deadline the event isn't pending at all
+	cmd.AckDeadline = time.Time{}
+	_, err = testPeel.QGet(testCtx, cmd)
+	require.Nil(t, err)
+
+	pp, err := testPeel.QPendingList(testCtx, QPendingListCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	require.Len(t, pp, 2)
+	assert.Equal(t, ii[0], pp[0].ID)
+	assert.Equal(t, consumerID, pp[0].ConsumerID)
+	assert.Equal(t, core.NewTS(ackDeadline), core.NewTS(pp[0].AckDeadline))
+	assert.Equal(t, ii[1], pp[1].ID)
+	assert.Equal(t, "", pp[1].ConsumerID)
+
+	// Once ack'd the event is no longer pending, and its claim is gone
+	acked, err := testPeel.QAck(testCtx, QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+	})
+	require.Nil(t, err)
+	assert.True(t, acked)
+
+	pp, err = testPeel.QPendingList(testCtx, QPendingListCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	require.Len(t, pp, 1)
+	assert.Equal(t, ii[1], pp[0].ID)
+
+	claims, err := testPeel.c.HashGetIDs(testCtx, keyClaims, ii[:1])
+	require.Nil(t, err)
+	assert.Equal(t, []string{""}, claims)
+}
+
+func TestQConsumers(t *T) {
+	queue, ii := newTestQueue(t, 3)
+	cgroupA, cgroupB := "a"+testutil.RandStr(), "b"+testutil.RandStr()
+
+	get := func(cgroup, consumerID string, deadline time.Time) {
+		_, err := testPeel.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   deadline,
+			ConsumerID:    consumerID,
+		})
+		require.Nil(t, err)
+	}
+
+	before := time.Now()
+	get(cgroupA, "w1", time.Now().Add(1*time.Minute))
+	get(cgroupA, "w1", time.Now().Add(1*time.Minute))
+	get(cgroupA, "w2", time.Time{})
+	get(cgroupB, "w1", time.Now().Add(1*time.Minute))
+	// Without a ConsumerID nothing is registered
+	get(cgroupB, "", time.Now().Add(1*time.Minute))
+
+	cc, err := testPeel.QConsumers(testCtx, QConsumersCommand{Queue: queue})
+	require.Nil(t, err)
+	require.Len(t, cc, 3)
+	for _, ci := range cc {
+		assert.False(t, ci.LastSeen.Before(before.Truncate(time.Microsecond)))
+	}
+	assert.Equal(t, cgroupA, cc[0].ConsumerGroup)
+	assert.Equal(t, "w1", cc[0].ConsumerID)
+	assert.Equal(t, 2, cc[0].InFlight)
+	assert.Equal(t, cgroupA, cc[1].ConsumerGroup)
+	assert.Equal(t, "w2", cc[1].ConsumerID)
+	assert.Equal(t, 0, cc[1].InFlight)
+	assert.Equal(t, cgroupB, cc[2].ConsumerGroup)
+	assert.Equal(t, "w1", cc[2].ConsumerID)
+	assert.Equal(t, 1, cc[2].InFlight)
+
+	// Ack'd events are no longer in flight
+	_, err = testPeel.QAck(testCtx, QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroupA,
+		EventID:       ii[0],
+	})
+	require.Nil(t, err)
+
+	cc, err = testPeel.QConsumers(testCtx, QConsumersCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroupA,
+	})
+	require.Nil(t, err)
+	require.Len(t, cc, 2)
+	assert.Equal(t, 1, cc[0].InFlight)
+	assert.Equal(t, 0, cc[1].InFlight)
+}
+
+func TestQSteal(t *T) {
+	rpool, err := pool.New("tcp", "127.0.0.1:6379", 10)
+	require.Nil(t, err)
+
+	o := testPeel.o
+	o.ConsumerTTL = 100 * time.Millisecond
+	p := New(rpool, &o)
+
+	queue, ii := newTestQueue(t, 3)
+	cgroup := testutil.RandStr()
+
+	var tokens []string
+	for _, consumerID := range []string{"dead", "dead", ""} {
+		e, err := p.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   time.Now().Add(1 * time.Minute),
+			ConsumerID:    consumerID,
+		})
+		require.Nil(t, err)
+		tokens = append(tokens, e.DeliveryToken)
+	}
+
+	steal := func(c QStealCommand) []core.Event {
+		c.Queue, c.ConsumerGroup = queue, cgroup
+		c.ConsumerID = "alive"
+		c.AckDeadline = time.Now().Add(1 * time.Minute)
+		ee, err := p.QSteal(testCtx, c)
+		require.Nil(t, err)
+		return ee
+	}
+
+	// Nothing is stolen while the consumer is still active
+	assert.Empty(t, steal(QStealCommand{}))
+
+	time.Sleep(200 * time.Millisecond)
+	ee := steal(QStealCommand{Count: 1})
+	require.Len(t, ee, 1)
+	assert.Equal(t, ii[0], ee[0].ID)
+	assert.Equal(t, uint64(2), ee[0].Attempts)
+	assert.NotEqual(t, tokens[0], ee[0].DeliveryToken)
+
+	// The rest of the dead consumer's events are stolen, but not the one
+	// retrieved without a ConsumerID
+	ee = steal(QStealCommand{})
+	require.Len(t, ee, 1)
+	assert.Equal(t, ii[1], ee[0].ID)
+
+	// The original consumer can no longer ack with its token
+	acked, err := p.QAck(testCtx, QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+		DeliveryToken: tokens[0],
+	})
+	require.Nil(t, err)
+	assert.False(t, acked)
+
+	pp, err := p.QPendingList(testCtx, QPendingListCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	require.Len(t, pp, 3)
+	assert.Equal(t, "alive", pp[0].ConsumerID)
+	assert.Equal(t, "alive", pp[1].ConsumerID)
+	assert.Equal(t, "", pp[2].ConsumerID)
+}
+
+func TestQPendingListLastError(t *T) {
+	queue, ii := newTestQueue(t, 1)
+	cgroup := testutil.RandStr()
+
+	keyErrors, err := queueErrors(queue, cgroup)
+	require.Nil(t, err)
+
+	get := func() {
+		e, err := testPeel.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   time.Now().Add(1 * time.Minute),
+		})
+		require.Nil(t, err)
+		assert.Equal(t, ii[0], e.ID)
+	}
+	pending := func() PendingEvent {
+		pp, err := testPeel.QPendingList(testCtx, QPendingListCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+		})
+		require.Nil(t, err)
+		require.Len(t, pp, 1)
+		return pp[0]
+	}
+
+	get()
+	assert.Equal(t, "", pending().LastError)
+
+	nacked, err := testPeel.QNack(testCtx, QNackCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+		Error:         "boom",
+	})
+	require.Nil(t, err)
+	assert.True(t, nacked)
+
+	// The error sticks with the event when it's retrieved again
+	get()
+	assert.Equal(t, "boom", pending().LastError)
+
+	// And is forgotten once the event is ack'd
+	acked, err := testPeel.QAck(testCtx, QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+	})
+	require.Nil(t, err)
+	assert.True(t, acked)
+
+	errs, err := testPeel.c.HashGetIDs(testCtx, keyErrors, ii)
+	require.Nil(t, err)
+	assert.Equal(t, []string{""}, errs)
+}
+
+func TestQDoneList(t *T) {
+	queue, ii := newTestQueue(t, 5)
+	cgroup := testutil.RandStr()
+
+	// Retrieve the first four events, leaving the second in progress
+	for i := 0; i < 4; i++ {
+		cmd := QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+		}
+		if i == 1 {
+			cmd.AckDeadline = time.Now().Add(1 * time.Minute)
+		}
+		_, err := testPeel.QGet(testCtx, cmd)
+		require.Nil(t, err)
+	}
+
+	ids := func(ee []core.Event) []core.ID {
+		ret := make([]core.ID, len(ee))
+		for i := range ee {
+			ret[i] = ee[i].ID
+		}
+		return ret
+	}
+
+	ee, cursor, err := testPeel.QDoneList(testCtx, QDoneListCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []core.ID{ii[0], ii[2], ii[3]}, ids(ee))
+	assert.Zero(t, cursor)
+
+	// Paging through two at a time
+	ee, cursor, err = testPeel.QDoneList(testCtx, QDoneListCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		Limit:         2,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []core.ID{ii[0], ii[2]}, ids(ee))
+	assert.NotZero(t, cursor)
+
+	ee, cursor, err = testPeel.QDoneList(testCtx, QDoneListCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		Limit:         2,
+		Cursor:        cursor,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []core.ID{ii[3]}, ids(ee))
+	assert.Zero(t, cursor)
+
+	// Limiting by time
+	ee, _, err = testPeel.QDoneList(testCtx, QDoneListCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		From:          ii[2].T.Time(),
+		To:            ii[3].T.Time(),
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []core.ID{ii[2]}, ids(ee))
+
+	// A consumer group which hasn't retrieved anything has nothing done
+	ee, _, err = testPeel.QDoneList(testCtx, QDoneListCommand{
+		Queue:         queue,
+		ConsumerGroup: testutil.RandStr(),
+	})
+	require.Nil(t, err)
+	assert.Empty(t, ee)
+}
+
+func TestQBrowse(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+
+	// Every other event has "match" in its contents, and one is in a group set
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       queue,
+		QueueConfig: QueueConfig{Grouped: true},
+	}))
+	var ii []core.ID
+	for i := 0; i < 6; i++ {
+		c := QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(10 * time.Minute),
+			Contents: testutil.RandStr(),
+		}
+		if i%2 == 0 {
+			c.Contents = "match-" + c.Contents
+		}
+		if i == 4 {
+			c.GroupID = testutil.RandStr()
+		}
+		id, err := testPeel.QAdd(testCtx, c)
+		require.Nil(t, err)
+		ii = append(ii, id)
+	}
+
+	ids := func(ee []core.Event) []core.ID {
+		ret := make([]core.ID, len(ee))
+		for i := range ee {
+			ret[i] = ee[i].ID
+		}
+		return ret
+	}
+
+	ee, cursor, err := testPeel.QBrowse(testCtx, QBrowseCommand{Queue: queue})
+	require.Nil(t, err)
+	assert.Equal(t, ii, ids(ee))
+	assert.Zero(t, cursor)
+
+	// Paging through the matching events two at a time skips over the rest
+	ee, cursor, err = testPeel.QBrowse(testCtx, QBrowseCommand{
+		Queue:    queue,
+		Contains: "match-",
+		Limit:    2,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []core.ID{ii[0], ii[2]}, ids(ee))
+	assert.NotZero(t, cursor)
+
+	ee, cursor, err = testPeel.QBrowse(testCtx, QBrowseCommand{
+		Queue:  queue,
+		Match:  regexp.MustCompile("^match-"),
+		Limit:  2,
+		Cursor: cursor,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []core.ID{ii[4]}, ids(ee))
+	assert.Zero(t, cursor)
+
+	// Limiting by time
+	ee, _, err = testPeel.QBrowse(testCtx, QBrowseCommand{
+		Queue: queue,
+		From:  ii[1].T.Time(),
+		To:    ii[3].T.Time(),
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []core.ID{ii[1], ii[2]}, ids(ee))
+
+	// Only the events the consumer group is done with. The grouped event is
+	// retrieved first, but done is only tracked for the other events.
+	for i := 0; i < 2; i++ {
+		_, err := testPeel.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+		require.Nil(t, err)
+	}
+	ee, _, err = testPeel.QBrowse(testCtx, QBrowseCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		Contains:      "match-",
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []core.ID{ii[0]}, ids(ee))
+}
+
+func TestQReplayDone(t *T) {
+	queue, ii := newTestQueue(t, 4)
+	cgroup := testutil.RandStr()
+
+	// The first three are done, and the fourth is in progress
+	for i := 0; i < 4; i++ {
+		cmd := QGetCommand{Queue: queue, ConsumerGroup: cgroup}
+		if i == 3 {
+			cmd.AckDeadline = time.Now().Add(time.Minute)
+		}
+		e, err := testPeel.QGet(testCtx, cmd)
+		require.Nil(t, err)
+		assert.Equal(t, ii[i], e.ID)
+	}
+
+	n, err := testPeel.QReplay(testCtx, QReplayCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		From:          ii[1].T.Time(),
+		Done:          true,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(2), n)
+
+	// The same events are retrieved again, and then nothing
+	for _, id := range ii[1:3] {
+		e, err := testPeel.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+		require.Nil(t, err)
+		assert.Equal(t, id, e.ID)
+	}
+	e, err := testPeel.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{}, e)
+}
+
+func TestClean(t *T) {
+	queue, ii := newTestQueue(t, 6)
+	cgroup := testutil.RandStr()
+	now := time.Now()
+
+	for i, id := range ii {
+		t.Logf("ii[%d]: %d (%#v)", i, id, id)
+	}
 
 	ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(queue, cgroup)
 	require.Nil(t, err)
@@ -452,7 +2407,7 @@ func TestClean(t *T) {
 	// pointer, not older than the oldest in avail
 	requireSetSingleKey(t, keyPtr, ii[0])
 
-	require.Nil(t, testPeel.Clean(queue, cgroup))
+	require.Nil(t, testPeel.Clean(testCtx, queue, cgroup))
 	assertKey(t, ewInProg.byArb, ii[0])
 	assertKey(t, ewInProg.byExp, ii[0])
 	assertKey(t, ewRedo.byArb, ii[1], ii[3])
@@ -463,10 +2418,58 @@ func TestClean(t *T) {
 	oldID := ii[0]
 	oldID.T--
 	requireSetSingleKey(t, keyPtr, oldID)
-	require.Nil(t, testPeel.Clean(queue, cgroup))
+	require.Nil(t, testPeel.Clean(testCtx, queue, cgroup))
 	assertSingleKey(t, keyPtr)
 }
 
+func TestQClean(t *T) {
+	queue, ii := newTestQueue(t, 2)
+	cgroup := testutil.RandStr()
+
+	ewInProg, ewRedo, _, err := queueCGroupKeys(queue, cgroup)
+	require.Nil(t, err)
+
+	// The first event misses its deadline, the second doesn't
+	ackDeadline := time.Now().Add(100 * time.Millisecond)
+	for range ii {
+		_, err := testPeel.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   ackDeadline,
+		})
+		require.Nil(t, err)
+		ackDeadline = ackDeadline.Add(1 * time.Minute)
+	}
+
+	n, err := testPeel.QClean(testCtx, QCleanCommand{Queue: queue})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(0), n)
+
+	// A consumer blocking on the queue is woken up by the clean
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		n, err := testPeel.QClean(testCtx, QCleanCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+		})
+		require.Nil(t, err)
+		assert.Equal(t, uint64(1), n)
+	}()
+
+	start := time.Now()
+	e, err := testPeel.QGet(testCtx, QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		Block:         1 * time.Second,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e.ID)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+
+	assertKey(t, ewInProg.byArb, ii[1])
+	assertKey(t, ewRedo.byArb)
+}
+
 func TestCleanAvailable(t *T) {
 	queue := testutil.RandStr()
 
@@ -486,7 +2489,7 @@ func TestCleanAvailable(t *T) {
 	requireAddToKey(t, ewAvail.byArb, ii3, 0)
 	requireAddToKey(t, ewAvail.byExp, ii3, ii3.Expire)
 
-	require.Nil(t, testPeel.CleanAvailable(queue))
+	require.Nil(t, testPeel.CleanAvailable(testCtx, queue))
 	assertKey(t, ewAvail.byArb, ii0, ii2)
 }
 
@@ -506,14 +2509,27 @@ func TestQStatus(t *T) {
 	requireAddToKey(t, ewRedo.byArb, ii[2], 0)
 	requireAddToKey(t, ewRedo.byExp, ii[2], ii[2].Expire)
 
+	// cg3 consumes two events without a deadline, so they're done
+	cg3 := testutil.RandStr()
+	for i := 0; i < 2; i++ {
+		_, err = testPeel.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cg3})
+		require.Nil(t, err)
+	}
+
 	cmd := QStatusCommand{
 		QueuesConsumerGroups: map[string][]string{
-			queue: []string{cg1, cg2},
+			queue: []string{cg1, cg2, cg3},
 		},
 	}
-	qsm, err := testPeel.QStatus(cmd)
+	qsm, err := testPeel.QStatus(testCtx, cmd)
 	require.Nil(t, err)
 
+	// Lag is measured from the newest event each consumer group has retrieved,
+	// or from the oldest event for cg2 which hasn't retrieved any
+	lagFrom := func(id core.ID) time.Duration {
+		return ii[5].T.Time().Sub(id.T.Time())
+	}
+
 	expected := map[string]QueueStats{
 		queue: QueueStats{
 			Total: 6,
@@ -522,16 +2538,23 @@ func TestQStatus(t *T) {
 					InProgress: 2,
 					Redo:       1,
 					Available:  3,
+					Lag:        lagFrom(ii[2]),
 				},
 				cg2: ConsumerGroupStats{
 					Available: 6,
+					Lag:       lagFrom(ii[0]),
+				},
+				cg3: ConsumerGroupStats{
+					Available: 4,
+					Done:      2,
+					Lag:       lagFrom(ii[1]),
 				},
 			},
 		},
 	}
 	assert.Equal(t, expected, qsm)
 
-	lines, err := testPeel.QInfo(cmd)
+	lines, err := testPeel.QInfo(testCtx, cmd)
 	require.Nil(t, err)
 	// We don't need to try and assert what the lines are, but just print them
 	// out so I might notice if they get wonky somehow
@@ -539,3 +2562,392 @@ func TestQStatus(t *T) {
 		t.Log(line)
 	}
 }
+
+func TestQList(t *T) {
+	queue, ii := newTestQueue(t, 1)
+	cgroup1 := "a" + testutil.RandStr()
+	cgroup2 := "b" + testutil.RandStr()
+
+	for _, cgroup := range []string{cgroup2, cgroup1} {
+		ewInProg, err := queueInProgress(queue, cgroup)
+		require.Nil(t, err)
+		requireAddToKey(t, ewInProg.byArb, ii[0], 0)
+	}
+	emptyQueue, _ := newTestQueue(t, 1)
+
+	m, err := testPeel.QList(testCtx, QListCommand{})
+	require.Nil(t, err)
+	assert.Equal(t, []string{cgroup1, cgroup2}, m[queue])
+	assert.Equal(t, []string{}, m[emptyQueue])
+
+	m, err = testPeel.QList(testCtx, QListCommand{Queue: queue})
+	require.Nil(t, err)
+	assert.Equal(t, map[string][]string{queue: {cgroup1, cgroup2}}, m)
+
+	m, err = testPeel.QList(testCtx, QListCommand{Queue: testutil.RandStr()})
+	require.Nil(t, err)
+	assert.Empty(t, m)
+}
+
+func TestNewWithBackend(t *T) {
+	p := NewWithBackend(core.NewMemBackend(), nil)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	p.Run(stopCh)
+
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+	var ii []core.ID
+	for i := 0; i < 2; i++ {
+		id, err := p.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(10 * time.Second),
+			Contents: testutil.RandStr(),
+		})
+		require.Nil(t, err)
+		ii = append(ii, id)
+	}
+
+	cmd := QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(10 * time.Second),
+	}
+	e, err := p.QGet(testCtx, cmd)
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e.ID)
+
+	acked, err := p.QAck(testCtx, QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       e.ID,
+	})
+	require.Nil(t, err)
+	assert.True(t, acked)
+
+	e, err = p.QGet(testCtx, cmd)
+	require.Nil(t, err)
+	assert.Equal(t, ii[1], e.ID)
+
+	// A blocking QGet is woken up by a QAdd
+	cmd.Block = 5 * time.Second
+	contents := testutil.RandStr()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(10 * time.Second),
+			Contents: contents,
+		})
+	}()
+	e, err = p.QGet(testCtx, cmd)
+	require.Nil(t, err)
+	assert.Equal(t, contents, e.Contents)
+}
+
+func TestNewMem(t *T) {
+	clock := core.NewManualClock(time.Now())
+	p := NewMem(clock, nil)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	p.Run(stopCh)
+
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+	add := func(c QAddCommand) core.ID {
+		c.Queue, c.Contents = queue, testutil.RandStr()
+		id, err := p.QAdd(testCtx, c)
+		require.Nil(t, err)
+		return id
+	}
+	id := add(QAddCommand{Expire: clock.Now().Add(10 * time.Minute)})
+	delayedID := add(QAddCommand{
+		Expire:       clock.Now().Add(10 * time.Minute),
+		VisibleAfter: clock.Now().Add(time.Minute),
+	})
+	expiringID := add(QAddCommand{Expire: clock.Now().Add(5 * time.Minute)})
+
+	qget := func() core.ID {
+		e, err := p.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   clock.Now().Add(30 * time.Second),
+		})
+		require.Nil(t, err)
+		return e.ID
+	}
+	assert.Equal(t, id, qget())
+	assert.Equal(t, expiringID, qget())
+	assert.Equal(t, core.ID{}, qget())
+
+	// Both events miss their ack deadline, and the delayed one becomes visible
+	clock.Advance(time.Minute)
+	require.Nil(t, p.Clean(testCtx, queue, cgroup))
+	assert.Equal(t, id, qget())
+	assert.Equal(t, expiringID, qget())
+	assert.Equal(t, delayedID, qget())
+
+	// The expiring event is gone once it expires
+	clock.Advance(5 * time.Minute)
+	require.Nil(t, p.Clean(testCtx, queue, cgroup))
+	assert.Equal(t, id, qget())
+	assert.Equal(t, delayedID, qget())
+	assert.Equal(t, core.ID{}, qget())
+}
+
+func TestClock(t *T) {
+	rp, err := pool.New("tcp", "127.0.0.1:6379", 1)
+	require.Nil(t, err)
+	clock := core.NewManualClock(time.Now())
+	p := New(rp, &Opts{Opts: core.Opts{RedisPrefix: testutil.RandStr(), Clock: clock}})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	p.Run(stopCh)
+
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+	id, err := p.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   clock.Now().Add(time.Hour),
+		Contents: testutil.RandStr(),
+	})
+	require.Nil(t, err)
+	assert.True(t, id.T.Time().Equal(clock.Now().Truncate(time.Microsecond)))
+
+	qget := func() core.Event {
+		e, err := p.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   clock.Now().Add(time.Minute),
+		})
+		require.Nil(t, err)
+		return e
+	}
+	e := qget()
+	assert.Equal(t, id, e.ID)
+
+	// Once the ack deadline has passed the event can't be acked, and is redone
+	clock.Advance(2 * time.Minute)
+	acked, err := p.QAck(testCtx, QAckCommand{Queue: queue, ConsumerGroup: cgroup, EventID: id})
+	require.Nil(t, err)
+	assert.False(t, acked)
+	require.Nil(t, p.Clean(testCtx, queue, cgroup))
+	assert.Equal(t, id, qget().ID)
+
+	// And once it expires it's gone altogether
+	clock.Advance(2 * time.Hour)
+	require.Nil(t, p.Clean(testCtx, queue, cgroup))
+	assert.Equal(t, core.ID{}, qget().ID)
+}
+
+func TestFaults(t *T) {
+	clock := core.NewManualClock(time.Now())
+	fi := core.NewFaultInjector()
+	p := NewMem(clock, &Opts{Opts: core.Opts{Faults: fi}})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	p.Run(stopCh)
+
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+	id, err := p.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   clock.Now().Add(time.Hour),
+		Contents: testutil.RandStr(),
+	})
+	require.Nil(t, err)
+	qget := func() core.ID {
+		e, err := p.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   clock.Now().Add(time.Minute),
+		})
+		require.Nil(t, err)
+		return e.ID
+	}
+	ack := QAckCommand{Queue: queue, ConsumerGroup: cgroup, EventID: id}
+	assert.Equal(t, id, qget())
+
+	// An ack which never makes it to the database leaves the event to be
+	// redelivered once its deadline passes
+	fi.Set(core.Fault{Kind: core.FaultError, Ops: []string{"Query"}, Probability: 1})
+	_, err = p.QAck(testCtx, ack)
+	assert.Equal(t, core.ErrFaultInjected, err)
+	fi.Set()
+	clock.Advance(2 * time.Minute)
+	require.Nil(t, p.Clean(testCtx, queue, cgroup))
+	assert.Equal(t, id, qget())
+
+	// One whose response is lost still acks it
+	fi.Set(core.Fault{Kind: core.FaultDrop, Ops: []string{"Query"}, Probability: 1})
+	_, err = p.QAck(testCtx, ack)
+	assert.Equal(t, core.ErrFaultDropped, err)
+	fi.Set()
+	clock.Advance(2 * time.Minute)
+	require.Nil(t, p.Clean(testCtx, queue, cgroup))
+	assert.Equal(t, core.ID{}, qget())
+}
+
+func TestRedisPrefix(t *T) {
+	p1, p2 := newTestPeel(), newTestPeel()
+	queue := testutil.RandStr()
+	_, err := p1.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(1 * time.Minute),
+		Contents: testutil.RandStr(),
+	})
+	require.Nil(t, err)
+
+	// Peels with different prefixes don't share anything, even when using the
+	// same queue and consumer group names
+	cmd := QGetCommand{Queue: queue, ConsumerGroup: testutil.RandStr()}
+	e, err := p2.QGet(testCtx, cmd)
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{}, e)
+
+	e, err = p1.QGet(testCtx, cmd)
+	require.Nil(t, err)
+	assert.NotEqual(t, core.Event{}, e)
+}
+
+func TestCleanAllOnce(t *T) {
+	// Two Peels sharing the same database
+	b := core.NewMemBackend()
+	o := Opts{CleanPeriod: 100 * time.Millisecond}
+	p1, p2 := NewWithBackend(b, &o), NewWithBackend(b, &o)
+
+	cleaned, err := p1.cleanAllOnce(testCtx)
+	require.Nil(t, err)
+	assert.True(t, cleaned)
+
+	// Only one of them cleans each period
+	cleaned, err = p2.cleanAllOnce(testCtx)
+	require.Nil(t, err)
+	assert.False(t, cleaned)
+	cleaned, err = p1.cleanAllOnce(testCtx)
+	require.Nil(t, err)
+	assert.False(t, cleaned)
+
+	time.Sleep(o.CleanPeriod)
+	cleaned, err = p2.cleanAllOnce(testCtx)
+	require.Nil(t, err)
+	assert.True(t, cleaned)
+
+	// The lock isn't mistaken for a queue
+	m, err := p1.AllQueuesConsumerGroups(testCtx)
+	require.Nil(t, err)
+	assert.Empty(t, m)
+}
+
+// testHook records the names and counts of every core.Stat it's given
+type testHook struct {
+	l  sync.Mutex
+	ss []core.Stat
+}
+
+func (th *testHook) Observe(s core.Stat) {
+	th.l.Lock()
+	defer th.l.Unlock()
+	th.ss = append(th.ss, s)
+}
+
+// returns only the Stats for Peel commands, which all start with Q
+func (th *testHook) commands() []core.Stat {
+	th.l.Lock()
+	defer th.l.Unlock()
+	var ss []core.Stat
+	for _, s := range th.ss {
+		if s.Name[0] == 'Q' && s.Name != "Query" {
+			s.Duration = 0
+			ss = append(ss, s)
+		}
+	}
+	return ss
+}
+
+func TestHook(t *T) {
+	th := &testHook{}
+	p := NewWithBackend(core.NewMemBackend(), &Opts{Opts: core.Opts{Hook: th}})
+	p.Run(nil)
+	queue := testutil.RandStr()
+
+	_, err := p.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(1 * time.Minute),
+		Contents: testutil.RandStr(),
+	})
+	require.Nil(t, err)
+	cmd := QGetCommand{Queue: queue, ConsumerGroup: testutil.RandStr()}
+	_, err = p.QGet(testCtx, cmd)
+	require.Nil(t, err)
+	_, err = p.QGet(testCtx, cmd)
+	require.Nil(t, err)
+	_, err = p.QGetMulti(testCtx, QGetMultiCommand{QGetCommand: cmd})
+	require.NotNil(t, err)
+
+	assert.Equal(t, []core.Stat{
+		{Name: "QAdd", Queue: queue, Count: 1},
+		{Name: "QGet", Queue: queue, ConsumerGroup: cmd.ConsumerGroup, Count: 1},
+		{Name: "QGet", Queue: queue, ConsumerGroup: cmd.ConsumerGroup},
+		{Name: "QGetMulti", Queue: queue, ConsumerGroup: cmd.ConsumerGroup, Err: err},
+	}, th.commands())
+
+	// The core operations are reported too
+	var sawQuery bool
+	for _, s := range th.ss {
+		sawQuery = sawQuery || s.Name == "Query"
+	}
+	assert.True(t, sawQuery)
+}
+
+func TestQAddRoundTrips(t *T) {
+	th := &testHook{}
+	p := NewWithBackend(core.NewMemBackend(), &Opts{Opts: core.Opts{Hook: th}})
+	p.Run(nil)
+	queue := testutil.RandStr()
+
+	// returns the names of the core operations performed by the QAddMulti
+	qadd := func(cc ...QAddCommand) []string {
+		th.l.Lock()
+		th.ss = nil
+		th.l.Unlock()
+		_, err := p.QAddMulti(testCtx, cc)
+		require.Nil(t, err)
+
+		th.l.Lock()
+		defer th.l.Unlock()
+		var names []string
+		for _, s := range th.ss {
+			if s.Name[0] != 'Q' || s.Name == "Query" {
+				names = append(names, s.Name)
+			}
+		}
+		return names
+	}
+
+	c := QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(1 * time.Minute),
+		Contents: testutil.RandStr(),
+	}
+	qadd(c)
+
+	// The events are set by the Query which adds them to the queue
+	c2 := c
+	c2.Contents = testutil.RandStr()
+	assert.Equal(t, []string{"HashGetAll", "MonoTSs", "Query", "KeyNotify"}, qadd(c, c2))
+
+	// unless they need different paddings
+	c2.Padding = time.Hour
+	assert.Equal(t,
+		[]string{"HashGetAll", "MonoTSs", "SetEvents", "SetEvents", "Query", "KeyNotify"},
+		qadd(c, c2),
+	)
+
+	cmd := QGetCommand{Queue: queue, ConsumerGroup: testutil.RandStr()}
+	for _, contents := range []string{c.Contents, c.Contents, c2.Contents, c.Contents, c2.Contents} {
+		e, err := p.QGet(testCtx, cmd)
+		require.Nil(t, err)
+		assert.Equal(t, contents, e.Contents)
+	}
+}
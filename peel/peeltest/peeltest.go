@@ -0,0 +1,411 @@
+// Package peeltest checks that a peel.Peel, and whatever Backend it's using,
+// neither loses nor duplicates events. Run performs a random sequence of
+// QAdd, QGet, QAck and QNack commands against a Peel, checking the result of
+// each against a simple model of what a queue should do, and then checks that
+// every event which was added was acked exactly once.
+//
+// It can be used to check forks of bananaq, other core.Backends, or Peels with
+// particular Opts:
+//
+//	func TestQueueSemantics(t *testing.T) {
+//		clock := core.NewManualClock(time.Now())
+//		p := peel.New(pool, &peel.Opts{Opts: core.Opts{Clock: clock}})
+//		p.Run(nil)
+//		if err := peeltest.Run(context.Background(), p, peeltest.Opts{Clock: clock}); err != nil {
+//			t.Fatal(err)
+//		}
+//	}
+//
+// Every failure includes the Seed, so a failing sequence can be repeated.
+package peeltest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+)
+
+// Opts are the parameters of Run, all of which are optional
+type Opts struct {
+	// Default a new random one. Determines the sequence of commands, so that
+	// a sequence which fails can be repeated.
+	Seed int64
+
+	// Default 1000. The number of commands to perform before the queue is
+	// emptied and checked.
+	Commands int
+
+	// Default a new random queue and consumer group. They should be empty and
+	// not used by anything else while Run is. Their QueueConfig should be the
+	// default one, apart from MaxDeliveries; events which are moved to the
+	// dead set are accounted for when checking none were lost.
+	Queue, ConsumerGroup string
+
+	// Default 30 seconds. The AckDeadline events are retrieved with.
+	AckDeadline time.Duration
+
+	// Optional. If set it should be the Clock used by the Peel (see
+	// core.Opts). Run then also moves it forward at random, cleaning the
+	// queue each time, so that events miss their ack deadline and are
+	// redelivered. Without it events never miss their ack deadline.
+	Clock *core.ManualClock
+}
+
+func (o Opts) withDefaults() Opts {
+	if o.Seed == 0 {
+		o.Seed = time.Now().UnixNano()
+	}
+	if o.Commands == 0 {
+		o.Commands = 1000
+	}
+	if o.Queue == "" {
+		o.Queue = "peeltest-" + strconv.FormatInt(rand.Int63(), 36)
+	}
+	if o.ConsumerGroup == "" {
+		o.ConsumerGroup = "peeltest"
+	}
+	if o.AckDeadline == 0 {
+		o.AckDeadline = 30 * time.Second
+	}
+	return o
+}
+
+// Failure is returned from Run when the Peel doesn't do what the model says
+// it should, or a command fails
+type Failure struct {
+	Seed int64
+
+	// The index of the command which failed. It's Opts.Commands for failures
+	// found while emptying and checking the queue.
+	Command int
+
+	Err error
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("seed %d, command %d: %s", f.Seed, f.Command, f.Err)
+}
+
+func (f *Failure) Unwrap() error {
+	return f.Err
+}
+
+type eventState int
+
+const (
+	stateAvail eventState = iota
+	stateInProg
+	stateAcked
+)
+
+type modelEvent struct {
+	e         core.Event
+	state     eventState
+	retrieved bool
+	deadline  time.Time
+	token     string
+}
+
+// model is what the queue should contain
+type model struct {
+	events map[core.ID]*modelEvent
+	ids    []core.ID // in the order they were added
+}
+
+// returns the IDs of events in the given state, in the order they were added
+func (m *model) inState(state eventState) []core.ID {
+	var ii []core.ID
+	for _, id := range m.ids {
+		if m.events[id].state == state {
+			ii = append(ii, id)
+		}
+	}
+	return ii
+}
+
+type runner struct {
+	p   *peel.Peel
+	o   Opts
+	r   *rand.Rand
+	m   model
+	cmd int
+}
+
+// Run performs the random sequence of commands against the Peel, which must
+// already be running, and returns a *Failure if anything went wrong.
+func Run(ctx context.Context, p *peel.Peel, o Opts) error {
+	o = o.withDefaults()
+	r := &runner{
+		p: p,
+		o: o,
+		r: rand.New(rand.NewSource(o.Seed)),
+		m: model{events: map[core.ID]*modelEvent{}},
+	}
+
+	for ; r.cmd < o.Commands; r.cmd++ {
+		var err error
+		switch n := r.r.Intn(100); {
+		case n < 30:
+			err = r.add(ctx)
+		case n < 60:
+			_, err = r.get(ctx)
+		case n < 80:
+			err = r.ack(ctx)
+		case n < 90:
+			err = r.nack(ctx)
+		case o.Clock != nil:
+			err = r.advance(ctx)
+		}
+		if err != nil {
+			return r.fail(err)
+		}
+	}
+
+	if err := r.check(ctx); err != nil {
+		return r.fail(err)
+	}
+	return nil
+}
+
+func (r *runner) fail(err error) error {
+	return &Failure{Seed: r.o.Seed, Command: r.cmd, Err: err}
+}
+
+func (r *runner) now() time.Time {
+	if r.o.Clock != nil {
+		return r.o.Clock.Now()
+	}
+	return time.Now()
+}
+
+// returns whether the in progress event has missed its ack deadline
+func (r *runner) missed(me *modelEvent) bool {
+	return me.state == stateInProg && !r.now().Before(me.deadline)
+}
+
+func (r *runner) add(ctx context.Context) error {
+	contents := strconv.FormatInt(r.r.Int63(), 36)
+	id, err := r.p.QAdd(ctx, peel.QAddCommand{
+		Queue:    r.o.Queue,
+		Expire:   r.now().Add(24 * time.Hour),
+		Contents: contents,
+	})
+	if err != nil {
+		return fmt.Errorf("QAdd: %w", err)
+	} else if _, ok := r.m.events[id]; ok {
+		return fmt.Errorf("QAdd returned ID %s twice", id)
+	}
+	r.m.events[id] = &modelEvent{e: core.Event{ID: id, Contents: contents}}
+	r.m.ids = append(r.m.ids, id)
+	return nil
+}
+
+// get retrieves an event, returning whether there was one
+func (r *runner) get(ctx context.Context) (bool, error) {
+	// The half second keeps deadlines from ever landing exactly on the clock's
+	// time, which only moves by whole seconds, since it'd be ambiguous whether
+	// they've been missed
+	deadline := r.now().Add(r.o.AckDeadline + 500*time.Millisecond)
+	e, err := r.p.QGet(ctx, peel.QGetCommand{
+		Queue:         r.o.Queue,
+		ConsumerGroup: r.o.ConsumerGroup,
+		AckDeadline:   deadline,
+	})
+	if err != nil {
+		return false, fmt.Errorf("QGet: %w", err)
+	} else if e.ID == (core.ID{}) {
+		// Events may have been moved to the dead set, so there being none
+		// isn't necessarily wrong. Whether any were lost is checked at the
+		// end.
+		return false, nil
+	}
+
+	me, ok := r.m.events[e.ID]
+	switch {
+	case !ok:
+		return false, fmt.Errorf("QGet returned unknown event %s", e.ID)
+	case me.state == stateAcked:
+		return false, fmt.Errorf("QGet returned event %s after it was acked", e.ID)
+	case me.state == stateInProg && !r.missed(me):
+		return false, fmt.Errorf("QGet returned event %s while it was still in progress", e.ID)
+	case e.Contents != me.e.Contents:
+		return false, fmt.Errorf("QGet returned event %s with contents %q, not %q", e.ID, e.Contents, me.e.Contents)
+	}
+	me.state, me.retrieved = stateInProg, true
+	me.deadline, me.token = deadline, e.DeliveryToken
+	return true, nil
+}
+
+// picks an event which was retrieved at some point, whether or not it's still
+// in progress, so that acks and nacks of events which aren't are checked too.
+// Returns nil if there aren't any.
+func (r *runner) pick() *modelEvent {
+	var mm []*modelEvent
+	for _, id := range r.m.ids {
+		if me := r.m.events[id]; me.retrieved {
+			mm = append(mm, me)
+		}
+	}
+	if len(mm) == 0 {
+		return nil
+	}
+	// Mostly pick events which are in progress, since acking those is what
+	// most consumers do
+	if r.r.Intn(4) > 0 {
+		for _, i := range r.r.Perm(len(mm)) {
+			if mm[i].state == stateInProg && !r.missed(mm[i]) {
+				return mm[i]
+			}
+		}
+	}
+	return mm[r.r.Intn(len(mm))]
+}
+
+func (r *runner) ack(ctx context.Context) error {
+	if me := r.pick(); me != nil {
+		return r.ackEvent(ctx, me)
+	}
+	return nil
+}
+
+func (r *runner) ackEvent(ctx context.Context, me *modelEvent) error {
+	acked, err := r.p.QAck(ctx, peel.QAckCommand{
+		Queue:         r.o.Queue,
+		ConsumerGroup: r.o.ConsumerGroup,
+		EventID:       me.e.ID,
+		DeliveryToken: me.token,
+	})
+	if err != nil {
+		return fmt.Errorf("QAck: %w", err)
+	}
+
+	shouldAck := me.state == stateInProg && !r.missed(me)
+	switch {
+	case acked && me.state == stateAcked:
+		return fmt.Errorf("QAck acked event %s twice", me.e.ID)
+	case acked && !shouldAck:
+		return fmt.Errorf("QAck acked event %s which wasn't in progress", me.e.ID)
+	case !acked && shouldAck:
+		return fmt.Errorf("QAck didn't ack event %s which was in progress", me.e.ID)
+	}
+	if acked {
+		me.state = stateAcked
+	}
+	return nil
+}
+
+func (r *runner) nack(ctx context.Context) error {
+	if me := r.pick(); me != nil {
+		return r.nackEvent(ctx, me)
+	}
+	return nil
+}
+
+func (r *runner) nackEvent(ctx context.Context, me *modelEvent) error {
+	nacked, err := r.p.QNack(ctx, peel.QNackCommand{
+		Queue:         r.o.Queue,
+		ConsumerGroup: r.o.ConsumerGroup,
+		EventID:       me.e.ID,
+		DeliveryToken: me.token,
+	})
+	if err != nil {
+		return fmt.Errorf("QNack: %w", err)
+	}
+
+	shouldNack := me.state == stateInProg && !r.missed(me)
+	switch {
+	case nacked && !shouldNack:
+		return fmt.Errorf("QNack nacked event %s which wasn't in progress", me.e.ID)
+	case !nacked && shouldNack:
+		return fmt.Errorf("QNack didn't nack event %s which was in progress", me.e.ID)
+	}
+	if nacked {
+		me.state = stateAvail
+	}
+	return nil
+}
+
+// advance moves the Clock forward by up to twice the AckDeadline, and cleans
+// the queue so that events which missed their deadline are redelivered
+func (r *runner) advance(ctx context.Context) error {
+	secs := int(2 * r.o.AckDeadline / time.Second)
+	r.o.Clock.Advance(time.Duration(r.r.Intn(secs)+1) * time.Second)
+	if err := r.p.Clean(ctx, r.o.Queue, r.o.ConsumerGroup); err != nil {
+		return fmt.Errorf("Clean: %w", err)
+	}
+	for _, me := range r.m.events {
+		if r.missed(me) {
+			me.state = stateAvail
+		}
+	}
+	return nil
+}
+
+// check nacks every event still in progress, retrieves and acks every event
+// left in the queue, and then checks every event was either acked or is dead
+func (r *runner) check(ctx context.Context) error {
+	for _, id := range r.m.inState(stateInProg) {
+		me := r.m.events[id]
+		if r.missed(me) {
+			// Only possible without a Clock, if the run took longer than the
+			// AckDeadline
+			return fmt.Errorf("event %s missed its ack deadline before it could be nacked", id)
+		}
+		if err := r.nackEvent(ctx, me); err != nil {
+			return err
+		}
+	}
+
+	for {
+		got, err := r.get(ctx)
+		if err != nil {
+			return err
+		} else if !got {
+			break
+		}
+		for _, id := range r.m.inState(stateInProg) {
+			if err := r.ackEvent(ctx, r.m.events[id]); err != nil {
+				return err
+			}
+		}
+	}
+
+	dead := map[core.ID]bool{}
+	var cursor core.TS
+	for {
+		dd, next, err := r.p.QDeadList(ctx, peel.QDeadListCommand{
+			Queue:         r.o.Queue,
+			ConsumerGroup: r.o.ConsumerGroup,
+			Limit:         100,
+			Cursor:        cursor,
+		})
+		if err != nil {
+			return fmt.Errorf("QDeadList: %w", err)
+		}
+		for _, d := range dd {
+			dead[d.ID] = true
+		}
+		if next == 0 || len(dd) == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	var lost []string
+	for _, id := range r.m.ids {
+		if r.m.events[id].state != stateAcked && !dead[id] {
+			lost = append(lost, id.String())
+		}
+	}
+	if len(lost) > 0 {
+		sort.Strings(lost)
+		return fmt.Errorf("%d of %d events were lost: %v", len(lost), len(r.m.ids), lost)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package peeltest
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testCtx = context.Background()
+
+func TestRunMem(t *T) {
+	clock := core.NewManualClock(time.Now())
+	p := peel.NewMem(clock, nil)
+	p.Run(nil)
+	assert.Nil(t, Run(testCtx, p, Opts{Clock: clock}))
+
+	// Without a Clock, and with events being dead-lettered
+	p = peel.NewMem(nil, &peel.Opts{MaxDeliveries: 2})
+	p.Run(nil)
+	assert.Nil(t, Run(testCtx, p, Opts{Commands: 300}))
+}
+
+func TestRunRedis(t *T) {
+	rp, err := pool.New("tcp", "127.0.0.1:6379", 1)
+	require.Nil(t, err)
+	clock := core.NewManualClock(time.Now())
+	p := peel.New(rp, &peel.Opts{
+		Opts:          core.Opts{RedisPrefix: testutil.RandStr(), Clock: clock},
+		MaxDeliveries: 3,
+	})
+	p.Run(nil)
+	assert.Nil(t, Run(testCtx, p, Opts{Clock: clock, Commands: 500}))
+}
+
+// brokenBackend silently skips every tenth Query, which should lose or
+// duplicate events somewhere along the way
+type brokenBackend struct {
+	core.Backend
+	n int
+}
+
+func (bb *brokenBackend) Query(ctx context.Context, qas core.QueryActions) (core.QueryRes, error) {
+	if bb.n++; bb.n%10 == 0 {
+		return core.QueryRes{}, nil
+	}
+	return bb.Backend.Query(ctx, qas)
+}
+
+func TestRunFailure(t *T) {
+	p := peel.NewWithBackend(&brokenBackend{Backend: core.NewMemBackend()}, nil)
+	p.Run(nil)
+	err := Run(testCtx, p, Opts{Seed: 5})
+	require.IsType(t, &Failure{}, err)
+	assert.Equal(t, int64(5), err.(*Failure).Seed)
+
+	// Errors from the Peel are failures too
+	fi := core.NewFaultInjector(core.Fault{Kind: core.FaultError, Ops: []string{"Query"}, Probability: 0.1})
+	p = peel.NewMem(nil, &peel.Opts{Opts: core.Opts{Faults: fi}})
+	p.Run(nil)
+	err = Run(testCtx, p, Opts{})
+	assert.ErrorIs(t, err, core.ErrFaultInjected)
+}
@@ -0,0 +1,314 @@
+package peel
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// ErrProducerClosed is returned by a Producer's Add and AddFunc once Close has
+// been called
+var ErrProducerClosed = errors.New("producer is closed")
+
+// ProducerOpts are extra optional parameters which may be passed into
+// NewProducer
+type ProducerOpts struct {
+	// Default 100. Buffered events are flushed as soon as there are this many
+	// of them.
+	BatchSize int
+
+	// Default 5 milliseconds. Buffered events are flushed once the first of
+	// them has been buffered for this long, even if there are fewer than
+	// BatchSize of them.
+	FlushInterval time.Duration
+
+	// Default 10 times BatchSize. The most events which may be buffered or
+	// being flushed at once. Once reached Add and AddFunc block until there's
+	// room, so that producers can't get ahead of the database.
+	MaxPending int
+
+	// Default 4. The most batches which may be flushed at once. Events in
+	// batches which are flushed at the same time may be added out of order
+	// relative to each other, so this should be 1 if events must be added in
+	// the order they were given to Add.
+	MaxFlushing int
+
+	// Default 10 seconds. How long each flush may take before its events are
+	// completed with an error.
+	FlushTimeout time.Duration
+}
+
+func (o ProducerOpts) withDefaults() ProducerOpts {
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = 5 * time.Millisecond
+	}
+	if o.MaxPending <= 0 {
+		o.MaxPending = o.BatchSize * 10
+	}
+	if o.MaxFlushing <= 0 {
+		o.MaxFlushing = 4
+	}
+	if o.FlushTimeout <= 0 {
+		o.FlushTimeout = 10 * time.Second
+	}
+	return o
+}
+
+type producerEvent struct {
+	c  QAddCommand
+	fn func(core.ID, error)
+}
+
+// Producer buffers events given to it and adds them in batches using QAddMulti,
+// rather than making a round trip to the database for every event like QAdd.
+// Each event is completed, with its ID or the error which prevented it from
+// being added, once the batch it's in has been flushed.
+//
+// Since the round trips are shared, a Producer is best suited to adding a lot
+// of events from many goroutines at once. It is safe to use from multiple
+// goroutines.
+type Producer struct {
+	p *Peel
+	o ProducerOpts
+
+	// one per event which is buffered or being flushed
+	pending chan struct{}
+	// one per batch which is being flushed
+	flushing chan struct{}
+
+	addCh   chan producerEvent
+	flushCh chan chan []chan struct{}
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+	doneCh    chan struct{}
+}
+
+// NewProducer returns a Producer which adds events through the given Peel. o
+// may be nil. Close should be called once the Producer is no longer needed.
+func NewProducer(p *Peel, o *ProducerOpts) *Producer {
+	if o == nil {
+		o = &ProducerOpts{}
+	}
+	oo := o.withDefaults()
+	pr := &Producer{
+		p:        p,
+		o:        oo,
+		pending:  make(chan struct{}, oo.MaxPending),
+		flushing: make(chan struct{}, oo.MaxFlushing),
+		addCh:    make(chan producerEvent),
+		flushCh:  make(chan chan []chan struct{}),
+		closeCh:  make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	go pr.spin()
+	return pr
+}
+
+func (pr *Producer) spin() {
+	defer close(pr.doneCh)
+
+	var batch []producerEvent
+	var timeout <-chan time.Time
+	// the done channels of the batches which are being flushed. Those which
+	// have been closed are pruned whenever a new one is added.
+	var flushes []chan struct{}
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		pr.flushing <- struct{}{}
+		doneCh := make(chan struct{})
+		go pr.flush(batch, doneCh)
+		batch, timeout = nil, nil
+
+		live := flushes[:0]
+		for _, ch := range flushes {
+			select {
+			case <-ch:
+			default:
+				live = append(live, ch)
+			}
+		}
+		flushes = append(live, doneCh)
+	}
+
+	for {
+		select {
+		case e := <-pr.addCh:
+			if batch = append(batch, e); len(batch) >= pr.o.BatchSize {
+				flush()
+			} else if timeout == nil {
+				timeout = time.After(pr.o.FlushInterval)
+			}
+		case <-timeout:
+			flush()
+		case retCh := <-pr.flushCh:
+			flush()
+			retCh <- append([]chan struct{}(nil), flushes...)
+		case <-pr.closeCh:
+			flush()
+			for _, ch := range flushes {
+				<-ch
+			}
+			return
+		}
+	}
+}
+
+func (pr *Producer) flush(batch []producerEvent, doneCh chan struct{}) {
+	defer close(doneCh)
+	defer func() { <-pr.flushing }()
+
+	cc := make([]QAddCommand, len(batch))
+	for i := range batch {
+		cc[i] = batch[i].c
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pr.o.FlushTimeout)
+	defer cancel()
+	ii, err := pr.p.QAddMulti(ctx, cc)
+	for i, e := range batch {
+		if err != nil {
+			e.fn(core.ID{}, err)
+		} else {
+			e.fn(ii[i], nil)
+		}
+		<-pr.pending
+	}
+}
+
+// AddFunc buffers an event to be added, and calls fn with the event's ID (see
+// QAdd), or the error which prevented it from being added, once it has been
+// flushed. fn is called from the Producer's own goroutines, and should not
+// block.
+//
+// If MaxPending events are already buffered or being flushed AddFunc blocks
+// until there's room, or ctx is done. An error is returned, and fn won't be
+// called, if ctx is done first, if the command's fields are invalid or its
+// Payload can't be marshaled, or if the Producer has been closed.
+func (pr *Producer) AddFunc(ctx context.Context, c QAddCommand, fn func(core.ID, error)) error {
+	if err := pr.p.encodePayload(&c); err != nil {
+		return err
+	} else if err := pr.p.checkQAdd(c); err != nil {
+		return err
+	} else if _, err := queueAvailable(c.Queue); err != nil {
+		return err
+	}
+
+	select {
+	case <-pr.closeCh:
+		return ErrProducerClosed
+	default:
+	}
+
+	select {
+	case pr.pending <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-pr.closeCh:
+		return ErrProducerClosed
+	}
+
+	select {
+	case pr.addCh <- producerEvent{c: c, fn: fn}:
+		return nil
+	case <-ctx.Done():
+		<-pr.pending
+		return ctx.Err()
+	case <-pr.closeCh:
+		<-pr.pending
+		return ErrProducerClosed
+	}
+}
+
+// ProducerResult is returned by a Producer's Add, and is completed once the
+// event's batch has been flushed
+type ProducerResult struct {
+	doneCh chan struct{}
+	id     core.ID
+	err    error
+}
+
+// Done returns a channel which is closed once the event's batch has been
+// flushed
+func (r *ProducerResult) Done() <-chan struct{} {
+	return r.doneCh
+}
+
+// Wait blocks until the event's batch has been flushed, and returns the event's
+// ID (see QAdd) or the error which prevented it from being added. If ctx is
+// done first its error is returned, though the event may still be added.
+func (r *ProducerResult) Wait(ctx context.Context) (core.ID, error) {
+	select {
+	case <-r.doneCh:
+		return r.id, r.err
+	case <-ctx.Done():
+		return core.ID{}, ctx.Err()
+	}
+}
+
+// Add is like AddFunc, but returns a ProducerResult which can be waited on for
+// the event to be added
+func (pr *Producer) Add(ctx context.Context, c QAddCommand) (*ProducerResult, error) {
+	r := &ProducerResult{doneCh: make(chan struct{})}
+	err := pr.AddFunc(ctx, c, func(id core.ID, err error) {
+		r.id, r.err = id, err
+		close(r.doneCh)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Flush immediately flushes all buffered events, and waits until every event
+// which was added before it was called has been completed, or until ctx is
+// done, in which case ctx's error is returned.
+func (pr *Producer) Flush(ctx context.Context) error {
+	retCh := make(chan []chan struct{}, 1)
+	select {
+	case pr.flushCh <- retCh:
+	case <-pr.doneCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var flushes []chan struct{}
+	select {
+	case flushes = <-retCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for _, ch := range flushes {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Close stops the Producer from accepting any more events, flushes any which
+// are buffered, and waits until all of them have been completed or ctx is done,
+// in which case ctx's error is returned and the remaining events are completed
+// in the background. Close may be called more than once.
+func (pr *Producer) Close(ctx context.Context) error {
+	pr.closeOnce.Do(func() { close(pr.closeCh) })
+	select {
+	case <-pr.doneCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,145 @@
+package peel
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testProducerAdd(t *T, pr *Producer, queue string) (*ProducerResult, string) {
+	contents := testutil.RandStr()
+	r, err := pr.Add(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(time.Minute),
+		Contents: contents,
+	})
+	require.Nil(t, err)
+	return r, contents
+}
+
+func assertProducerNotDone(t *T, rr ...*ProducerResult) {
+	for _, r := range rr {
+		select {
+		case <-r.Done():
+			assert.Fail(t, "event was flushed")
+		default:
+		}
+	}
+}
+
+func assertProducerDone(t *T, rr ...*ProducerResult) {
+	ctx, cancel := context.WithTimeout(testCtx, time.Second)
+	defer cancel()
+	for _, r := range rr {
+		_, err := r.Wait(ctx)
+		assert.Nil(t, err)
+	}
+}
+
+func TestProducer(t *T) {
+	queue := testutil.RandStr()
+	pr := NewProducer(testPeel, &ProducerOpts{BatchSize: 10, MaxFlushing: 1})
+
+	var rr []*ProducerResult
+	var contents []string
+	for i := 0; i < 25; i++ {
+		r, c := testProducerAdd(t, pr, queue)
+		rr, contents = append(rr, r), append(contents, c)
+	}
+
+	// With only one batch flushed at a time the events are added in order
+	cgroup := testutil.RandStr()
+	for i, r := range rr {
+		id, err := r.Wait(testCtx)
+		require.Nil(t, err)
+		e, err := testPeel.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+		require.Nil(t, err)
+		assert.Equal(t, id, e.ID)
+		assert.Equal(t, contents[i], e.Contents)
+	}
+
+	// Invalid events are rejected straight away, rather than failing their
+	// batch
+	_, err := pr.Add(testCtx, QAddCommand{Queue: queue, Contents: "foo", Priority: MaxPriority + 1})
+	assert.NotNil(t, err)
+
+	require.Nil(t, pr.Close(testCtx))
+	_, err = pr.Add(testCtx, QAddCommand{Queue: queue, Contents: "foo"})
+	assert.Equal(t, ErrProducerClosed, err)
+	assert.Nil(t, pr.Close(testCtx))
+}
+
+func TestProducerFlush(t *T) {
+	queue := testutil.RandStr()
+	pr := NewProducer(testPeel, &ProducerOpts{BatchSize: 3, FlushInterval: time.Hour})
+
+	// Nothing is flushed until there's a full batch
+	r1, _ := testProducerAdd(t, pr, queue)
+	r2, _ := testProducerAdd(t, pr, queue)
+	time.Sleep(50 * time.Millisecond)
+	assertProducerNotDone(t, r1, r2)
+
+	r3, _ := testProducerAdd(t, pr, queue)
+	assertProducerDone(t, r1, r2, r3)
+
+	// Or until Flush is called
+	r4, _ := testProducerAdd(t, pr, queue)
+	time.Sleep(50 * time.Millisecond)
+	assertProducerNotDone(t, r4)
+	require.Nil(t, pr.Flush(testCtx))
+	assertProducerDone(t, r4)
+
+	// Or Close
+	r5, _ := testProducerAdd(t, pr, queue)
+	require.Nil(t, pr.Close(testCtx))
+	assertProducerDone(t, r5)
+	require.Nil(t, pr.Flush(testCtx))
+
+	// Or the FlushInterval passes
+	pr = NewProducer(testPeel, &ProducerOpts{FlushInterval: 20 * time.Millisecond})
+	defer pr.Close(testCtx)
+	r6, _ := testProducerAdd(t, pr, queue)
+	assertProducerDone(t, r6)
+
+	qsm, err := testPeel.QStatus(testCtx, QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: nil},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(6), qsm[queue].Total)
+}
+
+func TestProducerBackpressure(t *T) {
+	queue := testutil.RandStr()
+	pr := NewProducer(testPeel, &ProducerOpts{BatchSize: 10, MaxPending: 2, FlushInterval: time.Hour})
+	defer pr.Close(testCtx)
+
+	var called []core.ID
+	for i := 0; i < 2; i++ {
+		err := pr.AddFunc(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(time.Minute),
+			Contents: testutil.RandStr(),
+		}, func(id core.ID, err error) {
+			assert.Nil(t, err)
+			called = append(called, id)
+		})
+		require.Nil(t, err)
+	}
+
+	ctx, cancel := context.WithTimeout(testCtx, 50*time.Millisecond)
+	defer cancel()
+	_, err := pr.Add(ctx, QAddCommand{Queue: queue, Contents: "foo"})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// Once the pending events are flushed there's room again
+	require.Nil(t, pr.Flush(testCtx))
+	assert.Len(t, called, 2)
+	r, _ := testProducerAdd(t, pr, queue)
+	require.Nil(t, pr.Flush(testCtx))
+	assertProducerDone(t, r)
+}
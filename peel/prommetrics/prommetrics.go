@@ -0,0 +1,268 @@
+// Package prommetrics exposes metrics about a Peel and its queues to
+// prometheus. A Collector is both the core.Hook for the Peel, from which it
+// counts events and times operations, and a prometheus.Collector, which
+// additionally reports the status of every queue and consumer group each time
+// it's scraped:
+//
+//	c := prommetrics.New()
+//	p := peel.New(rpool, &peel.Opts{
+//		Opts: core.Opts{Hook: c},
+//	})
+//	c.SetPeel(p)
+//	prometheus.MustRegister(c)
+//	http.Handle("/metrics", promhttp.Handler())
+//
+// The metrics are:
+//
+//	bananaq_queue_events{queue}
+//	bananaq_queue_delayed_events{queue}
+//	bananaq_queue_paused{queue}
+//	bananaq_consumer_group_available_events{queue,consumer_group}
+//	bananaq_consumer_group_in_progress_events{queue,consumer_group}
+//	bananaq_consumer_group_redo_events{queue,consumer_group}
+//	bananaq_consumer_group_done_events{queue,consumer_group}
+//	bananaq_consumer_group_dead_events{queue,consumer_group}
+//	bananaq_consumer_group_lag_seconds{queue,consumer_group}
+//	bananaq_events_added_total{queue}
+//	bananaq_events_delivered_total{queue,consumer_group}
+//	bananaq_events_acked_total{queue,consumer_group}
+//	bananaq_events_redelivered_total{queue,consumer_group}
+//	bananaq_operation_duration_seconds{operation,queue,consumer_group}
+//	bananaq_operation_errors_total{operation,queue,consumer_group}
+//	bananaq_pool_connections{state}
+//	bananaq_pool_waits_total
+//	bananaq_pool_wait_seconds_total
+//	bananaq_pool_wait_timeouts_total
+//	bananaq_pool_closed_total{reason}
+//
+// The gauges correspond to the fields of peel.QueueStats and
+// peel.ConsumerGroupStats. The pool metrics correspond to the fields of
+// core.PoolStats, and are only reported if the Peel is using a *core.Pool.
+// Operations are peel commands, like QAdd, as well as the core operations
+// they're made of, like Query.
+package prommetrics
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// How long the QStatus performed for each scrape may take
+const statusTimeout = 10 * time.Second
+
+const namespace = "bananaq"
+
+var (
+	queueLabels  = []string{"queue"}
+	cgroupLabels = []string{"queue", "consumer_group"}
+	opLabels     = []string{"operation", "queue", "consumer_group"}
+)
+
+func newDesc(name, help string, labels []string) *prometheus.Desc {
+	return prometheus.NewDesc(namespace+"_"+name, help, labels, nil)
+}
+
+var (
+	queueEventsDesc = newDesc("queue_events",
+		"Number of events in the queue, not including expired or delayed ones",
+		queueLabels)
+	queueDelayedDesc = newDesc("queue_delayed_events",
+		"Number of events in the queue which aren't visible to consumer groups yet",
+		queueLabels)
+	queuePausedDesc = newDesc("queue_paused",
+		"1 if the queue is paused, 0 otherwise",
+		queueLabels)
+	cgroupAvailableDesc = newDesc("consumer_group_available_events",
+		"Number of events the consumer group has yet to retrieve",
+		cgroupLabels)
+	cgroupInProgressDesc = newDesc("consumer_group_in_progress_events",
+		"Number of events the consumer group has retrieved but not yet acked",
+		cgroupLabels)
+	cgroupRedoDesc = newDesc("consumer_group_redo_events",
+		"Number of events awaiting being retrieved again by the consumer group",
+		cgroupLabels)
+	cgroupDoneDesc = newDesc("consumer_group_done_events",
+		"Number of events the consumer group has finished with, which haven't yet expired",
+		cgroupLabels)
+	cgroupDeadDesc = newDesc("consumer_group_dead_events",
+		"Number of events the consumer group gave up on after reaching MaxDeliveries",
+		cgroupLabels)
+	cgroupLagDesc = newDesc("consumer_group_lag_seconds",
+		"How long before the newest available event the newest event retrieved by the consumer group became available",
+		cgroupLabels)
+	poolConnsDesc = newDesc("pool_connections",
+		"Number of open connections in the pool, by whether they're in_use or idle",
+		[]string{"state"})
+	poolWaitsDesc = newDesc("pool_waits_total",
+		"Number of times a connection had to be waited for because the pool's maximum were in use",
+		nil)
+	poolWaitSecondsDesc = newDesc("pool_wait_seconds_total",
+		"Total time spent waiting for a connection from the pool",
+		nil)
+	poolWaitTimeoutsDesc = newDesc("pool_wait_timeouts_total",
+		"Number of waits for a connection from the pool which timed out",
+		nil)
+	poolClosedDesc = newDesc("pool_closed_total",
+		"Number of pooled connections closed for having been idle (max_idle_time) or open (max_lifetime) for too long",
+		[]string{"reason"})
+)
+
+// Collector implements both core.Hook and prometheus.Collector
+type Collector struct {
+	p atomic.Pointer[peel.Peel]
+
+	added       *prometheus.CounterVec
+	delivered   *prometheus.CounterVec
+	acked       *prometheus.CounterVec
+	redelivered *prometheus.CounterVec
+	durations   *prometheus.HistogramVec
+	errors      *prometheus.CounterVec
+}
+
+// New returns an initialized Collector. Until SetPeel is called it only
+// reports the metrics it gets from being a Hook.
+func New() *Collector {
+	return &Collector{
+		added: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "events_added_total",
+			Help:      "Number of events added to the queue",
+		}, queueLabels),
+		delivered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "events_delivered_total",
+			Help:      "Number of events retrieved by the consumer group",
+		}, cgroupLabels),
+		acked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "events_acked_total",
+			Help:      "Number of events acked by the consumer group",
+		}, cgroupLabels),
+		redelivered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "events_redelivered_total",
+			Help:      "Number of events the consumer group nacked or didn't ack by their deadline",
+		}, cgroupLabels),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "operation_duration_seconds",
+			Help:      "How long each operation took to perform",
+			Buckets:   prometheus.DefBuckets,
+		}, opLabels),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "operation_errors_total",
+			Help:      "Number of operations which returned an error",
+		}, opLabels),
+	}
+}
+
+// SetPeel sets the Peel whose queues' status is reported on each scrape. It's
+// separate from New since the Collector must be given to the Peel as its Hook
+// when the Peel is created.
+func (c *Collector) SetPeel(p *peel.Peel) {
+	c.p.Store(p)
+}
+
+// Observe implements the method for the core.Hook interface
+func (c *Collector) Observe(s core.Stat) {
+	c.durations.WithLabelValues(s.Name, s.Queue, s.ConsumerGroup).Observe(s.Duration.Seconds())
+	if s.Err != nil {
+		c.errors.WithLabelValues(s.Name, s.Queue, s.ConsumerGroup).Inc()
+		return
+	}
+
+	n := float64(s.Count)
+	switch s.Name {
+	case "QAdd", "QAddMulti":
+		c.added.WithLabelValues(s.Queue).Add(n)
+	case "QGet", "QGetMulti":
+		c.delivered.WithLabelValues(s.Queue, s.ConsumerGroup).Add(n)
+	case "QAck", "QAckMulti":
+		c.acked.WithLabelValues(s.Queue, s.ConsumerGroup).Add(n)
+	case "QNack", "Clean":
+		c.redelivered.WithLabelValues(s.Queue, s.ConsumerGroup).Add(n)
+	}
+}
+
+func (c *Collector) vecs() []prometheus.Collector {
+	return []prometheus.Collector{
+		c.added, c.delivered, c.acked, c.redelivered, c.durations, c.errors,
+	}
+}
+
+// Describe implements the method for the prometheus.Collector interface
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		queueEventsDesc, queueDelayedDesc, queuePausedDesc,
+		cgroupAvailableDesc, cgroupInProgressDesc, cgroupRedoDesc,
+		cgroupDoneDesc, cgroupDeadDesc, cgroupLagDesc,
+		poolConnsDesc, poolWaitsDesc, poolWaitSecondsDesc, poolWaitTimeoutsDesc,
+		poolClosedDesc,
+	} {
+		ch <- desc
+	}
+	for _, v := range c.vecs() {
+		v.Describe(ch)
+	}
+}
+
+// Collect implements the method for the prometheus.Collector interface
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, v := range c.vecs() {
+		v.Collect(ch)
+	}
+
+	p := c.p.Load()
+	if p == nil {
+		return
+	}
+
+	if ps, ok := p.PoolStats(); ok {
+		metric := func(desc *prometheus.Desc, typ prometheus.ValueType, val float64, labels ...string) {
+			ch <- prometheus.MustNewConstMetric(desc, typ, val, labels...)
+		}
+		metric(poolConnsDesc, prometheus.GaugeValue, float64(ps.InUse), "in_use")
+		metric(poolConnsDesc, prometheus.GaugeValue, float64(ps.Idle), "idle")
+		metric(poolWaitsDesc, prometheus.CounterValue, float64(ps.WaitCount))
+		metric(poolWaitSecondsDesc, prometheus.CounterValue, ps.WaitDuration.Seconds())
+		metric(poolWaitTimeoutsDesc, prometheus.CounterValue, float64(ps.WaitTimeouts))
+		metric(poolClosedDesc, prometheus.CounterValue, float64(ps.MaxIdleTimeClosed), "max_idle_time")
+		metric(poolClosedDesc, prometheus.CounterValue, float64(ps.MaxLifetimeClosed), "max_lifetime")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+	defer cancel()
+	qsm, err := p.QStatus(ctx, peel.QStatusCommand{})
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(queueEventsDesc, err)
+		return
+	}
+
+	gauge := func(desc *prometheus.Desc, val uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(val), labels...)
+	}
+	for queue, qs := range qsm {
+		gauge(queueEventsDesc, qs.Total, queue)
+		gauge(queueDelayedDesc, qs.Delayed, queue)
+		var paused uint64
+		if qs.Paused {
+			paused = 1
+		}
+		gauge(queuePausedDesc, paused, queue)
+
+		for cgroup, cgs := range qs.ConsumerGroupStats {
+			gauge(cgroupAvailableDesc, cgs.Available, queue, cgroup)
+			gauge(cgroupInProgressDesc, cgs.InProgress, queue, cgroup)
+			gauge(cgroupRedoDesc, cgs.Redo, queue, cgroup)
+			gauge(cgroupDoneDesc, cgs.Done, queue, cgroup)
+			gauge(cgroupDeadDesc, cgs.Dead, queue, cgroup)
+			ch <- prometheus.MustNewConstMetric(cgroupLagDesc, prometheus.GaugeValue, cgs.Lag.Seconds(), queue, cgroup)
+		}
+	}
+}
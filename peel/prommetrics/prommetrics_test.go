@@ -0,0 +1,146 @@
+package prommetrics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testCtx = context.Background()
+
+func TestCollector(t *T) {
+	c := New()
+	p := peel.NewWithBackend(core.NewMemBackend(), &peel.Opts{
+		Opts: core.Opts{Hook: c},
+	})
+	c.SetPeel(p)
+	errCh := p.Run(nil)
+	go func() { panic(<-errCh) }()
+	queue, cgroup := testutil.RandStr(), testutil.RandStr()
+
+	for i := 0; i < 3; i++ {
+		_, err := p.QAdd(testCtx, peel.QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(time.Minute),
+			Contents: testutil.RandStr(),
+		})
+		require.Nil(t, err)
+	}
+
+	// One event is acked, one nacked, and one is left in progress
+	var ids []core.ID
+	for i := 0; i < 3; i++ {
+		e, err := p.QGet(testCtx, peel.QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   time.Now().Add(time.Minute),
+		})
+		require.Nil(t, err)
+		ids = append(ids, e.ID)
+	}
+	acked, err := p.QAck(testCtx, peel.QAckCommand{Queue: queue, ConsumerGroup: cgroup, EventID: ids[0]})
+	require.Nil(t, err)
+	require.True(t, acked)
+	nacked, err := p.QNack(testCtx, peel.QNackCommand{Queue: queue, ConsumerGroup: cgroup, EventID: ids[1]})
+	require.Nil(t, err)
+	require.True(t, nacked)
+
+	expected := fmt.Sprintf(`
+# HELP bananaq_consumer_group_available_events Number of events the consumer group has yet to retrieve
+# TYPE bananaq_consumer_group_available_events gauge
+bananaq_consumer_group_available_events{consumer_group="%[2]s",queue="%[1]s"} 0
+# HELP bananaq_consumer_group_in_progress_events Number of events the consumer group has retrieved but not yet acked
+# TYPE bananaq_consumer_group_in_progress_events gauge
+bananaq_consumer_group_in_progress_events{consumer_group="%[2]s",queue="%[1]s"} 1
+# HELP bananaq_consumer_group_redo_events Number of events awaiting being retrieved again by the consumer group
+# TYPE bananaq_consumer_group_redo_events gauge
+bananaq_consumer_group_redo_events{consumer_group="%[2]s",queue="%[1]s"} 1
+# HELP bananaq_consumer_group_done_events Number of events the consumer group has finished with, which haven't yet expired
+# TYPE bananaq_consumer_group_done_events gauge
+bananaq_consumer_group_done_events{consumer_group="%[2]s",queue="%[1]s"} 1
+# HELP bananaq_consumer_group_lag_seconds How long before the newest available event the newest event retrieved by the consumer group became available
+# TYPE bananaq_consumer_group_lag_seconds gauge
+bananaq_consumer_group_lag_seconds{consumer_group="%[2]s",queue="%[1]s"} 0
+# HELP bananaq_queue_events Number of events in the queue, not including expired or delayed ones
+# TYPE bananaq_queue_events gauge
+bananaq_queue_events{queue="%[1]s"} 3
+# HELP bananaq_events_added_total Number of events added to the queue
+# TYPE bananaq_events_added_total counter
+bananaq_events_added_total{queue="%[1]s"} 3
+# HELP bananaq_events_delivered_total Number of events retrieved by the consumer group
+# TYPE bananaq_events_delivered_total counter
+bananaq_events_delivered_total{consumer_group="%[2]s",queue="%[1]s"} 3
+# HELP bananaq_events_acked_total Number of events acked by the consumer group
+# TYPE bananaq_events_acked_total counter
+bananaq_events_acked_total{consumer_group="%[2]s",queue="%[1]s"} 1
+# HELP bananaq_events_redelivered_total Number of events the consumer group nacked or didn't ack by their deadline
+# TYPE bananaq_events_redelivered_total counter
+bananaq_events_redelivered_total{consumer_group="%[2]s",queue="%[1]s"} 1
+`, queue, cgroup)
+
+	err = promtestutil.CollectAndCompare(c, strings.NewReader(expected),
+		"bananaq_consumer_group_available_events",
+		"bananaq_consumer_group_in_progress_events",
+		"bananaq_consumer_group_redo_events",
+		"bananaq_consumer_group_done_events",
+		"bananaq_consumer_group_lag_seconds",
+		"bananaq_queue_events",
+		"bananaq_events_added_total",
+		"bananaq_events_delivered_total",
+		"bananaq_events_acked_total",
+		"bananaq_events_redelivered_total",
+	)
+	assert.Nil(t, err)
+
+	// Every operation is timed, both peel commands and core operations
+	sampleCount := func(op, queue, cgroup string) uint64 {
+		var m dto.Metric
+		h := c.durations.WithLabelValues(op, queue, cgroup).(prometheus.Metric)
+		require.Nil(t, h.Write(&m))
+		return m.GetHistogram().GetSampleCount()
+	}
+	assert.Equal(t, uint64(1), sampleCount("QAck", queue, cgroup))
+	assert.NotZero(t, sampleCount("Query", queue, ""))
+}
+
+func TestCollectorPool(t *T) {
+	pool, err := core.NewPool("tcp", "127.0.0.1:6379", 1, core.DialOpts{}.DialFunc(), core.PoolOpts{})
+	require.Nil(t, err)
+	defer pool.Close()
+	c := New()
+	p := peel.New(pool, &peel.Opts{Opts: core.Opts{Hook: c}})
+	c.SetPeel(p)
+
+	_, ok := p.PoolStats()
+	require.True(t, ok)
+	expected := `
+# HELP bananaq_pool_connections Number of open connections in the pool, by whether they're in_use or idle
+# TYPE bananaq_pool_connections gauge
+bananaq_pool_connections{state="idle"} 1
+bananaq_pool_connections{state="in_use"} 0
+# HELP bananaq_pool_wait_timeouts_total Number of waits for a connection from the pool which timed out
+# TYPE bananaq_pool_wait_timeouts_total counter
+bananaq_pool_wait_timeouts_total 0
+`
+	err = promtestutil.CollectAndCompare(c, strings.NewReader(expected),
+		"bananaq_pool_connections",
+		"bananaq_pool_wait_timeouts_total",
+	)
+	assert.Nil(t, err)
+
+	// A Peel which isn't using a *core.Pool doesn't report pool metrics
+	c = New()
+	c.SetPeel(peel.NewWithBackend(core.NewMemBackend(), nil))
+	assert.Zero(t, promtestutil.CollectAndCount(c, "bananaq_pool_connections"))
+}
@@ -1,7 +1,10 @@
 package peel
 
 import (
+	"context"
 	"fmt"
+	"hash/fnv"
+	"strconv"
 	"strings"
 
 	"github.com/mediocregopher/bananaq/core"
@@ -39,8 +42,21 @@ func queueKeyUnmarshal(k core.Key) (core.Key, error) {
 	return k, nil
 }
 
+// Held by whichever Peel is running CleanAll for the current CleanPeriod. It has
+// no Subs, so it's never mistaken for one of a queue's keys.
+var keyCleanLock = core.Key{Base: "clean-lock"}
+
+// Hash holding a tenant's TenantConfig, along with the token bucket for its
+// AddRate. Queue names can't contain ':', and it has no Subs, so it's never
+// mistaken for one of a queue's keys. Subs is empty rather than nil since it's
+// used in a Query.
+func tenantKey(tenant string) core.Key {
+	return core.Key{Base: "tenant:" + tenant, Subs: []string{}}
+}
+
 // Keeps track of events which are available to be retrieved by any particular
-// consumer group, with scores corresponding to the event's id.
+// consumer group, with scores corresponding to the event's id, or to the time
+// the event became visible if it was delayed.
 func queueAvailable(queue string) (exWrap, error) {
 	k, err := queueKeyMarshal(core.Key{Base: queue, Subs: []string{"available"}})
 	if err != nil {
@@ -49,6 +65,210 @@ func queueAvailable(queue string) (exWrap, error) {
 	return newExWrap(k), nil
 }
 
+// Keeps track of events which have been added to the queue but aren't yet
+// visible to consumer groups, with scores corresponding to the time they become
+// visible. Once visible they are moved into available.
+func queueDelayed(queue string) (exWrap, error) {
+	k, err := queueKeyMarshal(core.Key{Base: queue, Subs: []string{"delayed"}})
+	if err != nil {
+		return exWrap{}, err
+	}
+	return newExWrap(k), nil
+}
+
+// Events with a non-zero priority are kept in their own avail and delayed sets,
+// one per priority, alongside the ones above. The sets for priority zero are
+// the ones above, so queues which don't use priorities are unaffected.
+
+func queuePrioritySubs(subs []string, priority int) []string {
+	if priority == 0 {
+		return subs
+	}
+	return append(subs, strconv.Itoa(priority))
+}
+
+// returns the avail set for every priority, indexed by priority
+func queueAvailableBands(queue string) ([]exWrap, error) {
+	ewAvails := make([]exWrap, MaxPriority+1)
+	for i := range ewAvails {
+		subs := queuePrioritySubs([]string{"available"}, i)
+		k, err := queueKeyMarshal(core.Key{Base: queue, Subs: subs})
+		if err != nil {
+			return nil, err
+		}
+		ewAvails[i] = newExWrap(k)
+	}
+	return ewAvails, nil
+}
+
+// returns the delayed set for every priority, indexed by priority
+func queueDelayedBands(queue string) ([]exWrap, error) {
+	ewDelayeds := make([]exWrap, MaxPriority+1)
+	for i := range ewDelayeds {
+		subs := queuePrioritySubs([]string{"delayed"}, i)
+		k, err := queueKeyMarshal(core.Key{Base: queue, Subs: subs})
+		if err != nil {
+			return nil, err
+		}
+		ewDelayeds[i] = newExWrap(k)
+	}
+	return ewDelayeds, nil
+}
+
+// The number of fair backlog sets each fair queue has, see queueFairBacklogs.
+// PartitionKeys which hash to the same set share it.
+const fairBuckets = 16
+
+// Keeps track of events which have been added to a fair queue (see
+// QueueConfig's Fair) but not yet made available, one set per bucket of
+// PartitionKeys, with scores corresponding to the event's id. Events are moved
+// into the priority zero avail round-robin across the sets, see promoteFair.
+func queueFairBacklogs(queue string) ([]exWrap, error) {
+	ewFairs := make([]exWrap, fairBuckets)
+	for i := range ewFairs {
+		k, err := queueKeyMarshal(core.Key{Base: queue, Subs: []string{"fair", strconv.Itoa(i)}})
+		if err != nil {
+			return nil, err
+		}
+		ewFairs[i] = newExWrap(k)
+	}
+	return ewFairs, nil
+}
+
+// returns the index of the fair backlog set which events with the given
+// PartitionKey go into
+func fairBucket(partitionKey string) int {
+	h := fnv.New32a()
+	h.Write([]byte(partitionKey))
+	return int(h.Sum32() % fairBuckets)
+}
+
+// The default and the greatest number of group sets a queue may have, see
+// QueueConfig's GroupBuckets
+const (
+	defaultGroupBuckets = 16
+	maxGroupBuckets     = 256
+)
+
+// Keeps track of events which were added with a GroupID, one set per bucket of
+// GroupIDs, with scores corresponding to the event's id. They're used like
+// avail, except each consumer group only retrieves an event from a set when it
+// has none of that set's events in progress.
+//
+// Every set a queue could have is returned, so that all of its keys can be
+// found. Only the first GroupBuckets of them (see QueueConfig) are used.
+func queueGroups(queue string) ([]exWrap, error) {
+	ewGroups := make([]exWrap, maxGroupBuckets)
+	for i := range ewGroups {
+		k, err := queueKeyMarshal(core.Key{Base: queue, Subs: []string{"group", strconv.Itoa(i)}})
+		if err != nil {
+			return nil, err
+		}
+		ewGroups[i] = newExWrap(k)
+	}
+	return ewGroups, nil
+}
+
+// like queueGroups, but only returns the sets which the queue uses
+func (p *Peel) usedQueueGroups(ctx context.Context, queue string) ([]exWrap, error) {
+	qc, err := p.cachedConfig(ctx, queue)
+	if err != nil {
+		return nil, err
+	}
+	ewGroups, err := queueGroups(queue)
+	if err != nil {
+		return nil, err
+	}
+	return ewGroups[:qc.groupBuckets()], nil
+}
+
+// returns the index of the group set which events with the given GroupID go
+// into, out of the given number of them
+func groupBucket(groupID string, buckets int) int {
+	h := fnv.New32a()
+	h.Write([]byte(groupID))
+	return int(h.Sum32() % uint32(buckets))
+}
+
+// Single key per DedupKey given to QAdd, holding the ID of the event which was
+// added with it. Expires after the DedupWindow.
+func queueDedup(queue, dedupKey string) (core.Key, error) {
+	return queueKeyMarshal(core.Key{Base: queue, Subs: []string{"dedup", dedupKey}})
+}
+
+// Single key which, if set, indicates that the queue is paused and no events
+// should be retrieved from it. Holds an ID whose T is the time the queue was
+// paused.
+func queuePaused(queue string) (core.Key, error) {
+	return queueKeyMarshal(core.Key{Base: queue, Subs: []string{"paused"}})
+}
+
+// Single key which, if set, indicates that the queue has StrictFIFO set in its
+// QueueConfig. It's kept apart from the config so that QGet can check it within
+// its query. Holds an ID whose T is the time it was set.
+func queueStrict(queue string) (core.Key, error) {
+	return queueKeyMarshal(core.Key{Base: queue, Subs: []string{"strict"}})
+}
+
+// Hash which, if set, indicates that the queue is being migrated to another
+// redis, see Migrate. Holds the times the queue started being dual-written and
+// was cut over, see migration.
+func queueMigration(queue string) (core.Key, error) {
+	return queueKeyMarshal(core.Key{Base: queue, Subs: []string{"migration"}})
+}
+
+// Hash holding the queue's QueueConfig, see QSetConfig
+func queueConfig(queue string) (core.Key, error) {
+	return queueKeyMarshal(core.Key{Base: queue, Subs: []string{"config"}})
+}
+
+// Keeps track of the events which are being kept for replay (see QueueConfig's
+// ReplayRetention), with scores corresponding to the event's id. It isn't an
+// exWrap, since its events are kept after they've expired.
+func queueReplay(queue string) (core.Key, error) {
+	return queueKeyMarshal(core.Key{Base: queue, Subs: []string{"replay"}})
+}
+
+// The pubsub channel which Notifications about the queue's events are published
+// to, see QWatch. Nothing is stored at it.
+func queueNotify(queue string) (core.Key, error) {
+	return queueKeyMarshal(core.Key{Base: queue, Subs: []string{"notify"}})
+}
+
+// Records when events made the given transition (see QTrace), with scores
+// corresponding to the time they made it. Transitions which happen to a queue's
+// events as a whole are recorded with an empty cgroup, the rest are recorded for
+// the consumer group they happened in.
+func queueTrace(queue, cgroup string, state TraceState) (core.Key, error) {
+	if cgroup == "" {
+		return queueKeyMarshal(core.Key{Base: queue, Subs: []string{"trace", string(state)}})
+	}
+	return queueKeyMarshal(core.Key{Base: queue, Subs: []string{cgroup, "trace", string(state)}})
+}
+
+// returns all of the keys queueTrace uses for the queue's events as a whole, or
+// for one of its consumer groups if cgroup is given
+func queueTraces(queue, cgroup string) ([]core.Key, error) {
+	states := queueTraceStates
+	if cgroup != "" {
+		states = cgroupTraceStates
+	}
+	kk := make([]core.Key, len(states))
+	for i, state := range states {
+		var err error
+		if kk[i], err = queueTrace(queue, cgroup, state); err != nil {
+			return nil, err
+		}
+	}
+	return kk, nil
+}
+
+// Single key per event which was QAck'd with a Result, holding the Result.
+// Expires after the ResultTTL.
+func queueResult(queue string, id core.ID) (core.Key, error) {
+	return queueKeyMarshal(core.Key{Base: queue, Subs: []string{"result", id.String()}})
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 // Keeps track of events that are currently in progress, with scores
@@ -62,6 +282,20 @@ func queueInProgress(queue, cgroup string) (exWrap, error) {
 	return newExWrap(k), nil
 }
 
+// Hash which keeps track of which consumer claimed each in progress event,
+// for events retrieved with a consumer ID. Fields are removed whenever the
+// event is removed from inProg.
+func queueClaims(queue, cgroup string) (core.Key, error) {
+	return queueKeyMarshal(core.Key{Base: queue, Subs: []string{cgroup, "claims"}})
+}
+
+// Hash holding the cgroup's RateLimit along with the state of its token bucket,
+// see core.QueryAction's RateLimit field. Unlike the cgroup's other keys this is
+// configuration, so it's left alone when the cgroup's state is reset.
+func queueRateLimit(queue, cgroup string) (core.Key, error) {
+	return queueKeyMarshal(core.Key{Base: queue, Subs: []string{cgroup, "ratelimit"}})
+}
+
 // Keeps track of events which were previously attempted to be processed but
 // failed. Score is the event's id
 func queueRedo(queue, cgroup string) (exWrap, error) {
@@ -72,12 +306,112 @@ func queueRedo(queue, cgroup string) (exWrap, error) {
 	return newExWrap(k), nil
 }
 
+// Keeps track of how many times each event has been retrieved with an ack
+// deadline by the cgroup, with scores corresponding to the number of attempts.
+// Events which are dead-lettered keep their entry until they're redriven.
+func queueAttempts(queue, cgroup string) (exWrap, error) {
+	k, err := queueKeyMarshal(core.Key{Base: queue, Subs: []string{cgroup, "attempts"}})
+	if err != nil {
+		return exWrap{}, err
+	}
+	return newExWrap(k), nil
+}
+
+// Keeps track of the latest delivery of each event retrieved with an ack
+// deadline by the cgroup, with scores corresponding to the delivery's token
+// (see core.Event's DeliveryToken). Events are removed when they're ack'd or
+// nack'd, otherwise they're left until they're delivered again or expire.
+func queueDeliveries(queue, cgroup string) (exWrap, error) {
+	k, err := queueKeyMarshal(core.Key{Base: queue, Subs: []string{cgroup, "deliveries"}})
+	if err != nil {
+		return exWrap{}, err
+	}
+	return newExWrap(k), nil
+}
+
+// Keeps track of events which were attempted too many times by the cgroup, and
+// so won't be attempted again unless explicitly redriven. Score is the event's
+// id
+func queueDead(queue, cgroup string) (exWrap, error) {
+	k, err := queueKeyMarshal(core.Key{Base: queue, Subs: []string{cgroup, "dead"}})
+	if err != nil {
+		return exWrap{}, err
+	}
+	return newExWrap(k), nil
+}
+
+// Single key per consumer which has retrieved events for the cgroup with a
+// ConsumerID, holding the TS it last did so. It expires after ConsumerTTL (see
+// Opts), so only active consumers have one.
+func queueConsumer(queue, cgroup, consumerID string) (core.Key, error) {
+	return queueKeyMarshal(core.Key{Base: queue, Subs: []string{cgroup, "consumer", consumerID}})
+}
+
+// Hash of event ID to the error the event was last QNack'd with by the cgroup.
+// Entries are removed when the event is ack'd, redriven or expires.
+func queueErrors(queue, cgroup string) (core.Key, error) {
+	return queueKeyMarshal(core.Key{Base: queue, Subs: []string{cgroup, "errors"}})
+}
+
+func queueDeadLetterKeys(queue, cgroup string) (exWrap, exWrap, error) {
+	ewAttempts, err := queueAttempts(queue, cgroup)
+	if err != nil {
+		return exWrap{}, exWrap{}, err
+	}
+
+	ewDead, err := queueDead(queue, cgroup)
+	if err != nil {
+		return exWrap{}, exWrap{}, err
+	}
+
+	return ewAttempts, ewDead, nil
+}
+
 // Single key, used to keep track of newest event retrieved from avail by the
-// cgroup
+// cgroup. The ID stored has its T replaced with the event's score in avail (see
+// QuerySingleSet's ScoreFrom), since an event's score might not match its T if
+// it was delayed.
 func queuePointer(queue, cgroup string) (core.Key, error) {
 	return queueKeyMarshal(core.Key{Base: queue, Subs: []string{cgroup, "ptr"}})
 }
 
+// returns the cgroup's pointer into the avail set of every priority, indexed by
+// priority
+func queuePointerBands(queue, cgroup string) ([]core.Key, error) {
+	kk := make([]core.Key, MaxPriority+1)
+	for i := range kk {
+		subs := queuePrioritySubs([]string{cgroup, "ptr"}, i)
+		var err error
+		if kk[i], err = queueKeyMarshal(core.Key{Base: queue, Subs: subs}); err != nil {
+			return nil, err
+		}
+	}
+	return kk, nil
+}
+
+// returns the cgroup's pointer into each group set (see queueGroups), like
+// queuePointerBands, along with the set of the cgroup's events in progress
+// which came from each. An event stays in the latter until it's no longer in
+// inProg or redo, which QGet checks for before retrieving from the group set.
+// Like queueGroups every one the queue could have is returned.
+func queueGroupCGroupKeys(queue, cgroup string) ([]core.Key, []exWrap, error) {
+	kk := make([]core.Key, maxGroupBuckets)
+	ewGroupInProgs := make([]exWrap, maxGroupBuckets)
+	for i := range kk {
+		var err error
+		b := strconv.Itoa(i)
+		if kk[i], err = queueKeyMarshal(core.Key{Base: queue, Subs: []string{cgroup, "groupptr", b}}); err != nil {
+			return nil, nil, err
+		}
+		k, err := queueKeyMarshal(core.Key{Base: queue, Subs: []string{cgroup, "groupinprog", b}})
+		if err != nil {
+			return nil, nil, err
+		}
+		ewGroupInProgs[i] = newExWrap(k)
+	}
+	return kk, ewGroupInProgs, nil
+}
+
 func queueCGroupKeys(queue, cgroup string) (exWrap, exWrap, core.Key, error) {
 	ewInProg, err := queueInProgress(queue, cgroup)
 	if err != nil {
@@ -97,13 +431,84 @@ func queueCGroupKeys(queue, cgroup string) (exWrap, exWrap, core.Key, error) {
 	return ewInProg, ewRedo, keyPtr, nil
 }
 
+// returns every key which holds state for the cgroup
+func queueCGroupAllKeys(queue, cgroup string) ([]core.Key, error) {
+	ewInProg, ewRedo, _, err := queueCGroupKeys(queue, cgroup)
+	if err != nil {
+		return nil, err
+	}
+
+	ewAttempts, ewDead, err := queueDeadLetterKeys(queue, cgroup)
+	if err != nil {
+		return nil, err
+	}
+
+	kk, err := queuePointerBands(queue, cgroup)
+	if err != nil {
+		return nil, err
+	}
+
+	keyClaims, err := queueClaims(queue, cgroup)
+	if err != nil {
+		return nil, err
+	}
+	kk = append(kk, keyClaims)
+
+	keyErrors, err := queueErrors(queue, cgroup)
+	if err != nil {
+		return nil, err
+	}
+	kk = append(kk, keyErrors)
+
+	ewDeliveries, err := queueDeliveries(queue, cgroup)
+	if err != nil {
+		return nil, err
+	}
+
+	keyGroupPtrs, ewGroupInProgs, err := queueGroupCGroupKeys(queue, cgroup)
+	if err != nil {
+		return nil, err
+	}
+	kk = append(kk, keyGroupPtrs...)
+
+	keyTraces, err := queueTraces(queue, cgroup)
+	if err != nil {
+		return nil, err
+	}
+	kk = append(kk, keyTraces...)
+
+	ews := []exWrap{ewInProg, ewRedo, ewAttempts, ewDead, ewDeliveries}
+	for _, ew := range append(ews, ewGroupInProgs...) {
+		kk = append(kk, ew.byArb, ew.byExp)
+	}
+	return kk, nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 // AllQueuesConsumerGroups returns a map whose keys are all the currently known
 // queues, and the values are a list of known consumer groups for each queue. A
 // queue may have no known consumer groups, but the slice will never be nil.
-func (p Peel) AllQueuesConsumerGroups() (map[string][]string, error) {
-	kk, err := p.c.KeyScan(core.Key{Base: "*", Subs: []string{"*"}})
+func (p Peel) AllQueuesConsumerGroups(ctx context.Context) (map[string][]string, error) {
+	return p.scanQueuesConsumerGroups(ctx, core.Key{Base: "*", Subs: []string{"*"}})
+}
+
+// returns the known consumer groups for a single queue. This may be empty
+func (p Peel) queueConsumerGroups(ctx context.Context, queue string) ([]string, error) {
+	k, err := queueKeyMarshal(core.Key{Base: queue, Subs: []string{"*"}})
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := p.scanQueuesConsumerGroups(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	return m[queue], nil
+}
+
+func (p Peel) scanQueuesConsumerGroups(ctx context.Context, scanK core.Key) (map[string][]string, error) {
+	kk, err := p.c.KeyScan(ctx, scanK)
 	if err != nil {
 		return nil, err
 	}
@@ -113,10 +518,19 @@ func (p Peel) AllQueuesConsumerGroups() (map[string][]string, error) {
 		if k, err = queueKeyUnmarshal(k); err != nil {
 			return nil, err
 		}
+		// Skip the keys which hold the queue's settings, or which are left
+		// behind by its events, so that the queue isn't known just because of
+		// them, e.g. after it's flushed
+		switch k.Subs[0] {
+		case "dedup", "paused", "strict", "config", "result", "migration":
+			continue
+		}
 		if m[k.Base] == nil {
 			m[k.Base] = map[string]struct{}{}
 		}
-		if k.Subs[0] == "available" {
+		// Skip the keys which belong to the queue rather than a consumer group
+		switch k.Subs[0] {
+		case "available", "delayed", "fair", "group", "replay", "trace":
 			continue
 		}
 		m[k.Base][k.Subs[0]] = struct{}{}
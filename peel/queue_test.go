@@ -5,6 +5,7 @@ import (
 
 	"github.com/levenlabs/golib/testutil"
 	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/radix.v2/cluster"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -28,7 +29,7 @@ func TestAllQueuesCGroups(t *T) {
 				},
 			},
 		}
-		_, err := p.c.Query(qa)
+		_, err := p.c.Query(testCtx, qa)
 		require.Nil(t, err)
 	}
 
@@ -60,11 +61,58 @@ func TestAllQueuesCGroups(t *T) {
 	requireAddToKey(t, ew12.byArb)
 	requireAddToKey(t, ew23.byArb)
 
-	m, err := p.AllQueuesConsumerGroups()
+	m, err := p.AllQueuesConsumerGroups(testCtx)
 	require.Nil(t, err)
 	assert.Len(t, m, 3)
 	assert.Contains(t, m[q1], cg1)
 	assert.Contains(t, m[q1], cg2)
 	assert.Contains(t, m[q2], cg3)
 	assert.Empty(t, m[q3])
+
+	cgs, err := p.queueConsumerGroups(testCtx, q1)
+	require.Nil(t, err)
+	assert.Len(t, cgs, 2)
+	assert.Contains(t, cgs, cg1)
+	assert.Contains(t, cgs, cg2)
+}
+
+func TestQueueKeysSameSlot(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+
+	var kk []core.Key
+	ewAvails, err := queueAvailableBands(queue)
+	require.Nil(t, err)
+	ewDelayeds, err := queueDelayedBands(queue)
+	require.Nil(t, err)
+	for _, ew := range append(ewAvails, ewDelayeds...) {
+		kk = append(kk, ew.byArb, ew.byExp)
+	}
+
+	for _, fn := range []func(string) (core.Key, error){queuePaused, queueConfig} {
+		k, err := fn(queue)
+		require.Nil(t, err)
+		kk = append(kk, k)
+	}
+	k, err := queueDedup(queue, testutil.RandStr())
+	require.Nil(t, err)
+	kk = append(kk, k)
+	k, err = queueResult(queue, randID(t, false))
+	require.Nil(t, err)
+	kk = append(kk, k)
+	k, err = queueRateLimit(queue, cgroup)
+	require.Nil(t, err)
+	kk = append(kk, k)
+
+	cgKeys, err := queueCGroupAllKeys(queue, cgroup)
+	require.Nil(t, err)
+	kk = append(kk, cgKeys...)
+
+	// Every key for a queue must be in the same cluster slot, so that queries
+	// on it work when running against a cluster
+	prefix := testPeel.o.RedisPrefix
+	slot := cluster.Slot(kk[0].String(prefix))
+	for _, k := range kk[1:] {
+		assert.Equal(t, slot, cluster.Slot(k.String(prefix)), "k:%q", k.String(prefix))
+	}
 }
@@ -0,0 +1,132 @@
+package peel
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Schedule describes an event which should be added to a queue on a recurring
+// basis, according to a cron expression.
+type Schedule struct {
+	// Required. Identifies the schedule, and may not contain ':'. Peel
+	// instances which have a Schedule with the same Name and Queue will
+	// coordinate so that only one of them adds each event.
+	Name string
+
+	Queue    string        // Required
+	Cron     string        // Required
+	Contents string        // Required
+	Expire   time.Duration // Required, how long each added event will live
+
+	// Optional. See QAddCommand
+	Priority int
+
+	// Optional, defaults to UTC. The location the Cron expression is evaluated
+	// in.
+	Location *time.Location
+}
+
+type scheduled struct {
+	Schedule
+	cron cronSchedule
+	next time.Time
+}
+
+type scheduler struct {
+	l sync.Mutex
+	m map[string]*scheduled
+}
+
+// AddSchedule registers the given Schedule with the Peel, replacing any
+// existing Schedule with the same Name. While Run is running events will be
+// added to the Schedule's queue whenever its Cron expression matches. Times
+// which are missed, e.g. because Run wasn't running, are skipped.
+//
+// The Cron expression is a standard five field one (minute, hour, day of
+// month, month, day of week), or one of @yearly, @monthly, @weekly, @daily or
+// @hourly.
+//
+// Schedules are not stored in the database. Every Peel instance which should be
+// able to add a Schedule's events must have AddSchedule called on it. If
+// multiple instances have the same Schedule only one of them will add each
+// event, so long as their clocks are no more than Opts.DedupWindow apart.
+func (p *Peel) AddSchedule(s Schedule) error {
+	if s.Name == "" || s.Queue == "" || s.Expire <= 0 {
+		return errors.New("Name, Queue and Expire are required")
+	} else if s.Priority < 0 || s.Priority > MaxPriority {
+		return errors.New("invalid Priority")
+	} else if err := p.checkContents(s.Contents); err != nil {
+		return err
+	}
+	if _, err := queueDedup(s.Queue, scheduleDedupKey(s.Name, time.Time{})); err != nil {
+		return err
+	}
+
+	cs, err := parseCron(s.Cron)
+	if err != nil {
+		return err
+	}
+
+	if s.Location == nil {
+		s.Location = time.UTC
+	}
+
+	next := cs.next(time.Now().In(s.Location))
+	if next.IsZero() {
+		return errors.New("Cron expression never matches")
+	}
+
+	p.sched.l.Lock()
+	defer p.sched.l.Unlock()
+	p.sched.m[s.Name] = &scheduled{
+		Schedule: s,
+		cron:     cs,
+		next:     next,
+	}
+	return nil
+}
+
+// RemoveSchedule unregisters the Schedule with the given Name from the Peel. It
+// does nothing if there's no such Schedule.
+func (p *Peel) RemoveSchedule(name string) {
+	p.sched.l.Lock()
+	defer p.sched.l.Unlock()
+	delete(p.sched.m, name)
+}
+
+func scheduleDedupKey(name string, t time.Time) string {
+	return "schedule_" + name + "_" + strconv.FormatInt(t.Unix(), 10)
+}
+
+// runSchedules adds an event for every Schedule which was due at or before now,
+// and works out when each is next due. A Schedule which was due multiple times
+// only has a single event added.
+func (p *Peel) runSchedules(ctx context.Context, now time.Time) error {
+	p.sched.l.Lock()
+	defer p.sched.l.Unlock()
+
+	for _, s := range p.sched.m {
+		if s.next.IsZero() || s.next.After(now) {
+			continue
+		}
+
+		// The DedupKey is based on the time the event was due, so all Peel
+		// instances will use the same one for it
+		_, err := p.QAdd(ctx, QAddCommand{
+			Queue:    s.Queue,
+			Expire:   now.Add(s.Expire),
+			Contents: s.Contents,
+			Priority: s.Priority,
+			DedupKey: scheduleDedupKey(s.Name, s.next),
+		})
+		if err != nil {
+			return err
+		}
+
+		s.next = s.cron.next(now.In(s.Location))
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package peel
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedule(t *T) {
+	rpool, err := pool.New("tcp", "127.0.0.1:6379", 10)
+	require.Nil(t, err)
+
+	// A second peel sharing testPeel's prefix, as if it were a different
+	// process, so they should coordinate
+	o := testPeel.o
+	p2 := New(rpool, &o)
+
+	queue := testutil.RandStr()
+	s := Schedule{
+		Name:     testutil.RandStr(),
+		Queue:    queue,
+		Cron:     "* * * * *",
+		Contents: testutil.RandStr(),
+		Expire:   10 * time.Minute,
+	}
+	for _, p := range []*Peel{testPeel, p2} {
+		require.Nil(t, p.AddSchedule(s))
+	}
+	defer testPeel.RemoveSchedule(s.Name)
+
+	qsm := func() uint64 {
+		m, err := testPeel.QStatus(testCtx, QStatusCommand{
+			QueuesConsumerGroups: map[string][]string{queue: nil},
+		})
+		require.Nil(t, err)
+		return m[queue].Total
+	}
+
+	now := time.Now()
+	require.Nil(t, testPeel.runSchedules(testCtx, now))
+	require.Nil(t, p2.runSchedules(testCtx, now))
+	assert.Equal(t, uint64(0), qsm())
+
+	// Both peels hit the same due time, only one event should be added
+	now = now.Add(1 * time.Minute)
+	require.Nil(t, testPeel.runSchedules(testCtx, now))
+	require.Nil(t, p2.runSchedules(testCtx, now))
+	assert.Equal(t, uint64(1), qsm())
+
+	require.Nil(t, testPeel.runSchedules(testCtx, now))
+	assert.Equal(t, uint64(1), qsm())
+
+	// Once removed no more events are added
+	p2.RemoveSchedule(s.Name)
+	now = now.Add(1 * time.Minute)
+	require.Nil(t, p2.runSchedules(testCtx, now))
+	assert.Equal(t, uint64(1), qsm())
+
+	assert.NotNil(t, testPeel.AddSchedule(Schedule{
+		Name:   testutil.RandStr(),
+		Queue:  queue,
+		Cron:   "not a cron",
+		Expire: 1 * time.Minute,
+	}))
+}
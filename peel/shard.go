@@ -0,0 +1,294 @@
+package peel
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// A sharded queue (see QueueConfig's Shards) is made up of a number of shard
+// queues, each of which is an ordinary queue with its own keys. Since each
+// queue's keys share a hashtag, the shards will generally end up on different
+// nodes of a cluster.
+//
+// QAdd puts each event into one of the shards, and QGet retrieves events from
+// whichever shard has any, starting from a different one each time so none are
+// starved. The DeliveryTokens QGet returns are prefixed with the index of the
+// shard the event came from, which is how QAck, QExtend and QNack know which
+// shard to act on. Without a token they try each shard in turn.
+//
+// QPause, QResume, QFlush, QStatus and QSetRateLimit act on all of the shards
+// when given the sharded queue. Every other command acts on the queue it's
+// given as-is, so dead events, pending events and so on are looked at by giving
+// the command the name of the shard, see shardQueue.
+
+// returns the name of the queue holding the given shard of a sharded queue
+func shardQueue(queue string, i int) string {
+	return queue + "#" + strconv.Itoa(i)
+}
+
+// returns the queues making up a queue with the given number of shards. If it
+// has fewer than two it isn't sharded, and the queue itself is returned.
+func shardQueues(queue string, shards int) []string {
+	if shards < 2 {
+		return []string{queue}
+	}
+	qq := make([]string, shards)
+	for i := range qq {
+		qq[i] = shardQueue(queue, i)
+	}
+	return qq
+}
+
+// returns the index of the shard which events with the given PartitionKey go
+// into. A different hash than fairBucket's is used, so that the PartitionKeys
+// within a shard are still spread across all of its fair backlog sets.
+func shardIndex(partitionKey string, shards int) int {
+	return int(crc32.ChecksumIEEE([]byte(partitionKey)) % uint32(shards))
+}
+
+func shardToken(i int, token string) string {
+	if token == "" {
+		return ""
+	}
+	return strconv.Itoa(i) + "." + token
+}
+
+// splits a DeliveryToken returned from a sharded queue with the given number of
+// shards into the index of the shard and the shard's own token
+func splitShardToken(token string, shards int) (int, string, error) {
+	pp := strings.SplitN(token, ".", 2)
+	if len(pp) != 2 {
+		return 0, "", ErrInvalidDeliveryToken
+	}
+	i, err := strconv.Atoi(pp[0])
+	if err != nil || i < 0 || i >= shards {
+		return 0, "", ErrInvalidDeliveryToken
+	}
+	return i, pp[1], nil
+}
+
+// returns the index of the next shard to use, out of the given number. Used to
+// spread events without a PartitionKey across shards, and to pick the shard
+// QGet starts from.
+func (p *Peel) nextShard(shards int) int {
+	return int(atomic.AddUint64(p.shardNext, 1) % uint64(shards))
+}
+
+// returns the queues making up the given queue, see shardQueues
+func (p *Peel) queueShards(ctx context.Context, queue string) ([]string, error) {
+	qc, err := p.cachedConfig(ctx, queue)
+	if err != nil {
+		return nil, err
+	}
+	return shardQueues(queue, qc.Shards), nil
+}
+
+// changes the Queue of each command for a sharded queue to the shard the event
+// should be added to
+func (p *Peel) routeQAdds(ctx context.Context, cc []QAddCommand) error {
+	shardsByQueue := map[string][]string{}
+	for i := range cc {
+		shards, ok := shardsByQueue[cc[i].Queue]
+		if !ok {
+			var err error
+			if shards, err = p.queueShards(ctx, cc[i].Queue); err != nil {
+				return err
+			}
+			shardsByQueue[cc[i].Queue] = shards
+		}
+
+		switch {
+		case len(shards) == 1:
+			continue
+		case cc[i].GroupID != "":
+			// A group's events must all be in the same shard to be kept in order
+			cc[i].Queue = shards[shardIndex(cc[i].GroupID, len(shards))]
+		case cc[i].PartitionKey != "":
+			cc[i].Queue = shards[shardIndex(cc[i].PartitionKey, len(shards))]
+		case cc[i].DedupKey != "":
+			// DedupKeys are only unique within a shard
+			cc[i].Queue = shards[shardIndex(cc[i].DedupKey, len(shards))]
+		default:
+			cc[i].Queue = shards[p.nextShard(len(shards))]
+		}
+	}
+	return nil
+}
+
+// qgetShards is like qgetDirect, but for every one of the given shards of the
+// queue in turn until one of them has events. The events' DeliveryTokens are
+// prefixed with the shard they came from. If there's only one shard it's
+// passed to qgetDirect as-is.
+func (p *Peel) qgetShards(ctx context.Context, c QGetCommand, shards []string, count int, peek bool) ([]core.Event, error) {
+	if len(shards) == 1 {
+		return p.qgetDirect(ctx, c, count, peek)
+	}
+
+	start := p.nextShard(len(shards))
+	for j := range shards {
+		i := (start + j) % len(shards)
+		sc := c
+		sc.Queue = shards[i]
+		ee, err := p.qgetDirect(ctx, sc, count, peek)
+		if err != nil {
+			return nil, err
+		} else if len(ee) == 0 {
+			continue
+		}
+		for k := range ee {
+			ee[k].DeliveryToken = shardToken(i, ee[k].DeliveryToken)
+		}
+		return ee, nil
+	}
+	return []core.Event{}, nil
+}
+
+// eachEventShard calls fn with the queue an event is in, along with the
+// DeliveryToken which that queue gave it. If the given queue isn't sharded
+// that's just the queue and token as they are. If it is, and there's no token
+// to say which shard the event is in, fn is called for each shard until it
+// returns true.
+func (p *Peel) eachEventShard(ctx context.Context, queue, token string, fn func(queue, token string) (bool, error)) (bool, error) {
+	shards, err := p.queueShards(ctx, queue)
+	if err != nil {
+		return false, err
+	} else if len(shards) == 1 {
+		return fn(queue, token)
+	}
+
+	if token != "" {
+		i, token, err := splitShardToken(token, len(shards))
+		if err != nil {
+			return false, err
+		}
+		return fn(shards[i], token)
+	}
+
+	for _, shard := range shards {
+		if ok, err := fn(shard, ""); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// qackMultiShards is like qackMulti, but acks each event in the shard it's in
+// if the queue is sharded, see eachEventShard. The events in each shard are
+// still ack'd atomically.
+func (p *Peel) qackMultiShards(ctx context.Context, c QAckMultiCommand) ([]bool, error) {
+	shards, err := p.queueShards(ctx, c.Queue)
+	if err != nil {
+		return nil, err
+	} else if len(shards) == 1 {
+		return p.qackMulti(ctx, c)
+	} else if len(c.DeliveryTokens) > 0 && len(c.DeliveryTokens) != len(c.EventIDs) {
+		return nil, errors.New("must be given one delivery token per event")
+	}
+
+	acked := make([]bool, len(c.EventIDs))
+	for i, shard := range shards {
+		sc := QAckMultiCommand{Queue: shard, ConsumerGroup: c.ConsumerGroup}
+		var idx []int
+		for j, id := range c.EventIDs {
+			if acked[j] {
+				continue
+			}
+			if len(c.DeliveryTokens) > 0 {
+				tokenShard, token, err := splitShardToken(c.DeliveryTokens[j], len(shards))
+				if err != nil {
+					return nil, err
+				} else if tokenShard != i {
+					continue
+				}
+				sc.DeliveryTokens = append(sc.DeliveryTokens, token)
+			}
+			sc.EventIDs = append(sc.EventIDs, id)
+			idx = append(idx, j)
+		}
+		if len(idx) == 0 {
+			continue
+		}
+
+		shardAcked, err := p.qackMulti(ctx, sc)
+		if err != nil {
+			return nil, err
+		}
+		for k, j := range idx {
+			acked[j] = shardAcked[k]
+		}
+	}
+	return acked, nil
+}
+
+// calls fn for each of the queue's shards, or just the queue if it isn't
+// sharded
+func (p *Peel) eachShard(ctx context.Context, queue string, fn func(queue string) error) error {
+	shards, err := p.queueShards(ctx, queue)
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		if err := fn(shard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// qstatusShards is like qstatus, but if the queue is sharded it adds together
+// the stats of all of its shards. If no consumer groups are given then those
+// known for any of the shards are used.
+func (p *Peel) qstatusShards(ctx context.Context, queue string, cgroups []string) (QueueStats, error) {
+	shards, err := p.queueShards(ctx, queue)
+	if err != nil {
+		return QueueStats{}, err
+	} else if len(shards) == 1 {
+		return p.qstatus(ctx, queue, cgroups)
+	}
+
+	if len(cgroups) == 0 {
+		cgm := map[string]bool{}
+		for _, shard := range shards {
+			shardCGroups, err := p.queueConsumerGroups(ctx, shard)
+			if err != nil {
+				return QueueStats{}, err
+			}
+			for _, cg := range shardCGroups {
+				if !cgm[cg] {
+					cgm[cg] = true
+					cgroups = append(cgroups, cg)
+				}
+			}
+		}
+	}
+
+	qs := QueueStats{ConsumerGroupStats: map[string]ConsumerGroupStats{}}
+	for _, shard := range shards {
+		shardQS, err := p.qstatus(ctx, shard, cgroups)
+		if err != nil {
+			return QueueStats{}, err
+		}
+		qs.Total += shardQS.Total
+		qs.Delayed += shardQS.Delayed
+		qs.Paused = qs.Paused || shardQS.Paused
+		for cg, shardCGS := range shardQS.ConsumerGroupStats {
+			cgs := qs.ConsumerGroupStats[cg]
+			cgs.Available += shardCGS.Available
+			cgs.InProgress += shardCGS.InProgress
+			cgs.Redo += shardCGS.Redo
+			cgs.Done += shardCGS.Done
+			cgs.Dead += shardCGS.Dead
+			if shardCGS.Lag > cgs.Lag {
+				cgs.Lag = shardCGS.Lag
+			}
+			qs.ConsumerGroupStats[cg] = cgs
+		}
+	}
+	return qs, nil
+}
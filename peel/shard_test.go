@@ -0,0 +1,170 @@
+package peel
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShards(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       queue,
+		QueueConfig: QueueConfig{Shards: 4},
+	}))
+
+	qadd := func(partitionKey string) core.ID {
+		id, err := testPeel.QAdd(testCtx, QAddCommand{
+			Queue:        queue,
+			Expire:       time.Now().Add(10 * time.Minute),
+			Contents:     testutil.RandStr(),
+			PartitionKey: partitionKey,
+		})
+		require.Nil(t, err)
+		return id
+	}
+
+	byPartition := map[string][]core.ID{}
+	for i := 0; i < 3; i++ {
+		for _, pk := range []string{"a", "b", ""} {
+			byPartition[pk] = append(byPartition[pk], qadd(pk))
+		}
+	}
+
+	// Events with the same PartitionKey all go into the same shard
+	aShard := shardQueue(queue, shardIndex("a", 4))
+	qsm, err := testPeel.QStatus(testCtx, QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: {cgroup}, aShard: nil},
+	})
+	require.Nil(t, err)
+	assert.True(t, qsm[aShard].Total >= 3)
+	assert.Equal(t, uint64(9), qsm[queue].Total)
+	assert.Equal(t, uint64(9), qsm[queue].ConsumerGroupStats[cgroup].Available)
+
+	// Every event is retrieved, and those with the same PartitionKey are
+	// retrieved in the order they were added
+	gotByID := map[core.ID]core.Event{}
+	var gotOrder []core.ID
+	for i := 0; i < 9; i++ {
+		e, err := testPeel.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   time.Now().Add(time.Minute),
+		})
+		require.Nil(t, err)
+		require.NotEqual(t, core.ID{}, e.ID)
+		gotByID[e.ID] = e
+		gotOrder = append(gotOrder, e.ID)
+	}
+	for _, pk := range []string{"a", "b"} {
+		var got []core.ID
+		for _, id := range gotOrder {
+			for _, pkID := range byPartition[pk] {
+				if id == pkID {
+					got = append(got, id)
+				}
+			}
+		}
+		assert.Equal(t, byPartition[pk], got)
+	}
+
+	e, err := testPeel.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{}, e)
+
+	// Events are acked in whichever shard they came from, using their tokens
+	// or without them
+	e = gotByID[byPartition["a"][0]]
+	_, err = testPeel.QAck(testCtx, QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       e.ID,
+		DeliveryToken: "wat",
+	})
+	assert.Equal(t, ErrInvalidDeliveryToken, err)
+
+	ok, err := testPeel.QAck(testCtx, QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       e.ID,
+		DeliveryToken: e.DeliveryToken,
+	})
+	require.Nil(t, err)
+	assert.True(t, ok)
+
+	e = gotByID[byPartition["b"][0]]
+	ok, err = testPeel.QNack(testCtx, QNackCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       e.ID,
+	})
+	require.Nil(t, err)
+	assert.True(t, ok)
+
+	e, err = testPeel.QGet(testCtx, QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(time.Minute),
+	})
+	require.Nil(t, err)
+	assert.Equal(t, byPartition["b"][0], e.ID)
+	gotByID[e.ID] = e
+
+	var ids []core.ID
+	var tokens []string
+	for _, id := range gotOrder {
+		ids = append(ids, gotByID[id].ID)
+		tokens = append(tokens, gotByID[id].DeliveryToken)
+	}
+	acked, err := testPeel.QAckMulti(testCtx, QAckMultiCommand{
+		Queue:          queue,
+		ConsumerGroup:  cgroup,
+		EventIDs:       ids,
+		DeliveryTokens: tokens,
+	})
+	require.Nil(t, err)
+	for i, id := range ids {
+		assert.Equal(t, id != byPartition["a"][0], acked[i], "id:%v", id)
+	}
+
+	qsm, err = testPeel.QStatus(testCtx, QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: nil},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ConsumerGroupStats{Done: 9}, qsm[queue].ConsumerGroupStats[cgroup])
+
+	// A blocking QGet is woken up by an event being added to any shard
+	doneCh := make(chan core.Event)
+	go func() {
+		e, err := testPeel.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			Block:         5 * time.Second,
+		})
+		require.Nil(t, err)
+		doneCh <- e
+	}()
+	time.Sleep(100 * time.Millisecond)
+	id := qadd("")
+	assert.Equal(t, id, (<-doneCh).ID)
+
+	// Pausing and flushing the queue does so for all of its shards
+	require.Nil(t, testPeel.QPause(testCtx, QPauseCommand{Queue: queue}))
+	qadd("")
+	e, err = testPeel.QGet(testCtx, QGetCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{}, e)
+	require.Nil(t, testPeel.QResume(testCtx, QResumeCommand{Queue: queue}))
+
+	require.Nil(t, testPeel.QFlush(testCtx, QFlushCommand{Queue: queue}))
+	qsm, err = testPeel.QStatus(testCtx, QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: nil},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(0), qsm[queue].Total)
+}
@@ -0,0 +1,139 @@
+package streamimport
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/mediocregopher/radix.v2/util"
+)
+
+type redisStream struct {
+	cmder util.Cmder
+	key   string
+}
+
+// NewRedisStream returns a Stream which reads the stream at the given key in
+// redis. It needs redis 5 or later. The key isn't prefixed, so is the key the
+// stream's producers and consumers use.
+func NewRedisStream(cmder util.Cmder, key string) Stream {
+	return redisStream{cmder: cmder, key: key}
+}
+
+// returns the ID which comes straight after the given one, so that a range
+// starting from it excludes the given one, without needing redis 6.2's
+// exclusive ranges
+func nextStreamID(s string) (string, error) {
+	id, err := parseStreamID(s)
+	if err != nil {
+		return "", err
+	}
+	if id.seq == ^uint64(0) {
+		id.ms, id.seq = id.ms+1, 0
+	} else {
+		id.seq++
+	}
+	return fmt.Sprintf("%d-%d", id.ms, id.seq), nil
+}
+
+func (rs redisStream) Range(_ context.Context, after string, count int) ([]Entry, error) {
+	start, err := nextStreamID(after)
+	if err != nil {
+		return nil, err
+	}
+	arr, err := rs.cmder.Cmd("XRANGE", rs.key, start, "+", "COUNT", count).Array()
+	if err != nil {
+		return nil, err
+	}
+
+	ee := make([]Entry, len(arr))
+	for i, r := range arr {
+		parts, err := r.Array()
+		if err != nil {
+			return nil, err
+		} else if len(parts) != 2 {
+			return nil, fmt.Errorf("unexpected XRANGE entry: %s", r)
+		}
+		if ee[i].ID, err = parts[0].Str(); err != nil {
+			return nil, err
+		}
+		fields, err := parts[1].List()
+		if err != nil {
+			return nil, err
+		}
+		ee[i].Fields = make(map[string]string, len(fields)/2)
+		for j := 0; j+1 < len(fields); j += 2 {
+			ee[i].Fields[fields[j]] = fields[j+1]
+		}
+	}
+	return ee, nil
+}
+
+func (rs redisStream) Groups(context.Context) ([]Group, error) {
+	// XINFO errors on a stream which doesn't exist, but it has no groups
+	if exists, err := rs.cmder.Cmd("EXISTS", rs.key).Int(); err != nil {
+		return nil, err
+	} else if exists == 0 {
+		return nil, nil
+	}
+	arr, err := rs.cmder.Cmd("XINFO", "GROUPS", rs.key).Array()
+	if err != nil {
+		return nil, err
+	}
+
+	gg := make([]Group, len(arr))
+	for i, gr := range arr {
+		kvs, err := gr.Array()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j+1 < len(kvs); j += 2 {
+			k, err := kvs[j].Str()
+			if err != nil {
+				return nil, err
+			}
+			switch k {
+			case "name":
+				gg[i].Name, err = kvs[j+1].Str()
+			case "last-delivered-id":
+				gg[i].LastDeliveredID, err = kvs[j+1].Str()
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return gg, nil
+}
+
+func (rs redisStream) Pending(_ context.Context, group, after string, count int) ([]string, error) {
+	start, err := nextStreamID(after)
+	if err != nil {
+		return nil, err
+	}
+	r := rs.cmder.Cmd("XPENDING", rs.key, group, start, "+", strconv.Itoa(count))
+	if r.IsType(redis.Nil) {
+		// Some servers reply with nil, rather than an empty array, when
+		// nothing is pending
+		return nil, nil
+	}
+	arr, err := r.Array()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(arr))
+	for i, r := range arr {
+		parts, err := r.Array()
+		if err != nil {
+			return nil, err
+		} else if len(parts) == 0 {
+			return nil, fmt.Errorf("unexpected XPENDING entry: %s", r)
+		}
+		if ids[i], err = parts[0].Str(); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,327 @@
+// Package streamimport moves the entries of a Redis Stream into a bananaq
+// queue, along with the state of each of the stream's consumer groups, so that
+// work can be moved off of Streams without losing what's in flight. For each
+// consumer group, entries it has acked are done with, entries in its pending
+// entries list (PEL) are made available to be retrieved again straight away,
+// and entries it hasn't been delivered yet are left available.
+//
+//	stats, err := streamimport.Importer{
+//		Peel:   p,
+//		Stream: streamimport.NewRedisStream(cmder, "orders"),
+//		Queue:  "orders",
+//		TTL:    24 * time.Hour,
+//	}.Run(ctx)
+package streamimport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+)
+
+// Entry is a single entry in a stream
+type Entry struct {
+	ID     string
+	Fields map[string]string
+}
+
+// Group describes one of a stream's consumer groups, as returned by XINFO
+// GROUPS
+type Group struct {
+	Name            string
+	LastDeliveredID string
+}
+
+// Stream reads a Redis Stream and its consumer groups' state. NewRedisStream
+// returns one which reads a stream in redis.
+type Stream interface {
+	// Range returns up to count entries with IDs greater than after, in order,
+	// as XRANGE does. after is "0-0" for the first call.
+	Range(ctx context.Context, after string, count int) ([]Entry, error)
+
+	// Groups returns all of the stream's consumer groups
+	Groups(ctx context.Context) ([]Group, error)
+
+	// Pending returns the IDs of up to count entries with IDs greater than
+	// after in the group's pending entries list, in order, as XPENDING does.
+	Pending(ctx context.Context, group, after string, count int) ([]string, error)
+}
+
+// streamID is a parsed stream entry ID, which can be compared
+type streamID struct {
+	ms, seq uint64
+}
+
+func parseStreamID(s string) (streamID, error) {
+	msStr, seqStr, _ := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msStr, 10, 64)
+	if err != nil {
+		return streamID{}, fmt.Errorf("invalid stream ID %q", s)
+	}
+	var seq uint64
+	if seqStr != "" {
+		if seq, err = strconv.ParseUint(seqStr, 10, 64); err != nil {
+			return streamID{}, fmt.Errorf("invalid stream ID %q", s)
+		}
+	}
+	return streamID{ms: ms, seq: seq}, nil
+}
+
+func (id streamID) after(id2 streamID) bool {
+	return id.ms > id2.ms || (id.ms == id2.ms && id.seq > id2.seq)
+}
+
+// GroupStats describes the state a consumer group was imported with
+type GroupStats struct {
+	Done      int // Entries the group had acked
+	Pending   int // Entries in the group's PEL, made available again
+	Available int // Entries which hadn't been delivered to the group yet
+}
+
+// Stats describes what Importer's Run imported
+type Stats struct {
+	Entries int
+	Groups  map[string]GroupStats
+}
+
+// Importer adds every entry in a Stream to a queue, in order, and then gives
+// each of the stream's consumer groups a bananaq consumer group of the same
+// name with the same state.
+//
+// The queue must be empty, which Run checks, and must not have been configured
+// in a way which changes the order events are retrieved in, e.g. by making it
+// grouped. The stream must not be written to or consumed from while it's
+// imported.
+type Importer struct {
+	Peel   *peel.Peel // Required
+	Stream Stream     // Required
+	Queue  string     // Required
+
+	// How long after being added each event expires. Required unless the
+	// queue has a DefaultTTL (see peel.QueueConfig).
+	TTL time.Duration
+
+	// Optional. If set, each event's contents are the value of this field of
+	// its entry, and entries without it are skipped. Otherwise each event's
+	// contents are all of its entry's fields, as a JSON object.
+	Field string
+
+	// Default 100. How many entries are read from the Stream and added to the
+	// queue at a time.
+	BatchSize int
+}
+
+// an entry which has been added to the queue
+type imported struct {
+	streamID streamID
+	id       core.ID
+}
+
+// Run imports the stream, returning what was imported. If an error is returned
+// part of the stream may already have been imported.
+func (im Importer) Run(ctx context.Context) (Stats, error) {
+	if im.Peel == nil || im.Stream == nil {
+		return Stats{}, errors.New("Peel and Stream are required")
+	} else if im.Queue == "" {
+		return Stats{}, errors.New("Queue is required")
+	}
+	if im.BatchSize < 1 {
+		im.BatchSize = 100
+	}
+
+	qsm, err := im.Peel.QStatus(ctx, peel.QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{im.Queue: nil},
+	})
+	if err != nil {
+		return Stats{}, err
+	} else if qs := qsm[im.Queue]; qs.Total > 0 || qs.Delayed > 0 {
+		return Stats{}, fmt.Errorf("queue %q must be empty before importing", im.Queue)
+	}
+
+	// The groups' state is read before anything is added, so that it's
+	// consistent with the entries which are
+	groups, err := im.Stream.Groups(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+	pending := make([]map[streamID]bool, len(groups))
+	for i, g := range groups {
+		if pending[i], err = im.pending(ctx, g.Name); err != nil {
+			return Stats{}, err
+		}
+	}
+
+	ii, err := im.addEntries(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	stats := Stats{Entries: len(ii), Groups: map[string]GroupStats{}}
+	for i, g := range groups {
+		if stats.Groups[g.Name], err = im.importGroup(ctx, ii, g, pending[i]); err != nil {
+			return stats, fmt.Errorf("importing group %q: %w", g.Name, err)
+		}
+	}
+	return stats, nil
+}
+
+func (im Importer) pending(ctx context.Context, group string) (map[streamID]bool, error) {
+	m := map[streamID]bool{}
+	after := "0-0"
+	for {
+		ids, err := im.Stream.Pending(ctx, group, after, im.BatchSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, idStr := range ids {
+			id, err := parseStreamID(idStr)
+			if err != nil {
+				return nil, err
+			}
+			m[id] = true
+		}
+		if len(ids) < im.BatchSize {
+			return m, nil
+		}
+		after = ids[len(ids)-1]
+	}
+}
+
+func (im Importer) addEntries(ctx context.Context) ([]imported, error) {
+	var ii []imported
+	after := "0-0"
+	for {
+		ee, err := im.Stream.Range(ctx, after, im.BatchSize)
+		if err != nil {
+			return ii, err
+		}
+
+		var cc []peel.QAddCommand
+		var sids []streamID
+		for _, e := range ee {
+			sid, err := parseStreamID(e.ID)
+			if err != nil {
+				return ii, err
+			}
+			c := peel.QAddCommand{Queue: im.Queue}
+			if im.TTL > 0 {
+				c.Expire = time.Now().Add(im.TTL)
+			}
+			if im.Field == "" {
+				b, err := json.Marshal(e.Fields)
+				if err != nil {
+					return ii, err
+				}
+				c.Contents = string(b)
+			} else if v, ok := e.Fields[im.Field]; ok {
+				c.Contents = v
+			} else {
+				continue
+			}
+			cc = append(cc, c)
+			sids = append(sids, sid)
+		}
+
+		if len(cc) > 0 {
+			ids, err := im.Peel.QAddMulti(ctx, cc)
+			if err != nil {
+				return ii, err
+			}
+			for j := range ids {
+				ii = append(ii, imported{streamID: sids[j], id: ids[j]})
+			}
+		}
+
+		if len(ee) < im.BatchSize {
+			return ii, nil
+		}
+		after = ee[len(ee)-1].ID
+	}
+}
+
+// importGroup gives the bananaq consumer group the same state as the stream's.
+// It seeks the consumer group to the first event which the stream's group
+// hadn't acked, then retrieves each event up to the group's last delivered
+// one, acking those which it had acked. The rest of those, which were pending,
+// are then nacked, so they're available to be retrieved again first.
+func (im Importer) importGroup(ctx context.Context, ii []imported, g Group, pending map[streamID]bool) (GroupStats, error) {
+	lastDelivered, err := parseStreamID(g.LastDeliveredID)
+	if err != nil {
+		return GroupStats{}, err
+	}
+	delivered := func(i int) bool { return !ii[i].streamID.after(lastDelivered) }
+
+	var stats GroupStats
+	start := len(ii)
+	for i := range ii {
+		if !delivered(i) || pending[ii[i].streamID] {
+			start = i
+			break
+		}
+		stats.Done++
+	}
+
+	seek := peel.QSeekCommand{Queue: im.Queue, ConsumerGroup: g.Name}
+	if start < len(ii) {
+		seek.From = ii[start].id.T.Time()
+	} else if len(ii) > 0 {
+		seek.From = (ii[len(ii)-1].id.T + 1).Time()
+	}
+	if err := im.Peel.QSeek(ctx, seek); err != nil {
+		return stats, err
+	}
+
+	var inProg []core.Event
+	for i := start; i < len(ii) && delivered(i); i++ {
+		e, err := im.Peel.QGet(ctx, peel.QGetCommand{
+			Queue:         im.Queue,
+			ConsumerGroup: g.Name,
+			AckDeadline:   time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			return stats, err
+		} else if e.ID != ii[i].id {
+			return stats, fmt.Errorf("expected to retrieve event %s but got %s", ii[i].id, e.ID)
+		}
+
+		if pending[ii[i].streamID] {
+			inProg = append(inProg, e)
+			stats.Pending++
+			continue
+		}
+		if _, err := im.Peel.QAck(ctx, peel.QAckCommand{
+			Queue:         im.Queue,
+			ConsumerGroup: g.Name,
+			EventID:       e.ID,
+			DeliveryToken: e.DeliveryToken,
+		}); err != nil {
+			return stats, err
+		}
+		stats.Done++
+	}
+
+	for _, e := range inProg {
+		if _, err := im.Peel.QNack(ctx, peel.QNackCommand{
+			Queue:         im.Queue,
+			ConsumerGroup: g.Name,
+			EventID:       e.ID,
+			DeliveryToken: e.DeliveryToken,
+		}); err != nil {
+			return stats, err
+		}
+	}
+
+	for i := range ii {
+		if !delivered(i) {
+			stats.Available++
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,129 @@
+package streamimport
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testCtx = context.Background()
+
+func newTestPeel() *peel.Peel {
+	p := peel.NewWithBackend(core.NewMemBackend(), nil)
+	errCh := p.Run(nil)
+	go func() { panic(<-errCh) }()
+	return p
+}
+
+func TestNextStreamID(t *T) {
+	for in, out := range map[string]string{
+		"0-0":                    "0-1",
+		"5":                      "5-1",
+		"1526919030474-55":       "1526919030474-56",
+		"1-18446744073709551615": "2-0",
+	} {
+		next, err := nextStreamID(in)
+		require.Nil(t, err)
+		assert.Equal(t, out, next)
+	}
+	_, err := nextStreamID("foo")
+	assert.NotNil(t, err)
+}
+
+func TestImporter(t *T) {
+	rpool, err := pool.New("tcp", "127.0.0.1:6379", 1)
+	require.Nil(t, err)
+	key := "streamimport-" + testutil.RandStr()
+	defer rpool.Cmd("DEL", key)
+
+	var ids []string
+	for _, n := range []string{"1", "2", "3", "4", "5"} {
+		id, err := rpool.Cmd("XADD", key, "*", "n", n, "other", "foo").Str()
+		require.Nil(t, err)
+		ids = append(ids, id)
+	}
+
+	// g1 has been delivered the first three entries and acked the first and
+	// third, g2 hasn't been delivered anything, and g3 was created after all
+	// the entries were added
+	require.Nil(t, rpool.Cmd("XGROUP", "CREATE", key, "g1", "0").Err)
+	require.Nil(t, rpool.Cmd("XGROUP", "CREATE", key, "g2", "0").Err)
+	require.Nil(t, rpool.Cmd("XGROUP", "CREATE", key, "g3", "$").Err)
+	require.Nil(t, rpool.Cmd("XREADGROUP", "GROUP", "g1", "c", "COUNT", 3, "STREAMS", key, ">").Err)
+	require.Nil(t, rpool.Cmd("XACK", key, "g1", ids[0], ids[2]).Err)
+
+	p := newTestPeel()
+	queue := testutil.RandStr()
+	stats, err := Importer{
+		Peel:      p,
+		Stream:    NewRedisStream(rpool, key),
+		Queue:     queue,
+		TTL:       time.Minute,
+		Field:     "n",
+		BatchSize: 2,
+	}.Run(testCtx)
+	require.Nil(t, err)
+	assert.Equal(t, Stats{
+		Entries: 5,
+		Groups: map[string]GroupStats{
+			"g1": {Done: 2, Pending: 1, Available: 2},
+			"g2": {Available: 5},
+			"g3": {Done: 5},
+		},
+	}, stats)
+
+	assertGets := func(group string, expected ...string) {
+		for _, contents := range append(expected, "") {
+			e, err := p.QGet(testCtx, peel.QGetCommand{Queue: queue, ConsumerGroup: group})
+			require.Nil(t, err)
+			assert.Equal(t, contents, e.Contents, "group:%s", group)
+		}
+	}
+	// The pending entry was already delivered once, and is retrieved again
+	// first
+	e, err := p.QPeek(testCtx, peel.QPeekCommand{Queue: queue, ConsumerGroup: "g1"})
+	require.Nil(t, err)
+	assert.Equal(t, "2", e.Contents)
+	assertGets("g1", "2", "4", "5")
+	assertGets("g2", "1", "2", "3", "4", "5")
+	assertGets("g3")
+
+	// Without a Field all of each entry's fields are the contents
+	queue = testutil.RandStr()
+	_, err = Importer{
+		Peel:   p,
+		Stream: NewRedisStream(rpool, key),
+		Queue:  queue,
+		TTL:    time.Minute,
+	}.Run(testCtx)
+	require.Nil(t, err)
+	e, err = p.QGet(testCtx, peel.QGetCommand{Queue: queue, ConsumerGroup: "g2"})
+	require.Nil(t, err)
+	assert.JSONEq(t, `{"n":"1","other":"foo"}`, e.Contents)
+
+	// Importing into a queue which isn't empty fails
+	_, err = Importer{
+		Peel:   p,
+		Stream: NewRedisStream(rpool, key),
+		Queue:  queue,
+		TTL:    time.Minute,
+	}.Run(testCtx)
+	assert.NotNil(t, err)
+
+	// A stream which doesn't exist has nothing to import
+	stats, err = Importer{
+		Peel:   p,
+		Stream: NewRedisStream(rpool, testutil.RandStr()),
+		Queue:  testutil.RandStr(),
+		TTL:    time.Minute,
+	}.Run(testCtx)
+	require.Nil(t, err)
+	assert.Equal(t, Stats{Groups: map[string]GroupStats{}}, stats)
+}
@@ -0,0 +1,149 @@
+package peel
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// QSubscribeCommand describes the parameters which can be passed into the
+// QSubscribe command
+type QSubscribeCommand struct {
+	Queue         string // Required
+	ConsumerGroup string // Required
+
+	// Optional. If set each event is retrieved with an AckDeadline this far
+	// from when it was retrieved, and must be QAck'd by the consumer before
+	// then. If not set events never need to be QAck'd.
+	AckDeadline time.Duration
+
+	// Optional. Passed along as the ConsumerID of each QGet. See QPendingList.
+	ConsumerID string
+
+	// Optional. Passed along as the Filter of each QGet, so only events which
+	// match it are retrieved. See QGetCommand.
+	Filter string
+
+	// Optional. Called with every error encountered while retrieving events,
+	// before backing off and trying again. Must not block.
+	OnError func(error)
+}
+
+// The range of time QSubscribe will wait after an error before trying again
+const (
+	subscribeMinBackoff = 100 * time.Millisecond
+	subscribeMaxBackoff = 10 * time.Second
+)
+
+// QSubscribe continuously retrieves events from the queue for the consumer
+// group, as with QGet, and writes them to the returned channel. Only one event
+// is retrieved at a time, and the next is not retrieved until the previous one
+// has been read off the channel.
+//
+// Errors encountered while retrieving events (e.g. connection problems) are
+// passed to OnError, and retrieval is retried with an exponential backoff, so
+// the subscription will survive the database temporarily going away.
+//
+// The returned function stops the subscription, after which the channel is
+// closed. The subscription is also stopped once ctx is done, or once the Peel
+// starts draining (see Drain). If an event with an AckDeadline had been
+// retrieved but not yet read off the channel it is QNack'd so others in the
+// consumer group may retrieve it.
+func (p *Peel) QSubscribe(ctx context.Context, c QSubscribeCommand) (<-chan core.Event, func(), error) {
+	if c.Queue == "" || c.ConsumerGroup == "" {
+		return nil, nil, errors.New("Queue and ConsumerGroup are required")
+	}
+	if _, _, _, err := queueCGroupKeys(c.Queue, c.ConsumerGroup); err != nil {
+		return nil, nil, err
+	}
+	if c.Filter != "" {
+		if _, err := ParseFilter(c.Filter); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	ch := make(chan core.Event)
+	ctx, stop := context.WithCancel(ctx)
+	go p.subscribe(ctx, c, ch)
+	return ch, stop, nil
+}
+
+func (p *Peel) subscribe(ctx context.Context, c QSubscribeCommand, ch chan<- core.Event) {
+	defer close(ch)
+
+	var backoff time.Duration
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		qget := QGetCommand{
+			Queue:         c.Queue,
+			ConsumerGroup: c.ConsumerGroup,
+			Block:         1 * time.Minute,
+			ConsumerID:    c.ConsumerID,
+			Filter:        c.Filter,
+		}
+		if c.AckDeadline > 0 {
+			qget.AckTimeout = c.AckDeadline
+		}
+
+		ee, err := p.qget(ctx, qget, 1)
+		if err != nil && (ctx.Err() != nil || err == ErrDraining) {
+			return
+		} else if err != nil {
+			if c.OnError != nil {
+				c.OnError(err)
+			}
+
+			if backoff *= 2; backoff < subscribeMinBackoff {
+				backoff = subscribeMinBackoff
+			} else if backoff > subscribeMaxBackoff {
+				backoff = subscribeMaxBackoff
+			}
+
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		backoff = 0
+
+		if len(ee) == 0 {
+			continue
+		}
+
+		select {
+		case ch <- ee[0]:
+		case <-ctx.Done():
+			p.subscribeNack(c, ee[0])
+			return
+		case <-p.drainCh:
+			p.subscribeNack(c, ee[0])
+			return
+		}
+	}
+}
+
+// subscribeNack nacks an event which was retrieved for a subscription but never
+// read off its channel
+func (p *Peel) subscribeNack(c QSubscribeCommand, e core.Event) {
+	if c.AckDeadline <= 0 {
+		return
+	}
+
+	// ctx may be done, so the nack can't use it
+	_, err := p.QNack(context.Background(), QNackCommand{
+		Queue:         c.Queue,
+		ConsumerGroup: c.ConsumerGroup,
+		EventID:       e.ID,
+		DeliveryToken: e.DeliveryToken,
+	})
+	if err != nil && c.OnError != nil {
+		c.OnError(err)
+	}
+}
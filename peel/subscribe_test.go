@@ -0,0 +1,118 @@
+package peel
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQSubscribe(t *T) {
+	queue, ii := newTestQueue(t, 2)
+	cgroup := testutil.RandStr()
+
+	ch, stop, err := testPeel.QSubscribe(testCtx, QSubscribeCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   1 * time.Minute,
+	})
+	require.Nil(t, err)
+
+	assertRecv := func(id core.ID) {
+		select {
+		case e := <-ch:
+			assert.Equal(t, id, e.ID)
+		case <-time.After(500 * time.Millisecond):
+			assert.Fail(t, "didn't receive event")
+		}
+	}
+
+	assertRecv(ii[0])
+	assertRecv(ii[1])
+
+	// Events added after the subscription is waiting should come through too
+	id, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(10 * time.Minute),
+		Contents: testutil.RandStr(),
+	})
+	require.Nil(t, err)
+	assertRecv(id)
+
+	ewInProg, err := queueInProgress(queue, cgroup)
+	require.Nil(t, err)
+	assertKey(t, ewInProg.byArb, ii[0], ii[1], id)
+
+	stop()
+	select {
+	case _, ok := <-ch:
+		assert.False(t, ok)
+	case <-time.After(500 * time.Millisecond):
+		assert.Fail(t, "channel wasn't closed")
+	}
+
+	// Calling stop again shouldn't panic
+	stop()
+}
+
+func TestQSubscribeAckDeadline(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+
+	ch, stop, err := testPeel.QSubscribe(testCtx, QSubscribeCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   1 * time.Second,
+	})
+	require.Nil(t, err)
+	defer stop()
+
+	// The deadline starts once the event is retrieved, not when the
+	// subscription started waiting for it
+	time.Sleep(1500 * time.Millisecond)
+	id, err := testPeel.QAdd(testCtx, QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(10 * time.Minute),
+		Contents: testutil.RandStr(),
+	})
+	require.Nil(t, err)
+	select {
+	case e := <-ch:
+		assert.Equal(t, id, e.ID)
+	case <-time.After(500 * time.Millisecond):
+		assert.Fail(t, "didn't receive event")
+	}
+
+	pp, err := testPeel.QPendingList(testCtx, QPendingListCommand{Queue: queue, ConsumerGroup: cgroup})
+	require.Nil(t, err)
+	require.Len(t, pp, 1)
+	assert.True(t, pp[0].AckDeadline.After(time.Now()), "AckDeadline:%s", pp[0].AckDeadline)
+}
+
+func TestQSubscribeContext(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+
+	ctx, cancel := context.WithCancel(testCtx)
+	ch, stop, err := testPeel.QSubscribe(ctx, QSubscribeCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	defer stop()
+
+	// Canceling ctx stops the subscription, even while it's blocked waiting
+	// for events
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case _, ok := <-ch:
+		assert.False(t, ok)
+	case <-time.After(500 * time.Millisecond):
+		assert.Fail(t, "channel wasn't closed")
+	}
+}
@@ -0,0 +1,337 @@
+package peel
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// A tenant is a namespace of queues, so that many teams can share a bananaq
+// while being limited in how much of it they can use. A queue belongs to the
+// tenant named by the part of its name before the first TenantSeparator, e.g.
+// "team-a.orders" belongs to "team-a", and all of a tenant's queues' keys share
+// that prefix. Queues without a TenantSeparator in their name don't belong to
+// any tenant.
+//
+// A tenant's limits only apply to events added to its queues (see
+// TenantConfig), and are checked by QAdd against a count of its events which
+// is cached like QueueConfigs are, so they may be exceeded by a little while
+// many events are being added at once.
+
+// TenantSeparator separates the name of the tenant a queue belongs to from the
+// rest of the queue's name
+const TenantSeparator = "."
+
+// TenantOf returns the name of the tenant which the queue belongs to, or "" if
+// it doesn't belong to one
+func TenantOf(queue string) string {
+	tenant, _, ok := strings.Cut(queue, TenantSeparator)
+	if !ok {
+		return ""
+	}
+	return tenant
+}
+
+// ErrTenantFull is returned from QAdd when the events can't be added because
+// their queue's tenant already has its MaxEvents (see TenantConfig)
+var ErrTenantFull = errors.New("tenant is full")
+
+// ErrTenantRateLimited is returned from QAdd when the events can't be added
+// because their queue's tenant has added too many recently (see TenantConfig)
+var ErrTenantRateLimited = errors.New("tenant is rate limited")
+
+// TenantConfig describes the limits on a single tenant's queues. It is stored
+// in the database, so all Peel instances share it.
+type TenantConfig struct {
+	// Default 0, meaning unlimited. The maximum number of events which may be
+	// in all of the tenant's queues at once, including delayed ones. QAdd
+	// fails with ErrTenantFull rather than going over it, regardless of the
+	// queues' Overflow.
+	MaxEvents uint64
+
+	// Default 0, meaning unlimited. The number of events per second which may
+	// be added to the tenant's queues, across all Peel instances. It's
+	// implemented as a token bucket, like RateLimit. QAdd fails with
+	// ErrTenantRateLimited rather than going over it, though the events it
+	// didn't add still use up what was left of the limit.
+	AddRate float64
+
+	// Default 1. The number of events which may be added at once, after the
+	// tenant hasn't added any for a while. Only used with AddRate.
+	AddBurst int
+}
+
+// QSetTenantConfigCommand describes the parameters which can be passed into
+// the QSetTenantConfig command
+type QSetTenantConfigCommand struct {
+	Tenant string // Required
+	TenantConfig
+}
+
+// QSetTenantConfig replaces the TenantConfig for the given tenant. Setting a
+// zero TenantConfig removes its limits.
+func (p *Peel) QSetTenantConfig(ctx context.Context, c QSetTenantConfigCommand) (err error) {
+	ctx, end := p.start(ctx, "QSetTenantConfig", "", "")
+	defer end(&err, nil)
+	if c.Tenant == "" || strings.Contains(c.Tenant, TenantSeparator) {
+		return errors.New("invalid tenant name")
+	} else if c.AddRate < 0 || c.AddBurst < 0 {
+		return errors.New("AddRate and AddBurst may not be negative")
+	}
+
+	// The token bucket is kept in the same hash, so setting the config also
+	// refills it
+	m := map[string]string{}
+	if c.MaxEvents > 0 {
+		m["maxevents"] = strconv.FormatUint(c.MaxEvents, 10)
+	}
+	if c.AddRate > 0 {
+		m["rate"] = strconv.FormatFloat(c.AddRate, 'f', -1, 64)
+		m["burst"] = strconv.Itoa(c.AddBurst)
+	}
+	if err := p.c.HashSetAll(ctx, tenantKey(c.Tenant), m); err != nil {
+		return err
+	}
+	p.tenants.forget(c.Tenant)
+	return nil
+}
+
+// QGetTenantConfigCommand describes the parameters which can be passed into
+// the QGetTenantConfig command
+type QGetTenantConfigCommand struct {
+	Tenant string // Required
+}
+
+// QGetTenantConfig returns the TenantConfig for the given tenant, as set by
+// QSetTenantConfig. AddBurst is 0 if no AddRate is set.
+func (p *Peel) QGetTenantConfig(ctx context.Context, c QGetTenantConfigCommand) (_ TenantConfig, err error) {
+	ctx, end := p.start(ctx, "QGetTenantConfig", "", "")
+	defer end(&err, nil)
+	return p.getTenantConfig(ctx, c.Tenant)
+}
+
+func (p *Peel) getTenantConfig(ctx context.Context, tenant string) (TenantConfig, error) {
+	m, err := p.c.HashGetAll(ctx, tenantKey(tenant))
+	if err != nil {
+		return TenantConfig{}, err
+	}
+
+	var tc TenantConfig
+	if s, ok := m["maxevents"]; ok {
+		if tc.MaxEvents, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return TenantConfig{}, err
+		}
+	}
+	if s, ok := m["rate"]; ok {
+		if tc.AddRate, err = strconv.ParseFloat(s, 64); err != nil {
+			return TenantConfig{}, err
+		}
+	}
+	if s, ok := m["burst"]; ok {
+		if tc.AddBurst, err = strconv.Atoi(s); err != nil {
+			return TenantConfig{}, err
+		}
+	}
+	if tc.AddRate > 0 && tc.AddBurst < 1 {
+		tc.AddBurst = 1
+	}
+	return tc, nil
+}
+
+// TenantStats are available statistics about all of a tenant's queues
+type TenantStats struct {
+	// Names of the tenant's queues, sorted alphabetically. The shards of a
+	// sharded queue are listed separately.
+	Queues []string
+
+	// Number of events in the tenant's queues. Does NOT include expired or
+	// delayed events.
+	Total uint64
+
+	// Number of events in the tenant's queues which won't be visible to
+	// consumer groups until some point in the future
+	Delayed uint64
+
+	// Number of events in progress, across all of the queues' consumer groups
+	InProgress uint64
+
+	// Number of dead events, across all of the queues' consumer groups
+	Dead uint64
+}
+
+// QTenantStatusCommand describes the parameters which can be passed into the
+// QTenantStatus command
+type QTenantStatusCommand struct {
+	Tenant string // Required
+}
+
+// QTenantStatus returns statistics about the given tenant's queues. It has to
+// look at every one of them, so it's fairly expensive for tenants with many
+// queues.
+func (p *Peel) QTenantStatus(ctx context.Context, c QTenantStatusCommand) (_ TenantStats, err error) {
+	ctx, end := p.start(ctx, "QTenantStatus", "", "")
+	defer end(&err, nil)
+	return p.tenantStatus(ctx, c.Tenant)
+}
+
+func (p *Peel) tenantStatus(ctx context.Context, tenant string) (TenantStats, error) {
+	if tenant == "" || strings.Contains(tenant, TenantSeparator) {
+		return TenantStats{}, errors.New("invalid tenant name")
+	}
+	k, err := queueKeyMarshal(core.Key{Base: tenant + TenantSeparator + "*", Subs: []string{"*"}})
+	if err != nil {
+		return TenantStats{}, err
+	}
+	qcg, err := p.scanQueuesConsumerGroups(ctx, k)
+	if err != nil {
+		return TenantStats{}, err
+	}
+
+	// Each shard of a sharded queue is listed alongside the queue itself,
+	// which holds no events of its own, so qstatus is used rather than
+	// qstatusShards to not count them twice
+	ts := TenantStats{Queues: make([]string, 0, len(qcg))}
+	for q, cgs := range qcg {
+		ts.Queues = append(ts.Queues, q)
+		qs, err := p.qstatus(ctx, q, cgs)
+		if err != nil {
+			return TenantStats{}, err
+		}
+		ts.Total += qs.Total
+		ts.Delayed += qs.Delayed
+		for _, cgs := range qs.ConsumerGroupStats {
+			ts.InProgress += cgs.InProgress
+			ts.Dead += cgs.Dead
+		}
+	}
+	sort.Strings(ts.Queues)
+	return ts, nil
+}
+
+type tenantCacheEntry struct {
+	tc      TenantConfig
+	events  uint64
+	fetched time.Time
+}
+
+// tenantCache keeps track of each tenant's TenantConfig and how many events it
+// has, so that QAdd doesn't have to look at all of its queues every time it's
+// called
+type tenantCache struct {
+	l sync.Mutex
+	m map[string]tenantCacheEntry
+}
+
+func newTenantCache() *tenantCache {
+	return &tenantCache{m: map[string]tenantCacheEntry{}}
+}
+
+func (tc *tenantCache) get(tenant string, now time.Time) (tenantCacheEntry, bool) {
+	tc.l.Lock()
+	defer tc.l.Unlock()
+	e, ok := tc.m[tenant]
+	if !ok || now.Sub(e.fetched) >= configCacheTTL {
+		return tenantCacheEntry{}, false
+	}
+	return e, true
+}
+
+func (tc *tenantCache) set(tenant string, e tenantCacheEntry) {
+	tc.l.Lock()
+	defer tc.l.Unlock()
+	tc.m[tenant] = e
+}
+
+// adds n to the tenant's cached count of events, so that a Peel adding many
+// events doesn't go far over the tenant's MaxEvents before the count is next
+// fetched
+func (tc *tenantCache) add(tenant string, n uint64) {
+	tc.l.Lock()
+	defer tc.l.Unlock()
+	if e, ok := tc.m[tenant]; ok {
+		e.events += n
+		tc.m[tenant] = e
+	}
+}
+
+func (tc *tenantCache) forget(tenant string) {
+	tc.l.Lock()
+	defer tc.l.Unlock()
+	delete(tc.m, tenant)
+}
+
+func (p *Peel) cachedTenant(ctx context.Context, tenant string) (tenantCacheEntry, error) {
+	now := time.Now()
+	if e, ok := p.tenants.get(tenant, now); ok {
+		return e, nil
+	}
+	tc, err := p.getTenantConfig(ctx, tenant)
+	if err != nil {
+		return tenantCacheEntry{}, err
+	}
+	e := tenantCacheEntry{tc: tc, fetched: now}
+	if tc.MaxEvents > 0 {
+		ts, err := p.tenantStatus(ctx, tenant)
+		if err != nil {
+			return tenantCacheEntry{}, err
+		}
+		e.events = ts.Total + ts.Delayed
+	}
+	p.tenants.set(tenant, e)
+	return e, nil
+}
+
+// checkTenants makes sure the events being added don't put any of their
+// queues' tenants over their limits. Events being added to a MigrationTarget
+// were already checked by the Peel migrating them, so aren't checked again.
+func (p *Peel) checkTenants(ctx context.Context, cc []QAddCommand) error {
+	var tenants []string
+	byTenant := map[string]uint64{}
+	for _, c := range cc {
+		tenant := TenantOf(c.Queue)
+		if tenant == "" || c.id != (core.ID{}) {
+			continue
+		} else if _, ok := byTenant[tenant]; !ok {
+			tenants = append(tenants, tenant)
+		}
+		byTenant[tenant]++
+	}
+
+	for _, tenant := range tenants {
+		n := byTenant[tenant]
+		e, err := p.cachedTenant(ctx, tenant)
+		if err != nil {
+			return err
+		} else if e.tc.MaxEvents > 0 && e.events+n > e.tc.MaxEvents {
+			return ErrTenantFull
+		}
+
+		if e.tc.AddRate > 0 {
+			ii := make([]core.ID, n)
+			for i := range ii {
+				ii[i] = core.ID{T: core.TS(i + 1)}
+			}
+			k := tenantKey(tenant)
+			res, err := p.c.Query(ctx, core.QueryActions{
+				KeyBase: k.Base,
+				QueryActions: []core.QueryAction{
+					{QuerySelector: &core.QuerySelector{IDs: ii}},
+					{RateLimit: &k},
+				},
+			})
+			if err != nil {
+				return err
+			} else if uint64(len(res.IDs)) < n {
+				return ErrTenantRateLimited
+			}
+		}
+		p.tenants.add(tenant, n)
+	}
+	return nil
+}
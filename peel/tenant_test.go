@@ -0,0 +1,68 @@
+package peel
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantOf(t *T) {
+	assert.Equal(t, "foo", TenantOf("foo.bar"))
+	assert.Equal(t, "foo", TenantOf("foo.bar.baz"))
+	assert.Equal(t, "", TenantOf("foo"))
+}
+
+func TestTenantLimits(t *T) {
+	tenant := testutil.RandStr()
+	queueA, queueB := tenant+".a", tenant+".b"
+	require.Nil(t, testPeel.QSetTenantConfig(testCtx, QSetTenantConfigCommand{
+		Tenant:       tenant,
+		TenantConfig: TenantConfig{MaxEvents: 3},
+	}))
+	tc, err := testPeel.QGetTenantConfig(testCtx, QGetTenantConfigCommand{Tenant: tenant})
+	require.Nil(t, err)
+	assert.Equal(t, TenantConfig{MaxEvents: 3}, tc)
+
+	add := func(queue string, n int) error {
+		cc := make([]QAddCommand, n)
+		for i := range cc {
+			cc[i] = QAddCommand{
+				Queue:    queue,
+				Expire:   time.Now().Add(time.Minute),
+				Contents: testutil.RandStr(),
+			}
+		}
+		_, err := testPeel.QAddMulti(testCtx, cc)
+		return err
+	}
+	require.Nil(t, add(queueA, 2))
+	require.Nil(t, add(queueB, 1))
+	assert.Equal(t, ErrTenantFull, add(queueA, 1))
+	assert.Equal(t, ErrTenantFull, add(queueB, 1))
+
+	// Queues which don't belong to the tenant aren't limited by it
+	require.Nil(t, add(testutil.RandStr(), 5))
+
+	_, err = testPeel.QGet(testCtx, QGetCommand{Queue: queueA, ConsumerGroup: "cg", AckDeadline: time.Now().Add(time.Minute)})
+	require.Nil(t, err)
+	ts, err := testPeel.QTenantStatus(testCtx, QTenantStatusCommand{Tenant: tenant})
+	require.Nil(t, err)
+	assert.Equal(t, TenantStats{Queues: []string{queueA, queueB}, Total: 3, InProgress: 1}, ts)
+
+	// Removing the limit lets events be added again
+	require.Nil(t, testPeel.QSetTenantConfig(testCtx, QSetTenantConfigCommand{Tenant: tenant}))
+	require.Nil(t, add(queueA, 1))
+
+	require.Nil(t, testPeel.QSetTenantConfig(testCtx, QSetTenantConfigCommand{
+		Tenant:       tenant,
+		TenantConfig: TenantConfig{AddRate: 0.001, AddBurst: 2},
+	}))
+	require.Nil(t, add(queueA, 1))
+	require.Nil(t, add(queueB, 1))
+	assert.Equal(t, ErrTenantRateLimited, add(queueA, 1))
+
+	assert.NotNil(t, testPeel.QSetTenantConfig(testCtx, QSetTenantConfigCommand{Tenant: "foo.bar"}))
+}
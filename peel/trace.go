@@ -0,0 +1,180 @@
+package peel
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// TraceState describes a transition which an event made, as recorded for
+// queues with a TraceMaxLength (see QueueConfig) and returned by QTrace
+type TraceState string
+
+// The possible TraceStates. TraceAdded and TraceExpired happen to an event as a
+// whole, the rest happen within a consumer group.
+const (
+	TraceAdded        TraceState = "added"
+	TraceExpired      TraceState = "expired"
+	TraceDelivered    TraceState = "delivered"
+	TraceAcked        TraceState = "acked"
+	TraceNacked       TraceState = "nacked"
+	TraceDeadLettered TraceState = "deadlettered"
+)
+
+var (
+	queueTraceStates  = []TraceState{TraceAdded, TraceExpired}
+	cgroupTraceStates = []TraceState{TraceDelivered, TraceAcked, TraceNacked, TraceDeadLettered}
+)
+
+// returns actions which record that the events in their input made the given
+// transition, and which publish it for QWatch, or nil if the queue neither
+// keeps a trace nor has Notify set. The input is passed through as the output.
+func traceActions(qc QueueConfig, queue, cgroup string, state TraceState, now core.TS) ([]core.QueryAction, error) {
+	var qq []core.QueryAction
+	if qc.TraceMaxLength > 0 {
+		k, err := queueTrace(queue, cgroup, state)
+		if err != nil {
+			return nil, err
+		}
+		qq = append(qq, core.QueryAction{
+			QueryAddTo: &core.QueryAddTo{Keys: []core.Key{k}, Score: now},
+		})
+	}
+	if qc.Notify {
+		k, err := queueNotify(queue)
+		if err != nil {
+			return nil, err
+		}
+		qq = append(qq, core.QueryAction{
+			QueryPublish: &core.QueryPublish{
+				Key:     k,
+				Message: notificationMessage(state, cgroup, now),
+			},
+		})
+	}
+	return qq, nil
+}
+
+// returns actions which only keep the TraceMaxLength most recent events in each
+// of the given trace keys, or which delete them if the queue doesn't keep a
+// trace
+func trimTraces(qc QueueConfig, kk []core.Key) []core.QueryAction {
+	var qq []core.QueryAction
+	for i := range kk {
+		if qc.TraceMaxLength == 0 {
+			qq = append(qq, core.QueryAction{Delete: &kk[i]})
+			continue
+		}
+		qq = append(qq,
+			core.QueryAction{
+				QuerySelector: &core.QuerySelector{
+					Key:            kk[i],
+					PosRangeSelect: []int64{0, -int64(qc.TraceMaxLength) - 1},
+				},
+			},
+			core.QueryAction{RemoveFrom: []core.Key{kk[i]}},
+		)
+	}
+	return qq
+}
+
+// QTraceCommand describes the parameters which can be passed into the QTrace
+// command
+type QTraceCommand struct {
+	Queue   string  // Required
+	EventID core.ID // Required
+}
+
+// TraceEntry describes a single transition made by an event, as returned by
+// QTrace
+type TraceEntry struct {
+	State TraceState
+
+	// Empty for TraceAdded and TraceExpired
+	ConsumerGroup string
+
+	Time time.Time
+}
+
+// QTrace returns the transitions recorded for the given event, oldest first.
+// Transitions are only recorded while the queue has a TraceMaxLength (see
+// QueueConfig), and only the latest time an event made each transition within
+// a consumer group is kept, so e.g. an event which was delivered to a consumer
+// group twice only has its second delivery returned. If the queue is sharded
+// each of its shards is checked for the event.
+func (p *Peel) QTrace(ctx context.Context, c QTraceCommand) (tt []TraceEntry, err error) {
+	ctx, end := p.start(ctx, "QTrace", c.Queue, "")
+	defer end(&err, func() int { return len(tt) })
+
+	shards, err := p.queueShards(ctx, c.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	tt = []TraceEntry{}
+	for _, q := range shards {
+		qtt, err := p.qtrace(ctx, q, c.EventID)
+		if err != nil {
+			return nil, err
+		}
+		tt = append(tt, qtt...)
+	}
+
+	sort.SliceStable(tt, func(i, j int) bool {
+		return tt[i].Time.Before(tt[j].Time)
+	})
+	return tt, nil
+}
+
+func (p *Peel) qtrace(ctx context.Context, queue string, id core.ID) ([]TraceEntry, error) {
+	cgroups, err := p.queueConsumerGroups(ctx, queue)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each trace key is checked for the event, in the same order as entries
+	var entries []TraceEntry
+	var kk []core.Key
+	for _, cgroup := range append([]string{""}, cgroups...) {
+		states := cgroupTraceStates
+		if cgroup == "" {
+			states = queueTraceStates
+		}
+		for _, state := range states {
+			k, err := queueTrace(queue, cgroup, state)
+			if err != nil {
+				return nil, err
+			}
+			kk = append(kk, k)
+			entries = append(entries, TraceEntry{State: state, ConsumerGroup: cgroup})
+		}
+	}
+
+	qq := []core.QueryAction{{
+		QuerySelector: &core.QuerySelector{Key: kk[0], IDs: []core.ID{id}},
+	}}
+	for i := range kk {
+		qq = append(qq, core.QueryAction{ScoresFrom: &kk[i]})
+	}
+
+	res, err := p.c.Query(ctx, core.QueryActions{
+		KeyBase:      kk[0].Base,
+		QueryActions: qq,
+		Now:          core.NewTS(p.now()),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var tt []TraceEntry
+	for i, score := range res.Counts {
+		if score == 0 {
+			continue
+		}
+		entries[i].Time = core.TS(score).Time()
+		tt = append(tt, entries[i])
+	}
+	return tt, nil
+}
@@ -0,0 +1,113 @@
+package peel
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQTrace(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+	cgroup2 := testutil.RandStr()
+
+	qadd := func(expire time.Duration) core.ID {
+		id, err := testPeel.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(expire),
+			Contents: testutil.RandStr(),
+		})
+		require.Nil(t, err)
+		return id
+	}
+	qgetNack := func(cgroup string, ack bool) {
+		e, err := testPeel.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   time.Now().Add(time.Minute),
+		})
+		require.Nil(t, err)
+		require.NotEqual(t, core.Event{}, e)
+		if ack {
+			_, err = testPeel.QAck(testCtx, QAckCommand{Queue: queue, ConsumerGroup: cgroup, EventID: e.ID})
+		} else {
+			_, err = testPeel.QNack(testCtx, QNackCommand{Queue: queue, ConsumerGroup: cgroup, EventID: e.ID})
+		}
+		require.Nil(t, err)
+	}
+	assertTrace := func(id core.ID, expected ...TraceEntry) {
+		tt, err := testPeel.QTrace(testCtx, QTraceCommand{Queue: queue, EventID: id})
+		require.Nil(t, err)
+		require.Len(t, tt, len(expected))
+		if len(expected) == 0 {
+			return
+		}
+		for i := range tt {
+			assert.False(t, tt[i].Time.IsZero())
+			tt[i].Time = time.Time{}
+		}
+		assert.Equal(t, expected, tt)
+	}
+
+	// Nothing is recorded by default
+	id := qadd(time.Minute)
+	assertTrace(id)
+	require.Nil(t, testPeel.QFlush(testCtx, QFlushCommand{Queue: queue}))
+
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       queue,
+		QueueConfig: QueueConfig{TraceMaxLength: 10, MaxDeliveries: 2},
+	}))
+
+	// Only the latest delivery to cgroup is kept, and the event being nacked
+	// the second time moves it to cgroup2's dead set
+	id = qadd(time.Minute)
+	qgetNack(cgroup, false)
+	qgetNack(cgroup, true)
+	qgetNack(cgroup2, false)
+	qgetNack(cgroup2, false)
+	assertTrace(id,
+		TraceEntry{State: TraceAdded},
+		TraceEntry{State: TraceNacked, ConsumerGroup: cgroup},
+		TraceEntry{State: TraceDelivered, ConsumerGroup: cgroup},
+		TraceEntry{State: TraceAcked, ConsumerGroup: cgroup},
+		TraceEntry{State: TraceDelivered, ConsumerGroup: cgroup2},
+		TraceEntry{State: TraceNacked, ConsumerGroup: cgroup2},
+		TraceEntry{State: TraceDeadLettered, ConsumerGroup: cgroup2},
+	)
+
+	id2 := qadd(50 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	require.Nil(t, testPeel.CleanAvailable(testCtx, queue))
+	assertTrace(id2,
+		TraceEntry{State: TraceAdded},
+		TraceEntry{State: TraceExpired},
+	)
+
+	// Cleaning only keeps the most recent events which made each transition
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       queue,
+		QueueConfig: QueueConfig{TraceMaxLength: 1, MaxDeliveries: 2},
+	}))
+	require.Nil(t, testPeel.CleanAvailable(testCtx, queue))
+	assertTrace(id,
+		TraceEntry{State: TraceNacked, ConsumerGroup: cgroup},
+		TraceEntry{State: TraceDelivered, ConsumerGroup: cgroup},
+		TraceEntry{State: TraceAcked, ConsumerGroup: cgroup},
+		TraceEntry{State: TraceDelivered, ConsumerGroup: cgroup2},
+		TraceEntry{State: TraceNacked, ConsumerGroup: cgroup2},
+		TraceEntry{State: TraceDeadLettered, ConsumerGroup: cgroup2},
+	)
+
+	// Everything recorded is forgotten once it's disabled
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{Queue: queue}))
+	require.Nil(t, testPeel.CleanAvailable(testCtx, queue))
+	require.Nil(t, testPeel.Clean(testCtx, queue, cgroup))
+	require.Nil(t, testPeel.Clean(testCtx, queue, cgroup2))
+	assertTrace(id)
+	assertTrace(id2)
+}
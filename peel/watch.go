@@ -0,0 +1,131 @@
+package peel
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// QWatchCommand describes the parameters which can be passed into the QWatch
+// command
+type QWatchCommand struct {
+	Queue string // Required
+
+	// Optional. If given only Notifications of these transitions are
+	// returned, otherwise all of them are.
+	States []TraceState
+}
+
+// Notification describes a transition which one or more events made together,
+// as returned by QWatch
+type Notification struct {
+	// The queue the events are in. If the queue being watched is sharded this
+	// is the name of the shard, see the Shards field of QueueConfig.
+	Queue string
+
+	State TraceState
+
+	// Empty for TraceAdded and TraceExpired
+	ConsumerGroup string
+
+	EventIDs []core.ID
+	Time     time.Time
+}
+
+// returns the Message of the QueryPublish made for a transition, which
+// parseNotification turns back into a Notification
+func notificationMessage(state TraceState, cgroup string, now core.TS) string {
+	return string(state) + " " + strconv.FormatUint(uint64(now), 10) + " " + cgroup
+}
+
+func parseNotification(queue string, pub core.Publication) (Notification, bool) {
+	parts := strings.SplitN(pub.Message, " ", 3)
+	if len(parts) != 3 {
+		return Notification{}, false
+	}
+	ts, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return Notification{}, false
+	}
+	return Notification{
+		Queue:         queue,
+		State:         TraceState(parts[0]),
+		ConsumerGroup: parts[2],
+		EventIDs:      pub.IDs,
+		Time:          core.TS(ts).Time(),
+	}, true
+}
+
+// QWatch writes a Notification to the returned channel each time events in the
+// queue make a transition (see TraceState), so that the queue's activity can be
+// followed without consuming it as a consumer group does. Notifications are
+// only published while the queue has Notify set (see QueueConfig). If the queue
+// is sharded each of its shards is watched.
+//
+// Notifications are published using redis pubsub, so they're best effort:
+// those published while the Peel's pubsub connection is down, or while the
+// channel isn't being read from quickly enough, are lost, and a transition made
+// by a command which was retried (see core.RetryPolicy) may be received twice.
+// Use a consumer group, or QTrace, where every transition must be seen.
+//
+// The returned function stops watching, after which the channel is closed.
+// Watching is also stopped once ctx is done.
+func (p *Peel) QWatch(ctx context.Context, c QWatchCommand) (<-chan Notification, func(), error) {
+	if c.Queue == "" {
+		return nil, nil, errors.New("Queue is required")
+	}
+
+	shards, err := p.queueShards(ctx, c.Queue)
+	if err != nil {
+		return nil, nil, err
+	}
+	kk := make([]core.Key, len(shards))
+	for i, q := range shards {
+		if kk[i], err = queueNotify(q); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	states := map[TraceState]bool{}
+	for _, state := range c.States {
+		states[state] = true
+	}
+
+	ch := make(chan Notification)
+	ctx, stop := context.WithCancel(ctx)
+	wg := new(sync.WaitGroup)
+	for i, q := range shards {
+		// Subscribe before returning, so that anything published after QWatch
+		// returns is seen
+		pubCh := p.c.KeySubscribe(ctx, kk[i])
+		wg.Add(1)
+		go func(q string) {
+			defer wg.Done()
+			p.watch(ctx, q, pubCh, states, ch)
+		}(q)
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	return ch, stop, nil
+}
+
+func (p *Peel) watch(ctx context.Context, queue string, pubCh <-chan core.Publication, states map[TraceState]bool, ch chan<- Notification) {
+	for pub := range pubCh {
+		n, ok := parseNotification(queue, pub)
+		if !ok || (len(states) > 0 && !states[n.State]) {
+			continue
+		}
+		select {
+		case ch <- n:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package peel
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQWatch(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+	cgroup2 := testutil.RandStr()
+
+	ch, stop, err := testPeel.QWatch(testCtx, QWatchCommand{
+		Queue:  queue,
+		States: []TraceState{TraceAdded, TraceAcked, TraceDeadLettered},
+	})
+	require.Nil(t, err)
+
+	qadd := func() core.ID {
+		id, err := testPeel.QAdd(testCtx, QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(time.Minute),
+			Contents: testutil.RandStr(),
+		})
+		require.Nil(t, err)
+		return id
+	}
+	assertNotification := func(expected Notification) {
+		select {
+		case n := <-ch:
+			assert.False(t, n.Time.IsZero())
+			n.Time = time.Time{}
+			assert.Equal(t, expected, n)
+		case <-time.After(time.Second):
+			assert.Fail(t, "notification not received", "expected:%#v", expected)
+		}
+	}
+	assertNoNotification := func() {
+		select {
+		case n := <-ch:
+			assert.Fail(t, "unexpected notification", "%#v", n)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// Nothing is published by default
+	qadd()
+	assertNoNotification()
+	require.Nil(t, testPeel.QFlush(testCtx, QFlushCommand{Queue: queue}))
+
+	require.Nil(t, testPeel.QSetConfig(testCtx, QSetConfigCommand{
+		Queue:       queue,
+		QueueConfig: QueueConfig{Notify: true, MaxDeliveries: 1},
+	}))
+
+	id := qadd()
+	assertNotification(Notification{Queue: queue, State: TraceAdded, EventIDs: []core.ID{id}})
+
+	// The event being nacked in cgroup2 moves it to the dead set straight
+	// away, and neither delivery nor the nack is returned
+	for _, cgroup := range []string{cgroup, cgroup2} {
+		e, err := testPeel.QGet(testCtx, QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   time.Now().Add(time.Minute),
+		})
+		require.Nil(t, err)
+		require.Equal(t, id, e.ID)
+	}
+	_, err = testPeel.QAck(testCtx, QAckCommand{Queue: queue, ConsumerGroup: cgroup, EventID: id})
+	require.Nil(t, err)
+	assertNotification(Notification{Queue: queue, State: TraceAcked, ConsumerGroup: cgroup, EventIDs: []core.ID{id}})
+	_, err = testPeel.QNack(testCtx, QNackCommand{Queue: queue, ConsumerGroup: cgroup2, EventID: id})
+	require.Nil(t, err)
+	assertNotification(Notification{Queue: queue, State: TraceDeadLettered, ConsumerGroup: cgroup2, EventIDs: []core.ID{id}})
+	assertNoNotification()
+
+	stop()
+	for range ch {
+	}
+}
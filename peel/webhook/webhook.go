@@ -0,0 +1,274 @@
+// Package webhook delivers the events in a queue to HTTP endpoints, for
+// consumers which can't run a polling loop of their own. A Dispatcher POSTs
+// every event to each of its Endpoints, retrying failed deliveries with an
+// exponential backoff, and moving events which still can't be delivered after
+// MaxAttempts to the endpoint's dead set, where they can be inspected with
+// peel's QDeadList and retried with QDeadRedrive.
+//
+// Each request is signed if the Endpoint has a Secret, so that the receiver
+// can check the request came from the Dispatcher:
+//
+//	func handle(w http.ResponseWriter, r *http.Request) {
+//		body, err := io.ReadAll(r.Body)
+//		if err != nil {
+//			http.Error(w, err.Error(), 500)
+//			return
+//		} else if err := webhook.Verify(secret, r.Header, body, 5*time.Minute); err != nil {
+//			http.Error(w, err.Error(), 401)
+//			return
+//		}
+//		...
+//	}
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+)
+
+// Headers which are sent with each request
+const (
+	HeaderID        = "Bananaq-Id"
+	HeaderAttempt   = "Bananaq-Attempt"
+	HeaderTimestamp = "Bananaq-Timestamp"
+	HeaderSignature = "Bananaq-Signature"
+)
+
+// The version prefixed to each signature, so that the scheme can be changed
+// without receivers mistaking one kind of signature for another
+const signatureVersion = "v1="
+
+// Default values for the fields of Dispatcher
+const (
+	defaultMaxAttempts = 10
+	defaultMinBackoff  = 1 * time.Second
+	defaultMaxBackoff  = 5 * time.Minute
+	defaultTimeout     = 30 * time.Second
+)
+
+// Endpoint is an HTTP endpoint which a Dispatcher POSTs events to
+type Endpoint struct {
+	// Required. The consumer group the endpoint's events are retrieved for, so
+	// each Endpoint is sent every event in the queue, and undeliverable events
+	// can be found in this consumer group's dead set.
+	Name string
+
+	URL string // Required
+
+	// Optional. If set each request is signed with it, see Sign.
+	Secret string
+}
+
+// Dispatcher consumes a queue and POSTs each event to every one of its
+// Endpoints, with the event's contents as the body. The Content-Type is
+// application/cloudevents+json for events added with a CloudEvent,
+// application/json for other events whose contents are JSON, and otherwise
+// application/octet-stream. The event's ID and the number of the attempt are
+// sent in the Bananaq-Id and Bananaq-Attempt headers.
+//
+// Any 2xx response acks the event. Anything else, or an error making the
+// request, is a failed attempt, and the event is attempted again once the
+// backoff has passed. Since an event may be delivered more than once, e.g. if
+// the Dispatcher stops between delivering and acking it, endpoints should use
+// the Bananaq-Id header to ignore duplicates.
+type Dispatcher struct {
+	Peel      *peel.Peel // Required
+	Queue     string     // Required
+	Endpoints []Endpoint // Required
+
+	// Default a client with a 30 second Timeout. Used to make every request.
+	Client *http.Client
+
+	// Default 10. How many times each event is attempted before it's moved
+	// to the endpoint's dead set.
+	MaxAttempts int
+
+	// Default 1 second and 5 minutes. The backoff after the first failed
+	// attempt is MinBackoff, and it doubles after each further one up to
+	// MaxBackoff.
+	MinBackoff, MaxBackoff time.Duration
+
+	// Default 1. The most events which may be being delivered to each
+	// Endpoint at once, including those waiting out their backoff. Events
+	// are delivered in the order they're retrieved only if this is 1.
+	Concurrency int
+
+	// Optional. Called with every error encountered, see peel.Consumer.
+	OnError func(error)
+}
+
+// Run delivers events until ctx is done or the Peel starts draining, see
+// peel.Consumer's Run. An error is only returned if the Dispatcher's fields
+// are invalid.
+func (d Dispatcher) Run(ctx context.Context) error {
+	if d.Peel == nil || d.Queue == "" {
+		return errors.New("Peel and Queue are required")
+	} else if len(d.Endpoints) == 0 {
+		return errors.New("at least one Endpoint is required")
+	}
+	names := map[string]bool{}
+	for _, ep := range d.Endpoints {
+		if ep.Name == "" || ep.URL == "" {
+			return errors.New("Endpoint Name and URL are required")
+		} else if names[ep.Name] {
+			return fmt.Errorf("Endpoint Name %q is used more than once", ep.Name)
+		} else if u, err := url.Parse(ep.URL); err != nil {
+			return fmt.Errorf("invalid Endpoint URL %q: %s", ep.URL, err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("Endpoint URL %q must be http or https", ep.URL)
+		}
+		names[ep.Name] = true
+	}
+
+	if d.Client == nil {
+		d.Client = &http.Client{Timeout: defaultTimeout}
+	}
+	if d.MaxAttempts < 1 {
+		d.MaxAttempts = defaultMaxAttempts
+	}
+	if d.MinBackoff <= 0 {
+		d.MinBackoff = defaultMinBackoff
+	}
+	if d.MaxBackoff <= 0 {
+		d.MaxBackoff = defaultMaxBackoff
+	}
+	d.MaxBackoff = max(d.MaxBackoff, d.MinBackoff)
+
+	errCh := make(chan error, len(d.Endpoints))
+	for _, ep := range d.Endpoints {
+		go func(ep Endpoint) {
+			errCh <- peel.Consumer{
+				Peel:          d.Peel,
+				Queue:         d.Queue,
+				ConsumerGroup: ep.Name,
+				Concurrency:   d.Concurrency,
+				OnError:       d.OnError,
+				Handler: func(ctx context.Context, e core.Event) error {
+					return d.handle(ctx, ep, e)
+				},
+			}.Run(ctx)
+		}(ep)
+	}
+
+	var err error
+	for range d.Endpoints {
+		if runErr := <-errCh; runErr != nil && err == nil {
+			err = runErr
+		}
+	}
+	return err
+}
+
+// handle makes a single attempt at delivering the event. The number of
+// attempts is kept by the Peel, as the event's Attempts, so that it's
+// remembered across restarts. After a failed attempt the event is held on to,
+// with its deadline being extended, until the backoff has passed, and then
+// nacked so it's retrieved again straight away.
+func (d Dispatcher) handle(ctx context.Context, ep Endpoint, e core.Event) error {
+	err := d.deliver(ctx, ep, e)
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("delivering %s to %s: %w", e.ID, ep.Name, err)
+	if e.Attempts >= uint64(d.MaxAttempts) {
+		return fmt.Errorf("%w after %d attempts: %w", peel.ErrDeadLetter, e.Attempts, err)
+	}
+
+	backoff := d.MinBackoff
+	for i := uint64(1); i < e.Attempts && backoff < d.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	select {
+	case <-time.After(min(backoff, d.MaxBackoff)):
+	case <-ctx.Done():
+	}
+	return err
+}
+
+func (d Dispatcher) deliver(ctx context.Context, ep Endpoint, e core.Event) error {
+	body := []byte(e.Contents)
+	r, err := http.NewRequestWithContext(ctx, "POST", ep.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", contentType(e))
+	r.Header.Set(HeaderID, e.ID.String())
+	r.Header.Set(HeaderAttempt, strconv.FormatUint(e.Attempts, 10))
+	if ep.Secret != "" {
+		ts := time.Now().Unix()
+		r.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+		r.Header.Set(HeaderSignature, Sign(ep.Secret, ts, body))
+	}
+
+	resp, err := d.Client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Reading the rest of the body lets the connection be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+	return nil
+}
+
+func contentType(e core.Event) string {
+	if _, err := peel.ParseCloudEvent(e); err == nil {
+		return "application/cloudevents+json"
+	} else if json.Valid([]byte(e.Contents)) {
+		return "application/json"
+	}
+	return "application/octet-stream"
+}
+
+// Sign returns the signature of a request with the given timestamp and body,
+// as it's sent in the Bananaq-Signature header. It's "v1=" followed by the hex
+// encoded HMAC-SHA256, keyed by the secret, of the timestamp in unix seconds, a
+// '.', and the body. The timestamp is sent in the Bananaq-Timestamp header, and
+// is signed so that an old request can't be replayed.
+func Sign(secret string, timestamp int64, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	h.Write([]byte("."))
+	h.Write(body)
+	return signatureVersion + hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify checks that the headers of a request have a valid signature of the
+// body for the secret, see Sign. If tolerance is set then the request's
+// timestamp must also be no further than that from the current time.
+func Verify(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header", HeaderTimestamp)
+	}
+	sig := header.Get(HeaderSignature)
+	if !strings.HasPrefix(sig, signatureVersion) {
+		return fmt.Errorf("invalid %s header", HeaderSignature)
+	} else if !hmac.Equal([]byte(sig), []byte(Sign(secret, ts, body))) {
+		return errors.New("signature doesn't match")
+	}
+
+	if tolerance > 0 {
+		if diff := time.Since(time.Unix(ts, 0)); diff > tolerance || diff < -tolerance {
+			return errors.New("timestamp is outside of tolerance")
+		}
+	}
+	return nil
+}
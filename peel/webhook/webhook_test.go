@@ -0,0 +1,210 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testCtx = context.Background()
+
+func newTestPeel(o *peel.Opts) *peel.Peel {
+	p := peel.NewWithBackend(core.NewMemBackend(), o)
+	errCh := p.Run(nil)
+	go func() { panic(<-errCh) }()
+	return p
+}
+
+type request struct {
+	header http.Header
+	body   string
+}
+
+// testEndpoint records every request made to it, responding to each with the
+// next of its codes, or 200 once they've run out
+type testEndpoint struct {
+	*httptest.Server
+	l     sync.Mutex
+	codes []int
+	rr    []request
+}
+
+func newTestEndpoint(codes ...int) *testEndpoint {
+	te := &testEndpoint{codes: codes}
+	te.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		te.l.Lock()
+		defer te.l.Unlock()
+		te.rr = append(te.rr, request{header: r.Header, body: string(body)})
+		code := 200
+		if len(te.codes) > 0 {
+			code, te.codes = te.codes[0], te.codes[1:]
+		}
+		w.WriteHeader(code)
+	}))
+	return te
+}
+
+func (te *testEndpoint) requests() []request {
+	te.l.Lock()
+	defer te.l.Unlock()
+	return append([]request(nil), te.rr...)
+}
+
+func runTestDispatcher(t *T, d Dispatcher) func() {
+	ctx, cancel := context.WithCancel(testCtx)
+	doneCh := make(chan error)
+	go func() { doneCh <- d.Run(ctx) }()
+	return func() {
+		cancel()
+		select {
+		case err := <-doneCh:
+			assert.Nil(t, err)
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "Run didn't return")
+		}
+	}
+}
+
+func TestDispatcher(t *T) {
+	p := newTestPeel(nil)
+	queue := testutil.RandStr()
+
+	var ii []core.ID
+	var contents []string
+	for i := 0; i < 3; i++ {
+		contents = append(contents, `{"n":`+strconv.Itoa(i)+`}`)
+		id, err := p.QAdd(testCtx, peel.QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(time.Minute),
+			Contents: contents[i],
+		})
+		require.Nil(t, err)
+		ii = append(ii, id)
+	}
+
+	// The second endpoint fails the first attempt at the first event
+	ok, flaky := newTestEndpoint(), newTestEndpoint(500)
+	defer ok.Close()
+	defer flaky.Close()
+	secret := testutil.RandStr()
+	stop := runTestDispatcher(t, Dispatcher{
+		Peel:  p,
+		Queue: queue,
+		Endpoints: []Endpoint{
+			{Name: "ok", URL: ok.URL, Secret: secret},
+			{Name: "flaky", URL: flaky.URL},
+		},
+		MinBackoff: 10 * time.Millisecond,
+	})
+	time.Sleep(200 * time.Millisecond)
+	stop()
+
+	rr := ok.requests()
+	require.Len(t, rr, 3)
+	for i, r := range rr {
+		assert.Equal(t, contents[i], r.body)
+		assert.Equal(t, ii[i].String(), r.header.Get(HeaderID))
+		assert.Equal(t, "1", r.header.Get(HeaderAttempt))
+		assert.Equal(t, "application/json", r.header.Get("Content-Type"))
+		assert.Nil(t, Verify(secret, r.header, []byte(r.body), time.Minute))
+	}
+
+	rr = flaky.requests()
+	require.Len(t, rr, 4)
+	assert.Equal(t, ii[0].String(), rr[0].header.Get(HeaderID))
+	assert.Equal(t, ii[0].String(), rr[1].header.Get(HeaderID))
+	assert.Equal(t, "2", rr[1].header.Get(HeaderAttempt))
+	assert.Empty(t, rr[0].header.Get(HeaderSignature))
+
+	for _, cgroup := range []string{"ok", "flaky"} {
+		qsm, err := p.QStatus(testCtx, peel.QStatusCommand{
+			QueuesConsumerGroups: map[string][]string{queue: {cgroup}},
+		})
+		require.Nil(t, err)
+		assert.Equal(t, uint64(3), qsm[queue].ConsumerGroupStats[cgroup].Done, "cgroup:%s", cgroup)
+	}
+}
+
+func TestDispatcherDeadLetter(t *T) {
+	p := newTestPeel(nil)
+	queue := testutil.RandStr()
+	id, err := p.QAdd(testCtx, peel.QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(time.Minute),
+		Contents: "foo",
+	})
+	require.Nil(t, err)
+
+	down := newTestEndpoint(503, 503, 503, 503)
+	defer down.Close()
+	stop := runTestDispatcher(t, Dispatcher{
+		Peel:        p,
+		Queue:       queue,
+		Endpoints:   []Endpoint{{Name: "down", URL: down.URL}},
+		MaxAttempts: 3,
+		MinBackoff:  10 * time.Millisecond,
+	})
+	time.Sleep(200 * time.Millisecond)
+	stop()
+
+	rr := down.requests()
+	require.Len(t, rr, 3)
+	assert.Equal(t, "application/octet-stream", rr[0].header.Get("Content-Type"))
+	assert.Equal(t, "3", rr[2].header.Get(HeaderAttempt))
+
+	dd, _, err := p.QDeadList(testCtx, peel.QDeadListCommand{Queue: queue, ConsumerGroup: "down"})
+	require.Nil(t, err)
+	require.Len(t, dd, 1)
+	assert.Equal(t, id, dd[0].ID)
+	assert.Equal(t, uint64(3), dd[0].Attempts)
+	assert.Contains(t, dd[0].LastError, "503")
+}
+
+func TestDispatcherValidate(t *T) {
+	p := newTestPeel(nil)
+	ep := Endpoint{Name: "foo", URL: "http://localhost"}
+	for _, d := range []Dispatcher{
+		{Queue: "foo", Endpoints: []Endpoint{ep}},
+		{Peel: p, Endpoints: []Endpoint{ep}},
+		{Peel: p, Queue: "foo"},
+		{Peel: p, Queue: "foo", Endpoints: []Endpoint{{Name: "foo"}}},
+		{Peel: p, Queue: "foo", Endpoints: []Endpoint{ep, ep}},
+		{Peel: p, Queue: "foo", Endpoints: []Endpoint{{Name: "foo", URL: "ftp://localhost"}}},
+	} {
+		assert.NotNil(t, d.Run(testCtx))
+	}
+}
+
+func TestVerify(t *T) {
+	secret, body := testutil.RandStr(), []byte(testutil.RandStr())
+	now := time.Now().Unix()
+	header := func(ts int64, sig string) http.Header {
+		h := http.Header{}
+		h.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+		h.Set(HeaderSignature, sig)
+		return h
+	}
+
+	assert.Nil(t, Verify(secret, header(now, Sign(secret, now, body)), body, time.Minute))
+	assert.NotNil(t, Verify("bad", header(now, Sign(secret, now, body)), body, time.Minute))
+	assert.NotNil(t, Verify(secret, header(now, Sign(secret, now, body)), []byte("bad"), time.Minute))
+	assert.NotNil(t, Verify(secret, header(now+1, Sign(secret, now, body)), body, time.Minute))
+	assert.NotNil(t, Verify(secret, http.Header{}, body, time.Minute))
+
+	// An old signature is only valid if there's no tolerance
+	old := now - 3600
+	assert.NotNil(t, Verify(secret, header(old, Sign(secret, old, body)), body, time.Minute))
+	assert.Nil(t, Verify(secret, header(old, Sign(secret, old, body)), body, 0))
+}
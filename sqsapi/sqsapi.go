@@ -0,0 +1,580 @@
+// Package sqsapi serves a subset of Amazon SQS's API on top of a Peel, so that
+// applications already using an SQS SDK can be pointed at bananaq by changing
+// their endpoint. The following actions are supported:
+//
+//	SendMessage             QAdd. DelaySeconds, MessageDeduplicationId and
+//	                        MessageGroupId are supported, message attributes
+//	                        aren't.
+//	ReceiveMessage          QGetMulti, with VisibilityTimeout as the
+//	                        AckDeadline and WaitTimeSeconds to long-poll.
+//	DeleteMessage           QAck
+//	ChangeMessageVisibility QExtend, or QNack if the timeout is 0
+//	GetQueueAttributes      QStatus and QGetConfig
+//	GetQueueUrl
+//
+// Only the JSON protocol (Content-Type application/x-amz-json-1.0, with the
+// action in the X-Amz-Target header) is spoken, which is what current SDKs
+// use. Requests' signatures aren't checked, so the handler should only be
+// reachable by trusted clients.
+//
+// SQS has no consumer groups, so every message is received by the
+// ConsumerGroup consumer group. Other consumer groups can consume the same
+// queues through bananaq's other APIs as usual. A queue's URL is the endpoint's
+// URL with the queue's name as its path, though only the last path segment of
+// any QueueUrl is looked at, so real SQS URLs with an account ID work too.
+//
+// Messages are added with the SQS default retention of 4 days, unless their
+// queue has a DefaultTTL (see peel.QueueConfig).
+package sqsapi
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+)
+
+// ConsumerGroup is the consumer group all messages are received by
+const ConsumerGroup = "sqs"
+
+// Defaults which SQS would take from a queue's attributes
+const (
+	DefaultVisibilityTimeout = 30 * time.Second
+	DefaultRetention         = 4 * 24 * time.Hour
+)
+
+// Limits on parameters, as SQS has them
+const (
+	maxDelaySeconds      = 900
+	maxVisibilityTimeout = 43200
+	maxWaitTimeSeconds   = 20
+	maxNumberOfMessages  = 10
+)
+
+// targetPrefix prefixes the action in each request's X-Amz-Target header
+const targetPrefix = "AmazonSQS."
+
+// sqsError is an error returned to the client as an SQS error of the given
+// code, e.g. "InvalidParameterValue"
+type sqsError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (se sqsError) Error() string {
+	return se.msg
+}
+
+func invalidParam(format string, args ...interface{}) error {
+	return sqsError{
+		status: http.StatusBadRequest,
+		code:   "InvalidParameterValue",
+		msg:    fmt.Sprintf(format, args...),
+	}
+}
+
+var errInvalidReceiptHandle = sqsError{
+	status: http.StatusBadRequest,
+	code:   "ReceiptHandleIsInvalid",
+	msg:    "the receipt handle is invalid",
+}
+
+var errNotInflight = sqsError{
+	status: http.StatusBadRequest,
+	code:   "MessageNotInflight",
+	msg:    "the message's visibility timeout has already passed, or it was deleted",
+}
+
+type handler struct {
+	p *peel.Peel
+}
+
+// New returns an http.Handler which serves the API described in the package
+// doc using the given Peel, which should already be running.
+func New(p *peel.Peel) http.Handler {
+	return handler{p: p}
+}
+
+func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var ret interface{}
+	var err error
+	if r.Method != "POST" {
+		err = sqsError{
+			status: http.StatusMethodNotAllowed,
+			code:   "InvalidAction",
+			msg:    "method must be POST",
+		}
+	} else {
+		ret, err = h.route(r)
+	}
+
+	if err != nil {
+		se, ok := err.(sqsError)
+		if !ok {
+			se = sqsError{
+				status: http.StatusInternalServerError,
+				code:   "InternalError",
+				msg:    err.Error(),
+			}
+			switch err {
+			case peel.ErrContentsTooLarge, peel.ErrNoExpire, peel.ErrNotGrouped, peel.ErrStrictFIFO:
+				se.status, se.code = http.StatusBadRequest, "InvalidParameterValue"
+			case peel.ErrQueueFull, peel.ErrDraining, peel.ErrTenantFull, peel.ErrTenantRateLimited:
+				se.status, se.code = http.StatusServiceUnavailable, "ServiceUnavailable"
+			}
+		}
+		fault := "Sender"
+		if se.status >= 500 {
+			fault = "Receiver"
+		}
+		w.Header().Set("x-amzn-query-error", se.code+";"+fault)
+		writeJSON(w, se.status, map[string]string{
+			"__type":  "com.amazonaws.sqs#" + se.code,
+			"message": se.msg,
+		})
+		return
+	}
+	if ret == nil {
+		ret = struct{}{}
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// route decodes the request's body and calls the method for its action,
+// returning what should be written back
+func (h handler) route(r *http.Request) (interface{}, error) {
+	action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), targetPrefix)
+	decode := func(v interface{}) error {
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+			return sqsError{
+				status: http.StatusBadRequest,
+				code:   "InvalidParameterValue",
+				msg:    fmt.Sprintf("invalid body: %s", err),
+			}
+		}
+		return nil
+	}
+
+	switch action {
+	case "SendMessage":
+		var req sendMessageRequest
+		if err := decode(&req); err != nil {
+			return nil, err
+		}
+		return h.sendMessage(r, req)
+
+	case "ReceiveMessage":
+		var req receiveMessageRequest
+		if err := decode(&req); err != nil {
+			return nil, err
+		}
+		return h.receiveMessage(r, req)
+
+	case "DeleteMessage":
+		var req deleteMessageRequest
+		if err := decode(&req); err != nil {
+			return nil, err
+		}
+		return nil, h.deleteMessage(r, req)
+
+	case "ChangeMessageVisibility":
+		var req changeMessageVisibilityRequest
+		if err := decode(&req); err != nil {
+			return nil, err
+		}
+		return nil, h.changeMessageVisibility(r, req)
+
+	case "GetQueueAttributes":
+		var req getQueueAttributesRequest
+		if err := decode(&req); err != nil {
+			return nil, err
+		}
+		return h.getQueueAttributes(r, req)
+
+	case "GetQueueUrl":
+		var req getQueueURLRequest
+		if err := decode(&req); err != nil {
+			return nil, err
+		}
+		return h.getQueueURL(r, req)
+	}
+
+	return nil, sqsError{
+		status: http.StatusBadRequest,
+		code:   "InvalidAction",
+		msg:    fmt.Sprintf("unsupported action %q", action),
+	}
+}
+
+// returns the name of the queue the QueueUrl refers to
+func queueName(queueURL string) (string, error) {
+	queueURL = strings.TrimRight(queueURL, "/")
+	queue := queueURL[strings.LastIndex(queueURL, "/")+1:]
+	if queue == "" {
+		return "", sqsError{
+			status: http.StatusBadRequest,
+			code:   "MissingParameter",
+			msg:    "QueueUrl is required",
+		}
+	}
+	return queue, nil
+}
+
+// returns the given number of seconds, or def if secs is nil, making sure it's
+// between min and max
+func secsParam(name string, secs *int, def time.Duration, min, max int) (time.Duration, error) {
+	if secs == nil {
+		return def, nil
+	} else if *secs < min || *secs > max {
+		return 0, invalidParam("%s must be between %d and %d", name, min, max)
+	}
+	return time.Duration(*secs) * time.Second, nil
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// A receipt handle is the event's ID and the delivery token it was retrieved
+// with, which is all that's needed to ack it. IDs never contain '.', though
+// delivery tokens may.
+func receiptHandle(e core.Event) string {
+	return e.ID.String() + "." + e.DeliveryToken
+}
+
+func parseReceiptHandle(handle string) (core.ID, string, error) {
+	parts := strings.SplitN(handle, ".", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return core.ID{}, "", errInvalidReceiptHandle
+	}
+	id, err := core.IDFromString(parts[0])
+	if err != nil {
+		return core.ID{}, "", errInvalidReceiptHandle
+	}
+	return id, parts[1], nil
+}
+
+type sendMessageRequest struct {
+	QueueURL               string `json:"QueueUrl"`
+	MessageBody            string
+	DelaySeconds           *int
+	MessageDeduplicationID string `json:"MessageDeduplicationId"`
+	MessageGroupID         string `json:"MessageGroupId"`
+}
+
+type sendMessageResponse struct {
+	MessageID        string `json:"MessageId"`
+	MD5OfMessageBody string
+}
+
+func (h handler) sendMessage(r *http.Request, req sendMessageRequest) (interface{}, error) {
+	queue, err := queueName(req.QueueURL)
+	if err != nil {
+		return nil, err
+	}
+	delay, err := secsParam("DelaySeconds", req.DelaySeconds, 0, 0, maxDelaySeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	qc, err := h.p.QGetConfig(r.Context(), peel.QGetConfigCommand{Queue: queue})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	c := peel.QAddCommand{
+		Queue:    queue,
+		Contents: req.MessageBody,
+		// DedupKeys may not contain ':'
+		DedupKey: strings.ReplaceAll(req.MessageDeduplicationID, ":", "/"),
+		GroupID:  req.MessageGroupID,
+	}
+	if qc.DefaultTTL == 0 {
+		c.Expire = now.Add(DefaultRetention)
+	}
+	if delay > 0 {
+		c.VisibleAfter = now.Add(delay)
+	}
+
+	id, err := h.p.QAdd(r.Context(), c)
+	if err != nil {
+		return nil, err
+	}
+	return sendMessageResponse{
+		MessageID:        id.String(),
+		MD5OfMessageBody: md5Hex(req.MessageBody),
+	}, nil
+}
+
+type receiveMessageRequest struct {
+	QueueURL                    string `json:"QueueUrl"`
+	MaxNumberOfMessages         *int
+	VisibilityTimeout           *int
+	WaitTimeSeconds             *int
+	AttributeNames              []string
+	MessageSystemAttributeNames []string
+}
+
+type message struct {
+	MessageID     string `json:"MessageId"`
+	ReceiptHandle string
+	MD5OfBody     string
+	Body          string
+	Attributes    map[string]string `json:",omitempty"`
+}
+
+type receiveMessageResponse struct {
+	Messages []message `json:",omitempty"`
+}
+
+func (h handler) receiveMessage(r *http.Request, req receiveMessageRequest) (interface{}, error) {
+	queue, err := queueName(req.QueueURL)
+	if err != nil {
+		return nil, err
+	}
+	count := 1
+	if req.MaxNumberOfMessages != nil {
+		if count = *req.MaxNumberOfMessages; count < 1 || count > maxNumberOfMessages {
+			return nil, invalidParam("MaxNumberOfMessages must be between 1 and %d", maxNumberOfMessages)
+		}
+	}
+	// A visibility timeout of 0 would mean the message doesn't need to be
+	// deleted at all, which isn't what SQS means by it
+	visibility, err := secsParam("VisibilityTimeout", req.VisibilityTimeout, DefaultVisibilityTimeout, 1, maxVisibilityTimeout)
+	if err != nil {
+		return nil, err
+	}
+	wait, err := secsParam("WaitTimeSeconds", req.WaitTimeSeconds, 0, 0, maxWaitTimeSeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	c := peel.QGetMultiCommand{
+		QGetCommand: peel.QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: ConsumerGroup,
+			AckDeadline:   now.Add(visibility),
+		},
+		Count: count,
+	}
+	if wait > 0 {
+		c.BlockUntil = now.Add(wait)
+	}
+
+	// The request's context is canceled if the client goes away, which ends
+	// the long-poll early
+	ee, err := h.p.QGetMulti(r.Context(), c)
+	if err != nil && r.Context().Err() != nil {
+		return receiveMessageResponse{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var withReceiveCount bool
+	for _, name := range append(req.AttributeNames, req.MessageSystemAttributeNames...) {
+		if name == "All" || name == "ApproximateReceiveCount" {
+			withReceiveCount = true
+		}
+	}
+
+	var ret receiveMessageResponse
+	for _, e := range ee {
+		m := message{
+			MessageID:     e.ID.String(),
+			ReceiptHandle: receiptHandle(e),
+			MD5OfBody:     md5Hex(e.Contents),
+			Body:          e.Contents,
+		}
+		if withReceiveCount {
+			m.Attributes = map[string]string{
+				"ApproximateReceiveCount": strconv.FormatUint(e.Attempts, 10),
+			}
+		}
+		ret.Messages = append(ret.Messages, m)
+	}
+	return ret, nil
+}
+
+type deleteMessageRequest struct {
+	QueueURL      string `json:"QueueUrl"`
+	ReceiptHandle string
+}
+
+// Like SQS, deleting a message which was already deleted, or whose visibility
+// timeout has passed, isn't an error
+func (h handler) deleteMessage(r *http.Request, req deleteMessageRequest) error {
+	queue, err := queueName(req.QueueURL)
+	if err != nil {
+		return err
+	}
+	id, token, err := parseReceiptHandle(req.ReceiptHandle)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.p.QAck(r.Context(), peel.QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: ConsumerGroup,
+		EventID:       id,
+		DeliveryToken: token,
+	})
+	if err == peel.ErrInvalidDeliveryToken || err == peel.ErrDeliveryTokenRequired {
+		return errInvalidReceiptHandle
+	}
+	return err
+}
+
+type changeMessageVisibilityRequest struct {
+	QueueURL          string `json:"QueueUrl"`
+	ReceiptHandle     string
+	VisibilityTimeout *int
+}
+
+func (h handler) changeMessageVisibility(r *http.Request, req changeMessageVisibilityRequest) error {
+	queue, err := queueName(req.QueueURL)
+	if err != nil {
+		return err
+	}
+	id, token, err := parseReceiptHandle(req.ReceiptHandle)
+	if err != nil {
+		return err
+	} else if req.VisibilityTimeout == nil {
+		return sqsError{
+			status: http.StatusBadRequest,
+			code:   "MissingParameter",
+			msg:    "VisibilityTimeout is required",
+		}
+	}
+	visibility, err := secsParam("VisibilityTimeout", req.VisibilityTimeout, 0, 0, maxVisibilityTimeout)
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	if visibility == 0 {
+		ok, err = h.p.QNack(r.Context(), peel.QNackCommand{
+			Queue:         queue,
+			ConsumerGroup: ConsumerGroup,
+			EventID:       id,
+			DeliveryToken: token,
+		})
+	} else {
+		ok, err = h.p.QExtend(r.Context(), peel.QExtendCommand{
+			Queue:         queue,
+			ConsumerGroup: ConsumerGroup,
+			EventID:       id,
+			AckDeadline:   time.Now().Add(visibility),
+			DeliveryToken: token,
+		})
+	}
+	if err == peel.ErrInvalidDeliveryToken || err == peel.ErrDeliveryTokenRequired {
+		return errInvalidReceiptHandle
+	} else if err != nil {
+		return err
+	} else if !ok {
+		return errNotInflight
+	}
+	return nil
+}
+
+type getQueueAttributesRequest struct {
+	QueueURL       string `json:"QueueUrl"`
+	AttributeNames []string
+}
+
+type getQueueAttributesResponse struct {
+	Attributes map[string]string
+}
+
+func (h handler) getQueueAttributes(r *http.Request, req getQueueAttributesRequest) (interface{}, error) {
+	queue, err := queueName(req.QueueURL)
+	if err != nil {
+		return nil, err
+	}
+
+	qsm, err := h.p.QStatus(r.Context(), peel.QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: {ConsumerGroup}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	qc, err := h.p.QGetConfig(r.Context(), peel.QGetConfigCommand{Queue: queue})
+	if err != nil {
+		return nil, err
+	}
+	qs := qsm[queue]
+	cgs := qs.ConsumerGroupStats[ConsumerGroup]
+	retention := DefaultRetention
+	if qc.DefaultTTL > 0 {
+		retention = qc.DefaultTTL
+	}
+
+	fmtUint := func(i uint64) string { return strconv.FormatUint(i, 10) }
+	all := map[string]string{
+		"ApproximateNumberOfMessages":           fmtUint(cgs.Available + cgs.Redo),
+		"ApproximateNumberOfMessagesNotVisible": fmtUint(cgs.InProgress),
+		"ApproximateNumberOfMessagesDelayed":    fmtUint(qs.Delayed),
+		"VisibilityTimeout":                     fmtUint(uint64(DefaultVisibilityTimeout / time.Second)),
+		"MessageRetentionPeriod":                fmtUint(uint64(retention / time.Second)),
+		"DelaySeconds":                          "0",
+		"ReceiveMessageWaitTimeSeconds":         "0",
+	}
+
+	// Like SQS, only the attributes asked for are returned, and ones which
+	// aren't known are ignored
+	ret := getQueueAttributesResponse{Attributes: map[string]string{}}
+	for _, name := range req.AttributeNames {
+		if name == "All" {
+			ret.Attributes = all
+			break
+		} else if v, ok := all[name]; ok {
+			ret.Attributes[name] = v
+		}
+	}
+	return ret, nil
+}
+
+type getQueueURLRequest struct {
+	QueueName string
+}
+
+type getQueueURLResponse struct {
+	QueueURL string `json:"QueueUrl"`
+}
+
+func (h handler) getQueueURL(r *http.Request, req getQueueURLRequest) (interface{}, error) {
+	if req.QueueName == "" {
+		return nil, sqsError{
+			status: http.StatusBadRequest,
+			code:   "MissingParameter",
+			msg:    "QueueName is required",
+		}
+	} else if strings.Contains(req.QueueName, "/") {
+		return nil, invalidParam("QueueName may not contain '/'")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return getQueueURLResponse{
+		QueueURL: scheme + "://" + r.Host + "/" + req.QueueName,
+	}, nil
+}
@@ -0,0 +1,209 @@
+package sqsapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer() *httptest.Server {
+	p := peel.NewWithBackend(core.NewMemBackend(), nil)
+	errCh := p.Run(nil)
+	go func() { panic(<-errCh) }()
+	return httptest.NewServer(New(p))
+}
+
+// do performs the action, the way an SDK using the JSON protocol would,
+// decoding the response body into into and returning the status code
+func do(t *T, srv *httptest.Server, action string, body, into interface{}) int {
+	bodyb, err := json.Marshal(body)
+	require.Nil(t, err)
+
+	r, err := http.NewRequest("POST", srv.URL+"/", bytes.NewReader(bodyb))
+	require.Nil(t, err)
+	r.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	r.Header.Set("X-Amz-Target", targetPrefix+action)
+	resp, err := http.DefaultClient.Do(r)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(into))
+	return resp.StatusCode
+}
+
+type errResp struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func TestSQS(t *T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	var urlResp getQueueURLResponse
+	queue := testutil.RandStr()
+	code := do(t, srv, "GetQueueUrl", map[string]interface{}{"QueueName": queue}, &urlResp)
+	require.Equal(t, 200, code)
+	queueURL := urlResp.QueueURL
+	assert.Equal(t, srv.URL+"/"+queue, queueURL)
+
+	body := testutil.RandStr()
+	var sendResp sendMessageResponse
+	code = do(t, srv, "SendMessage", map[string]interface{}{
+		"QueueUrl":    queueURL,
+		"MessageBody": body,
+	}, &sendResp)
+	require.Equal(t, 200, code)
+	assert.NotEmpty(t, sendResp.MessageID)
+	assert.Equal(t, md5Hex(body), sendResp.MD5OfMessageBody)
+
+	// A delayed message isn't received yet
+	code = do(t, srv, "SendMessage", map[string]interface{}{
+		"QueueUrl":     queueURL,
+		"MessageBody":  testutil.RandStr(),
+		"DelaySeconds": 60,
+	}, &sendResp)
+	require.Equal(t, 200, code)
+
+	receive := func(visibility int) receiveMessageResponse {
+		var resp receiveMessageResponse
+		code := do(t, srv, "ReceiveMessage", map[string]interface{}{
+			"QueueUrl":            queueURL,
+			"MaxNumberOfMessages": 10,
+			"VisibilityTimeout":   visibility,
+			"AttributeNames":      []string{"All"},
+		}, &resp)
+		require.Equal(t, 200, code)
+		return resp
+	}
+
+	recvResp := receive(60)
+	require.Len(t, recvResp.Messages, 1)
+	m := recvResp.Messages[0]
+	assert.Equal(t, body, m.Body)
+	assert.Equal(t, md5Hex(body), m.MD5OfBody)
+	assert.Equal(t, "1", m.Attributes["ApproximateReceiveCount"])
+	assert.Empty(t, receive(60).Messages)
+
+	var attrResp getQueueAttributesResponse
+	code = do(t, srv, "GetQueueAttributes", map[string]interface{}{
+		"QueueUrl": queueURL,
+		"AttributeNames": []string{
+			"ApproximateNumberOfMessages",
+			"ApproximateNumberOfMessagesNotVisible",
+			"ApproximateNumberOfMessagesDelayed",
+			"Policy",
+		},
+	}, &attrResp)
+	require.Equal(t, 200, code)
+	assert.Equal(t, map[string]string{
+		"ApproximateNumberOfMessages":           "0",
+		"ApproximateNumberOfMessagesNotVisible": "1",
+		"ApproximateNumberOfMessagesDelayed":    "1",
+	}, attrResp.Attributes)
+
+	// Setting the visibility timeout to 0 makes the message available again
+	// straight away, which makes the old receipt handle stale
+	var empty struct{}
+	code = do(t, srv, "ChangeMessageVisibility", map[string]interface{}{
+		"QueueUrl":          queueURL,
+		"ReceiptHandle":     m.ReceiptHandle,
+		"VisibilityTimeout": 0,
+	}, &empty)
+	require.Equal(t, 200, code)
+	recvResp = receive(1)
+	require.Len(t, recvResp.Messages, 1)
+	m2 := recvResp.Messages[0]
+	assert.Equal(t, m.MessageID, m2.MessageID)
+	assert.Equal(t, "2", m2.Attributes["ApproximateReceiveCount"])
+
+	// Deleting with the stale receipt handle isn't an error, but doesn't
+	// delete the message either
+	code = do(t, srv, "DeleteMessage", map[string]interface{}{
+		"QueueUrl":      queueURL,
+		"ReceiptHandle": m.ReceiptHandle,
+	}, &empty)
+	require.Equal(t, 200, code)
+
+	code = do(t, srv, "ChangeMessageVisibility", map[string]interface{}{
+		"QueueUrl":          queueURL,
+		"ReceiptHandle":     m2.ReceiptHandle,
+		"VisibilityTimeout": 60,
+	}, &empty)
+	require.Equal(t, 200, code)
+	time.Sleep(1500 * time.Millisecond)
+	assert.Empty(t, receive(60).Messages)
+
+	code = do(t, srv, "DeleteMessage", map[string]interface{}{
+		"QueueUrl":      queueURL,
+		"ReceiptHandle": m2.ReceiptHandle,
+	}, &empty)
+	require.Equal(t, 200, code)
+
+	// The message is done with, so its visibility can't be changed anymore
+	var er errResp
+	code = do(t, srv, "ChangeMessageVisibility", map[string]interface{}{
+		"QueueUrl":          queueURL,
+		"ReceiptHandle":     m2.ReceiptHandle,
+		"VisibilityTimeout": 60,
+	}, &er)
+	assert.Equal(t, 400, code)
+	assert.Equal(t, "com.amazonaws.sqs#MessageNotInflight", er.Type)
+}
+
+func TestSQSLongPoll(t *T) {
+	srv := newTestServer()
+	defer srv.Close()
+	queueURL := "https://sqs.us-east-1.amazonaws.com/123456789012/" + testutil.RandStr()
+
+	body := testutil.RandStr()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		var sendResp sendMessageResponse
+		do(t, srv, "SendMessage", map[string]interface{}{
+			"QueueUrl":    queueURL,
+			"MessageBody": body,
+		}, &sendResp)
+	}()
+
+	var recvResp receiveMessageResponse
+	code := do(t, srv, "ReceiveMessage", map[string]interface{}{
+		"QueueUrl":        queueURL,
+		"WaitTimeSeconds": 5,
+	}, &recvResp)
+	require.Equal(t, 200, code)
+	require.Len(t, recvResp.Messages, 1)
+	assert.Equal(t, body, recvResp.Messages[0].Body)
+	assert.Nil(t, recvResp.Messages[0].Attributes)
+}
+
+func TestSQSErrors(t *T) {
+	srv := newTestServer()
+	defer srv.Close()
+	queueURL := srv.URL + "/" + testutil.RandStr()
+
+	assertErr := func(action string, body interface{}, expectedCode int, expectedType string) {
+		var er errResp
+		code := do(t, srv, action, body, &er)
+		assert.Equal(t, expectedCode, code, "action:%s body:%v", action, body)
+		assert.Equal(t, "com.amazonaws.sqs#"+expectedType, er.Type, "action:%s body:%v", action, body)
+		assert.NotEmpty(t, er.Message)
+	}
+
+	assertErr("CreateQueue", map[string]interface{}{"QueueName": "foo"}, 400, "InvalidAction")
+	assertErr("SendMessage", map[string]interface{}{"MessageBody": "foo"}, 400, "MissingParameter")
+	assertErr("SendMessage", map[string]interface{}{"QueueUrl": queueURL, "DelaySeconds": 901}, 400, "InvalidParameterValue")
+	assertErr("ReceiveMessage", map[string]interface{}{"QueueUrl": queueURL, "MaxNumberOfMessages": 11}, 400, "InvalidParameterValue")
+	assertErr("ReceiveMessage", map[string]interface{}{"QueueUrl": queueURL, "VisibilityTimeout": 0}, 400, "InvalidParameterValue")
+	assertErr("DeleteMessage", map[string]interface{}{"QueueUrl": queueURL, "ReceiptHandle": "foo"}, 400, "ReceiptHandleIsInvalid")
+	assertErr("ChangeMessageVisibility", map[string]interface{}{"QueueUrl": queueURL, "ReceiptHandle": "1_2.foo"}, 400, "MissingParameter")
+}